@@ -87,14 +87,35 @@ var (
 		utils.GCModeFlag,
 		utils.LightServFlag,
 		utils.LightPeersFlag,
+		utils.LightRecentStatesFlag,
+		utils.LightSubnetRateFlag,
+		utils.LightDailyCapFlag,
+		utils.LightStopResumeFlag,
+		utils.LightStopAlternativesFlag,
+		utils.LightSLATargetFlag,
+		utils.LightSignedAnnounceFlag,
+		utils.LightAnnounceTrustFlag,
+		utils.LightDivergenceBlocksFlag,
+		utils.LightDivergenceTimeFlag,
+		utils.LightSignedResponsesFlag,
+		utils.LightULCServersFlag,
+		utils.LightULCFractionFlag,
+		utils.LightOdrCacheFlag,
 		utils.LightKDFFlag,
 		utils.CacheFlag,
 		utils.CacheDatabaseFlag,
 		utils.CacheGCFlag,
 		utils.TrieCacheGenFlag,
+		utils.TrieCacheSizeFlag,
+		utils.TrieCacheLimitFlag,
+		utils.SnapshotFlag,
+		utils.StatePrefetchFlag,
+		utils.AccountBloomFlag,
 		utils.ListenPortFlag,
 		utils.MaxPeersFlag,
 		utils.MaxPendingPeersFlag,
+		utils.ReservedSlotsFlag,
+		utils.MsgEventsFlag,
 		utils.MiningEnabledFlag,
 		utils.MinerThreadsFlag,
 		utils.MinerLegacyThreadsFlag,
@@ -111,7 +132,15 @@ var (
 		utils.NATFlag,
 		utils.NoDiscoverFlag,
 		utils.DiscoveryV5Flag,
+		utils.PassiveDiscoveryFlag,
 		utils.NetrestrictFlag,
+		utils.RelayServiceFlag,
+		utils.UseRelaysFlag,
+		utils.WSListenFlag,
+		utils.WSOriginsFlag,
+		utils.WSOriginPeersFlag,
+		utils.WSCertFlag,
+		utils.WSKeyFlag,
 		utils.NodeKeyFileFlag,
 		utils.NodeKeyHexFlag,
 		utils.DeveloperFlag,
@@ -126,6 +155,9 @@ var (
 		utils.MetricsEnabledFlag,
 		utils.FakePoWFlag,
 		utils.NoCompactionFlag,
+		utils.ChainAnalyticsFlag,
+		utils.ChainRecordFlag,
+		utils.ChainRecordIntervalFlag,
 		utils.GpoBlocksFlag,
 		utils.GpoPercentileFlag,
 		configFileFlag,
@@ -136,6 +168,7 @@ var (
 		utils.RPCListenAddrFlag,
 		utils.RPCPortFlag,
 		utils.RPCApiFlag,
+		utils.RPCStateFallbackFlag,
 		utils.WSEnabledFlag,
 		utils.WSListenAddrFlag,
 		utils.WSPortFlag,
@@ -80,6 +80,20 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.IdentityFlag,
 			utils.LightServFlag,
 			utils.LightPeersFlag,
+			utils.LightRecentStatesFlag,
+			utils.LightSubnetRateFlag,
+			utils.LightDailyCapFlag,
+			utils.LightStopResumeFlag,
+			utils.LightStopAlternativesFlag,
+			utils.LightSLATargetFlag,
+			utils.LightSignedAnnounceFlag,
+			utils.LightAnnounceTrustFlag,
+			utils.LightDivergenceBlocksFlag,
+			utils.LightDivergenceTimeFlag,
+			utils.LightSignedResponsesFlag,
+			utils.LightULCServersFlag,
+			utils.LightULCFractionFlag,
+			utils.LightOdrCacheFlag,
 			utils.LightKDFFlag,
 		},
 	},
@@ -134,6 +148,11 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.CacheDatabaseFlag,
 			utils.CacheGCFlag,
 			utils.TrieCacheGenFlag,
+			utils.TrieCacheSizeFlag,
+			utils.TrieCacheLimitFlag,
+			utils.SnapshotFlag,
+			utils.StatePrefetchFlag,
+			utils.AccountBloomFlag,
 		},
 	},
 	{
@@ -159,6 +178,7 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.IPCPathFlag,
 			utils.RPCCORSDomainFlag,
 			utils.RPCVirtualHostsFlag,
+			utils.RPCStateFallbackFlag,
 			utils.JSpathFlag,
 			utils.ExecFlag,
 			utils.PreloadJSFlag,
@@ -173,10 +193,20 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.ListenPortFlag,
 			utils.MaxPeersFlag,
 			utils.MaxPendingPeersFlag,
+			utils.ReservedSlotsFlag,
+			utils.MsgEventsFlag,
 			utils.NATFlag,
 			utils.NoDiscoverFlag,
 			utils.DiscoveryV5Flag,
+			utils.PassiveDiscoveryFlag,
 			utils.NetrestrictFlag,
+			utils.RelayServiceFlag,
+			utils.UseRelaysFlag,
+			utils.WSListenFlag,
+			utils.WSOriginsFlag,
+			utils.WSOriginPeersFlag,
+			utils.WSCertFlag,
+			utils.WSKeyFlag,
 			utils.NodeKeyFileFlag,
 			utils.NodeKeyHexFlag,
 		},
@@ -212,6 +242,9 @@ var AppHelpFlagGroups = []flagGroup{
 		Flags: append([]cli.Flag{
 			utils.FakePoWFlag,
 			utils.NoCompactionFlag,
+			utils.ChainAnalyticsFlag,
+			utils.ChainRecordFlag,
+			utils.ChainRecordIntervalFlag,
 		}, debug.Flags...),
 	},
 	{
@@ -178,6 +178,66 @@ var (
 		Usage: "Maximum number of LES client peers",
 		Value: eth.DefaultConfig.LightPeers,
 	}
+	LightRecentStatesFlag = cli.Uint64Flag{
+		Name:  "lightrecentstates",
+		Usage: "Number of recent block states kept resolvable for LES clients (light server only)",
+	}
+	LightSubnetRateFlag = cli.Uint64Flag{
+		Name:  "lightsubnetrate",
+		Usage: "Requests per second served to the LES clients of one IP subnet (light server only, 0 = unlimited)",
+	}
+	LightDailyCapFlag = cli.Uint64Flag{
+		Name:  "lightdailycap",
+		Usage: "Megabytes sent to one LES client in a rolling 24 hour window, after which it's disconnected (light server only, 0 = unlimited)",
+	}
+	LightStopResumeFlag = cli.DurationFlag{
+		Name:  "lightstopresume",
+		Usage: "Time after which the light server expects to be back, announced to the LES clients on shutdown (0 = unknown)",
+	}
+	LightStopAlternativesFlag = cli.StringFlag{
+		Name:  "lightstopalternatives",
+		Usage: "Comma separated enode URLs of the servers the LES clients are pointed to on shutdown",
+	}
+	LightSLATargetFlag = cli.DurationFlag{
+		Name:  "lightslatarget",
+		Usage: "Target latency of answering LES client requests, for the service level report (light server only)",
+		Value: 500 * time.Millisecond,
+	}
+	LightSignedAnnounceFlag = cli.BoolFlag{
+		Name:  "lightsignedannounce",
+		Usage: "Require signed block announcements from untrusted LES servers",
+	}
+	LightAnnounceTrustFlag = cli.Uint64Flag{
+		Name:  "lightannouncetrust",
+		Usage: "Valid signed announcements after which an untrusted LES server is asked for unsigned ones (0 = never)",
+		Value: eth.DefaultConfig.LightAnnounceTrust,
+	}
+	LightDivergenceBlocksFlag = cli.Uint64Flag{
+		Name:  "lightdivergenceblocks",
+		Usage: "Head spread of the LES servers in blocks reported as a divergence if it lasts (0 = default)",
+	}
+	LightDivergenceTimeFlag = cli.DurationFlag{
+		Name:  "lightdivergencetime",
+		Usage: "Time the head spread of the LES servers has to last to be reported as a divergence (0 = default)",
+	}
+	LightSignedResponsesFlag = cli.BoolFlag{
+		Name:  "lightsignedresponses",
+		Usage: "Ask the LES servers to sign their responses, keeping the invalid ones as evidence of misbehavior",
+	}
+	LightULCServersFlag = cli.StringFlag{
+		Name:  "lightulcservers",
+		Usage: "Comma separated enode URLs of the LES servers voting on the head, enables the ultra-light client mode",
+	}
+	LightULCFractionFlag = cli.IntFlag{
+		Name:  "lightulcfraction",
+		Usage: "Percentage of the ultra-light servers announcing a head needed to accept it",
+		Value: eth.DefaultConfig.LightULCFraction,
+	}
+	LightOdrCacheFlag = cli.IntFlag{
+		Name:  "lightodrcache",
+		Usage: "Megabytes of verified on-demand retrieved data kept across restarts (0 = untracked)",
+		Value: eth.DefaultConfig.LightOdrCache,
+	}
 	LightKDFFlag = cli.BoolFlag{
 		Name:  "lightkdf",
 		Usage: "Reduce key-derivation RAM & CPU usage at some expense of KDF strength",
@@ -307,6 +367,26 @@ var (
 		Usage: "Number of trie node generations to keep in memory",
 		Value: int(state.MaxTrieCacheGen),
 	}
+	TrieCacheSizeFlag = cli.IntFlag{
+		Name:  "trie-cache-size",
+		Usage: "Megabytes of account trie nodes to keep in memory, unloading the least recently used ones instead of old generations (0 = generations)",
+	}
+	TrieCacheLimitFlag = cli.IntFlag{
+		Name:  "trie-cache-limit",
+		Usage: "Megabytes of trie database memory at which the fewest trie node generations are kept, reducing them under memory pressure (0 = static)",
+	}
+	SnapshotFlag = cli.BoolFlag{
+		Name:  "snapshot",
+		Usage: "Maintain a flat snapshot of the head state to speed up state reads (experimental)",
+	}
+	StatePrefetchFlag = cli.BoolFlag{
+		Name:  "prefetch",
+		Usage: "Warm the state caches with the senders and recipients of the pooled transactions before block execution",
+	}
+	AccountBloomFlag = cli.IntFlag{
+		Name:  "accountbloom",
+		Usage: "Megabytes of the bloom filter of the existing accounts, skipping the trie lookups of missing ones (0 = disabled)",
+	}
 	// Miner settings
 	MiningEnabledFlag = cli.BoolFlag{
 		Name:  "mine",
@@ -398,6 +478,19 @@ var (
 		Name:  "nocompaction",
 		Usage: "Disables db compaction after import",
 	}
+	ChainAnalyticsFlag = cli.BoolFlag{
+		Name:  "analytics",
+		Usage: "Collect uncle rate, block propagation and reorg depth statistics",
+	}
+	ChainRecordFlag = cli.StringFlag{
+		Name:  "chainrecord",
+		Usage: "File to periodically append chain, state and peer statistics to (rotated when large)",
+	}
+	ChainRecordIntervalFlag = cli.DurationFlag{
+		Name:  "chainrecord.interval",
+		Usage: "Time interval between two chain statistics records",
+		Value: eth.DefaultConfig.ChainRecorder.Interval,
+	}
 	// RPC settings
 	RPCEnabledFlag = cli.BoolFlag{
 		Name:  "rpc",
@@ -428,6 +521,11 @@ var (
 		Usage: "API's offered over the HTTP-RPC interface",
 		Value: "",
 	}
+	RPCStateFallbackFlag = cli.IntFlag{
+		Name:  "rpcstatefallback",
+		Usage: "Number of blocks RPC calls may fall back to an older state if the requested one is pruned (0 = disabled)",
+		Value: 0,
+	}
 	IPCDisabledFlag = cli.BoolFlag{
 		Name:  "ipcdisable",
 		Usage: "Disable the IPC-RPC server",
@@ -480,6 +578,15 @@ var (
 		Usage: "Maximum number of pending connection attempts (defaults used if set to 0)",
 		Value: 0,
 	}
+	ReservedSlotsFlag = cli.StringFlag{
+		Name:  "reservedslots",
+		Usage: "Comma separated peer slots reserved per protocol (e.g. les=20,eth=10, light servers reserve --lightpeers for les by default)",
+		Value: "",
+	}
+	MsgEventsFlag = cli.BoolFlag{
+		Name:  "msgevents",
+		Usage: "Emit the sent and received p2p messages to the admin peer event subscriptions",
+	}
 	ListenPortFlag = cli.IntFlag{
 		Name:  "port",
 		Usage: "Network listening port",
@@ -521,10 +628,42 @@ var (
 		Name:  "v5disc",
 		Usage: "Enables the experimental RLPx V5 (Topic Discovery) mechanism",
 	}
+	PassiveDiscoveryFlag = cli.BoolFlag{
+		Name:  "passivedisc",
+		Usage: "Answers discovery pings but looks up nodes only on demand at a limited rate, without table maintenance (enables v4 discovery of light clients)",
+	}
 	NetrestrictFlag = cli.StringFlag{
 		Name:  "netrestrict",
 		Usage: "Restricts network communication to the given IP networks (CIDR masks)",
 	}
+	RelayServiceFlag = cli.BoolFlag{
+		Name:  "relayservice",
+		Usage: "Helps connected peers behind NAT to reach each other (hole punching and time limited relaying)",
+	}
+	UseRelaysFlag = cli.BoolFlag{
+		Name:  "userelays",
+		Usage: "Reaches peers through connected relay nodes if they can't be dialed directly",
+	}
+	WSListenFlag = cli.StringFlag{
+		Name:  "p2pws",
+		Usage: "Address accepting peer sessions over WebSocket, e.g. for in-browser light clients",
+	}
+	WSOriginsFlag = cli.StringFlag{
+		Name:  "p2pws.origins",
+		Usage: "Comma separated list of web page origins allowed to connect over WebSocket (* = all)",
+	}
+	WSOriginPeersFlag = cli.IntFlag{
+		Name:  "p2pws.originpeers",
+		Usage: "Maximum number of WebSocket peer connections per web page origin (0 = default)",
+	}
+	WSCertFlag = cli.StringFlag{
+		Name:  "p2pws.cert",
+		Usage: "TLS certificate file of the WebSocket peer listener (wss)",
+	}
+	WSKeyFlag = cli.StringFlag{
+		Name:  "p2pws.key",
+		Usage: "TLS key file of the WebSocket peer listener (wss)",
+	}
 
 	// ATM the url is left to the user and deployment to
 	JSpathFlag = cli.StringFlag{
@@ -768,6 +907,26 @@ func splitAndTrim(input string) []string {
 	return result
 }
 
+// parseReservedSlots parses the protocol=slots list of the reserved peer slots.
+func parseReservedSlots(input string) map[string]int {
+	slots := make(map[string]int)
+	for _, entry := range splitAndTrim(input) {
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			Fatalf("Option %s: invalid entry %q, want protocol=slots", ReservedSlotsFlag.Name, entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 0 {
+			Fatalf("Option %s: invalid slot count in %q", ReservedSlotsFlag.Name, entry)
+		}
+		slots[strings.TrimSpace(parts[0])] = n
+	}
+	return slots
+}
+
 // setHTTP creates the HTTP RPC listener interface string from the set
 // command line flags, returning empty if the HTTP endpoint is disabled.
 func setHTTP(ctx *cli.Context, cfg *node.Config) {
@@ -976,12 +1135,30 @@ func SetP2PConfig(ctx *cli.Context, cfg *p2p.Config) {
 	}
 	log.Info("Maximum peer count", "ETH", ethPeers, "LES", lightPeers, "total", cfg.MaxPeers)
 
+	// 按协议 预留 peer 名额, light server 默认为 les client 预留 lightpeers 个
+	// Name: "reservedslots"
+	if ctx.GlobalIsSet(ReservedSlotsFlag.Name) {
+		cfg.ReservedSlots = parseReservedSlots(ctx.GlobalString(ReservedSlotsFlag.Name))
+	} else if lightServer && lightPeers > 0 {
+		cfg.ReservedSlots = map[string]int{"les": lightPeers}
+	}
+
+	// Name: "msgevents"
+	if ctx.GlobalBool(MsgEventsFlag.Name) {
+		cfg.EnableMsgEvents = true
+	}
+
 	// Name: "maxpendpeers"
 	if ctx.GlobalIsSet(MaxPendingPeersFlag.Name) {
 		cfg.MaxPendingPeers = ctx.GlobalInt(MaxPendingPeersFlag.Name)
 	}
+	// Name: "passivedisc"
+	// 被动的节点发现 对 light client 也保留 v4 发现
+	passiveDiscovery := ctx.GlobalBool(PassiveDiscoveryFlag.Name)
+	cfg.DiscoveryPassive = passiveDiscovery
+
 	// Name: "nodiscover"
-	if ctx.GlobalIsSet(NoDiscoverFlag.Name) || lightClient {
+	if ctx.GlobalIsSet(NoDiscoverFlag.Name) || (lightClient && !passiveDiscovery) {
 		cfg.NoDiscovery = true
 	}
 
@@ -1007,6 +1184,36 @@ func SetP2PConfig(ctx *cli.Context, cfg *p2p.Config) {
 		cfg.NetRestrict = list
 	}
 
+	// Name: "relayservice"
+	if ctx.GlobalIsSet(RelayServiceFlag.Name) {
+		cfg.RelayService = ctx.GlobalBool(RelayServiceFlag.Name)
+	}
+	// Name: "userelays"
+	if ctx.GlobalIsSet(UseRelaysFlag.Name) {
+		cfg.UseRelays = ctx.GlobalBool(UseRelaysFlag.Name)
+	}
+
+	// 浏览器中的 light client 通过 WebSocket 连接
+	// Name: "p2pws"
+	if ctx.GlobalIsSet(WSListenFlag.Name) {
+		cfg.WSListenAddr = ctx.GlobalString(WSListenFlag.Name)
+	}
+	// Name: "p2pws.origins"
+	if ctx.GlobalIsSet(WSOriginsFlag.Name) {
+		cfg.WSOrigins = splitAndTrim(ctx.GlobalString(WSOriginsFlag.Name))
+	}
+	// Name: "p2pws.originpeers"
+	if ctx.GlobalIsSet(WSOriginPeersFlag.Name) {
+		cfg.WSOriginPeers = ctx.GlobalInt(WSOriginPeersFlag.Name)
+	}
+	// Name: "p2pws.cert", "p2pws.key"
+	if ctx.GlobalIsSet(WSCertFlag.Name) {
+		cfg.WSCertFile = ctx.GlobalString(WSCertFlag.Name)
+	}
+	if ctx.GlobalIsSet(WSKeyFlag.Name) {
+		cfg.WSKeyFile = ctx.GlobalString(WSKeyFlag.Name)
+	}
+
 	// Name: "dev"
 	if ctx.GlobalBool(DeveloperFlag.Name) {
 		// --dev mode can't use p2p networking.
@@ -1231,6 +1438,71 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	if ctx.GlobalIsSet(LightPeersFlag.Name) {
 		cfg.LightPeers = ctx.GlobalInt(LightPeersFlag.Name)
 	}
+	// Name: "lightrecentstates"
+	if ctx.GlobalIsSet(LightRecentStatesFlag.Name) {
+		cfg.LightRecentStates = ctx.GlobalUint64(LightRecentStatesFlag.Name)
+	}
+	// 按 IP 子网 限制 LES client 的 req 速率
+	// Name: "lightsubnetrate"
+	if ctx.GlobalIsSet(LightSubnetRateFlag.Name) {
+		cfg.LightSubnetRate = ctx.GlobalUint64(LightSubnetRateFlag.Name)
+	}
+	// 每个 client 每 24 小时 (滚动窗口) 最多发送的字节数 (MB)
+	// Name: "lightdailycap"
+	if ctx.GlobalIsSet(LightDailyCapFlag.Name) {
+		cfg.LightDailyCap = ctx.GlobalUint64(LightDailyCapFlag.Name)
+	}
+	// server 停止时 通知 client 的 预计恢复时间 及 替代 server
+	// Name: "lightstopresume"
+	if ctx.GlobalIsSet(LightStopResumeFlag.Name) {
+		cfg.LightStopResume = ctx.GlobalDuration(LightStopResumeFlag.Name)
+	}
+	// Name: "lightstopalternatives"
+	if ctx.GlobalIsSet(LightStopAlternativesFlag.Name) {
+		cfg.LightStopAlternatives = strings.Split(ctx.GlobalString(LightStopAlternativesFlag.Name), ",")
+	}
+	// Name: "lightslatarget"
+	if ctx.GlobalIsSet(LightSLATargetFlag.Name) {
+		cfg.LightSLATarget = ctx.GlobalDuration(LightSLATargetFlag.Name)
+	}
+	// 要求 不可信的 server 对广播的 header 进行签名
+	// Name: "lightsignedannounce"
+	if ctx.GlobalIsSet(LightSignedAnnounceFlag.Name) {
+		cfg.LightSignedAnnounce = ctx.GlobalBool(LightSignedAnnounceFlag.Name)
+	}
+	// 有效签名 announce 的历史足够长的 server, 下次连接时只要求 simple announce
+	// Name: "lightannouncetrust"
+	if ctx.GlobalIsSet(LightAnnounceTrustFlag.Name) {
+		cfg.LightAnnounceTrust = ctx.GlobalUint64(LightAnnounceTrustFlag.Name)
+	}
+	// 各 server 的 head 相差超过 多少个块 并持续 多久 时 视为分歧 (可能是 eclipse 攻击 或 落后的 server)
+	// Name: "lightdivergenceblocks"
+	if ctx.GlobalIsSet(LightDivergenceBlocksFlag.Name) {
+		cfg.LightDivergenceBlocks = ctx.GlobalUint64(LightDivergenceBlocksFlag.Name)
+	}
+	// Name: "lightdivergencetime"
+	if ctx.GlobalIsSet(LightDivergenceTimeFlag.Name) {
+		cfg.LightDivergenceTime = ctx.GlobalDuration(LightDivergenceTimeFlag.Name)
+	}
+	// 要求 server 对 resp 签名, 无效的 resp 作为证据保留
+	// Name: "lightsignedresponses"
+	if ctx.GlobalIsSet(LightSignedResponsesFlag.Name) {
+		cfg.LightSignedResponses = ctx.GlobalBool(LightSignedResponsesFlag.Name)
+	}
+	// 超轻节点模式: 计票的 server 列表, 及接受 head 所需的 同意比例 (%)
+	// Name: "lightulcservers"
+	if ctx.GlobalIsSet(LightULCServersFlag.Name) {
+		cfg.LightULCServers = strings.Split(ctx.GlobalString(LightULCServersFlag.Name), ",")
+	}
+	// Name: "lightulcfraction"
+	if ctx.GlobalIsSet(LightULCFractionFlag.Name) {
+		cfg.LightULCFraction = ctx.GlobalInt(LightULCFractionFlag.Name)
+	}
+	// 跨重启 持久化 的 已校验 ODR 结果 的大小上限 (MB)
+	// Name: "lightodrcache"
+	if ctx.GlobalIsSet(LightOdrCacheFlag.Name) {
+		cfg.LightOdrCache = ctx.GlobalInt(LightOdrCacheFlag.Name)
+	}
 	// 设置 网络ID
 	// Name: "networkid"
 	if ctx.GlobalIsSet(NetworkIdFlag.Name) {
@@ -1305,6 +1577,22 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 		// TODO(fjl): force-enable this in --dev mode
 		cfg.EnablePreimageRecording = ctx.GlobalBool(VMEnableDebugFlag.Name)
 	}
+	// Name: "analytics"
+	if ctx.GlobalIsSet(ChainAnalyticsFlag.Name) {
+		cfg.ChainAnalytics = ctx.GlobalBool(ChainAnalyticsFlag.Name)
+	}
+	// Name: "chainrecord"
+	if ctx.GlobalIsSet(ChainRecordFlag.Name) {
+		cfg.ChainRecorder.Path = ctx.GlobalString(ChainRecordFlag.Name)
+	}
+	// Name: "chainrecord.interval"
+	if ctx.GlobalIsSet(ChainRecordIntervalFlag.Name) {
+		cfg.ChainRecorder.Interval = ctx.GlobalDuration(ChainRecordIntervalFlag.Name)
+	}
+	// Name: "rpcstatefallback"
+	if ctx.GlobalIsSet(RPCStateFallbackFlag.Name) {
+		cfg.RPCStateFallback = ctx.GlobalInt(RPCStateFallbackFlag.Name)
+	}
 
 	// Override any default configs for hard coded networks.
 	switch {
@@ -1360,11 +1648,34 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 			cfg.MinerGasPrice = big.NewInt(1)
 		}
 	}
-	// TODO(fjl): move trie cache generations into config
 	// Name: "trie-cache-gens"
 	if gen := ctx.GlobalInt(TrieCacheGenFlag.Name); gen > 0 {
-		// 最大的 Trie 缓存 ？？
-		state.MaxTrieCacheGen = uint16(gen)
+		// 内存中保留的 Trie node 的代数
+		cfg.TrieCacheGen = uint16(gen)
+	}
+	// Name: "trie-cache-size"
+	if size := ctx.GlobalInt(TrieCacheSizeFlag.Name); size > 0 {
+		// 内存中保留的 Trie node 的字节预算 (MB), 代替 代数
+		cfg.TrieCacheSize = size
+	}
+	// Name: "trie-cache-limit"
+	if limit := ctx.GlobalInt(TrieCacheLimitFlag.Name); limit > 0 {
+		// trie.Database 内存 达到该值 (MB) 时 只保留最少的代数
+		cfg.TrieCacheLimit = limit
+	}
+	// Name: "snapshot"
+	if ctx.GlobalIsSet(SnapshotFlag.Name) {
+		cfg.StateSnapshot = ctx.GlobalBool(SnapshotFlag.Name)
+	}
+	// Name: "accountbloom"
+	if size := ctx.GlobalInt(AccountBloomFlag.Name); size > 0 {
+		// 已存在账户的 bloom 过滤器大小 (MB)
+		cfg.StateAccountBloom = size
+	}
+	// Name: "prefetch"
+	if ctx.GlobalIsSet(StatePrefetchFlag.Name) {
+		// 根据 txpool 中的交易 预先加载 state
+		cfg.StatePrefetch = ctx.GlobalBool(StatePrefetchFlag.Name)
 	}
 }
 
@@ -1556,6 +1867,19 @@ func MakeChain(ctx *cli.Context, stack *node.Node) (chain *core.BlockChain, chai
 		TrieNodeLimit: eth.DefaultConfig.TrieCache,
 		TrieTimeLimit: eth.DefaultConfig.TrieTimeout,
 	}
+	if gen := ctx.GlobalInt(TrieCacheGenFlag.Name); gen > 0 {
+		cache.State.TrieCacheGen = uint16(gen)
+	}
+	if size := ctx.GlobalInt(TrieCacheSizeFlag.Name); size > 0 {
+		cache.State.TrieCacheSize = uint64(size) * 1024 * 1024
+	}
+	if limit := ctx.GlobalInt(TrieCacheLimitFlag.Name); limit > 0 {
+		cache.State.TrieCacheLimit = uint64(limit) * 1024 * 1024
+	}
+	cache.Snapshot = ctx.GlobalBool(SnapshotFlag.Name)
+	if size := ctx.GlobalInt(AccountBloomFlag.Name); size > 0 {
+		cache.AccountBloom = uint64(size) * 1024 * 1024
+	}
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheGCFlag.Name) {
 		cache.TrieNodeLimit = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheGCFlag.Name) / 100
 	}
@@ -43,7 +43,6 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
 	"github.com/hashicorp/golang-lru"
-	"gopkg.in/karalabe/cookiejar.v2/collections/prque"
 )
 
 var (
@@ -70,6 +69,16 @@ type CacheConfig struct {
 	Disabled      bool          // Whether to disable trie write caching (archive node)
 	TrieNodeLimit int           // Memory limit (MB) at which to flush the current in-memory trie to disk
 	TrieTimeLimit time.Duration // Time limit after which to flush the current in-memory trie to disk
+	State         state.Config  // Cache sizes of the state database
+
+	// RecentStates is the number of recent block states guaranteed to stay
+	// resolvable, e.g. sized for the serving window of a light server. Values
+	// below the default retention of in-memory tries are ignored.
+	RecentStates uint64
+
+	Snapshot bool // Whether to maintain a flat snapshot of the head state for faster reads
+
+	AccountBloom uint64 // Bytes of the bloom filter of the existing accounts, zero to disable
 }
 
 // BlockChain represents the canonical chain given a database with a genesis
@@ -94,9 +103,8 @@ type BlockChain struct {
 	cacheConfig *CacheConfig        // Cache configuration for pruning
 
 	db     ethdb.Database // Low level persistent database to store final content in
-	// 优先级队列映射块编号以尝试gc
-	// 详细请参照：https://godoc.org/gopkg.in/karalabe/cookiejar.v2/collections/prque
-	triegc *prque.Prque   // Priority queue mapping block numbers to tries to gc
+	// 基于引用计数的 state trie 裁剪, 保留最近 triesInMemory 个块的 state
+	pruner *state.Pruner  // Reference counting garbage collector of the recent tries
 
 	// 做 gc处理的时长计数 (主要针对 trie )
 	gcproc time.Duration  // Accumulates canonical block processing for trie dumping
@@ -110,6 +118,7 @@ type BlockChain struct {
 	chainSideFeed event.Feed
 	chainHeadFeed event.Feed
 	logsFeed      event.Feed
+	reorgFeed     event.Feed
 
 	/** 各种订阅 详情 */
 	scope         event.SubscriptionScope
@@ -129,6 +138,9 @@ type BlockChain struct {
 
 	/** 对 db 的一个封装，给state 用的， 底层的引用了 chain的 db 实例 */
 	stateCache   state.Database // State database to reuse between imports (contains state cache)
+	snaps        *state.Snapshot // Flat snapshot of the head state, nil if disabled
+	accountBloom *state.AccountBloom // Filter of the accounts of the head state, nil if disabled
+	stateRange   atomic.Value        // Cached result of the state availability probe (*StateRange)
 
 	/** 各种 lru 缓存 */
 	bodyCache    *lru.Cache     // Cache for the most recent block bodies
@@ -160,6 +172,15 @@ type BlockChain struct {
 	badBlocks *lru.Cache // Bad block cache
 }
 
+// stateConfig returns the config of the state database of a chain: the given
+// cache sizes and backend, with the trie commitment of the chain.
+func stateConfig(config state.Config, chainConfig *params.ChainConfig) state.Config {
+	if chainConfig != nil {
+		config.Commitment = trie.CommitmentVersion(chainConfig.TrieCommitment)
+	}
+	return config
+}
+
 // NewBlockChain returns a fully initialised block chain using information
 // available in the database. It initialises the default Ethereum Validator and
 // Processor.
@@ -184,6 +205,14 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	futureBlocks, _ := lru.New(maxFutureBlocks) // 256
 	badBlocks, _ := lru.New(badBlockLimit) // 10
 
+	// 按配置的 backend 名字 创建 state.Database (状态树的 叶子格式 由 chain config 决定)
+	if err := state.CheckChainBackend(cacheConfig.State.Backend); err != nil {
+		return nil, err
+	}
+	stateCache, err := state.OpenDatabase(db, stateConfig(cacheConfig.State, chainConfig))
+	if err != nil {
+		return nil, err
+	}
 	/**  */
 	bc := &BlockChain{
 		// 链配置
@@ -192,10 +221,8 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		cacheConfig:  cacheConfig,
 		// db 实例
 		db:           db,
-		// 创建一个优先级队列
-		triegc:       prque.New(),
 		// 构建一个 db 的封装
-		stateCache:   state.NewDatabase(db),
+		stateCache:   stateCache,
 		// 一个接收退出信号的 chan
 		quit:         make(chan struct{}),
 		/** 各种缓存 */
@@ -207,13 +234,25 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		vmConfig:     vmConfig, // vm 配置
 		badBlocks:    badBlocks, // 缓存 bad block 的 (10个)
 	}
+	retention := uint64(triesInMemory)
+	if cacheConfig.RecentStates > retention {
+		retention = cacheConfig.RecentStates
+	}
+	bc.pruner = state.NewPruner(bc.stateCache, retention)
+	if cacheConfig.Snapshot {
+		bc.snaps = state.NewSnapshot(db, bc.stateCache.TrieDB())
+		state.SetSnapshot(bc.stateCache, bc.snaps)
+	}
+	if cacheConfig.AccountBloom > 0 {
+		bc.accountBloom = state.NewAccountBloom(bc.stateCache.TrieDB(), cacheConfig.AccountBloom)
+		state.SetAccountBloom(bc.stateCache, bc.accountBloom)
+	}
 
 	/** 创建一个 chain 的校验器 */
 	bc.SetValidator(NewBlockValidator(chainConfig, bc, engine))
 	/** 创建一个 chain 的处理器 */
 	bc.SetProcessor(NewStateProcessor(chainConfig, bc, engine))
 
-	var err error
 	/** 创建一个 由 head 组成的 chain */
 	bc.hc, err = NewHeaderChain(db, chainConfig, engine, bc.getProcInterrupt)
 	if err != nil {
@@ -230,6 +269,14 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	if err := bc.loadLastState(); err != nil {
 		return nil, err
 	}
+	// 让 snapshot 跟随 head state, root 不一致时在后台重新生成
+	if bc.snaps != nil {
+		bc.snaps.Rebuild(bc.CurrentBlock().Root())
+	}
+	// 让 account bloom 覆盖 head state, 未覆盖时在后台重新生成
+	if bc.accountBloom != nil {
+		bc.accountBloom.Rebuild(bc.CurrentBlock().Root())
+	}
 	// Check the current state of the block hashes and make sure that we do not have any of the bad blocks in our chain
 	// 检查块哈希的当前状态，并确保我们的链中没有任何坏块
 	for hash := range BadHashes {
@@ -447,6 +494,44 @@ func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
 	return state.New(root, bc.stateCache)
 }
 
+// BatchReaderAt returns a reader resolving many accounts and storage slots of
+// the state with the given root in one pass.
+func (bc *BlockChain) BatchReaderAt(root common.Hash) (*state.BatchReader, error) {
+	return state.NewBatchReader(root, bc.stateCache)
+}
+
+// StateAtNearest returns a new mutable state based on the given header. If that
+// state is not available (e.g. pruned), the nearest available state of the at
+// most maxDepthBack preceding blocks is returned along with the header it
+// belongs to.
+func (bc *BlockChain) StateAtNearest(header *types.Header, maxDepthBack int) (*state.StateDB, *types.Header, error) {
+	headers := []*types.Header{header}
+	history := func(back int) (common.Hash, bool) {
+		for len(headers) <= back {
+			last := headers[len(headers)-1]
+			if last.Number.Sign() == 0 {
+				return common.Hash{}, false
+			}
+			parent := bc.GetHeader(last.ParentHash, last.Number.Uint64()-1)
+			if parent == nil {
+				return common.Hash{}, false
+			}
+			headers = append(headers, parent)
+		}
+		return headers[back].Root, true
+	}
+	statedb, _, back, err := state.NewNearest(bc.stateCache, header.Root, maxDepthBack, history)
+	if err != nil {
+		return nil, nil, err
+	}
+	return statedb, headers[back], nil
+}
+
+// StateCache returns the caching database underpinning the blockchain instance.
+func (bc *BlockChain) StateCache() state.Database {
+	return bc.stateCache
+}
+
 // Reset purges the entire blockchain, restoring it to its genesis state.
 func (bc *BlockChain) Reset() error {
 	return bc.ResetWithGenesisBlock(bc.genesisBlock)
@@ -541,7 +626,7 @@ func (bc *BlockChain) insert(block *types.Block) {
 
 	// Add the block to the canonical chain number scheme and mark as the head
 	// todo 这里我们可以看出来 server 端在 insertchain 时 一起写入了 CanonicalHash
-	rawdb.WriteCanonicalHash(bc.db, block.Hash(), block.NumberU64())
+	bc.hc.WriteCanonicalHash(block.Hash(), block.NumberU64())
 	rawdb.WriteHeadBlockHash(bc.db, block.Hash())
 
 	bc.currentBlock.Store(block)
@@ -724,6 +809,12 @@ func (bc *BlockChain) Stop() {
 	atomic.StoreInt32(&bc.procInterrupt, 1)
 
 	bc.wg.Wait()
+	if bc.snaps != nil {
+		bc.snaps.Stop()
+	}
+	if bc.accountBloom != nil {
+		bc.accountBloom.Stop()
+	}
 
 	// Ensure the state of a recent block is also stored to disk before exiting.
 	// We're writing three different states to catch different restart scenarios:
@@ -747,10 +838,8 @@ func (bc *BlockChain) Stop() {
 				}
 			}
 		}
-		for !bc.triegc.Empty() {
-			fmt.Println("节点退出时，把triegc 队列中的 root 引用全部释放掉 ...")
-			triedb.Dereference(bc.triegc.PopItem().(common.Hash))
-		}
+		fmt.Println("节点退出时，把 pruner 中的 root 引用全部释放掉 ...")
+		bc.pruner.Release()
 		if size, _ := triedb.Size(); size != 0 {
 			log.Error("Dangling trie nodes after full cleanup")
 		}
@@ -758,6 +847,15 @@ func (bc *BlockChain) Stop() {
 	log.Info("Blockchain manager stopped")
 }
 
+// RecentStates returns the number of recent block states which are guaranteed
+// to be resolvable, or zero if all the states are kept (archive node).
+func (bc *BlockChain) RecentStates() uint64 {
+	if bc.cacheConfig.Disabled {
+		return 0
+	}
+	return bc.pruner.Retention()
+}
+
 // 处理 未来区块 (处理没有连续但过早接收到的块高靠后的区块)
 func (bc *BlockChain) procFutureBlocks() {
 	// 收集所有 未来快的临时切片
@@ -1014,13 +1112,9 @@ func (bc *BlockChain) WriteBlockWithState(block *types.Block, receipts []*types.
 		// Full but not archive node, do proper garbage collection
 		// 如果是全节点，但不是归档节点，则会做适当的 gc
 
-		// 元数据引用以保持trie活着
-		triedb.Reference(root, common.Hash{}) // metadata reference to keep trie alive
-		// 将具有给定优先级的值推送到队列中，必要时根据里头的值去做 gc 操作
-		// 第一个入参为加进来的数据， 第二个入参为 当前数据的优先级
-		// (用负数的做法是：block越靠后的优先级越低)
-		bc.triegc.Push(root, -float32(block.NumberU64()))
-		fmt.Println("写入链时，triegc push", "root", root.String(), "priority", -float32(block.NumberU64()))
+		// 元数据引用以保持trie活着, 直到该块离开保留窗口
+		bc.pruner.Reference(root, block.NumberU64())
+		fmt.Println("写入链时，pruner reference", "root", root.String(), "number", block.NumberU64())
 
 		/** 如果当前 块高 大于 128 */
 		if current := block.NumberU64(); current > triesInMemory {
@@ -1071,23 +1165,9 @@ func (bc *BlockChain) WriteBlockWithState(block *types.Block, receipts []*types.
 			}
 			// Garbage collect anything below our required write retention
 			// gc 低于我们所需写入的该块的其他内容。
-			// 即：把之前存在 triegc 队列中的root引用，取消掉
-			for !bc.triegc.Empty() {
-				root, number := bc.triegc.Pop()
-
-				fmt.Println("写入链时，非归档，之前存进去的块高:", uint64(-number), "之前存进去的 root", root.(common.Hash).String(), "当前块往前128的目标块高", chosen)
-
-				// 在最上面使用 -块高 作为 优先级存进来的
-				// 现在需要还原成正数 来和该块高对比
-				// 只要是块高在该块之后的 块的root都继续保留
-				if uint64(-number) > chosen {
-					fmt.Println("写入链时，停止 for Dereference ...")
-					bc.triegc.Push(root, number)
-					break
-				}
-				//根据 triegc 队列中的获取的root去删除掉 db.nodes 中的trie 的各个node信息
-				triedb.Dereference(root.(common.Hash))
-			}
+			// 即：把之前 Reference 的、块高不大于 chosen 的 root 引用取消掉,
+			// 删除掉 db.nodes 中只被这些 trie 引用的 node
+			bc.pruner.Prune(current)
 		}
 	}
 
@@ -1126,6 +1206,15 @@ func (bc *BlockChain) WriteBlockWithState(block *types.Block, receipts []*types.
 	// Set new head.
 	if status == CanonStatTy {
 		bc.insert(block)
+
+		// Move the snapshot to the new head by applying the diffs of the commits
+		// leading to it, rolling back the abandoned blocks on reorgs
+		if bc.snaps != nil {
+			bc.snaps.Follow(block.Root())
+		}
+		if bc.accountBloom != nil {
+			bc.accountBloom.Rebuild(block.Root())
+		}
 	}
 	bc.futureBlocks.Remove(block.Hash())
 	return status, nil
@@ -1577,6 +1666,9 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 			}
 		}()
 	}
+	if len(oldChain) > 0 && len(newChain) > 0 {
+		go bc.reorgFeed.Send(ChainReorgEvent{Common: commonBlock, Dropped: len(oldChain), Added: len(newChain)})
+	}
 
 	return nil
 }
@@ -1801,6 +1893,11 @@ func (bc *BlockChain) SubscribeChainSideEvent(ch chan<- ChainSideEvent) event.Su
 	return bc.scope.Track(bc.chainSideFeed.Subscribe(ch))
 }
 
+// SubscribeChainReorgEvent registers a subscription of ChainReorgEvent.
+func (bc *BlockChain) SubscribeChainReorgEvent(ch chan<- ChainReorgEvent) event.Subscription {
+	return bc.scope.Track(bc.reorgFeed.Subscribe(ch))
+}
+
 // SubscribeLogsEvent registers a subscription of []*types.Log.
 func (bc *BlockChain) SubscribeLogsEvent(ch chan<- []*types.Log) event.Subscription {
 	return bc.scope.Track(bc.logsFeed.Subscribe(ch))
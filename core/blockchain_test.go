@@ -1483,3 +1483,54 @@ func BenchmarkBlockChain_1x1000Executions(b *testing.B) {
 
 	benchmarkLargeNumberOfValueToNonexisting(b, numTxs, numBlocks, recipientFn, dataFn)
 }
+
+// Tests that the nearest available state is opened if the state of a block has
+// been pruned, returned with the header of the block it belongs to.
+func TestStateAtNearest(t *testing.T) {
+	engine := ethash.NewFaker()
+
+	db := ethdb.NewMemDatabase()
+	genesis := new(Genesis).MustCommit(db)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 3, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
+
+	diskdb := ethdb.NewMemDatabase()
+	new(Genesis).MustCommit(diskdb)
+
+	chain, err := NewBlockChain(diskdb, &CacheConfig{Disabled: true}, params.TestChainConfig, engine, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	chain.Stop()
+
+	// Prune the state of the second block and reopen the chain without the
+	// cached tries
+	diskdb.Delete(blocks[1].Root().Bytes())
+	chain, err = NewBlockChain(diskdb, &CacheConfig{Disabled: true}, params.TestChainConfig, engine, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to reopen tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	statedb, header, err := chain.StateAtNearest(blocks[1].Header(), 1)
+	if err != nil {
+		t.Fatalf("failed to open nearest state: %v", err)
+	}
+	if header.Hash() != blocks[0].Hash() {
+		t.Errorf("header mismatch: have #%d, want #%d", header.Number, blocks[0].Number())
+	}
+	if root := statedb.IntermediateRoot(false); root != blocks[0].Root() {
+		t.Errorf("state root mismatch: have %x, want %x", root, blocks[0].Root())
+	}
+	// Available states are returned with their own header
+	if _, header, err := chain.StateAtNearest(blocks[2].Header(), 1); err != nil {
+		t.Errorf("failed to open available state: %v", err)
+	} else if header.Hash() != blocks[2].Hash() {
+		t.Errorf("available state header mismatch: have #%d, want #%d", header.Number, blocks[2].Number())
+	}
+	if _, _, err := chain.StateAtNearest(blocks[1].Header(), 0); err == nil {
+		t.Error("pruned state opened without fallback")
+	}
+}
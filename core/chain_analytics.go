@@ -0,0 +1,208 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+var (
+	analyticsBlockMeter       = metrics.NewRegisteredMeter("chain/analytics/blocks", nil)
+	analyticsUncleMeter       = metrics.NewRegisteredMeter("chain/analytics/uncles", nil)
+	analyticsSideMeter        = metrics.NewRegisteredMeter("chain/analytics/sideblocks", nil)
+	analyticsPropagationTimer = metrics.NewRegisteredTimer("chain/analytics/propagation", nil)
+	analyticsReorgHistogram   = metrics.NewRegisteredHistogram("chain/analytics/reorgdepth", nil, metrics.NewExpDecaySample(1028, 0.015))
+)
+
+// maxTrackedAnnounces is the number of announced but not yet imported blocks
+// remembered for propagation delay estimation.
+const maxTrackedAnnounces = 4096
+
+// ChainAnalytics is an optional service recording uncle rates, block propagation
+// delays and the depth distribution of chain reorganisations. The figures are
+// exported as metrics and can be queried through ChainAnalytics.Stats.
+//
+// Propagation delay is measured from the first announcement of a block (reported
+// by the protocol handlers through NoteAnnounce) until its import. For blocks never
+// announced (e.g. fetched by the downloader) the block timestamp is used instead,
+// which makes the estimate include the miner's clock skew.
+//
+/**
+ChainAnalytics:
+可选的链统计服务, 统计 uncle 比例, block 的传播延迟 (announce 到 import 的时间) 以及 reorg 深度分布
+ */
+type ChainAnalytics struct {
+	chain *BlockChain
+
+	lock        sync.Mutex
+	announced   map[common.Hash]mclock.AbsTime // first announcement time of pending blocks
+	blocks      uint64                         // canonical blocks imported
+	uncles      uint64                         // uncles referenced by imported blocks
+	sideBlocks  uint64                         // blocks ending up on a side chain
+	propSum     time.Duration                  // sum of the measured propagation delays
+	propCount   uint64                         // number of propagation samples
+	propMax     time.Duration                  // largest propagation delay seen
+	reorgDepths map[int]uint64                 // number of reorgs by dropped block count
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// ChainAnalyticsStats is a snapshot of the collected chain statistics.
+type ChainAnalyticsStats struct {
+	Blocks          uint64         `json:"blocks"`
+	Uncles          uint64         `json:"uncles"`
+	SideBlocks      uint64         `json:"sideBlocks"`
+	UncleRate       float64        `json:"uncleRate"`
+	PropagationMean time.Duration  `json:"propagationMean"`
+	PropagationMax  time.Duration  `json:"propagationMax"`
+	ReorgDepths     map[int]uint64 `json:"reorgDepths"`
+}
+
+// NewChainAnalytics creates a chain analytics service on top of the given chain.
+func NewChainAnalytics(chain *BlockChain) *ChainAnalytics {
+	return &ChainAnalytics{
+		chain:       chain,
+		announced:   make(map[common.Hash]mclock.AbsTime),
+		reorgDepths: make(map[int]uint64),
+		quit:        make(chan struct{}),
+	}
+}
+
+// Start subscribes to the chain events and starts collecting statistics.
+func (a *ChainAnalytics) Start() {
+	var (
+		chainCh = make(chan ChainEvent, 16)
+		sideCh  = make(chan ChainSideEvent, 16)
+		reorgCh = make(chan ChainReorgEvent, 16)
+		subs    = []event.Subscription{
+			a.chain.SubscribeChainEvent(chainCh),
+			a.chain.SubscribeChainSideEvent(sideCh),
+			a.chain.SubscribeChainReorgEvent(reorgCh),
+		}
+	)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer func() {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+		}()
+		for {
+			select {
+			case ev := <-chainCh:
+				a.blockImported(ev)
+			case <-sideCh:
+				a.lock.Lock()
+				a.sideBlocks++
+				a.lock.Unlock()
+				analyticsSideMeter.Mark(1)
+			case ev := <-reorgCh:
+				a.lock.Lock()
+				a.reorgDepths[ev.Dropped]++
+				a.lock.Unlock()
+				analyticsReorgHistogram.Update(int64(ev.Dropped))
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates the event processing of the service.
+func (a *ChainAnalytics) Stop() {
+	close(a.quit)
+	a.wg.Wait()
+}
+
+// NoteAnnounce records the time a block was first announced by any peer.
+func (a *ChainAnalytics) NoteAnnounce(hash common.Hash) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.announced[hash]; ok {
+		return
+	}
+	if len(a.announced) >= maxTrackedAnnounces {
+		// never imported announcements pile up here, drop a random one
+		for h := range a.announced {
+			delete(a.announced, h)
+			break
+		}
+	}
+	a.announced[hash] = mclock.Now()
+}
+
+// blockImported updates the statistics with a newly imported canonical block.
+func (a *ChainAnalytics) blockImported(ev ChainEvent) {
+	var delay time.Duration
+	a.lock.Lock()
+	if announced, ok := a.announced[ev.Hash]; ok {
+		delay = time.Duration(mclock.Now() - announced)
+		delete(a.announced, ev.Hash)
+	} else {
+		delay = time.Since(time.Unix(ev.Block.Time().Int64(), 0))
+	}
+	uncles := uint64(len(ev.Block.Uncles()))
+	a.blocks++
+	a.uncles += uncles
+	if delay >= 0 {
+		a.propSum += delay
+		a.propCount++
+		if delay > a.propMax {
+			a.propMax = delay
+		}
+	}
+	a.lock.Unlock()
+
+	analyticsBlockMeter.Mark(1)
+	analyticsUncleMeter.Mark(int64(uncles))
+	if delay >= 0 {
+		analyticsPropagationTimer.Update(delay)
+	}
+}
+
+// Stats returns a snapshot of the statistics collected so far.
+func (a *ChainAnalytics) Stats() *ChainAnalyticsStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	stats := &ChainAnalyticsStats{
+		Blocks:         a.blocks,
+		Uncles:         a.uncles,
+		SideBlocks:     a.sideBlocks,
+		PropagationMax: a.propMax,
+		ReorgDepths:    make(map[int]uint64, len(a.reorgDepths)),
+	}
+	if a.blocks > 0 {
+		stats.UncleRate = float64(a.uncles) / float64(a.blocks)
+	}
+	if a.propCount > 0 {
+		stats.PropagationMean = a.propSum / time.Duration(a.propCount)
+	}
+	for depth, count := range a.reorgDepths {
+		stats.ReorgDepths[depth] = count
+	}
+	return stats
+}
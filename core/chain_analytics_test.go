@@ -0,0 +1,74 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
+)
+
+// Tests that the analytics service counts imported blocks and detects reorgs.
+func TestChainAnalytics(t *testing.T) {
+	var (
+		db      = ethdb.NewMemDatabase()
+		genesis = new(Genesis).MustCommit(db)
+		engine  = ethash.NewFaker()
+	)
+	chain, err := NewBlockChain(db, nil, params.TestChainConfig, engine, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	analytics := NewChainAnalytics(chain)
+	analytics.Start()
+	defer analytics.Stop()
+
+	// import a short chain, then a longer fork replacing two of its blocks
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, db, 3, func(i int, b *BlockGen) {})
+	fork, _ := GenerateChain(params.TestChainConfig, blocks[0], engine, db, 3, func(i int, b *BlockGen) { b.SetExtra([]byte("fork")) })
+
+	analytics.NoteAnnounce(blocks[0].Hash())
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	// events are delivered asynchronously, wait for them to be processed
+	var stats *ChainAnalyticsStats
+	for i := 0; i < 100; i++ {
+		if stats = analytics.Stats(); stats.ReorgDepths[2] == 1 && stats.SideBlocks >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.ReorgDepths[2] != 1 {
+		t.Errorf("reorg depths mismatch: have %v, want one reorg of depth 2", stats.ReorgDepths)
+	}
+	if stats.SideBlocks < 2 {
+		t.Errorf("side block count mismatch: have %d, want at least 2", stats.SideBlocks)
+	}
+	if stats.Blocks == 0 || stats.UncleRate != 0 {
+		t.Errorf("block statistics mismatch: %d blocks, uncle rate %f", stats.Blocks, stats.UncleRate)
+	}
+}
@@ -124,10 +124,19 @@ type ChainIndexer struct {
 	// 磁盘节流以防止大量升级占用资源
 	throttling time.Duration // Disk throttling to prevent a heavy upgrade from hogging resources
 
+	sectionFeed event.Feed // Notifies of the sections completed
+	scope       event.SubscriptionScope
+
 	log  log.Logger
 	lock sync.RWMutex
 }
 
+// ChainSectionEvent is posted when a chain indexer completed a section.
+type ChainSectionEvent struct {
+	Section uint64      // Index of the completed section
+	Head    common.Hash // Hash of the last block of the section
+}
+
 // NewChainIndexer creates a new chain indexer to do background processing on
 // chain segments of a given size after certain number of confirmations passed.
 // The throttling parameter might be used to prevent database thrashing.
@@ -230,6 +239,8 @@ func (c *ChainIndexer) Close() error {
 			errs = append(errs, err)
 		}
 	}
+	c.scope.Close()
+
 	// Return any failures
 	switch {
 	case len(errs) == 0:
@@ -440,6 +451,7 @@ func (c *ChainIndexer) updateLoop() {
 			// Section headers completed (or rolled back), update the index
 			//
 			// todo Section headers 完成（或回滚），更新索引
+			var completed *ChainSectionEvent
 			c.lock.Lock()
 
 			// todo 当已知的,需要完成的 section数 > 成功检索到db的section数
@@ -508,6 +520,7 @@ func (c *ChainIndexer) updateLoop() {
 				if err == nil && oldHead == c.SectionHead(section-1) {
 					c.setSectionHead(section, newHead)
 					c.setValidSections(section + 1)
+					completed = &ChainSectionEvent{Section: section, Head: newHead}
 					if c.storedSections == c.knownSections && updating {
 						updating = false
 						c.log.Info("Finished upgrading chain index")
@@ -543,6 +556,11 @@ func (c *ChainIndexer) updateLoop() {
 				})
 			}
 			c.lock.Unlock()
+
+			// Notify the subscribers outside of the lock, they may query the indexer
+			if completed != nil {
+				c.sectionFeed.Send(*completed)
+			}
 		}
 	}
 }
@@ -665,6 +683,24 @@ func (c *ChainIndexer) Sections() (uint64, uint64, common.Hash) {
 	return c.storedSections, c.storedSections*c.sectionSize - 1, c.SectionHead(c.storedSections - 1)
 }
 
+// Progress returns the number of sections stored by the indexer and the number
+// of sections known to be complete on the chain, the ones in between waiting to
+// be processed.
+//
+// 返回 已处理完成的 section 数 和 链上 已知完整的 section 数, 两者之差 为 待处理的 section
+func (c *ChainIndexer) Progress() (stored, known uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.storedSections, c.knownSections
+}
+
+// SubscribeSections registers a subscription of ChainSectionEvent, posted each
+// time the indexer completes a section.
+func (c *ChainIndexer) SubscribeSections(ch chan<- ChainSectionEvent) event.Subscription {
+	return c.scope.Track(c.sectionFeed.Subscribe(ch))
+}
+
 // AddChildIndexer adds a child ChainIndexer that can use the output of this one
 //
 /**
@@ -134,6 +134,48 @@ func testChainIndexer(t *testing.T, count int) {
 	}
 }
 
+// Tests that the subscribers are notified of the completed sections and that
+// the progress of the indexer is reported.
+func TestChainIndexerSectionEvents(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	backend := &testChainIndexBackend{t: t, processCh: make(chan uint64)}
+	backend.indexer = NewChainIndexer(db, ethdb.NewTable(db, "i"), backend, 10, 0, 0, "indexer")
+	defer backend.indexer.Close()
+
+	events := make(chan ChainSectionEvent, 3)
+	sub := backend.indexer.SubscribeSections(events)
+	defer sub.Unsubscribe()
+
+	go func() {
+		for range backend.processCh {
+		}
+	}()
+	var parent common.Hash
+	for i := uint64(0); i < 30; i++ {
+		header := &types.Header{Number: big.NewInt(int64(i)), ParentHash: parent}
+		rawdb.WriteHeader(db, header)
+		rawdb.WriteCanonicalHash(db, header.Hash(), i)
+		parent = header.Hash()
+	}
+	backend.indexer.newHead(29, false)
+
+	for i := uint64(0); i < 3; i++ {
+		select {
+		case ev := <-events:
+			if ev.Section != i || ev.Head != rawdb.ReadCanonicalHash(db, i*10+9) {
+				t.Errorf("event %d mismatch: have section %d head %x", i, ev.Section, ev.Head)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("section %d not notified", i)
+		}
+	}
+	if stored, known := backend.indexer.Progress(); stored != 3 || known != 3 {
+		t.Errorf("progress mismatch: have %d/%d, want %d/%d", stored, known, 3, 3)
+	}
+}
+
 // testChainIndexBackend implements ChainIndexerBackend
 type testChainIndexBackend struct {
 	t                          *testing.T
@@ -210,7 +210,7 @@ func GenerateChain(config *params.ChainConfig, parent *types.Block, engine conse
 		return nil, nil
 	}
 	for i := 0; i < n; i++ {
-		statedb, err := state.New(parent.Root(), state.NewDatabase(db))
+		statedb, err := state.New(parent.Root(), state.NewDatabaseWithConfig(db, stateConfig(state.Config{}, config)))
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,304 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// ChainRecorderConfig are the configuration parameters of the chain recorder.
+type ChainRecorderConfig struct {
+	Path     string        // File the samples are appended to, empty to disable the recorder
+	Interval time.Duration // Time between two consecutive samples
+	MaxSize  int64         // Size after which the file is rotated
+	MaxFiles int           // Number of rotated files kept besides the current one
+
+	TrieSamples int // Number of random state trie lookups per sample
+}
+
+// DefaultChainRecorderConfig contains the default settings of the chain recorder.
+var DefaultChainRecorderConfig = ChainRecorderConfig{
+	Interval:    10 * time.Minute,
+	MaxSize:     64 * 1024 * 1024,
+	MaxFiles:    8,
+	TrieSamples: 32,
+}
+
+// sanitize checks the provided user configurations and changes anything that's
+// unreasonable or unworkable.
+func (config *ChainRecorderConfig) sanitize() ChainRecorderConfig {
+	conf := *config
+	if conf.Interval < time.Second {
+		log.Warn("Sanitizing invalid chain recorder interval", "provided", conf.Interval, "updated", DefaultChainRecorderConfig.Interval)
+		conf.Interval = DefaultChainRecorderConfig.Interval
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = DefaultChainRecorderConfig.MaxSize
+	}
+	if conf.MaxFiles < 0 {
+		conf.MaxFiles = 0
+	}
+	if conf.TrieSamples <= 0 {
+		conf.TrieSamples = DefaultChainRecorderConfig.TrieSamples
+	}
+	return conf
+}
+
+// trieSampleLeaves is the number of consecutive leaves walked from a random key to
+// estimate the density of the accounts in the key space.
+const trieSampleLeaves = 16
+
+// ChainSample is a single record of the chain recorder, written as one line of
+// JSON into the time series file.
+type ChainSample struct {
+	Time   time.Time   `json:"time"`
+	Number uint64      `json:"number"`
+	Hash   common.Hash `json:"hash"`
+
+	Accounts  uint64  `json:"accounts"`           // estimated number of accounts in the state
+	StateSize uint64  `json:"stateSize"`          // estimated size of the account trie leaves in bytes
+	DepthMean float64 `json:"depthMean"`          // mean node depth of the random trie lookups
+	DepthMax  int     `json:"depthMax"`           // deepest random trie lookup
+	StateErr  string  `json:"stateErr,omitempty"` // reason the state could not be sampled
+
+	Sources map[string]interface{} `json:"sources,omitempty"` // values of the registered sources
+}
+
+// ChainRecorder is an optional service periodically appending chain wide
+// statistics to a local time series file, making it possible to correlate the
+// protocol behaviour over long periods without monitoring infrastructure. The
+// file is rotated when it grows beyond the configured size.
+//
+// Besides the state estimates taken from the chain, other subsystems (the p2p
+// server, the les server) can register their own figures with AddSource.
+//
+/**
+ChainRecorder:
+可选服务, 定期将链的统计数据 (state 大小估计, trie 深度采样, 以及注册的其他数据源, 如 peer 数, les 服务成本)
+以 JSON 行的形式追加到本地文件, 文件超过大小后轮转
+ */
+type ChainRecorder struct {
+	config ChainRecorderConfig
+	chain  *BlockChain
+
+	lock    sync.Mutex
+	sources map[string]func() interface{}
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewChainRecorder creates a chain recorder on top of the given chain.
+func NewChainRecorder(config ChainRecorderConfig, chain *BlockChain) *ChainRecorder {
+	return &ChainRecorder{
+		config:  (&config).sanitize(),
+		chain:   chain,
+		sources: make(map[string]func() interface{}),
+		quit:    make(chan struct{}),
+	}
+}
+
+// AddSource registers a function whose result is included in every sample under
+// the given name. The function is called from the recorder's goroutine.
+func (r *ChainRecorder) AddSource(name string, fn func() interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.sources[name] = fn
+}
+
+// Start starts taking samples in the background.
+func (r *ChainRecorder) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.write(r.sample()); err != nil {
+					log.Warn("Failed to record chain sample", "path", r.config.Path, "err", err)
+				}
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates the sampling of the recorder.
+func (r *ChainRecorder) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// sample collects the current statistics of the chain and the sources.
+func (r *ChainRecorder) sample() *ChainSample {
+	head := r.chain.CurrentBlock()
+	sample := &ChainSample{
+		Time:   time.Now(),
+		Number: head.NumberU64(),
+		Hash:   head.Hash(),
+	}
+	if err := r.sampleState(sample, head.Root()); err != nil {
+		sample.StateErr = err.Error()
+	}
+	r.lock.Lock()
+	if len(r.sources) > 0 {
+		sample.Sources = make(map[string]interface{}, len(r.sources))
+		for name, fn := range r.sources {
+			sample.Sources[name] = fn()
+		}
+	}
+	r.lock.Unlock()
+
+	return sample
+}
+
+// sampleState estimates the size of the account trie of the given state. The node
+// depths are taken from proofs of random keys, the number of accounts from the
+// distance of trieSampleLeaves consecutive keys following the random ones.
+func (r *ChainRecorder) sampleState(sample *ChainSample, root common.Hash) error {
+	tr, err := r.chain.StateCache().OpenTrie(root)
+	if err != nil {
+		return err
+	}
+	var (
+		depths   int
+		samples  int
+		leaves   int
+		bytes    int
+		spans    []*big.Int
+		keySpace = new(big.Int).Lsh(common.Big1, 256)
+	)
+	for i := 0; i < r.config.TrieSamples; i++ {
+		key := make([]byte, common.HashLength)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		proof := ethdb.NewMemDatabase()
+		if err := tr.Prove(key, 0, proof); err != nil {
+			return err
+		}
+		depths += proof.Len()
+		samples++
+		if proof.Len() > sample.DepthMax {
+			sample.DepthMax = proof.Len()
+		}
+		// walk the leaves following the random key
+		var (
+			it    = trie.NewIterator(tr.NodeIterator(key))
+			first = new(big.Int).SetBytes(key)
+			last  *big.Int
+			count int
+		)
+		for count < trieSampleLeaves && it.Next() {
+			last = new(big.Int).SetBytes(it.Key)
+			bytes += len(it.Value)
+			count++
+		}
+		if it.Err != nil {
+			return it.Err
+		}
+		leaves += count
+		if count < trieSampleLeaves {
+			// too few accounts after the key, the trie is small enough to count
+			it = trie.NewIterator(tr.NodeIterator(nil))
+			for count = 0; it.Next(); count++ {
+			}
+			if it.Err != nil {
+				return it.Err
+			}
+			sample.Accounts = uint64(count)
+			spans = nil
+			break
+		}
+		spans = append(spans, new(big.Int).Sub(last, first))
+	}
+	sample.DepthMean = float64(depths) / float64(samples)
+	if len(spans) > 0 {
+		// the median span is robust against the random keys falling into gaps
+		sort.Slice(spans, func(i, j int) bool { return spans[i].Cmp(spans[j]) < 0 })
+		span := spans[len(spans)/2]
+		if span.Sign() > 0 {
+			accounts := new(big.Int).Mul(keySpace, big.NewInt(trieSampleLeaves))
+			sample.Accounts = accounts.Div(accounts, span).Uint64()
+		}
+	}
+	if leaves > 0 {
+		sample.StateSize = sample.Accounts * uint64(bytes) / uint64(leaves)
+	}
+	return nil
+}
+
+// write appends a sample to the time series file, rotating the file first if it
+// would grow beyond the configured size.
+func (r *ChainRecorder) write(sample *ChainSample) error {
+	line, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if info, err := os.Stat(r.config.Path); err == nil && info.Size()+int64(len(line)) > r.config.MaxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(r.config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotate shifts the current and the rotated files by one, path.1 being the most
+// recent rotated file, and drops the ones beyond the configured count.
+func (r *ChainRecorder) rotate() error {
+	if r.config.MaxFiles == 0 {
+		return os.Remove(r.config.Path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.config.Path, r.config.MaxFiles))
+	for i := r.config.MaxFiles - 1; i > 0; i-- {
+		old := fmt.Sprintf("%s.%d", r.config.Path, i)
+		if _, err := os.Stat(old); err == nil {
+			if err := os.Rename(old, fmt.Sprintf("%s.%d", r.config.Path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(r.config.Path, r.config.Path+".1")
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
+)
+
+// Tests that the recorder estimates the state, includes the sources and rotates
+// the time series file.
+func TestChainRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainrecorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create a chain with a few hundred accounts in the state
+	var (
+		db    = ethdb.NewMemDatabase()
+		alloc = make(GenesisAlloc)
+	)
+	for i := 0; i < 500; i++ {
+		alloc[common.BigToAddress(big.NewInt(int64(i+1)))] = GenesisAccount{Balance: big.NewInt(1)}
+	}
+	(&Genesis{Alloc: alloc}).MustCommit(db)
+	chain, err := NewBlockChain(db, nil, params.TestChainConfig, ethash.NewFaker(), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	path := filepath.Join(dir, "chain.log")
+	recorder := NewChainRecorder(ChainRecorderConfig{Path: path, MaxSize: 1024, MaxFiles: 2}, chain)
+	recorder.AddSource("test", func() interface{} { return 42 })
+
+	sample := recorder.sample()
+	if sample.StateErr != "" {
+		t.Fatalf("state not sampled: %s", sample.StateErr)
+	}
+	if sample.Accounts < 100 || sample.Accounts > 2500 {
+		t.Errorf("account estimate off: have %d, want about 500", sample.Accounts)
+	}
+	if sample.DepthMax == 0 || sample.DepthMean == 0 || sample.StateSize == 0 {
+		t.Errorf("trie statistics missing: depth mean %v max %d, size %d", sample.DepthMean, sample.DepthMax, sample.StateSize)
+	}
+	if sample.Sources["test"] != 42 {
+		t.Errorf("source value mismatch: have %v, want 42", sample.Sources["test"])
+	}
+	// write enough samples to rotate several times
+	for i := 0; i < 20; i++ {
+		if err := recorder.write(sample); err != nil {
+			t.Fatalf("failed to write sample %d: %v", i, err)
+		}
+	}
+	for _, name := range []string{"chain.log", "chain.log.1", "chain.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("missing time series file %s: %v", name, err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("file %s not rotated: size %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "chain.log.3")); !os.IsNotExist(err) {
+		t.Errorf("excess rotated file kept: %v", err)
+	}
+	// the records must be valid JSON lines
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record ChainSample
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record: %v", err)
+		}
+		if record.Hash != sample.Hash || record.Accounts != sample.Accounts {
+			t.Errorf("record mismatch: have %x/%d, want %x/%d", record.Hash, record.Accounts, sample.Hash, sample.Accounts)
+		}
+	}
+}
@@ -46,3 +46,11 @@ type ChainSideEvent struct {
 }
 
 type ChainHeadEvent struct{ Block *types.Block }
+
+// ChainReorgEvent is posted when the canonical chain is reorganised. Dropped and
+// Added are the number of blocks removed from and written to the canonical chain
+// above the common ancestor.
+type ChainReorgEvent struct {
+	Common         *types.Block
+	Dropped, Added int
+}
@@ -203,7 +203,12 @@ func SetupGenesisBlock(db ethdb.Database, genesis *Genesis) (*params.ChainConfig
 		return newcfg, stored, fmt.Errorf("missing block number for head header hash")
 	}
 	compatErr := storedcfg.CheckCompatible(newcfg, *height)
-	if compatErr != nil && *height != 0 && compatErr.RewindTo != 0 {
+	// A changed trie commitment is only possible with a genesis of empty state (the
+	// genesis hash would differ otherwise), the chain is rewound to it.
+	//
+	// 叶子格式 改变 时 (只可能是 空 state 的 genesis), 需要 回滚到 genesis 重新同步
+	changedCommitment := storedcfg.TrieCommitment != newcfg.TrieCommitment
+	if compatErr != nil && *height != 0 && (compatErr.RewindTo != 0 || changedCommitment) {
 		return newcfg, stored, compatErr
 	}
 	rawdb.WriteChainConfig(db, stored, newcfg)
@@ -229,7 +234,7 @@ func (g *Genesis) ToBlock(db ethdb.Database) *types.Block {
 	if db == nil {
 		db = ethdb.NewMemDatabase()
 	}
-	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	statedb, _ := state.New(common.Hash{}, state.NewDatabaseWithConfig(db, stateConfig(state.Config{}, g.Config)))
 	for addr, account := range g.Alloc {
 		statedb.AddBalance(addr, account.Balance)
 		statedb.SetCode(addr, account.Code)
@@ -51,8 +51,13 @@ func TestSetupGenesis(t *testing.T) {
 			},
 		}
 		oldcustomg = customg
+
+		emptyg  = Genesis{Config: &params.ChainConfig{HomesteadBlock: big.NewInt(3)}}
+		hashedg = emptyg
 	)
 	oldcustomg.Config = &params.ChainConfig{HomesteadBlock: big.NewInt(2)}
+	hashedg.Config = &params.ChainConfig{HomesteadBlock: big.NewInt(3), TrieCommitment: 1}
+	emptyghash := emptyg.ToBlock(nil).Hash()
 	tests := []struct {
 		name       string
 		fn         func(ethdb.Database) (*params.ChainConfig, common.Hash, error)
@@ -138,6 +143,29 @@ func TestSetupGenesis(t *testing.T) {
 				RewindTo:     1,
 			},
 		},
+		{
+			name: "changed trie commitment in DB",
+			fn: func(db ethdb.Database) (*params.ChainConfig, common.Hash, error) {
+				// Advance past the genesis of empty state, readable in any leaf format
+				genesis := emptyg.MustCommit(db)
+
+				bc, _ := NewBlockChain(db, nil, emptyg.Config, ethash.NewFullFaker(), vm.Config{})
+				defer bc.Stop()
+
+				blocks, _ := GenerateChain(emptyg.Config, genesis, ethash.NewFaker(), db, 2, nil)
+				bc.InsertChain(blocks)
+				// This should return a compatibility error.
+				return SetupGenesisBlock(db, &hashedg)
+			},
+			wantHash:   emptyghash,
+			wantConfig: hashedg.Config,
+			wantErr: &params.ConfigCompatError{
+				What:         "trie commitment",
+				StoredConfig: big.NewInt(0),
+				NewConfig:    big.NewInt(0),
+				RewindTo:     0,
+			},
+		},
 	}
 
 	for _, test := range tests {
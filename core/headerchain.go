@@ -40,6 +40,18 @@ const (
 	headerCacheLimit = 512
 	tdCacheLimit     = 1024
 	numberCacheLimit = 2048
+
+	// canonicalCacheLimit is the number of recent number->hash canonical
+	// assignments kept in memory for the ancestor lookups.
+	canonicalCacheLimit = 4096
+
+	// ancestorCacheLimit is the number of ancestor jumps kept in memory.
+	ancestorCacheLimit = 4096
+
+	// ancestorJumpInterval is the distance between the blocks the ancestor jumps
+	// point to. A non-canonical block jumps to the nearest lower block with a
+	// number divisible by the interval.
+	ancestorJumpInterval = 32
 )
 
 // HeaderChain implements the basic block header chain logic that is shared by
@@ -60,6 +72,9 @@ type HeaderChain struct {
 	tdCache     *lru.Cache // Cache for the most recent block total difficulties
 	numberCache *lru.Cache // Cache for the most recent block numbers
 
+	canonicalCache *lru.Cache // Cache for the recent canonical number->hash assignments
+	ancestorCache  *lru.Cache // Cache for the ancestor jumps of the non-canonical blocks
+
 	procInterrupt func() bool
 
 	rand   *mrand.Rand
@@ -77,6 +92,8 @@ func NewHeaderChain(chainDb ethdb.Database, config *params.ChainConfig, engine c
 	headerCache, _ := lru.New(headerCacheLimit) // 512
 	tdCache, _ := lru.New(tdCacheLimit) // 1024
 	numberCache, _ := lru.New(numberCacheLimit) // 2048
+	canonicalCache, _ := lru.New(canonicalCacheLimit)
+	ancestorCache, _ := lru.New(ancestorCacheLimit)
 
 	// Seed a fast but crypto originating random generator
 	// 快速的加密的种子始发随机发生器 (1<<63 - 1 == 9223372036854775807) 100兆 ？
@@ -97,6 +114,9 @@ func NewHeaderChain(chainDb ethdb.Database, config *params.ChainConfig, engine c
 		headerCache:   headerCache,
 		tdCache:       tdCache,
 		numberCache:   numberCache,
+		// 反向 GetBlockHeaders 查询用的 number->hash 与 祖先跳转 缓存
+		canonicalCache: canonicalCache,
+		ancestorCache:  ancestorCache,
 		// 一个回调函数 (返回 块处理是否中断信号标识位)
 		procInterrupt: procInterrupt,
 		// 一个求随机数的 rand 实例
@@ -181,7 +201,7 @@ func (hc *HeaderChain) WriteHeader(header *types.Header) (status WriteStatus, er
 			if hash == (common.Hash{}) {
 				break
 			}
-			rawdb.DeleteCanonicalHash(batch, i)
+			hc.deleteCanonicalHash(batch, i)
 		}
 		batch.Write()
 
@@ -192,14 +212,14 @@ func (hc *HeaderChain) WriteHeader(header *types.Header) (status WriteStatus, er
 			headHeader = hc.GetHeader(headHash, headNumber)
 		)
 		for rawdb.ReadCanonicalHash(hc.chainDb, headNumber) != headHash {
-			rawdb.WriteCanonicalHash(hc.chainDb, headHash, headNumber)
+			hc.WriteCanonicalHash(headHash, headNumber)
 
 			headHash = headHeader.ParentHash
 			headNumber = headHeader.Number.Uint64() - 1
 			headHeader = hc.GetHeader(headHash, headNumber)
 		}
 		// Extend the canonical chain with the new header
-		rawdb.WriteCanonicalHash(hc.chainDb, hash, number)
+		hc.WriteCanonicalHash(hash, number)
 		rawdb.WriteHeadHeaderHash(hc.chainDb, hash)
 
 		hc.currentHeaderHash = hash
@@ -240,17 +260,20 @@ func (hc *HeaderChain) ValidateHeaderChain(chain []*types.Header, checkFreq int)
 	//
 	// 生成印章(headers)验证请求列表，并启动并行验证
 	// 用于  `跳跃性` 校验
+	// checkFreq 为 0 时 不校验任何 seal (如 超轻节点 信任 server 的投票)
 	seals := make([]bool, len(chain))
-	for i := 0; i < len(seals)/checkFreq; i++ {
-		index := i*checkFreq + hc.rand.Intn(checkFreq)
-		if index >= len(seals) {
-			index = len(seals) - 1
+	if checkFreq != 0 {
+		for i := 0; i < len(seals)/checkFreq; i++ {
+			index := i*checkFreq + hc.rand.Intn(checkFreq)
+			if index >= len(seals) {
+				index = len(seals) - 1
+			}
+			seals[index] = true
 		}
-		seals[index] = true
-	}
 
-	// 最后一个header应该始终被验证以避免垃圾
-	seals[len(seals)-1] = true // Last should always be verified to avoid junk
+		// 最后一个header应该始终被验证以避免垃圾
+		seals[len(seals)-1] = true // Last should always be verified to avoid junk
+	}
 
 	// `跳跃性` 校验 header
 	abort, results := hc.engine.VerifyHeaders(hc, chain, seals)
@@ -352,10 +375,27 @@ func (hc *HeaderChain) GetAncestor(hash common.Hash, number, ancestor uint64, ma
 			return common.Hash{}, 0
 		}
 	}
+	// Hashes walked since the last jump target, they all jump to the same ancestor
+	var pending []common.Hash
+
 	for ancestor != 0 {
-		if rawdb.ReadCanonicalHash(hc.chainDb, number) == hash {
+		if hc.GetCanonicalHash(number) == hash {
 			number -= ancestor
-			return rawdb.ReadCanonicalHash(hc.chainDb, number), number
+			return hc.GetCanonicalHash(number), number
+		}
+		// Jump to a known ancestor if it's not beyond the requested one. The jumped
+		// blocks still count as non-canonical, the results are the same as walking.
+		if jump, ok := hc.ancestorCache.Get(hash); ok {
+			jump := jump.(ancestorJump)
+			if dist := number - jump.number; dist <= ancestor && dist <= *maxNonCanonical {
+				hc.addAncestorJumps(pending, jump)
+				pending = pending[:0]
+
+				*maxNonCanonical -= dist
+				ancestor -= dist
+				hash, number = jump.hash, jump.number
+				continue
+			}
 		}
 		if *maxNonCanonical == 0 {
 			return common.Hash{}, 0
@@ -366,12 +406,59 @@ func (hc *HeaderChain) GetAncestor(hash common.Hash, number, ancestor uint64, ma
 		if header == nil {
 			return common.Hash{}, 0
 		}
+		pending = append(pending, hash)
 		hash = header.ParentHash
 		number--
+
+		if number%ancestorJumpInterval == 0 {
+			hc.addAncestorJumps(pending, ancestorJump{hash, number})
+			pending = pending[:0]
+		}
 	}
 	return hash, number
 }
 
+// ancestorJump is the ancestor of a block at the previous jump interval boundary.
+type ancestorJump struct {
+	hash   common.Hash
+	number uint64
+}
+
+// addAncestorJumps records the common jump target of the given blocks. The
+// ancestry of a block never changes, so the jumps don't need to be invalidated.
+func (hc *HeaderChain) addAncestorJumps(hashes []common.Hash, jump ancestorJump) {
+	for _, hash := range hashes {
+		hc.ancestorCache.Add(hash, jump)
+	}
+}
+
+// GetCanonicalHash retrieves the canonical hash assigned to a block number,
+// caching it if found.
+func (hc *HeaderChain) GetCanonicalHash(number uint64) common.Hash {
+	if cached, ok := hc.canonicalCache.Get(number); ok {
+		return cached.(common.Hash)
+	}
+	hash := rawdb.ReadCanonicalHash(hc.chainDb, number)
+	if hash != (common.Hash{}) {
+		hc.canonicalCache.Add(number, hash)
+	}
+	return hash
+}
+
+// WriteCanonicalHash assigns a hash to a canonical block number, updating the
+// cached assignment too.
+func (hc *HeaderChain) WriteCanonicalHash(hash common.Hash, number uint64) {
+	rawdb.WriteCanonicalHash(hc.chainDb, hash, number)
+	hc.canonicalCache.Add(number, hash)
+}
+
+// deleteCanonicalHash removes the canonical assignment of a block number in the
+// batch and drops the cached one.
+func (hc *HeaderChain) deleteCanonicalHash(db rawdb.DatabaseDeleter, number uint64) {
+	rawdb.DeleteCanonicalHash(db, number)
+	hc.canonicalCache.Remove(number)
+}
+
 // GetTd retrieves a block's total difficulty in the canonical chain from the
 // database by hash and number, caching it if found.
 func (hc *HeaderChain) GetTd(hash common.Hash, number uint64) *big.Int {
@@ -447,7 +534,7 @@ func (hc *HeaderChain) HasHeader(hash common.Hash, number uint64) bool {
 // GetHeaderByNumber retrieves a block header from the database by number,
 // caching it (associated with its hash) if found.
 func (hc *HeaderChain) GetHeaderByNumber(number uint64) *types.Header {
-	hash := rawdb.ReadCanonicalHash(hc.chainDb, number)
+	hash := hc.GetCanonicalHash(number)
 	if hash == (common.Hash{}) {
 		return nil
 	}
@@ -494,7 +581,7 @@ func (hc *HeaderChain) SetHead(head uint64, delFn DeleteCallback) {
 	}
 	// Roll back the canonical chain numbering
 	for i := height; i > head; i-- {
-		rawdb.DeleteCanonicalHash(batch, i)
+		hc.deleteCanonicalHash(batch, i)
 	}
 	batch.Write()
 
@@ -502,6 +589,8 @@ func (hc *HeaderChain) SetHead(head uint64, delFn DeleteCallback) {
 	hc.headerCache.Purge()
 	hc.tdCache.Purge()
 	hc.numberCache.Purge()
+	hc.canonicalCache.Purge()
+	hc.ancestorCache.Purge()
 
 	if hc.CurrentHeader() == nil {
 		hc.currentHeader.Store(hc.genesisHeader)
@@ -0,0 +1,89 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+)
+
+// Tests that the ancestor lookups of side chain blocks return the same results
+// with the cached jumps as walking the headers one by one, and that the cached
+// canonical assignments follow a reorg.
+func TestHeaderChainAncestorCache(t *testing.T) {
+	db, blockchain, err := newCanonical(ethash.NewFaker(), 0, false)
+	if err != nil {
+		t.Fatalf("failed to create pristine chain: %v", err)
+	}
+	defer blockchain.Stop()
+
+	main := makeHeaderChain(blockchain.CurrentHeader(), 100, ethash.NewFaker(), db, 0)
+	if _, err := blockchain.InsertHeaderChain(main, 1); err != nil {
+		t.Fatalf("failed to insert main chain: %v", err)
+	}
+	fork := makeHeaderChain(blockchain.Genesis().Header(), 80, ethash.NewFaker(), db, 1)
+	if _, err := blockchain.InsertHeaderChain(fork, 1); err != nil {
+		t.Fatalf("failed to insert side chain: %v", err)
+	}
+	hc := blockchain.hc
+
+	// Walks the parents of a header without any caches
+	walk := func(hash common.Hash, number, ancestor uint64) common.Hash {
+		for ; ancestor > 0; ancestor-- {
+			header := hc.GetHeader(hash, number)
+			hash, number = header.ParentHash, number-1
+		}
+		return hash
+	}
+	tip := fork[len(fork)-1]
+	for round := 0; round < 2; round++ {
+		for _, ancestor := range []uint64{2, 5, 31, 32, 33, 64, 79, 80} {
+			maxNonCanonical := uint64(100)
+			hash, number := hc.GetAncestor(tip.Hash(), tip.Number.Uint64(), ancestor, &maxNonCanonical)
+			if want := walk(tip.Hash(), tip.Number.Uint64(), ancestor); hash != want || number != tip.Number.Uint64()-ancestor {
+				t.Errorf("round %d, ancestor %d: have %x #%d, want %x #%d", round, ancestor, hash, number, want, tip.Number.Uint64()-ancestor)
+			}
+			if want := 100 - ancestor; ancestor > 1 && maxNonCanonical != want {
+				t.Errorf("round %d, ancestor %d: non-canonical allowance mismatch: have %d, want %d", round, ancestor, maxNonCanonical, want)
+			}
+		}
+	}
+	if hc.ancestorCache.Len() == 0 {
+		t.Errorf("no ancestor jumps cached")
+	}
+	// The walk is limited by the non-canonical allowance with the jumps too
+	maxNonCanonical := uint64(40)
+	if hash, _ := hc.GetAncestor(tip.Hash(), tip.Number.Uint64(), 64, &maxNonCanonical); hash != (common.Hash{}) {
+		t.Errorf("non-canonical allowance exceeded")
+	}
+	// Make the side chain canonical and check the cached assignments
+	if hc.GetHeaderByNumber(50).Hash() != main[49].Hash() {
+		t.Fatalf("canonical header mismatch before reorg")
+	}
+	extension := makeHeaderChain(tip, 40, ethash.NewFaker(), db, 1)
+	if _, err := blockchain.InsertHeaderChain(extension, 1); err != nil {
+		t.Fatalf("failed to insert side chain extension: %v", err)
+	}
+	if hash := hc.GetHeaderByNumber(50).Hash(); hash != fork[49].Hash() {
+		t.Errorf("canonical header mismatch after reorg: have %x, want %x", hash, fork[49].Hash())
+	}
+	if header := hc.GetHeaderByNumber(100); header == nil || header.Hash() != extension[19].Hash() {
+		t.Errorf("canonical header mismatch at the new head")
+	}
+}
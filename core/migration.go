@@ -0,0 +1,189 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+)
+
+// Migration is a single upgrade of the stored data formats, moving the database
+// schema from Version-1 to Version.
+//
+// The data is transformed incrementally: Step is called repeatedly with the
+// progress marker returned by the previous call (nil on the first one) and
+// transforms the next chunk of the data, returning the marker to continue from
+// or an empty one when the migration is done. The marker is persisted after
+// every step, so a migration interrupted by a shutdown resumes from the last
+// completed step. Steps must therefore be idempotent.
+//
+// Non-blocking migrations run in the background while the node is operating, so
+// the code reading the migrated data has to understand both formats until the
+// schema version reaches the migration.
+type Migration struct {
+	Version  uint64
+	Name     string
+	Blocking bool // Whether the migration has to finish before the chain is loaded
+	Step     func(db ethdb.Database, progress []byte) ([]byte, error)
+}
+
+// Migrations lists the schema migrations of the chain database, in version
+// order. The schema version of a fresh database is the version of the last one.
+//
+// 新增存储格式变更 (例如 receipt 压缩, tx index 变更) 时在这里追加 migration, 已有的数据原地升级, 不需要重新同步
+var Migrations []Migration
+
+// errMigrationStopped is returned if a migration is interrupted by a shutdown.
+var errMigrationStopped = errors.New("migration stopped")
+
+// Migrator upgrades the schema of a chain database by running the pending
+// migrations, the blocking ones synchronously on startup and the rest in the
+// background.
+//
+/**
+Migrator:
+db 中记录 schema version, 启动时对比已注册的 migration:
+阻塞的 migration (以及它之前的) 在加载链之前同步执行, 其余的在后台逐步执行, 每一步的进度都持久化, 重启后从断点继续
+*/
+type Migrator struct {
+	db         ethdb.Database
+	migrations []Migration
+
+	lock    sync.RWMutex
+	version uint64 // current schema version of the database
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewMigrator creates a migrator for the given database. Fresh databases are
+// marked with the latest schema version right away, databases predating the
+// schema versions start at version zero. It fails if the migrations are not
+// numbered sequentially or the database has a newer schema than supported.
+func NewMigrator(db ethdb.Database, migrations []Migration) (*Migrator, error) {
+	for i, migration := range migrations {
+		if migration.Version != uint64(i+1) {
+			return nil, fmt.Errorf("migration %q has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+	}
+	latest := uint64(len(migrations))
+
+	var version uint64
+	if stored := rawdb.ReadSchemaVersion(db); stored != nil {
+		version = *stored
+	} else if rawdb.ReadHeadHeaderHash(db) == (common.Hash{}) {
+		version = latest
+		rawdb.WriteSchemaVersion(db, version)
+	}
+	if version > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than the supported %d", version, latest)
+	}
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+		version:    version,
+		quit:       make(chan struct{}),
+	}, nil
+}
+
+// Version returns the current schema version of the database.
+func (m *Migrator) Version() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.version
+}
+
+// Done reports whether all the migrations have been applied.
+func (m *Migrator) Done() bool {
+	return m.Version() == uint64(len(m.migrations))
+}
+
+// RunBlocking applies the pending migrations up to and including the last
+// blocking one.
+func (m *Migrator) RunBlocking() error {
+	var limit uint64
+	for _, migration := range m.migrations {
+		if migration.Blocking {
+			limit = migration.Version
+		}
+	}
+	return m.run(limit)
+}
+
+// Start applies the rest of the pending migrations in the background.
+func (m *Migrator) Start() {
+	if m.Done() {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if err := m.run(uint64(len(m.migrations))); err != nil && err != errMigrationStopped {
+			log.Error("Database migration failed", "version", m.Version(), "err", err)
+		}
+	}()
+}
+
+// Stop interrupts the background migrations, they resume from their last step
+// on the next start.
+func (m *Migrator) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// run applies the pending migrations up to the given schema version.
+func (m *Migrator) run(limit uint64) error {
+	for version := m.Version(); version < limit; version = m.Version() {
+		migration := m.migrations[version]
+		progress := rawdb.ReadMigrationProgress(m.db, migration.Version)
+
+		log.Info("Migrating database", "version", migration.Version, "name", migration.Name, "resumed", len(progress) > 0)
+		start := time.Now()
+		for {
+			select {
+			case <-m.quit:
+				return errMigrationStopped
+			default:
+			}
+			next, err := migration.Step(m.db, progress)
+			if err != nil {
+				return fmt.Errorf("migration %q: %v", migration.Name, err)
+			}
+			if len(next) == 0 {
+				break
+			}
+			rawdb.WriteMigrationProgress(m.db, migration.Version, next)
+			progress = next
+		}
+		m.lock.Lock()
+		rawdb.WriteSchemaVersion(m.db, migration.Version)
+		rawdb.DeleteMigrationProgress(m.db, migration.Version)
+		m.version = migration.Version
+		m.lock.Unlock()
+
+		log.Info("Database migrated", "version", migration.Version, "name", migration.Name, "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// renameMigration moves the entries "old-<i>" to "new-<i>", two per step. It
+// fails after the given number of steps if fail is set.
+func renameMigration(version uint64, blocking bool, count int, fail *int) Migration {
+	return Migration{
+		Version:  version,
+		Name:     fmt.Sprintf("rename-%d", version),
+		Blocking: blocking,
+		Step: func(db ethdb.Database, progress []byte) ([]byte, error) {
+			if fail != nil {
+				if *fail == 0 {
+					return nil, errors.New("interrupted")
+				}
+				*fail--
+			}
+			next := 0
+			if len(progress) > 0 {
+				next, _ = strconv.Atoi(string(progress))
+			}
+			for i := next; i < next+2 && i < count; i++ {
+				key := fmt.Sprintf("%d-%d", version, i)
+				value, _ := db.Get([]byte("old-" + key))
+				db.Put([]byte("new-"+key), value)
+				db.Delete([]byte("old-" + key))
+			}
+			if next+2 >= count {
+				return nil, nil
+			}
+			return []byte(strconv.Itoa(next + 2)), nil
+		},
+	}
+}
+
+// Tests that fresh databases are created with the latest schema version.
+func TestMigratorFreshDatabase(t *testing.T) {
+	migrator, err := NewMigrator(ethdb.NewMemDatabase(), []Migration{renameMigration(1, true, 0, nil)})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	if !migrator.Done() || migrator.Version() != 1 {
+		t.Errorf("fresh database not at the latest version: %d", migrator.Version())
+	}
+}
+
+// Tests that the migrations of a legacy database are applied, resuming an
+// interrupted one from its last step.
+func TestMigratorResume(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	rawdb.WriteHeadHeaderHash(db, common.Hash{1})
+	for _, version := range []int{1, 2} {
+		for i := 0; i < 5; i++ {
+			db.Put([]byte(fmt.Sprintf("old-%d-%d", version, i)), []byte{byte(i)})
+		}
+	}
+	// Interrupt the blocking migration after two steps
+	fail := 2
+	migrator, _ := NewMigrator(db, []Migration{renameMigration(1, true, 5, &fail), renameMigration(2, false, 5, nil)})
+	if migrator.Version() != 0 {
+		t.Fatalf("legacy database version mismatch: have %d, want 0", migrator.Version())
+	}
+	if err := migrator.RunBlocking(); err == nil {
+		t.Fatalf("interrupted migration succeeded")
+	}
+	if progress := rawdb.ReadMigrationProgress(db, 1); string(progress) != "4" {
+		t.Fatalf("progress mismatch: have %q, want \"4\"", progress)
+	}
+	// Resume on restart, the background migration runs after the blocking one
+	migrator, _ = NewMigrator(db, []Migration{renameMigration(1, true, 5, nil), renameMigration(2, false, 5, nil)})
+	if err := migrator.RunBlocking(); err != nil {
+		t.Fatalf("failed to resume migration: %v", err)
+	}
+	if migrator.Version() != 1 || rawdb.ReadMigrationProgress(db, 1) != nil {
+		t.Fatalf("blocking migration not finished: version %d", migrator.Version())
+	}
+	migrator.Start()
+	for start := time.Now(); !migrator.Done(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("background migration not finished")
+		}
+	}
+	migrator.Stop()
+
+	if version := rawdb.ReadSchemaVersion(db); version == nil || *version != 2 {
+		t.Fatalf("stored schema version mismatch: %v", version)
+	}
+	for _, version := range []int{1, 2} {
+		for i := 0; i < 5; i++ {
+			if has, _ := db.Has([]byte(fmt.Sprintf("old-%d-%d", version, i))); has {
+				t.Errorf("entry %d-%d not migrated", version, i)
+			}
+			if value, _ := db.Get([]byte(fmt.Sprintf("new-%d-%d", version, i))); len(value) != 1 || value[0] != byte(i) {
+				t.Errorf("entry %d-%d mismatch: %x", version, i, value)
+			}
+		}
+	}
+}
+
+// Tests that invalid migration lists and newer schemas are rejected.
+func TestMigratorInvalid(t *testing.T) {
+	if _, err := NewMigrator(ethdb.NewMemDatabase(), []Migration{renameMigration(2, false, 0, nil)}); err == nil {
+		t.Errorf("misnumbered migrations accepted")
+	}
+	db := ethdb.NewMemDatabase()
+	rawdb.WriteSchemaVersion(db, 3)
+	if _, err := NewMigrator(db, []Migration{renameMigration(1, false, 0, nil)}); err == nil {
+		t.Errorf("newer schema accepted")
+	}
+}
@@ -43,6 +43,72 @@ func WriteDatabaseVersion(db DatabaseWriter, version int) {
 	}
 }
 
+// ReadSchemaVersion retrieves the version of the stored data formats, nil if the
+// database predates the schema versions.
+func ReadSchemaVersion(db DatabaseReader) *uint64 {
+	enc, _ := db.Get(schemaVersionKey)
+	if len(enc) == 0 {
+		return nil
+	}
+	var version uint64
+	if err := rlp.DecodeBytes(enc, &version); err != nil {
+		log.Error("Invalid schema version", "err", err)
+		return nil
+	}
+	return &version
+}
+
+// WriteSchemaVersion stores the version of the stored data formats.
+func WriteSchemaVersion(db DatabaseWriter, version uint64) {
+	enc, _ := rlp.EncodeToBytes(version)
+	if err := db.Put(schemaVersionKey, enc); err != nil {
+		log.Crit("Failed to store the schema version", "err", err)
+	}
+}
+
+// ReadMigrationProgress retrieves the progress marker of an interrupted schema
+// migration, nil if it hasn't been started.
+func ReadMigrationProgress(db DatabaseReader, version uint64) []byte {
+	data, _ := db.Get(migrationKey(version))
+	return data
+}
+
+// WriteMigrationProgress stores the progress marker of a schema migration.
+func WriteMigrationProgress(db DatabaseWriter, version uint64, progress []byte) {
+	if err := db.Put(migrationKey(version), progress); err != nil {
+		log.Crit("Failed to store migration progress", "err", err)
+	}
+}
+
+// DeleteMigrationProgress removes the progress marker of a finished migration.
+func DeleteMigrationProgress(db DatabaseDeleter, version uint64) {
+	if err := db.Delete(migrationKey(version)); err != nil {
+		log.Crit("Failed to delete migration progress", "err", err)
+	}
+}
+
+// ReadUncleanShutdownMarker reports whether the node using the database was
+// stopped without closing it properly.
+func ReadUncleanShutdownMarker(db DatabaseReader) bool {
+	has, _ := db.Has(uncleanShutdownKey)
+	return has
+}
+
+// WriteUncleanShutdownMarker marks the database as being in use, the marker is
+// removed on a clean shutdown.
+func WriteUncleanShutdownMarker(db DatabaseWriter) {
+	if err := db.Put(uncleanShutdownKey, []byte{1}); err != nil {
+		log.Crit("Failed to store unclean shutdown marker", "err", err)
+	}
+}
+
+// DeleteUncleanShutdownMarker removes the in use marker of the database.
+func DeleteUncleanShutdownMarker(db DatabaseDeleter) {
+	if err := db.Delete(uncleanShutdownKey); err != nil {
+		log.Crit("Failed to remove unclean shutdown marker", "err", err)
+	}
+}
+
 // ReadChainConfig retrieves the consensus settings based on the given genesis hash.
 func ReadChainConfig(db DatabaseReader, hash common.Hash) *params.ChainConfig {
 	data, _ := db.Get(configKey(hash))
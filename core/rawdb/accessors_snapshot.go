@@ -0,0 +1,106 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// ReadSnapshotGenerator retrieves the serialized progress of the flat state
+// snapshot generation.
+func ReadSnapshotGenerator(db DatabaseReader) []byte {
+	data, _ := db.Get(snapshotGeneratorKey)
+	return data
+}
+
+// WriteSnapshotGenerator stores the serialized progress of the flat state
+// snapshot generation.
+func WriteSnapshotGenerator(db DatabaseWriter, generator []byte) {
+	if err := db.Put(snapshotGeneratorKey, generator); err != nil {
+		log.Crit("Failed to store snapshot generator", "err", err)
+	}
+}
+
+// ReadAccountSnapshot retrieves the flat entry of an account of the given
+// snapshot generation, nil if the account doesn't exist.
+func ReadAccountSnapshot(db DatabaseReader, gen uint64, hash common.Hash) []byte {
+	data, _ := db.Get(snapshotAccountKey(gen, hash))
+	return data
+}
+
+// WriteAccountSnapshot stores the flat entry of an account.
+func WriteAccountSnapshot(db DatabaseWriter, gen uint64, hash common.Hash, entry []byte) {
+	if err := db.Put(snapshotAccountKey(gen, hash), entry); err != nil {
+		log.Crit("Failed to store account snapshot", "err", err)
+	}
+}
+
+// DeleteAccountSnapshot removes the flat entry of an account.
+func DeleteAccountSnapshot(db DatabaseDeleter, gen uint64, hash common.Hash) {
+	if err := db.Delete(snapshotAccountKey(gen, hash)); err != nil {
+		log.Crit("Failed to delete account snapshot", "err", err)
+	}
+}
+
+// ReadStorageSnapshot retrieves the flat entry of a storage slot of the given
+// snapshot generation, nil if the slot is empty.
+func ReadStorageSnapshot(db DatabaseReader, gen uint64, accountHash, storageHash common.Hash) []byte {
+	data, _ := db.Get(snapshotStorageKey(gen, accountHash, storageHash))
+	return data
+}
+
+// WriteStorageSnapshot stores the flat entry of a storage slot.
+func WriteStorageSnapshot(db DatabaseWriter, gen uint64, accountHash, storageHash common.Hash, entry []byte) {
+	if err := db.Put(snapshotStorageKey(gen, accountHash, storageHash), entry); err != nil {
+		log.Crit("Failed to store storage snapshot", "err", err)
+	}
+}
+
+// DeleteStorageSnapshot removes the flat entry of a storage slot.
+func DeleteStorageSnapshot(db DatabaseDeleter, gen uint64, accountHash, storageHash common.Hash) {
+	if err := db.Delete(snapshotStorageKey(gen, accountHash, storageHash)); err != nil {
+		log.Crit("Failed to delete storage snapshot", "err", err)
+	}
+}
+
+// prefixIterator is implemented by the databases able to iterate over the keys
+// with a given prefix.
+type prefixIterator interface {
+	NewIteratorWithPrefix(prefix []byte) iterator.Iterator
+}
+
+// DeleteSnapshotGeneration removes all the flat entries of an abandoned snapshot
+// generation. It returns false if the database cannot iterate over its keys, in
+// which case the entries are left behind.
+func DeleteSnapshotGeneration(db Database, gen uint64) bool {
+	it, ok := db.(prefixIterator)
+	if !ok {
+		return false
+	}
+	for _, prefix := range [][]byte{snapshotAccountPrefix, snapshotStoragePrefix} {
+		iter := it.NewIteratorWithPrefix(append(append([]byte{}, prefix...), encodeBlockNumber(gen)...))
+		for iter.Next() {
+			if err := db.Delete(common.CopyBytes(iter.Key())); err != nil {
+				log.Crit("Failed to delete snapshot entry", "err", err)
+			}
+		}
+		iter.Release()
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+)
+
+// ConsistencyIssue is a single inconsistency found in the chain database.
+type ConsistencyIssue struct {
+	Number  uint64      `json:"number"`
+	Hash    common.Hash `json:"hash"`
+	Problem string      `json:"problem"`
+}
+
+// ConsistencyReport is the outcome of a chain database consistency check.
+type ConsistencyReport struct {
+	From        uint64             `json:"from"`        // First block number checked
+	To          uint64             `json:"to"`          // Last block number checked
+	Issues      []ConsistencyIssue `json:"issues"`      // Inconsistencies found
+	Quarantined int                `json:"quarantined"` // Canonical mappings moved to the quarantine
+	Repaired    bool               `json:"repaired"`    // Whether the head markers were rewound
+
+	HeadHeader    common.Hash `json:"headHeader"` // Head markers after the check
+	HeadBlock     common.Hash `json:"headBlock"`
+	HeadFastBlock common.Hash `json:"headFastBlock"`
+}
+
+// Consistent reports whether the check found no issues.
+func (r *ConsistencyReport) Consistent() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *ConsistencyReport) issue(number uint64, hash common.Hash, problem string) {
+	r.Issues = append(r.Issues, ConsistencyIssue{Number: number, Hash: hash, Problem: problem})
+}
+
+// headMarker is one of the head pointers of the chain database.
+type headMarker struct {
+	name  string
+	hash  common.Hash
+	num   uint64
+	known bool // whether the number of the hash could be resolved
+	write func(DatabaseWriter, common.Hash)
+}
+
+// CheckChainConsistency runs a fast consistency check of the most recent part of
+// the chain database, meant to be run on startup after an unclean shutdown. The
+// last depth canonical blocks below the highest head marker are checked for
+//
+//   - a canonical hash for every number,
+//   - the header of the canonical hash, with a matching number mapping,
+//   - the header linking to the canonical hash of the previous number,
+//   - the block body of canonical blocks up to the head (fast) block.
+//
+// If repair is set, the canonical mappings above the first inconsistent number
+// are moved to the quarantine and the head markers are rewound to the last
+// consistent block. The state of the new head is not checked, it is repaired by
+// the blockchain on load.
+//
+/**
+CheckChainConsistency:
+非正常关闭 (crash / kill) 之后启动时, 对 chain db 最近的 depth 个 canonical block 做快速一致性检查:
+canonical hash 是否存在, header 是否存在且 number 映射一致, header 的 parentHash 是否指向上一个 canonical hash,
+head (fast) block 以下的 body 是否存在.
+repair 时将第一个不一致 number 之上的 canonical 映射挪到 quarantine 前缀下, 并把 head 标记回退到最后一致的 block
+*/
+func CheckChainConsistency(db Database, depth uint64, repair bool) *ConsistencyReport {
+	report := new(ConsistencyReport)
+
+	heads := []*headMarker{
+		{name: "header", hash: ReadHeadHeaderHash(db), write: WriteHeadHeaderHash},
+		{name: "block", hash: ReadHeadBlockHash(db), write: WriteHeadBlockHash},
+		{name: "fast block", hash: ReadHeadFastBlockHash(db), write: WriteHeadFastBlockHash},
+	}
+	var (
+		top       uint64 // highest head number, checking starts below it
+		bodyLimit uint64 // highest head (fast) block number, bodies are present below it
+		hasBodies bool
+		empty     = true
+	)
+	for i, head := range heads {
+		if head.hash == (common.Hash{}) {
+			continue
+		}
+		empty = false
+		if num := ReadHeaderNumber(db, head.hash); num != nil {
+			head.num, head.known = *num, true
+			if head.num > top {
+				top = head.num
+			}
+			if i > 0 && head.num >= bodyLimit {
+				bodyLimit, hasBodies = head.num, true
+			}
+		} else {
+			report.issue(0, head.hash, "unknown head "+head.name)
+		}
+	}
+	if empty {
+		return report // fresh database
+	}
+	if top > depth {
+		report.From = top - depth
+	}
+	report.To = top
+
+	// Find the last block of the checked range with consistent header data
+	var (
+		good     uint64
+		bad      bool
+		badFirst uint64
+		parent   common.Hash
+	)
+	if report.From > 0 {
+		parent = ReadCanonicalHash(db, report.From-1)
+	}
+	for n := report.From; n <= top; n++ {
+		hash := ReadCanonicalHash(db, n)
+		switch {
+		case hash == (common.Hash{}):
+			report.issue(n, hash, "missing canonical hash")
+		case !HasHeader(db, hash, n):
+			report.issue(n, hash, "missing header")
+		default:
+			if num := ReadHeaderNumber(db, hash); num == nil || *num != n {
+				report.issue(n, hash, "header number mismatch")
+			} else if header := ReadHeader(db, hash, n); header == nil {
+				report.issue(n, hash, "undecodable header")
+			} else if n > 0 && header.ParentHash != parent {
+				report.issue(n, hash, "parent hash mismatch")
+			} else {
+				good, parent = n, hash
+				continue
+			}
+		}
+		bad, badFirst = true, n
+		break
+	}
+	if bad && badFirst == 0 {
+		log.Error("Chain database genesis is corrupted, cannot repair")
+		return report.withHeads(db)
+	}
+	if bad && badFirst == report.From {
+		// Nothing consistent in the checked range, rewind to below it
+		good = badFirst - 1
+	}
+	// Find the last block with a body below the head (fast) block
+	bodyGood := good
+	if hasBodies {
+		limit := bodyLimit
+		if limit > good {
+			limit = good
+		}
+		for n := report.From; n <= limit; n++ {
+			hash := ReadCanonicalHash(db, n)
+			if !HasBody(db, hash, n) {
+				report.issue(n, hash, "missing body")
+				bodyGood = n - 1
+				if n == 0 {
+					log.Error("Chain database genesis body is missing, cannot repair")
+					return report.withHeads(db)
+				}
+				break
+			}
+		}
+	}
+	if !repair || report.Consistent() {
+		return report.withHeads(db)
+	}
+	// Quarantine the canonical mappings above the corruption
+	if bad {
+		for n := badFirst; n <= top; n++ {
+			key := headerHashKey(n)
+			data, _ := db.Get(key)
+			if len(data) == 0 {
+				continue
+			}
+			if err := db.Put(quarantineKey(key), data); err != nil {
+				log.Crit("Failed to quarantine canonical hash", "number", n, "err", err)
+			}
+			DeleteCanonicalHash(db, n)
+			report.Quarantined++
+		}
+	}
+	// Rewind the head markers to the last consistent blocks
+	for i, head := range heads {
+		if head.hash == (common.Hash{}) {
+			continue
+		}
+		limit := good
+		if i > 0 {
+			limit = bodyGood
+		}
+		if head.known && head.num <= limit && ReadCanonicalHash(db, head.num) == head.hash {
+			continue
+		}
+		if head.known && head.num < limit {
+			limit = head.num
+		}
+		hash := ReadCanonicalHash(db, limit)
+		log.Warn("Rewinding corrupted head marker", "marker", head.name, "from", head.hash, "number", limit, "to", hash)
+		head.write(db, hash)
+		report.Repaired = true
+	}
+	return report.withHeads(db)
+}
+
+// withHeads fills the head markers of the report from the database.
+func (r *ConsistencyReport) withHeads(db DatabaseReader) *ConsistencyReport {
+	r.HeadHeader = ReadHeadHeaderHash(db)
+	r.HeadBlock = ReadHeadBlockHash(db)
+	r.HeadFastBlock = ReadHeadFastBlockHash(db)
+	return r
+}
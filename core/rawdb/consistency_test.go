@@ -0,0 +1,150 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// makeConsistencyChain writes a canonical chain of the given length with all
+// its headers and bodies, returning the block hashes.
+func makeConsistencyChain(db *ethdb.MemDatabase, length int) []common.Hash {
+	var (
+		hashes []common.Hash
+		parent common.Hash
+	)
+	for i := 0; i <= length; i++ {
+		header := &types.Header{ParentHash: parent, Number: big.NewInt(int64(i)), Extra: []byte("consistency")}
+		block := types.NewBlockWithHeader(header)
+		WriteBlock(db, block)
+		WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		hashes = append(hashes, block.Hash())
+		parent = block.Hash()
+	}
+	WriteHeadHeaderHash(db, parent)
+	WriteHeadBlockHash(db, parent)
+	WriteHeadFastBlockHash(db, parent)
+	return hashes
+}
+
+// Tests that a consistent chain database is left untouched.
+func TestChainConsistencyClean(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	hashes := makeConsistencyChain(db, 10)
+
+	report := CheckChainConsistency(db, 1024, true)
+	if !report.Consistent() || report.Repaired {
+		t.Fatalf("consistent chain reported issues: %+v", report.Issues)
+	}
+	if report.From != 0 || report.To != 10 {
+		t.Errorf("checked range mismatch: have %d-%d, want 0-10", report.From, report.To)
+	}
+	if report.HeadHeader != hashes[10] || report.HeadBlock != hashes[10] {
+		t.Errorf("head markers changed")
+	}
+	// Only the recent blocks are checked
+	if report := CheckChainConsistency(db, 4, true); report.From != 6 || !report.Consistent() {
+		t.Errorf("limited check mismatch: from %d, issues %+v", report.From, report.Issues)
+	}
+	// Fresh databases are consistent
+	if report := CheckChainConsistency(ethdb.NewMemDatabase(), 1024, true); !report.Consistent() {
+		t.Errorf("empty database reported issues: %+v", report.Issues)
+	}
+}
+
+// Tests that a gap in the canonical mappings quarantines the entries above it
+// and rewinds all the head markers below it.
+func TestChainConsistencyMissingCanonical(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	hashes := makeConsistencyChain(db, 10)
+	DeleteCanonicalHash(db, 7)
+
+	// Check only, nothing changes
+	report := CheckChainConsistency(db, 1024, false)
+	if len(report.Issues) != 1 || report.Issues[0].Number != 7 || report.Issues[0].Problem != "missing canonical hash" {
+		t.Fatalf("issues mismatch: %+v", report.Issues)
+	}
+	if report.Repaired || report.Quarantined != 0 || report.HeadHeader != hashes[10] {
+		t.Fatalf("check without repair modified the database")
+	}
+	// Repair the database
+	report = CheckChainConsistency(db, 1024, true)
+	if !report.Repaired || report.Quarantined != 3 {
+		t.Fatalf("repair mismatch: repaired %v, quarantined %d", report.Repaired, report.Quarantined)
+	}
+	for _, head := range []common.Hash{report.HeadHeader, report.HeadBlock, report.HeadFastBlock} {
+		if head != hashes[6] {
+			t.Errorf("head marker mismatch: have %x, want %x", head, hashes[6])
+		}
+	}
+	for n := uint64(7); n <= 10; n++ {
+		if hash := ReadCanonicalHash(db, n); hash != (common.Hash{}) {
+			t.Errorf("canonical hash #%d not removed", n)
+		}
+	}
+	if data, _ := db.Get(quarantineKey(headerHashKey(8))); common.BytesToHash(data) != hashes[8] {
+		t.Errorf("canonical hash #8 not quarantined")
+	}
+	if report := CheckChainConsistency(db, 1024, true); !report.Consistent() {
+		t.Errorf("repaired database reported issues: %+v", report.Issues)
+	}
+}
+
+// Tests that a missing body only rewinds the head block markers.
+func TestChainConsistencyMissingBody(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	hashes := makeConsistencyChain(db, 10)
+	DeleteBody(db, hashes[5], 5)
+
+	report := CheckChainConsistency(db, 1024, true)
+	if len(report.Issues) != 1 || report.Issues[0].Number != 5 || report.Issues[0].Problem != "missing body" {
+		t.Fatalf("issues mismatch: %+v", report.Issues)
+	}
+	if report.HeadHeader != hashes[10] {
+		t.Errorf("head header rewound")
+	}
+	if report.HeadBlock != hashes[4] || report.HeadFastBlock != hashes[4] {
+		t.Errorf("head block not rewound: have %x, want %x", report.HeadBlock, hashes[4])
+	}
+	if report.Quarantined != 0 {
+		t.Errorf("canonical hashes quarantined: %d", report.Quarantined)
+	}
+}
+
+// Tests that a header not linking to its canonical parent is detected.
+func TestChainConsistencyBrokenLink(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	hashes := makeConsistencyChain(db, 10)
+
+	// Replace the canonical block #8 with one on a side chain
+	side := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(8), Extra: []byte("side")})
+	WriteBlock(db, side)
+	WriteCanonicalHash(db, side.Hash(), 8)
+
+	report := CheckChainConsistency(db, 1024, true)
+	if len(report.Issues) != 1 || report.Issues[0].Number != 8 || report.Issues[0].Problem != "parent hash mismatch" {
+		t.Fatalf("issues mismatch: %+v", report.Issues)
+	}
+	if report.HeadHeader != hashes[7] || report.HeadBlock != hashes[7] {
+		t.Errorf("head markers not rewound")
+	}
+}
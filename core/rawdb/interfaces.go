@@ -31,3 +31,10 @@ type DatabaseWriter interface {
 type DatabaseDeleter interface {
 	Delete(key []byte) error
 }
+
+// Database wraps the read, write and delete methods of a backing data store.
+type Database interface {
+	DatabaseReader
+	DatabaseWriter
+	DatabaseDeleter
+}
@@ -29,6 +29,10 @@ var (
 	// databaseVerisionKey tracks the current database version.
 	databaseVerisionKey = []byte("DatabaseVersion")
 
+	// schemaVersionKey tracks the version of the stored data formats, upgraded
+	// in place by the migrations.
+	schemaVersionKey = []byte("SchemaVersion")
+
 	// headHeaderKey tracks the latest know header's hash.
 	headHeaderKey = []byte("LastHeader")
 
@@ -41,6 +45,14 @@ var (
 	// fastTrieProgressKey tracks the number of trie entries imported during fast sync.
 	fastTrieProgressKey = []byte("TrieSync")
 
+	// uncleanShutdownKey is present while a node is running on the database,
+	// surviving a crash or kill.
+	uncleanShutdownKey = []byte("UncleanShutdown")
+
+	// snapshotGeneratorKey tracks the generation and the progress of the flat
+	// state snapshot.
+	snapshotGeneratorKey = []byte("SnapshotGenerator")
+
 	// Data item prefixes (use single byte to avoid mixing data types, avoid `i`, used for indexes).
 	//
 	// 数据项前缀（使用单字节以避免混合数据类型，避免使用“ i”作为索引）
@@ -58,6 +70,12 @@ var (
 	preimagePrefix = []byte("secure-key-")      // preimagePrefix + hash -> preimage
 	configPrefix   = []byte("ethereum-config-") // config prefix for the db
 
+	quarantinePrefix = []byte("quarantine-") // quarantinePrefix + key -> inconsistent entry moved away by the startup check
+	migrationPrefix  = []byte("migration-")  // migrationPrefix + version (uint64 big endian) -> progress of an interrupted migration
+
+	snapshotAccountPrefix = []byte("a") // snapshotAccountPrefix + generation (uint64 big endian) + account hash -> account trie value
+	snapshotStoragePrefix = []byte("o") // snapshotStoragePrefix + generation (uint64 big endian) + account hash + storage hash -> storage trie value
+
 	// Chain index prefixes (use `i` + single byte to avoid mixing data types).
 	BloomBitsIndexPrefix = []byte("iB") // BloomBitsIndexPrefix is the data table of a chain indexer to track its progress
 
@@ -130,6 +148,27 @@ func preimageKey(hash common.Hash) []byte {
 	return append(preimagePrefix, hash.Bytes()...)
 }
 
+// quarantineKey = quarantinePrefix + key
+func quarantineKey(key []byte) []byte {
+	return append(append([]byte{}, quarantinePrefix...), key...)
+}
+
+// snapshotAccountKey = snapshotAccountPrefix + generation (uint64 big endian) + hash
+func snapshotAccountKey(gen uint64, hash common.Hash) []byte {
+	return append(append(append([]byte{}, snapshotAccountPrefix...), encodeBlockNumber(gen)...), hash.Bytes()...)
+}
+
+// snapshotStorageKey = snapshotStoragePrefix + generation (uint64 big endian) + account hash + storage hash
+func snapshotStorageKey(gen uint64, accountHash, storageHash common.Hash) []byte {
+	key := append(append([]byte{}, snapshotStoragePrefix...), encodeBlockNumber(gen)...)
+	return append(append(key, accountHash.Bytes()...), storageHash.Bytes()...)
+}
+
+// migrationKey = migrationPrefix + version (uint64 big endian)
+func migrationKey(version uint64) []byte {
+	return append(append([]byte{}, migrationPrefix...), encodeBlockNumber(version)...)
+}
+
 // configKey = configPrefix + hash
 func configKey(hash common.Hash) []byte {
 	return append(configPrefix, hash.Bytes()...)
@@ -0,0 +1,130 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+var (
+	errReorgTooDeep  = errors.New("reorg deeper than the chain")
+	errReorgTooShort = errors.New("reorg branch not longer than the dropped blocks")
+	errReorgQuit     = errors.New("reorg script aborted")
+)
+
+// ReorgStep is a step of a reorg script. A zero Depth only extends the head by
+// Length blocks, otherwise the last Depth blocks are replaced by a new branch of
+// Length blocks. The step is executed after waiting Delay.
+type ReorgStep struct {
+	Depth  int
+	Length int
+	Delay  time.Duration
+}
+
+// ReorgSimulator drives a BlockChain through scripted reorgs, so the consumers
+// of the chain events (e.g. the les announcements, the client fetcher and the
+// transaction pool) can be tested against reorgs of a given depth and speed.
+//
+// Like GenerateChain, it creates blocks without valid proof of work, the chain
+// must be using FakePow or a similar non-validating engine.
+//
+/**
+ReorgSimulator: 测试工具
+	按脚本 驱动 BlockChain 发生指定 深度 和 速度 的 reorg (分叉切换),
+	由 BlockChain 发出的 ChainHeadEvent / ChainSideEvent 等事件 驱动 les 的 announce, fetcher 和 txpool 的 reorg 处理,
+	使这些逻辑 可以在 CI 中 测试, 而不只是在 真实网络中 碰到
+ */
+type ReorgSimulator struct {
+	chain  *BlockChain
+	engine consensus.Engine
+	db     ethdb.Database
+
+	branch int // counter keeping the blocks of the branches distinct
+}
+
+// NewReorgSimulator creates a simulator extending and reorganising the given
+// chain, db must be the database of the chain.
+func NewReorgSimulator(chain *BlockChain, engine consensus.Engine, db ethdb.Database) *ReorgSimulator {
+	return &ReorgSimulator{chain: chain, engine: engine, db: db}
+}
+
+// Extend appends n blocks to the current head, returning the inserted blocks.
+func (s *ReorgSimulator) Extend(n int) ([]*types.Block, error) {
+	return s.Reorg(0, n)
+}
+
+// Reorg replaces the last depth blocks of the canonical chain by a new branch of
+// length blocks, returning the blocks of the branch. The branch must be longer
+// than the dropped blocks to have a higher total difficulty.
+func (s *ReorgSimulator) Reorg(depth, length int) ([]*types.Block, error) {
+	head := s.chain.CurrentBlock().NumberU64()
+	if uint64(depth) > head {
+		return nil, errReorgTooDeep
+	}
+	if length <= depth {
+		return nil, errReorgTooShort
+	}
+	parent := s.chain.GetBlockByNumber(head - uint64(depth))
+
+	// GenerateChain reads the state of the parent from the database, flush it
+	// if the chain only kept it in memory.
+	if _, err := state.New(parent.Root(), state.NewDatabase(s.db)); err != nil {
+		if err := s.chain.stateCache.TrieDB().Commit(parent.Root(), false); err != nil {
+			return nil, err
+		}
+	}
+	s.branch++
+	var (
+		coinbase = common.BigToAddress(common.Big1)
+		extra    = []byte(fmt.Sprintf("reorgsim branch %d", s.branch))
+	)
+	coinbase[0] = byte(s.branch)
+
+	blocks, _ := GenerateChain(s.chain.Config(), parent, s.engine, s.db, length, func(i int, b *BlockGen) {
+		b.SetCoinbase(coinbase)
+		b.SetExtra(extra)
+	})
+	if _, err := s.chain.InsertChain(blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// Run executes a reorg script, returning early if quit is closed.
+func (s *ReorgSimulator) Run(script []ReorgStep, quit <-chan struct{}) error {
+	for i, step := range script {
+		if step.Delay > 0 {
+			select {
+			case <-time.After(step.Delay):
+			case <-quit:
+				return errReorgQuit
+			}
+		}
+		if _, err := s.Reorg(step.Depth, step.Length); err != nil {
+			return fmt.Errorf("reorg step %d: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
+)
+
+// Tests that the simulator switches the canonical chain to the new branches and
+// emits the side events of the dropped blocks.
+func TestReorgSimulator(t *testing.T) {
+	var (
+		db     = ethdb.NewMemDatabase()
+		engine = ethash.NewFaker()
+	)
+	(&Genesis{Config: params.TestChainConfig}).MustCommit(db)
+	chain, err := NewBlockChain(db, nil, params.TestChainConfig, engine, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	sideCh := make(chan ChainSideEvent, 16)
+	sub := chain.SubscribeChainSideEvent(sideCh)
+	defer sub.Unsubscribe()
+
+	sim := NewReorgSimulator(chain, engine, db)
+	if _, err := sim.Extend(5); err != nil {
+		t.Fatalf("failed to extend chain: %v", err)
+	}
+	old := chain.GetBlockByNumber(4)
+
+	branch, err := sim.Reorg(2, 3)
+	if err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != branch[2].Hash() || head.NumberU64() != 6 {
+		t.Fatalf("head mismatch: have #%d %x, want #6 %x", head.NumberU64(), head.Hash(), branch[2].Hash())
+	}
+	if chain.GetBlockByNumber(4).Hash() == old.Hash() {
+		t.Fatalf("dropped block still canonical")
+	}
+	// The side events are delivered asynchronously
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-sideCh:
+			if n := ev.Block.NumberU64(); n != 4 && n != 5 {
+				t.Fatalf("side event of block #%d", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("side event %d missing", i)
+		}
+	}
+	// Branches must outweigh the dropped blocks and fit into the chain
+	if _, err := sim.Reorg(2, 2); err != errReorgTooShort {
+		t.Fatalf("equal length reorg error mismatch: have %v, want %v", err, errReorgTooShort)
+	}
+	if _, err := sim.Reorg(7, 8); err != errReorgTooDeep {
+		t.Fatalf("deep reorg error mismatch: have %v, want %v", err, errReorgTooDeep)
+	}
+	// Scripts run the steps in order
+	script := []ReorgStep{{Length: 1}, {Depth: 1, Length: 2, Delay: time.Millisecond}}
+	if err := sim.Run(script, nil); err != nil {
+		t.Fatalf("failed to run script: %v", err)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != 8 {
+		t.Fatalf("head number mismatch after script: have %d, want 8", head)
+	}
+}
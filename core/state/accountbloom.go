@@ -0,0 +1,249 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+const (
+	// accountBloomHashes is the number of bits set per account in the filter.
+	accountBloomHashes = 4
+
+	// maxBloomRoots is the number of covered state roots remembered by the
+	// filter, the oldest ones stop using it when exceeded.
+	maxBloomRoots = 1024
+)
+
+// accountBloomSkipCounter counts the account reads answered by the filter
+// without resolving the trie.
+var accountBloomSkipCounter = metrics.NewRegisteredCounter("state/accountbloom/skip", nil)
+
+// AccountBloom is a bloom filter of the hashes of the existing accounts, telling
+// the reads of missing accounts apart without a walk down the account trie. It
+// is generated in the background from the trie of a state root and extended by
+// the state commits on top of it.
+//
+// Only the states descending from the generation root through the commits seen
+// by the filter are covered, since accounts only present in other states (e.g.
+// ones deleted before the generation root) are missing from it. Reads of the
+// other states always fall back to the trie.
+//
+/**
+AccountBloom:
+已存在账户 (addrHash) 的 bloom 过滤器, 用于快速判断 "账户不存在", 避免 trie 的逐层查找
+(例如 les server 上交易校验时大量的 不存在账户 检查).
+后台从某个 state root 的 trie 遍历生成, 之后每次 commit 把新写入的账户加进来;
+只有 从生成时的 root 经过 commit 派生出来的 state 才会使用它 (其他 state 可能含有 bloom 中没有的账户)
+*/
+type AccountBloom struct {
+	triedb *trie.Database
+	bits   []uint64
+
+	root    common.Hash              // generation root
+	ready   bool                     // whether the generation finished
+	covered map[common.Hash]struct{} // state roots whose accounts are all in the filter
+	order   []common.Hash            // covered roots in insertion order, for eviction
+
+	quit chan struct{} // closed to abort the running generation
+	wg   sync.WaitGroup
+	lock sync.RWMutex
+}
+
+// NewAccountBloom creates an empty account filter of the given size in bytes,
+// resolving the tries through triedb. It doesn't answer any reads until it is
+// generated for a state root with Rebuild.
+func NewAccountBloom(triedb *trie.Database, size uint64) *AccountBloom {
+	if size < 8 {
+		size = 8
+	}
+	return &AccountBloom{
+		triedb:  triedb,
+		bits:    make([]uint64, size/8),
+		covered: make(map[common.Hash]struct{}),
+	}
+}
+
+// Rebuild makes the filter cover the given state root. If the root is covered
+// already nothing happens, otherwise the filter is generated from its account
+// trie in the background.
+func (b *AccountBloom) Rebuild(root common.Hash) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.covered[root]; ok {
+		return
+	}
+	if b.quit != nil {
+		close(b.quit)
+	}
+	log.Info("Generating account bloom filter", "root", root)
+
+	// Set bits are kept, stale accounts only cause false positives
+	b.root, b.ready = root, false
+	b.covered, b.order = make(map[common.Hash]struct{}), nil
+	b.cover(root)
+
+	b.quit = make(chan struct{})
+	b.wg.Add(1)
+	go b.generate(root, b.quit)
+}
+
+// Stop terminates the background generation.
+func (b *AccountBloom) Stop() {
+	b.lock.Lock()
+	if b.quit != nil {
+		close(b.quit)
+		b.quit = nil
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+}
+
+// generate adds the accounts of the trie of root to the filter.
+func (b *AccountBloom) generate(root common.Hash, quit chan struct{}) {
+	defer b.wg.Done()
+
+	tr, err := trie.New(root, b.triedb)
+	if err != nil {
+		log.Warn("Account bloom filter generation failed", "root", root, "err", err)
+		return
+	}
+	var (
+		it       = tr.NodeIterator(nil)
+		accounts int
+	)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		b.lock.Lock()
+		b.add(common.BytesToHash(it.LeafKey()))
+		b.lock.Unlock()
+
+		if accounts++; accounts%10000 == 0 {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+		}
+	}
+	if it.Error() != nil {
+		log.Warn("Account bloom filter generation failed", "root", root, "err", it.Error())
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	select {
+	case <-quit:
+		return
+	default:
+	}
+	b.ready = true
+	log.Info("Generated account bloom filter", "root", root, "accounts", accounts)
+}
+
+// mayContain reports whether the account may exist in the given state. It only
+// returns false if the state is covered and the account is missing for sure.
+func (b *AccountBloom) mayContain(root, addrHash common.Hash) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if !b.ready {
+		return true
+	}
+	if _, ok := b.covered[root]; !ok {
+		return true
+	}
+	for i := 0; i < accountBloomHashes; i++ {
+		bit := binary.BigEndian.Uint64(addrHash[i*8:]) % uint64(len(b.bits)*64)
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			accountBloomSkipCounter.Inc(1)
+			return false
+		}
+	}
+	return true
+}
+
+// update adds the accounts written by a commit of root on top of parent. The
+// new root is covered if the parent was.
+func (b *AccountBloom) update(parent, root common.Hash, addrHashes []common.Hash) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, hash := range addrHashes {
+		b.add(hash)
+	}
+	if _, ok := b.covered[parent]; ok {
+		b.cover(root)
+	}
+}
+
+// add sets the bits of an account. The caller must hold the write lock.
+func (b *AccountBloom) add(addrHash common.Hash) {
+	for i := 0; i < accountBloomHashes; i++ {
+		bit := binary.BigEndian.Uint64(addrHash[i*8:]) % uint64(len(b.bits)*64)
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// cover marks a state root as covered, evicting the oldest one if the limit is
+// reached. The caller must hold the write lock.
+func (b *AccountBloom) cover(root common.Hash) {
+	if _, ok := b.covered[root]; ok {
+		return
+	}
+	if len(b.order) >= maxBloomRoots {
+		delete(b.covered, b.order[0])
+		b.order = b.order[1:]
+	}
+	b.covered[root] = struct{}{}
+	b.order = append(b.order, root)
+}
+
+// SetAccountBloom installs an account filter consulted by the states opened
+// through the database from now on before their tries, or removes it if nil. It
+// returns false if the database doesn't support account filters.
+func SetAccountBloom(db Database, bloom *AccountBloom) bool {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return false
+	}
+	cdb.mu.Lock()
+	cdb.bloom = bloom
+	cdb.mu.Unlock()
+	return true
+}
+
+// GetAccountBloom returns the account filter installed in the database, if any.
+func GetAccountBloom(db Database) *AccountBloom {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return nil
+	}
+	cdb.mu.Lock()
+	defer cdb.mu.Unlock()
+	return cdb.bloom
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+func TestAccountBloom(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase())
+
+	// Create a state with some accounts and one deleted again
+	state, _ := New(common.Hash{}, db)
+	for i := byte(0); i < 100; i++ {
+		state.AddBalance(common.BytesToAddress([]byte{i}), big.NewInt(int64(i)+1))
+	}
+	old, _ := state.Commit(false)
+	state.Suicide(common.BytesToAddress([]byte{99}))
+	root, _ := state.Commit(false)
+	db.TrieDB().Commit(old, false)
+	db.TrieDB().Commit(root, false)
+
+	bloom := NewAccountBloom(db.TrieDB(), 1024)
+	SetAccountBloom(db, bloom)
+	bloom.Rebuild(root)
+	bloom.wg.Wait()
+
+	hash := func(b byte) common.Hash { return crypto.Keccak256Hash(common.BytesToAddress([]byte{b}).Bytes()) }
+	for i := byte(0); i < 99; i++ {
+		if !bloom.mayContain(root, hash(i)) {
+			t.Fatalf("existing account %d filtered", i)
+		}
+	}
+	skipped := 0
+	for i := byte(100); i < 200; i++ {
+		if !bloom.mayContain(root, hash(i)) {
+			skipped++
+		}
+	}
+	if skipped < 90 {
+		t.Errorf("too few missing accounts filtered: %d", skipped)
+	}
+	// The deleted account of the older state must not be filtered there
+	if !bloom.mayContain(old, hash(99)) {
+		t.Error("account of an uncovered state filtered")
+	}
+	// Commits on top of the covered root are covered, with their new accounts
+	state, _ = New(root, db)
+	state.AddBalance(common.BytesToAddress([]byte{150}), big.NewInt(1))
+	next, _ := state.Commit(false)
+	if !bloom.mayContain(next, hash(150)) {
+		t.Error("committed account filtered")
+	}
+	state, _ = New(next, db)
+	if state.GetBalance(common.BytesToAddress([]byte{150})).Sign() == 0 {
+		t.Error("committed account missing")
+	}
+	if state.Exist(common.BytesToAddress([]byte{151})) && !bloom.mayContain(next, hash(151)) {
+		t.Error("filtered account exists")
+	}
+	// Rebuilding for a covered root is a noop, the filter stays ready
+	bloom.Rebuild(next)
+	if !bloom.ready {
+		t.Error("filter not ready after covered rebuild")
+	}
+	bloom.Stop()
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// DefaultBackend is the name of the state database backend used if none is
+// configured: tries and code cached in memory on top of the key-value store.
+const DefaultBackend = "caching"
+
+// ErrReadOnlyState is returned by the writes of a read-only state database.
+var ErrReadOnlyState = errors.New("state database is read-only")
+
+// Backend creates a state database on top of a key-value store with the given
+// cache sizes.
+type Backend func(db ethdb.Database, config Config) (Database, error)
+
+// registeredBackend is a state database backend in the registry.
+type registeredBackend struct {
+	open  Backend
+	chain bool // whether the backend persists the committed state of a blockchain
+}
+
+// Registry of the known state database backends.
+//
+// 已注册的 state.Database 后端 (按名字), 下游代码通过 Config.Backend 选择, 而不必写死 cachingDB;
+// 不能持久化 state 的后端 (memory, readonly, odr) 不允许用于 BlockChain
+var (
+	backendLock sync.RWMutex
+	backends    = make(map[string]registeredBackend)
+)
+
+func init() {
+	RegisterBackend(DefaultBackend, func(db ethdb.Database, config Config) (Database, error) {
+		return newCachingDB(db, config)
+	})
+	// The state is kept in a private in-memory store, nothing reaches the given
+	// database (tests, throwaway executions)
+	RegisterViewBackend("memory", func(db ethdb.Database, config Config) (Database, error) {
+		return newCachingDB(ethdb.NewMemDatabase(), config)
+	})
+	// The state is read from the given database, flushing it fails
+	RegisterViewBackend("readonly", func(db ethdb.Database, config Config) (Database, error) {
+		return newCachingDB(readOnlyStore{db}, config)
+	})
+}
+
+// RegisterBackend adds a state database backend persisting the committed state
+// to the global registry. It panics if the name is already taken.
+func RegisterBackend(name string, backend Backend) {
+	registerBackend(name, registeredBackend{open: backend, chain: true})
+}
+
+// RegisterViewBackend adds a state database backend not persisting the committed
+// state (kept in memory, read-only or retrieved on demand) to the global registry.
+// Such backends can't be selected for a blockchain. It panics if the name is
+// already taken.
+func RegisterViewBackend(name string, backend Backend) {
+	registerBackend(name, registeredBackend{open: backend})
+}
+
+func registerBackend(name string, backend registeredBackend) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+
+	if _, ok := backends[name]; ok {
+		panic("state backend " + name + " already registered")
+	}
+	backends[name] = backend
+}
+
+// CheckChainBackend returns an error if the named backend (DefaultBackend if
+// empty) is unknown or doesn't persist the committed state, so it can't hold the
+// state of a blockchain.
+func CheckChainBackend(name string) error {
+	if name == "" {
+		name = DefaultBackend
+	}
+	backendLock.RLock()
+	backend, ok := backends[name]
+	backendLock.RUnlock()
+
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown state backend %q (known: %v)", name, Backends())
+	case !backend.chain:
+		return fmt.Errorf("state backend %q can't hold the state of a blockchain", name)
+	}
+	return nil
+}
+
+// Backends returns the names of the registered state database backends.
+func Backends() []string {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenDatabase creates a state database on top of the key-value store with the
+// backend selected by the config, DefaultBackend if none.
+func OpenDatabase(db ethdb.Database, config Config) (Database, error) {
+	name := config.Backend
+	if name == "" {
+		name = DefaultBackend
+	}
+	backendLock.RLock()
+	backend, ok := backends[name]
+	backendLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown state backend %q (known: %v)", name, Backends())
+	}
+	return backend.open(db, config)
+}
+
+// readOnlyStore is a key-value store rejecting all writes.
+type readOnlyStore struct {
+	ethdb.Database
+}
+
+func (s readOnlyStore) Put(key []byte, value []byte) error { return ErrReadOnlyState }
+func (s readOnlyStore) Delete(key []byte) error            { return ErrReadOnlyState }
+func (s readOnlyStore) NewBatch() ethdb.Batch              { return &readOnlyBatch{} }
+
+// GetMany keeps the batched reads of the wrapped store.
+func (s readOnlyStore) GetMany(keys [][]byte) ([][]byte, error) {
+	return ethdb.GetMany(s.Database, keys)
+}
+
+// readOnlyBatch is a batch of a read-only store, it fails to be written if
+// anything was added to it.
+type readOnlyBatch struct {
+	size int
+}
+
+func (b *readOnlyBatch) Put(key []byte, value []byte) error {
+	b.size += len(value)
+	return nil
+}
+
+func (b *readOnlyBatch) Delete(key []byte) error {
+	b.size++
+	return nil
+}
+
+func (b *readOnlyBatch) ValueSize() int { return b.size }
+func (b *readOnlyBatch) Reset()         { b.size = 0 }
+
+func (b *readOnlyBatch) Write() error {
+	if b.size > 0 {
+		return ErrReadOnlyState
+	}
+	return nil
+}
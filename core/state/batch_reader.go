@@ -0,0 +1,197 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// errAccountNotFound is returned when proving the storage of a missing account.
+var errAccountNotFound = errors.New("account not found")
+
+// StorageKey identifies a storage slot of an account.
+type StorageKey struct {
+	Address common.Address
+	Slot    common.Hash
+}
+
+// BatchReader reads many accounts and storage slots of a state at once. The keys
+// are visited in the order of their hashes, the order of the secure tries, so the
+// nodes on shared paths are resolved only once, and the resolved accounts and the
+// opened storage tries are reused by all the reads of the reader.
+//
+// A BatchReader is read only and not safe for concurrent use.
+//
+/**
+BatchReader: 一次性读取 某个 state 的多个 account 与 storage slot.
+按 key 的 hash 顺序 (即 secure trie 中的顺序) 访问, 共享路径上的 node 只解析一次,
+已解析的 account 和 已打开的 storage trie 在该 reader 的所有读取之间复用.
+ */
+type BatchReader struct {
+	db       Database
+	accounts Trie                     // account trie, read by the address hashes
+	objects  map[common.Hash]*Account // resolved accounts by address hash, nil if missing
+	storage  map[common.Hash]Trie     // opened storage tries by address hash
+}
+
+// NewBatchReader creates a reader of the state with the given root. The account
+// trie is opened through the database, reusing its recently committed tries.
+func NewBatchReader(root common.Hash, db Database) (*BatchReader, error) {
+	tr, err := db.OpenTrie(root)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchReader{
+		db:       db,
+		accounts: tr,
+		objects:  make(map[common.Hash]*Account),
+		storage:  make(map[common.Hash]Trie),
+	}, nil
+}
+
+// Account returns the account with the given address hash, or nil if it doesn't
+// exist.
+func (r *BatchReader) Account(addrHash common.Hash) (*Account, error) {
+	if account, ok := r.objects[addrHash]; ok {
+		return account, nil
+	}
+	enc, err := r.accounts.TryGetHashed(addrHash[:])
+	if err != nil {
+		return nil, err
+	}
+	var account *Account
+	if len(enc) > 0 {
+		account = new(Account)
+		if err := rlp.DecodeBytes(enc, account); err != nil {
+			return nil, err
+		}
+	}
+	r.objects[addrHash] = account
+	return account, nil
+}
+
+// ReadAccounts returns the accounts of the given addresses in the order of the
+// addresses, nil for the missing ones.
+func (r *BatchReader) ReadAccounts(addrs []common.Address) ([]*Account, error) {
+	hashes := make([]common.Hash, len(addrs))
+	for i, addr := range addrs {
+		hashes[i] = crypto.Keccak256Hash(addr[:])
+	}
+	accounts := make([]*Account, len(addrs))
+	for _, i := range sortedIndices(len(hashes), func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	}) {
+		account, err := r.Account(hashes[i])
+		if err != nil {
+			return nil, err
+		}
+		accounts[i] = account
+	}
+	return accounts, nil
+}
+
+// ReadStorage returns the values of the given storage slots in the order of the
+// keys. The slots of missing accounts are empty.
+func (r *BatchReader) ReadStorage(keys []StorageKey) ([]common.Hash, error) {
+	addrHashes := make([]common.Hash, len(keys))
+	slotHashes := make([]common.Hash, len(keys))
+	for i, key := range keys {
+		addrHashes[i] = crypto.Keccak256Hash(key.Address[:])
+		slotHashes[i] = crypto.Keccak256Hash(key.Slot[:])
+	}
+	values := make([]common.Hash, len(keys))
+	for _, i := range sortedIndices(len(keys), func(i, j int) bool {
+		if c := bytes.Compare(addrHashes[i][:], addrHashes[j][:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(slotHashes[i][:], slotHashes[j][:]) < 0
+	}) {
+		tr, err := r.storageTrie(addrHashes[i])
+		if err != nil {
+			return nil, err
+		}
+		if tr == nil {
+			continue
+		}
+		enc, err := tr.TryGet(keys[i].Slot[:])
+		if err != nil {
+			return nil, err
+		}
+		if len(enc) > 0 {
+			_, content, _, err := rlp.Split(enc)
+			if err != nil {
+				return nil, err
+			}
+			values[i].SetBytes(content)
+		}
+	}
+	return values, nil
+}
+
+// ProveAccounts collects the merkle proofs of the given (hashed) account keys,
+// see Trie.ProveMulti.
+func (r *BatchReader) ProveAccounts(keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error {
+	return r.accounts.ProveMulti(keys, fromLevel, proofDb)
+}
+
+// ProveStorage collects the merkle proofs of the given (hashed) storage keys of
+// an account, see Trie.ProveMulti.
+func (r *BatchReader) ProveStorage(addrHash common.Hash, keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error {
+	tr, err := r.storageTrie(addrHash)
+	if err != nil {
+		return err
+	}
+	if tr == nil {
+		return errAccountNotFound
+	}
+	return tr.ProveMulti(keys, fromLevel, proofDb)
+}
+
+// storageTrie returns the storage trie of an account, or nil if the account
+// doesn't exist.
+func (r *BatchReader) storageTrie(addrHash common.Hash) (Trie, error) {
+	if tr, ok := r.storage[addrHash]; ok {
+		return tr, nil
+	}
+	account, err := r.Account(addrHash)
+	if err != nil || account == nil {
+		return nil, err
+	}
+	tr, err := r.db.OpenStorageTrie(addrHash, account.Root)
+	if err != nil {
+		return nil, err
+	}
+	r.storage[addrHash] = tr
+	return tr, nil
+}
+
+// sortedIndices returns the indices 0..n-1 sorted by the given order.
+func sortedIndices(n int, less func(i, j int) bool) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return less(order[a], order[b]) })
+	return order
+}
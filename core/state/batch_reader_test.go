@@ -0,0 +1,117 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// Tests that the batch reader returns the same accounts and storage slots as the
+// state, and that its proofs verify against the state root.
+func TestBatchReader(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase())
+	state, _ := New(common.Hash{}, db)
+
+	var (
+		addrs []common.Address
+		keys  []StorageKey
+	)
+	for i := 0; i < 20; i++ {
+		addr := common.Address{byte(i), 1}
+		state.AddBalance(addr, big.NewInt(int64(i+1)))
+		state.SetNonce(addr, uint64(i))
+		for j := 0; j < i%4; j++ {
+			slot := common.Hash{byte(j), 2}
+			state.SetState(addr, slot, common.Hash{byte(i), byte(j + 1)})
+			keys = append(keys, StorageKey{addr, slot})
+		}
+		// Missing slots of existing accounts
+		keys = append(keys, StorageKey{addr, common.Hash{0xff}})
+		addrs = append(addrs, addr)
+	}
+	root, err := state.Commit(false)
+	if err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	// Missing accounts
+	addrs = append(addrs, common.Address{0xff})
+	keys = append(keys, StorageKey{common.Address{0xff}, common.Hash{1}})
+
+	reader, err := NewBatchReader(root, db)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	accounts, err := reader.ReadAccounts(addrs)
+	if err != nil {
+		t.Fatalf("failed to read accounts: %v", err)
+	}
+	state, _ = New(root, db)
+	for i, addr := range addrs {
+		if !state.Exist(addr) {
+			if accounts[i] != nil {
+				t.Errorf("account %x: missing account returned", addr)
+			}
+			continue
+		}
+		if accounts[i] == nil || accounts[i].Nonce != state.GetNonce(addr) || accounts[i].Balance.Cmp(state.GetBalance(addr)) != 0 {
+			t.Errorf("account %x: mismatch: have %+v", addr, accounts[i])
+		}
+	}
+	values, err := reader.ReadStorage(keys)
+	if err != nil {
+		t.Fatalf("failed to read storage: %v", err)
+	}
+	for i, key := range keys {
+		if want := state.GetState(key.Address, key.Slot); values[i] != want {
+			t.Errorf("slot %x/%x: value mismatch: have %x, want %x", key.Address, key.Slot, values[i], want)
+		}
+	}
+	// Prove a few accounts and the storage of one of them
+	var hashed [][]byte
+	for _, addr := range addrs[:5] {
+		hashed = append(hashed, crypto.Keccak256(addr[:]))
+	}
+	proof := ethdb.NewMemDatabase()
+	if err := reader.ProveAccounts(hashed, 0, proof); err != nil {
+		t.Fatalf("failed to prove accounts: %v", err)
+	}
+	for _, key := range hashed {
+		if _, _, err := trie.VerifyProof(root, key, proof); err != nil {
+			t.Errorf("account proof of %x invalid: %v", key, err)
+		}
+	}
+	addrHash := crypto.Keccak256Hash(addrs[3][:])
+	slots := [][]byte{crypto.Keccak256(common.Hash{0, 2}.Bytes()), crypto.Keccak256(common.Hash{2, 2}.Bytes())}
+	proof = ethdb.NewMemDatabase()
+	if err := reader.ProveStorage(addrHash, slots, 0, proof); err != nil {
+		t.Fatalf("failed to prove storage: %v", err)
+	}
+	for _, key := range slots {
+		if _, _, err := trie.VerifyProof(accounts[3].Root, key, proof); err != nil {
+			t.Errorf("storage proof of %x invalid: %v", key, err)
+		}
+	}
+	if err := reader.ProveStorage(crypto.Keccak256Hash([]byte{0xff}), slots, 0, proof); err != errAccountNotFound {
+		t.Errorf("storage of missing account proven: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+const (
+	// minTrieCacheGen is the number of trie node generations kept in memory when
+	// the trie database is at its memory limit.
+	minTrieCacheGen = 2
+
+	// cacheGenPressure is the fraction of the memory limit above which the cache
+	// generations start to be reduced.
+	cacheGenPressure = 0.5
+)
+
+// cacheGenGauge reports the current trie cache generation limit of the account tries.
+var cacheGenGauge = metrics.NewRegisteredGauge("state/cachegen", nil)
+
+// cacheGenController picks the number of trie node generations the account tries
+// keep in memory from the memory usage of the trie database. Up to half of the
+// memory limit the configured generations are kept, above that the limit is
+// lowered linearly down to minTrieCacheGen, so that the nodes are unloaded more
+// aggressively as the trie database approaches its budget.
+//
+// cacheGenController: 根据 trie.Database 的内存占用 动态调整 cachelimit (代替固定的 MaxTrieCacheGen),
+// 内存占用 超过 limit 的一半后 线性减少 保留的代数, 到达 limit 时 只保留 minTrieCacheGen 代
+type cacheGenController struct {
+	db    *trie.Database
+	max   uint16             // generations kept without memory pressure
+	limit common.StorageSize // memory usage of the trie database at which minTrieCacheGen is used, zero for static
+}
+
+// newCacheGenController creates a controller keeping at most max generations,
+// limit is the memory ceiling in bytes of the trie database.
+func newCacheGenController(db *trie.Database, max uint16, limit uint64) *cacheGenController {
+	return &cacheGenController{db: db, max: max, limit: common.StorageSize(limit)}
+}
+
+// gen returns the cache generation limit to open the tries with.
+func (c *cacheGenController) gen() uint16 {
+	if c.limit == 0 || c.max <= minTrieCacheGen {
+		return c.max
+	}
+	size, _ := c.db.Size()
+	gen := cacheGenFor(size, c.limit, c.max)
+	cacheGenGauge.Update(int64(gen))
+	return gen
+}
+
+// cacheGenFor calculates the generation limit for the given memory usage.
+func cacheGenFor(size, limit common.StorageSize, max uint16) uint16 {
+	low := limit * cacheGenPressure
+	switch {
+	case size <= low:
+		return max
+	case size >= limit:
+		return minTrieCacheGen
+	}
+	span := float64(max - minTrieCacheGen)
+	return max - uint16(span*float64(size-low)/float64(limit-low))
+}
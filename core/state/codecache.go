@@ -0,0 +1,77 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// codeCache is an LRU cache of contract code keyed by code hash, bounded by the
+// total size of the cached code instead of the number of entries.
+//
+/**
+codeCache:
+按 codeHash 缓存完整的合约 code, 以 code 的总字节数 (而不是条目数) 作为上限,
+热点合约在 EVM 执行时无需反复从 trie.Database 中查找
+*/
+type codeCache struct {
+	lock   sync.Mutex
+	lru    *simplelru.LRU // code hash -> []byte
+	size   int            // total size of the cached code
+	budget int            // maximum total size of the cached code
+}
+
+// newCodeCache creates a contract code cache holding at most budget bytes.
+func newCodeCache(budget int) *codeCache {
+	c := &codeCache{budget: budget}
+	c.lru, _ = simplelru.NewLRU(math.MaxInt32, func(key, value interface{}) {
+		c.size -= len(value.([]byte))
+	})
+	return c
+}
+
+// get retrieves the code of the given hash from the cache.
+func (c *codeCache) get(codeHash common.Hash) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if code, ok := c.lru.Get(codeHash); ok {
+		return code.([]byte), true
+	}
+	return nil, false
+}
+
+// add inserts the code of the given hash into the cache, evicting the least
+// recently used code until the cache fits its budget. Code larger than the whole
+// budget is not cached.
+func (c *codeCache) add(codeHash common.Hash, code []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(code) > c.budget || c.lru.Contains(codeHash) {
+		return
+	}
+	c.lru.Add(codeHash, code)
+	c.size += len(code)
+	for c.size > c.budget {
+		c.lru.RemoveOldest()
+	}
+}
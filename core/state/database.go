@@ -17,16 +17,21 @@
 package state
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
 	lru "github.com/hashicorp/golang-lru"
 )
 
 // Trie cache generation limit after which to evict trie nodes from memory.   ·Trie· 缓存生成限制，之后将 对应的 trie nodes 从内存中逐出
+// It is the default upper bound, the generations actually used may be lowered
+// under memory pressure if Config.TrieCacheLimit is set.
 var MaxTrieCacheGen = uint16(120)
 
 const (
@@ -36,6 +41,27 @@ const (
 
 	// Number of codehash->size associations to keep.
 	codeSizeCacheSize = 100000
+
+	// Total size in bytes of the contract code to keep.
+	codeCacheSize = 64 * 1024 * 1024
+
+	// Number of opened storage tries to keep, keyed by their root.
+	maxStorageTries = 4096
+)
+
+// Counters of the caches of the state database, for tuning maxPastTries and
+// codeSizeCacheSize against real workloads.
+//
+// pastTries 和 codeSizeCache 的命中/未命中 计数, 用于根据实际负载调整 maxPastTries 与 codeSizeCacheSize
+var (
+	pastTrieHitCounter  = metrics.NewRegisteredCounter("state/pasttries/hit", nil)
+	pastTrieMissCounter = metrics.NewRegisteredCounter("state/pasttries/miss", nil)
+	codeSizeHitCounter  = metrics.NewRegisteredCounter("state/codesize/hit", nil)
+	codeSizeMissCounter = metrics.NewRegisteredCounter("state/codesize/miss", nil)
+	codeHitCounter      = metrics.NewRegisteredCounter("state/code/hit", nil)
+	codeMissCounter     = metrics.NewRegisteredCounter("state/code/miss", nil)
+	storageHitCounter   = metrics.NewRegisteredCounter("state/storagetries/hit", nil)
+	storageMissCounter  = metrics.NewRegisteredCounter("state/storagetries/miss", nil)
 )
 
 // Database wraps access to tries and contract code.
@@ -52,6 +78,10 @@ type Database interface {
 	// ContractCode retrieves a particular contract's code.
 	ContractCode(addrHash, codeHash common.Hash) ([]byte, error)
 
+	// ContractCodes retrieves the codes of several contracts in one go. The codes
+	// not found are left nil and the error of the first one is returned.
+	ContractCodes(addrHashes, codeHashes []common.Hash) ([][]byte, error)
+
 	// ContractCodeSize retrieves a particular contracts code's size.
 	ContractCodeSize(addrHash, codeHash common.Hash) (int, error)
 
@@ -62,6 +92,8 @@ type Database interface {
 // Trie is a Ethereum Merkle Trie.
 type Trie interface {
 	TryGet(key []byte) ([]byte, error)
+	// TryGetHashed returns the value of an already hashed key
+	TryGetHashed(hashedKey []byte) ([]byte, error)
 	TryUpdate(key, value []byte) error
 	TryDelete(key []byte) error
 	Commit(onleaf trie.LeafCallback) (common.Hash, error)
@@ -69,6 +101,11 @@ type Trie interface {
 	NodeIterator(startKey []byte) trie.NodeIterator
 	GetKey([]byte) []byte // TODO(fjl): remove this when SecureTrie is removed
 	Prove(key []byte, fromLevel uint, proofDb ethdb.Putter) error
+	// ProveMulti generates the proofs of several keys, traversing shared paths once
+	ProveMulti(keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error
+	// ProveRange generates the proofs of all the (hashed) keys in a range, along
+	// with the boundary proofs
+	ProveRange(start, end []byte, proofDb ethdb.Putter) error
 }
 
 // NewDatabase creates a backing store for state. The returned database is safe for
@@ -79,13 +116,73 @@ type Trie interface {
 对 db 的封装
  */
 func NewDatabase(db ethdb.Database) Database {
+	return NewDatabaseWithConfig(db, Config{})
+}
+
+// Config contains the cache sizes of a state database. Zero fields select the
+// defaults.
+type Config struct {
+	PastTries      int    // Number of committed account tries kept for reuse
+	CodeSizeCache  int    // Number of codehash->size associations to keep
+	CodeCache      int    // Total size in bytes of the contract code to keep
+	StorageTries   int    // Number of opened storage tries to keep
+	TrieCacheGen   uint16 // Trie node generations kept in memory, MaxTrieCacheGen if zero
+	TrieCacheSize  uint64 // Bytes of account trie nodes kept in memory, replaces TrieCacheGen if non-zero
+	TrieCacheLimit uint64 // Bytes of trie database memory at which the fewest generations are kept, zero for static
+	Backend        string // Name of the registered backend creating the database, DefaultBackend if empty
+
+	// 叶子节点 承诺 value 的格式 (实验用, 由 chain config 决定), 零值为 以太坊标准格式
+	Commitment trie.CommitmentVersion // Leaf format of the state tries, trie.CommitmentPlain if zero
+}
+
+// NewDatabaseWithConfig creates a backing store for state like NewDatabase,
+// with the given cache sizes and backend. It panics if the backend is unknown,
+// use OpenDatabase to handle the error.
+//
+// 例如 archive 节点 与 light server 可以使用不同的 cache 大小
+func NewDatabaseWithConfig(db ethdb.Database, config Config) Database {
+	sdb, err := OpenDatabase(db, config)
+	if err != nil {
+		panic(err)
+	}
+	return sdb
+}
+
+// newCachingDB creates the default state database, caching tries and code in
+// memory on top of the key-value store.
+func newCachingDB(db ethdb.Database, config Config) (*cachingDB, error) {
+	if config.PastTries <= 0 {
+		config.PastTries = maxPastTries
+	}
+	if config.CodeSizeCache <= 0 {
+		config.CodeSizeCache = codeSizeCacheSize
+	}
+	if config.CodeCache <= 0 {
+		config.CodeCache = codeCacheSize
+	}
+	if config.StorageTries <= 0 {
+		config.StorageTries = maxStorageTries
+	}
+	if config.TrieCacheGen == 0 {
+		config.TrieCacheGen = MaxTrieCacheGen
+	}
 	/** 封装了 10 W 字节的 lru缓存 */
-	csc, _ := lru.New(codeSizeCacheSize)  // 10W 大小的 lru 缓存, 用来存储 codeHash 和code 的
+	csc, _ := lru.New(config.CodeSizeCache)  // 默认 10W 大小的 lru 缓存, 用来存储 codeHash 和code 的
+	st, _ := lru.New(config.StorageTries)
+	triedb := trie.NewDatabase(db)
+	if err := triedb.SetCommitment(config.Commitment); err != nil {
+		return nil, err
+	}
 	return &cachingDB{  // todo 这个 cachingDB 最终会被各个StateDB 引用着 ...
-		db:            trie.NewDatabase(db),
+		db:            triedb,
 		// 存放 code 的缓存
 		codeSizeCache: csc,
-	}
+		codeCache:     newCodeCache(config.CodeCache),
+		storageTries:  st,
+		maxPastTries:  config.PastTries,
+		cacheGen:      newCacheGenController(triedb, config.TrieCacheGen, config.TrieCacheLimit),
+		cacheSize:     config.TrieCacheSize,
+	}, nil
 }
 
 // cachingDB 中 也有 SecureTrie 数组  和  LRU 缓存(存放codeHash和code的)
@@ -94,6 +191,52 @@ type cachingDB struct {
 	mu            sync.Mutex
 	pastTries     []*trie.SecureTrie  // 这里装的是 各个 版本的 StateDB Trie <StateDB 的Trie是 cachedTire 但是最终也是一颗 SecureTrie>
 	codeSizeCache *lru.Cache // LRU 缓存(存放codeHash和code的)
+	codeCache     *codeCache   // contract code bounded by total size
+	storageTries  *lru.Cache   // storage root -> *trie.SecureTrie, never modified, only copied
+	heat          *TrieHeatMap // optional node access statistics of the opened tries
+	snap          *Snapshot    // optional flat state consulted before the tries
+	bloom         *AccountBloom // optional filter of the existing accounts consulted before the tries
+	maxPastTries  int          // number of past tries to keep
+	cacheGen      *cacheGenController // trie node generations kept in memory by the account tries
+	cacheSize     uint64       // bytes of trie nodes kept in memory by the account tries, zero for generations
+}
+
+// SetTrieHeatMap installs a heat map recording the node loads of the tries opened
+// through the database from now on, or removes it if nil. It returns false if the
+// database doesn't support access tracking.
+func SetTrieHeatMap(db Database, heat *TrieHeatMap) bool {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return false
+	}
+	cdb.mu.Lock()
+	cdb.heat = heat
+	cdb.mu.Unlock()
+	return true
+}
+
+// GetTrieHeatMap returns the heat map installed in the database, if any.
+func GetTrieHeatMap(db Database) *TrieHeatMap {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return nil
+	}
+	cdb.mu.Lock()
+	defer cdb.mu.Unlock()
+	return cdb.heat
+}
+
+// trackTrie sets up the node access recording of a trie of the given owner. The
+// resolved root node is counted as well if it has just been loaded.
+func (db *cachingDB) trackTrie(tr *trie.SecureTrie, owner, root common.Hash, loaded bool) {
+	if db.heat == nil {
+		tr.SetResolveHook(nil)
+		return
+	}
+	tr.SetResolveHook(db.heat.hook(owner))
+	if loaded && root != (common.Hash{}) && root != types.EmptyRootHash {
+		db.heat.record(owner, nil)
+	}
 }
 
 // OpenTrie opens the main account trie.
@@ -103,13 +246,23 @@ func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
 
 	for i := len(db.pastTries) - 1; i >= 0; i-- {   // 优先 从全局的 SecureTrie 缓存中 获取 被 上一个block 中 被commit 的 StateDB Trie
 		if db.pastTries[i].Hash() == root {
-			return cachedTrie{db.pastTries[i].Copy(), db}, nil // 封装成 cachedTrie
+			tr := db.pastTries[i].Copy()
+			tr.SetCacheLimit(db.cacheGen.gen())
+			db.trackTrie(tr, common.Hash{}, root, false)
+			pastTrieHitCounter.Inc(1)
+			return cachedTrie{tr, db}, nil // 封装成 cachedTrie
 		}
 	}
-	tr, err := trie.NewSecure(root, db.db, MaxTrieCacheGen)  // cachelimit = 120
+	pastTrieMissCounter.Inc(1)
+	tr, err := trie.NewSecure(root, db.db, db.cacheGen.gen())  // cachelimit 默认为 120, 内存压力下 会降低
 	if err != nil {
 		return nil, err
 	}
+	if db.cacheSize > 0 {
+		// 按 字节预算 (而非 generation 数) 卸载 node
+		tr.SetCachePolicy(trie.ByteBudgetPolicy(db.cacheSize))
+	}
+	db.trackTrie(tr, common.Hash{}, root, true)
 	return cachedTrie{tr, db}, nil
 }
 
@@ -117,7 +270,12 @@ func (db *cachingDB) pushTrie(t *trie.SecureTrie) { // 将 某个 SecureTrie 放
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if len(db.pastTries) >= maxPastTries {
+	db.pushTrieLocked(t)
+}
+
+// pushTrieLocked is the locked version of pushTrie.
+func (db *cachingDB) pushTrieLocked(t *trie.SecureTrie) {
+	if len(db.pastTries) >= db.maxPastTries {
 		copy(db.pastTries, db.pastTries[1:])
 		db.pastTries[len(db.pastTries)-1] = t
 	} else {
@@ -125,9 +283,32 @@ func (db *cachingDB) pushTrie(t *trie.SecureTrie) { // 将 某个 SecureTrie 放
 	}
 }
 
-// OpenStorageTrie opens the storage trie of an account.
+// OpenStorageTrie opens the storage trie of an account. The tries with resolved
+// roots are cached by root and every caller gets an independent copy, so it is
+// safe to call concurrently from copies of a StateDB.
+//
+// 按 storage root 缓存已解析 root 的 storage trie (类似 pastTries), 每次返回一个副本,
+// 避免 block 处理过程中反复解析同一个 trie root
 func (db *cachingDB) OpenStorageTrie(addrHash, root common.Hash) (Trie, error) {  // 打开 StateObject Trie
-	return trie.NewSecure(root, db.db, 0)
+	if cached, ok := db.storageTries.Get(root); ok {
+		storageHitCounter.Inc(1)
+		tr := cached.(*trie.SecureTrie).Copy()
+		db.mu.Lock()
+		db.trackTrie(tr, addrHash, root, false)
+		db.mu.Unlock()
+		return tr, nil
+	}
+	storageMissCounter.Inc(1)
+	tr, err := trie.NewSecure(root, db.db, 0)
+	if err != nil {
+		return nil, err
+	}
+	db.storageTries.Add(root, tr.Copy())
+
+	db.mu.Lock()
+	db.trackTrie(tr, addrHash, root, true)
+	db.mu.Unlock()
+	return tr, nil
 }
 
 // CopyTrie returns an independent copy of the given trie.
@@ -144,18 +325,71 @@ func (db *cachingDB) CopyTrie(t Trie) Trie {
 
 // ContractCode retrieves a particular contract's code.
 func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
+	if code, ok := db.codeCache.get(codeHash); ok {
+		codeHitCounter.Inc(1)
+		return code, nil
+	}
+	codeMissCounter.Inc(1)
 	code, err := db.db.Node(codeHash)
 	if err == nil {
 		db.codeSizeCache.Add(codeHash, len(code))
+		db.codeCache.add(codeHash, code)
 	}
 	return code, err
 }
 
+// ContractCodes retrieves the codes of several contracts, reading the ones not
+// cached from the database in one batch.
+//
+// 批量获取 code: 先查 codeCache, 未命中的一次性从 db 读取 (tracer 与 les server 的 GetCode 使用)
+func (db *cachingDB) ContractCodes(addrHashes, codeHashes []common.Hash) ([][]byte, error) {
+	var (
+		codes  = make([][]byte, len(codeHashes))
+		hashes []common.Hash
+		misses []int
+	)
+	for i, codeHash := range codeHashes {
+		if bytes.Equal(codeHash[:], emptyCodeHash) {
+			continue
+		}
+		if code, ok := db.codeCache.get(codeHash); ok {
+			codeHitCounter.Inc(1)
+			codes[i] = code
+			continue
+		}
+		codeMissCounter.Inc(1)
+		hashes = append(hashes, codeHash)
+		misses = append(misses, i)
+	}
+	if len(hashes) == 0 {
+		return codes, nil
+	}
+	fetched, err := db.db.NodeBatch(hashes)
+	if err != nil {
+		return codes, err
+	}
+	for i, index := range misses {
+		code := fetched[i]
+		if code == nil {
+			if err == nil {
+				err = fmt.Errorf("contract code %x not found", hashes[i])
+			}
+			continue
+		}
+		db.codeSizeCache.Add(hashes[i], len(code))
+		db.codeCache.add(hashes[i], code)
+		codes[index] = code
+	}
+	return codes, err
+}
+
 // ContractCodeSize retrieves a particular contracts code's size.
 func (db *cachingDB) ContractCodeSize(addrHash, codeHash common.Hash) (int, error) {
 	if cached, ok := db.codeSizeCache.Get(codeHash); ok {
+		codeSizeHitCounter.Inc(1)
 		return cached.(int), nil
 	}
+	codeSizeMissCounter.Inc(1)
 	code, err := db.ContractCode(addrHash, codeHash)
 	return len(code), err
 }
@@ -188,3 +422,11 @@ func (m cachedTrie) Commit(onleaf trie.LeafCallback) (common.Hash, error) {
 func (m cachedTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.Putter) error {
 	return m.SecureTrie.Prove(key, fromLevel, proofDb)
 }
+
+func (m cachedTrie) ProveMulti(keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error {
+	return m.SecureTrie.ProveMulti(keys, fromLevel, proofDb)
+}
+
+func (m cachedTrie) ProveRange(start, end []byte, proofDb ethdb.Putter) error {
+	return m.SecureTrie.ProveRange(start, end, proofDb)
+}
@@ -0,0 +1,381 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// Tests that the configured cache sizes of the state database are respected and
+// that zero values select the defaults.
+func TestDatabaseConfig(t *testing.T) {
+	db := NewDatabaseWithConfig(ethdb.NewMemDatabase(), Config{PastTries: 2, TrieCacheGen: 3}).(*cachingDB)
+	if db.maxPastTries != 2 || db.cacheGen.max != 3 {
+		t.Fatalf("config mismatch: past tries %d, cache gen %d", db.maxPastTries, db.cacheGen.max)
+	}
+	for i := 0; i < 4; i++ {
+		state, _ := New(common.Hash{}, db)
+		state.AddBalance(common.Address{byte(i)}, big.NewInt(int64(i+1)))
+		if _, err := state.Commit(false); err != nil {
+			t.Fatalf("commit %d failed: %v", i, err)
+		}
+	}
+	if len(db.pastTries) != 2 {
+		t.Errorf("past tries mismatch: have %d, want 2", len(db.pastTries))
+	}
+	def := NewDatabase(ethdb.NewMemDatabase()).(*cachingDB)
+	if def.maxPastTries != maxPastTries || def.cacheGen.max != MaxTrieCacheGen {
+		t.Errorf("default config mismatch: past tries %d, cache gen %d", def.maxPastTries, def.cacheGen.max)
+	}
+}
+
+// Tests that the contract code cache is bounded by the total size of the code.
+func TestCodeCacheBudget(t *testing.T) {
+	cache := newCodeCache(100)
+
+	a, b, c := common.Hash{1}, common.Hash{2}, common.Hash{3}
+	cache.add(a, make([]byte, 40))
+	cache.add(b, make([]byte, 40))
+	if _, ok := cache.get(a); !ok { // a becomes the most recently used
+		t.Fatalf("code a not cached")
+	}
+	cache.add(c, make([]byte, 40))
+	if _, ok := cache.get(b); ok {
+		t.Errorf("least recently used code not evicted")
+	}
+	if _, ok := cache.get(a); !ok {
+		t.Errorf("recently used code evicted")
+	}
+	if cache.size != 80 {
+		t.Errorf("cached size mismatch: have %d, want 80", cache.size)
+	}
+	// Code exceeding the budget is not cached
+	cache.add(b, make([]byte, 101))
+	if _, ok := cache.get(b); ok || cache.size != 80 {
+		t.Errorf("oversized code cached")
+	}
+}
+
+// Tests that contract code is served from the cache once loaded.
+func TestContractCodeCached(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase()).(*cachingDB)
+	state, _ := New(common.Hash{}, db)
+	code := []byte{0x60, 0x00, 0x60, 0x00}
+	state.SetCode(common.Address{1}, code)
+	root, _ := state.Commit(false)
+	if err := db.TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	hash := state.GetCodeHash(common.Address{1})
+	if _, ok := db.codeCache.get(hash); ok {
+		t.Fatalf("code cached before being read")
+	}
+	if have, err := db.ContractCode(common.Hash{}, hash); err != nil || !bytes.Equal(have, code) {
+		t.Fatalf("code mismatch: have %x, %v", have, err)
+	}
+	if have, ok := db.codeCache.get(hash); !ok || !bytes.Equal(have, code) {
+		t.Errorf("code not cached after being read")
+	}
+}
+
+// Tests that several contract codes are retrieved in one batch, mixing cached,
+// stored, empty and missing codes.
+func TestContractCodes(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase()).(*cachingDB)
+	state, _ := New(common.Hash{}, db)
+	codes := [][]byte{{0x60, 0x01}, {0x60, 0x02}}
+	state.SetCode(common.Address{1}, codes[0])
+	state.SetCode(common.Address{2}, codes[1])
+	state.AddBalance(common.Address{3}, big.NewInt(1))
+	root, _ := state.Commit(false)
+	if err := db.TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	var hashes []common.Hash
+	for _, addr := range []common.Address{{1}, {2}, {3}} {
+		hashes = append(hashes, state.GetCodeHash(addr))
+	}
+	// Cache the first code, the second one is read from the database
+	if _, err := db.ContractCode(common.Hash{}, hashes[0]); err != nil {
+		t.Fatalf("failed to read code: %v", err)
+	}
+	have, err := db.ContractCodes(make([]common.Hash, 3), hashes)
+	if err != nil {
+		t.Fatalf("failed to read codes: %v", err)
+	}
+	if !bytes.Equal(have[0], codes[0]) || !bytes.Equal(have[1], codes[1]) || have[2] != nil {
+		t.Fatalf("codes mismatch: have %x", have)
+	}
+	if _, ok := db.codeCache.get(hashes[1]); !ok {
+		t.Errorf("code not cached after being read")
+	}
+	// Missing codes are left nil and reported
+	missing := common.Hash{0xff}
+	have, err = db.ContractCodes(make([]common.Hash, 2), []common.Hash{missing, hashes[1]})
+	if err == nil {
+		t.Errorf("missing code not reported")
+	}
+	if have[0] != nil || !bytes.Equal(have[1], codes[1]) {
+		t.Errorf("codes mismatch with missing code: have %x", have)
+	}
+}
+
+// Tests that the cached storage tries are handed out as independent copies, also
+// when opened concurrently.
+func TestStorageTrieCache(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase()).(*cachingDB)
+	state, _ := New(common.Hash{}, db)
+	addr := common.Address{1}
+	state.SetState(addr, common.Hash{1}, common.Hash{2})
+	root, _ := state.Commit(false)
+	if err := db.TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	state, _ = New(root, db)
+	storageRoot := state.getStateObject(addr).data.Root
+	cached := db.storageTries.Len()
+
+	var (
+		tries = make([]Trie, 8)
+		errs  = make(chan error, len(tries))
+	)
+	for i := range tries {
+		go func(i int) {
+			tr, err := db.OpenStorageTrie(common.Hash{}, storageRoot)
+			if err == nil {
+				_, err = tr.TryGet(common.Hash{1}.Bytes())
+			}
+			tries[i] = tr
+			errs <- err
+		}(i)
+	}
+	for range tries {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to open storage trie: %v", err)
+		}
+	}
+	if db.storageTries.Len() != cached+1 {
+		t.Fatalf("cached storage tries mismatch: have %d, want %d", db.storageTries.Len(), cached+1)
+	}
+	// Modifying an opened trie leaves the cache and the other copies intact
+	tries[0].TryUpdate(common.Hash{1}.Bytes(), []byte{0x03})
+	if tries[0].Hash() == storageRoot {
+		t.Fatalf("storage trie not modified")
+	}
+	if tries[1].Hash() != storageRoot {
+		t.Errorf("modification leaked into another copy")
+	}
+	tr, _ := db.OpenStorageTrie(common.Hash{}, storageRoot)
+	if tr.Hash() != storageRoot {
+		t.Errorf("modification leaked into the cache")
+	}
+}
+
+// Tests that the trie cache generations are reduced as the memory usage of the
+// trie database approaches the configured limit.
+func TestCacheGenController(t *testing.T) {
+	tests := []struct {
+		size common.StorageSize
+		want uint16
+	}{
+		{0, 120}, {500, 120}, {750, 61}, {999, 3}, {1000, 2}, {5000, 2},
+	}
+	for _, tt := range tests {
+		if gen := cacheGenFor(tt.size, 1000, 120); gen != tt.want {
+			t.Errorf("size %v: generations mismatch: have %d, want %d", tt.size, gen, tt.want)
+		}
+	}
+	db := NewDatabaseWithConfig(ethdb.NewMemDatabase(), Config{TrieCacheLimit: 1024}).(*cachingDB)
+	if gen := db.cacheGen.gen(); gen != MaxTrieCacheGen {
+		t.Fatalf("empty database: generations mismatch: have %d, want %d", gen, MaxTrieCacheGen)
+	}
+	state, _ := New(common.Hash{}, db)
+	for i := 0; i < 100; i++ {
+		state.AddBalance(common.Address{byte(i)}, big.NewInt(int64(i+1)))
+	}
+	if _, err := state.Commit(false); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if gen := db.cacheGen.gen(); gen != minTrieCacheGen {
+		t.Errorf("full database: generations mismatch: have %d, want %d", gen, minTrieCacheGen)
+	}
+	// Without a limit the configured generations are always kept
+	static := NewDatabase(ethdb.NewMemDatabase()).(*cachingDB)
+	static.db = db.db
+	static.cacheGen.db = db.db
+	if gen := static.cacheGen.gen(); gen != MaxTrieCacheGen {
+		t.Errorf("static limit: generations mismatch: have %d, want %d", gen, MaxTrieCacheGen)
+	}
+}
+
+// Tests that state databases are created by the registered backends selected by
+// name, and that unknown backends are rejected.
+func TestDatabaseBackends(t *testing.T) {
+	diskdb := ethdb.NewMemDatabase()
+
+	db, err := OpenDatabase(diskdb, Config{})
+	if err != nil {
+		t.Fatalf("default backend failed: %v", err)
+	}
+	if _, ok := db.(*cachingDB); !ok {
+		t.Errorf("default backend type mismatch: have %T", db)
+	}
+	if _, err := OpenDatabase(diskdb, Config{Backend: "nonexistent"}); err == nil {
+		t.Errorf("unknown backend accepted")
+	}
+	// Only the backends persisting the state can hold a blockchain
+	for name, ok := range map[string]bool{"": true, DefaultBackend: true, "memory": false, "readonly": false, "nonexistent": false} {
+		if err := CheckChainBackend(name); (err == nil) != ok {
+			t.Errorf("backend %q: chain check mismatch: have %v, want ok %v", name, err, ok)
+		}
+	}
+	// A committed state of the in-memory backend doesn't reach the given database
+	mem, err := OpenDatabase(diskdb, Config{Backend: "memory"})
+	if err != nil {
+		t.Fatalf("memory backend failed: %v", err)
+	}
+	state, _ := New(common.Hash{}, mem)
+	state.AddBalance(common.Address{1}, big.NewInt(1))
+	root, _ := state.Commit(false)
+	if err := mem.TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("memory backend flush failed: %v", err)
+	}
+	if diskdb.Len() != 0 {
+		t.Errorf("memory backend wrote %d entries to the database", diskdb.Len())
+	}
+	// The read-only backend serves the existing state but can't flush a new one
+	disk := NewDatabase(diskdb)
+	state, _ = New(common.Hash{}, disk)
+	state.AddBalance(common.Address{1}, big.NewInt(1))
+	root, _ = state.Commit(false)
+	disk.TrieDB().Commit(root, false)
+
+	ro, err := OpenDatabase(diskdb, Config{Backend: "readonly"})
+	if err != nil {
+		t.Fatalf("read-only backend failed: %v", err)
+	}
+	state, err = New(root, ro)
+	if err != nil {
+		t.Fatalf("read-only backend can't open state: %v", err)
+	}
+	if balance := state.GetBalance(common.Address{1}); balance.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("balance mismatch: have %v, want 1", balance)
+	}
+	state.AddBalance(common.Address{2}, big.NewInt(2))
+	root, _ = state.Commit(false)
+	if err := ro.TrieDB().Commit(root, false); err != ErrReadOnlyState {
+		t.Errorf("read-only backend flush error mismatch: have %v, want %v", err, ErrReadOnlyState)
+	}
+}
+
+// Tests that a backend name can only be registered once.
+func TestRegisterBackendTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("duplicate backend registration didn't panic")
+		}
+	}()
+	RegisterBackend(DefaultBackend, func(db ethdb.Database, config Config) (Database, error) {
+		return nil, nil
+	})
+}
+
+func TestStateCommitmentPlain(t *testing.T)  { testStateCommitment(t, trie.CommitmentPlain) }
+func TestStateCommitmentHashed(t *testing.T) { testStateCommitment(t, trie.CommitmentHashed) }
+
+// Tests that accounts, storage and code are committed and read back from disk
+// in the configured leaf format of the state tries.
+func testStateCommitment(t *testing.T, version trie.CommitmentVersion) {
+	diskdb := ethdb.NewMemDatabase()
+	db, err := OpenDatabase(diskdb, Config{Commitment: version})
+	if err != nil {
+		t.Fatalf("failed to open state database: %v", err)
+	}
+	if have := db.TrieDB().Commitment(); have != version {
+		t.Fatalf("commitment mismatch: have %v, want %v", have, version)
+	}
+	state, _ := New(common.Hash{}, db)
+	for i := byte(0); i < 10; i++ {
+		addr := common.Address{i}
+		state.AddBalance(addr, big.NewInt(int64(i)+1))
+		state.SetNonce(addr, uint64(i))
+		state.SetState(addr, common.Hash{i}, common.Hash{i, 1})
+		state.SetCode(addr, []byte{i, 0x60, 0x00})
+	}
+	root, err := state.Commit(false)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if err := db.TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("failed to flush state: %v", err)
+	}
+	// Reopen the state from disk
+	db, _ = OpenDatabase(diskdb, Config{Commitment: version})
+	state, err = New(root, db)
+	if err != nil {
+		t.Fatalf("failed to reopen state: %v", err)
+	}
+	for i := byte(0); i < 10; i++ {
+		addr := common.Address{i}
+		if balance := state.GetBalance(addr); balance.Int64() != int64(i)+1 {
+			t.Errorf("account %d: balance mismatch: have %v, want %d", i, balance, i+1)
+		}
+		if nonce := state.GetNonce(addr); nonce != uint64(i) {
+			t.Errorf("account %d: nonce mismatch: have %d, want %d", i, nonce, i)
+		}
+		if value := state.GetState(addr, common.Hash{i}); value != (common.Hash{i, 1}) {
+			t.Errorf("account %d: storage mismatch: have %x", i, value)
+		}
+		if code := state.GetCode(addr); !bytes.Equal(code, []byte{i, 0x60, 0x00}) {
+			t.Errorf("account %d: code mismatch: have %x", i, code)
+		}
+	}
+	// The iterating users of the tries see the values, not the leaves
+	state, _ = New(root, db)
+	for i := byte(0); i < 10; i++ {
+		state.ForEachStorage(common.Address{i}, func(key, value common.Hash) bool {
+			if value != (common.Hash{i, 1}) {
+				t.Errorf("account %d: iterated storage mismatch: have %x", i, value)
+			}
+			return true
+		})
+	}
+	dump := state.RawDump()
+	if len(dump.Accounts) != 10 {
+		t.Errorf("dumped accounts: have %d, want 10", len(dump.Accounts))
+	}
+	for addr, account := range dump.Accounts {
+		if len(account.Storage) != 1 {
+			t.Errorf("account %s: dumped storage slots: have %d, want 1", addr, len(account.Storage))
+		}
+	}
+	it := NewNodeIterator(state)
+	for it.Next() {
+	}
+	if it.Error != nil {
+		t.Errorf("state iteration failed: %v", it.Error)
+	}
+	if _, err := OpenDatabase(diskdb, Config{Commitment: trie.CommitmentHashed + 1}); err == nil {
+		t.Errorf("unknown commitment version accepted")
+	}
+}
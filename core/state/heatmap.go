@@ -0,0 +1,219 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+)
+
+const (
+	// DefaultHeatMapWindow is the default aggregation window of a trie heat map.
+	DefaultHeatMapWindow = 10 * time.Minute
+
+	// DefaultHeatMapDepth is the default path prefix length (in nibbles) the
+	// node accesses are grouped by.
+	DefaultHeatMapDepth = 4
+
+	// maxHeatMapDepth limits the prefix length, keeping the number of buckets sane.
+	maxHeatMapDepth = 16
+
+	// maxHeatMapBuckets is the number of distinct subtries tracked per window,
+	// accesses to further subtries are only counted in the total.
+	maxHeatMapBuckets = 65536
+)
+
+// heatKey identifies a subtrie: the owner is the hashed address of the account
+// for storage tries and the zero hash for the account trie.
+type heatKey struct {
+	owner  common.Hash
+	prefix string
+}
+
+// TrieHeatMap counts the trie node loads of the state database by path prefix
+// over a sliding window, identifying the hottest subtries of the account and
+// storage tries.
+//
+/**
+TrieHeatMap:
+按 path 前缀 (默认 4 个 nibble) 统计 state 的 trie node 从 db 加载的次数,
+统计窗口可配置, 用于找出最热的子树 (为 cache pinning / prefetching 提供真实数据)
+ */
+type TrieHeatMap struct {
+	window time.Duration
+	depth  int
+
+	lock     sync.Mutex
+	start    time.Time          // start of the current window
+	current  map[heatKey]uint64 // accesses in the current window
+	previous map[heatKey]uint64 // accesses in the last complete window
+	total    uint64             // all accesses in the current window
+	prevTot  uint64             // all accesses in the last complete window
+}
+
+// TrieHeatMapEntry is the access count of one subtrie.
+type TrieHeatMapEntry struct {
+	Owner  *common.Hash `json:"owner,omitempty"` // Hashed account address, nil for the account trie
+	Prefix string       `json:"prefix"`          // Path prefix in hex nibbles
+	Count  uint64       `json:"count"`
+	Share  float64      `json:"share"` // Fraction of all accesses in the window
+}
+
+// TrieHeatMapReport is the exported heat map, listing the hottest subtries first.
+type TrieHeatMapReport struct {
+	Start   time.Time          `json:"start"`
+	Window  time.Duration      `json:"window"`
+	Depth   int                `json:"depth"`
+	Total   uint64             `json:"total"`
+	Entries []TrieHeatMapEntry `json:"entries"`
+}
+
+// NewTrieHeatMap creates a heat map aggregating over the given window, grouping
+// the accesses by path prefixes of the given length. Zero values select the
+// defaults.
+func NewTrieHeatMap(window time.Duration, depth int) *TrieHeatMap {
+	if window <= 0 {
+		window = DefaultHeatMapWindow
+	}
+	if depth <= 0 {
+		depth = DefaultHeatMapDepth
+	}
+	if depth > maxHeatMapDepth {
+		depth = maxHeatMapDepth
+	}
+	return &TrieHeatMap{
+		window:  window,
+		depth:   depth,
+		start:   time.Now(),
+		current: make(map[heatKey]uint64),
+	}
+}
+
+// record counts a node load of the trie owned by the given account.
+func (h *TrieHeatMap) record(owner common.Hash, path []byte) {
+	if len(path) > h.depth {
+		path = path[:h.depth]
+	}
+	key := heatKey{owner: owner, prefix: nibblesToHex(path)}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.rotate(time.Now())
+	h.total++
+	if _, ok := h.current[key]; ok || len(h.current) < maxHeatMapBuckets {
+		h.current[key]++
+	}
+}
+
+// rotate starts a new window if the current one has expired.
+func (h *TrieHeatMap) rotate(now time.Time) {
+	elapsed := now.Sub(h.start)
+	if elapsed < h.window {
+		return
+	}
+	if elapsed < 2*h.window {
+		h.previous, h.prevTot = h.current, h.total
+		h.start = h.start.Add(h.window)
+	} else {
+		// no accesses during a whole window
+		h.previous, h.prevTot = nil, 0
+		h.start = now
+	}
+	h.current, h.total = make(map[heatKey]uint64), 0
+}
+
+// hook returns the trie resolve callback recording the accesses of a trie.
+func (h *TrieHeatMap) hook(owner common.Hash) func(path []byte) {
+	return func(path []byte) { h.record(owner, path) }
+}
+
+// Report exports the hottest subtries of the last complete window (or of the
+// current one if none completed yet). At most limit entries are returned, zero
+// meaning no limit.
+func (h *TrieHeatMap) Report(limit int) *TrieHeatMapReport {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	h.rotate(now)
+
+	report := &TrieHeatMapReport{
+		Window:  h.window,
+		Depth:   h.depth,
+		Entries: []TrieHeatMapEntry{},
+	}
+	counts := h.current
+	if h.previous != nil {
+		counts = h.previous
+		report.Start, report.Total = h.start.Add(-h.window), h.prevTot
+	} else {
+		report.Start, report.Total = h.start, h.total
+		report.Window = now.Sub(h.start)
+	}
+	for key, count := range counts {
+		entry := TrieHeatMapEntry{Prefix: key.prefix, Count: count}
+		if key.owner != (common.Hash{}) {
+			owner := key.owner
+			entry.Owner = &owner
+		}
+		if report.Total > 0 {
+			entry.Share = float64(count) / float64(report.Total)
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		a, b := report.Entries[i], report.Entries[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		var ao, bo common.Hash
+		if a.Owner != nil {
+			ao = *a.Owner
+		}
+		if b.Owner != nil {
+			bo = *b.Owner
+		}
+		if ao != bo {
+			return bytes.Compare(ao[:], bo[:]) < 0
+		}
+		return a.Prefix < b.Prefix
+	})
+	if limit > 0 && len(report.Entries) > limit {
+		report.Entries = report.Entries[:limit]
+	}
+	return report
+}
+
+// nibblesToHex formats a trie path (one nibble per byte, without terminator) as
+// a hex string.
+func nibblesToHex(path []byte) string {
+	const digits = "0123456789abcdef"
+
+	buf := make([]byte, 0, len(path))
+	for _, n := range path {
+		if n >= 16 {
+			break // terminator
+		}
+		buf = append(buf, digits[n])
+	}
+	return string(buf)
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// Tests that the node loads of the account and storage tries are recorded by
+// path prefix.
+func TestTrieHeatMap(t *testing.T) {
+	diskdb := ethdb.NewMemDatabase()
+	state, _ := New(common.Hash{}, NewDatabase(diskdb))
+	for i := byte(0); i < 255; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		state.AddBalance(addr, big.NewInt(int64(i)))
+	}
+	contract := common.BytesToAddress([]byte{0xff, 0xff})
+	for i := byte(0); i < 64; i++ {
+		state.SetState(contract, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i + 1}))
+	}
+	root, _ := state.Commit(false)
+	state.Database().TrieDB().Commit(root, false)
+
+	// Read everything back through a fresh database tracking the accesses
+	db := NewDatabase(diskdb)
+	heat := NewTrieHeatMap(time.Hour, 1)
+	if !SetTrieHeatMap(db, heat) {
+		t.Fatal("heat map not supported")
+	}
+	state, _ = New(root, db)
+	for i := byte(0); i < 255; i++ {
+		state.GetBalance(common.BytesToAddress([]byte{i}))
+	}
+	for i := byte(0); i < 64; i++ {
+		state.GetState(contract, common.BytesToHash([]byte{i}))
+	}
+
+	report := heat.Report(0)
+	if report.Depth != 1 {
+		t.Errorf("depth mismatch: have %d, want 1", report.Depth)
+	}
+	var (
+		sum          uint64
+		accounts     int
+		storage      int
+		contractHash = crypto.Keccak256Hash(contract[:])
+	)
+	for i, entry := range report.Entries {
+		if i > 0 && entry.Count > report.Entries[i-1].Count {
+			t.Errorf("entries not sorted by count at %d", i)
+		}
+		if len(entry.Prefix) > 1 {
+			t.Errorf("prefix %q longer than depth", entry.Prefix)
+		}
+		switch {
+		case entry.Owner == nil:
+			accounts++
+		case *entry.Owner == contractHash:
+			storage++
+		default:
+			t.Errorf("unexpected owner %x", *entry.Owner)
+		}
+		sum += entry.Count
+	}
+	if sum != report.Total {
+		t.Errorf("total mismatch: have %d, counted %d", report.Total, sum)
+	}
+	// The root and the 16 subtries of the first level of both tries are hit
+	if accounts != 17 || storage != 17 {
+		t.Errorf("subtrie count mismatch: have %d account and %d storage, want 17 each", accounts, storage)
+	}
+
+	// Tries opened after uninstalling the heat map aren't tracked any more
+	SetTrieHeatMap(db, nil)
+	state, _ = New(root, db)
+	state.GetBalance(common.BytesToAddress([]byte{1}))
+	if total := heat.Report(0).Total; total != report.Total {
+		t.Errorf("access recorded after removal: have %d, want %d", total, report.Total)
+	}
+}
+
+// Tests that the heat map reports the last complete window.
+func TestTrieHeatMapWindow(t *testing.T) {
+	heat := NewTrieHeatMap(time.Minute, 2)
+	heat.record(common.Hash{}, []byte{1, 2, 3})
+	heat.record(common.Hash{}, []byte{1, 2, 4})
+	heat.record(common.Hash{}, []byte{5})
+
+	report := heat.Report(1)
+	if report.Total != 3 || len(report.Entries) != 1 {
+		t.Fatalf("report mismatch: total %d, %d entries", report.Total, len(report.Entries))
+	}
+	if entry := report.Entries[0]; entry.Prefix != "12" || entry.Count != 2 {
+		t.Errorf("hottest entry mismatch: have %q/%d, want \"12\"/2", entry.Prefix, entry.Count)
+	}
+
+	// Close the window, the new accesses aren't reported until it's complete
+	heat.lock.Lock()
+	heat.start = heat.start.Add(-time.Minute)
+	heat.lock.Unlock()
+	heat.record(common.Hash{}, []byte{7})
+	if report := heat.Report(0); report.Total != 3 || len(report.Entries) != 2 {
+		t.Errorf("last window mismatch: total %d, %d entries", report.Total, len(report.Entries))
+	}
+	// A window without any accesses resets the statistics
+	heat.lock.Lock()
+	heat.start = heat.start.Add(-2 * time.Minute)
+	heat.lock.Unlock()
+	if report := heat.Report(0); report.Total != 0 || len(report.Entries) != 0 {
+		t.Errorf("stale statistics reported: total %d, %d entries", report.Total, len(report.Entries))
+	}
+}
@@ -104,8 +104,12 @@ func (it *NodeIterator) step() error {
 		return nil
 	}
 	// Otherwise we've reached an account node, initiate data iteration
+	blob, err := it.state.db.TrieDB().LeafValue(it.stateIt.LeafBlob())
+	if err != nil {
+		return err
+	}
 	var account Account
-	if err := rlp.Decode(bytes.NewReader(it.stateIt.LeafBlob()), &account); err != nil {
+	if err := rlp.Decode(bytes.NewReader(blob), &account); err != nil {
 		return err
 	}
 	dataTrie, err := it.state.db.OpenStorageTrie(common.BytesToHash(it.stateIt.LeafKey()), account.Root)
@@ -60,3 +60,73 @@ func TestNodeIteratorCoverage(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the account iterator decodes all the accounts of a state together
+// with their code and storage.
+func TestAccountIterator(t *testing.T) {
+	db, root, accounts := makeTestState()
+
+	// Add some storage to a few accounts
+	state, _ := New(root, db)
+	for i := byte(0); i < 96; i += 10 {
+		state.SetState(common.BytesToAddress([]byte{i}), common.Hash{i}, common.Hash{1, i})
+		state.SetState(common.BytesToAddress([]byte{i}), common.Hash{i + 1}, common.Hash{2, i})
+	}
+	root, _ = state.Commit(false)
+
+	it, err := NewIterator(db, root)
+	if err != nil {
+		t.Fatalf("failed to create iterator: %v", err)
+	}
+	var (
+		seen  = make(map[common.Address]bool)
+		slots int
+		last  common.Hash
+	)
+	for it.Next() {
+		if it.Address == nil {
+			t.Fatalf("missing address preimage of %x", it.Hash)
+		}
+		if bytes.Compare(it.Hash[:], last[:]) <= 0 && len(seen) > 0 {
+			t.Errorf("accounts out of order: %x after %x", it.Hash, last)
+		}
+		last = it.Hash
+		acc := accounts[it.Address[19]]
+		seen[*it.Address] = true
+		if it.Account.Balance.Cmp(acc.balance) != 0 || it.Account.Nonce != acc.nonce {
+			t.Errorf("account %x mismatch: balance %v, nonce %d", *it.Address, it.Account.Balance, it.Account.Nonce)
+		}
+		if code, err := it.Code(); err != nil || !bytes.Equal(code, acc.code) {
+			t.Errorf("account %x code mismatch: %x, %v", *it.Address, code, err)
+		}
+		storage, err := it.Storage()
+		if err != nil {
+			t.Fatalf("failed to create storage iterator: %v", err)
+		}
+		for storage.Next() {
+			slots++
+			i := it.Address[19]
+			if storage.Key == nil || (*storage.Key != common.Hash{i} && *storage.Key != common.Hash{i + 1}) {
+				t.Errorf("account %x unexpected slot %v", *it.Address, storage.Key)
+				continue
+			}
+			if want := (common.Hash{1 + storage.Key[0] - i, i}); storage.Value != want {
+				t.Errorf("account %x slot %x mismatch: have %x, want %x", *it.Address, *storage.Key, storage.Value, want)
+			}
+		}
+		if storage.Err != nil {
+			t.Errorf("storage iteration failed: %v", storage.Err)
+		}
+	}
+	if it.Err != nil {
+		t.Fatalf("iteration failed: %v", it.Err)
+	}
+	if len(seen) != len(accounts) || slots != 20 {
+		t.Errorf("iterated %d accounts and %d slots, want %d and 20", len(seen), slots, len(accounts))
+	}
+	// Resume from the middle of the state
+	from, _ := NewIteratorFrom(db, root, last)
+	if !from.Next() || from.Hash != last || from.Next() {
+		t.Errorf("resumed iteration mismatch")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// RootHistory returns the state root of the block the given number of blocks
+// before the one whose state is being opened, or false if there is no such block.
+type RootHistory func(back int) (common.Hash, bool)
+
+// OpenTrieNearest opens the account trie of the given state root. If the state
+// is not available (e.g. because it has been pruned), the states of the preceding
+// blocks are tried, at most maxDepthBack blocks back. It returns the trie of the
+// nearest available state together with its root and its distance in blocks
+// from the requested one.
+//
+// If none of the states are available, the missing node error of the requested
+// root is returned.
+//
+/**
+OpenTrieNearest:
+打开指定 root 的 account trie, 如果该 state 已经被裁剪 (missing trie node),
+则依次尝试前面 block 的 state (最多往回 maxDepthBack 个 block), 返回最近的可用 state 及其距离
+ */
+func OpenTrieNearest(db Database, root common.Hash, maxDepthBack int, history RootHistory) (Trie, common.Hash, int, error) {
+	tr, err := db.OpenTrie(root)
+	if err == nil {
+		return tr, root, 0, nil
+	}
+	if _, missing := err.(*trie.MissingNodeError); !missing || history == nil {
+		return nil, common.Hash{}, 0, err
+	}
+	for back := 1; back <= maxDepthBack; back++ {
+		prev, ok := history(back)
+		if !ok {
+			break
+		}
+		tr, perr := db.OpenTrie(prev)
+		if perr == nil {
+			return tr, prev, back, nil
+		}
+		if _, missing := perr.(*trie.MissingNodeError); !missing {
+			return nil, common.Hash{}, 0, perr
+		}
+	}
+	return nil, common.Hash{}, 0, err
+}
+
+// NewNearest creates a state from the nearest available state at or before the
+// given root, see OpenTrieNearest.
+func NewNearest(db Database, root common.Hash, maxDepthBack int, history RootHistory) (*StateDB, common.Hash, int, error) {
+	tr, found, back, err := OpenTrieNearest(db, root, maxDepthBack, history)
+	if err != nil {
+		return nil, common.Hash{}, 0, err
+	}
+	return newWithTrie(db, tr), found, back, nil
+}
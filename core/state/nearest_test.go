@@ -0,0 +1,67 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// Tests that the nearest available older state is opened if the requested one
+// is missing.
+func TestOpenTrieNearest(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase())
+	state, _ := New(common.Hash{}, db)
+	addr := common.BytesToAddress([]byte{1})
+	state.AddBalance(addr, big.NewInt(42))
+	available, _ := state.Commit(false)
+	db.TrieDB().Commit(available, false)
+
+	// Blocks 1 and 2 after the available state have been pruned
+	roots := []common.Hash{{0x02}, {0x01}, available}
+	history := func(back int) (common.Hash, bool) {
+		if back >= len(roots) {
+			return common.Hash{}, false
+		}
+		return roots[back], true
+	}
+
+	statedb, root, back, err := NewNearest(db, roots[0], 2, history)
+	if err != nil {
+		t.Fatalf("failed to open nearest state: %v", err)
+	}
+	if root != available || back != 2 {
+		t.Errorf("nearest state mismatch: have %x/%d, want %x/2", root, back, available)
+	}
+	if balance := statedb.GetBalance(addr); balance.Uint64() != 42 {
+		t.Errorf("balance mismatch: have %v, want 42", balance)
+	}
+	// Not going back far enough reports the original error
+	if _, _, _, err := OpenTrieNearest(db, roots[0], 1, history); err == nil {
+		t.Error("missing state opened")
+	} else if merr, ok := err.(*trie.MissingNodeError); !ok || merr.NodeHash != roots[0] {
+		t.Errorf("error mismatch: have %v, want missing node %x", err, roots[0])
+	}
+	// Available states are opened directly
+	if _, root, back, err := OpenTrieNearest(db, available, 2, history); err != nil || root != available || back != 0 {
+		t.Errorf("available state: have %x/%d/%v, want %x/0/nil", root, back, err, available)
+	}
+}
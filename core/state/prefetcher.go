@@ -0,0 +1,189 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// prefetchQueueSize is the number of prefetch tasks waiting to be processed,
+// further ones are dropped.
+const prefetchQueueSize = 16
+
+// errPrefetchUnsupported is returned if the state database has no caches to warm.
+var errPrefetchUnsupported = errors.New("state database doesn't support prefetching")
+
+var (
+	prefetchAccountMeter = metrics.NewRegisteredMeter("state/prefetch/accounts", nil)
+	prefetchDropMeter    = metrics.NewRegisteredMeter("state/prefetch/drops", nil)
+)
+
+// Prefetcher warms the caches of a state database in the background with the
+// accounts expected to be accessed soon, e.g. the senders and recipients of the
+// pending transactions before a block is executed: the account trie paths are
+// resolved into the kept past tries, and the storage trie roots and contract
+// codes of the accounts are cached.
+//
+/**
+Prefetcher: 在后台 预先加载 即将被访问的账户 (如 txpool 中 pending 交易的 from/to),
+把 account trie 路径 解析进 pastTries, 并缓存 账户的 storage trie root 与 合约 code,
+减少 block 执行时 读取磁盘 的延迟
+ */
+type Prefetcher struct {
+	db    *cachingDB
+	tasks chan prefetchTask
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// prefetchTask is a set of accounts to load from a state.
+type prefetchTask struct {
+	root  common.Hash
+	addrs []common.Address
+}
+
+// NewPrefetcher creates and starts a prefetcher warming the given database.
+func NewPrefetcher(db Database) (*Prefetcher, error) {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return nil, errPrefetchUnsupported
+	}
+	p := &Prefetcher{
+		db:    cdb,
+		tasks: make(chan prefetchTask, prefetchQueueSize),
+		quit:  make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.loop()
+	return p, nil
+}
+
+// Prefetch schedules the loading of the given accounts of the state with the
+// given root. It returns false if the task was dropped because the prefetcher is
+// lagging behind.
+func (p *Prefetcher) Prefetch(root common.Hash, addrs []common.Address) bool {
+	if len(addrs) == 0 {
+		return true
+	}
+	select {
+	case p.tasks <- prefetchTask{root, addrs}:
+		return true
+	default:
+		prefetchDropMeter.Mark(1)
+		return false
+	}
+}
+
+// Close terminates the prefetcher, dropping the tasks not yet processed.
+func (p *Prefetcher) Close() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// loop processes the prefetch tasks until the prefetcher is closed.
+func (p *Prefetcher) loop() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case task := <-p.tasks:
+			p.db.prefetch(task.root, task.addrs, p.quit)
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// prefetch loads the given accounts of a state into the caches of the database,
+// and keeps the account trie with the resolved paths as the past trie of the root.
+func (db *cachingDB) prefetch(root common.Hash, addrs []common.Address, quit <-chan struct{}) {
+	// Start from the kept trie of the root so its resolved nodes aren't lost
+	db.mu.Lock()
+	var tr *trie.SecureTrie
+	for i := len(db.pastTries) - 1; i >= 0; i-- {
+		if db.pastTries[i].Hash() == root {
+			tr = db.pastTries[i].Copy()
+			tr.SetResolveHook(nil)
+			break
+		}
+	}
+	gen := db.cacheGen.gen()
+	db.mu.Unlock()
+
+	if tr == nil {
+		var err error
+		if tr, err = trie.NewSecure(root, db.db, gen); err != nil {
+			return
+		}
+		if db.cacheSize > 0 {
+			tr.SetCachePolicy(trie.ByteBudgetPolicy(db.cacheSize))
+		}
+	}
+	for _, addr := range addrs {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		enc, err := tr.TryGet(addr[:])
+		if err != nil || len(enc) == 0 {
+			continue
+		}
+		var account Account
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			continue
+		}
+		prefetchAccountMeter.Mark(1)
+
+		// Cache the storage trie root and the code, bypassing the hit/miss counters
+		// and the heat map which should reflect the real accesses
+		if account.Root != types.EmptyRootHash && !db.storageTries.Contains(account.Root) {
+			if st, err := trie.NewSecure(account.Root, db.db, 0); err == nil {
+				db.storageTries.Add(account.Root, st)
+			}
+		}
+		if codeHash := common.BytesToHash(account.CodeHash); !bytes.Equal(account.CodeHash, emptyCodeHash) {
+			if _, ok := db.codeCache.get(codeHash); !ok {
+				if code, err := db.db.Node(codeHash); err == nil {
+					db.codeSizeCache.Add(codeHash, len(code))
+					db.codeCache.add(codeHash, code)
+				}
+			}
+		}
+	}
+	// Replace the kept trie of the root with the warmed one, the tries opened from
+	// now on are copied from it
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := len(db.pastTries) - 1; i >= 0; i-- {
+		if db.pastTries[i].Hash() == root {
+			db.pastTries[i] = tr
+			return
+		}
+	}
+	db.pushTrieLocked(tr)
+}
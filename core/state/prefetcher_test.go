@@ -0,0 +1,98 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// Tests that the prefetched accounts, their storage roots and codes are served
+// from the caches of the database, without touching the disk.
+func TestPrefetcher(t *testing.T) {
+	diskdb := ethdb.NewMemDatabase()
+	state, _ := New(common.Hash{}, NewDatabase(diskdb))
+	for i := byte(0); i < 64; i++ {
+		state.AddBalance(common.Address{i}, big.NewInt(int64(i)+1))
+	}
+	contract := common.Address{0xff}
+	state.SetCode(contract, []byte{1, 2, 3})
+	state.SetState(contract, common.Hash{1}, common.Hash{2})
+	root, _ := state.Commit(false)
+	state.Database().TrieDB().Commit(root, false)
+
+	// Prefetch a few accounts into a fresh database, then drop the disk content
+	db := NewDatabase(diskdb)
+	prefetcher, err := NewPrefetcher(db)
+	if err != nil {
+		t.Fatalf("failed to create prefetcher: %v", err)
+	}
+	defer prefetcher.Close()
+
+	addrs := []common.Address{{1}, {7}, {42}, contract}
+	if !prefetcher.Prefetch(root, addrs) {
+		t.Fatalf("prefetch task dropped")
+	}
+	cdb := db.(*cachingDB)
+	for i := 0; ; i++ {
+		cdb.mu.Lock()
+		done := len(cdb.pastTries) == 1
+		cdb.mu.Unlock()
+		if done && cdb.storageTries.Len() == 1 {
+			if _, ok := cdb.codeCache.get(state.GetCodeHash(contract)); ok {
+				break
+			}
+		}
+		if i == 100 {
+			t.Fatalf("accounts not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range diskdb.Keys() {
+		diskdb.Delete(key)
+	}
+	state, err = New(root, db)
+	if err != nil {
+		t.Fatalf("failed to open prefetched state: %v", err)
+	}
+	for _, addr := range addrs[:3] {
+		if balance := state.GetBalance(addr); balance.Cmp(big.NewInt(int64(addr[0])+1)) != 0 {
+			t.Errorf("account %x: balance mismatch: have %v, want %d", addr, balance, addr[0]+1)
+		}
+	}
+	if code := state.GetCode(contract); !bytes.Equal(code, []byte{1, 2, 3}) {
+		t.Errorf("code mismatch: have %x", code)
+	}
+	if value := state.GetState(contract, common.Hash{1}); value != (common.Hash{2}) {
+		t.Errorf("storage mismatch: have %x", value)
+	}
+	if err := state.Error(); err != nil {
+		t.Errorf("prefetched state read from disk: %v", err)
+	}
+}
+
+// Tests that databases without caches are rejected.
+func TestPrefetcherUnsupported(t *testing.T) {
+	if _, err := NewPrefetcher(nil); err != errPrefetchUnsupported {
+		t.Errorf("error mismatch: have %v, want %v", err, errPrefetchUnsupported)
+	}
+}
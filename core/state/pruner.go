@@ -0,0 +1,109 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"gopkg.in/karalabe/cookiejar.v2/collections/prque"
+)
+
+// Pruner garbage collects the trie nodes of the committed state roots through the
+// reference counting of the trie database. Every committed root is referenced,
+// the roots older than the retention window are dereferenced again, so the trie
+// nodes only reachable from them are dropped from memory before they are ever
+// flushed to disk.
+//
+/**
+Pruner:
+基于 trie.Database 的引用计数做 state trie 的裁剪:
+每个被提交的 state root 都会 Reference 一次, 超出保留窗口 (retention 个 block) 的 root 会被 Dereference,
+只被这些 root 引用的 node 在刷盘之前就从内存中删除, 从而限制全节点磁盘的增长
+*/
+type Pruner struct {
+	db        Database
+	retention uint64       // number of recent blocks whose state is kept
+	roots     *prque.Prque // priority queue mapping block numbers to the roots to gc
+	lock      sync.Mutex
+}
+
+// NewPruner creates a pruner keeping the states of the last retention blocks.
+func NewPruner(db Database, retention uint64) *Pruner {
+	return &Pruner{
+		db:        db,
+		retention: retention,
+		roots:     prque.New(),
+	}
+}
+
+// Reference keeps the state root committed at the given block number alive until
+// it leaves the retention window.
+func (p *Pruner) Reference(root common.Hash, number uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.db.TrieDB().Reference(root, common.Hash{}) // metadata reference to keep trie alive
+	p.roots.Push(root, -float32(number))
+}
+
+// Prune dereferences the state roots of the blocks which left the retention
+// window behind the given head number. The caller is expected to flush any of
+// the states it wants to persist before pruning them.
+func (p *Pruner) Prune(head uint64) {
+	if head <= p.retention {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	limit := head - p.retention
+	triedb := p.db.TrieDB()
+	for !p.roots.Empty() {
+		root, number := p.roots.Pop()
+		if uint64(-number) > limit {
+			p.roots.Push(root, number)
+			break
+		}
+		triedb.Dereference(root.(common.Hash))
+	}
+}
+
+// Release dereferences all the referenced state roots, e.g. on shutdown after
+// the states to keep have been flushed.
+func (p *Pruner) Release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	triedb := p.db.TrieDB()
+	for !p.roots.Empty() {
+		triedb.Dereference(p.roots.PopItem().(common.Hash))
+	}
+}
+
+// Retention returns the number of recent blocks whose state is kept.
+func (p *Pruner) Retention() uint64 {
+	return p.retention
+}
+
+// Len returns the number of referenced state roots.
+func (p *Pruner) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.roots.Size()
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// Tests that the pruner drops the trie nodes of the states leaving the retention
+// window and keeps the recent ones.
+func TestPrunerRetention(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase())
+	pruner := NewPruner(db, 2)
+
+	var (
+		roots []common.Hash
+		root  common.Hash
+	)
+	for i := 1; i <= 5; i++ {
+		state, _ := New(root, db)
+		state.AddBalance(common.Address{byte(i)}, big.NewInt(int64(i)))
+		root, _ = state.Commit(false)
+		pruner.Reference(root, uint64(i))
+		roots = append(roots, root)
+	}
+	// Nothing is pruned while the window is not exceeded
+	pruner.Prune(2)
+	if pruner.Len() != 5 {
+		t.Fatalf("referenced roots mismatch: have %d, want 5", pruner.Len())
+	}
+	pruner.Prune(5)
+	if pruner.Len() != 2 {
+		t.Fatalf("referenced roots mismatch after pruning: have %d, want 2", pruner.Len())
+	}
+	for i, root := range roots {
+		_, err := trie.New(root, db.TrieDB())
+		if kept := i >= 3; kept && err != nil {
+			t.Errorf("state #%d pruned: %v", i+1, err)
+		} else if !kept && err == nil {
+			t.Errorf("state #%d not pruned", i+1)
+		}
+	}
+	pruner.Release()
+	if size, _ := db.TrieDB().Size(); size != 0 || pruner.Len() != 0 {
+		t.Errorf("trie nodes left after release: %v, %d roots", size, pruner.Len())
+	}
+}
@@ -0,0 +1,633 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// Counters of the flat state reads, misses fall back to the tries.
+var (
+	snapAccountHitCounter  = metrics.NewRegisteredCounter("state/snapshot/account/hit", nil)
+	snapAccountMissCounter = metrics.NewRegisteredCounter("state/snapshot/account/miss", nil)
+	snapStorageHitCounter  = metrics.NewRegisteredCounter("state/snapshot/storage/hit", nil)
+	snapStorageMissCounter = metrics.NewRegisteredCounter("state/snapshot/storage/miss", nil)
+)
+
+// errSnapshotRootChanged is returned by the generator if the snapshot moved to
+// another state root while a range was being generated.
+var errSnapshotRootChanged = errors.New("snapshot root changed")
+
+// Limits of the in-memory history used to move the snapshot between roots.
+const (
+	maxSnapshotDiffs = 128 // committed diffs kept for following the chain
+	maxSnapshotUndos = 128 // applied diffs that can be rolled back on reorgs
+)
+
+// snapshotDiff is the change set of a state commit, kept until the snapshot
+// follows its root (or it's evicted).
+type snapshotDiff struct {
+	parent    common.Hash
+	root      common.Hash
+	destructs map[common.Hash]struct{}
+	accounts  map[common.Hash][]byte
+	storage   map[common.Hash]map[common.Hash][]byte
+}
+
+// snapshotUndo holds the flat entries overwritten by an applied diff (nil for
+// the entries that were absent), for rolling the snapshot back to the parent
+// root on reorgs.
+type snapshotUndo struct {
+	parent   common.Hash
+	root     common.Hash
+	marker   []byte // generation progress when the diff was applied
+	accounts map[common.Hash][]byte
+	storage  map[common.Hash]map[common.Hash][]byte
+}
+
+// saveAccount records the flat entry of an account before it's first changed.
+func (u *snapshotUndo) saveAccount(db rawdb.DatabaseReader, gen uint64, accHash common.Hash) {
+	if _, ok := u.accounts[accHash]; !ok {
+		u.accounts[accHash] = rawdb.ReadAccountSnapshot(db, gen, accHash)
+	}
+}
+
+// saveStorage records the flat entry of a storage slot before it's first changed.
+func (u *snapshotUndo) saveStorage(db rawdb.DatabaseReader, gen uint64, accHash, slot common.Hash) {
+	slots := u.storage[accHash]
+	if slots == nil {
+		slots = make(map[common.Hash][]byte)
+		u.storage[accHash] = slots
+	}
+	if _, ok := slots[slot]; !ok {
+		slots[slot] = rawdb.ReadStorageSnapshot(db, gen, accHash, slot)
+	}
+}
+
+// snapshotGenerator is the persisted progress of the snapshot generation.
+type snapshotGenerator struct {
+	Gen    uint64      // Generation of the flat entries, bumped on every rebuild
+	Root   common.Hash // State root the flat entries belong to
+	Marker []byte      // Last account hash generated
+	Done   bool        // Whether the generation finished
+}
+
+// Snapshot is a flat key-value copy of the accounts and storage slots of a single
+// state root, keyed by their hashes outside of the tries. It is built by a
+// background generator and kept up to date with the head of the chain by applying
+// the diffs of the state commits leading to it, so that reads of that state resolve with a single database lookup
+// instead of a walk down the trie.
+//
+// Reads of a state root other than the one of the snapshot, or of accounts not
+// generated yet, are not served and fall back to the tries.
+//
+/**
+Snapshot:
+将某个 state root 下的 account 和 storage slot 按 hash 平铺存放在 trie 之外 (flat k-v),
+由后台的 generator 从 trie 遍历生成, 之后由 Follow 应用 head 前进所经过的各个 commit 的 diff (root 跟着前移),
+reorg 时先回滚共同祖先之后已应用的 diff; 只有无法通过 diff 到达新 root 时才在后台重新生成.
+StateDB 读 account/storage 时先查 snapshot, 一次 db 查询代替 trie 的逐层随机读;
+root 不一致 或者 还没生成到的 account 则回退到 trie
+*/
+type Snapshot struct {
+	diskdb ethdb.Database
+	triedb *trie.Database
+
+	gen    uint64      // generation of the flat entries
+	root   common.Hash // state root the flat entries belong to
+	marker []byte      // last account generated, nil once the generation is done
+
+	diffs     map[common.Hash]*snapshotDiff // committed diffs by their root
+	diffOrder []common.Hash                 // roots of the diffs in commit order, for eviction
+	undos     []*snapshotUndo               // applied diffs, most recent last
+
+	generating bool          // whether the generator goroutine is running
+	wake       chan struct{} // notifies the generator of root changes
+	quit       chan struct{}
+	wg         sync.WaitGroup
+	lock       sync.RWMutex
+}
+
+// NewSnapshot creates the flat state snapshot stored in the given database,
+// resolving the tries through triedb. The snapshot doesn't serve any reads until
+// it is (re)built for a state root with Rebuild, done once at startup.
+func NewSnapshot(diskdb ethdb.Database, triedb *trie.Database) *Snapshot {
+	snap := &Snapshot{
+		diskdb: diskdb,
+		triedb: triedb,
+		marker: []byte{},
+		diffs:  make(map[common.Hash]*snapshotDiff),
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	if blob := rawdb.ReadSnapshotGenerator(diskdb); len(blob) > 0 {
+		var generator snapshotGenerator
+		if err := rlp.DecodeBytes(blob, &generator); err != nil {
+			log.Error("Invalid snapshot generator", "err", err)
+		} else {
+			snap.gen, snap.root, snap.marker = generator.Gen, generator.Root, generator.Marker
+			if generator.Done {
+				snap.marker = nil
+			}
+		}
+	}
+	return snap
+}
+
+// Root returns the state root the snapshot belongs to.
+func (s *Snapshot) Root() common.Hash {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.root
+}
+
+// Generated reports whether the generation of the snapshot finished.
+func (s *Snapshot) Generated() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.marker == nil
+}
+
+// Rebuild makes the snapshot serve the given state root, typically the head at
+// startup. If the snapshot is missing or belongs to another root, its entries are
+// abandoned and a new generation is started in the background, otherwise an
+// interrupted generation is resumed. Use Follow to track the chain afterwards.
+func (s *Snapshot) Rebuild(root common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.root != root {
+		s.reset(root)
+	}
+	s.startGenerator()
+}
+
+// Stop terminates the background generation, its progress is kept for resuming
+// on the next Rebuild of the same root.
+func (s *Snapshot) Stop() {
+	s.lock.Lock()
+	select {
+	case <-s.quit:
+	default:
+		close(s.quit)
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+// Follow moves the snapshot to the given state root, the new head of the chain,
+// by applying the recorded diffs of the commits leading to it. On reorgs the
+// diffs applied on top of the common ancestor are rolled back first. Only if
+// the root can't be reached this way are the entries abandoned and regenerated
+// in the background; either way the caller is never blocked by a generation.
+func (s *Snapshot) Follow(root common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.root == root {
+		return
+	}
+	// Find the roots the snapshot can be rolled back to, preferring the most
+	// recent ones, and the diffs leading from one of them to the new root
+	reachable := map[common.Hash]int{s.root: len(s.undos)}
+	for i := len(s.undos) - 1; i >= 0; i-- {
+		if _, ok := reachable[s.undos[i].parent]; !ok {
+			reachable[s.undos[i].parent] = i
+		}
+	}
+	var (
+		path []*snapshotDiff
+		keep int
+	)
+	for cur := root; ; {
+		if n, ok := reachable[cur]; ok {
+			keep = n
+			break
+		}
+		diff := s.diffs[cur]
+		if diff == nil || len(path) >= maxSnapshotDiffs {
+			s.reset(root)
+			s.startGenerator()
+			return
+		}
+		path = append(path, diff)
+		cur = diff.parent
+	}
+	for len(s.undos) > keep {
+		if !s.rollback() {
+			s.reset(root)
+			s.startGenerator()
+			return
+		}
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if err := s.apply(path[i]); err != nil {
+			log.Warn("Failed to update state snapshot", "root", path[i].root, "err", err)
+			s.reset(root)
+			s.startGenerator()
+			return
+		}
+	}
+	s.notify()
+}
+
+// reset abandons the current flat entries and starts over for the given root.
+// The caller must hold the write lock.
+func (s *Snapshot) reset(root common.Hash) {
+	log.Info("Rebuilding state snapshot", "root", root, "stale", s.root)
+
+	stale := s.gen
+	s.gen, s.root, s.marker = s.gen+1, root, []byte{}
+	s.undos = nil
+	s.writeGenerator(s.diskdb)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if !rawdb.DeleteSnapshotGeneration(s.diskdb, stale) {
+			log.Debug("Stale snapshot entries left in the database", "generation", stale)
+		}
+	}()
+	s.notify()
+}
+
+// startGenerator starts the generator goroutine if the snapshot is not complete
+// yet. The caller must hold the write lock.
+func (s *Snapshot) startGenerator() {
+	if s.marker == nil || s.generating {
+		return
+	}
+	select {
+	case <-s.quit:
+		return
+	default:
+	}
+	s.generating = true
+	s.wg.Add(1)
+	go s.generate()
+}
+
+// notify wakes the generator up after a root change.
+func (s *Snapshot) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeGenerator stores the progress of the snapshot. The caller must hold the
+// lock.
+func (s *Snapshot) writeGenerator(db ethdb.Putter) {
+	blob, err := rlp.EncodeToBytes(&snapshotGenerator{Gen: s.gen, Root: s.root, Marker: s.marker, Done: s.marker == nil})
+	if err != nil {
+		panic(err) // can't happen
+	}
+	rawdb.WriteSnapshotGenerator(db, blob)
+}
+
+// covered reports whether the flat entries of the given account are present.
+// The caller must hold the lock.
+func (s *Snapshot) covered(accHash common.Hash) bool {
+	return s.marker == nil || (len(s.marker) > 0 && bytes.Compare(accHash[:], s.marker) <= 0)
+}
+
+// account retrieves the trie encoding of an account of the given state root from
+// the flat entries, nil if the account doesn't exist. It returns false if the
+// account is not served by the snapshot.
+func (s *Snapshot) account(root, accHash common.Hash) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.root != root || !s.covered(accHash) {
+		snapAccountMissCounter.Inc(1)
+		return nil, false
+	}
+	snapAccountHitCounter.Inc(1)
+	return rawdb.ReadAccountSnapshot(s.diskdb, s.gen, accHash), true
+}
+
+// storage retrieves the trie encoding of a storage slot (by its unhashed key) of the given state root
+// from the flat entries, nil if the slot is empty. It returns false if the slot
+// is not served by the snapshot.
+func (s *Snapshot) storage(root, accHash, key common.Hash) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.root != root || !s.covered(accHash) {
+		snapStorageMissCounter.Inc(1)
+		return nil, false
+	}
+	snapStorageHitCounter.Inc(1)
+	return rawdb.ReadStorageSnapshot(s.diskdb, s.gen, accHash, crypto.Keccak256Hash(key[:])), true
+}
+
+// update records the changes of a state commit from the parent state root to
+// the committed root: the destructed accounts have their storage wiped before
+// the updated accounts and storage slots (keyed by their hashes, nil values for
+// deletions) are written. The changes are applied once the snapshot follows a
+// root built on top of them.
+func (s *Snapshot) update(parent, root common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) {
+	if parent == root {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.diffs[root]; !ok {
+		s.diffOrder = append(s.diffOrder, root)
+	}
+	s.diffs[root] = &snapshotDiff{parent: parent, root: root, destructs: destructs, accounts: accounts, storage: storage}
+	for len(s.diffOrder) > maxSnapshotDiffs {
+		delete(s.diffs, s.diffOrder[0])
+		s.diffOrder = s.diffOrder[1:]
+	}
+}
+
+// apply writes a diff on top of the snapshot root, moving the snapshot to the
+// root of the diff and remembering the overwritten entries for a rollback. The
+// caller must hold the write lock.
+func (s *Snapshot) apply(diff *snapshotDiff) error {
+	undo := &snapshotUndo{
+		parent:   s.root,
+		root:     diff.root,
+		marker:   common.CopyBytes(s.marker),
+		accounts: make(map[common.Hash][]byte),
+		storage:  make(map[common.Hash]map[common.Hash][]byte),
+	}
+	batch := s.diskdb.NewBatch()
+	for accHash := range diff.destructs {
+		if !s.covered(accHash) {
+			continue
+		}
+		if err := s.wipeStorage(batch, accHash, undo); err != nil {
+			return err
+		}
+		if _, ok := diff.accounts[accHash]; !ok {
+			undo.saveAccount(s.diskdb, s.gen, accHash)
+			rawdb.DeleteAccountSnapshot(batch, s.gen, accHash)
+		}
+	}
+	for accHash, enc := range diff.accounts {
+		if s.covered(accHash) {
+			undo.saveAccount(s.diskdb, s.gen, accHash)
+			rawdb.WriteAccountSnapshot(batch, s.gen, accHash, enc)
+		}
+	}
+	for accHash, slots := range diff.storage {
+		if !s.covered(accHash) {
+			continue
+		}
+		for slot, enc := range slots {
+			undo.saveStorage(s.diskdb, s.gen, accHash, slot)
+			if enc == nil {
+				rawdb.DeleteStorageSnapshot(batch, s.gen, accHash, slot)
+			} else {
+				rawdb.WriteStorageSnapshot(batch, s.gen, accHash, slot, enc)
+			}
+		}
+	}
+	s.root = diff.root
+	s.writeGenerator(batch)
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to update state snapshot", "err", err)
+	}
+	s.undos = append(s.undos, undo)
+	if len(s.undos) > maxSnapshotUndos {
+		s.undos = append(s.undos[:0], s.undos[1:]...)
+	}
+	return nil
+}
+
+// rollback restores the entries overwritten by the most recently applied diff,
+// moving the snapshot back to its parent root. It fails if the generator made
+// progress since the diff was applied, as the accounts generated in between
+// belong to the newer root. The caller must hold the write lock.
+func (s *Snapshot) rollback() bool {
+	undo := s.undos[len(s.undos)-1]
+	if (undo.marker == nil) != (s.marker == nil) || !bytes.Equal(undo.marker, s.marker) {
+		return false
+	}
+	batch := s.diskdb.NewBatch()
+	for accHash, enc := range undo.accounts {
+		if enc == nil {
+			rawdb.DeleteAccountSnapshot(batch, s.gen, accHash)
+		} else {
+			rawdb.WriteAccountSnapshot(batch, s.gen, accHash, enc)
+		}
+	}
+	for accHash, slots := range undo.storage {
+		for slot, enc := range slots {
+			if enc == nil {
+				rawdb.DeleteStorageSnapshot(batch, s.gen, accHash, slot)
+			} else {
+				rawdb.WriteStorageSnapshot(batch, s.gen, accHash, slot, enc)
+			}
+		}
+	}
+	s.root = undo.parent
+	s.writeGenerator(batch)
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to roll back state snapshot", "err", err)
+	}
+	s.undos = s.undos[:len(s.undos)-1]
+	return true
+}
+
+// wipeStorage deletes the flat storage entries of an account, found through the
+// storage trie of its flat account entry, recording them in the undo. The caller
+// must hold the write lock.
+func (s *Snapshot) wipeStorage(batch ethdb.Batch, accHash common.Hash, undo *snapshotUndo) error {
+	enc := rawdb.ReadAccountSnapshot(s.diskdb, s.gen, accHash)
+	if enc == nil {
+		return nil
+	}
+	var account Account
+	if err := rlp.DecodeBytes(enc, &account); err != nil {
+		return err
+	}
+	if account.Root == types.EmptyRootHash {
+		return nil
+	}
+	tr, err := trie.NewSecure(account.Root, s.triedb, 0)
+	if err != nil {
+		return err
+	}
+	it := trie.NewIterator(tr.NodeIterator(nil))
+	for it.Next() {
+		slot := common.BytesToHash(it.Key)
+		undo.saveStorage(s.diskdb, s.gen, accHash, slot)
+		rawdb.DeleteStorageSnapshot(batch, s.gen, accHash, slot)
+	}
+	return it.Err
+}
+
+// generate builds the flat entries of the snapshot root from its tries, following
+// the root as it moves with the commits. If the tries are not available (e.g.
+// pruned), it waits for the next root change.
+func (s *Snapshot) generate() {
+	defer s.wg.Done()
+
+	start := time.Now()
+	for {
+		s.lock.Lock()
+		root, gen, marker := s.root, s.gen, s.marker
+		if marker == nil {
+			s.generating = false
+			s.lock.Unlock()
+			log.Info("Generated state snapshot", "root", root, "elapsed", common.PrettyDuration(time.Since(start)))
+			return
+		}
+		s.lock.Unlock()
+
+		err := s.generateRange(root, gen, marker)
+		if err == nil || err == errSnapshotRootChanged {
+			continue
+		}
+		log.Debug("State snapshot generation paused", "root", root, "err", err)
+		select {
+		case <-s.wake:
+		case <-s.quit:
+			s.lock.Lock()
+			s.generating = false
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+// generateRange generates the accounts after the marker from the tries of the
+// given root, until it's done, interrupted or the root changes.
+func (s *Snapshot) generateRange(root common.Hash, gen uint64, marker []byte) error {
+	tr, err := trie.NewSecure(root, s.triedb, 0)
+	if err != nil {
+		return err
+	}
+	var start []byte
+	if len(marker) > 0 {
+		if start = nextHash(marker); start == nil {
+			return s.finishGeneration(root, gen)
+		}
+	}
+	it := trie.NewIterator(tr.NodeIterator(start))
+	for it.Next() {
+		select {
+		case <-s.quit:
+			return errors.New("snapshot generation aborted")
+		default:
+		}
+		accHash := common.BytesToHash(it.Key)
+		var account Account
+		if err := rlp.DecodeBytes(it.Value, &account); err != nil {
+			return err
+		}
+		batch := s.diskdb.NewBatch()
+		rawdb.WriteAccountSnapshot(batch, gen, accHash, common.CopyBytes(it.Value))
+		if account.Root != types.EmptyRootHash {
+			st, err := trie.NewSecure(account.Root, s.triedb, 0)
+			if err != nil {
+				return err
+			}
+			sit := trie.NewIterator(st.NodeIterator(nil))
+			for sit.Next() {
+				rawdb.WriteStorageSnapshot(batch, gen, accHash, common.BytesToHash(sit.Key), common.CopyBytes(sit.Value))
+			}
+			if sit.Err != nil {
+				return sit.Err
+			}
+		}
+		s.lock.Lock()
+		if s.root != root || s.gen != gen {
+			s.lock.Unlock()
+			return errSnapshotRootChanged
+		}
+		s.marker = accHash.Bytes()
+		s.writeGenerator(batch)
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to write state snapshot", "err", err)
+		}
+		s.lock.Unlock()
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+	return s.finishGeneration(root, gen)
+}
+
+// finishGeneration marks the generation of the given root as done.
+func (s *Snapshot) finishGeneration(root common.Hash, gen uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.root != root || s.gen != gen {
+		return errSnapshotRootChanged
+	}
+	s.marker = nil
+	s.writeGenerator(s.diskdb)
+	return nil
+}
+
+// nextHash returns the hash following the given one, nil if there is none.
+func nextHash(hash []byte) []byte {
+	next := common.CopyBytes(hash)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// SetSnapshot installs a flat state snapshot consulted by the states opened
+// through the database from now on before their tries, or removes it if nil. It
+// returns false if the database doesn't support snapshots.
+func SetSnapshot(db Database, snap *Snapshot) bool {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return false
+	}
+	cdb.mu.Lock()
+	cdb.snap = snap
+	cdb.mu.Unlock()
+	return true
+}
+
+// GetSnapshot returns the flat state snapshot installed in the database, if any.
+func GetSnapshot(db Database) *Snapshot {
+	cdb, ok := db.(*cachingDB)
+	if !ok {
+		return nil
+	}
+	cdb.mu.Lock()
+	defer cdb.mu.Unlock()
+	return cdb.snap
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// checkSnapshot verifies that the flat entries of the snapshot match the tries
+// of the given root for all the accounts and storage slots.
+func checkSnapshot(t *testing.T, snap *Snapshot, triedb *trie.Database, root common.Hash, addrs []common.Address, keys []common.Hash) {
+	tr, err := trie.NewSecure(root, triedb, 0)
+	if err != nil {
+		t.Fatalf("failed to open state trie: %v", err)
+	}
+	for _, addr := range addrs {
+		want, _ := tr.TryGet(addr[:])
+		have, ok := snap.account(root, crypto.Keccak256Hash(addr[:]))
+		if !ok {
+			t.Fatalf("account %x not served", addr)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", addr, have, want)
+		}
+		if len(want) == 0 {
+			continue
+		}
+		var account Account
+		rlp.DecodeBytes(want, &account)
+		st, err := trie.NewSecure(account.Root, triedb, 0)
+		if err != nil {
+			t.Fatalf("failed to open storage trie: %v", err)
+		}
+		for _, key := range keys {
+			want, _ := st.TryGet(key[:])
+			if have, _ := snap.storage(root, crypto.Keccak256Hash(addr[:]), key); !bytes.Equal(have, want) {
+				t.Errorf("account %x slot %x mismatch: have %x, want %x", addr, key, have, want)
+			}
+		}
+	}
+}
+
+// Tests that the snapshot is generated from the tries, serves the reads of the
+// state, and follows the commits on top of its root.
+func TestSnapshotGenerationAndUpdate(t *testing.T) {
+	var (
+		diskdb = ethdb.NewMemDatabase()
+		db     = NewDatabase(diskdb)
+		addrs  []common.Address
+		keys   = []common.Hash{{1}, {2}, {3}, {4}}
+	)
+	state, _ := New(common.Hash{}, db)
+	for i := 1; i <= 16; i++ {
+		addr := common.BytesToAddress([]byte{byte(i)})
+		addrs = append(addrs, addr)
+		state.AddBalance(addr, big.NewInt(int64(i)))
+		if i%4 == 0 {
+			state.SetCode(addr, []byte{byte(i)})
+			for j := 0; j < 3; j++ {
+				state.SetState(addr, keys[j], common.Hash{byte(i), byte(j + 1)})
+			}
+		}
+	}
+	root, _ := state.Commit(false)
+
+	snap := NewSnapshot(diskdb, db.TrieDB())
+	defer snap.Stop()
+	SetSnapshot(db, snap)
+	snap.Rebuild(root)
+	for start := time.Now(); !snap.Generated(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("snapshot not generated")
+		}
+	}
+	checkSnapshot(t, snap, db.TrieDB(), root, addrs, keys)
+
+	// Modify the state on top of the snapshot root, recreating an account
+	state, _ = New(root, db)
+	if have := state.GetState(addrs[3], keys[1]); have != (common.Hash{4, 2}) {
+		t.Fatalf("storage read mismatch: have %x", have)
+	}
+	state.SetBalance(addrs[0], big.NewInt(100))
+	state.SetState(addrs[3], keys[0], common.Hash{})
+	state.SetState(addrs[3], keys[3], common.Hash{0xff})
+	state.Suicide(addrs[7])
+	state.Finalise(false)
+
+	state.CreateAccount(addrs[7])
+	state.SetState(addrs[7], keys[3], common.Hash{0xee})
+	state.CreateAccount(addrs[11])
+	state.SetState(addrs[11], keys[3], common.Hash{0xdd})
+
+	root2, err := state.Commit(false)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if snap.Root() != root {
+		t.Fatalf("snapshot moved before following the commit: have %x", snap.Root())
+	}
+	snap.Follow(root2)
+	if snap.Root() != root2 {
+		t.Fatalf("snapshot root mismatch: have %x, want %x", snap.Root(), root2)
+	}
+	checkSnapshot(t, snap, db.TrieDB(), root2, addrs, keys)
+
+	// Reads of the previous root are not served anymore
+	if _, ok := snap.account(root, crypto.Keccak256Hash(addrs[0][:])); ok {
+		t.Errorf("stale root served")
+	}
+	state, _ = New(root2, db)
+	if have := state.GetBalance(addrs[0]); have.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("balance mismatch: have %v, want 100", have)
+	}
+	if have := state.GetState(addrs[7], keys[0]); have != (common.Hash{}) {
+		t.Errorf("wiped storage served: %x", have)
+	}
+}
+
+// Tests that the generation progress survives a restart.
+func TestSnapshotResume(t *testing.T) {
+	diskdb := ethdb.NewMemDatabase()
+	db := NewDatabase(diskdb)
+	state, _ := New(common.Hash{}, db)
+	state.AddBalance(common.Address{1}, big.NewInt(1))
+	root, _ := state.Commit(false)
+
+	snap := NewSnapshot(diskdb, db.TrieDB())
+	snap.Rebuild(root)
+	for !snap.Generated() {
+		time.Sleep(time.Millisecond)
+	}
+	snap.Stop()
+
+	snap = NewSnapshot(diskdb, db.TrieDB())
+	if snap.Root() != root || !snap.Generated() {
+		t.Fatalf("snapshot progress lost: root %x, generated %v", snap.Root(), snap.Generated())
+	}
+	if enc, ok := snap.account(root, crypto.Keccak256Hash(common.Address{1}.Bytes())); !ok || len(enc) == 0 {
+		t.Errorf("account not served after restart")
+	}
+}
+
+// Tests that the snapshot follows reorgs by rolling back the applied diffs to the
+// common ancestor instead of regenerating, and only regenerates if the new root
+// can't be reached through the recorded diffs.
+func TestSnapshotReorg(t *testing.T) {
+	var (
+		diskdb = ethdb.NewMemDatabase()
+		db     = NewDatabase(diskdb)
+		addrs  = []common.Address{{1}, {2}, {3}}
+		keys   = []common.Hash{{1}, {2}}
+	)
+	state, _ := New(common.Hash{}, db)
+	for i, addr := range addrs {
+		state.AddBalance(addr, big.NewInt(int64(i+1)))
+		state.SetState(addr, keys[0], common.Hash{byte(i + 1)})
+	}
+	root, _ := state.Commit(false)
+
+	snap := NewSnapshot(diskdb, db.TrieDB())
+	defer snap.Stop()
+	SetSnapshot(db, snap)
+	snap.Rebuild(root)
+	for start := time.Now(); !snap.Generated(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("snapshot not generated")
+		}
+	}
+	snap.lock.RLock()
+	gen := snap.gen
+	snap.lock.RUnlock()
+
+	// Build two forks on top of the root, the first one two commits long
+	state, _ = New(root, db)
+	state.SetBalance(addrs[0], big.NewInt(100))
+	state.SetState(addrs[1], keys[1], common.Hash{0xaa})
+	a1, _ := state.Commit(false)
+	state, _ = New(a1, db)
+	state.Suicide(addrs[2])
+	a2, _ := state.Commit(false)
+
+	state, _ = New(root, db)
+	state.SetBalance(addrs[1], big.NewInt(200))
+	state.SetState(addrs[0], keys[0], common.Hash{})
+	b1, _ := state.Commit(false)
+
+	snap.Follow(a2)
+	checkSnapshot(t, snap, db.TrieDB(), a2, addrs, keys)
+	snap.Follow(b1)
+	checkSnapshot(t, snap, db.TrieDB(), b1, addrs, keys)
+	snap.Follow(a2)
+	checkSnapshot(t, snap, db.TrieDB(), a2, addrs, keys)
+
+	snap.lock.RLock()
+	if snap.gen != gen || snap.marker != nil {
+		t.Errorf("snapshot regenerated on reorg: generation %d, want %d", snap.gen, gen)
+	}
+	snap.lock.RUnlock()
+
+	// A root without recorded diffs can only be reached by regenerating
+	state, _ = New(root, db)
+	state.SetBalance(addrs[2], big.NewInt(300))
+	c1, _ := state.Commit(false)
+	snap.lock.Lock()
+	delete(snap.diffs, c1)
+	snap.lock.Unlock()
+
+	snap.Follow(c1)
+	for start := time.Now(); !snap.Generated(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("snapshot not regenerated")
+		}
+	}
+	snap.lock.RLock()
+	if snap.gen == gen {
+		t.Errorf("snapshot not regenerated for unreachable root")
+	}
+	snap.lock.RUnlock()
+	checkSnapshot(t, snap, db.TrieDB(), c1, addrs, keys)
+}
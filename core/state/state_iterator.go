@@ -0,0 +1,151 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// AccountIterator walks the accounts of a state root in the order of their
+// address hashes, decoding them on the way. It is meant for external indexers
+// that need to visit a full state without dealing with the trie encoding.
+//
+/**
+AccountIterator:
+按 address hash 的顺序遍历某个 state root 下的所有账户 (已 rlp 解码),
+并可以为当前账户打开 storage 迭代器, 方便外部索引工具遍历整个 state
+*/
+type AccountIterator struct {
+	db   Database
+	tr   Trie
+	iter *trie.Iterator
+
+	Hash    common.Hash     // Hash of the address of the current account
+	Address *common.Address // Address of the current account, nil if its preimage is unknown
+	Account Account         // Decoded current account
+
+	Err error // Failure set in case of an internal error in the iterator
+}
+
+// NewIterator creates an iterator over the accounts of the given state root.
+func NewIterator(db Database, root common.Hash) (*AccountIterator, error) {
+	return NewIteratorFrom(db, root, common.Hash{})
+}
+
+// NewIteratorFrom creates an iterator over the accounts of the given state root
+// starting at the given address hash, e.g. to resume an interrupted walk.
+func NewIteratorFrom(db Database, root, start common.Hash) (*AccountIterator, error) {
+	tr, err := db.OpenTrie(root)
+	if err != nil {
+		return nil, err
+	}
+	return &AccountIterator{
+		db:   db,
+		tr:   tr,
+		iter: trie.NewIterator(tr.NodeIterator(start[:])),
+	}, nil
+}
+
+// Next moves the iterator to the next account, returning whether there is one.
+// In case of an internal error it returns false and sets the Err field.
+func (it *AccountIterator) Next() bool {
+	if it.Err != nil {
+		return false
+	}
+	if !it.iter.Next() {
+		it.Err = it.iter.Err
+		return false
+	}
+	var account Account
+	if err := rlp.DecodeBytes(it.iter.Value, &account); err != nil {
+		it.Err = err
+		return false
+	}
+	it.Hash, it.Account = common.BytesToHash(it.iter.Key), account
+	it.Address = nil
+	if preimage := it.tr.GetKey(it.iter.Key); preimage != nil {
+		addr := common.BytesToAddress(preimage)
+		it.Address = &addr
+	}
+	return true
+}
+
+// Code retrieves the contract code of the current account, nil if it has none.
+func (it *AccountIterator) Code() ([]byte, error) {
+	if bytes.Equal(it.Account.CodeHash, emptyCodeHash) {
+		return nil, nil
+	}
+	return it.db.ContractCode(it.Hash, common.BytesToHash(it.Account.CodeHash))
+}
+
+// Storage creates an iterator over the storage slots of the current account.
+func (it *AccountIterator) Storage() (*StorageIterator, error) {
+	root := it.Account.Root
+	if root == types.EmptyRootHash {
+		root = common.Hash{}
+	}
+	tr, err := it.db.OpenStorageTrie(it.Hash, root)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageIterator{
+		tr:   tr,
+		iter: trie.NewIterator(tr.NodeIterator(nil)),
+	}, nil
+}
+
+// StorageIterator walks the storage slots of an account in the order of their
+// key hashes, decoding the values on the way.
+type StorageIterator struct {
+	tr   Trie
+	iter *trie.Iterator
+
+	Hash  common.Hash  // Hash of the key of the current slot
+	Key   *common.Hash // Key of the current slot, nil if its preimage is unknown
+	Value common.Hash  // Value of the current slot
+
+	Err error // Failure set in case of an internal error in the iterator
+}
+
+// Next moves the iterator to the next storage slot, returning whether there is
+// one. In case of an internal error it returns false and sets the Err field.
+func (it *StorageIterator) Next() bool {
+	if it.Err != nil {
+		return false
+	}
+	if !it.iter.Next() {
+		it.Err = it.iter.Err
+		return false
+	}
+	_, content, _, err := rlp.Split(it.iter.Value)
+	if err != nil {
+		it.Err = err
+		return false
+	}
+	it.Hash, it.Value = common.BytesToHash(it.iter.Key), common.BytesToHash(content)
+	it.Key = nil
+	if preimage := it.tr.GetKey(it.iter.Key); preimage != nil {
+		key := common.BytesToHash(preimage)
+		it.Key = &key
+	}
+	return true
+}
@@ -118,6 +118,13 @@ type stateObject struct {
 
 	// 账户删除标识 <注意： 自杀时，还未被删除的>
 	deleted   bool
+
+	// Flat snapshot tracking.
+	//
+	// loaded 表示账户是从 state 中加载的 (而不是新建的), 只有这样的账户才能从 snapshot 读 storage
+	loaded      bool                   // the object was loaded from the state, its storage can be read from the snapshot
+	recreated   bool                   // the object overwrote an existing account since the last commit
+	snapStorage map[common.Hash][]byte // storage trie values written since the last commit, nil for deletions
 }
 
 // empty returns whether the account is considered empty.
@@ -221,8 +228,20 @@ func (self *stateObject) GetState(db Database, key common.Hash) common.Hash {
 	}
 	// Load from DB in case it is missing.
 	//
-	// 当缓存 没有时, 尝试从 trie 上拿
-	enc, err := self.getTrie(db).TryGet(key[:])  // GetState() 时, 这里的 key  是 32 byte
+	// 当缓存 没有时, 先尝试从 snapshot 上拿 (需要考虑已经写进 trie 但尚未 commit 的值), 再尝试从 trie 上拿
+	var (
+		enc []byte
+		err error
+		hit bool
+	)
+	if self.loaded && self.db.snap != nil {
+		if enc, hit = self.snapStorage[key]; !hit {
+			enc, hit = self.db.snap.storage(self.db.originalRoot, self.addrHash, key)
+		}
+	}
+	if !hit {
+		enc, err = self.getTrie(db).TryGet(key[:])  // GetState() 时, 这里的 key  是 32 byte
+	}
 	if err != nil {
 		self.setError(err)
 		return common.Hash{}
@@ -267,8 +286,14 @@ func (self *stateObject) updateTrie(db Database) Trie {
 	// 将 dirtStorage 的东西更新树
 	for key, value := range self.dirtyStorage {
 		delete(self.dirtyStorage, key)
+		if self.db.snap != nil && self.snapStorage == nil {
+			self.snapStorage = make(map[common.Hash][]byte)
+		}
 		if (value == common.Hash{}) {
 			self.setError(tr.TryDelete(key[:]))
+			if self.snapStorage != nil {
+				self.snapStorage[key] = nil
+			}
 			continue
 		}
 		// Encoding []byte cannot fail, ok to ignore the error.
@@ -278,6 +303,9 @@ func (self *stateObject) updateTrie(db Database) Trie {
 		// 为什么需要切掉 0, 因为 前缀有0时, 说明真实的 value没32byte, value真实的值是不包含前面的0的, rlp当然是需要对真实值做编码, 还有就是 0其实做rlp也是有值的，不能被混淆了
 		v, _ := rlp.EncodeToBytes(bytes.TrimLeft(value[:], "\x00"))
 		self.setError(tr.TryUpdate(key[:], v))
+		if self.snapStorage != nil {
+			self.snapStorage[key] = v
+		}
 	}
 	return tr
 }
@@ -355,6 +383,14 @@ func (self *stateObject) deepCopy(db *StateDB) *stateObject {
 	stateObject.suicided = self.suicided
 	stateObject.dirtyCode = self.dirtyCode
 	stateObject.deleted = self.deleted
+	stateObject.loaded = self.loaded
+	stateObject.recreated = self.recreated
+	if self.snapStorage != nil {
+		stateObject.snapStorage = make(map[common.Hash][]byte, len(self.snapStorage))
+		for key, value := range self.snapStorage {
+			stateObject.snapStorage[key] = value
+		}
+	}
 	return stateObject
 }
 
@@ -68,6 +68,18 @@ type StateDB struct {
 	// todo 而 cachingTrie 其实是封装了 SecureTrie
 	trie Trie
 
+	// Flat state snapshot consulted before the trie, serving the reads of the
+	// state root the StateDB was opened at (or last committed).
+	//
+	// snap 只能服务 originalRoot 这个 state 的读取, snapDestructs 记录自上次 commit 以来被删除的账户 (commit 时清空其 flat storage)
+	snap          *Snapshot
+	originalRoot  common.Hash
+	snapDestructs map[common.Hash]struct{}
+
+	// Filter of the existing accounts, answering the reads of missing accounts
+	// in the covered states without resolving the trie.
+	bloom *AccountBloom
+
 	// This map holds 'live' objects, which will get modified while processing a state transition.
 	//
 	// 此map包含“活动”对象，在处理state转换时会对其进行修改。
@@ -129,17 +141,27 @@ func New(root common.Hash, db Database) (*StateDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newWithTrie(db, tr), nil
+}
+
+// newWithTrie creates a new state on top of an already opened account trie.
+func newWithTrie(db Database, tr Trie) *StateDB {
 	return &StateDB{
 		db:                db,  // 外面入参的 全局的 cachingDB 实例
 		trie:              tr,
+		snap:              GetSnapshot(db),
+		bloom:             GetAccountBloom(db),
+		originalRoot:      tr.Hash(),
+		snapDestructs:     make(map[common.Hash]struct{}),
 		stateObjects:      make(map[common.Address]*stateObject),
 		stateObjectsDirty: make(map[common.Address]struct{}),
 		logs:              make(map[common.Hash][]*types.Log),
 		preimages:         make(map[common.Hash][]byte),
 		journal:           newJournal(),
-	}, nil
+	}
 }
 
+
 // setError remembers the first non-nil error it is called with.
 //
 // setError: 记住第一个非零错误
@@ -165,6 +187,8 @@ func (self *StateDB) Reset(root common.Hash) error {
 		return err
 	}
 	self.trie = tr
+	self.originalRoot = root
+	self.snapDestructs = make(map[common.Hash]struct{})
 	self.stateObjects = make(map[common.Address]*stateObject)
 	self.stateObjectsDirty = make(map[common.Address]struct{})
 	self.thash = common.Hash{}
@@ -419,6 +443,9 @@ func (self *StateDB) deleteStateObject(stateObject *stateObject) {
 
 	// 将 State Trie 上的对应该账户的信息 移除
 	self.setError(self.trie.TryDelete(addr[:]))
+	if self.snap != nil {
+		self.snapDestructs[stateObject.addrHash] = struct{}{}
+	}
 }
 
 // Retrieve a state object given by the address. Returns nil if not found.
@@ -431,8 +458,22 @@ func (self *StateDB) getStateObject(addr common.Address) (stateObject *stateObje
 		return obj
 	}
 
-	// Load the object from the database.
-	enc, err := self.trie.TryGet(addr[:])  // getStateObject(addr) 时, 这里的 key 是 addr 是 20 byte
+	// Skip the accounts known to be missing from the state
+	if self.bloom != nil && !self.bloom.mayContain(self.originalRoot, crypto.Keccak256Hash(addr[:])) {
+		return nil
+	}
+	// Load the object from the database, preferring the flat snapshot.
+	var (
+		enc []byte
+		err error
+		hit bool
+	)
+	if self.snap != nil {
+		enc, hit = self.snap.account(self.originalRoot, crypto.Keccak256Hash(addr[:]))
+	}
+	if !hit {
+		enc, err = self.trie.TryGet(addr[:])  // getStateObject(addr) 时, 这里的 key 是 addr 是 20 byte
+	}
 	if len(enc) == 0 {
 		self.setError(err)
 		return nil
@@ -446,6 +487,7 @@ func (self *StateDB) getStateObject(addr common.Address) (stateObject *stateObje
 	}
 	// Insert into the live set.
 	obj := newObject(self, addr, data)  // 创建 内存中的 stateObject
+	obj.loaded = true
 	self.setStateObject(obj)			// 将 stateObject 放入 StateDB 的 map 缓存
 	return obj
 }
@@ -469,6 +511,7 @@ func (self *StateDB) createObject(addr common.Address) (newobj, prev *stateObjec
 	prev = self.getStateObject(addr)
 	newobj = newObject(self, addr, Account{})
 	newobj.setNonce(0) // sets the object to dirty
+	newobj.recreated = prev != nil
 	if prev == nil {
 		self.journal.append(createObjectChange{account: &addr})
 	} else {
@@ -495,6 +538,9 @@ func (self *StateDB) CreateAccount(addr common.Address) {
 	}
 }
 
+// ForEachStorage calls cb with the decoded storage slots of the account. The slots
+// which can't be decoded are skipped, the first such error is remembered and
+// returned by Error.
 func (db *StateDB) ForEachStorage(addr common.Address, cb func(key, value common.Hash) bool) {
 	so := db.getStateObject(addr)
 	if so == nil {
@@ -511,7 +557,13 @@ func (db *StateDB) ForEachStorage(addr common.Address, cb func(key, value common
 		// ignore cached values
 		key := common.BytesToHash(db.trie.GetKey(it.Key))  // 这里获取的是 key 的原始数据, 没做 sha3，  没做 hex，  没做  compact 的
 		if _, ok := so.cachedStorage[key]; !ok {
-			cb(key, common.BytesToHash(it.Value))
+			// 存储的是 rlp 编码后 (去掉前缀 0) 的 value, 与 stateObject.GetCommittedState() 一样先解码
+			_, content, _, err := rlp.Split(it.Value)
+			if err != nil {
+				db.setError(fmt.Errorf("undecodable storage slot %x of %x: %v", key, addr, err))
+				continue
+			}
+			cb(key, common.BytesToHash(content))
 		}
 	}
 }
@@ -529,6 +581,10 @@ func (self *StateDB) Copy() *StateDB {
 	state := &StateDB{
 		db:                self.db,
 		trie:              self.db.CopyTrie(self.trie),
+		snap:              self.snap,
+		bloom:             self.bloom,
+		originalRoot:      self.originalRoot,
+		snapDestructs:     make(map[common.Hash]struct{}, len(self.snapDestructs)),
 		stateObjects:      make(map[common.Address]*stateObject, len(self.journal.dirties)),
 		stateObjectsDirty: make(map[common.Address]struct{}, len(self.journal.dirties)),
 		refund:            self.refund,
@@ -567,6 +623,9 @@ func (self *StateDB) Copy() *StateDB {
 	for hash, preimage := range self.preimages {
 		state.preimages[hash] = preimage
 	}
+	for hash := range self.snapDestructs {
+		state.snapDestructs[hash] = struct{}{}
+	}
 	return state
 }
 
@@ -690,6 +749,16 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (root common.Hash, err error)
 	}
 
 
+	// Collect the changes of the flat snapshot along the way
+	var (
+		snapAccounts map[common.Hash][]byte
+		snapStorage  map[common.Hash]map[common.Hash][]byte
+		bloomHashes  []common.Hash
+	)
+	if s.snap != nil {
+		snapAccounts = make(map[common.Hash][]byte)
+		snapStorage = make(map[common.Hash]map[common.Hash][]byte)
+	}
 	// Commit objects to the trie.
 	//
 	// 逐个处理最近活动的 账户
@@ -729,6 +798,13 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (root common.Hash, err error)
 			}
 			// Update the object in the main account trie.
 			s.updateStateObject(stateObject)   // 将该 stateObject 去更新 stateDB的 trie
+
+			if s.snap != nil {
+				s.snapObjectChanges(stateObject, snapAccounts, snapStorage)
+			}
+			if s.bloom != nil {
+				bloomHashes = append(bloomHashes, stateObject.addrHash)
+			}
 		}
 		delete(s.stateObjectsDirty, addr)
 	}
@@ -763,5 +839,41 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (root common.Hash, err error)
 		return nil
 	})
 	log.Debug("Trie cache stats after commit", "misses", trie.CacheMisses(), "unloads", trie.CacheUnloads())  // 将统计的变量,   缓存未命中次数   和  node从内存中卸载次数   打印出来
+	if err == nil {
+		if s.snap != nil {
+			s.snap.update(s.originalRoot, root, s.snapDestructs, snapAccounts, snapStorage)
+			s.snapDestructs = make(map[common.Hash]struct{})
+		}
+		if s.bloom != nil {
+			s.bloom.update(s.originalRoot, root, bloomHashes)
+		}
+		s.originalRoot = root
+	}
 	return root, err
 }
+
+// snapObjectChanges collects the changes of a committed object for the flat
+// snapshot and resets the ones tracked by the object.
+func (s *StateDB) snapObjectChanges(obj *stateObject, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) {
+	enc, err := rlp.EncodeToBytes(obj)
+	if err != nil {
+		panic(fmt.Errorf("can't encode object at %x: %v", obj.address[:], err))
+	}
+	accounts[obj.addrHash] = enc
+	if obj.recreated {
+		// The previous account was overwritten, its storage is gone
+		s.snapDestructs[obj.addrHash] = struct{}{}
+		obj.recreated = false
+	}
+	if len(obj.snapStorage) > 0 {
+		slots := storage[obj.addrHash]
+		if slots == nil {
+			slots = make(map[common.Hash][]byte, len(obj.snapStorage))
+			storage[obj.addrHash] = slots
+		}
+		for key, value := range obj.snapStorage {
+			slots[crypto.Keccak256Hash(key[:])] = value
+		}
+		obj.snapStorage = nil
+	}
+}
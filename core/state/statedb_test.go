@@ -167,6 +167,48 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+// Tests that ForEachStorage reports the decoded values of the committed slots
+// and skips the undecodable ones, remembering the error.
+func TestForEachStorage(t *testing.T) {
+	var (
+		addr  = common.BytesToAddress([]byte{1})
+		key1  = common.BytesToHash([]byte{1})
+		key2  = common.BytesToHash([]byte{2})
+		value = common.BytesToHash([]byte{0, 1, 2})
+	)
+	db := NewDatabase(ethdb.NewMemDatabase())
+	state, _ := New(common.Hash{}, db)
+	state.SetState(addr, key1, value)
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, db)
+	slots := make(map[common.Hash]common.Hash)
+	state.ForEachStorage(addr, func(key, value common.Hash) bool {
+		slots[key] = value
+		return true
+	})
+	if len(slots) != 1 || slots[key1] != value {
+		t.Fatalf("iterated storage mismatch: have %x, want %x", slots, value)
+	}
+	if err := state.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+
+	// A slot whose RLP encoding is cut short can't be decoded
+	state.getStateObject(addr).getTrie(db).TryUpdate(key2[:], []byte{0x82, 0x01})
+	slots = make(map[common.Hash]common.Hash)
+	state.ForEachStorage(addr, func(key, value common.Hash) bool {
+		slots[key] = value
+		return true
+	})
+	if _, ok := slots[key2]; ok || len(slots) != 1 {
+		t.Errorf("undecodable slot iterated: %x", slots)
+	}
+	if state.Error() == nil {
+		t.Errorf("undecodable slot not reported")
+	}
+}
+
 func TestSnapshotRandom(t *testing.T) {
 	config := &quick.Config{MaxCount: 1000}
 	err := quick.Check((*snapshotTest).run, config)
@@ -0,0 +1,98 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+)
+
+// StateRange is the range of recent blocks whose state is available locally, so
+// that calls and proofs can be served on top of them.
+type StateRange struct {
+	Oldest uint64 // Oldest block of the contiguous range ending at the head
+	Newest uint64 // Newest block with state (the head block)
+
+	head common.Hash // head block the range was probed at
+}
+
+// StateRange probes the range of recent blocks with locally available state. The
+// range is the contiguous one ending at the head block, older states which were
+// flushed to disk sporadically (pruned nodes) are not included. The probe result
+// is cached until the head changes. Nil is returned if even the head has no state
+// (e.g. during fast sync).
+//
+/**
+StateRange: 探测 本地 有完整 state 的 最近区块范围 (以 head 结尾的 连续区间).
+	pruning 节点: 在 保留窗口内 从 head 往回 逐块检查;
+	archive 节点: 在 [1, head] 上二分查找 (fast sync 的 pivot 之前没有 state);
+结果 按 head 缓存.
+ */
+func (bc *BlockChain) StateRange() *StateRange {
+	head := bc.CurrentBlock()
+	if cached, _ := bc.stateRange.Load().(*StateRange); cached != nil && cached.head == head.Hash() {
+		return cached
+	}
+	if !bc.HasState(head.Root()) {
+		return nil
+	}
+	number := head.NumberU64()
+	has := func(n uint64) bool {
+		header := bc.GetHeaderByNumber(n)
+		return header != nil && bc.HasState(header.Root)
+	}
+	oldest := number
+	if retention := bc.RecentStates(); retention > 0 {
+		// Pruned node: walk back through the retention window, the states before a
+		// restart are only partially persisted
+		for oldest > 0 && number-oldest+1 < retention && has(oldest-1) {
+			oldest--
+		}
+	} else {
+		// Archive node: every state after the fast sync pivot (if any) is kept,
+		// the genesis state is always present so it's not probed
+		lo, hi := uint64(1), number
+		for lo < hi {
+			if mid := (lo + hi) / 2; has(mid) {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		if oldest = lo; oldest == 1 && has(0) {
+			oldest = 0
+		}
+		if oldest > number {
+			oldest = number
+		}
+	}
+	sr := &StateRange{Oldest: oldest, Newest: number, head: head.Hash()}
+	bc.stateRange.Store(sr)
+	return sr
+}
+
+// Contains returns whether the state of the given block number is available.
+func (sr *StateRange) Contains(number uint64) bool {
+	return sr != nil && sr.Oldest <= number && number <= sr.Newest
+}
+
+// Blocks returns the number of blocks in the range.
+func (sr *StateRange) Blocks() uint64 {
+	if sr == nil {
+		return 0
+	}
+	return sr.Newest - sr.Oldest + 1
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
+)
+
+// newStateRangeChain creates a chain of n blocks with distinct state roots.
+func newStateRangeChain(t *testing.T, db ethdb.Database, cacheConfig *CacheConfig, n int) *BlockChain {
+	gendb := ethdb.NewMemDatabase()
+	genesis := new(Genesis).MustCommit(gendb)
+	new(Genesis).MustCommit(db)
+	chain, err := NewBlockChain(db, cacheConfig, params.TestChainConfig, ethash.NewFaker(), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), gendb, n, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{byte(i + 1)})
+	})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return chain
+}
+
+// Tests that the contiguous range of available states is found on archive nodes,
+// e.g. starting at the pivot block of a fast sync.
+func TestStateRangeArchive(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newStateRangeChain(t, db, &CacheConfig{Disabled: true}, 20)
+
+	if sr := chain.StateRange(); sr == nil || sr.Oldest != 0 || sr.Newest != 20 {
+		t.Fatalf("full range mismatch: have %+v, want [0, 20]", sr)
+	}
+	// Drop the states before block 10, the cached range is kept until the head changes
+	for n := uint64(1); n < 10; n++ {
+		root := chain.GetHeaderByNumber(n).Root
+		db.Delete(root[:])
+	}
+	if sr := chain.StateRange(); sr.Oldest != 0 {
+		t.Fatalf("cached range not used: have %+v", sr)
+	}
+	chain.Stop()
+
+	chain, err := NewBlockChain(db, &CacheConfig{Disabled: true}, params.TestChainConfig, ethash.NewFaker(), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to reopen chain: %v", err)
+	}
+	defer chain.Stop()
+
+	sr := chain.StateRange()
+	if sr == nil || sr.Oldest != 10 || sr.Newest != 20 {
+		t.Fatalf("partial range mismatch: have %+v, want [10, 20]", sr)
+	}
+	if sr.Contains(9) || !sr.Contains(10) || !sr.Contains(20) || sr.Contains(21) || sr.Blocks() != 11 {
+		t.Errorf("range accessors mismatch: %+v", sr)
+	}
+}
+
+// Tests that the range of pruned nodes covers the in-memory states, and only the
+// persisted ones after a restart.
+func TestStateRangePruned(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newStateRangeChain(t, db, nil, 20)
+
+	if sr := chain.StateRange(); sr == nil || sr.Oldest != 0 || sr.Newest != 20 {
+		t.Fatalf("in-memory range mismatch: have %+v, want [0, 20]", sr)
+	}
+	chain.Stop()
+
+	// The states of the head and its parent are flushed on shutdown
+	chain, err := NewBlockChain(db, nil, params.TestChainConfig, ethash.NewFaker(), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to reopen chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if sr := chain.StateRange(); sr == nil || sr.Oldest != 19 || sr.Newest != 20 {
+		t.Fatalf("restarted range mismatch: have %+v, want [19, 20]", sr)
+	}
+}
@@ -727,6 +727,70 @@ func (pool *TxPool) SetGasPrice(price *big.Int) {
 	log.Info("Transaction pool price threshold updated", "price", price)
 }
 
+// TxPoolLimits is the subset of the pool configuration that may be changed while
+// the pool is running.
+type TxPoolLimits struct {
+	PriceBump    uint64 `json:"priceBump"`    // Minimum price bump percentage to replace an already existing transaction (nonce)
+	AccountSlots uint64 `json:"accountSlots"` // Number of executable transaction slots guaranteed per account
+	GlobalSlots  uint64 `json:"globalSlots"`  // Maximum number of executable transaction slots for all accounts
+	AccountQueue uint64 `json:"accountQueue"` // Maximum number of non-executable transaction slots permitted per account
+	GlobalQueue  uint64 `json:"globalQueue"`  // Maximum number of non-executable transaction slots for all accounts
+}
+
+// Limits returns the currently active replacement and slot limits of the pool.
+func (pool *TxPool) Limits() TxPoolLimits {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return TxPoolLimits{
+		PriceBump:    pool.config.PriceBump,
+		AccountSlots: pool.config.AccountSlots,
+		GlobalSlots:  pool.config.GlobalSlots,
+		AccountQueue: pool.config.AccountQueue,
+		GlobalQueue:  pool.config.GlobalQueue,
+	}
+}
+
+// UpdateLimits atomically modifies the replacement and slot limits of the pool.
+// The update callback receives the current limits and may change any of them;
+// the result is validated and applied as a whole, after which the pool contents
+// are truncated to fit within the new limits.
+//
+// UpdateLimits: 运行时原子性地修改 txpool 的 PriceBump 及 slot 限制, 修改后会立即按照新的限制裁剪 pending 和 queue
+func (pool *TxPool) UpdateLimits(update func(limits *TxPoolLimits)) (TxPoolLimits, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	limits := TxPoolLimits{
+		PriceBump:    pool.config.PriceBump,
+		AccountSlots: pool.config.AccountSlots,
+		GlobalSlots:  pool.config.GlobalSlots,
+		AccountQueue: pool.config.AccountQueue,
+		GlobalQueue:  pool.config.GlobalQueue,
+	}
+	old := limits
+	update(&limits)
+
+	if limits.PriceBump < 1 {
+		return old, fmt.Errorf("invalid price bump %d", limits.PriceBump)
+	}
+	if limits.AccountSlots < 1 || limits.GlobalSlots < 1 || limits.AccountQueue < 1 || limits.GlobalQueue < 1 {
+		return old, errors.New("slot limits must be positive")
+	}
+	pool.config.PriceBump = limits.PriceBump
+	pool.config.AccountSlots = limits.AccountSlots
+	pool.config.GlobalSlots = limits.GlobalSlots
+	pool.config.AccountQueue = limits.AccountQueue
+	pool.config.GlobalQueue = limits.GlobalQueue
+
+	// enforce the (possibly lowered) limits on the current pool contents
+	pool.promoteExecutables(nil)
+
+	log.Info("Transaction pool limits updated", "pricebump", limits.PriceBump, "accountslots", limits.AccountSlots,
+		"globalslots", limits.GlobalSlots, "accountqueue", limits.AccountQueue, "globalqueue", limits.GlobalQueue)
+	return limits, nil
+}
+
 // State returns the virtual managed state of the transaction pool.
 func (pool *TxPool) State() *state.ManagedState {
 	pool.mu.RLock()
@@ -753,6 +753,48 @@ func TestTransactionQueueAccountLimiting(t *testing.T) {
 	}
 }
 
+// Tests that the pool limits can be changed at runtime, that lowered limits are
+// enforced on the existing pool contents and that invalid updates are rejected
+// as a whole.
+func TestTransactionPoolUpdateLimits(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	account, _ := deriveSender(transaction(0, 0, key))
+	pool.currentState.AddBalance(account, big.NewInt(1000000))
+
+	for i := uint64(1); i <= 10; i++ {
+		if err := pool.AddRemote(transaction(i, 100000, key)); err != nil {
+			t.Fatalf("tx %d: failed to add transaction: %v", i, err)
+		}
+	}
+	limits, err := pool.UpdateLimits(func(limits *TxPoolLimits) {
+		limits.AccountQueue = 4
+		limits.PriceBump = 50
+	})
+	if err != nil {
+		t.Fatalf("failed to update limits: %v", err)
+	}
+	if limits.AccountQueue != 4 || limits.PriceBump != 50 || limits.GlobalSlots != testTxPoolConfig.GlobalSlots {
+		t.Errorf("updated limits mismatch: %+v", limits)
+	}
+	if pool.queue[account].Len() != 4 {
+		t.Errorf("queue size mismatch: have %d, want %d", pool.queue[account].Len(), 4)
+	}
+	// an invalid field must leave all the limits untouched
+	if _, err := pool.UpdateLimits(func(limits *TxPoolLimits) {
+		limits.GlobalQueue = 1
+		limits.GlobalSlots = 0
+	}); err == nil {
+		t.Fatalf("invalid limits accepted")
+	}
+	if have := pool.Limits(); have != limits {
+		t.Errorf("limits changed by failed update: have %+v, want %+v", have, limits)
+	}
+}
+
 // Tests that if the transaction count belonging to multiple accounts go above
 // some threshold, the higher transactions are dropped to prevent DOS attacks.
 //
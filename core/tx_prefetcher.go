@@ -0,0 +1,140 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
+)
+
+const (
+	// maxPrefetchAccounts is the number of accounts prefetched for a new head,
+	// the senders of the pending transactions beyond it are skipped.
+	maxPrefetchAccounts = 4096
+
+	// prefetchTxChanSize is the size of the channel listening to NewTxsEvent.
+	prefetchTxChanSize = 1024
+)
+
+// TxPrefetcher is an optional service warming the state caches of the chain with
+// the senders and recipients of the transactions in the pool, so the accounts
+// are already loaded when a miner or validator executes the next block: the new
+// transactions are prefetched from the head state on arrival, and all the pending
+// ones from every new head.
+//
+/**
+TxPrefetcher:
+根据 txpool 中的交易 (from/to) 预先加载 head state 的账户, 让 miner/validator 执行下一个 block 时 少读磁盘
+ */
+type TxPrefetcher struct {
+	chain      *BlockChain
+	pool       *TxPool
+	prefetcher *state.Prefetcher
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewTxPrefetcher creates a transaction driven prefetcher on top of the given
+// chain and pool.
+func NewTxPrefetcher(chain *BlockChain, pool *TxPool) (*TxPrefetcher, error) {
+	prefetcher, err := state.NewPrefetcher(chain.StateCache())
+	if err != nil {
+		return nil, err
+	}
+	return &TxPrefetcher{
+		chain:      chain,
+		pool:       pool,
+		prefetcher: prefetcher,
+		quit:       make(chan struct{}),
+	}, nil
+}
+
+// Start subscribes to the pool and chain events and starts prefetching.
+func (p *TxPrefetcher) Start() {
+	var (
+		txsCh  = make(chan NewTxsEvent, prefetchTxChanSize)
+		headCh = make(chan ChainHeadEvent, chainHeadChanSize)
+		subs   = []event.Subscription{
+			p.pool.SubscribeNewTxsEvent(txsCh),
+			p.chain.SubscribeChainHeadEvent(headCh),
+		}
+	)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+		}()
+		for {
+			select {
+			case ev := <-txsCh:
+				p.prefetcher.Prefetch(p.chain.CurrentBlock().Root(), p.accounts(ev.Txs, nil))
+			case ev := <-headCh:
+				pending, _ := p.pool.Pending()
+				seen := make(map[common.Address]struct{})
+				var addrs []common.Address
+				for _, txs := range pending {
+					if addrs = append(addrs, p.accounts(txs, seen)...); len(addrs) >= maxPrefetchAccounts {
+						break
+					}
+				}
+				p.prefetcher.Prefetch(ev.Block.Root(), addrs)
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates the prefetching.
+func (p *TxPrefetcher) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+	p.prefetcher.Close()
+}
+
+// accounts returns the senders and recipients of the transactions not in seen,
+// adding them to it.
+func (p *TxPrefetcher) accounts(txs types.Transactions, seen map[common.Address]struct{}) []common.Address {
+	if seen == nil {
+		seen = make(map[common.Address]struct{})
+	}
+	var addrs []common.Address
+	add := func(addr common.Address) {
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, tx := range txs {
+		// The senders of the pooled transactions are cached by their validation
+		if from, err := types.Sender(p.pool.signer, tx); err == nil {
+			add(from)
+		}
+		if to := tx.To(); to != nil {
+			add(*to)
+		}
+	}
+	return addrs
+}
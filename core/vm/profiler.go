@@ -0,0 +1,117 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+)
+
+// ContractProfile aggregates the executions of the code of a single contract.
+type ContractProfile struct {
+	Calls     uint64            `json:"calls"`     // Number of frames executing the code
+	Gas       uint64            `json:"gas"`       // Gas spent by the opcodes of the code
+	Opcodes   map[string]uint64 `json:"opcodes"`   // Executed opcodes by name
+	OpcodeGas map[string]uint64 `json:"opcodeGas"` // Gas spent by opcode name
+}
+
+// Profiler is a Tracer aggregating the executed opcodes and their gas usage per
+// contract over any number of transactions. The gas of the CALL family opcodes
+// excludes the gas forwarded to the callee, which is accounted to the callee's
+// own opcodes, so the gas figures of the contracts add up.
+//
+// The executions are accounted to the address of the code being run, i.e. the
+// library in case of DELEGATECALL and CALLCODE. Profiler is not safe for
+// concurrent use.
+//
+/**
+Profiler:
+实现了 Tracer, 按合约 (被执行的 code 的地址) 统计执行的 opcode 次数及其 gas 消耗, 可以跨多笔 tx 累加.
+CALL 类指令的 cost 中包含了转给被调用方的 gas, 这里将其扣除, 避免和被调用方自身的指令重复统计
+*/
+type Profiler struct {
+	contracts map[common.Address]*ContractProfile
+	txs       uint64 // number of top level executions profiled
+	depth     int    // depth of the last executed opcode, zero between executions
+}
+
+// NewProfiler creates an empty execution profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{contracts: make(map[common.Address]*ContractProfile)}
+}
+
+// CaptureStart implements Tracer, starting a new top level execution.
+func (p *Profiler) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	p.txs++
+	p.depth = 0
+	return nil
+}
+
+// CaptureState implements Tracer, accounting an executed opcode to its contract.
+func (p *Profiler) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	if err != nil {
+		return nil // not executed
+	}
+	addr := contract.Address()
+	if contract.CodeAddr != nil {
+		addr = *contract.CodeAddr
+	}
+	profile := p.contracts[addr]
+	if profile == nil {
+		profile = &ContractProfile{Opcodes: make(map[string]uint64), OpcodeGas: make(map[string]uint64)}
+		p.contracts[addr] = profile
+	}
+	if depth > p.depth {
+		profile.Calls++
+	}
+	p.depth = depth
+
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL:
+		if cost >= env.callGasTemp {
+			cost -= env.callGasTemp
+		}
+	}
+	name := op.String()
+	profile.Opcodes[name]++
+	profile.OpcodeGas[name] += cost
+	profile.Gas += cost
+	return nil
+}
+
+// CaptureFault implements Tracer.
+func (p *Profiler) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd implements Tracer, finishing a top level execution.
+func (p *Profiler) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	p.depth = 0
+	return nil
+}
+
+// Transactions returns the number of top level executions profiled.
+func (p *Profiler) Transactions() uint64 {
+	return p.txs
+}
+
+// Contracts returns the profiles of the executed contracts.
+func (p *Profiler) Contracts() map[common.Address]*ContractProfile {
+	return p.contracts
+}
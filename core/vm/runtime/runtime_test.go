@@ -148,3 +148,40 @@ func BenchmarkCall(b *testing.B) {
 		}
 	}
 }
+
+// Tests that the profiler accounts the opcodes and the gas to the executed
+// contracts, excluding the gas forwarded by calls.
+func TestProfiler(t *testing.T) {
+	var (
+		callee   = common.BytesToAddress([]byte{0xaa})
+		caller   = common.BytesToAddress([]byte("contract"))
+		profiler = vm.NewProfiler()
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	statedb.SetCode(callee, []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP),
+	})
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 0xaa, byte(vm.PUSH2), 0xff, 0xff, byte(vm.CALL), byte(vm.STOP),
+	}
+	cfg := &Config{State: statedb, EVMConfig: vm.Config{Debug: true, Tracer: profiler}}
+	for i := 0; i < 2; i++ {
+		if _, _, err := Execute(code, nil, cfg); err != nil {
+			t.Fatalf("execution failed: %v", err)
+		}
+	}
+	if profiler.Transactions() != 2 {
+		t.Errorf("transaction count mismatch: have %d, want 2", profiler.Transactions())
+	}
+	profiles := profiler.Contracts()
+	if len(profiles) != 2 {
+		t.Fatalf("profiled contract count mismatch: have %d, want 2", len(profiles))
+	}
+	if p := profiles[callee]; p.Calls != 2 || p.Gas != 2*11 || p.Opcodes["PUSH1"] != 4 || p.Opcodes["ADD"] != 2 {
+		t.Errorf("callee profile mismatch: %+v", p)
+	}
+	if p := profiles[caller]; p.Calls != 2 || p.OpcodeGas["CALL"] != 2*700 || p.Gas != 2*(7*3+700) {
+		t.Errorf("caller profile mismatch: %+v", p)
+	}
+}
@@ -183,6 +183,43 @@ func NewPrivateAdminAPI(eth *Ethereum) *PrivateAdminAPI {
 	return &PrivateAdminAPI{eth: eth}
 }
 
+// TxPoolLimits returns the active replacement and slot limits of the transaction pool.
+func (api *PrivateAdminAPI) TxPoolLimits() core.TxPoolLimits {
+	return api.eth.TxPool().Limits()
+}
+
+// TxPoolLimitsArgs are the transaction pool limits to change, omitted fields
+// keep their current values.
+type TxPoolLimitsArgs struct {
+	PriceBump    *uint64 `json:"priceBump"`
+	AccountSlots *uint64 `json:"accountSlots"`
+	GlobalSlots  *uint64 `json:"globalSlots"`
+	AccountQueue *uint64 `json:"accountQueue"`
+	GlobalQueue  *uint64 `json:"globalQueue"`
+}
+
+// SetTxPoolLimits atomically changes the replacement and slot limits of the
+// transaction pool without a restart, returning the new limits.
+func (api *PrivateAdminAPI) SetTxPoolLimits(args TxPoolLimitsArgs) (core.TxPoolLimits, error) {
+	return api.eth.TxPool().UpdateLimits(func(limits *core.TxPoolLimits) {
+		if args.PriceBump != nil {
+			limits.PriceBump = *args.PriceBump
+		}
+		if args.AccountSlots != nil {
+			limits.AccountSlots = *args.AccountSlots
+		}
+		if args.GlobalSlots != nil {
+			limits.GlobalSlots = *args.GlobalSlots
+		}
+		if args.AccountQueue != nil {
+			limits.AccountQueue = *args.AccountQueue
+		}
+		if args.GlobalQueue != nil {
+			limits.GlobalQueue = *args.GlobalQueue
+		}
+	})
+}
+
 // ExportChain exports the current blockchain into a local file.
 func (api *PrivateAdminAPI) ExportChain(file string) (bool, error) {
 	// Make sure we can create the file to export into
@@ -276,6 +313,15 @@ func NewPublicDebugAPI(eth *Ethereum) *PublicDebugAPI {
 	return &PublicDebugAPI{eth: eth}
 }
 
+// ChainAnalytics returns the uncle rate, block propagation and reorg depth
+// statistics collected since the node started.
+func (api *PublicDebugAPI) ChainAnalytics() (*core.ChainAnalyticsStats, error) {
+	if api.eth.chainAnalytics == nil {
+		return nil, errors.New("chain analytics not enabled")
+	}
+	return api.eth.chainAnalytics.Stats(), nil
+}
+
 // DumpBlock retrieves the entire state of the database at a given block.
 func (api *PublicDebugAPI) DumpBlock(blockNr rpc.BlockNumber) (state.Dump, error) {
 	if blockNr == rpc.PendingBlockNumber {
@@ -322,6 +368,49 @@ func (api *PrivateDebugAPI) Preimage(ctx context.Context, hash common.Hash) (hex
 	return nil, errors.New("unknown preimage")
 }
 
+// AuditTrieCache checks the reference counts of the in-memory trie node cache
+// against the nodes reachable from the given state roots (or from all the roots
+// currently held in memory if none are given), reporting leaked and prematurely
+// dereferenced nodes.
+func (api *PrivateDebugAPI) AuditTrieCache(roots []common.Hash) *trie.AuditReport {
+	return api.eth.BlockChain().StateCache().TrieDB().Audit(roots)
+}
+
+// StartTrieHeatMap starts counting the state trie node loads by path prefix,
+// aggregated over windows of the given number of seconds. The depth is the
+// length of the path prefixes in nibbles. Zero values select the defaults.
+func (api *PrivateDebugAPI) StartTrieHeatMap(window uint64, depth int) error {
+	heat := state.NewTrieHeatMap(time.Duration(window)*time.Second, depth)
+	if !state.SetTrieHeatMap(api.eth.BlockChain().StateCache(), heat) {
+		return errors.New("trie access tracking not supported")
+	}
+	return nil
+}
+
+// StopTrieHeatMap stops counting the state trie node loads.
+func (api *PrivateDebugAPI) StopTrieHeatMap() {
+	state.SetTrieHeatMap(api.eth.BlockChain().StateCache(), nil)
+}
+
+// TrieHeatMap exports the hottest subtries of the state trie heat map, at most
+// limit entries if it is non-zero.
+func (api *PrivateDebugAPI) TrieHeatMap(limit int) (*state.TrieHeatMapReport, error) {
+	heat := state.GetTrieHeatMap(api.eth.BlockChain().StateCache())
+	if heat == nil {
+		return nil, errors.New("trie heat map not running")
+	}
+	return heat.Report(limit), nil
+}
+
+// ChainConsistencyReport returns the outcome of the chain database check run
+// on startup after an unclean shutdown.
+func (api *PrivateDebugAPI) ChainConsistencyReport() (*rawdb.ConsistencyReport, error) {
+	if api.eth.consistencyReport == nil {
+		return nil, errors.New("no consistency check ran, the last shutdown was clean")
+	}
+	return api.eth.consistencyReport, nil
+}
+
 // BadBlockArgs represents the entries in the list returned when bad blocks are queried.
 type BadBlockArgs struct {
 	Hash  common.Hash            `json:"hash"`
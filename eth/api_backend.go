@@ -33,6 +33,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/gasprice"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rpc"
 )
@@ -98,6 +99,14 @@ func (b *EthAPIBackend) StateAndHeaderByNumber(ctx context.Context, blockNr rpc.
 	if header == nil || err != nil {
 		return nil, nil, err
 	}
+	if b.eth.config.RPCStateFallback > 0 {
+		// Serve the nearest older state if the requested one has been pruned
+		stateDb, nearest, err := b.eth.BlockChain().StateAtNearest(header, b.eth.config.RPCStateFallback)
+		if err == nil && nearest.Hash() != header.Hash() {
+			log.Debug("Requested state unavailable, using older one", "number", header.Number, "nearest", nearest.Number)
+		}
+		return stateDb, nearest, err
+	}
 	stateDb, err := b.eth.BlockChain().StateAt(header.Root)
 	return stateDb, header, err
 }
@@ -205,6 +214,10 @@ func (b *EthAPIBackend) Downloader() *downloader.Downloader {
 	return b.eth.Downloader()
 }
 
+func (b *EthAPIBackend) StateRange() *core.StateRange {
+	return b.eth.BlockChain().StateRange()
+}
+
 func (b *EthAPIBackend) ProtocolVersion() int {
 	return b.eth.EthVersion()
 }
@@ -0,0 +1,161 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/hexutil"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rpc"
+)
+
+// maxProfileBlocks is the maximum number of blocks profiled by a single request.
+const maxProfileBlocks = 10000
+
+// ChainProfile is the opcode and gas usage of the contracts executed in a range
+// of blocks.
+type ChainProfile struct {
+	From         hexutil.Uint64                         `json:"from"`
+	To           hexutil.Uint64                         `json:"to"`
+	Transactions uint64                                 `json:"transactions"`
+	Contracts    map[common.Address]*vm.ContractProfile `json:"contracts"`
+}
+
+// ProfileChain re-executes the blocks between start and end (both inclusive) and
+// returns the executed opcodes and their gas usage aggregated per contract.
+//
+// 研究/分析用: 重新执行一段 block, 按合约统计 opcode 的执行次数和 gas 消耗
+func (api *PrivateDebugAPI) ProfileChain(ctx context.Context, start, end rpc.BlockNumber, config *TraceConfig) (*ChainProfile, error) {
+	var from, to *types.Block
+	switch start {
+	case rpc.PendingBlockNumber, rpc.LatestBlockNumber:
+		from = api.eth.blockchain.CurrentBlock()
+	default:
+		from = api.eth.blockchain.GetBlockByNumber(uint64(start))
+	}
+	switch end {
+	case rpc.PendingBlockNumber, rpc.LatestBlockNumber:
+		to = api.eth.blockchain.CurrentBlock()
+	default:
+		to = api.eth.blockchain.GetBlockByNumber(uint64(end))
+	}
+	if from == nil {
+		return nil, fmt.Errorf("starting block #%d not found", start)
+	}
+	if to == nil {
+		return nil, fmt.Errorf("end block #%d not found", end)
+	}
+	if from.NumberU64() == 0 {
+		return nil, fmt.Errorf("genesis is not executable")
+	}
+	if from.NumberU64() > to.NumberU64() {
+		return nil, fmt.Errorf("end block (#%d) needs to come after start block (#%d)", end, start)
+	}
+	if to.NumberU64()-from.NumberU64() >= maxProfileBlocks {
+		return nil, fmt.Errorf("too many blocks to profile: %d > %d", to.NumberU64()-from.NumberU64()+1, maxProfileBlocks)
+	}
+	return api.profileChain(ctx, from, to, config)
+}
+
+// profileChain executes the blocks between start and end on top of the state of
+// the parent of start with a profiler installed. If the state is missing, up to
+// the configured number of preceding blocks are re-executed without profiling.
+func (api *PrivateDebugAPI) profileChain(ctx context.Context, start, end *types.Block, config *TraceConfig) (*ChainProfile, error) {
+	database := state.NewDatabase(api.eth.ChainDb())
+
+	base := api.eth.blockchain.GetBlock(start.ParentHash(), start.NumberU64()-1)
+	if base == nil {
+		return nil, fmt.Errorf("parent block #%d not found", start.NumberU64()-1)
+	}
+	statedb, err := state.New(base.Root(), database)
+	if err != nil {
+		reexec := defaultTraceReexec
+		if config != nil && config.Reexec != nil {
+			reexec = *config.Reexec
+		}
+		for i := uint64(0); i < reexec && base.NumberU64() > 0; i++ {
+			if base = api.eth.blockchain.GetBlock(base.ParentHash(), base.NumberU64()-1); base == nil {
+				break
+			}
+			if statedb, err = state.New(base.Root(), database); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, errors.New("required historical state unavailable")
+		}
+	}
+	var (
+		profiler = vm.NewProfiler()
+		begin    = time.Now()
+		logged   time.Time
+		proot    common.Hash
+	)
+	defer func() {
+		if proot != (common.Hash{}) {
+			database.TrieDB().Dereference(proot)
+		}
+	}()
+	for number := base.NumberU64() + 1; number <= end.NumberU64(); number++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Profiling chain segment", "start", start.NumberU64(), "end", end.NumberU64(), "current", number, "elapsed", common.PrettyDuration(time.Since(begin)))
+			logged = time.Now()
+		}
+		block := api.eth.blockchain.GetBlockByNumber(number)
+		if block == nil {
+			return nil, fmt.Errorf("block #%d not found", number)
+		}
+		// Only profile the requested blocks, fast forward through the rest
+		var vmConfig vm.Config
+		if number >= start.NumberU64() {
+			vmConfig = vm.Config{Debug: true, Tracer: profiler}
+		}
+		if _, _, _, err := api.eth.blockchain.Processor().Process(block, statedb, vmConfig); err != nil {
+			return nil, fmt.Errorf("block #%d: %v", number, err)
+		}
+		// Carry the state over to the next block, keeping only its trie referenced
+		root, err := statedb.Commit(true)
+		if err != nil {
+			return nil, err
+		}
+		if err := statedb.Reset(root); err != nil {
+			return nil, err
+		}
+		database.TrieDB().Reference(root, common.Hash{})
+		if proot != (common.Hash{}) {
+			database.TrieDB().Dereference(proot)
+		}
+		proot = root
+	}
+	return &ChainProfile{
+		From:         hexutil.Uint64(start.NumberU64()),
+		To:           hexutil.Uint64(end.NumberU64()),
+		Transactions: profiler.Transactions(),
+		Contracts:    profiler.Contracts(),
+	}, nil
+}
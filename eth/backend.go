@@ -34,6 +34,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/bloombits"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/downloader"
@@ -51,11 +52,16 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rpc"
 )
 
+// consistencyCheckDepth is the number of recent canonical blocks checked on
+// startup after an unclean shutdown.
+const consistencyCheckDepth = 8192
+
 type LesServer interface {
 	Start(srvr *p2p.Server)
 	Stop()
 	Protocols() []p2p.Protocol
 	SetBloomBitsIndexer(bbIndexer *core.ChainIndexer)
+	APIs() []rpc.API
 }
 
 // Ethereum implements the Ethereum full node service.
@@ -70,10 +76,15 @@ type Ethereum struct {
 	txPool          *core.TxPool
 	blockchain      *core.BlockChain
 	protocolManager *ProtocolManager
+	chainAnalytics  *core.ChainAnalytics // nil unless enabled in the config
+	chainRecorder   *core.ChainRecorder  // nil unless a time series file is configured
+	txPrefetcher    *core.TxPrefetcher   // nil unless state prefetching is enabled
+	migrator        *core.Migrator       // Upgrades the stored data formats in the background
 	lesServer       LesServer  // 全节点 在启动了  轻节点的服务端时,  这个是当前全节点的 轻节点服务端
 
 	// DB interfaces
-	chainDb ethdb.Database // Block chain database
+	chainDb           ethdb.Database             // Block chain database
+	consistencyReport *rawdb.ConsistencyReport // Outcome of the startup check, nil after a clean shutdown
 
 	eventMux       *event.TypeMux
 	engine         consensus.Engine
@@ -178,12 +189,45 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		// 把当前节点的 链版本写到 底层db
 		rawdb.WriteDatabaseVersion(chainDb, core.BlockChainVersion)
 	}
+	// Upgrade the stored data formats, the blocking migrations before the chain is loaded
+	//
+	// 存储格式升级: 阻塞的 migration 在加载链之前执行完, 其余的在 Start 之后后台执行
+	if eth.migrator, err = core.NewMigrator(chainDb, core.Migrations); err != nil {
+		return nil, err
+	}
+	if err := eth.migrator.RunBlocking(); err != nil {
+		return nil, err
+	}
+	// Check and repair the recent chain data if the node wasn't stopped cleanly
+	//
+	// 上次非正常关闭 (crash / kill) 时, 在加载链之前检查并修复最近的 chain 数据
+	if rawdb.ReadUncleanShutdownMarker(chainDb) {
+		log.Warn("Unclean shutdown detected, checking chain database", "depth", consistencyCheckDepth)
+		report := rawdb.CheckChainConsistency(chainDb, consistencyCheckDepth, true)
+		for _, issue := range report.Issues {
+			log.Warn("Chain database inconsistency", "number", issue.Number, "hash", issue.Hash, "problem", issue.Problem)
+		}
+		if report.Consistent() {
+			log.Info("Chain database consistent", "from", report.From, "to", report.To)
+		} else {
+			log.Warn("Chain database repaired", "issues", len(report.Issues), "quarantined", report.Quarantined, "rewound", report.Repaired)
+		}
+		eth.consistencyReport = report
+	}
+	rawdb.WriteUncleanShutdownMarker(chainDb)
+
 	var (
 		// vm 的配置
 		vmConfig    = vm.Config{EnablePreimageRecording: config.EnablePreimageRecording}
 		// cache 的配置
-		cacheConfig = &core.CacheConfig{Disabled: config.NoPruning, TrieNodeLimit: config.TrieCache, TrieTimeLimit: config.TrieTimeout}
+		cacheConfig = &core.CacheConfig{Disabled: config.NoPruning, TrieNodeLimit: config.TrieCache, TrieTimeLimit: config.TrieTimeout,
+			State: state.Config{PastTries: config.StatePastTries, CodeSizeCache: config.StateCodeSizeCache, CodeCache: config.StateCodeCache, StorageTries: config.StateStorageTries, TrieCacheGen: config.TrieCacheGen, TrieCacheSize: uint64(config.TrieCacheSize) * 1024 * 1024, TrieCacheLimit: uint64(config.TrieCacheLimit) * 1024 * 1024, Backend: config.StateBackend},
+			Snapshot: config.StateSnapshot, AccountBloom: uint64(config.StateAccountBloom) * 1024 * 1024}
 	)
+	if config.LightServ > 0 {
+		// 轻节点 server 保证最近若干个块的 state 不被 gc, 并在 les 握手时声明
+		cacheConfig.RecentStates = config.LightRecentStates
+	}
 
 	/**
 	创建一条链
@@ -205,6 +249,12 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		config.TxPool.Journal = ctx.ResolvePath(config.TxPool.Journal)
 	}
 	eth.txPool = core.NewTxPool(config.TxPool, eth.chainConfig, eth.blockchain)  // 创建 交易池
+	if config.StatePrefetch {
+		// 根据 txpool 中的交易 预先加载 head state 的账户
+		if eth.txPrefetcher, err = core.NewTxPrefetcher(eth.blockchain, eth.txPool); err != nil {
+			return nil, err
+		}
+	}
 
 	/**
 	协议管理器, 主要管理同步之类的
@@ -212,6 +262,14 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 	if eth.protocolManager, err = NewProtocolManager(eth.chainConfig, config.SyncMode, config.NetworkId, eth.eventMux, eth.txPool, eth.engine, eth.blockchain, chainDb); err != nil {
 		return nil, err
 	}
+	if config.ChainAnalytics {
+		eth.chainAnalytics = core.NewChainAnalytics(eth.blockchain)
+		eth.protocolManager.analytics = eth.chainAnalytics
+	}
+	if config.ChainRecorder.Path != "" {
+		config.ChainRecorder.Path = ctx.ResolvePath(config.ChainRecorder.Path)
+		eth.chainRecorder = core.NewChainRecorder(config.ChainRecorder, eth.blockchain)
+	}
 
 	/**
 	创建一个 miner 实例
@@ -310,6 +368,11 @@ func (s *Ethereum) APIs() []rpc.API {
 	// Append any APIs exposed explicitly by the consensus engine
 	apis = append(apis, s.engine.APIs(s.BlockChain())...)
 
+	// Append the APIs of the light server if it's running
+	if s.lesServer != nil {
+		apis = append(apis, s.lesServer.APIs()...)
+	}
+
 	// Append all the local APIs and return
 	return append(apis, []rpc.API{
 		{
@@ -435,6 +498,9 @@ func (s *Ethereum) EthVersion() int                    { return int(s.protocolMa
 func (s *Ethereum) NetVersion() uint64                 { return s.networkID }
 func (s *Ethereum) Downloader() *downloader.Downloader { return s.protocolManager.downloader }
 
+// ChainRecorder returns the chain statistics recorder, nil if it is disabled.
+func (s *Ethereum) ChainRecorder() *core.ChainRecorder { return s.chainRecorder }
+
 // Protocols implements node.Service, returning all the currently configured
 // network protocols to start.
 func (s *Ethereum) Protocols() []p2p.Protocol {
@@ -452,6 +518,18 @@ func (s *Ethereum) Start(srvr *p2p.Server) error {
 	// Start the bloom bits servicing goroutines
 	s.startBloomHandlers()   // todo 启动 布隆处理器
 
+	if s.chainAnalytics != nil {
+		s.chainAnalytics.Start()
+	}
+	if s.txPrefetcher != nil {
+		s.txPrefetcher.Start()
+	}
+	if s.chainRecorder != nil {
+		s.chainRecorder.AddSource("peers", func() interface{} { return srvr.PeerCount() })
+		s.chainRecorder.Start()
+	}
+	s.migrator.Start()
+
 	// Start the RPC service
 	s.netRPCService = ethapi.NewPublicNetAPI(srvr, s.NetVersion())
 
@@ -488,16 +566,27 @@ func (s *Ethereum) Start(srvr *p2p.Server) error {
 // Ethereum protocol.
 func (s *Ethereum) Stop() error {
 	s.bloomIndexer.Close()
+	s.migrator.Stop()
 	s.blockchain.Stop()
 	s.engine.Close()
 	s.protocolManager.Stop()
+	if s.chainAnalytics != nil {
+		s.chainAnalytics.Stop()
+	}
+	if s.chainRecorder != nil {
+		s.chainRecorder.Stop()
+	}
 	if s.lesServer != nil {
 		s.lesServer.Stop()
 	}
+	if s.txPrefetcher != nil {
+		s.txPrefetcher.Stop()
+	}
 	s.txPool.Stop()
 	s.miner.Stop()
 	s.eventMux.Stop()
 
+	rawdb.DeleteUncleanShutdownMarker(s.chainDb)
 	s.chainDb.Close()
 	close(s.shutdownChan)
 	return nil
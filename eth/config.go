@@ -30,6 +30,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/downloader"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/gasprice"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
 )
 
@@ -43,15 +44,19 @@ var DefaultConfig = Config{
 		DatasetsInMem:  1,
 		DatasetsOnDisk: 2,
 	},
-	NetworkId:     1,
-	LightPeers:    100,
-	DatabaseCache: 768,
-	TrieCache:     256,
-	TrieTimeout:   60 * time.Minute,
-	MinerGasPrice: big.NewInt(18 * params.Shannon),
-	MinerRecommit: 3 * time.Second,
-
-	TxPool: core.DefaultTxPoolConfig,
+	NetworkId:          1,
+	LightPeers:         100,
+	LightAnnounceTrust: 1000,
+	LightOdrCache:      64,
+	LightULCFraction:   75,
+	DatabaseCache:      768,
+	TrieCache:          256,
+	TrieTimeout:        60 * time.Minute,
+	MinerGasPrice:      big.NewInt(18 * params.Shannon),
+	MinerRecommit:      3 * time.Second,
+
+	TxPool:        core.DefaultTxPoolConfig,
+	ChainRecorder: core.DefaultChainRecorderConfig,
 	GPO: gasprice.Config{
 		Blocks:     20,
 		Percentile: 60,
@@ -88,12 +93,80 @@ type Config struct {
 	LightServ  int `toml:",omitempty"` // Maximum percentage of time allowed for serving LES requests
 	LightPeers int `toml:",omitempty"` // Maximum number of LES client peers
 
+	// Number of recent block states kept resolvable for LES clients (light server only)
+	LightRecentStates uint64 `toml:",omitempty"`
+
+	// Requests per second served to the LES clients of one IP subnet (light server only, 0 = unlimited)
+	LightSubnetRate uint64 `toml:",omitempty"`
+
+	// Megabytes sent to one LES client in a rolling 24 hour window, after which
+	// it's disconnected (light server only, 0 = unlimited)
+	LightDailyCap uint64 `toml:",omitempty"`
+
+	// Time after which a stopping light server expects to be back, announced to
+	// its LES clients on shutdown (light server only, 0 = unknown)
+	LightStopResume time.Duration `toml:",omitempty"`
+
+	// Enode URLs of the alternative servers the LES clients are pointed to on
+	// shutdown (light server only)
+	LightStopAlternatives []string `toml:",omitempty"`
+
+	// Target latency of answering the requests of LES clients, for the service level report (light server only, 0 = default)
+	LightSLATarget time.Duration `toml:",omitempty"`
+
+	// Flow control recharge weights of LES clients by hex node ID (default 1)
+	LightClientWeights map[string]uint64 `toml:",omitempty"`
+
+	// Require signed block announcements from untrusted LES servers (light client only)
+	LightSignedAnnounce bool `toml:",omitempty"`
+
+	// Valid signed announcements after which an untrusted LES server is asked for
+	// simple ones on its next connection (light client only, 0 = never)
+	LightAnnounceTrust uint64 `toml:",omitempty"`
+
+	// Head spread of the LES servers, in blocks, reported as a divergence if it
+	// lasts longer than LightDivergenceTime (light client only, 0 = default)
+	LightDivergenceBlocks uint64        `toml:",omitempty"`
+	LightDivergenceTime   time.Duration `toml:",omitempty"`
+
+	// Megabytes of verified ODR results persisted across restarts (light client only, 0 = untracked)
+	LightOdrCache int `toml:",omitempty"`
+
+	// Ask the LES servers to sign their responses, keeping the invalid ones as
+	// evidence of misbehavior (light client only)
+	LightSignedResponses bool `toml:",omitempty"`
+
+	// Enode URLs of the LES servers voting on the head in ultra-light mode, the
+	// headers are not validated (light client only, empty = disabled)
+	LightULCServers []string `toml:",omitempty"`
+
+	// Percentage of the ultra-light servers announcing a head needed to accept it
+	LightULCFraction int `toml:",omitempty"`
+
+	// Trusted checkpoint of light clients, overrides the hardcoded one of the network
+	LightCheckpoint *light.TrustedCheckpoint `toml:",omitempty"`
+
+	// File or URL polled for newer checkpoints signed by one of the signers (light client only)
+	LightCheckpointFeed    string           `toml:",omitempty"`
+	LightCheckpointSigners []common.Address `toml:",omitempty"`
+
 	// Database options
 	SkipBcVersionCheck bool `toml:"-"`
 	DatabaseHandles    int  `toml:"-"`
 	DatabaseCache      int
 	TrieCache          int
 	TrieTimeout        time.Duration
+	TrieCacheGen       uint16 `toml:",omitempty"` // Trie node generations kept in memory, zero for the default
+	TrieCacheSize      int    `toml:",omitempty"` // Megabytes of account trie nodes kept in memory, replaces TrieCacheGen if non-zero
+	TrieCacheLimit     int    `toml:",omitempty"` // Megabytes of trie database memory at which the fewest generations are kept, zero for static
+	StatePastTries     int    `toml:",omitempty"` // Committed account tries kept for reuse, zero for the default
+	StateCodeSizeCache int    `toml:",omitempty"` // Cached contract code sizes, zero for the default
+	StateCodeCache     int    `toml:",omitempty"` // Bytes of cached contract code, zero for the default
+	StateStorageTries  int    `toml:",omitempty"` // Cached opened storage tries, zero for the default
+	StateBackend       string `toml:",omitempty"` // Name of the registered state database backend, empty for the default
+	StateSnapshot      bool   `toml:",omitempty"` // Maintain a flat snapshot of the head state for faster reads
+	StateAccountBloom  int    `toml:",omitempty"` // Megabytes of the bloom filter of the existing accounts, zero to disable
+	StatePrefetch      bool   `toml:",omitempty"` // Warm the state caches with the accounts of the pooled transactions
 
 	// Mining-related options
 	Etherbase      common.Address `toml:",omitempty"`
@@ -118,6 +191,17 @@ type Config struct {
 	// 允许跟踪VM中的SHA3 preimages
 	EnablePreimageRecording bool
 
+	// Enables the uncle, propagation and reorg statistics service
+	ChainAnalytics bool
+
+	// Chain statistics time series options, disabled unless a file is set
+	ChainRecorder core.ChainRecorderConfig
+
+	// Number of blocks RPC calls may fall back to an older state if the requested
+	// one has been pruned, zero disables the fallback. The block whose state is
+	// used is reported by eth_stateBlockNumber.
+	RPCStateFallback int `toml:",omitempty"`
+
 	// Miscellaneous options
 	DocRoot string `toml:"-"`
 }
@@ -36,6 +36,13 @@ import (
 
 var (
 	deadline = 5 * time.Minute // consider a filter inactive if it has not been polled for within deadline
+
+	// headsBuffer and logsBuffer buffer the notifications of the newHeads and logs
+	// subscriptions, so that a slow client drops the oldest notifications instead
+	// of stalling the event system. The headers and logs posted by the chain are
+	// never modified, they are buffered as they are.
+	headsBuffer = rpc.SubscriptionBuffer{Size: 1024, Policy: rpc.OverflowDropOldest}
+	logsBuffer  = rpc.SubscriptionBuffer{Size: 1024, Policy: rpc.OverflowDropOldest}
 )
 
 // filter is a helper struct that holds meta information over the filter type
@@ -210,7 +217,7 @@ func (api *PublicFilterAPI) NewHeads(ctx context.Context) (*rpc.Subscription, er
 		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
 	}
 
-	rpcSub := notifier.CreateSubscription()
+	rpcSub := notifier.CreateSubscriptionWithBuffer(headsBuffer)
 
 	go func() {
 		headers := make(chan *types.Header)
@@ -241,7 +248,7 @@ func (api *PublicFilterAPI) Logs(ctx context.Context, crit FilterCriteria) (*rpc
 	}
 
 	var (
-		rpcSub      = notifier.CreateSubscription()
+		rpcSub      = notifier.CreateSubscriptionWithBuffer(logsBuffer)
 		matchedLogs = make(chan []*types.Log)
 	)
 
@@ -256,7 +263,7 @@ func (api *PublicFilterAPI) Logs(ctx context.Context, crit FilterCriteria) (*rpc
 			select {
 			case logs := <-matchedLogs:
 				for _, log := range logs {
-					notifier.Notify(rpcSub.ID, &log)
+					notifier.Notify(rpcSub.ID, log)
 				}
 			case <-rpcSub.Err(): // client send an unsubscribe request
 				logsSub.Unsubscribe()
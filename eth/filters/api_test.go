@@ -19,9 +19,17 @@ package filters
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/hexutil"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rpc"
 )
 
@@ -183,3 +191,128 @@ func TestUnmarshalJSONNewFilterArgs(t *testing.T) {
 		t.Fatalf("expected 0 topics, got %d topics", len(test7.Topics[2]))
 	}
 }
+
+// Tests that a newHeads subscription doesn't stall the event system when the
+// client doesn't read, dropping the oldest headers instead.
+func TestNewHeadsSubscriptionBuffer(t *testing.T) {
+	t.Parallel()
+
+	testSubscriptionBuffer(t, `["newHeads"]`, 2*headsBuffer.Size, func(backend *testBackend, n uint64) {
+		block := types.NewBlockWithHeader(&types.Header{Number: new(big.Int).SetUint64(n)})
+		backend.chainFeed.Send(core.ChainEvent{Block: block, Hash: block.Hash()})
+	})
+}
+
+// Tests that a logs subscription doesn't stall the event system when the client
+// doesn't read, dropping the oldest logs instead.
+func TestLogsSubscriptionBuffer(t *testing.T) {
+	t.Parallel()
+
+	testSubscriptionBuffer(t, `["logs", {}]`, 2*logsBuffer.Size, func(backend *testBackend, n uint64) {
+		backend.logsFeed.Send([]*types.Log{{BlockNumber: n}})
+	})
+}
+
+// testSubscriptionBuffer subscribes over an RPC connection, posts count events
+// while the client isn't reading and checks that the notifications received
+// and the dropped ones reported by the lag notifications add up.
+func testSubscriptionBuffer(t *testing.T, params string, count int, post func(backend *testBackend, n uint64)) {
+	var (
+		mux     = new(event.TypeMux)
+		db      = ethdb.NewMemDatabase()
+		backend = &testBackend{mux, db, 0, new(event.Feed), new(event.Feed), new(event.Feed), new(event.Feed)}
+		api     = NewPublicFilterAPI(backend, false)
+		server  = rpc.NewServer()
+	)
+	defer server.Stop()
+	if err := server.RegisterName("eth", api); err != nil {
+		t.Fatalf("failed to register the filter API: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	go server.ServeCodec(rpc.NewJSONCodec(serverConn), rpc.OptionMethodInvocation|rpc.OptionSubscriptions)
+
+	in := json.NewDecoder(clientConn)
+	fmt.Fprintf(clientConn, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":%s}`, params)
+	var resp struct {
+		Result rpc.ID `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := in.Decode(&resp); err != nil {
+		t.Fatalf("failed to read subscription response: %v", err)
+	}
+	if resp.Error != nil {
+		t.Fatalf("failed to subscribe: %s", resp.Error.Message)
+	}
+	time.Sleep(time.Second) // wait for the subscription to be activated
+
+	// Nobody reads the connection, the events must not block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < count; i++ {
+			post(backend, uint64(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("events blocked by the client")
+	}
+	// Read the notifications: all but the dropped ones arrive in order
+	var (
+		received = int64(-1)
+		total    uint64
+		lagged   bool
+	)
+	for total < uint64(count) {
+		var msg struct {
+			Method string `json:"method"`
+			Params struct {
+				Result json.RawMessage `json:"result"`
+			} `json:"params"`
+		}
+		if err := in.Decode(&msg); err != nil {
+			t.Fatalf("failed to read notification: %v", err)
+		}
+		switch msg.Method {
+		case "eth_subscriptionLag":
+			var lag struct {
+				Dropped uint64 `json:"dropped"`
+			}
+			if err := json.Unmarshal(msg.Params.Result, &lag); err != nil {
+				t.Fatalf("invalid lag notification: %v", err)
+			}
+			total += lag.Dropped
+			lagged = true
+		case "eth_subscription":
+			var res struct {
+				Number      *hexutil.Big   `json:"number"`
+				BlockNumber hexutil.Uint64 `json:"blockNumber"`
+			}
+			if err := json.Unmarshal(msg.Params.Result, &res); err != nil {
+				t.Fatalf("invalid notification: %v", err)
+			}
+			n := int64(res.BlockNumber)
+			if res.Number != nil {
+				n = res.Number.ToInt().Int64()
+			}
+			if n <= received {
+				t.Fatalf("notification out of order: %d after %d", n, received)
+			}
+			received = n
+			total++
+		default:
+			t.Fatalf("unexpected method %q", msg.Method)
+		}
+	}
+	if !lagged {
+		t.Errorf("no lag notification received")
+	}
+	if received != int64(count-1) {
+		t.Errorf("last notification mismatch: have %d, want %d", received, count-1)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/downloader"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/gasprice"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
 )
 
 var _ = (*configMarshaling)(nil)
@@ -23,13 +24,42 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		NetworkId               uint64
 		SyncMode                downloader.SyncMode
 		NoPruning               bool
-		LightServ               int  `toml:",omitempty"`
-		LightPeers              int  `toml:",omitempty"`
-		SkipBcVersionCheck      bool `toml:"-"`
-		DatabaseHandles         int  `toml:"-"`
+		LightServ               int                      `toml:",omitempty"`
+		LightPeers              int                      `toml:",omitempty"`
+		LightRecentStates       uint64                   `toml:",omitempty"`
+		LightSubnetRate         uint64                   `toml:",omitempty"`
+		LightDailyCap           uint64                   `toml:",omitempty"`
+		LightStopResume         time.Duration            `toml:",omitempty"`
+		LightStopAlternatives   []string                 `toml:",omitempty"`
+		LightSLATarget          time.Duration            `toml:",omitempty"`
+		LightClientWeights      map[string]uint64        `toml:",omitempty"`
+		LightSignedAnnounce     bool                     `toml:",omitempty"`
+		LightAnnounceTrust      uint64                   `toml:",omitempty"`
+		LightDivergenceBlocks   uint64                   `toml:",omitempty"`
+		LightDivergenceTime     time.Duration            `toml:",omitempty"`
+		LightOdrCache           int                      `toml:",omitempty"`
+		LightSignedResponses    bool                     `toml:",omitempty"`
+		LightULCServers         []string                 `toml:",omitempty"`
+		LightULCFraction        int                      `toml:",omitempty"`
+		LightCheckpoint         *light.TrustedCheckpoint `toml:",omitempty"`
+		LightCheckpointFeed     string                   `toml:",omitempty"`
+		LightCheckpointSigners  []common.Address         `toml:",omitempty"`
+		SkipBcVersionCheck      bool                     `toml:"-"`
+		DatabaseHandles         int                      `toml:"-"`
 		DatabaseCache           int
 		TrieCache               int
 		TrieTimeout             time.Duration
+		TrieCacheGen            uint16         `toml:",omitempty"`
+		TrieCacheSize           int            `toml:",omitempty"`
+		TrieCacheLimit          int            `toml:",omitempty"`
+		StatePastTries          int            `toml:",omitempty"`
+		StateCodeSizeCache      int            `toml:",omitempty"`
+		StateCodeCache          int            `toml:",omitempty"`
+		StateStorageTries       int            `toml:",omitempty"`
+		StateBackend            string         `toml:",omitempty"`
+		StateSnapshot           bool           `toml:",omitempty"`
+		StateAccountBloom       int            `toml:",omitempty"`
+		StatePrefetch           bool           `toml:",omitempty"`
 		Etherbase               common.Address `toml:",omitempty"`
 		MinerThreads            int            `toml:",omitempty"`
 		MinerNotify             []string       `toml:",omitempty"`
@@ -40,6 +70,9 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		TxPool                  core.TxPoolConfig
 		GPO                     gasprice.Config
 		EnablePreimageRecording bool
+		ChainAnalytics          bool
+		ChainRecorder           core.ChainRecorderConfig
+		RPCStateFallback        int    `toml:",omitempty"`
 		DocRoot                 string `toml:"-"`
 	}
 	var enc Config
@@ -49,11 +82,40 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.NoPruning = c.NoPruning
 	enc.LightServ = c.LightServ
 	enc.LightPeers = c.LightPeers
+	enc.LightRecentStates = c.LightRecentStates
+	enc.LightSubnetRate = c.LightSubnetRate
+	enc.LightDailyCap = c.LightDailyCap
+	enc.LightStopResume = c.LightStopResume
+	enc.LightStopAlternatives = c.LightStopAlternatives
+	enc.LightSLATarget = c.LightSLATarget
+	enc.LightClientWeights = c.LightClientWeights
+	enc.LightSignedAnnounce = c.LightSignedAnnounce
+	enc.LightAnnounceTrust = c.LightAnnounceTrust
+	enc.LightDivergenceBlocks = c.LightDivergenceBlocks
+	enc.LightDivergenceTime = c.LightDivergenceTime
+	enc.LightOdrCache = c.LightOdrCache
+	enc.LightSignedResponses = c.LightSignedResponses
+	enc.LightULCServers = c.LightULCServers
+	enc.LightULCFraction = c.LightULCFraction
+	enc.LightCheckpoint = c.LightCheckpoint
+	enc.LightCheckpointFeed = c.LightCheckpointFeed
+	enc.LightCheckpointSigners = c.LightCheckpointSigners
 	enc.SkipBcVersionCheck = c.SkipBcVersionCheck
 	enc.DatabaseHandles = c.DatabaseHandles
 	enc.DatabaseCache = c.DatabaseCache
 	enc.TrieCache = c.TrieCache
 	enc.TrieTimeout = c.TrieTimeout
+	enc.TrieCacheGen = c.TrieCacheGen
+	enc.TrieCacheSize = c.TrieCacheSize
+	enc.TrieCacheLimit = c.TrieCacheLimit
+	enc.StatePastTries = c.StatePastTries
+	enc.StateCodeSizeCache = c.StateCodeSizeCache
+	enc.StateCodeCache = c.StateCodeCache
+	enc.StateStorageTries = c.StateStorageTries
+	enc.StateBackend = c.StateBackend
+	enc.StateSnapshot = c.StateSnapshot
+	enc.StateAccountBloom = c.StateAccountBloom
+	enc.StatePrefetch = c.StatePrefetch
 	enc.Etherbase = c.Etherbase
 	enc.MinerThreads = c.MinerThreads
 	enc.MinerNotify = c.MinerNotify
@@ -64,6 +126,9 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.TxPool = c.TxPool
 	enc.GPO = c.GPO
 	enc.EnablePreimageRecording = c.EnablePreimageRecording
+	enc.ChainAnalytics = c.ChainAnalytics
+	enc.ChainRecorder = c.ChainRecorder
+	enc.RPCStateFallback = c.RPCStateFallback
 	enc.DocRoot = c.DocRoot
 	return &enc, nil
 }
@@ -75,13 +140,42 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		NetworkId               *uint64
 		SyncMode                *downloader.SyncMode
 		NoPruning               *bool
-		LightServ               *int  `toml:",omitempty"`
-		LightPeers              *int  `toml:",omitempty"`
-		SkipBcVersionCheck      *bool `toml:"-"`
-		DatabaseHandles         *int  `toml:"-"`
+		LightServ               *int                     `toml:",omitempty"`
+		LightPeers              *int                     `toml:",omitempty"`
+		LightRecentStates       *uint64                  `toml:",omitempty"`
+		LightSubnetRate         *uint64                  `toml:",omitempty"`
+		LightDailyCap           *uint64                  `toml:",omitempty"`
+		LightStopResume         *time.Duration           `toml:",omitempty"`
+		LightStopAlternatives   []string                 `toml:",omitempty"`
+		LightSLATarget          *time.Duration           `toml:",omitempty"`
+		LightClientWeights      map[string]uint64        `toml:",omitempty"`
+		LightSignedAnnounce     *bool                    `toml:",omitempty"`
+		LightAnnounceTrust      *uint64                  `toml:",omitempty"`
+		LightDivergenceBlocks   *uint64                  `toml:",omitempty"`
+		LightDivergenceTime     *time.Duration           `toml:",omitempty"`
+		LightOdrCache           *int                     `toml:",omitempty"`
+		LightSignedResponses    *bool                    `toml:",omitempty"`
+		LightULCServers         []string                 `toml:",omitempty"`
+		LightULCFraction        *int                     `toml:",omitempty"`
+		LightCheckpoint         *light.TrustedCheckpoint `toml:",omitempty"`
+		LightCheckpointFeed     *string                  `toml:",omitempty"`
+		LightCheckpointSigners  []common.Address         `toml:",omitempty"`
+		SkipBcVersionCheck      *bool                    `toml:"-"`
+		DatabaseHandles         *int                     `toml:"-"`
 		DatabaseCache           *int
 		TrieCache               *int
 		TrieTimeout             *time.Duration
+		TrieCacheGen            *uint16         `toml:",omitempty"`
+		TrieCacheSize           *int            `toml:",omitempty"`
+		TrieCacheLimit          *int            `toml:",omitempty"`
+		StatePastTries          *int            `toml:",omitempty"`
+		StateCodeSizeCache      *int            `toml:",omitempty"`
+		StateCodeCache          *int            `toml:",omitempty"`
+		StateStorageTries       *int            `toml:",omitempty"`
+		StateBackend            *string         `toml:",omitempty"`
+		StateSnapshot           *bool           `toml:",omitempty"`
+		StateAccountBloom       *int            `toml:",omitempty"`
+		StatePrefetch           *bool           `toml:",omitempty"`
 		Etherbase               *common.Address `toml:",omitempty"`
 		MinerThreads            *int            `toml:",omitempty"`
 		MinerNotify             []string        `toml:",omitempty"`
@@ -92,6 +186,9 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		TxPool                  *core.TxPoolConfig
 		GPO                     *gasprice.Config
 		EnablePreimageRecording *bool
+		ChainAnalytics          *bool
+		ChainRecorder           *core.ChainRecorderConfig
+		RPCStateFallback        *int    `toml:",omitempty"`
 		DocRoot                 *string `toml:"-"`
 	}
 	var dec Config
@@ -116,6 +213,60 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.LightPeers != nil {
 		c.LightPeers = *dec.LightPeers
 	}
+	if dec.LightRecentStates != nil {
+		c.LightRecentStates = *dec.LightRecentStates
+	}
+	if dec.LightSubnetRate != nil {
+		c.LightSubnetRate = *dec.LightSubnetRate
+	}
+	if dec.LightDailyCap != nil {
+		c.LightDailyCap = *dec.LightDailyCap
+	}
+	if dec.LightStopResume != nil {
+		c.LightStopResume = *dec.LightStopResume
+	}
+	if dec.LightStopAlternatives != nil {
+		c.LightStopAlternatives = dec.LightStopAlternatives
+	}
+	if dec.LightSLATarget != nil {
+		c.LightSLATarget = *dec.LightSLATarget
+	}
+	if dec.LightClientWeights != nil {
+		c.LightClientWeights = dec.LightClientWeights
+	}
+	if dec.LightSignedAnnounce != nil {
+		c.LightSignedAnnounce = *dec.LightSignedAnnounce
+	}
+	if dec.LightAnnounceTrust != nil {
+		c.LightAnnounceTrust = *dec.LightAnnounceTrust
+	}
+	if dec.LightDivergenceBlocks != nil {
+		c.LightDivergenceBlocks = *dec.LightDivergenceBlocks
+	}
+	if dec.LightDivergenceTime != nil {
+		c.LightDivergenceTime = *dec.LightDivergenceTime
+	}
+	if dec.LightOdrCache != nil {
+		c.LightOdrCache = *dec.LightOdrCache
+	}
+	if dec.LightSignedResponses != nil {
+		c.LightSignedResponses = *dec.LightSignedResponses
+	}
+	if dec.LightULCServers != nil {
+		c.LightULCServers = dec.LightULCServers
+	}
+	if dec.LightULCFraction != nil {
+		c.LightULCFraction = *dec.LightULCFraction
+	}
+	if dec.LightCheckpoint != nil {
+		c.LightCheckpoint = dec.LightCheckpoint
+	}
+	if dec.LightCheckpointFeed != nil {
+		c.LightCheckpointFeed = *dec.LightCheckpointFeed
+	}
+	if dec.LightCheckpointSigners != nil {
+		c.LightCheckpointSigners = dec.LightCheckpointSigners
+	}
 	if dec.SkipBcVersionCheck != nil {
 		c.SkipBcVersionCheck = *dec.SkipBcVersionCheck
 	}
@@ -131,6 +282,39 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.TrieTimeout != nil {
 		c.TrieTimeout = *dec.TrieTimeout
 	}
+	if dec.TrieCacheGen != nil {
+		c.TrieCacheGen = *dec.TrieCacheGen
+	}
+	if dec.TrieCacheSize != nil {
+		c.TrieCacheSize = *dec.TrieCacheSize
+	}
+	if dec.TrieCacheLimit != nil {
+		c.TrieCacheLimit = *dec.TrieCacheLimit
+	}
+	if dec.StatePastTries != nil {
+		c.StatePastTries = *dec.StatePastTries
+	}
+	if dec.StateCodeSizeCache != nil {
+		c.StateCodeSizeCache = *dec.StateCodeSizeCache
+	}
+	if dec.StateCodeCache != nil {
+		c.StateCodeCache = *dec.StateCodeCache
+	}
+	if dec.StateStorageTries != nil {
+		c.StateStorageTries = *dec.StateStorageTries
+	}
+	if dec.StateBackend != nil {
+		c.StateBackend = *dec.StateBackend
+	}
+	if dec.StateSnapshot != nil {
+		c.StateSnapshot = *dec.StateSnapshot
+	}
+	if dec.StateAccountBloom != nil {
+		c.StateAccountBloom = *dec.StateAccountBloom
+	}
+	if dec.StatePrefetch != nil {
+		c.StatePrefetch = *dec.StatePrefetch
+	}
 	if dec.Etherbase != nil {
 		c.Etherbase = *dec.Etherbase
 	}
@@ -161,6 +345,15 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.EnablePreimageRecording != nil {
 		c.EnablePreimageRecording = *dec.EnablePreimageRecording
 	}
+	if dec.ChainAnalytics != nil {
+		c.ChainAnalytics = *dec.ChainAnalytics
+	}
+	if dec.ChainRecorder != nil {
+		c.ChainRecorder = *dec.ChainRecorder
+	}
+	if dec.RPCStateFallback != nil {
+		c.RPCStateFallback = *dec.RPCStateFallback
+	}
 	if dec.DocRoot != nil {
 		c.DocRoot = *dec.DocRoot
 	}
@@ -75,6 +75,8 @@ type ProtocolManager struct {
 	blockchain  *core.BlockChain
 	// 链配置 信息
 	chainconfig *params.ChainConfig
+	// 可选的链统计服务, 用于记录 block 的 announce 时间
+	analytics   *core.ChainAnalytics
 
 	// 本地节点做大允许连接的远端节点数目
 	maxPeers    int
@@ -707,6 +709,9 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 
 			// 在该远端节点实例的相关容器中 记录标识 下这些block的Hash (为了去重用)
 			p.MarkBlock(block.Hash)
+			if pm.analytics != nil {
+				pm.analytics.NoteAnnounce(block.Hash)
+			}
 		}
 		// Schedule all the unknown hashes for retrieval
 		unknown := make(newBlockHashesData, 0, len(announces))   // todo 用来收集 存在于 对端peer 但是不存在当前本地 peer 的chain 中的block
@@ -733,6 +738,9 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 
 		// Mark the peer as owning the block and schedule it for import
 		p.MarkBlock(request.Block.Hash())
+		if pm.analytics != nil {
+			pm.analytics.NoteAnnounce(request.Block.Hash())
+		}
 		pm.fetcher.Enqueue(p.id, request.Block)
 
 		// Assuming the block is importable by the peer, but possibly not yet done so,
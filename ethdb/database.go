@@ -119,6 +119,29 @@ func (db *LDBDatabase) Get(key []byte) ([]byte, error) {
 	return dat, nil
 }
 
+// GetMany returns the values of the given keys, nil for the missing ones. All
+// the keys are read from the same snapshot of the database.
+func (db *LDBDatabase) GetMany(keys [][]byte) ([][]byte, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		dat, err := snap.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[i] = dat
+	}
+	return values, nil
+}
+
 // Delete deletes the key from the queue and database
 func (db *LDBDatabase) Delete(key []byte) error {
 	return db.db.Delete(key, nil)
@@ -210,3 +210,40 @@ func testParallelPutGet(db ethdb.Database, t *testing.T) {
 	}
 	pending.Wait()
 }
+
+func TestLDB_GetMany(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+	testGetMany(db, t)
+}
+
+func TestMemoryDB_GetMany(t *testing.T) {
+	testGetMany(ethdb.NewMemDatabase(), t)
+}
+
+func testGetMany(db ethdb.Database, t *testing.T) {
+	t.Parallel()
+
+	keys := [][]byte{[]byte("a"), []byte("missing"), []byte("1251"), []byte("a")}
+	for _, v := range []string{"a", "1251"} {
+		if err := db.Put([]byte(v), []byte(v+"!")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	values, err := ethdb.GetMany(db, keys)
+	if err != nil {
+		t.Fatalf("get many failed: %v", err)
+	}
+	want := []string{"a!", "", "1251!", "a!"}
+	if len(values) != len(want) {
+		t.Fatalf("value count mismatch: have %d, want %d", len(values), len(want))
+	}
+	for i, value := range values {
+		if string(value) != want[i] {
+			t.Errorf("value %d mismatch: have %q, want %q", i, value, want[i])
+		}
+	}
+	if values[1] != nil {
+		t.Errorf("missing key returned non-nil value %q", values[1])
+	}
+}
@@ -58,3 +58,24 @@ type Batch interface {
 	// Reset resets the batch for reuse
 	Reset()
 }
+
+// MultiGetter wraps the retrieval of several keys in one read, supported by the
+// databases which can serve them from a single consistent view.
+//
+// 一次读取多个 key (levelDB 上为同一个 snapshot), 不存在的 key 对应的值为 nil
+type MultiGetter interface {
+	GetMany(keys [][]byte) ([][]byte, error)
+}
+
+// GetMany retrieves the values of the given keys, nil for the missing ones. It
+// reads them in one go if the database is a MultiGetter, one by one otherwise.
+func GetMany(db Database, keys [][]byte) ([][]byte, error) {
+	if mg, ok := db.(MultiGetter); ok {
+		return mg.GetMany(keys)
+	}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], _ = db.Get(key)
+	}
+	return values, nil
+}
@@ -18,9 +18,14 @@ package ethdb
 
 import (
 	"errors"
+	"strings"
 	"sync"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 /*
@@ -69,6 +74,19 @@ func (db *MemDatabase) Get(key []byte) ([]byte, error) {
 	return nil, errors.New("not found")
 }
 
+func (db *MemDatabase) GetMany(keys [][]byte) ([][]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if entry, ok := db.db[string(key)]; ok {
+			values[i] = common.CopyBytes(entry)
+		}
+	}
+	return values, nil
+}
+
 func (db *MemDatabase) Keys() [][]byte {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -88,6 +106,21 @@ func (db *MemDatabase) Delete(key []byte) error {
 	return nil
 }
 
+// NewIteratorWithPrefix returns an iterator over a copy of the entries with the
+// given key prefix, in key order.
+func (db *MemDatabase) NewIteratorWithPrefix(prefix []byte) iterator.Iterator {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	entries := memdb.New(comparer.DefaultComparer, 0)
+	for key, value := range db.db {
+		if strings.HasPrefix(key, string(prefix)) {
+			entries.Put([]byte(key), value)
+		}
+	}
+	return entries.NewIterator(util.BytesPrefix(prefix))
+}
+
 func (db *MemDatabase) Close() {}
 
 func (db *MemDatabase) NewBatch() Batch {
@@ -87,13 +87,33 @@ func (s *PublicEthereumAPI) Syncing() (interface{}, error) {
 		return false, nil
 	}
 	// Otherwise gather the block sync stats
-	return map[string]interface{}{
+	status := map[string]interface{}{
 		"startingBlock": hexutil.Uint64(progress.StartingBlock),
 		"currentBlock":  hexutil.Uint64(progress.CurrentBlock),
 		"highestBlock":  hexutil.Uint64(progress.HighestBlock),
 		"pulledStates":  hexutil.Uint64(progress.PulledStates),
 		"knownStates":   hexutil.Uint64(progress.KnownStates),
-	}, nil
+	}
+	// 本地有完整 state 的区块范围 (fast sync 期间 / light client 没有)
+	if sr := s.b.StateRange(); sr != nil {
+		status["oldestStateBlock"] = hexutil.Uint64(sr.Oldest)
+		status["newestStateBlock"] = hexutil.Uint64(sr.Newest)
+	}
+	return status, nil
+}
+
+// StateRange returns the range of recent blocks whose state is available locally,
+// i.e. the blocks eth_call, eth_getBalance etc. can be executed at. It returns
+// nil if no state is available locally (light clients, fast sync in progress).
+func (s *PublicEthereumAPI) StateRange() map[string]interface{} {
+	sr := s.b.StateRange()
+	if sr == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"oldestBlock": hexutil.Uint64(sr.Oldest),
+		"newestBlock": hexutil.Uint64(sr.Newest),
+	}
 }
 
 // PublicTxPoolAPI offers and API for the transaction pool. It only operates on data that is non confidential.
@@ -503,6 +523,18 @@ func (s *PublicBlockChainAPI) BlockNumber() hexutil.Uint64 {
 	return hexutil.Uint64(header.Number.Uint64())
 }
 
+// StateBlockNumber returns the number of the block whose state is used by the
+// state accessing calls (e.g. eth_call, eth_getBalance) for the given block
+// number. It is lower than the requested one if the node falls back to an older
+// state because the requested one has been pruned.
+func (s *PublicBlockChainAPI) StateBlockNumber(ctx context.Context, blockNr rpc.BlockNumber) (hexutil.Uint64, error) {
+	state, header, err := s.b.StateAndHeaderByNumber(ctx, blockNr)
+	if state == nil || err != nil {
+		return 0, err
+	}
+	return hexutil.Uint64(header.Number.Uint64()), nil
+}
+
 // GetBalance returns the amount of wei for the given address in the state of the
 // given block number. The rpc.LatestBlockNumber and rpc.PendingBlockNumber meta
 // block numbers are also allowed.
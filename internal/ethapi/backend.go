@@ -69,6 +69,10 @@ type Backend interface {
 
 	ChainConfig() *params.ChainConfig
 	CurrentBlock() *types.Block
+
+	// StateRange returns the range of recent blocks with locally available
+	// state, nil if there are none (e.g. light clients, fast sync in progress).
+	StateRange() *core.StateRange
 }
 
 func GetAPIs(apiBackend Backend) []rpc.API {
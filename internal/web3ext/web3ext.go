@@ -24,6 +24,7 @@ var Modules = map[string]string{
 	"ethash":     Ethash_JS,
 	"debug":      Debug_JS,
 	"eth":        Eth_JS,
+	"les":        LES_JS,
 	"miner":      Miner_JS,
 	"net":        Net_JS,
 	"personal":   Personal_JS,
@@ -168,6 +169,15 @@ web3._extend({
 			params: 1,
 			inputFormatter: [null]
 		}),
+		new web3._extend.Method({
+			name: 'txPoolLimits',
+			call: 'admin_txPoolLimits'
+		}),
+		new web3._extend.Method({
+			name: 'setTxPoolLimits',
+			call: 'admin_setTxPoolLimits',
+			params: 1
+		}),
 		new web3._extend.Method({
 			name: 'importChain',
 			call: 'admin_importChain',
@@ -245,6 +255,11 @@ web3._extend({
 			call: 'debug_dumpBlock',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'chainAnalytics',
+			call: 'debug_chainAnalytics',
+			params: 0
+		}),
 		new web3._extend.Method({
 			name: 'chaindbProperty',
 			call: 'debug_chaindbProperty',
@@ -378,6 +393,12 @@ web3._extend({
 			params: 2,
 			inputFormatter: [null, null]
 		}),
+		new web3._extend.Method({
+			name: 'profileChain',
+			call: 'debug_profileChain',
+			params: 3,
+			inputFormatter: [null, null, null]
+		}),
 		new web3._extend.Method({
 			name: 'traceBlockByNumber',
 			call: 'debug_traceBlockByNumber',
@@ -424,6 +445,34 @@ web3._extend({
 			params: 2,
 			inputFormatter:[null, null],
 		}),
+		new web3._extend.Method({
+			name: 'auditTrieCache',
+			call: 'debug_auditTrieCache',
+			params: 1,
+			inputFormatter: [null]
+		}),
+		new web3._extend.Method({
+			name: 'startTrieHeatMap',
+			call: 'debug_startTrieHeatMap',
+			params: 2,
+			inputFormatter: [null, null]
+		}),
+		new web3._extend.Method({
+			name: 'stopTrieHeatMap',
+			call: 'debug_stopTrieHeatMap',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'trieHeatMap',
+			call: 'debug_trieHeatMap',
+			params: 1,
+			inputFormatter: [null]
+		}),
+		new web3._extend.Method({
+			name: 'chainConsistencyReport',
+			call: 'debug_chainConsistencyReport',
+			params: 0
+		}),
 	],
 	properties: []
 });
@@ -470,6 +519,13 @@ web3._extend({
 			params: 2,
 			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter, web3._extend.utils.toHex]
 		}),
+		new web3._extend.Method({
+			name: 'stateBlockNumber',
+			call: 'eth_stateBlockNumber',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter],
+			outputFormatter: web3._extend.utils.toDecimal
+		}),
 	],
 	properties: [
 		new web3._extend.Property({
@@ -484,6 +540,112 @@ web3._extend({
 				return formatted;
 			}
 		}),
+		new web3._extend.Property({
+			name: 'stateRange',
+			getter: 'eth_stateRange'
+		}),
+	]
+});
+`
+
+const LES_JS = `
+web3._extend({
+	property: 'les',
+	methods: [
+		new web3._extend.Method({
+			name: 'setCheckpoint',
+			call: 'les_setCheckpoint',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'unbanPeer',
+			call: 'les_unbanPeer',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'startFlowTrace',
+			call: 'les_startFlowTrace',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'stopFlowTrace',
+			call: 'les_stopFlowTrace',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'exportState',
+			call: 'les_exportState',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'importState',
+			call: 'les_importState',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'headerRange',
+			call: 'les_headerRange',
+			params: 3,
+			inputFormatter: [web3._extend.utils.fromDecimal, web3._extend.utils.fromDecimal, null]
+		}),
+	],
+	properties: [
+		new web3._extend.Property({
+			name: 'checkpoint',
+			getter: 'les_checkpoint'
+		}),
+		new web3._extend.Property({
+			name: 'peerStats',
+			getter: 'les_peerStats'
+		}),
+		new web3._extend.Property({
+			name: 'peerScores',
+			getter: 'les_peerScores'
+		}),
+		new web3._extend.Property({
+			name: 'bannedPeers',
+			getter: 'les_bannedPeers'
+		}),
+		new web3._extend.Property({
+			name: 'status',
+			getter: 'les_status'
+		}),
+		new web3._extend.Property({
+			name: 'peerVersions',
+			getter: 'les_peerVersions'
+		}),
+		new web3._extend.Property({
+			name: 'capabilityProviders',
+			getter: 'les_capabilityProviders'
+		}),
+		new web3._extend.Property({
+			name: 'distributorStatus',
+			getter: 'les_distributorStatus'
+		}),
+		new web3._extend.Property({
+			name: 'headDivergence',
+			getter: 'les_headDivergence'
+		}),
+		new web3._extend.Property({
+			name: 'indexerStatus',
+			getter: 'les_indexerStatus'
+		}),
+		new web3._extend.Property({
+			name: 'slaReport',
+			getter: 'les_slaReport'
+		}),
+		new web3._extend.Property({
+			name: 'underrunStats',
+			getter: 'les_underrunStats'
+		}),
+		new web3._extend.Property({
+			name: 'ulcStatus',
+			getter: 'les_ulcStatus'
+		}),
+		new web3._extend.Property({
+			name: 'responseEvidence',
+			getter: 'les_responseEvidence'
+		}),
 	]
 });
 `
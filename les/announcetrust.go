@@ -0,0 +1,122 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// announceTrustPrefix is the database key prefix of the announcement history
+// of the servers.
+var announceTrustPrefix = []byte("announceTrust/")
+
+// announceTrustKey = announceTrustPrefix + node id
+func announceTrustKey(id discover.NodeID) []byte {
+	return append(append([]byte{}, announceTrustPrefix...), id[:]...)
+}
+
+// announceTrust keeps the number of valid signed announcements received from the
+// untrusted servers, across connections and restarts. Servers with a long enough
+// clean history are asked for simple announcements on their next connection,
+// saving the signing and verification overhead. An invalid signature or response
+// restarts the history of the server.
+//
+// announceTrust: 记录每个 (非可信) server 发来的有效签名 announce 数 (持久化),
+// 历史足够长的 server 在下次连接时只要求 simple announce, 出错则清零
+type announceTrust struct {
+	db        ethdb.Database
+	threshold uint64 // valid signed announcements after which simple ones are requested, zero for never
+
+	lock   sync.Mutex
+	counts map[discover.NodeID]uint64 // histories of the connected servers
+}
+
+// newAnnounceTrust creates the announcement history tracker of the client.
+func newAnnounceTrust(db ethdb.Database, threshold uint64) *announceTrust {
+	return &announceTrust{
+		db:        db,
+		threshold: threshold,
+		counts:    make(map[discover.NodeID]uint64),
+	}
+}
+
+// connect loads the history of a server and returns the announcement type to
+// request from it.
+func (t *announceTrust) connect(id discover.NodeID) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var count uint64
+	if enc, err := t.db.Get(announceTrustKey(id)); err == nil && len(enc) == 8 {
+		count = binary.BigEndian.Uint64(enc)
+	}
+	t.counts[id] = count
+
+	if t.threshold > 0 && count >= t.threshold {
+		return announceTypeSimple
+	}
+	return announceTypeSigned
+}
+
+// disconnect saves the history of a server.
+func (t *announceTrust) disconnect(id discover.NodeID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if count, ok := t.counts[id]; ok {
+		t.store(id, count)
+		delete(t.counts, id)
+	}
+}
+
+// valid records a valid signed announcement of a server.
+func (t *announceTrust) valid(id discover.NodeID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.counts[id]; ok {
+		t.counts[id]++
+	}
+}
+
+// invalid restarts the history of a misbehaving server.
+func (t *announceTrust) invalid(id discover.NodeID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if count, ok := t.counts[id]; ok && count > 0 {
+		t.counts[id] = 0
+		t.store(id, 0)
+	}
+}
+
+// store writes the history of a server into the database. The lock is held by
+// the caller.
+func (t *announceTrust) store(id discover.NodeID, count uint64) {
+	key := announceTrustKey(id)
+	if count == 0 {
+		t.db.Delete(key)
+		return
+	}
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], count)
+	t.db.Put(key, enc[:])
+}
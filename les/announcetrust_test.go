@@ -0,0 +1,63 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+func TestAnnounceTrust(t *testing.T) {
+	var (
+		db    = ethdb.NewMemDatabase()
+		trust = newAnnounceTrust(db, 3)
+		id    = discover.NodeID{1}
+	)
+	// Unknown servers sign, until they have a long enough history
+	for i := 0; i < 3; i++ {
+		if typ := trust.connect(id); typ != announceTypeSigned {
+			t.Fatalf("connection %d: announce type mismatch: have %d, want %d", i, typ, announceTypeSigned)
+		}
+		trust.valid(id)
+		trust.disconnect(id)
+	}
+	// The history survives a restart
+	trust = newAnnounceTrust(db, 3)
+	if typ := trust.connect(id); typ != announceTypeSimple {
+		t.Fatalf("announce type mismatch: have %d, want %d", typ, announceTypeSimple)
+	}
+	// Misbehaviour restarts the history
+	trust.invalid(id)
+	trust.disconnect(id)
+	if typ := trust.connect(id); typ != announceTypeSigned {
+		t.Fatalf("announce type after misbehaviour mismatch: have %d, want %d", typ, announceTypeSigned)
+	}
+	trust.disconnect(id)
+
+	// A zero threshold never trusts the servers
+	trust = newAnnounceTrust(db, 0)
+	for i := 0; i < 3; i++ {
+		trust.connect(id)
+		trust.valid(id)
+		trust.disconnect(id)
+	}
+	if typ := trust.connect(id); typ != announceTypeSigned {
+		t.Fatalf("announce type without threshold mismatch: have %d, want %d", typ, announceTypeSigned)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/hexutil"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+)
+
+var (
+	errNoCheckpoint = errors.New("no trusted checkpoint")
+	errULCDisabled  = errors.New("ultra-light client mode disabled")
+	errNoSignedResp = errors.New("signed responses not requested")
+	errTracing      = errors.New("flow control trace already running")
+	errNotTracing   = errors.New("no flow control trace running")
+)
+
+// maxHeaderRange is the number of headers retrieved at most by one HeaderRange
+// call.
+const maxHeaderRange = 8192
+
+// LightStatus aggregates the health of the light client for status screens.
+type LightStatus struct {
+	Peers             map[string]int     `json:"peers"`             // Connected servers by role
+	FlowSaturation    float64            `json:"flowSaturation"`    // Average used fraction of the servers' flow control buffers
+	CacheHitRates     map[string]float64 `json:"cacheHitRates"`     // Hit rates of the caches of the ODR retrieved block data
+	ProofVerifyTime   time.Duration      `json:"proofVerifyTime"`   // Average time of verifying the proofs of a response
+	PendingRetrievals int                `json:"pendingRetrievals"` // Retrievals waiting for a valid answer
+	HeadAge           time.Duration      `json:"headAge"`           // Time since the timestamp of the head header
+}
+
+// DistributorStatus is the state of the request distributor of the light client.
+type DistributorStatus struct {
+	Pending int                             `json:"pending"` // Requests waiting for a suitable server
+	Peers   map[string]DistributorPeerStats `json:"peers"`   // Distribution history of the connected servers
+}
+
+// ULCStatus is the state of the ultra-light client mode.
+type ULCStatus struct {
+	Fraction  int `json:"fraction"`  // Percentage of the voting servers announcing a head needed to accept it
+	Servers   int `json:"servers"`   // Configured voting servers
+	Connected int `json:"connected"` // Connected voting servers
+}
+
+// PrivateLightAPI provides an API to inspect and override the trusted checkpoint
+// of the light client and to inspect the performance of the connected servers.
+//
+// PrivateLightAPI: 用于 查看/覆盖 light client 的 trusted checkpoint, 以及查看 server 的响应延迟
+type PrivateLightAPI struct {
+	les *LightEthereum
+}
+
+// NewPrivateLightAPI creates a new light client API.
+func NewPrivateLightAPI(les *LightEthereum) *PrivateLightAPI {
+	return &PrivateLightAPI{les: les}
+}
+
+// Checkpoint returns the active trusted checkpoint of the light chain.
+func (api *PrivateLightAPI) Checkpoint() (*light.TrustedCheckpoint, error) {
+	cp := api.les.blockchain.Checkpoint()
+	if cp == nil {
+		return nil, errNoCheckpoint
+	}
+	return cp, nil
+}
+
+// SetCheckpoint replaces the active trusted checkpoint. Headers before the head
+// of the new checkpoint are not downloaded by subsequent syncs.
+func (api *PrivateLightAPI) SetCheckpoint(cp light.TrustedCheckpoint) (bool, error) {
+	if err := api.les.blockchain.SetCheckpoint(cp); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PeerStats returns the request round-trip time statistics of the connected
+// servers, keyed by peer id and request type.
+func (api *PrivateLightAPI) PeerStats() map[string]map[string]LatencyStats {
+	stats := make(map[string]map[string]LatencyStats)
+	for _, p := range api.les.peers.AllPeers() {
+		stats[p.id] = p.LatencyStats()
+	}
+	return stats
+}
+
+// PeerScores returns the reputation score of the connected servers, keyed by
+// peer id. Servers falling below the ban threshold are disconnected and banned.
+func (api *PrivateLightAPI) PeerScores() map[string]int {
+	return api.les.peers.AllPeerScores()
+}
+
+// BannedPeers returns the remaining ban time of the banned servers, keyed by
+// peer id.
+func (api *PrivateLightAPI) BannedPeers() map[string]time.Duration {
+	return api.les.peers.BannedPeers()
+}
+
+// UnbanPeer lifts the ban of a server, returning false if it wasn't banned.
+func (api *PrivateLightAPI) UnbanPeer(id string) bool {
+	return api.les.peers.Unban(id)
+}
+
+// PeerVersions returns the number of connected peers by protocol version.
+func (api *PrivateLightAPI) PeerVersions() map[string]int {
+	return api.les.peers.VersionCounts()
+}
+
+// CapabilityProviders returns the number of connected servers able to serve the
+// requests only some of the servers support, keyed by the feature needing them.
+func (api *PrivateLightAPI) CapabilityProviders() map[string]int {
+	return api.les.peers.Providers()
+}
+
+// OriginStats returns the number of requests, the flow control cost and the
+// reply bytes of the ODR retrievals, keyed by the origin of the RPC calls
+// triggering them. Calls without an origin are reported as "local".
+func (api *PrivateLightAPI) OriginStats() map[string]OriginStats {
+	return api.les.odr.origins.Stats()
+}
+
+// Status returns a summary of the health of the light client: the connected
+// servers, their flow control saturation, the cache hit rates, the average proof
+// verification time, the pending retrievals and the age of the head.
+func (api *PrivateLightAPI) Status() *LightStatus {
+	status := &LightStatus{
+		Peers:             map[string]int{"trusted": 0, "untrusted": 0},
+		CacheHitRates:     api.les.blockchain.CacheHitRates(),
+		ProofVerifyTime:   proofVerifier.averageTime(),
+		PendingRetrievals: api.les.retriever.pending(),
+	}
+	var (
+		used    float64
+		servers int
+	)
+	for _, p := range api.les.peers.AllPeers() {
+		if p.Peer.Info().Network.Trusted {
+			status.Peers["trusted"]++
+		} else {
+			status.Peers["untrusted"]++
+		}
+		if p.fcServer != nil {
+			used += 1 - p.fcServer.BufferLevel()
+			servers++
+		}
+	}
+	if servers > 0 {
+		status.FlowSaturation = used / float64(servers)
+	}
+	if head := api.les.blockchain.CurrentHeader(); head != nil {
+		status.HeadAge = time.Since(time.Unix(head.Time.Int64(), 0))
+	}
+	return status
+}
+
+// UlcStatus returns the agreeing fraction of the servers needed to accept a head
+// in ultra-light mode, and the number of the configured and connected ones.
+func (api *PrivateLightAPI) UlcStatus() (*ULCStatus, error) {
+	u := api.les.protocolManager.ulc
+	if u == nil {
+		return nil, errULCDisabled
+	}
+	status := &ULCStatus{Fraction: u.fraction, Servers: len(u.servers)}
+	for _, p := range api.les.peers.AllPeers() {
+		if u.trusted(p.ID()) {
+			status.Connected++
+		}
+	}
+	return status, nil
+}
+
+// ResponseEvidence returns the most recent responses found invalid among the
+// ones signed by the servers, each verifiable by anyone knowing the node ID of
+// the server, e.g. to report it to a public server scoreboard.
+func (api *PrivateLightAPI) ResponseEvidence() ([]*SignedResponse, error) {
+	evidence := api.les.protocolManager.evidence
+	if evidence == nil {
+		return nil, errNoSignedResp
+	}
+	return evidence.list(), nil
+}
+
+// HeadDivergence returns whether the connected servers disagree about the head
+// of the chain by more than the configured number of blocks for longer than the
+// configured time, and the heads they announced as of the last comparison.
+func (api *PrivateLightAPI) HeadDivergence() *HeadDivergence {
+	return api.les.divergence.status()
+}
+
+// HeaderRange returns count canonical headers from start on, retrieving the
+// missing ones from the network. With the "anchored" (default) verification only
+// the last header is proven by the CHT and the others by their hash chain, with
+// "seal" the seal of every header is checked as well.
+func (api *PrivateLightAPI) HeaderRange(ctx context.Context, start, count hexutil.Uint64, verify string) ([]*types.Header, error) {
+	if count > maxHeaderRange {
+		return nil, fmt.Errorf("too many headers requested: %d > %d", count, maxHeaderRange)
+	}
+	var mode light.HeaderVerifyMode
+	switch verify {
+	case "", light.HeaderVerifyAnchored.String():
+		mode = light.HeaderVerifyAnchored
+	case light.HeaderVerifySeal.String():
+		mode = light.HeaderVerifySeal
+	default:
+		return nil, fmt.Errorf("unknown header verification %q", verify)
+	}
+	return api.les.blockchain.GetHeaderRangeOdr(ctx, uint64(start), uint64(count), mode)
+}
+
+// DistributorStatus returns the number of requests waiting to be sent and, for
+// each connected server, the number of requests queued to it, the average flow
+// control waiting time and the requests dropped while its send queue was full.
+// A light client stalling with pending requests shows where they are stuck.
+func (api *PrivateLightAPI) DistributorStatus() *DistributorStatus {
+	stats, pending := api.les.reqDist.status()
+
+	status := &DistributorStatus{
+		Pending: pending,
+		Peers:   make(map[string]DistributorPeerStats),
+	}
+	for _, p := range api.les.peers.AllPeers() {
+		if s, ok := stats[p]; ok {
+			status.Peers[p.id] = s
+		}
+	}
+	return status
+}
+
+// PrivateLightServerAPI provides an API to inspect the service provided by the
+// light server to its clients.
+//
+// PrivateLightServerAPI: 用于查看 light server 对 client 的服务水平
+type PrivateLightServerAPI struct {
+	server *LesServer
+
+	traceLock sync.Mutex
+	trace     *flowcontrol.TraceRecorder
+}
+
+// FlowTrace is a recorded flow control trace of the clients of the server.
+type FlowTrace struct {
+	Events  []flowcontrol.TraceEvent `json:"events"`
+	Dropped int                      `json:"dropped"` // events over the limit
+}
+
+// NewPrivateLightServerAPI creates a new light server API.
+func NewPrivateLightServerAPI(server *LesServer) *PrivateLightServerAPI {
+	return &PrivateLightServerAPI{server: server}
+}
+
+// SlaReport returns the service level summary of the server: for each connected
+// client the fraction of the requests answered within the target latency and the
+// number of requests delayed or refused by flow control, throttling or overload
+// protection, and the same for all the clients since the last periodic report.
+func (api *PrivateLightServerAPI) SlaReport() *SLAReport {
+	return api.server.sla.report(false)
+}
+
+// UnderrunStats returns the number of requests of the clients exceeding their
+// flow control buffers, by the penalty applied: a warning, a freeze or a
+// disconnection.
+func (api *PrivateLightServerAPI) UnderrunStats() flowcontrol.UnderrunStats {
+	return api.server.fcManager.UnderrunStats()
+}
+
+// IndexerStatus returns the progress of generating the CHT and the bloom trie:
+// the sections completed, the ones waiting to be indexed and the head and root of
+// the last one, the newest checkpoint the server can serve.
+func (api *PrivateLightServerAPI) IndexerStatus() map[string]*IndexerStatus {
+	return api.server.indexerStatus()
+}
+
+// ExportState returns the operational state of the server kept across restarts:
+// the recent usage of the free clients, the traffic of the clients in the daily
+// quota window and the banned peers.
+func (api *PrivateLightServerAPI) ExportState() *ServerState {
+	return api.server.exportState()
+}
+
+// ImportState restores an exported server state, e.g. one of another data
+// directory, adding the clients and peers not known yet.
+func (api *PrivateLightServerAPI) ImportState(state ServerState) error {
+	return api.server.importState(&state)
+}
+
+// StartFlowTrace starts recording the flow control events of the clients, at most
+// limit of them (zero for unlimited), for a deterministic replay.
+func (api *PrivateLightServerAPI) StartFlowTrace(limit int) error {
+	api.traceLock.Lock()
+	defer api.traceLock.Unlock()
+
+	if api.trace != nil {
+		return errTracing
+	}
+	api.trace = flowcontrol.NewTraceRecorder(mclock.System{}, limit)
+	api.server.fcManager.SetTraceRecorder(api.trace)
+	return nil
+}
+
+// StopFlowTrace stops recording the flow control events and returns the trace.
+func (api *PrivateLightServerAPI) StopFlowTrace() (*FlowTrace, error) {
+	api.traceLock.Lock()
+	defer api.traceLock.Unlock()
+
+	if api.trace == nil {
+		return nil, errNotTracing
+	}
+	api.server.fcManager.SetTraceRecorder(nil)
+	events, dropped := api.trace.Events()
+	api.trace = nil
+	return &FlowTrace{Events: events, Dropped: dropped}, nil
+}
@@ -177,6 +177,11 @@ func (b *LesApiBackend) Downloader() *downloader.Downloader {
 	return b.eth.Downloader()
 }
 
+// StateRange returns nil, the states are retrieved on demand from the servers.
+func (b *LesApiBackend) StateRange() *core.StateRange {
+	return nil
+}
+
 func (b *LesApiBackend) ProtocolVersion() int {
 	return b.eth.LesVersion() + 10000
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/accounts"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/hexutil"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/bloombits"
@@ -63,6 +64,10 @@ type LightEthereum struct {
 	txPool     *light.TxPool
 	// lightchain指针
 	blockchain *light.LightChain
+	// 签名 checkpoint 的热更新源 (可为 nil)
+	checkpointFeed *light.CheckpointFeed
+	// 比较各 server 广播的 head, 发现 分歧 (eclipse 攻击 / 落后的 server)
+	divergence *divergenceMonitor
 
 	// todo 这个东西,只有当前节点为 light 节点测 client端的时候才会有值
 	// todo 里头记录的是和当前 client链接的 server 端
@@ -152,10 +157,15 @@ func New(ctx *node.ServiceContext, config *eth.Config) (*LightEthereum, error) {
 	// todo 里头记录的是和当前 client链接的 server 端
 	leth.serverPool = newServerPool(chainDb, quitSync, &leth.wg)
 	// 请求拉取管理器 (额,请求分发器的更上一层)
-	leth.retriever = newRetrieveManager(peers, leth.reqDist, leth.serverPool)
+	leth.retriever = newRetrieveManager(peers, leth.reqDist, leth.serverPool, mclock.System{})
+	leth.divergence = newDivergenceMonitor(peers, config.LightDivergenceBlocks, config.LightDivergenceTime, mclock.System{})
 
 	// todo 处理ODR检索类型的后端服务 （这个只有 Client 端才会有）
 	leth.odr = NewLesOdr(chainDb, leth.retriever)
+	if config.LightOdrCache > 0 {
+		// 持久化 已校验的 ODR 结果, 重启后复用
+		leth.odr.SetCache(light.NewOdrCache(chainDb, uint64(config.LightOdrCache)*1024*1024))
+	}
 
 	// todo cht 是轻节点相关的 checkpoint 索引器
 	leth.chtIndexer = light.NewChtIndexer(chainDb, true, leth.odr)
@@ -169,9 +179,12 @@ func New(ctx *node.ServiceContext, config *eth.Config) (*LightEthereum, error) {
 	// indexers already set but not started yet
 	//
 	// 注意：NewLightChain添加了受信任的检查点，因此需要已设置索引器但尚未启动的ODR
-	if leth.blockchain, err = light.NewLightChain(leth.odr, leth.chainConfig, leth.engine); err != nil {
+	if leth.blockchain, err = light.NewLightChain(leth.odr, leth.chainConfig, leth.engine, config.LightCheckpoint); err != nil {
 		return nil, err
 	}
+	if config.LightCheckpointFeed != "" {
+		leth.checkpointFeed = light.NewCheckpointFeed(config.LightCheckpointFeed, config.LightCheckpointSigners, leth.blockchain)
+	}
 	// Note: AddChildIndexer starts the update process for the child
 	//
 	// 注意：AddChildIndexer启动 子索引器 的更新过程
@@ -195,11 +208,29 @@ func New(ctx *node.ServiceContext, config *eth.Config) (*LightEthereum, error) {
 
 	// 初始化 light txpool
 	leth.txPool = light.NewTxPool(leth.chainConfig, leth.blockchain, leth.relay)
+	leth.relay.setNonceHandler(leth.txPool.AdviseNonce)
 
 	/** TODO 这个是大头啊  p2p 管理 */
 	if leth.protocolManager, err = NewProtocolManager(leth.chainConfig, true, config.NetworkId, leth.eventMux, leth.engine, leth.peers, leth.blockchain, nil, chainDb, leth.odr, leth.relay, leth.serverPool, quitSync, &leth.wg); err != nil {
 		return nil, err
 	}
+	leth.protocolManager.signedAnnounce = config.LightSignedAnnounce
+	if config.LightSignedAnnounce {
+		leth.protocolManager.announceTrust = newAnnounceTrust(chainDb, config.LightAnnounceTrust)
+	}
+	// 要求 server 对 resp 签名, 无效的 resp 作为 server 作恶的证据保留
+	if config.LightSignedResponses {
+		leth.protocolManager.signedResponses = true
+		leth.protocolManager.evidence = new(responseEvidence)
+	}
+	// 超轻节点模式: 只信任 指定 server 的投票, 不校验 header chain
+	if len(config.LightULCServers) > 0 {
+		if leth.protocolManager.ulc, err = newULC(config.LightULCServers, config.LightULCFraction); err != nil {
+			return nil, err
+		}
+		leth.blockchain.DisableCheckFreq()
+		log.Info("Ultra-light client mode enabled", "servers", len(leth.protocolManager.ulc.servers), "fraction", config.LightULCFraction)
+	}
 
 	// light api backend
 	leth.ApiBackend = &LesApiBackend{leth, nil}
@@ -213,6 +244,12 @@ func New(ctx *node.ServiceContext, config *eth.Config) (*LightEthereum, error) {
 	return leth, nil
 }
 
+// lesTopic returns the discovery v5 topic a light server advertises itself with
+// for a protocol version, e.g. "LES2@d4e56740f876aef8" on the main network. Light
+// clients search the topic of the first advertised version in their server pool.
+//
+// lesTopic: les server 在 discv5 中注册的 topic (协议版本名 + "@" + 创世块 hash 前 8 字节),
+// light client 的 serverPool 按此 topic 查找 server, 不再依赖静态/种子节点
 func lesTopic(genesisHash common.Hash, protocolVersion uint) discv5.Topic {
 	var name string
 	switch protocolVersion {
@@ -272,6 +309,10 @@ func (s *LightEthereum) APIs() []rpc.API {
 			Version:   "1.0",
 			Service:   s.netRPCService,
 			Public:    true,
+		}, {
+			Namespace: "les",
+			Version:   "1.0",
+			Service:   NewPrivateLightAPI(s),
 		},
 	}...)
 }
@@ -287,6 +328,12 @@ func (s *LightEthereum) LesVersion() int                    { return int(ClientP
 func (s *LightEthereum) Downloader() *downloader.Downloader { return s.protocolManager.downloader }
 func (s *LightEthereum) EventMux() *event.TypeMux           { return s.eventMux }
 
+// SubscribeHeadDivergence subscribes to the events of the connected servers
+// starting or stopping to disagree about the head of the chain.
+func (s *LightEthereum) SubscribeHeadDivergence(ch chan<- HeadDivergenceEvent) event.Subscription {
+	return s.divergence.SubscribeDivergence(ch)
+}
+
 // Protocols implements node.Service, returning all the currently configured
 // network protocols to start.
 // todo ##############################
@@ -299,7 +346,7 @@ func (s *LightEthereum) EventMux() *event.TypeMux           { return s.eventMux
 func (s *LightEthereum) Protocols() []p2p.Protocol {
 
 	// 这边才是创建
-	return s.makeProtocols(ClientProtocolVersions)
+	return s.makeProtocols(ClientProtocolVersions, p2p.DialOutbound)
 }
 
 // Start implements node.Service, starting all internal goroutines needed by the
@@ -318,12 +365,20 @@ func (s *LightEthereum) Start(srvr *p2p.Server) error {
 
 	// todo 启动轻节点的 Client 端
 	s.protocolManager.Start(s.config.LightPeers)
+	if s.checkpointFeed != nil {
+		s.checkpointFeed.Start()
+	}
+	s.divergence.start()
 	return nil
 }
 
 // Stop implements node.Service, terminating all internal goroutines used by the
 // Ethereum protocol.
 func (s *LightEthereum) Stop() error {
+	if s.checkpointFeed != nil {
+		s.checkpointFeed.Stop()
+	}
+	s.divergence.stop()
 	s.odr.Stop()
 	s.bloomIndexer.Close()
 	s.chtIndexer.Close()
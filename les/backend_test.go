@@ -0,0 +1,42 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discv5"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
+)
+
+func TestLesTopic(t *testing.T) {
+	if topic := lesTopic(params.MainnetGenesisHash, lpv2); topic != "LES2@d4e56740f876aef8" {
+		t.Errorf("mainnet topic mismatch: have %s, want LES2@d4e56740f876aef8", topic)
+	}
+	if lesTopic(params.MainnetGenesisHash, lpv1) == lesTopic(params.TestnetGenesisHash, lpv1) {
+		t.Error("topics of different networks match")
+	}
+	// The topic searched by the clients must be advertised by the servers
+	search := lesTopic(params.MainnetGenesisHash, AdvertiseProtocolVersions[0])
+	advertised := make(map[discv5.Topic]bool)
+	for _, pv := range AdvertiseProtocolVersions {
+		advertised[lesTopic(params.MainnetGenesisHash, pv)] = true
+	}
+	if !advertised[search] {
+		t.Errorf("searched topic %s not advertised", search)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+)
+
+var quotaExceededMeter = metrics.NewRegisteredMeter("les/server/quota/exceeded", nil)
+
+const (
+	// bandwidthBucketLength is the resolution of the rolling window the bytes
+	// sent to the clients are capped in.
+	bandwidthBucketLength = time.Hour
+
+	// bandwidthBuckets is the number of buckets in the rolling window, a day.
+	bandwidthBuckets = 24
+)
+
+// bandwidthTracker caps the bytes sent to each client in a rolling 24 hour
+// window. The usage is kept by client ID across connections until it leaves the
+// window, so a client can't reset its quota by reconnecting.
+//
+/**
+bandwidthTracker:
+	按 client 统计 最近 24 小时 (滚动窗口, 按小时分桶) server 发送给它的字节数,
+	超出上限后 该 client 的 req 不再被处理, 并断开连接;
+	断开后 统计仍保留直到移出窗口, 重连无法重置配额
+ */
+type bandwidthTracker struct {
+	limit uint64 // bytes allowed per client in the window
+	clock mclock.Clock
+
+	lock    sync.Mutex
+	clients map[string]*clientBandwidth
+}
+
+// clientBandwidth is the usage of a client in the hourly buckets of the window.
+type clientBandwidth struct {
+	buckets [bandwidthBuckets]uint64
+	hour    int64 // index of the hour of the latest bucket
+	sum     uint64
+}
+
+// newBandwidthTracker creates a tracker capping the bytes sent to each client in
+// a day, or returns nil (no cap) if the limit is zero.
+func newBandwidthTracker(limit uint64, clock mclock.Clock) *bandwidthTracker {
+	if limit == 0 {
+		return nil
+	}
+	return &bandwidthTracker{
+		limit:   limit,
+		clock:   clock,
+		clients: make(map[string]*clientBandwidth),
+	}
+}
+
+// hour returns the index of the current hour.
+func (t *bandwidthTracker) hour() int64 {
+	return int64(time.Duration(t.clock.Now()) / bandwidthBucketLength)
+}
+
+// roll drops the buckets of a client leaving the window by the given hour.
+func (c *clientBandwidth) roll(hour int64) {
+	for c.hour < hour {
+		c.hour++
+		idx := c.hour % bandwidthBuckets
+		c.sum -= c.buckets[idx]
+		c.buckets[idx] = 0
+		if c.sum == 0 {
+			c.hour = hour
+		}
+	}
+}
+
+// add accounts the bytes sent to a client.
+func (t *bandwidthTracker) add(id string, bytes uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hour := t.hour()
+	c := t.clients[id]
+	if c == nil {
+		c = &clientBandwidth{hour: hour}
+		t.clients[id] = c
+	}
+	c.roll(hour)
+	c.buckets[hour%bandwidthBuckets] += bytes
+	c.sum += bytes
+}
+
+// usage returns the bytes sent to a client in the window.
+func (t *bandwidthTracker) usage(id string) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := t.clients[id]
+	if c == nil {
+		return 0
+	}
+	c.roll(t.hour())
+	return c.sum
+}
+
+// exceeded returns whether a client used up its quota, and if so, the time after
+// which enough of its usage leaves the window to be served again.
+func (t *bandwidthTracker) exceeded(id string) (bool, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := t.clients[id]
+	if c == nil {
+		return false, 0
+	}
+	now := t.clock.Now()
+	hour := int64(time.Duration(now) / bandwidthBucketLength)
+	c.roll(hour)
+	if c.sum < t.limit {
+		return false, 0
+	}
+	// Find the first hour after which the usage falls below the limit
+	sum := c.sum
+	for i := int64(1); i <= bandwidthBuckets; i++ {
+		sum -= c.buckets[(hour+i)%bandwidthBuckets]
+		if sum < t.limit {
+			return true, time.Duration(hour+i)*bandwidthBucketLength - time.Duration(now)
+		}
+	}
+	return true, bandwidthBuckets * bandwidthBucketLength
+}
+
+// prune drops the clients without usage in the window, those behave the same as
+// unknown ones.
+func (t *bandwidthTracker) prune() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hour := t.hour()
+	for id, c := range t.clients {
+		if c.roll(hour); c.sum == 0 {
+			delete(t.clients, id)
+		}
+	}
+}
+
+// bandwidthMsgWriter counts the bytes sent to a client.
+type bandwidthMsgWriter struct {
+	p2p.MsgReadWriter
+	peer *peer
+}
+
+func (w *bandwidthMsgWriter) WriteMsg(msg p2p.Msg) error {
+	size := uint64(msg.Size)
+	if err := w.MsgReadWriter.WriteMsg(msg); err != nil {
+		return err
+	}
+	atomic.AddUint64(&w.peer.bytesSent, size)
+	if w.peer.bandwidth != nil {
+		w.peer.bandwidth.add(w.peer.id, size)
+	}
+	return nil
+}
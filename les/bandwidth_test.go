@@ -0,0 +1,65 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+func TestBandwidthTracker(t *testing.T) {
+	if newBandwidthTracker(0, nil) != nil {
+		t.Fatalf("tracker created with zero limit")
+	}
+	clock := &mclock.Simulated{}
+	tracker := newBandwidthTracker(1000, clock)
+
+	// Use up the quota over a few hours
+	tracker.add("a", 600)
+	clock.Run(3 * time.Hour)
+	tracker.add("a", 300)
+	if over, _ := tracker.exceeded("a"); over {
+		t.Fatalf("quota exceeded at 900 bytes")
+	}
+	tracker.add("a", 200)
+	over, retry := tracker.exceeded("a")
+	if !over {
+		t.Fatalf("quota not exceeded at 1100 bytes")
+	}
+	// The first 600 bytes leave the window 21 hours later
+	if retry != 21*time.Hour {
+		t.Fatalf("retry time mismatch: have %v, want %v", retry, 21*time.Hour)
+	}
+	if over, _ := tracker.exceeded("b"); over {
+		t.Fatalf("quota of another client exceeded")
+	}
+	clock.Run(retry)
+	if over, _ := tracker.exceeded("a"); over {
+		t.Fatalf("quota still exceeded after the window moved on")
+	}
+	if usage := tracker.usage("a"); usage != 500 {
+		t.Fatalf("usage mismatch: have %d, want 500", usage)
+	}
+	// Clients leaving the window entirely are forgotten
+	clock.Run(24 * time.Hour)
+	tracker.prune()
+	if len(tracker.clients) != 0 {
+		t.Fatalf("idle clients kept: %d", len(tracker.clients))
+	}
+}
@@ -51,6 +51,12 @@ const (
 
 // startBloomHandlers starts a batch of goroutines to accept bloom bit database
 // retrievals from possibly a range of filters and serving the data to satisfy.
+//
+// This is what makes eth_getLogs and the logs subscriptions work on a light node:
+// the filters run the bloombits matcher locally (see LesApiBackend.ServiceFilter),
+// the bit vectors of the sections not indexed locally are retrieved from the
+// servers as BloomRequests, verified against the trusted bloom trie and stored,
+// and the receipts of the matching blocks are fetched and verified on demand.
 func (eth *LightEthereum) startBloomHandlers() {
 
 	// 默认全局开启 16 个 goroutine
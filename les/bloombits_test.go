@@ -0,0 +1,180 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// bloomTrieKey returns the bloom trie key of a bit vector.
+func bloomTrieKey(bit uint, section uint64) []byte {
+	var key [10]byte
+	binary.BigEndian.PutUint16(key[:2], uint16(bit))
+	binary.BigEndian.PutUint64(key[2:], section)
+	return key[:]
+}
+
+// bloomTestVector returns a compressed bit vector stand-in, long enough for the
+// trie nodes not to be embedded into each other.
+func bloomTestVector(bit uint, section uint64) []byte {
+	return append(bytes.Repeat([]byte{0xff}, 40), byte(bit), byte(section))
+}
+
+// Tests that the bloom bits served for the light client log filtering are only
+// accepted with a valid proof against the bloom trie.
+func TestBloomRequestValidate(t *testing.T) {
+	tr, _ := trie.New(common.Hash{}, trie.NewDatabase(ethdb.NewMemDatabase()))
+	for section := uint64(0); section < 4; section++ {
+		for bit := uint(0); bit < 8; bit++ {
+			tr.Update(bloomTrieKey(bit, section), bloomTestVector(bit, section))
+		}
+	}
+	root := tr.Hash()
+
+	// reply builds a helper trie reply proving the given bloom bits vectors
+	reply := func(bit uint, sections ...uint64) *Msg {
+		proofs := light.NewNodeSet()
+		for _, section := range sections {
+			if err := tr.Prove(bloomTrieKey(bit, section), 0, proofs); err != nil {
+				t.Fatalf("failed to prove section %d: %v", section, err)
+			}
+		}
+		return &Msg{MsgType: MsgHelperTrieProofs, Obj: HelperTrieResps{Proofs: proofs.NodeList()}}
+	}
+
+	// A valid reply delivers the vectors in the order of the sections
+	req := &BloomRequest{BloomTrieRoot: root, BitIdx: 3, SectionIdxList: []uint64{2, 0}}
+	if err := req.Validate(nil, reply(3, 2, 0)); err != nil {
+		t.Fatalf("valid bloom bits rejected: %v", err)
+	}
+	if len(req.BloomBits) != 2 || !bytes.Equal(req.BloomBits[0], bloomTestVector(3, 2)) || !bytes.Equal(req.BloomBits[1], bloomTestVector(3, 0)) {
+		t.Errorf("bloom bits mismatch: %x", req.BloomBits)
+	}
+	// Proofs of a different trie, missing proofs and useless nodes are rejected
+	req = &BloomRequest{BloomTrieRoot: common.Hash{1}, BitIdx: 3, SectionIdxList: []uint64{2}}
+	if err := req.Validate(nil, reply(3, 2)); err == nil {
+		t.Errorf("bloom bits of an untrusted trie accepted")
+	}
+	req = &BloomRequest{BloomTrieRoot: root, BitIdx: 3, SectionIdxList: []uint64{1, 2}}
+	if err := req.Validate(nil, reply(3, 1)); err == nil {
+		t.Errorf("bloom bits with missing proof accepted")
+	}
+	req = &BloomRequest{BloomTrieRoot: root, BitIdx: 3, SectionIdxList: []uint64{1}}
+	if err := req.Validate(nil, reply(3, 1, 3)); err != errUselessNodes {
+		t.Errorf("useless proof nodes: have %v, want %v", err, errUselessNodes)
+	}
+}
+
+// Tests that CHT entries and bloom bits requested together are validated against
+// the single merged proof of the different helper tries.
+func TestHelperTrieBatchValidate(t *testing.T) {
+	// Assemble a CHT and a bloom trie
+	cht, _ := trie.New(common.Hash{}, trie.NewDatabase(ethdb.NewMemDatabase()))
+	headers := make([]*types.Header, 4)
+	for i := range headers {
+		headers[i] = &types.Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(131072)}
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		node, _ := rlp.EncodeToBytes(light.ChtNode{Hash: headers[i].Hash(), Td: big.NewInt(int64(i + 1))})
+		cht.Update(key[:], node)
+	}
+	bloom, _ := trie.New(common.Hash{}, trie.NewDatabase(ethdb.NewMemDatabase()))
+	for section := uint64(0); section < 4; section++ {
+		for bit := uint(0); bit < 8; bit++ {
+			bloom.Update(bloomTrieKey(bit, section), bloomTestVector(bit, section))
+		}
+	}
+	// request assembles a batch retrieving headers 1 and 3 and bits 2 and 5 of section 1
+	request := func() *HelperTrieBatchRequest {
+		r := &HelperTrieBatchRequest{}
+		for _, number := range []uint64{1, 3} {
+			r.Chts = append(r.Chts, &light.ChtRequest{ChtRoot: cht.Hash(), BlockNum: number})
+		}
+		for _, bit := range []uint{2, 5} {
+			r.Blooms = append(r.Blooms, &light.BloomRequest{BloomTrieRoot: bloom.Hash(), BitIdx: bit, SectionIdxList: []uint64{1}})
+		}
+		return r
+	}
+	// reply merges the proofs of the requests the way the server does
+	reply := func(r *HelperTrieBatchRequest) *Msg {
+		nodes := light.NewNodeSet()
+		var aux [][]byte
+		for _, req := range r.Chts {
+			var key [8]byte
+			binary.BigEndian.PutUint64(key[:], req.BlockNum)
+			cht.Prove(key[:], 0, nodes)
+			enc, _ := rlp.EncodeToBytes(headers[req.BlockNum])
+			aux = append(aux, enc)
+		}
+		for _, req := range r.Blooms {
+			bloom.Prove(bloomTrieKey(req.BitIdx, req.SectionIdxList[0]), 0, nodes)
+		}
+		return &Msg{MsgType: MsgHelperTrieProofs, Obj: HelperTrieResps{Proofs: nodes.NodeList(), AuxData: aux}}
+	}
+
+	// A valid merged reply fills in all the entries
+	req := request()
+	if err := req.Validate(nil, reply(req)); err != nil {
+		t.Fatalf("valid batch rejected: %v", err)
+	}
+	for i, r := range req.Chts {
+		if r.Header == nil || r.Header.Hash() != headers[r.BlockNum].Hash() {
+			t.Errorf("cht %d: header mismatch", i)
+		}
+		if r.Td == nil || r.Td.Uint64() != r.BlockNum+1 {
+			t.Errorf("cht %d: td mismatch: have %v, want %d", i, r.Td, r.BlockNum+1)
+		}
+	}
+	for i, r := range req.Blooms {
+		if len(r.BloomBits) != 1 || !bytes.Equal(r.BloomBits[0], bloomTestVector(r.BitIdx, 1)) {
+			t.Errorf("bloom %d: bits mismatch: %x", i, r.BloomBits)
+		}
+		if r.Proofs != req.Chts[0].Proof {
+			t.Errorf("bloom %d: proof not shared", i)
+		}
+	}
+	// Missing headers, missing proofs and useless nodes are rejected
+	req = request()
+	msg := reply(req)
+	resp := msg.Obj.(HelperTrieResps)
+	resp.AuxData = resp.AuxData[:1]
+	msg.Obj = resp
+	if err := req.Validate(nil, msg); err != errInvalidEntryCount {
+		t.Errorf("missing header: have %v, want %v", err, errInvalidEntryCount)
+	}
+	req = request()
+	msg = reply(&HelperTrieBatchRequest{Chts: req.Chts, Blooms: req.Blooms[:1]})
+	if err := req.Validate(nil, msg); err == nil {
+		t.Errorf("batch with missing bloom proof accepted")
+	}
+	req = request()
+	msg = reply(req)
+	req.Blooms = req.Blooms[:1]
+	if err := req.Validate(nil, msg); err != errUselessNodes {
+		t.Errorf("useless proof nodes: have %v, want %v", err, errUselessNodes)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+var (
+	breakerOpenMeter   = metrics.NewRegisteredMeter("les/server/breaker/open", nil)
+	breakerCloseMeter  = metrics.NewRegisteredMeter("les/server/breaker/close", nil)
+	breakerRejectMeter = metrics.NewRegisteredMeter("les/server/breaker/rejected", nil)
+	breakerStateGauge  = metrics.NewRegisteredGauge("les/server/breaker/state", nil)
+)
+
+const (
+	// breakerThreshold is the average serving queue wait time above which the
+	// server is considered overloaded. It is well below the soft request timeout
+	// (500ms) of the clients so that they can still be told to go elsewhere in time.
+	breakerThreshold = 250 * time.Millisecond
+
+	// breakerCooldown is the minimum time the breaker stays open, also sent to
+	// the rejected clients as the time after which they may retry.
+	breakerCooldown = time.Second
+
+	// breakerDecay is the weight of a new sample in the average wait time.
+	breakerDecay = 0.1
+)
+
+// lowPriorityRequests are the request types rejected while the server is
+// overloaded. Header and transaction related requests keep being served so that
+// clients can stay in sync.
+var lowPriorityRequests = map[uint64]bool{
+	GetBlockBodiesMsg:      true,
+	GetReceiptsMsg:         true,
+	GetCodeMsg:             true,
+	GetProofsV1Msg:         true,
+	GetProofsV2Msg:         true,
+	GetHeaderProofsMsg:     true,
+	GetHelperTrieProofsMsg: true,
+}
+
+// circuitBreaker watches the time client requests spend in the serving queue
+// and trips when the average wait exceeds the threshold. While tripped, low
+// priority requests are answered with a "retry after" message instead of being
+// queued, which lets the queue drain instead of making every request time out.
+//
+/**
+circuitBreaker:
+	监控 client req 在 servingQueue 中的排队时间, 当平均排队时间超过阈值时 断开 (open),
+	断开期间, 低优先级的 req 直接回复 "retry after" 而不是排队, 使得队列可以尽快恢复
+ */
+type circuitBreaker struct {
+	threshold time.Duration
+	cooldown  time.Duration
+
+	lock      sync.Mutex
+	avgWait   float64        // exponential moving average of the queue wait time
+	open      bool           // whether low priority requests are rejected
+	openUntil mclock.AbsTime // earliest time the breaker may close again
+}
+
+// newCircuitBreaker creates a closed circuit breaker.
+func newCircuitBreaker(threshold, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// observe updates the average wait time with a new sample and opens or closes
+// the breaker accordingly.
+func (b *circuitBreaker) observe(wait time.Duration, now mclock.AbsTime) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.avgWait += (float64(wait) - b.avgWait) * breakerDecay
+	switch {
+	case !b.open && b.avgWait > float64(b.threshold):
+		b.open, b.openUntil = true, now+mclock.AbsTime(b.cooldown)
+		breakerOpenMeter.Mark(1)
+		breakerStateGauge.Update(1)
+
+	case b.open && now >= b.openUntil:
+		// After the cooldown low priority requests are let through again (and
+		// measured), close the breaker if the queue recovered, re-arm it if not
+		if b.avgWait > float64(b.threshold) {
+			b.openUntil = now + mclock.AbsTime(b.cooldown)
+		} else if b.avgWait < float64(b.threshold)/2 {
+			b.open = false
+			breakerCloseMeter.Mark(1)
+			breakerStateGauge.Update(0)
+		}
+	}
+}
+
+// reject returns whether a request of the given type should be turned away, and
+// if so, after how much time the client may retry.
+func (b *circuitBreaker) reject(msgcode uint64, now mclock.AbsTime) (bool, time.Duration) {
+	if !lowPriorityRequests[msgcode] {
+		return false, 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.open || now >= b.openUntil {
+		return false, 0
+	}
+	breakerRejectMeter.Mark(1)
+	return true, time.Duration(b.openUntil - now)
+}
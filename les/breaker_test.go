@@ -0,0 +1,75 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		b   = newCircuitBreaker(100*time.Millisecond, time.Second)
+		now mclock.AbsTime
+	)
+	// Short queue waits keep the breaker closed
+	for i := 0; i < 50; i++ {
+		b.observe(10*time.Millisecond, now)
+	}
+	if busy, _ := b.reject(GetBlockBodiesMsg, now); busy {
+		t.Fatalf("breaker open with short waits")
+	}
+	// Long waits trip it, rejecting low priority requests only
+	for i := 0; i < 50 && !b.open; i++ {
+		b.observe(time.Second, now)
+	}
+	if !b.open {
+		t.Fatalf("breaker closed with long waits")
+	}
+	if busy, retry := b.reject(GetBlockBodiesMsg, now); !busy || retry != time.Second {
+		t.Errorf("low priority request: have busy %v retry %v, want true %v", busy, retry, time.Second)
+	}
+	if busy, _ := b.reject(GetBlockHeadersMsg, now); busy {
+		t.Errorf("header request rejected by open breaker")
+	}
+	now += mclock.AbsTime(400 * time.Millisecond)
+	if _, retry := b.reject(GetProofsV2Msg, now); retry != 600*time.Millisecond {
+		t.Errorf("retry time mismatch: have %v, want %v", retry, 600*time.Millisecond)
+	}
+	// After the cooldown requests are let through, a still congested queue re-arms it
+	now += mclock.AbsTime(600 * time.Millisecond)
+	if busy, _ := b.reject(GetProofsV2Msg, now); busy {
+		t.Errorf("request rejected after cooldown")
+	}
+	b.observe(time.Second, now)
+	if busy, _ := b.reject(GetProofsV2Msg, now); !busy {
+		t.Errorf("breaker not re-armed on congested queue")
+	}
+	// Once the queue recovered the breaker closes
+	for i := 0; i < 100 && b.open; i++ {
+		now += mclock.AbsTime(100 * time.Millisecond)
+		b.observe(0, now)
+	}
+	if b.open {
+		t.Fatalf("breaker stuck open after queue recovered")
+	}
+	if busy, _ := b.reject(GetProofsV2Msg, now); busy {
+		t.Errorf("request rejected by closed breaker")
+	}
+}
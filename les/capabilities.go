@@ -0,0 +1,144 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+)
+
+// neededCapabilities are the requests of the client features which only some of
+// the servers can serve. If none of the connected servers supports one of them,
+// a warning is logged as the feature stops working until such a server connects.
+//
+// neededCapabilities: 只有部分 server (如 LES/2) 支持的 req, 没有任何已连接的 server 支持时打印警告
+var neededCapabilities = []struct {
+	msgcode uint64
+	feature string
+}{
+	{GetHelperTrieProofsMsg, "bloom bits retrieval (log filtering)"},
+	{GetTxStatusMsg, "transaction status queries"},
+	{TxStatusSubscribeMsg, "transaction status subscriptions"},
+}
+
+// supports tells whether the server can be sent a request of the given type: the
+// message exists in the negotiated protocol version, the server announced a cost
+// for it and, for the optional features, both sides enabled it in the handshake.
+// Requests are routed by this probe, so lpv1 and lpv2 servers can be used side
+// by side.
+//
+// supports: 探测 server 是否支持某种 req (协议版本, server 声明的成本表, 握手中协商的特性),
+// client 依此把 req 只发给支持的 server, LES/1 与 LES/2 的 server 可以同时使用
+func (p *peer) supports(msgcode uint64) bool {
+	if msgcode >= ProtocolLengths[uint(p.version)] {
+		return false
+	}
+	p.lock.RLock()
+	costs := p.fcCosts
+	p.lock.RUnlock()
+
+	if costs != nil {
+		for _, code := range reqList {
+			if code == msgcode && costs[msgcode] == nil {
+				return false
+			}
+		}
+	}
+	switch msgcode {
+	case TxStatusSubscribeMsg:
+		return p.txStatusPush
+	}
+	return true
+}
+
+// registered updates the per version peer counts and the capability providers
+// after a peer joined. The lock is held by the caller.
+func (ps *peerSet) registered(p *peer) {
+	ps.versions[p.version]++
+	ps.checkCapabilities()
+}
+
+// unregistered updates the per version peer counts and the capability providers
+// after a peer left. The lock is held by the caller.
+func (ps *peerSet) unregistered(p *peer) {
+	if ps.versions[p.version]--; ps.versions[p.version] <= 0 {
+		delete(ps.versions, p.version)
+	}
+	ps.checkCapabilities()
+}
+
+// checkCapabilities warns about the needed capabilities without any provider
+// among the connected servers, and notes when a provider shows up again. Nothing
+// is reported while no server is connected at all. The lock is held by the caller.
+func (ps *peerSet) checkCapabilities() {
+	servers := 0
+	for _, p := range ps.peers {
+		if p.fcServer != nil {
+			servers++
+		}
+	}
+	if servers == 0 {
+		return
+	}
+	for _, c := range neededCapabilities {
+		providers := 0
+		for _, p := range ps.peers {
+			if p.fcServer != nil && p.supports(c.msgcode) {
+				providers++
+			}
+		}
+		switch {
+		case providers == 0 && !ps.missing[c.msgcode]:
+			log.Warn("No connected light server supports a needed request", "feature", c.feature, "servers", servers)
+			ps.missing[c.msgcode] = true
+		case providers > 0 && ps.missing[c.msgcode]:
+			log.Info("Light server supporting a missing request connected", "feature", c.feature, "providers", providers)
+			delete(ps.missing, c.msgcode)
+		}
+	}
+}
+
+// VersionCounts returns the number of registered peers by protocol version.
+func (ps *peerSet) VersionCounts() map[string]int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	counts := make(map[string]int, len(ps.versions))
+	for version, count := range ps.versions {
+		counts[fmt.Sprintf("les/%d", version)] = count
+	}
+	return counts
+}
+
+// Providers returns the number of registered servers supporting each of the
+// needed capabilities, keyed by the feature they are needed for.
+func (ps *peerSet) Providers() map[string]int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	providers := make(map[string]int, len(neededCapabilities))
+	for _, c := range neededCapabilities {
+		providers[c.feature] = 0
+		for _, p := range ps.peers {
+			if p.fcServer != nil && p.supports(c.msgcode) {
+				providers[c.feature]++
+			}
+		}
+	}
+	return providers
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// newCapabilityTestServer creates a server peer of the given version announcing
+// a cost for all the requests of the version.
+func newCapabilityTestServer(id byte, version int, txStatusPush bool) *peer {
+	var nodeID discover.NodeID
+	nodeID[0] = id
+	p := newPeer(version, NetworkId, p2p.NewPeer(nodeID, "test", nil), nil)
+
+	params := &flowcontrol.ServerParams{BufLimit: 1000, MinRecharge: 1}
+	p.fcServer = flowcontrol.NewServerNode(params, mclock.System{})
+	p.fcServerParams = params
+	p.fcCosts = make(requestCostTable)
+	for _, code := range reqList {
+		if code < ProtocolLengths[uint(version)] {
+			p.fcCosts[code] = &requestCosts{}
+		}
+	}
+	p.txStatusPush = txStatusPush
+	return p
+}
+
+// Tests that requests are only routed to the servers supporting them.
+func TestPeerSupports(t *testing.T) {
+	v1 := newCapabilityTestServer(1, lpv1, false)
+	v2 := newCapabilityTestServer(2, lpv2, true)
+
+	tests := []struct {
+		msgcode uint64
+		v1, v2  bool
+	}{
+		{GetBlockBodiesMsg, true, true},
+		{GetProofsV1Msg, true, true},
+		{GetProofsV2Msg, false, true},
+		{GetHelperTrieProofsMsg, false, true},
+		{GetTxStatusMsg, false, true},
+		{TxStatusSubscribeMsg, false, true},
+		{GetBufferValueMsg, false, true},
+	}
+	for _, tt := range tests {
+		if have := v1.supports(tt.msgcode); have != tt.v1 {
+			t.Errorf("les/1 support of msg %#x: have %v, want %v", tt.msgcode, have, tt.v1)
+		}
+		if have := v2.supports(tt.msgcode); have != tt.v2 {
+			t.Errorf("les/2 support of msg %#x: have %v, want %v", tt.msgcode, have, tt.v2)
+		}
+	}
+	// optional features and requests missing from the cost table are not supported
+	plain := newCapabilityTestServer(3, lpv2, false)
+	delete(plain.fcCosts, GetTxStatusMsg)
+	if plain.supports(TxStatusSubscribeMsg) || plain.supports(GetTxStatusMsg) {
+		t.Errorf("unannounced requests reported as supported")
+	}
+	if (&BloomRequest{}).CanSend(v1) {
+		t.Errorf("bloom bits request routed to les/1 server")
+	}
+}
+
+// Tests the per version peer counts and the capability providers of the peer set.
+func TestPeerSetVersions(t *testing.T) {
+	ps := newPeerSet()
+	v1 := newCapabilityTestServer(1, lpv1, false)
+	ps.Register(v1)
+
+	if counts := ps.VersionCounts(); len(counts) != 1 || counts["les/1"] != 1 {
+		t.Errorf("version counts mismatch: %v", counts)
+	}
+	for _, c := range neededCapabilities {
+		if !ps.missing[c.msgcode] {
+			t.Errorf("capability %q not reported missing", c.feature)
+		}
+	}
+	v2 := newCapabilityTestServer(2, lpv2, true)
+	ps.Register(v2)
+
+	if counts := ps.VersionCounts(); counts["les/1"] != 1 || counts["les/2"] != 1 {
+		t.Errorf("version counts mismatch: %v", counts)
+	}
+	if len(ps.missing) != 0 {
+		t.Errorf("capabilities still reported missing: %v", ps.missing)
+	}
+	for feature, providers := range ps.Providers() {
+		if providers != 1 {
+			t.Errorf("providers of %q mismatch: have %d, want 1", feature, providers)
+		}
+	}
+	ps.Unregister(v2.id)
+	if counts := ps.VersionCounts(); len(counts) != 1 || counts["les/1"] != 1 {
+		t.Errorf("version counts mismatch after disconnect: %v", counts)
+	}
+	if len(ps.missing) != len(neededCapabilities) {
+		t.Errorf("lost capabilities not reported missing: %v", ps.missing)
+	}
+}
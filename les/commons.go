@@ -54,10 +54,11 @@ type NodeInfo struct {
 	CHT        light.TrustedCheckpoint `json:"cht"`        // Trused CHT checkpoint for fast catchup
 }
 
-// makeProtocols creates protocol descriptors for the given LES versions.
+// makeProtocols creates protocol descriptors for the given LES versions. Clients
+// seek outbound connections to servers while servers only accept inbound ones.
 //
 // makeProtocols: 为给定的LES版本创建协议描述符
-func (c *lesCommons) makeProtocols(versions []uint) []p2p.Protocol {
+func (c *lesCommons) makeProtocols(versions []uint, dial p2p.DialPreference) []p2p.Protocol {
 	protos := make([]p2p.Protocol, len(versions))
 	for i, version := range versions {
 		version := version
@@ -66,6 +67,10 @@ func (c *lesCommons) makeProtocols(versions []uint) []p2p.Protocol {
 			Version:  version,
 			Length:   ProtocolLengths[version],
 			NodeInfo: c.nodeInfo,
+			Dial:     dial,
+			Compress: true,
+
+			HandshakeTimeout: handshakeBudget,
 
 			/**
 			todo 启动当前节点
@@ -0,0 +1,245 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// conformanceStep is a single raw message sent to the server under test,
+// optionally followed by the reply the server is expected to send back.
+type conformanceStep struct {
+	code    uint64      // Message code to send
+	data    interface{} // Message payload, encoded as is (may be deliberately malformed)
+	noReply bool        // Whether the server is expected to stay silent
+	reply   uint64      // Expected reply message code
+	reqID   uint64      // Expected request ID of the reply
+	result  interface{} // Expected reply data (nil = not checked)
+}
+
+// conformanceTest is a scenario of raw les messages together with the expected
+// fate of the connection after the last step.
+type conformanceTest struct {
+	name    string
+	prepare func(p *testPeer) // Optional hook run after the handshake has completed
+	steps   []conformanceStep
+	drop    bool    // Whether the server should disconnect after the last step
+	reason  errCode // Expected disconnect reason if drop is set
+}
+
+// headerRequest assembles a raw GetBlockHeaders message payload.
+func headerRequest(reqID uint64, query getBlockHeadersData) interface{} {
+	return &struct {
+		ReqID uint64
+		Query getBlockHeadersData
+	}{reqID, query}
+}
+
+// bodiesRequest assembles a raw GetBlockBodies message payload.
+func bodiesRequest(reqID uint64, hashes []common.Hash) interface{} {
+	return struct {
+		ReqID  uint64
+		Hashes []common.Hash
+	}{reqID, hashes}
+}
+
+// Tests the server's reaction to valid and deliberately malformed message sequences.
+func TestConformanceLes1(t *testing.T) { testConformance(t, lpv1) }
+func TestConformanceLes2(t *testing.T) { testConformance(t, lpv2) }
+
+func testConformance(t *testing.T, protocol int) {
+	// The served cost table changes with the measured serving times and would break
+	// the handshake of later scenarios, run each against a fresh server
+	newServer := func() *ProtocolManager {
+		return newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, ethdb.NewMemDatabase())
+	}
+	genesis := []*types.Header{newServer().blockchain.(*core.BlockChain).GetHeaderByNumber(0)}
+
+	tests := []conformanceTest{
+		{
+			name: "reqID is echoed verbatim",
+			steps: []conformanceStep{
+				{code: GetBlockHeadersMsg, data: headerRequest(math.MaxUint64, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg, reqID: math.MaxUint64, result: genesis},
+			},
+		}, {
+			name: "duplicate reqIDs are served independently",
+			steps: []conformanceStep{
+				{code: GetBlockHeadersMsg, data: headerRequest(7, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg, reqID: 7, result: genesis},
+				{code: GetBlockHeadersMsg, data: headerRequest(7, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg, reqID: 7, result: genesis},
+			},
+		}, {
+			name: "oversized header request",
+			steps: []conformanceStep{
+				{code: GetBlockHeadersMsg, data: headerRequest(1, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: MaxHeaderFetch + 1}), noReply: true},
+			},
+			drop: true, reason: ErrRequestRejected,
+		}, {
+			name: "oversized body request",
+			steps: []conformanceStep{
+				{code: GetBlockBodiesMsg, data: bodiesRequest(1, make([]common.Hash, MaxBodyFetch+1)), noReply: true},
+			},
+			drop: true, reason: ErrRequestRejected,
+		}, {
+			name: "status message after handshake",
+			steps: []conformanceStep{
+				{code: StatusMsg, data: keyValueList{}, noReply: true},
+			},
+			drop: true, reason: ErrExtraStatusMsg,
+		}, {
+			name: "unsolicited response with unknown reqID",
+			steps: []conformanceStep{
+				{code: BlockHeadersMsg, data: struct {
+					ReqID, BV uint64
+					Headers   []*types.Header
+				}{12345, 0, nil}, noReply: true},
+			},
+			drop: true, reason: ErrUnexpectedResponse,
+		}, {
+			name: "undecodable request",
+			steps: []conformanceStep{
+				{code: GetBlockHeadersMsg, data: "garbage", noReply: true},
+			},
+			drop: true, reason: ErrDecode,
+		}, {
+			name: "unknown message code",
+			steps: []conformanceStep{
+				{code: 0x7f, data: []uint{}, noReply: true},
+			},
+			drop: true, reason: ErrInvalidMsgCode,
+		}, {
+			name: "buffer limit warning",
+			prepare: func(p *testPeer) {
+				// make a single header request drain the entire buffer, tolerating one underrun
+				p.fcCosts = requestCostTable{GetBlockHeadersMsg: &requestCosts{baseCost: testBufLimit}}
+				p.pm.server.fcManager.SetUnderrunPolicy(flowcontrol.UnderrunPolicy{Warnings: 1})
+			},
+			steps: []conformanceStep{
+				{code: GetBlockHeadersMsg, data: headerRequest(1, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg, reqID: 1, result: genesis},
+				{code: GetBlockHeadersMsg, data: headerRequest(2, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg, reqID: 2, result: genesis},
+			},
+		}, {
+			name: "buffer limit violation",
+			prepare: func(p *testPeer) {
+				// make a single header request drain the entire buffer, without tolerating underruns
+				p.fcCosts = requestCostTable{GetBlockHeadersMsg: &requestCosts{baseCost: testBufLimit}}
+				p.pm.server.fcManager.SetUnderrunPolicy(flowcontrol.UnderrunPolicy{})
+			},
+			steps: []conformanceStep{
+				{code: GetBlockHeadersMsg, data: headerRequest(1, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg, reqID: 1, result: genesis},
+				{code: GetBlockHeadersMsg, data: headerRequest(2, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), noReply: true},
+			},
+			drop: true, reason: ErrRequestRejected,
+		},
+	}
+	for _, tt := range tests {
+		if err := runConformanceTest(t, newServer(), protocol, tt); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// runConformanceTest connects a fresh raw peer to the server, executes the steps
+// of the scenario and verifies the state of the connection afterwards.
+func runConformanceTest(t *testing.T, pm *ProtocolManager, protocol int, tt conformanceTest) error {
+	peer, errc := newTestPeer(t, "peer", protocol, pm, true)
+	defer peer.close()
+
+	// The server finishes its side of the handshake asynchronously, wait for a
+	// reply to a harmless request before touching any peer state
+	if err := runConformanceStep(peer, conformanceStep{
+		code: GetBlockHeadersMsg, data: headerRequest(0, getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1}), reply: BlockHeadersMsg,
+	}); err != nil {
+		return fmt.Errorf("sync request: %v", err)
+	}
+	if tt.prepare != nil {
+		tt.prepare(peer)
+	}
+	for i, step := range tt.steps {
+		if err := runConformanceStep(peer, step); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+	if !tt.drop {
+		select {
+		case err := <-errc:
+			return fmt.Errorf("unexpected disconnect: %v", err)
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+	select {
+	case err := <-errc:
+		if err == nil || !strings.HasPrefix(err.Error(), tt.reason.String()) {
+			return fmt.Errorf("disconnect reason mismatch: have %v, want %v", err, tt.reason)
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("peer not dropped, want %v", tt.reason)
+	}
+	return nil
+}
+
+// runConformanceStep sends the raw message of a step and checks the reply.
+func runConformanceStep(peer *testPeer, step conformanceStep) error {
+	if err := p2p.Send(peer.app, step.code, step.data); err != nil {
+		return fmt.Errorf("send failed: %v", err)
+	}
+	if step.noReply {
+		return nil
+	}
+	msg, err := peer.app.ReadMsg()
+	if err != nil {
+		return fmt.Errorf("no reply: %v", err)
+	}
+	defer msg.Discard()
+
+	if msg.Code != step.reply {
+		return fmt.Errorf("reply code mismatch: have %d, want %d", msg.Code, step.reply)
+	}
+	var resp struct {
+		ReqID, BV uint64
+		Data      rlp.RawValue
+	}
+	if err := msg.Decode(&resp); err != nil {
+		return fmt.Errorf("invalid reply: %v", err)
+	}
+	if resp.ReqID != step.reqID {
+		return fmt.Errorf("reqID mismatch: have %d, want %d", resp.ReqID, step.reqID)
+	}
+	if step.result != nil {
+		want, err := rlp.EncodeToBytes(step.result)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(resp.Data, want) {
+			return fmt.Errorf("reply data mismatch: have %x, want %x", resp.Data, want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// costEstimateAlpha is the weight of a new response time in the moving
+	// averages of the cost estimates.
+	costEstimateAlpha = 0.1
+
+	// costEstimateMinSamples is the number of replies of a request type needed
+	// from a server before its costs are adjusted.
+	costEstimateMinSamples = 5
+
+	// maxCostFactor caps the factor the announced request costs of a slow
+	// server are multiplied with.
+	maxCostFactor = 4.0
+)
+
+// movingAverage is an exponential moving average of response times.
+type movingAverage struct {
+	value   float64
+	samples uint64
+}
+
+// add updates the average with a new response time.
+func (a *movingAverage) add(rtt time.Duration) {
+	if a.samples == 0 {
+		a.value = float64(rtt)
+	} else {
+		a.value += costEstimateAlpha * (float64(rtt) - a.value)
+	}
+	a.samples++
+}
+
+// costReference keeps the average response times of all the connected servers
+// by request type, the base the response times of a single server are compared
+// against.
+//
+// costReference: 所有 server 的平均响应时间 (按 req 类型), 单个 server 的响应时间与之比较
+type costReference struct {
+	lock sync.RWMutex
+	avg  map[uint64]*movingAverage
+}
+
+// newCostReference creates an empty cost reference.
+func newCostReference() *costReference {
+	return &costReference{avg: make(map[uint64]*movingAverage)}
+}
+
+// add records the response time of a request served by any of the servers.
+func (r *costReference) add(msgcode uint64, rtt time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	avg := r.avg[msgcode]
+	if avg == nil {
+		avg = new(movingAverage)
+		r.avg[msgcode] = avg
+	}
+	avg.add(rtt)
+}
+
+// average returns the average response time of the given request type over all
+// the servers, zero if no reply has been received yet.
+func (r *costReference) average(msgcode uint64) float64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if avg := r.avg[msgcode]; avg != nil {
+		return avg.value
+	}
+	return 0
+}
+
+// costEstimator learns how much slower a server responds than the average of
+// all the servers, and scales the costs announced by the server accordingly.
+// The adjusted costs make the distributor wait longer before sending requests
+// to an overloaded server and prefer the faster ones meanwhile.
+//
+// costEstimator: 根据 server 实际的响应时间调整其声明的 req 成本 (只会调高),
+// 使分发器自动绕开过载的 server
+type costEstimator struct {
+	ref *costReference
+
+	lock sync.RWMutex
+	avg  map[uint64]*movingAverage // response times of the server by request type
+}
+
+// newCostEstimator creates a cost estimator of a server comparing it to the
+// given reference.
+func newCostEstimator(ref *costReference) *costEstimator {
+	return &costEstimator{
+		ref: ref,
+		avg: make(map[uint64]*movingAverage),
+	}
+}
+
+// add records the response time of a request of the given number of items served
+// by the server. The time is normalised to a single item, so large requests don't
+// distort the estimates.
+func (e *costEstimator) add(msgcode uint64, amount int, rtt time.Duration) {
+	if amount > 1 {
+		rtt /= time.Duration(amount)
+	}
+	e.lock.Lock()
+	avg := e.avg[msgcode]
+	if avg == nil {
+		avg = new(movingAverage)
+		e.avg[msgcode] = avg
+	}
+	avg.add(rtt)
+	e.lock.Unlock()
+
+	e.ref.add(msgcode, rtt)
+}
+
+// factor returns the factor the announced cost of the given request type is
+// multiplied with. It is never less than one, requests are never considered
+// cheaper than the server announced, and capped at maxCostFactor.
+func (e *costEstimator) factor(msgcode uint64) float64 {
+	e.lock.RLock()
+	avg := e.avg[msgcode]
+	if avg == nil || avg.samples < costEstimateMinSamples {
+		e.lock.RUnlock()
+		return 1
+	}
+	value := avg.value
+	e.lock.RUnlock()
+
+	ref := e.ref.average(msgcode)
+	if ref <= 0 || value <= ref {
+		return 1
+	}
+	if f := value / ref; f < maxCostFactor {
+		return f
+	}
+	return maxCostFactor
+}
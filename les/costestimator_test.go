@@ -0,0 +1,83 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCostEstimator(t *testing.T) {
+	var (
+		ref  = newCostReference()
+		fast = newCostEstimator(ref)
+		slow = newCostEstimator(ref)
+	)
+	// No adjustment until enough replies have been measured
+	for i := 0; i < costEstimateMinSamples-1; i++ {
+		fast.add(GetReceiptsMsg, 1, 10*time.Millisecond)
+		slow.add(GetReceiptsMsg, 1, 50*time.Millisecond)
+	}
+	if f := slow.factor(GetReceiptsMsg); f != 1 {
+		t.Fatalf("cost adjusted before enough samples: factor %v", f)
+	}
+	for i := 0; i < 20; i++ {
+		fast.add(GetReceiptsMsg, 1, 10*time.Millisecond)
+		slow.add(GetReceiptsMsg, 1, 50*time.Millisecond)
+	}
+	// The fast server is never made cheaper, the slow one gets more expensive
+	if f := fast.factor(GetReceiptsMsg); f != 1 {
+		t.Errorf("fast server factor mismatch: have %v, want 1", f)
+	}
+	if f := slow.factor(GetReceiptsMsg); f <= 1 || f > maxCostFactor {
+		t.Errorf("slow server factor out of range: %v", f)
+	}
+	// Other request types are not affected
+	if f := slow.factor(GetBlockHeadersMsg); f != 1 {
+		t.Errorf("unrelated request type adjusted: factor %v", f)
+	}
+	// Very slow servers are capped
+	others := []*costEstimator{fast}
+	for i := 0; i < 7; i++ {
+		others = append(others, newCostEstimator(ref))
+	}
+	for i := 0; i < 100; i++ {
+		for _, e := range others {
+			e.add(GetReceiptsMsg, 1, 10*time.Millisecond)
+		}
+		slow.add(GetReceiptsMsg, 1, time.Second)
+	}
+	if f := slow.factor(GetReceiptsMsg); f != maxCostFactor {
+		t.Errorf("cost factor not capped: have %v, want %v", f, maxCostFactor)
+	}
+}
+
+func TestCostEstimatorAmount(t *testing.T) {
+	var (
+		ref   = newCostReference()
+		small = newCostEstimator(ref)
+		large = newCostEstimator(ref)
+	)
+	// Serving 100 items takes longer than serving one, the per item times match
+	for i := 0; i < 20; i++ {
+		small.add(GetReceiptsMsg, 1, 10*time.Millisecond)
+		large.add(GetReceiptsMsg, 100, time.Second)
+	}
+	if f := large.factor(GetReceiptsMsg); f != 1 {
+		t.Errorf("large request server factor mismatch: have %v, want 1", f)
+	}
+}
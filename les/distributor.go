@@ -20,6 +20,7 @@ package les
 
 import (
 	"container/list"
+	"context"
 	"sync"
 	"time"
 )
@@ -50,13 +51,36 @@ type requestDistributor struct {
 	// 默认初始化为 false
 	loopNextSent     bool
 	lock             sync.Mutex
+
+	// 等待 peer 的流控 buffer 充值的 goroutine 的取消函数, loop 再次运行时取消
+	cancelWait context.CancelFunc // stops waiting for the peers to recharge, nil if not waiting
+
+	// 各 peer 的分发统计 (排队/等待/丢弃), 用于排查 light client 卡住的原因
+	stats     map[distPeer]*distPeerStats
+	statsLock sync.Mutex
+}
+
+// DistributorPeerStats is the request distribution history of a server.
+type DistributorPeerStats struct {
+	Queued      uint64        `json:"queued"`      // Requests put in the send queue of the server
+	AverageWait time.Duration `json:"averageWait"` // Average waiting time required by flow control before a request
+	Dropped     uint64        `json:"dropped"`     // Requests dropped while the send queue of the server was full
+}
+
+// distPeerStats accumulates the distribution history of a peer.
+type distPeerStats struct {
+	queued, dropped uint64
+	waits           uint64
+	sumWait         time.Duration
 }
 
 // distPeer is an LES server peer interface for the request distributor.
 // waitBefore returns either the necessary waiting time before sending a request
 // with the given upper estimated cost or the estimated remaining relative buffer
 // value after sending such a request (in which case the request can be sent
-// immediately). At least one of these values is always zero.
+// immediately). At least one of these values is always zero. waitSend blocks
+// until a request with the given upper estimated cost can be sent or the context
+// is cancelled.
 //
 //
 /**
@@ -64,10 +88,12 @@ distPeer是请求分发器的 LES服务器peer 接口。
 waitBefore 在发送具有给定的较高估计成本的请求之前返回必需的等待时间，
 或者在发送此类请求之后返回估计的剩余相对缓冲区估计值
 （在这种情况下，可以立即发送请求）。 这些值中的至少一个始终为零。
+waitSend 阻塞直到可以发送给定成本的请求, 或者 ctx 被取消。
 
  */
 type distPeer interface {
 	waitBefore(uint64) (time.Duration, float64)
+	waitSend(context.Context, uint64) error
 	canQueue() bool
 	queueSend(f func())
 }
@@ -110,6 +136,9 @@ type distReq struct {
 	// req 在分发器队列中的索引 !?
 	reqOrder uint64
 
+	// 每个 peer 首次检查该 req 时 流控要求的等待时间, 发送时 只采样一次
+	waits map[distPeer]time.Duration // flow control waits of the first checks against the peers
+
 	// 用于接收 `getCost`, `canSend`, `request` 三个回调的入参 peer
 	sentChn  chan distPeer
 	// 这个是分发器的的真实req引用
@@ -131,6 +160,7 @@ func newRequestDistributor(peers *peerSet, stopChn chan struct{}) *requestDistri
 		stopChn:  stopChn,
 		// 缓存对端peer实例的 map
 		peers:    make(map[distPeer]struct{}),
+		stats:    make(map[distPeer]*distPeerStats),
 	}
 	if peers != nil {
 		// 逐个注册 peers中的 peer 到 请求分发器中
@@ -148,6 +178,14 @@ func (d *requestDistributor) registerPeer(p *peer) {
 	d.peerLock.Lock()
 	d.peers[p] = struct{}{}
 	d.peerLock.Unlock()
+
+	d.statsLock.Lock()
+	d.stats[p] = &distPeerStats{}
+	d.statsLock.Unlock()
+
+	d.lock.Lock()
+	d.wakeLoop()
+	d.lock.Unlock()
 }
 
 // unregisterPeer implements peerSetNotify
@@ -156,6 +194,14 @@ func (d *requestDistributor) unregisterPeer(p *peer) {
 	d.peerLock.Lock()
 	delete(d.peers, p)
 	d.peerLock.Unlock()
+
+	d.statsLock.Lock()
+	delete(d.stats, p)
+	d.statsLock.Unlock()
+
+	d.lock.Lock()
+	d.wakeLoop()
+	d.lock.Unlock()
 }
 
 // registerTestPeer adds a new test peer
@@ -163,11 +209,59 @@ func (d *requestDistributor) registerTestPeer(p distPeer) {
 	d.peerLock.Lock()
 	d.peers[p] = struct{}{}
 	d.peerLock.Unlock()
+
+	d.statsLock.Lock()
+	d.stats[p] = &distPeerStats{}
+	d.statsLock.Unlock()
+
+	d.lock.Lock()
+	d.wakeLoop()
+	d.lock.Unlock()
 }
 
-// distMaxWait is the maximum waiting time after which further necessary waiting
-// times are recalculated based on new feedback from the servers
-const distMaxWait = time.Millisecond * 10
+// wakeLoop signals the event loop to check the queue, unless a signal is already
+// pending. The caller must hold d.lock.
+//
+// 唤醒 loop 重新检查队列 (若已有未处理的信号则不再发送), 调用方需持有 d.lock
+func (d *requestDistributor) wakeLoop() {
+	if !d.loopNextSent {
+		d.loopNextSent = true
+		d.loopChn <- struct{}{}
+	}
+}
+
+// waitPeers waits in the background until a request can be sent to any of the
+// given peers, which need a flow control wait for the request costs given. The
+// loop is signalled then, unless it has cancelled the wait by running earlier.
+//
+// waitPeers: 后台等待 任一 peer 的流控 buffer 充值足够 (或者 reply 更新了估计值) 后唤醒 loop,
+// loop 每次运行都会取消之前的等待, 新的 req 入队 或 peer 变化 时 loop 照常被唤醒
+func (d *requestDistributor) waitPeers(waiting map[distPeer]uint64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancelWait = cancel
+
+	for peer, cost := range waiting {
+		go func(peer distPeer, cost uint64) {
+			if peer.waitSend(ctx, cost) != nil {
+				return
+			}
+			d.lock.Lock()
+			if ctx.Err() == nil {
+				d.wakeLoop()
+			}
+			d.lock.Unlock()
+		}(peer, cost)
+	}
+}
+
+// stopWaiting cancels the pending wait for the peers, if any. The caller must hold
+// d.lock.
+func (d *requestDistributor) stopWaiting() {
+	if d.cancelWait != nil {
+		d.cancelWait()
+		d.cancelWait = nil
+	}
+}
 
 // main event loop
 /**
@@ -180,6 +274,7 @@ func (d *requestDistributor) loop() {
 		// 是否接收到 退出信号
 		case <-d.stopChn:
 			d.lock.Lock()
+			d.stopWaiting()
 
 			// 返回 队列中记录的 next 元素
 			elem := d.reqQueue.Front()
@@ -200,12 +295,13 @@ func (d *requestDistributor) loop() {
 			// 		(所以,第一次接收到 loop 信号来自 req 入队!?) 因为在 new 分发器的时候 `d.loopNextSent = false` 允许接收第一次req 入队的loop信号
 			// 		看 queue() 函数即可~
 			d.loopNextSent = false
+			d.stopWaiting()
 		loop:
 			// 一直清空队列中的请求req
 			for {
 
-				peer, req, wait := d.nextRequest()
-				if req != nil && wait == 0 {
+				peer, req, waiting := d.nextRequest()
+				if req != nil && len(waiting) == 0 {
 					chn := req.sentChn // save sentChn because remove sets it to nil   保存sendChn，因为remove将其设置为nil
 					d.remove(req)
 
@@ -217,29 +313,28 @@ func (d *requestDistributor) loop() {
 					send := req.request(peer)
 					if send != nil {
 						peer.queueSend(send)
+						wait := req.waits[peer]
+						d.updateStats(peer, func(s *distPeerStats) {
+							s.queued++
+							s.waits++
+							s.sumWait += wait
+						})
 					}
 					chn <- peer
 					close(chn)
 				} else {
-					if wait == 0 {
+					if len(waiting) == 0 {
 						// no request to send and nothing to wait for; the next
 						// queued request will wake up the loop
 						//
 						// 当 没有req去send 且没有任何需要wait的,这时候 next req将继续loop
 						break loop
 					}
-					// a "next" signal has been sent, do not send another one until this one has been received
-					// 已发送“下一”信号，在收到该信号之前，请勿发送另一信号
-					d.loopNextSent = true
-					if wait > distMaxWait {
-						// waiting times may be reduced by incoming request replies, if it is too long, recalculate it periodically
-						// 入站请求回复可能会减少等待时间，如果时间太长，请定期重新计算
-						wait = distMaxWait
-					}
-					go func() {
-						time.Sleep(wait)
-						d.loopChn <- struct{}{}
-					}()
+					// wait for the flow control buffers to recharge, replies
+					// readjusting them wake the waiters up early
+					//
+					// 等待流控 buffer 充值, 入站的 reply 调整估计值时会提前唤醒
+					d.waitPeers(waiting)
 					break loop
 				}
 			}
@@ -264,20 +359,20 @@ func (sp selectPeerItem) Weight() int64 {
 }
 
 // nextRequest returns the next possible request from any peer, along with the
-// associated peer and necessary waiting time
+// associated peer. If no request can be sent right now, the peers requiring a
+// flow control wait are returned with the costs of their next requests.
 //
-// nextRequest从任何peer返回下一个可能的请求，以及关联的peer和必要的等待时间
-func (d *requestDistributor) nextRequest() (distPeer, *distReq, time.Duration) {
+// nextRequest从任何peer返回下一个可能的请求，以及关联的peer;
+// 如果当前没有可以发送的请求, 则返回需要等待流控的 peer 及其下一个请求的成本
+func (d *requestDistributor) nextRequest() (distPeer, *distReq, map[distPeer]uint64) {
 
 	// 初始化一个 有待 请求分发器检查的 les服务 peer的map
 	checkedPeers := make(map[distPeer]struct{})
 	// 从分发器的 peers缓存队列中取出next元素
 	elem := d.reqQueue.Front()
 	var (
-		bestPeer distPeer
-		bestReq  *distReq
-		bestWait time.Duration
-		sel      *weightedRandomSelect
+		waiting map[distPeer]uint64
+		sel     *weightedRandomSelect
 	)
 
 	d.peerLock.RLock()
@@ -290,17 +385,34 @@ func (d *requestDistributor) nextRequest() (distPeer, *distReq, time.Duration) {
 
 		// 是否可以发送请求了(即： 可以有资源处理请求了)
 		canSend := false
+		// 因 send queue 已满而跳过的 peer
+		var blocked []distPeer
 
 		// TODO 遍历所有peer
 		for peer := range d.peers {
 			// 去重 且 告知服务器peer是否适合处理请求
-			if _, ok := checkedPeers[peer]; !ok && peer.canQueue() && req.canSend(peer) {
+			if _, ok := checkedPeers[peer]; ok {
+				continue
+			}
+			if !peer.canQueue() {
+				if req.canSend(peer) {
+					blocked = append(blocked, peer)
+				}
+				continue
+			}
+			if req.canSend(peer) {
 				canSend = true
 				// 返回将请求发送到给定peer的开销的上限
 				cost := req.getCost(peer)
 
 				// 返回以给定的最大估计成本发送请求之前所需的最短等待时间
 				wait, bufRemain := peer.waitBefore(cost)
+				if _, ok := req.waits[peer]; !ok {
+					if req.waits == nil {
+						req.waits = make(map[distPeer]time.Duration)
+					}
+					req.waits[peer] = wait
+				}
 				if wait == 0 {
 					if sel == nil {
 						//  初始化一个 weightedRandomSelect
@@ -313,11 +425,10 @@ func (d *requestDistributor) nextRequest() (distPeer, *distReq, time.Duration) {
 					// 更新 selectItem 的权重
 					sel.update(selectPeerItem{peer: peer, req: req, weight: int64(bufRemain*1000000) + 1})
 				} else {
-					if bestReq == nil || wait < bestWait {
-						bestPeer = peer
-						bestReq = req
-						bestWait = wait
+					if waiting == nil {
+						waiting = make(map[distPeer]uint64)
 					}
+					waiting[peer] = cost
 				}
 				checkedPeers[peer] = struct{}{}
 			}
@@ -326,6 +437,9 @@ func (d *requestDistributor) nextRequest() (distPeer, *distReq, time.Duration) {
 		if !canSend && elem == d.reqQueue.Front() {
 			close(req.sentChn)
 			d.remove(req)
+			for _, peer := range blocked {
+				d.updateStats(peer, func(s *distPeerStats) { s.dropped++ })
+			}
 		}
 		elem = next
 	}
@@ -333,9 +447,40 @@ func (d *requestDistributor) nextRequest() (distPeer, *distReq, time.Duration) {
 	if sel != nil {
 		// TODO 随机返回一个 item
 		c := sel.choose().(selectPeerItem)
-		return c.peer, c.req, 0
+		return c.peer, c.req, nil
+	}
+	return nil, nil, waiting
+}
+
+// updateStats modifies the distribution history of a registered peer.
+func (d *requestDistributor) updateStats(p distPeer, update func(*distPeerStats)) {
+	d.statsLock.Lock()
+	defer d.statsLock.Unlock()
+
+	if s := d.stats[p]; s != nil {
+		update(s)
+	}
+}
+
+// status returns the distribution history of the registered peers and the
+// number of requests waiting in the queue.
+func (d *requestDistributor) status() (map[distPeer]DistributorPeerStats, int) {
+	d.lock.Lock()
+	pending := d.reqQueue.Len()
+	d.lock.Unlock()
+
+	d.statsLock.Lock()
+	defer d.statsLock.Unlock()
+
+	stats := make(map[distPeer]DistributorPeerStats, len(d.stats))
+	for p, s := range d.stats {
+		ps := DistributorPeerStats{Queued: s.queued, Dropped: s.dropped}
+		if s.waits > 0 {
+			ps.AverageWait = s.sumWait / time.Duration(s.waits)
+		}
+		stats[p] = ps
 	}
-	return bestPeer, bestReq, bestWait
+	return stats, pending
 }
 
 // queue adds a request to the distribution queue, returns a channel where the
@@ -373,12 +518,8 @@ func (d *requestDistributor) queue(r *distReq) chan distPeer {
 		r.element = d.reqQueue.InsertBefore(r, before)
 	}
 
-	if !d.loopNextSent {
-		d.loopNextSent = true
-
-		// todo req 入队的时候,就发起 loop 信号了
-		d.loopChn <- struct{}{}
-	}
+	// todo req 入队的时候,就发起 loop 信号了
+	d.wakeLoop()
 
 	r.sentChn = make(chan distPeer, 1)
 	return r.sentChn
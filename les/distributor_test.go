@@ -19,6 +19,7 @@
 package les
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"testing"
@@ -101,6 +102,20 @@ func (p *testDistPeer) waitBefore(cost uint64) (time.Duration, float64) {
 	return time.Duration(sumCost - testDistBufLimit), 0
 }
 
+func (p *testDistPeer) waitSend(ctx context.Context, cost uint64) error {
+	for {
+		wait, _ := p.waitBefore(cost)
+		if wait == 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (p *testDistPeer) canQueue() bool {
 	return true
 }
@@ -183,3 +198,187 @@ func testRequestDistributor(t *testing.T, resend bool) {
 
 	wg.Wait()
 }
+
+// fullDistPeer is a test peer with a permanently full send queue.
+type fullDistPeer struct {
+	testDistPeer
+}
+
+func (p *fullDistPeer) canQueue() bool {
+	return false
+}
+
+// waitingDistPeer asks for a flow control wait before its first requests.
+type waitingDistPeer struct {
+	testDistPeer
+	waits int
+}
+
+func (p *waitingDistPeer) waitBefore(uint64) (time.Duration, float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.waits > 0 {
+		p.waits--
+		return 5 * time.Millisecond, 0
+	}
+	return 0, 1
+}
+
+// Tests that the flow control wait is sampled once per request, not on every
+// scan of the queue while the request waits.
+func TestDistributorAverageWait(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	dist := newRequestDistributor(nil, stop)
+	peer := &waitingDistPeer{waits: 3}
+	dist.registerTestPeer(peer)
+
+	for i := 0; i < 2; i++ {
+		req := &distReq{
+			getCost: func(distPeer) uint64 { return 0 },
+			canSend: func(distPeer) bool { return true },
+			request: func(distPeer) func() { return func() {} },
+		}
+		select {
+		case <-dist.queue(req):
+		case <-time.After(time.Second):
+			t.Fatalf("request %d not processed", i)
+		}
+	}
+	// The first request waited, the second one didn't
+	stats, _ := dist.status()
+	if s := stats[peer]; s.Queued != 2 || s.AverageWait != 5*time.Millisecond/2 {
+		t.Errorf("peer stats mismatch: have %+v, want 2 queued, 2.5ms average wait", s)
+	}
+}
+
+func TestRequestDistributorStatus(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	dist := newRequestDistributor(nil, stop)
+	ready, full := &testDistPeer{}, &fullDistPeer{}
+	dist.registerTestPeer(ready)
+	dist.registerTestPeer(full)
+
+	send := func(peers ...distPeer) distPeer {
+		req := &distReq{
+			getCost: func(distPeer) uint64 { return 0 },
+			canSend: func(dp distPeer) bool {
+				for _, p := range peers {
+					if p == dp {
+						return true
+					}
+				}
+				return false
+			},
+			request: func(distPeer) func() { return func() {} },
+		}
+		select {
+		case p := <-dist.queue(req):
+			return p
+		case <-time.After(time.Second):
+			t.Fatalf("request not processed")
+			return nil
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if p := send(ready); p != ready {
+			t.Fatalf("request %d sent to %v, want the ready peer", i, p)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if p := send(full); p != nil {
+			t.Fatalf("request %d sent to %v, want drop", i, p)
+		}
+	}
+	stats, pending := dist.status()
+	if pending != 0 {
+		t.Errorf("pending requests mismatch: have %d, want 0", pending)
+	}
+	if s := stats[ready]; s.Queued != 3 || s.Dropped != 0 {
+		t.Errorf("ready peer stats mismatch: have %+v, want 3 queued", s)
+	}
+	if s := stats[full]; s.Queued != 0 || s.Dropped != 2 {
+		t.Errorf("full peer stats mismatch: have %+v, want 2 dropped", s)
+	}
+}
+
+// rechargingDistPeer is a test peer requiring a flow control wait until it is
+// recharged.
+type rechargingDistPeer struct {
+	testDistPeer
+	checks    int
+	recharged chan struct{}
+}
+
+func (p *rechargingDistPeer) waitBefore(uint64) (time.Duration, float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.checks++
+	select {
+	case <-p.recharged:
+		return 0, 1
+	default:
+		return time.Hour, 0
+	}
+}
+
+func (p *rechargingDistPeer) waitSend(ctx context.Context, cost uint64) error {
+	select {
+	case <-p.recharged:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Tests that the distributor waits for a peer to recharge instead of polling it,
+// and still sends the requests to the other peers meanwhile.
+func TestDistributorWaitRecharge(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	dist := newRequestDistributor(nil, stop)
+	waiting := &rechargingDistPeer{recharged: make(chan struct{})}
+	ready := &testDistPeer{}
+	dist.registerTestPeer(waiting)
+	dist.registerTestPeer(ready)
+
+	queue := func(peer distPeer) chan distPeer {
+		return dist.queue(&distReq{
+			getCost: func(distPeer) uint64 { return 0 },
+			canSend: func(dp distPeer) bool { return dp == peer },
+			request: func(distPeer) func() { return func() {} },
+		})
+	}
+	sent := queue(waiting)
+	time.Sleep(100 * time.Millisecond)
+
+	waiting.lock.Lock()
+	checks := waiting.checks
+	waiting.lock.Unlock()
+	if checks > 1 {
+		t.Errorf("waiting peer polled %d times", checks)
+	}
+	select {
+	case p := <-queue(ready):
+		if p != ready {
+			t.Fatalf("request sent to %v, want the ready peer", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request to the ready peer held back by the waiting one")
+	}
+	close(waiting.recharged)
+	select {
+	case p := <-sent:
+		if p != waiting {
+			t.Fatalf("request sent to %v, want the recharged peer", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not sent after the recharge")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+)
+
+const (
+	defaultDivergenceBlocks = 16          // Head spread of the servers tolerated by default
+	defaultDivergenceTime   = time.Minute // Time the spread has to last by default to be reported
+
+	divergenceCheckInterval = 5 * time.Second // Time between the comparisons of the server heads
+)
+
+// HeadDivergenceEvent is posted when the connected servers start or stop
+// disagreeing about the head of the chain.
+type HeadDivergenceEvent struct {
+	Diverged bool
+	Spread   uint64            // Difference of the highest and lowest announced head numbers
+	Heads    map[string]uint64 // Head numbers of the servers by peer ID
+}
+
+// HeadDivergence is the head divergence state of the connected servers.
+type HeadDivergence struct {
+	Diverged bool              `json:"diverged"`
+	Since    time.Duration     `json:"since,omitempty"` // Time the spread has been over the limit
+	Spread   uint64            `json:"spread"`
+	Limit    uint64            `json:"limit"`
+	Heads    map[string]uint64 `json:"heads"`
+}
+
+// divergenceMonitor compares the heads announced by the connected servers,
+// reporting them diverged when the highest and the lowest head are more than
+// blocks apart for longer than timeout. A light client connected to servers
+// which keep disagreeing is either being eclipsed by some of them, feeding it a
+// private chain, or is connected to stale servers.
+//
+/**
+divergenceMonitor: 比较 所有已连接 server 广播的 head,
+当 最高 与 最低 head 相差超过 blocks 个块 并持续 timeout 时, 发出 HeadDivergenceEvent 并在 RPC 中标记,
+帮助 light client 发现 eclipse 攻击 或 落后的 server
+ */
+type divergenceMonitor struct {
+	peers   *peerSet
+	blocks  uint64
+	timeout time.Duration
+	clock   mclock.Clock
+	feed    event.Feed
+
+	lock     sync.Mutex
+	over     bool           // whether the spread is currently over the limit
+	overFrom mclock.AbsTime // time the spread went over the limit
+	diverged bool           // whether the divergence has been reported
+	spread   uint64
+	heads    map[string]uint64
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newDivergenceMonitor creates a monitor of the heads of the servers in the peer
+// set, zero arguments selecting the defaults.
+func newDivergenceMonitor(peers *peerSet, blocks uint64, timeout time.Duration, clock mclock.Clock) *divergenceMonitor {
+	if blocks == 0 {
+		blocks = defaultDivergenceBlocks
+	}
+	if timeout == 0 {
+		timeout = defaultDivergenceTime
+	}
+	return &divergenceMonitor{
+		peers:   peers,
+		blocks:  blocks,
+		timeout: timeout,
+		clock:   clock,
+		quit:    make(chan struct{}),
+	}
+}
+
+// start starts comparing the server heads periodically.
+func (m *divergenceMonitor) start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		for {
+			select {
+			case <-m.clock.After(divergenceCheckInterval):
+				m.check()
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+}
+
+// stop terminates the monitor.
+func (m *divergenceMonitor) stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// check compares the current heads of the servers, posting an event if they
+// became diverged or agree again.
+func (m *divergenceMonitor) check() {
+	heads := make(map[string]uint64)
+	for _, p := range m.peers.AllPeers() {
+		p.lock.RLock()
+		if p.headInfo != nil {
+			heads[p.id] = p.headInfo.Number
+		}
+		p.lock.RUnlock()
+	}
+	spread := headSpread(heads)
+	now := m.clock.Now()
+
+	m.lock.Lock()
+	m.spread, m.heads = spread, heads
+	if spread <= m.blocks {
+		m.over = false
+	} else if !m.over {
+		m.over, m.overFrom = true, now
+	}
+	diverged := m.over && time.Duration(now-m.overFrom) >= m.timeout
+	changed := diverged != m.diverged
+	m.diverged = diverged
+	m.lock.Unlock()
+
+	if !changed {
+		return
+	}
+	if diverged {
+		log.Warn("LES servers disagree on the chain head", "spread", spread, "servers", len(heads))
+	} else {
+		log.Info("LES servers agree on the chain head again", "spread", spread)
+	}
+	m.feed.Send(HeadDivergenceEvent{Diverged: diverged, Spread: spread, Heads: heads})
+}
+
+// headSpread returns the difference of the highest and the lowest head number.
+func headSpread(heads map[string]uint64) uint64 {
+	if len(heads) == 0 {
+		return 0
+	}
+	numbers := make([]uint64, 0, len(heads))
+	for _, number := range heads {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers[len(numbers)-1] - numbers[0]
+}
+
+// status returns the divergence state as of the last check.
+func (m *divergenceMonitor) status() *HeadDivergence {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := &HeadDivergence{
+		Diverged: m.diverged,
+		Spread:   m.spread,
+		Limit:    m.blocks,
+		Heads:    make(map[string]uint64, len(m.heads)),
+	}
+	if m.over {
+		status.Since = time.Duration(m.clock.Now() - m.overFrom)
+	}
+	for id, number := range m.heads {
+		status.Heads[id] = number
+	}
+	return status
+}
+
+// SubscribeDivergence subscribes to the head divergence events of the servers.
+func (m *divergenceMonitor) SubscribeDivergence(ch chan<- HeadDivergenceEvent) event.Subscription {
+	return m.feed.Subscribe(ch)
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// Tests that the servers disagreeing on the head are reported only once the
+// spread lasted long enough, and that agreement is reported again.
+func TestHeadDivergence(t *testing.T) {
+	var (
+		clock = &mclock.Simulated{}
+		peers = newPeerSet()
+		heads = []uint64{100, 102, 130}
+	)
+	for i, number := range heads {
+		p := newPeer(lpv2, NetworkId, p2p.NewPeer(discover.NodeID{byte(i + 1)}, "test", nil), nil)
+		p.headInfo = &announceData{Number: number}
+		if err := peers.Register(p); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+		defer peers.Unregister(p.id)
+	}
+	monitor := newDivergenceMonitor(peers, 10, time.Minute, clock)
+	events := make(chan HeadDivergenceEvent, 2)
+	sub := monitor.SubscribeDivergence(events)
+	defer sub.Unsubscribe()
+
+	// A spread over the limit is not reported right away
+	monitor.check()
+	if status := monitor.status(); status.Diverged || status.Spread != 30 || len(status.Heads) != 3 {
+		t.Fatalf("fresh spread status mismatch: %+v", status)
+	}
+	clock.Run(time.Minute)
+	monitor.check()
+	select {
+	case ev := <-events:
+		if !ev.Diverged || ev.Spread != 30 {
+			t.Fatalf("divergence event mismatch: %+v", ev)
+		}
+	default:
+		t.Fatalf("no divergence event")
+	}
+	if status := monitor.status(); !status.Diverged || status.Since != time.Minute {
+		t.Fatalf("diverged status mismatch: %+v", status)
+	}
+	// The lagging servers catch up
+	for _, p := range peers.AllPeers() {
+		p.lock.Lock()
+		p.headInfo = &announceData{Number: 130}
+		p.lock.Unlock()
+	}
+	monitor.check()
+	select {
+	case ev := <-events:
+		if ev.Diverged || ev.Spread != 0 {
+			t.Fatalf("agreement event mismatch: %+v", ev)
+		}
+	default:
+		t.Fatalf("no agreement event")
+	}
+	// Agreement doesn't repeat the event
+	monitor.check()
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event: %+v", ev)
+	default:
+	}
+}
+
+// Tests that the started monitor compares the heads on the ticks of its clock.
+func TestHeadDivergenceLoop(t *testing.T) {
+	var (
+		clock = &mclock.Simulated{}
+		peers = newPeerSet()
+	)
+	for i, number := range []uint64{100, 130} {
+		p := newPeer(lpv2, NetworkId, p2p.NewPeer(discover.NodeID{byte(i + 1)}, "test", nil), nil)
+		p.headInfo = &announceData{Number: number}
+		if err := peers.Register(p); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+		defer peers.Unregister(p.id)
+	}
+	monitor := newDivergenceMonitor(peers, 10, time.Minute, clock)
+	events := make(chan HeadDivergenceEvent, 1)
+	sub := monitor.SubscribeDivergence(events)
+	defer sub.Unsubscribe()
+
+	monitor.start()
+	defer monitor.stop()
+	for elapsed := time.Duration(0); elapsed <= time.Minute; elapsed += divergenceCheckInterval {
+		clock.WaitForTimers(1)
+		clock.Run(divergenceCheckInterval)
+	}
+	select {
+	case ev := <-events:
+		if !ev.Diverged || ev.Spread != 30 {
+			t.Fatalf("divergence event mismatch: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no divergence event")
+	}
+}
@@ -16,24 +16,49 @@
 
 package les
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errQueueClosed is returned when queueing into an execution queue which has been
+// stopped.
+var errQueueClosed = errors.New("execution queue closed")
+
+// Lanes of an execution queue, the functions of the high priority lane are
+// executed before any of the normal one.
+const (
+	execNormal = iota // data responses, requests
+	execHigh          // announcements, control messages
+	execLanes
+)
 
 // execQueue implements a queue that executes function calls in a single thread,
-// in the same order as they have been queued.
+// in the same order as they have been queued within each of its two lanes, the
+// high priority lane going first. Each lane holds at most capacity functions;
+// the callers either check for room or block until there is some.
 //
 /**
 execQueue: 实现了一个队列，该队列在单个线程中按已排队的顺序执行 func 调用。
+	分为 两条通道: 高优先级 (announce 等控制消息) 和 普通 (数据响应, req), 高优先级通道中的 func 总是先执行;
+	每条通道最多 capacity 个 func, 满了之后 queue 直接返回 false, queueWait 则阻塞等待 (背压) 直到有空间或 ctx 结束
  */
 type execQueue struct {
 	mu        sync.Mutex
 	cond      *sync.Cond
-	funcs     []func()
+	capacity  int
+	lanes     [execLanes][]func()
+	running   int           // lane of the function being executed, -1 if idle
+	space     chan struct{} // closed and replaced when room is made in a lane
+	onDepth   func(high, normal int)
+	draining  bool // no more functions are accepted, the queued ones are executed before closing
 	closeWait chan struct{}
 }
 
 // newExecQueue creates a new execution queue.
 func newExecQueue(capacity int) *execQueue {
-	q := &execQueue{funcs: make([]func(), 0, capacity)}
+	q := &execQueue{capacity: capacity, running: -1, space: make(chan struct{})}
 	q.cond = sync.NewCond(&q.mu)
 	// 直接进入监听阶段
 	go q.loop()
@@ -47,16 +72,19 @@ func (q *execQueue) loop() {
 	close(q.closeWait)
 }
 
-func (q *execQueue) waitNext(drop bool) (f func()) {
+func (q *execQueue) waitNext(done bool) (f func()) {
 	q.mu.Lock()
-	if drop {
-		// Remove the function that just executed. We do this here instead of when
-		// dequeuing so len(q.funcs) includes the function that is running.
-		q.funcs = append(q.funcs[:0], q.funcs[1:]...)
+	if done {
+		// The function that just executed is counted in the length of its lane
+		// until here, so the lanes don't accept more than their capacity.
+		q.running = -1
+		q.madeSpace()
 	}
 	for !q.isClosed() {
-		if len(q.funcs) > 0 {
-			f = q.funcs[0]
+		if lane := q.nextLane(); lane >= 0 {
+			f = q.lanes[lane][0]
+			q.lanes[lane] = append(q.lanes[lane][:0], q.lanes[lane][1:]...)
+			q.running = lane
 			break
 		}
 		q.cond.Wait()
@@ -65,36 +93,167 @@ func (q *execQueue) waitNext(drop bool) (f func()) {
 	return f
 }
 
+// nextLane returns the lane to execute a function from, -1 if both are empty.
+func (q *execQueue) nextLane() int {
+	switch {
+	case len(q.lanes[execHigh]) > 0:
+		return execHigh
+	case len(q.lanes[execNormal]) > 0:
+		return execNormal
+	}
+	return -1
+}
+
+// madeSpace wakes up the callers waiting for room in the lanes and reports the
+// new depth.
+func (q *execQueue) madeSpace() {
+	close(q.space)
+	q.space = make(chan struct{})
+	q.reportDepth()
+}
+
+// reportDepth calls the depth hook of the queue, if any.
+func (q *execQueue) reportDepth() {
+	if q.onDepth != nil {
+		q.onDepth(q.depthOf(execHigh), q.depthOf(execNormal))
+	}
+}
+
+// depthOf returns the number of functions of a lane, including the one being
+// executed.
+func (q *execQueue) depthOf(lane int) int {
+	n := len(q.lanes[lane])
+	if q.running == lane {
+		n++
+	}
+	return n
+}
+
 func (q *execQueue) isClosed() bool {
 	return q.closeWait != nil
 }
 
+// isClosing tells whether the queue is closed or being drained.
+func (q *execQueue) isClosing() bool {
+	return q.draining || q.isClosed()
+}
+
+// canQueueIn tells whether a function can be added to a lane.
+func (q *execQueue) canQueueIn(lane int) bool {
+	return !q.isClosing() && q.depthOf(lane) < q.capacity
+}
+
 // canQueue returns true if more function calls can be added to the execution queue.
 func (q *execQueue) canQueue() bool {
 	q.mu.Lock()
-	ok := !q.isClosed() && len(q.funcs) < cap(q.funcs)
+	ok := q.canQueueIn(execNormal)
 	q.mu.Unlock()
 	return ok
 }
 
 // queue adds a function call to the execution queue. Returns true if successful.
 func (q *execQueue) queue(f func()) bool {
+	return q.queueIn(execNormal, f)
+}
+
+// queuePriority adds a function call to the high priority lane of the execution
+// queue. Returns true if successful.
+func (q *execQueue) queuePriority(f func()) bool {
+	return q.queueIn(execHigh, f)
+}
+
+func (q *execQueue) queueIn(lane int, f func()) bool {
 	q.mu.Lock()
-	ok := !q.isClosed() && len(q.funcs) < cap(q.funcs)
+	ok := q.canQueueIn(lane)
 	if ok {
-		q.funcs = append(q.funcs, f)
+		q.lanes[lane] = append(q.lanes[lane], f)
+		q.reportDepth()
 		q.cond.Signal()
 	}
 	q.mu.Unlock()
 	return ok
 }
 
+// queueWait adds a function call to a lane of the execution queue, waiting for
+// room in the lane if it's full. It returns an error if the queue is closed or
+// the context is done before there is room.
+func (q *execQueue) queueWait(ctx context.Context, high bool, f func()) error {
+	lane := execNormal
+	if high {
+		lane = execHigh
+	}
+	for {
+		q.mu.Lock()
+		if q.isClosing() {
+			q.mu.Unlock()
+			return errQueueClosed
+		}
+		if q.canQueueIn(lane) {
+			q.lanes[lane] = append(q.lanes[lane], f)
+			q.reportDepth()
+			q.cond.Signal()
+			q.mu.Unlock()
+			return nil
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// depth returns the number of functions queued in the high priority and the
+// normal lane, including the one being executed.
+func (q *execQueue) depth() (high, normal int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.depthOf(execHigh), q.depthOf(execNormal)
+}
+
+// setDepthHook sets a function called with the depth of the lanes whenever it
+// changes, e.g. to update the metrics. It's called with the queue locked.
+func (q *execQueue) setDepthHook(f func(high, normal int)) {
+	q.mu.Lock()
+	q.onDepth = f
+	q.mu.Unlock()
+}
+
+// drain stops accepting functions, queues a last one regardless of the capacity
+// and stops the queue once all the queued functions have been executed.
+//
+// drain: 不再接收新的 func, 追加最后一个 f (不受容量限制), 等待队列中的 func 全部执行完后关闭队列
+func (q *execQueue) drain(f func()) {
+	done := make(chan struct{})
+	q.mu.Lock()
+	if q.isClosing() {
+		q.mu.Unlock()
+		return
+	}
+	q.draining = true
+	q.lanes[execNormal] = append(q.lanes[execNormal], func() {
+		f()
+		close(done)
+	})
+	q.reportDepth()
+	q.cond.Signal()
+	q.mu.Unlock()
+
+	<-done
+	q.quit()
+}
+
 // quit stops the exec queue.
 // quit waits for the current execution to finish before returning.
 func (q *execQueue) quit() {
 	q.mu.Lock()
 	if !q.isClosed() {
 		q.closeWait = make(chan struct{})
+		q.madeSpace()
 		q.cond.Signal()
 	}
 	q.mu.Unlock()
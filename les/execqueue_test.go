@@ -17,7 +17,10 @@
 package les
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestExecQueue(t *testing.T) {
@@ -60,3 +63,102 @@ func TestExecQueue(t *testing.T) {
 	q.quit()
 	check("closed queue", false)
 }
+
+// Tests that the functions of the high priority lane are executed before the
+// pending ones of the normal lane, and that a full lane holds back the blocking
+// callers until there is room.
+func TestExecQueueLanes(t *testing.T) {
+	var (
+		q     = newExecQueue(2)
+		start = make(chan struct{})
+		block = make(chan struct{})
+		order = make(chan string, 8)
+	)
+	defer q.quit()
+
+	// Occupy the executor, then fill the normal lane
+	q.queue(func() { close(start); <-block; order <- "normal-0" })
+	<-start
+	q.queue(func() { order <- "normal-1" })
+	if q.canQueue() {
+		t.Fatalf("normal lane not full")
+	}
+	if !q.queuePriority(func() { order <- "high-0" }) {
+		t.Fatalf("high priority lane full")
+	}
+	if high, normal := q.depth(); high != 1 || normal != 2 {
+		t.Fatalf("depth mismatch: have %d/%d, want 1/2", high, normal)
+	}
+	// A blocking caller gives up when its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.queueWait(ctx, false, func() {}); err != context.DeadlineExceeded {
+		t.Fatalf("queueing into full lane: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Another one gets in once the executor makes room
+	queued := make(chan error, 1)
+	go func() {
+		queued <- q.queueWait(context.Background(), false, func() { order <- "normal-2" })
+	}()
+	close(block)
+	if err := <-queued; err != nil {
+		t.Fatalf("blocking queue failed: %v", err)
+	}
+	for _, want := range []string{"normal-0", "high-0", "normal-1", "normal-2"} {
+		select {
+		case have := <-order:
+			if have != want {
+				t.Fatalf("execution order mismatch: have %s, want %s", have, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not executed", want)
+		}
+	}
+	q.quit()
+	if err := q.queueWait(context.Background(), true, func() {}); err != errQueueClosed {
+		t.Fatalf("queueing into closed queue: have %v, want %v", err, errQueueClosed)
+	}
+}
+
+// Tests that draining a queue executes the queued functions and its last one
+// even if the lane is full, and rejects the functions queued meanwhile.
+func TestExecQueueDrain(t *testing.T) {
+	var (
+		q     = newExecQueue(2)
+		block = make(chan struct{})
+		order = make(chan string, 4)
+	)
+	q.queue(func() { <-block; order <- "first" })
+	if !q.queue(func() { order <- "second" }) {
+		t.Fatalf("failed to queue")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		q.drain(func() { order <- "last" })
+		close(drained)
+	}()
+	for {
+		q.mu.Lock()
+		draining := q.draining
+		q.mu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.queueWait(context.Background(), false, func() { order <- "late" }); err != errQueueClosed {
+		t.Fatalf("queueing into draining queue: have %v, want %v", err, errQueueClosed)
+	}
+	close(block)
+	<-drained
+	close(order)
+
+	var have []string
+	for f := range order {
+		have = append(have, f)
+	}
+	if want := []string{"first", "second", "last"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("execution mismatch: have %v, want %v", have, want)
+	}
+}
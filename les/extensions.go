@@ -0,0 +1,158 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// extensionsKey is the handshake key listing the extensions supported by a peer.
+const extensionsKey = "extensions"
+
+// builtinHandshakeKeys are the handshake keys of the protocol itself, which the
+// extensions can't override.
+var builtinHandshakeKeys = map[string]bool{
+	"protocolVersion": true, "networkId": true, "headTd": true, "headHash": true,
+	"headNum": true, "genesisHash": true, "serveHeaders": true, "serveChainSince": true,
+	"serveStateSince": true, "txRelay": true, "flowControl/BL": true, "flowControl/MRR": true,
+	"flowControl/MRC": true, "announceType": true, "bodyStreaming": true, "txStatusPush": true,
+	"stateHints": true, "nonceAdvice": true, "proofStreaming": true, "signResponses": true,
+	"serverBusy": true, "serveRecentState": true, extensionsKey: true,
+}
+
+// HandshakeExtension is an optional field of the les handshake. Both sides list
+// the extensions they support under the "extensions" key, and an extension is
+// only negotiated if the remote peer lists it too, so forks can add handshake
+// fields without breaking the compatibility with the peers not knowing them.
+//
+/**
+HandshakeExtension: les 握手中的 可选字段 (扩展)
+双方在握手的 "extensions" 中列出各自支持的扩展名, 只有双方都支持的扩展才会生效,
+分叉的网络 可以借此增加握手字段, 而不影响与 不认识这些字段的 peer 的兼容
+ */
+type HandshakeExtension struct {
+	// Name is the handshake key of the extension.
+	Name string
+
+	// Value returns the value advertised to a peer, server tells whether the
+	// local node is serving it. A nil value is sent as an empty one.
+	Value func(id discover.NodeID, server bool) interface{}
+
+	// Accept is called with the value of a peer supporting the extension too, an
+	// error fails the handshake. It may be nil.
+	Accept func(id discover.NodeID, server bool, value rlp.RawValue) error
+}
+
+var (
+	extensionLock sync.RWMutex
+	extensions    = make(map[string]*HandshakeExtension)
+)
+
+// RegisterHandshakeExtension adds an extension to the handshakes of all the les
+// peers connected from now on. It panics if the name is taken by the protocol or
+// another extension.
+func RegisterHandshakeExtension(ext HandshakeExtension) {
+	if ext.Name == "" || ext.Value == nil {
+		panic("les: incomplete handshake extension")
+	}
+	if builtinHandshakeKeys[ext.Name] {
+		panic(fmt.Sprintf("les: handshake key %q is reserved", ext.Name))
+	}
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+
+	if _, ok := extensions[ext.Name]; ok {
+		panic(fmt.Sprintf("les: handshake extension %q already registered", ext.Name))
+	}
+	extensions[ext.Name] = &ext
+}
+
+// registeredExtensions returns the registered extensions ordered by name.
+func registeredExtensions() []*HandshakeExtension {
+	extensionLock.RLock()
+	defer extensionLock.RUnlock()
+
+	list := make([]*HandshakeExtension, 0, len(extensions))
+	for _, ext := range extensions {
+		list = append(list, ext)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// addExtensions appends the values and the list of the supported extensions to a
+// handshake, if there are any.
+func addExtensions(send keyValueList, id discover.NodeID, server bool) keyValueList {
+	list := registeredExtensions()
+	if len(list) == 0 {
+		return send
+	}
+	names := make([]string, 0, len(list))
+	for _, ext := range list {
+		send = send.add(ext.Name, ext.Value(id, server))
+		names = append(names, ext.Name)
+	}
+	return send.add(extensionsKey, names)
+}
+
+// negotiateExtensions accepts the values of the extensions supported by both
+// sides. It returns them by name, together with the keys of the received
+// handshake not known locally, which are preserved for inspection.
+func negotiateExtensions(recv keyValueMap, id discover.NodeID, server bool) (negotiated, unknown keyValueMap, err error) {
+	var supported []string
+	recv.get(extensionsKey, &supported) // optional, peers without extensions don't send it
+
+	negotiated, unknown = make(keyValueMap), make(keyValueMap)
+	list := registeredExtensions()
+	for _, name := range supported {
+		for _, ext := range list {
+			if ext.Name != name {
+				continue
+			}
+			value, ok := recv[name]
+			if !ok {
+				return nil, nil, errResp(ErrMissingKey, "%s", name)
+			}
+			if ext.Accept != nil {
+				if err := ext.Accept(id, server, value); err != nil {
+					return nil, nil, errResp(ErrUselessPeer, "extension %s: %v", name, err)
+				}
+			}
+			negotiated[name] = value
+		}
+	}
+	for key, value := range recv {
+		if builtinHandshakeKeys[key] {
+			continue
+		}
+		if _, ok := negotiated[key]; ok {
+			continue
+		}
+		extensionLock.RLock()
+		_, known := extensions[key]
+		extensionLock.RUnlock()
+		if !known {
+			unknown[key] = value
+		}
+	}
+	return negotiated, unknown, nil
+}
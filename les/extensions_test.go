@@ -0,0 +1,100 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// Tests that the extensions are only negotiated if both sides support them, and
+// that the unknown keys of the remote side are preserved.
+func TestHandshakeExtensions(t *testing.T) {
+	var accepted []uint64
+	RegisterHandshakeExtension(HandshakeExtension{
+		Name:  "test/limit",
+		Value: func(id discover.NodeID, server bool) interface{} { return uint64(7) },
+		Accept: func(id discover.NodeID, server bool, value rlp.RawValue) error {
+			var limit uint64
+			if err := rlp.DecodeBytes(value, &limit); err != nil {
+				return err
+			}
+			if limit == 0 {
+				return errors.New("zero limit")
+			}
+			accepted = append(accepted, limit)
+			return nil
+		},
+	})
+	defer func() {
+		extensionLock.Lock()
+		delete(extensions, "test/limit")
+		extensionLock.Unlock()
+	}()
+	// Duplicate and reserved names are rejected
+	for _, name := range []string{"test/limit", "announceType"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("extension %q registered", name)
+				}
+			}()
+			RegisterHandshakeExtension(HandshakeExtension{Name: name, Value: func(discover.NodeID, bool) interface{} { return nil }})
+		}()
+	}
+	// The local handshake advertises the extension
+	send := addExtensions(nil, discover.NodeID{}, false).decode()
+	var names []string
+	if err := send.get(extensionsKey, &names); err != nil || len(names) != 2 || names[0] != stopAnnounceExtension || names[1] != "test/limit" {
+		t.Fatalf("advertised extensions mismatch: %v, %v", names, err)
+	}
+	// A peer supporting it negotiates it, a fork-specific key is kept as unknown
+	var recv keyValueList
+	recv = recv.add("protocolVersion", uint64(lpv2))
+	recv = recv.add("test/limit", uint64(42))
+	recv = recv.add("fork/field", "value")
+	recv = recv.add(extensionsKey, []string{"test/limit", "fork/field"})
+
+	negotiated, unknown, err := negotiateExtensions(recv.decode(), discover.NodeID{}, true)
+	if err != nil {
+		t.Fatalf("negotiation failed: %v", err)
+	}
+	if _, ok := negotiated["test/limit"]; !ok || len(negotiated) != 1 {
+		t.Errorf("negotiated extensions mismatch: %v", negotiated)
+	}
+	if len(accepted) != 1 || accepted[0] != 42 {
+		t.Errorf("accepted values mismatch: %v", accepted)
+	}
+	if _, ok := unknown["fork/field"]; !ok || len(unknown) != 1 {
+		t.Errorf("unknown keys mismatch: %v", unknown)
+	}
+	// A peer not listing it doesn't negotiate it, even if it sends the key
+	recv = recv[:len(recv)-1]
+	if negotiated, _, _ = negotiateExtensions(recv.decode(), discover.NodeID{}, true); len(negotiated) != 0 {
+		t.Errorf("extension negotiated without being listed: %v", negotiated)
+	}
+	// A rejected value fails the handshake
+	var bad keyValueList
+	bad = bad.add("test/limit", uint64(0))
+	bad = bad.add(extensionsKey, []string{"test/limit"})
+	if _, _, err := negotiateExtensions(bad.decode(), discover.NodeID{}, true); err == nil {
+		t.Errorf("rejected extension value accepted")
+	}
+}
@@ -511,7 +511,17 @@ func (f *lightFetcher) peerHasBlock(p *peer, hash common.Hash, number uint64) bo
 	}
 
 	fp := f.peers[p]
-	if fp == nil || fp.root == nil {
+	if fp == nil {
+		return false
+	}
+	if p.noAnnounce {
+		// the server sends no announcements in ultra-light mode, assume it knows
+		// the canonical blocks agreed on by the voting servers
+		f.chain.LockChain()
+		defer f.chain.UnlockChain()
+		return rawdb.ReadCanonicalHash(f.pm.chainDb, number) == hash
+	}
+	if fp.root == nil {
 		return false
 	}
 
@@ -529,6 +539,23 @@ func (f *lightFetcher) peerHasBlock(p *peer, hash common.Hash, number uint64) bo
 	return rawdb.ReadCanonicalHash(f.pm.chainDb, fp.root.number) == fp.root.hash && rawdb.ReadCanonicalHash(f.pm.chainDb, number) == hash
 }
 
+// ulcAgreed returns whether enough of the voting servers announced the given
+// head in ultra-light mode, always true otherwise.
+//
+// 超轻节点模式下, 只有 不少于 fraction% 的 计票 server 宣布了该 head, 才会去拉取
+func (f *lightFetcher) ulcAgreed(hash common.Hash) bool {
+	if f.pm.ulc == nil {
+		return true
+	}
+	votes := 0
+	for p, fp := range f.peers {
+		if f.pm.ulc.trusted(p.ID()) && fp.nodeByHash[hash] != nil {
+			votes++
+		}
+	}
+	return f.pm.ulc.agreed(votes)
+}
+
 // requestAmount calculates the amount of headers to be downloaded starting
 // from a certain head backwards
 //
@@ -576,7 +603,7 @@ func (f *lightFetcher) nextRequest() (*distReq, uint64) {
 		for hash, n := range fp.nodeByHash {
 
 			// 逐个教研检查,逐个对比td
-			if !f.checkKnownNode(p, n) && !n.requested && (bestTd == nil || n.td.Cmp(bestTd) >= 0) {
+			if !f.checkKnownNode(p, n) && !n.requested && (bestTd == nil || n.td.Cmp(bestTd) >= 0) && f.ulcAgreed(hash) {
 				// 计算从特定header开始向后下载的header的数量
 				amount := f.requestAmount(p, n)
 				if bestTd == nil || n.td.Cmp(bestTd) > 0 || amount < bestAmount {
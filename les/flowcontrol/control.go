@@ -24,6 +24,8 @@
 package flowcontrol
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -60,6 +62,14 @@ type ClientNode struct {
 
 	// clientManager中的 该peer 的实例
 	cmNode   *cmNode
+
+	// 超出 buffer 的次数 (按 UnderrunPolicy 逐级惩罚), 最后一次超出的时间, 冻结截止的时间
+	underruns    int
+	lastUnderrun mclock.AbsTime
+	frozenUntil  mclock.AbsTime
+
+	// 在 流控 trace 中 标识该 client 的 ID, 为空时不记录
+	id string
 }
 
 /**
@@ -70,7 +80,7 @@ func NewClientNode(cm *ClientManager, params *ServerParams) *ClientNode {
 		cm:       cm,
 		params:   params,
 		bufValue: params.BufLimit,
-		lastTime: mclock.Now(),
+		lastTime: cm.clock.Now(),
 	}
 	node.cmNode = cm.addNode(node)
 	return node
@@ -78,6 +88,20 @@ func NewClientNode(cm *ClientManager, params *ServerParams) *ClientNode {
 
 func (peer *ClientNode) Remove(cm *ClientManager) {
 	cm.removeNode(peer.cmNode)
+
+	peer.lock.Lock()
+	peer.recalcBV(cm.clock.Now())
+	peer.trace(TraceRemove, 0, peer.bufValue)
+	peer.lock.Unlock()
+}
+
+// SetWeight sets the recharge weight of the client (1 by default). A client with
+// weight 10 recharges ten times as fast as a default one while both of them are
+// waiting for recharge, giving it a proportionally larger share of the server.
+//
+// SetWeight: 设置 client 的充电权重 (默认为 1), 例如付费 client 可以获得 10 倍的服务容量
+func (peer *ClientNode) SetWeight(weight uint64) {
+	peer.cm.setWeight(peer.cmNode, weight)
 }
 
 func (peer *ClientNode) recalcBV(time mclock.AbsTime) {
@@ -105,22 +129,53 @@ func (peer *ClientNode) AcceptRequest() (uint64, bool) {
 	peer.lock.Lock()
 	defer peer.lock.Unlock()
 
-	time := mclock.Now()
+	time := peer.cm.clock.Now()
 
 	// 重新计算 peer 的缓存数量大小和最后一次请求时间
 	peer.recalcBV(time)
 	// 第一参数: 该peer 被允许的缓存数量大小
 	// 第二参数: 判断 node 是否可以被处理?
-	return peer.bufValue, peer.cm.accept(peer.cmNode, time)
+	accepted := peer.cm.accept(peer.cmNode, time)
+	if accepted {
+		peer.trace(TraceAccept, 0, peer.bufValue)
+	}
+	return peer.bufValue, accepted
+}
+
+// BufferLevel returns the current buffer value of the client relative to its
+// buffer limit (between 0 and 1).
+//
+// BufferLevel: 返回 client 当前的 buffer 占 buffer limit 的比例
+func (peer *ClientNode) BufferLevel() float64 {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.recalcBV(peer.cm.clock.Now())
+	return float64(peer.bufValue) / float64(peer.params.BufLimit)
+}
+
+// BufferValue returns the current buffer value of the client, reported to the
+// clients requesting a resync of their estimate.
+func (peer *ClientNode) BufferValue() uint64 {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.recalcBV(peer.cm.clock.Now())
+	return peer.bufValue
 }
 
 func (peer *ClientNode) RequestProcessed(cost uint64) (bv, realCost uint64) {
 	peer.lock.Lock()
 	defer peer.lock.Unlock()
 
-	time := mclock.Now()
+	time := peer.cm.clock.Now()
 	peer.recalcBV(time)
-	peer.bufValue -= cost
+	// A request served despite an underrun drains the buffer, it can't go below zero
+	if cost > peer.bufValue {
+		peer.bufValue = 0
+	} else {
+		peer.bufValue -= cost
+	}
 	peer.recalcBV(time)
 	rcValue, rcost := peer.cm.processed(peer.cmNode, time)
 	if rcValue < peer.params.BufLimit {
@@ -129,6 +184,7 @@ func (peer *ClientNode) RequestProcessed(cost uint64) (bv, realCost uint64) {
 			peer.bufValue = bv
 		}
 	}
+	peer.trace(TraceProcessed, cost, peer.bufValue)
 	return peer.bufValue, rcost
 }
 
@@ -149,15 +205,26 @@ type ServerNode struct {
 	sumCost     uint64            // sum of req costs sent to this server
 	// value = 发送给定请求后的sumCost
 	pending     map[uint64]uint64 // value = sumCost after sending the given req
+	// 在 buffer 估计值被 reply 重新调整后关闭, 用于唤醒 CanSendCtx 的等待者
+	wakeup      chan struct{}     // closed (and replaced) when a reply readjusts the buffer estimate
+	clock       mclock.Clock
 	lock        sync.RWMutex
 }
 
-func NewServerNode(params *ServerParams) *ServerNode {
+// ErrDeadlineTooSoon is returned by CanSendCtx if the buffer would not recharge
+// sufficiently before the deadline of the caller's context.
+var ErrDeadlineTooSoon = errors.New("flow control buffer recharges after deadline")
+
+// NewServerNode creates the flow control state of a server, estimating its buffer
+// value on the given clock.
+func NewServerNode(params *ServerParams, clock mclock.Clock) *ServerNode {
 	return &ServerNode{
+		clock:       clock,
 		bufEstimate: params.BufLimit,
-		lastTime:    mclock.Now(),
+		lastTime:    clock.Now(),
 		params:      params,
 		pending:     make(map[uint64]uint64),
+		wakeup:      make(chan struct{}),
 	}
 }
 
@@ -173,6 +240,10 @@ func (peer *ServerNode) recalcBLE(time mclock.AbsTime) {
 	peer.lastTime = time
 }
 
+// driftDivisor defines the drift of the estimated buffer value tolerated before
+// the flow control state is considered desynced, as a fraction of the limit.
+const driftDivisor = 10
+
 // safetyMargin is added to the flow control waiting time when estimated buffer value is low
 //
 // 当估计的缓冲区值较低时，将safetyMargin添加到流控制等待时间
@@ -186,7 +257,7 @@ const safetyMargin = time.Millisecond
 // Minimum Rate of Recharge
 //
 func (peer *ServerNode) canSend(maxCost uint64) (time.Duration, float64) {
-	peer.recalcBLE(mclock.Now()) // 客户总是对其电流有一个最低的估计BV，称为BLE
+	peer.recalcBLE(peer.clock.Now()) // 客户总是对其电流有一个最低的估计BV，称为BLE
 	maxCost += uint64(safetyMargin) * peer.params.MinRecharge / uint64(fcTimeConst)
 	if maxCost > peer.params.BufLimit {
 		maxCost = peer.params.BufLimit
@@ -212,6 +283,54 @@ func (peer *ServerNode) CanSend(maxCost uint64) (time.Duration, float64) {
 	return peer.canSend(maxCost)
 }
 
+// CanSendCtx blocks until a request with the given maximum estimated cost can be
+// sent to the server, returning the relative estimated buffer level after sending
+// it (see CanSend). Instead of polling CanSend the caller sleeps until either the
+// buffer recharges or a reply readjusts the estimate. An error is returned if the
+// context is cancelled or its deadline is too close to wait for the recharge. The
+// time left until the deadline is measured on the clock of the node.
+//
+// CanSendCtx: CanSend 的 context 版本, 阻塞直到 buffer 充值足够 (或者 reply 更新了估计值),
+// 如果 ctx 的 deadline 之前无法充值足够则直接返回错误 (剩余时间按 peer.clock 计算)
+func (peer *ServerNode) CanSendCtx(ctx context.Context, maxCost uint64) (float64, error) {
+	var end mclock.AbsTime
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		end = peer.clock.Now().Add(time.Until(deadline))
+	}
+	for {
+		peer.lock.RLock()
+		wait, bufLevel := peer.canSend(maxCost)
+		wakeup := peer.wakeup
+		peer.lock.RUnlock()
+
+		if wait == 0 {
+			return bufLevel, nil
+		}
+		if hasDeadline && time.Duration(end-peer.clock.Now()) < wait {
+			return 0, ErrDeadlineTooSoon
+		}
+		select {
+		case <-peer.clock.After(wait):
+		case <-wakeup:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// BufferLevel returns the estimated buffer value of the server relative to its
+// buffer limit (between 0 and 1).
+//
+// BufferLevel: 返回估计的 server buffer 占 buffer limit 的比例
+func (peer *ServerNode) BufferLevel() float64 {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.recalcBLE(peer.clock.Now())
+	return float64(peer.bufEstimate) / float64(peer.params.BufLimit)
+}
+
 // QueueRequest should be called when the request has been assigned to the given
 // server node, before putting it in the send queue. It is mandatory that requests
 // are sent in the same order as the QueueRequest calls are made.
@@ -234,29 +353,48 @@ func (peer *ServerNode) QueueRequest(reqID, maxCost uint64) {
 }
 
 // GotReply adjusts estimated buffer value according to the value included in
-// the latest request reply.
+// the latest request reply. It reports whether the flow control state seems to
+// be desynced: the server reported a value above the buffer limit or one falling
+// behind the estimate by more than 1/driftDivisor of the limit, i.e. it charged
+// more than the maximum costs. The caller should request a resync then.
 //
 /**
 GotReply:
 根据最新请求回复中包含的值来调整估计的缓冲区值。
+如果 server 回复的值超过了 buffer limit, 或者比估计值低太多 (server 的扣费超过了最大成本),
+说明双方的流控状态已不同步, 返回 true, 由调用方发起 resync
  */
-func (peer *ServerNode) GotReply(reqID, bv uint64) {
+func (peer *ServerNode) GotReply(reqID, bv uint64) (desynced bool) {
 
 	peer.lock.Lock()
 	defer peer.lock.Unlock()
 
 	if bv > peer.params.BufLimit {
 		bv = peer.params.BufLimit
+		desynced = true
 	}
 	sc, ok := peer.pending[reqID]
 	if !ok {
-		return
+		return desynced
 	}
 	delete(peer.pending, reqID)
 	cc := peer.sumCost - sc
+
+	now := peer.clock.Now()
+	peer.recalcBLE(now)
+	estimate := peer.bufEstimate
+
 	peer.bufEstimate = 0
 	if bv > cc {
 		peer.bufEstimate = bv - cc
 	}
-	peer.lastTime = mclock.Now()
+	peer.lastTime = now
+	if estimate > peer.bufEstimate && estimate-peer.bufEstimate > peer.params.BufLimit/driftDivisor {
+		desynced = true
+	}
+
+	// wake up any CanSendCtx waiters to recheck the new estimate
+	close(peer.wakeup)
+	peer.wakeup = make(chan struct{})
+	return desynced
 }
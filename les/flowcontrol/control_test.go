@@ -0,0 +1,217 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package flowcontrol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+// Tests that a request exhausting the client buffer exactly is accepted and the
+// buffer is recharged by the serving time and the minimum recharge rate.
+func TestClientNodeExhaustedBuffer(t *testing.T) {
+	clock := &mclock.Simulated{}
+	cm := NewClientManager(50, 10, 1000000000, clock)
+	defer cm.Stop()
+
+	node := NewClientNode(cm, &ServerParams{BufLimit: 1000000, MinRecharge: 1000})
+	if bv, ok := node.AcceptRequest(); !ok || bv != 1000000 {
+		t.Fatalf("request not accepted: buffer %d, accepted %v", bv, ok)
+	}
+	clock.Run(300 * time.Microsecond)
+
+	// The whole buffer is spent, the manager gives back what the serving time allows
+	bv, cost := node.RequestProcessed(1000000)
+	if bv != 700000 || cost != 300000 {
+		t.Fatalf("processed request mismatch: buffer %d, real cost %d, want 700000, 300000", bv, cost)
+	}
+	clock.Run(100 * time.Millisecond)
+	if level := node.BufferLevel(); level != 0.8 {
+		t.Errorf("buffer level mismatch after recharge: have %v, want 0.8", level)
+	}
+	clock.Run(time.Second)
+	if level := node.BufferLevel(); level != 1 {
+		t.Errorf("buffer not capped at the limit: have %v", level)
+	}
+}
+
+// Tests that the underruns of a client drain its buffer to zero instead of
+// wrapping it around, and are penalised with escalation and forgiveness.
+func TestClientNodeUnderrun(t *testing.T) {
+	clock := &mclock.Simulated{}
+	cm := NewClientManager(50, 10, 1000000000, clock)
+	defer cm.Stop()
+	cm.SetUnderrunPolicy(UnderrunPolicy{Warnings: 1, Freezes: 1, FreezeTime: time.Second, ForgiveTime: time.Minute})
+
+	node := NewClientNode(cm, &ServerParams{BufLimit: 1000, MinRecharge: 1})
+	node.AcceptRequest()
+	if bv, _ := node.RequestProcessed(5000); bv > 1000 {
+		t.Fatalf("buffer wrapped around on underrun: %d", bv)
+	}
+	if action := node.Underrun(); action != UnderrunWarn {
+		t.Fatalf("first underrun penalty mismatch: have %v, want %v", action, UnderrunWarn)
+	}
+	if frozen, _ := node.Frozen(); frozen {
+		t.Fatalf("client frozen after a warning")
+	}
+	if action := node.Underrun(); action != UnderrunFreeze {
+		t.Fatalf("second underrun penalty mismatch: have %v, want %v", action, UnderrunFreeze)
+	}
+	if frozen, retry := node.Frozen(); !frozen || retry != time.Second {
+		t.Fatalf("freeze mismatch: frozen %v, retry %v", frozen, retry)
+	}
+	clock.Run(time.Second)
+	if frozen, _ := node.Frozen(); frozen {
+		t.Fatalf("client still frozen after the freeze time")
+	}
+	if action := node.Underrun(); action != UnderrunDisconnect {
+		t.Fatalf("third underrun penalty mismatch: have %v, want %v", action, UnderrunDisconnect)
+	}
+	// Clients behaving for a while are forgiven
+	clock.Run(2 * time.Minute)
+	if action := node.Underrun(); action != UnderrunWarn {
+		t.Fatalf("penalty not reset after the forgive time: %v", action)
+	}
+	want := UnderrunStats{Warnings: 2, Freezes: 1, Disconnects: 1}
+	if stats := cm.UnderrunStats(); stats != want {
+		t.Errorf("underrun stats mismatch: have %+v, want %+v", stats, want)
+	}
+}
+
+// Tests the buffer estimate of a server when its buffer is exhausted exactly.
+func TestServerNodeExhaustedBuffer(t *testing.T) {
+	clock := &mclock.Simulated{}
+	node := NewServerNode(&ServerParams{BufLimit: 1000, MinRecharge: 10}, clock)
+
+	node.QueueRequest(1, 1000)
+	if wait, level := node.CanSend(0); wait != time.Millisecond || level != 0 {
+		t.Fatalf("exhausted buffer mismatch: wait %v, level %v, want 1ms, 0", wait, level)
+	}
+	clock.Run(time.Millisecond)
+	if wait, _ := node.CanSend(0); wait != 0 {
+		t.Fatalf("request not allowed after recharge, wait %v", wait)
+	}
+	// Waiters are woken up by the simulated recharge
+	node.QueueRequest(2, 10)
+	result := make(chan error, 1)
+	go func() {
+		_, err := node.CanSendCtx(context.Background(), 0)
+		result <- err
+	}()
+	clock.WaitForTimers(1)
+	clock.Run(time.Millisecond)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("CanSendCtx failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CanSendCtx not woken up by the recharge")
+	}
+}
+
+// Tests that a reply to an older request only credits the buffer with the costs
+// of the requests sent after it, superseding the locally estimated recharge.
+func TestServerNodeRechargeRace(t *testing.T) {
+	clock := &mclock.Simulated{}
+	node := NewServerNode(&ServerParams{BufLimit: 1000, MinRecharge: 10}, clock)
+
+	node.QueueRequest(1, 300)
+	node.QueueRequest(2, 300)
+	clock.Run(10 * time.Millisecond)
+	if level := node.BufferLevel(); level != 0.5 {
+		t.Fatalf("estimated recharge mismatch: have %v, want 0.5", level)
+	}
+	node.GotReply(1, 900)
+	if level := node.BufferLevel(); level != 0.6 {
+		t.Fatalf("buffer estimate mismatch after first reply: have %v, want 0.6", level)
+	}
+	// Replies to unknown or already answered requests are ignored
+	node.GotReply(1, 0)
+	node.GotReply(3, 0)
+	if level := node.BufferLevel(); level != 0.6 {
+		t.Fatalf("buffer estimate changed by stale replies: have %v", level)
+	}
+	clock.Run(5 * time.Millisecond)
+	node.GotReply(2, 2000)
+	if level := node.BufferLevel(); level != 1 {
+		t.Errorf("buffer estimate mismatch after last reply: have %v, want 1", level)
+	}
+}
+
+// Tests that replies inconsistent with the estimate are reported as desynced and
+// that a zero cost resync request readjusts the estimate.
+func TestServerNodeDesync(t *testing.T) {
+	clock := &mclock.Simulated{}
+	node := NewServerNode(&ServerParams{BufLimit: 1000, MinRecharge: 1}, clock)
+
+	node.QueueRequest(1, 100)
+	if node.GotReply(1, 950) {
+		t.Error("consistent reply reported as desynced")
+	}
+	node.QueueRequest(2, 100)
+	if !node.GotReply(2, 2000) {
+		t.Error("reply above the buffer limit not reported")
+	}
+	// The server charged way more than the maximum cost
+	node.QueueRequest(3, 100)
+	if !node.GotReply(3, 500) {
+		t.Error("overcharging reply not reported")
+	}
+	// Resync with a request sent after it still in flight
+	node.QueueRequest(4, 0)
+	node.QueueRequest(5, 100)
+	if node.GotReply(4, 800) {
+		t.Error("resync reported as desynced")
+	}
+	if level := node.BufferLevel(); level != 0.7 {
+		t.Errorf("buffer level mismatch after resync: have %v, want 0.7", level)
+	}
+}
+
+// Tests that CanSendCtx measures the time left until the deadline on the clock
+// of the node, giving up once the recharge falls behind the deadline.
+func TestServerNodeSendDeadline(t *testing.T) {
+	clock := &mclock.Simulated{}
+	node := NewServerNode(&ServerParams{BufLimit: 1000, MinRecharge: 10}, clock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	node.QueueRequest(1, 1000)
+	result := make(chan error, 1)
+	go func() {
+		_, err := node.CanSendCtx(ctx, 390) // 40ms to recharge
+		result <- err
+	}()
+	clock.WaitForTimers(1)
+	clock.Run(30 * time.Millisecond)
+
+	// The server reports an empty buffer, recharging takes 40ms again
+	node.GotReply(1, 0)
+	select {
+	case err := <-result:
+		if err != ErrDeadlineTooSoon {
+			t.Fatalf("error mismatch: have %v, want %v", err, ErrDeadlineTooSoon)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CanSendCtx not woken up by the reply")
+	}
+}
@@ -37,8 +37,8 @@ type cmNode struct {
 	// 服务中; 正在充电中
 	// 说白了就是 Server的服务中; 或者Client的接收中
 	serving, recharging          bool
-	// 允许充电的大小?
-	rcWeight                     uint64
+	// 充电的权重, 充电速度按 rcWeight/sumWeight 的比例分配
+	rcWeight                     uint64 // share of the recharge capacity relative to other recharging nodes
 
 	// 每个节点充电的value真实大小 ?;  ;
 	rcValue, rcDelta, startValue int64
@@ -120,15 +120,28 @@ type ClientManager struct {
 	rcRecharge                       uint64
 	resumeQueue                      chan chan bool
 	time                             mclock.AbsTime
+	clock                            mclock.Clock
+
+	// 超出 buffer 的 req 的 逐级惩罚策略, 及 各级惩罚的次数
+	underrunPolicy UnderrunPolicy
+	underrunStats  UnderrunStats
+
+	// 记录 client 流控事件的 recorder, nil 表示不记录
+	recorder *TraceRecorder
 }
 
-func NewClientManager(rcTarget, maxSimReq, maxRcSum uint64) *ClientManager {
+// NewClientManager creates a client manager using the given clock, which allows
+// the recharge calculations to be tested on a simulated clock.
+func NewClientManager(rcTarget, maxSimReq, maxRcSum uint64, clock mclock.Clock) *ClientManager {
 	cm := &ClientManager{
+		clock:       clock,
 		nodes:       make(map[*cmNode]struct{}),
 		resumeQueue: make(chan chan bool),
 		rcRecharge:  rcConst * rcConst / (100*rcConst/rcTarget - rcConst),
 		maxSimReq:   maxSimReq,
 		maxRcSum:    maxRcSum,
+
+		underrunPolicy: DefaultUnderrunPolicy,
 	}
 	go cm.queueProc()
 	return cm
@@ -144,7 +157,7 @@ func (self *ClientManager) Stop() {
 }
 
 func (self *ClientManager) addNode(cnode *ClientNode) *cmNode {
-	time := mclock.Now()
+	time := self.clock.Now()
 	node := &cmNode{
 		node:           cnode,
 		lastUpdate:     time,
@@ -155,7 +168,7 @@ func (self *ClientManager) addNode(cnode *ClientNode) *cmNode {
 	defer self.lock.Unlock()
 
 	self.nodes[node] = struct{}{}
-	self.update(mclock.Now())
+	self.update(self.clock.Now())
 	return node
 }
 
@@ -163,12 +176,48 @@ func (self *ClientManager) removeNode(node *cmNode) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	time := mclock.Now()
+	time := self.clock.Now()
 	self.stop(node, time)
 	delete(self.nodes, node)
 	self.update(time)
 }
 
+// setWeight changes the recharge weight of a node. Nodes with a higher weight
+// recharge proportionally faster when competing for the recharge capacity, so
+// their buffers (and thereby their serving capacity) recover sooner.
+//
+// setWeight: 设置 node 的充电权重, 权重越大的 node 在与其他 node 竞争充电容量时充电越快
+func (self *ClientManager) setWeight(node *cmNode, weight uint64) {
+	if weight == 0 {
+		weight = 1
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.nodes[node]; !ok || node.rcWeight == weight {
+		return
+	}
+	time := self.clock.Now()
+	self.update(time)
+	node.rcWeight = weight
+
+	self.update(time)
+	self.reschedule()
+}
+
+// reschedule recalculates the recharge speed of every recharging node from the
+// current weight distribution. It should be called whenever the set of recharging
+// nodes or their weights change.
+//
+// reschedule: 按当前的权重分布重新计算每个充电中 node 的充电速度
+func (self *ClientManager) reschedule() {
+	for node := range self.nodes {
+		if node.recharging {
+			node.set(node.serving, self.simReqCnt, self.sumWeight)
+		}
+	}
+}
+
 // recalc sumWeight
 // 重新计算sumWeight
 func (self *ClientManager) updateNodes(time mclock.AbsTime) (rce bool) {
@@ -228,11 +277,7 @@ func (self *ClientManager) update(time mclock.AbsTime) {
 		if self.updateNodes(firstTime) {
 
 			// 需要逐个将所有处于正在 充电中的 node 做某些重新计算!? todo 有点看不懂啊
-			for node := range self.nodes {
-				if node.recharging {
-					node.set(node.serving, self.simReqCnt, self.sumWeight)
-				}
-			}
+			self.reschedule()
 		} else {
 			// 更新下 time 字段
 			self.time = time
@@ -250,9 +295,9 @@ func (self *ClientManager) canStartReq() bool {
 func (self *ClientManager) queueProc() {
 	for rc := range self.resumeQueue {
 		for {
-			time.Sleep(time.Millisecond * 10)
+			self.clock.Sleep(time.Millisecond * 10)
 			self.lock.Lock()
-			self.update(mclock.Now())
+			self.update(self.clock.Now())
 			cs := self.canStartReq()
 			self.lock.Unlock()
 			if cs {
@@ -287,6 +332,7 @@ func (self *ClientManager) accept(node *cmNode, time mclock.AbsTime) bool {
 	node.set(true, self.simReqCnt, self.sumWeight)
 	node.startValue = node.rcValue
 	self.update(self.time)
+	self.reschedule()
 	return true
 }
 
@@ -296,6 +342,7 @@ func (self *ClientManager) stop(node *cmNode, time mclock.AbsTime) {
 		self.simReqCnt--
 		node.set(false, self.simReqCnt, self.sumWeight)
 		self.update(time)
+		self.reschedule()
 	}
 }
 
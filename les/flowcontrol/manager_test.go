@@ -0,0 +1,60 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package flowcontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+// Tests that recharging clients share the recharge capacity of the manager in
+// proportion to their weights.
+func TestClientManagerWeights(t *testing.T) {
+	cm := NewClientManager(50, 10, 1000000000, mclock.System{})
+	defer cm.Stop()
+
+	params := &ServerParams{BufLimit: 1000000000, MinRecharge: 1}
+	paying, free := NewClientNode(cm, params), NewClientNode(cm, params)
+	paying.SetWeight(10)
+
+	now := mclock.Now()
+	cm.accept(paying.cmNode, now)
+	cm.accept(free.cmNode, now)
+	now += mclock.AbsTime(100 * time.Millisecond)
+	cm.processed(paying.cmNode, now)
+	cm.processed(free.cmNode, now)
+
+	checkRatio := func(want float64) {
+		t.Helper()
+		if !paying.cmNode.recharging || !free.cmNode.recharging {
+			t.Fatalf("clients not recharging")
+		}
+		have := float64(paying.cmNode.rcDelta) / float64(free.cmNode.rcDelta)
+		if have < want*0.99 || have > want*1.01 {
+			t.Errorf("recharge speed ratio mismatch: have %v, want %v", have, want)
+		}
+	}
+	checkRatio(10)
+
+	// Weight changes reschedule the ongoing recharges
+	free.SetWeight(10)
+	checkRatio(1)
+	paying.SetWeight(0) // treated as 1
+	checkRatio(0.1)
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package flowcontrol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+// Kinds of the flow control trace events.
+const (
+	TraceAccept    = "accept"    // request accepted for serving, BufValue is the buffer before
+	TraceProcessed = "processed" // request served, BufValue is the buffer reported to the client
+	TraceRemove    = "remove"    // client disconnected
+)
+
+// TraceEvent is a flow control event of a client of a server.
+type TraceEvent struct {
+	Time     time.Duration `json:"time"` // since the start of the trace
+	Peer     string        `json:"peer"`
+	Kind     string        `json:"kind"`
+	Cost     uint64        `json:"cost,omitempty"`
+	BufValue uint64        `json:"bufValue"`
+}
+
+// TraceRecorder captures the flow control events of the clients of a live
+// server, so they can be replayed deterministically on a simulated clock, e.g. to
+// tune the server parameters or to reproduce a misbehaving client in a test.
+//
+/**
+TraceRecorder: 记录 live server 上 client 的 流控事件 (时间, peer, cost, buffer value),
+之后可以 用 Replay 在模拟时钟上 确定性地 重放, 用于调参 或 在测试中复现问题 client
+ */
+type TraceRecorder struct {
+	clock mclock.Clock
+	start mclock.AbsTime
+	limit int
+
+	lock    sync.Mutex
+	events  []TraceEvent
+	dropped int
+}
+
+// NewTraceRecorder creates a recorder keeping at most limit events (zero for
+// unlimited), timed on the given clock.
+func NewTraceRecorder(clock mclock.Clock, limit int) *TraceRecorder {
+	return &TraceRecorder{clock: clock, start: clock.Now(), limit: limit}
+}
+
+// record appends an event of a client.
+func (r *TraceRecorder) record(peer, kind string, cost, bufValue uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.limit > 0 && len(r.events) >= r.limit {
+		r.dropped++
+		return
+	}
+	r.events = append(r.events, TraceEvent{
+		Time:     time.Duration(r.clock.Now() - r.start),
+		Peer:     peer,
+		Kind:     kind,
+		Cost:     cost,
+		BufValue: bufValue,
+	})
+}
+
+// Events returns the recorded events and the number of events dropped over the
+// limit.
+func (r *TraceRecorder) Events() ([]TraceEvent, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]TraceEvent(nil), r.events...), r.dropped
+}
+
+// SetTraceRecorder starts recording the events of the clients with an ID into
+// the given recorder, or stops recording if nil.
+func (self *ClientManager) SetTraceRecorder(r *TraceRecorder) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.recorder = r
+}
+
+// traceRecorder returns the recorder of the manager, nil if not recording.
+func (self *ClientManager) traceRecorder() *TraceRecorder {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.recorder
+}
+
+// canStartReqNow tells whether a request could start serving without waiting.
+func (self *ClientManager) canStartReqNow() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.update(self.clock.Now())
+	return self.canStartReq()
+}
+
+// SetID sets the ID the client is identified by in the traces, the events of
+// the clients without an ID are not recorded.
+func (peer *ClientNode) SetID(id string) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.id = id
+}
+
+// trace records an event of the client if the manager is recording.
+func (peer *ClientNode) trace(kind string, cost, bufValue uint64) {
+	if peer.id == "" {
+		return
+	}
+	if r := peer.cm.traceRecorder(); r != nil {
+		r.record(peer.id, kind, cost, bufValue)
+	}
+}
+
+// Replay replays a recorded trace on a client manager running on a simulated
+// clock, returning the events as produced by the replay. The buffer values of
+// the replayed events match the recorded ones if the manager has the settings of
+// the recording server, or show the effect of different ones. The clients seen
+// first in the middle of their session start with their recorded buffer value.
+//
+// The manager must admit as many requests at once as the trace has, otherwise
+// the replay fails.
+func Replay(trace []TraceEvent, cm *ClientManager, clock *mclock.Simulated, params *ServerParams) ([]TraceEvent, error) {
+	var (
+		start  = clock.Now()
+		nodes  = make(map[string]*ClientNode)
+		replay = make([]TraceEvent, 0, len(trace))
+	)
+	for i, ev := range trace {
+		if wait := ev.Time - time.Duration(clock.Now()-start); wait > 0 {
+			clock.Run(wait)
+		}
+		node := nodes[ev.Peer]
+		if node == nil {
+			if ev.Kind == TraceRemove {
+				continue
+			}
+			node = NewClientNode(cm, params)
+			node.bufValue = ev.BufValue
+			nodes[ev.Peer] = node
+		}
+		out := TraceEvent{Time: ev.Time, Peer: ev.Peer, Kind: ev.Kind, Cost: ev.Cost}
+		switch ev.Kind {
+		case TraceAccept:
+			if !node.cm.canStartReqNow() {
+				return replay, fmt.Errorf("event %d: too many requests served at once", i)
+			}
+			out.BufValue, _ = node.AcceptRequest()
+		case TraceProcessed:
+			out.BufValue, _ = node.RequestProcessed(ev.Cost)
+		case TraceRemove:
+			out.BufValue = node.BufferValue()
+			node.Remove(cm)
+			delete(nodes, ev.Peer)
+		default:
+			return replay, fmt.Errorf("event %d: unknown kind %q", i, ev.Kind)
+		}
+		replay = append(replay, out)
+	}
+	return replay, nil
+}
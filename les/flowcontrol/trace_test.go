@@ -0,0 +1,91 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package flowcontrol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+// Tests that a recorded trace replays to the same events on a fresh manager with
+// the same settings.
+func TestTraceReplay(t *testing.T) {
+	params := &ServerParams{BufLimit: 1000000, MinRecharge: 1000}
+
+	clock := &mclock.Simulated{}
+	cm := NewClientManager(50, 10, 1000000000, clock)
+	defer cm.Stop()
+
+	recorder := NewTraceRecorder(clock, 0)
+	cm.SetTraceRecorder(recorder)
+
+	nodes := []*ClientNode{NewClientNode(cm, params), NewClientNode(cm, params)}
+	nodes[0].SetID("a")
+	nodes[1].SetID("b")
+	for i := 0; i < 10; i++ {
+		node := nodes[i%2]
+		node.AcceptRequest()
+		clock.Run(time.Duration(100+i*50) * time.Microsecond)
+		node.RequestProcessed(uint64(200000 + i*10000))
+		clock.Run(time.Duration(i) * time.Millisecond)
+	}
+	nodes[0].Remove(cm)
+	nodes[1].Remove(cm)
+
+	cm.SetTraceRecorder(nil)
+	trace, dropped := recorder.Events()
+	if len(trace) != 22 || dropped != 0 {
+		t.Fatalf("trace length mismatch: have %d (dropped %d), want 22", len(trace), dropped)
+	}
+	// Replay the trace on a fresh manager
+	replayClock := &mclock.Simulated{}
+	replayCm := NewClientManager(50, 10, 1000000000, replayClock)
+	defer replayCm.Stop()
+
+	replay, err := Replay(trace, replayCm, replayClock, params)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if !reflect.DeepEqual(replay, trace) {
+		t.Errorf("replayed trace mismatch:\nhave %+v\nwant %+v", replay, trace)
+	}
+}
+
+// Tests that the recorder keeps at most its limit of events.
+func TestTraceRecorderLimit(t *testing.T) {
+	clock := &mclock.Simulated{}
+	cm := NewClientManager(50, 10, 1000000000, clock)
+	defer cm.Stop()
+
+	recorder := NewTraceRecorder(clock, 3)
+	cm.SetTraceRecorder(recorder)
+
+	node := NewClientNode(cm, &ServerParams{BufLimit: 1000, MinRecharge: 1})
+	node.AcceptRequest() // not recorded without an ID
+	node.RequestProcessed(100)
+	node.SetID("a")
+	for i := 0; i < 3; i++ {
+		node.AcceptRequest()
+		node.RequestProcessed(100)
+	}
+	if events, dropped := recorder.Events(); len(events) != 3 || dropped != 3 {
+		t.Errorf("recorder limit mismatch: have %d events, %d dropped, want 3, 3", len(events), dropped)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package flowcontrol
+
+import (
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+// UnderrunAction is the penalty of a client sending a request its buffer value
+// can't cover, which would drive the buffer below zero.
+type UnderrunAction int
+
+const (
+	// UnderrunWarn logs the underrun, the request is served with the buffer
+	// drained to zero.
+	UnderrunWarn UnderrunAction = iota
+
+	// UnderrunFreeze serves the request, but no further requests of the client
+	// for the freeze time of the policy.
+	UnderrunFreeze
+
+	// UnderrunDisconnect refuses the request and disconnects the client.
+	UnderrunDisconnect
+)
+
+func (a UnderrunAction) String() string {
+	switch a {
+	case UnderrunWarn:
+		return "warn"
+	case UnderrunFreeze:
+		return "freeze"
+	default:
+		return "disconnect"
+	}
+}
+
+// UnderrunPolicy escalates the penalty of the clients repeatedly underrunning
+// their buffers: the first Warnings underruns are only logged, the next Freezes
+// ones freeze the client for FreezeTime each, and any further one disconnects it.
+// The count is reset after ForgiveTime without underruns, so clients with badly
+// estimated costs now and then are not disconnected eventually.
+//
+/**
+UnderrunPolicy: client 的 req 超出其 buffer value (会把 bufValue 扣成负数) 时的 逐级惩罚
+	前 Warnings 次: 只记录日志 (req 照常处理, buffer 扣到 0)
+	之后 Freezes 次: 冻结该 client FreezeTime, 期间不处理它的 req
+	再之后: 断开连接
+	连续 ForgiveTime 没有再次超出时, 计数清零
+ */
+type UnderrunPolicy struct {
+	Warnings    int
+	Freezes     int
+	FreezeTime  time.Duration
+	ForgiveTime time.Duration
+}
+
+// DefaultUnderrunPolicy is the underrun policy of the client managers.
+var DefaultUnderrunPolicy = UnderrunPolicy{
+	Warnings:    2,
+	Freezes:     2,
+	FreezeTime:  10 * time.Second,
+	ForgiveTime: 10 * time.Minute,
+}
+
+// UnderrunStats counts the buffer underruns of the clients of a manager by the
+// penalty applied.
+type UnderrunStats struct {
+	Warnings    uint64 `json:"warnings"`
+	Freezes     uint64 `json:"freezes"`
+	Disconnects uint64 `json:"disconnects"`
+}
+
+// SetUnderrunPolicy sets the penalties of the clients underrunning their buffers.
+func (self *ClientManager) SetUnderrunPolicy(policy UnderrunPolicy) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.underrunPolicy = policy
+}
+
+// UnderrunStats returns the number of underruns of the clients since the start
+// of the manager.
+func (self *ClientManager) UnderrunStats() UnderrunStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.underrunStats
+}
+
+// countUnderrun counts the penalty applied for an underrun.
+func (self *ClientManager) countUnderrun(action UnderrunAction) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	switch action {
+	case UnderrunWarn:
+		self.underrunStats.Warnings++
+	case UnderrunFreeze:
+		self.underrunStats.Freezes++
+	default:
+		self.underrunStats.Disconnects++
+	}
+}
+
+// policy returns the underrun policy of the manager.
+func (self *ClientManager) policy() UnderrunPolicy {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.underrunPolicy
+}
+
+// Underrun is called when the client sends a request costing more than its
+// buffer value. It returns the penalty escalated to by the policy of the
+// manager, freezing the client if needed.
+func (peer *ClientNode) Underrun() UnderrunAction {
+	policy := peer.cm.policy()
+	now := peer.cm.clock.Now()
+
+	peer.lock.Lock()
+	if peer.underruns > 0 && time.Duration(now-peer.lastUnderrun) > policy.ForgiveTime {
+		peer.underruns = 0
+	}
+	peer.underruns++
+	peer.lastUnderrun = now
+
+	var action UnderrunAction
+	switch {
+	case peer.underruns <= policy.Warnings:
+		action = UnderrunWarn
+	case peer.underruns <= policy.Warnings+policy.Freezes:
+		action = UnderrunFreeze
+		peer.frozenUntil = now + mclock.AbsTime(policy.FreezeTime)
+	default:
+		action = UnderrunDisconnect
+	}
+	peer.lock.Unlock()
+
+	peer.cm.countUnderrun(action)
+	return action
+}
+
+// Frozen returns whether the client is frozen for an underrun, and if so, the
+// time until it's served again.
+func (peer *ClientNode) Frozen() (bool, time.Duration) {
+	now := peer.cm.clock.Now()
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	if now >= peer.frozenUntil {
+		return false, 0
+	}
+	return true, time.Duration(peer.frozenUntil - now)
+}
@@ -18,6 +18,8 @@
 package les
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -36,6 +38,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/downloader"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
@@ -53,6 +56,7 @@ const (
 
 	MaxHeaderFetch           = 192 // Amount of block headers to be fetched per retrieval request
 	MaxBodyFetch             = 32  // Amount of block bodies to be fetched per retrieval request
+	MaxBodyStreamFetch       = 512 // Amount of block bodies to be fetched per request if responses are streamed
 	MaxReceiptFetch          = 128 // Amount of transaction receipts to allow fetching per request
 	MaxCodeFetch             = 64  // Amount of contract codes to allow fetching per request
 	// 每个检索请求将获取的Merkle证明数量
@@ -62,6 +66,10 @@ const (
 	MaxTxStatus              = 256 // Amount of transactions to queried per request
 
 	disableClientRemovePeer = false
+
+	// handshakeBudget is the time an inbound peer has to complete the les status
+	// exchange once the devp2p handshakes are done.
+	handshakeBudget = 10 * time.Second
 )
 
 func errResp(code errCode, format string, v ...interface{}) error {
@@ -89,6 +97,12 @@ type txPool interface {
 	Status(hashes []common.Hash) []core.TxStatus
 }
 
+// nonceTxPool is implemented by the transaction pools which can tell the pending
+// nonces of the senders, needed for the nonce advice.
+type nonceTxPool interface {
+	State() *state.ManagedState
+}
+
 type ProtocolManager struct {
 	// 是否是 轻节点
 	lightSync   bool // Client: true,  Server: false
@@ -121,6 +135,17 @@ type ProtocolManager struct {
 	// 限制当前 节点 最多可连接多少个对端peer
 	maxPeers   int
 
+	// Client: require signed announcements from untrusted servers
+	// 是否要求 非可信的 server 对广播的 header 签名
+	signedAnnounce bool
+	// Client: announcement histories of the untrusted servers, nil if all of them sign
+	announceTrust *announceTrust
+	// Client: servers voting on the head in ultra-light mode, nil if disabled
+	ulc *ulc
+	// Client: ask the servers to sign their responses, keeping the invalid ones as evidence
+	signedResponses bool
+	evidence        *responseEvidence
+
 	eventMux *event.TypeMux
 
 	// channels for fetcher, syncer, txsyncLoop
@@ -131,6 +156,10 @@ type ProtocolManager struct {
 	// wait group is used for graceful shutdowns during downloading
 	// and processing
 	wg *sync.WaitGroup
+
+	slotStats   *slotStats     // Server: storage slot reads by account, for the state hints
+	stateHintCh chan stateHint // Client: hinted storage slots waiting for prefetching
+	costRef     *costReference // Client: average response times of the servers, for the cost estimates
 }
 
 // NewProtocolManager returns a new ethereum sub protocol manager. The Ethereum sub protocol manages peers capable
@@ -163,6 +192,10 @@ func NewProtocolManager(chainConfig *params.ChainConfig, lightSync bool, network
 	if odr != nil {
 		manager.retriever = odr.retriever    // 请求分发器
 		manager.reqDist = odr.retriever.dist // 请求拉取管理器 (请求分发器更上一层)
+		manager.stateHintCh = make(chan stateHint, stateHintQueue)
+		manager.costRef = newCostReference()
+	} else {
+		manager.slotStats = newSlotStats()
 	}
 
 	// 获取 removePeerFunc 的指针
@@ -197,10 +230,18 @@ func (pm *ProtocolManager) Start(maxPeers int) {
 	// todo 当前是Client端的话
 	if pm.lightSync {
 		go pm.syncer()
+		if pm.odr != nil {
+			pm.wg.Add(1)
+			go pm.stateHintLoop()
+		}
 	} else {
 
 		// todo 如果当前是 Server端的话
 		pm.clientPool = newFreeClientPool(pm.chainDb, maxPeers, 10000, mclock.System{})
+		if pm.txpool != nil {
+			pm.wg.Add(1)
+			go pm.txStatusLoop()
+		}
 		go func() {
 			for range pm.newPeerCh {
 			}
@@ -282,7 +323,11 @@ func (pm *ProtocolManager) runPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWrit
 }
 
 func (pm *ProtocolManager) newPeer(pv int, nv uint64, p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
-	return newPeer(pv, nv, p, newMeteredMsgWriter(rw))
+	peer := newPeer(pv, nv, p, newMeteredMsgWriter(rw))
+	if pm.costRef != nil {
+		peer.costEstimate = newCostEstimator(pm.costRef)
+	}
+	return peer
 }
 
 // handle is the callback invoked to manage the life cycle of a les peer. When
@@ -316,6 +361,27 @@ func (pm *ProtocolManager) handle(p *peer) error {
 	)
 
 
+	// Servers not marked as trusted have to sign their announcements if the client
+	// asks for it, otherwise they could feed us fake heads. The ones with a long
+	// history of valid signatures are trusted with simple announcements.
+	if pm.lightSync && pm.signedAnnounce && !p.Peer.Info().Network.Trusted {
+		p.requestAnnounceType = announceTypeSigned
+		if pm.announceTrust != nil {
+			p.requestAnnounceType = pm.announceTrust.connect(p.ID())
+			defer pm.announceTrust.disconnect(p.ID())
+		}
+	}
+	p.requestSignedResponses = pm.lightSync && pm.signedResponses
+	// In ultra-light mode only the announcements of the voting servers are used,
+	// the others are asked for none.
+	if pm.lightSync && pm.ulc != nil {
+		if pm.ulc.trusted(p.ID()) {
+			p.requestAnnounceType = announceTypeSimple
+		} else {
+			p.noAnnounce = true
+		}
+	}
+
 	/**
 	TODO 处理 轻节点和全节点 握手 (即 tcp 的校验性链接)
 	todo 只是简单的发起 握手,并没有处理 TCP 连接之后的各种消息
@@ -325,6 +391,7 @@ func (pm *ProtocolManager) handle(p *peer) error {
 		p.Log().Debug("Light Ethereum handshake failed", "err", err)
 		return err
 	}
+	p.Peer.HandshakeDone("les")
 
 
 
@@ -347,10 +414,28 @@ func (pm *ProtocolManager) handle(p *peer) error {
 			}
 			defer pm.clientPool.disconnect(id)
 		}
+		p.subnet = subnetOf(p.RemoteAddr())
 	}
 
 	if rw, ok := p.rw.(*meteredMsgReadWriter); ok {
-		rw.Init(p.version)
+		rw.Init(p.version, p.id)
+		defer rw.expire()
+	}
+	// Count the bytes sent to the clients, capping the untrusted ones
+	//
+	// 统计 server 发送给 client 的字节数, 非可信 client 受每日上限约束
+	if !pm.lightSync && pm.server != nil {
+		if !p.Peer.Info().Network.Trusted && pm.server.bandwidth != nil {
+			pm.server.bandwidth.prune()
+			p.bandwidth = pm.server.bandwidth
+		}
+		p.rw = &bandwidthMsgWriter{MsgReadWriter: p.rw, peer: p}
+	}
+	// Sign the responses if the client asked for it
+	//
+	// client 要求时, server 对每个 resp 签名
+	if !pm.lightSync && p.signResponses {
+		p.rw = &signingMsgWriter{MsgReadWriter: p.rw, key: pm.server.privateKey}
 	}
 	// Register the peer locally
 	/**
@@ -371,6 +456,13 @@ func (pm *ProtocolManager) handle(p *peer) error {
 		// 从pm的peerSet中移除 对端peer
 		pm.removePeer(p.id)
 	}()
+	// Track the service level provided to the client
+	//
+	// 统计 server 对该 client 的服务水平 (SLA)
+	if pm.server != nil && pm.server.sla != nil {
+		pm.server.sla.connect(p.id)
+		defer pm.server.sla.disconnect(p.id)
+	}
 	// Register the peer in the downloader. If the downloader considers it banned, we disconnect
 	//
 	// 在 downloader中注册 该对端peer。
@@ -384,7 +476,8 @@ func (pm *ProtocolManager) handle(p *peer) error {
 		if pm.fetcher != nil {
 
 			// todo 根据可能的 header 去在本地的 `对端peer的缓存信息` 上拉取最高块的 header 的 hash, num, td 等等 announce msg
-			pm.fetcher.announce(p, head)
+			// (需要在 fetcher 的 registerPeer 之后)
+			pm.peers.afterRegistration(p, func() { pm.fetcher.announce(p, head) })
 		}
 
 		if p.poolEntry != nil {
@@ -394,6 +487,8 @@ func (pm *ProtocolManager) handle(p *peer) error {
 
 	stop := make(chan struct{})
 	defer close(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	/**
 	todo 超级重要这个携程
@@ -410,9 +505,9 @@ func (pm *ProtocolManager) handle(p *peer) error {
 			 */
 			case announce := <-p.announceChn:
 
-				// 发送新block header 通知
+				// 发送新block header 通知 (走 sendQueue 的高优先级通道, 不排在 数据响应 之后)
 				// todo 消息在 `pm.handleMsg(p)` 中被处理
-				p.SendAnnounce(announce)
+				p.queueAnnounce(ctx, announce)
 			case <-stop:
 				return
 			}
@@ -433,7 +528,24 @@ func (pm *ProtocolManager) handle(p *peer) error {
 }
 
 // TODO 轻节点的请求 集
-var reqList = []uint64{GetBlockHeadersMsg, GetBlockBodiesMsg, GetCodeMsg, GetReceiptsMsg, GetProofsV1Msg, SendTxMsg, SendTxV2Msg, GetTxStatusMsg, GetHeaderProofsMsg, GetProofsV2Msg, GetHelperTrieProofsMsg}
+var reqList = []uint64{GetBlockHeadersMsg, GetBlockBodiesMsg, GetCodeMsg, GetReceiptsMsg, GetProofsV1Msg, SendTxMsg, SendTxV2Msg, GetTxStatusMsg, TxStatusSubscribeMsg, GetHeaderProofsMsg, GetProofsV2Msg, GetHelperTrieProofsMsg, GetBufferValueMsg}
+
+// replyBusy answers a client request without serving it, telling the client to
+// retry after the given time. The answer is queued behind the pending replies,
+// as it carries a newer buffer value. It may only be sent to the clients that
+// agreed to the server busy replies in the handshake.
+func (pm *ProtocolManager) replyBusy(p *peer, msg p2p.Msg, retry time.Duration) error {
+	var req struct {
+		ReqID uint64
+		Rest  []rlp.RawValue `rlp:"tail"`
+	}
+	if err := msg.Decode(&req); err != nil {
+		return errResp(ErrDecode, "msg %v: %v", msg, err)
+	}
+	p.fcClient.AcceptRequest()
+	bv, _ := p.fcClient.RequestProcessed(0)
+	return p.queueReply(func() error { return p.SendServerBusy(req.ReqID, bv, retry) })
+}
 
 // handleMsg is invoked whenever an inbound message is received from a remote
 // peer. The remote connection is torn down upon returning any error.
@@ -446,6 +558,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		return err
 	}
 	p.Log().Trace("Light Ethereum message arrived", "code", msg.Code, "bytes", msg.Size)
+	arrived := mclock.Now()
 
 
 	// 根据不同的 msg.Code 获取
@@ -455,6 +568,9 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	//
 	// reqCnt: req的checkpoint <这里的checkpoint 指的是, req数据的数量级, 且没特指是哪种数据>
 	// maxCnt: max的checkpoint
+	//
+	// refused: req 因为 client 的 buffer 不足 而被拒绝 (计入 SLA 的 forced wait)
+	var refused bool
 	reject := func(reqCnt, maxCnt uint64) bool {
 
 		// 如果该 peer 是 light 的server 端,
@@ -479,7 +595,20 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// 如果计算出的预计消耗 令牌 > 剩余可消耗令牌
 		if cost > bufValue {
 			recharge := time.Duration((cost - bufValue) * 1000000 / pm.server.defParams.MinRecharge)
+
+			// 超出 buffer 的 req 按策略逐级惩罚: 警告 / 冻结 (本次 req 仍然处理), 最后断开连接
+			switch action := p.fcClient.Underrun(); action {
+			case flowcontrol.UnderrunWarn, flowcontrol.UnderrunFreeze:
+				underrunMeters[action].Mark(1)
+				p.Log().Warn("Request came too early", "recharge", common.PrettyDuration(recharge), "penalty", action)
+				return false
+			}
+			underrunMeters[flowcontrol.UnderrunDisconnect].Mark(1)
 			p.Log().Error("Request came too early", "recharge", common.PrettyDuration(recharge))
+			if pm.server.sla != nil {
+				pm.server.sla.forcedWait(p.id)
+			}
+			refused = true
 			return true
 		}
 		return false
@@ -494,12 +623,126 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	// TODO Discard: 会将所有剩余的有效负载数据读入黑洞
 	defer msg.Discard()
 
+	// Client requests are admitted to a serving thread in priority order
+	//
+	// client 的 req 需要按照优先级排队等待处理线程
+	if costs != nil && p.fcClient != nil && pm.server != nil && pm.server.servingQueue != nil {
+		// If the server is overloaded, tell the clients supporting server busy
+		// replies to retry low priority requests later instead of queueing them.
+		// The other ones are handled like LES/1 clients.
+		//
+		// server 过载时, 低优先级的 req 直接回复 "retry after" (仅限握手时声明了 "serverBusy" 的 client),
+		// 其他 client 按 LES/1 的方式处理
+		breaker, sla := pm.server.breaker, pm.server.sla
+
+		// A client having used up its daily quota is told when to come back
+		// (if supported) and disconnected
+		//
+		// client 超出每日字节上限: 支持 "serverBusy" 的 client 回复 "retry after" (配额恢复的时间), 然后断开连接
+		if p.bandwidth != nil {
+			if over, retry := p.bandwidth.exceeded(p.id); over {
+				quotaExceededMeter.Mark(1)
+				if p.serverBusy {
+					// the client is disconnected, make sure it's told when to come back
+					if pm.replyBusy(p, msg, retry) == nil {
+						p.flushReplies()
+					}
+				}
+				return errResp(ErrServiceQuotaExceeded, "retry after %v", retry)
+			}
+		}
+		// A client frozen for underrunning its buffer is told to retry after the
+		// freeze (if supported), or not read until then (LES/1)
+		//
+		// 因超出 buffer 被冻结的 client: 支持 "serverBusy" 的回复 "retry after", 其他的 延迟读取下一条 msg
+		if frozen, retry := p.fcClient.Frozen(); frozen {
+			if sla != nil {
+				sla.forcedWait(p.id)
+			}
+			if p.serverBusy {
+				return pm.replyBusy(p, msg, retry)
+			}
+			select {
+			case <-time.After(retry):
+			case <-pm.quitSync:
+				return p2p.DiscQuitting
+			}
+		}
+		if breaker != nil && p.serverBusy {
+			if busy, retry := breaker.reject(msg.Code, mclock.Now()); busy {
+				if sla != nil {
+					sla.forcedWait(p.id)
+				}
+				return pm.replyBusy(p, msg, retry)
+			}
+		}
+		// The clients of a subnet sending more requests than allowed are told to
+		// retry later (if supported) or slowed down by not reading their next
+		// message until a request token is available (LES/1). A LES/1 client still
+		// finding no token after the wait, since other clients of the subnet took
+		// it, is disconnected.
+		//
+		// 同一 IP 子网的 client 超出 req 速率时: 支持 "serverBusy" 的回复 "retry after", 其他的 延迟读取下一条 msg,
+		// 等待后 仍然拿不到 token 的 client 被断开
+		if limiter := pm.server.subnetLimiter; limiter != nil {
+			if ok, retry := limiter.allow(p.subnet); !ok {
+				if sla != nil {
+					sla.forcedWait(p.id)
+				}
+				if p.serverBusy {
+					return pm.replyBusy(p, msg, retry)
+				}
+				select {
+				case <-time.After(retry):
+				case <-pm.quitSync:
+					return p2p.DiscQuitting
+				}
+				if ok, _ := limiter.allow(p.subnet); !ok {
+					return errResp(ErrRequestRejected, "subnet request rate exceeded")
+				}
+			}
+		}
+		queued := mclock.Now()
+		if !pm.server.servingQueue.enter(servingPriority(p), pm.quitSync) {
+			return p2p.DiscQuitting
+		}
+		defer pm.server.servingQueue.leave()
+
+		// Measure the answering time of the request from its arrival, including
+		// the time waited for a serving thread
+		//
+		// 统计 req 从到达 到 应答完成 的时间 (包括排队等待处理线程的时间)
+		if sla != nil {
+			defer func() {
+				if !refused {
+					sla.served(p.id, time.Duration(mclock.Now()-arrived))
+				}
+			}()
+		}
+
+		if breaker != nil {
+			now := mclock.Now()
+			breaker.observe(time.Duration(now-queued), now)
+		}
+	}
+
 
 	/**
 	todo 交付的消息
 	 */
 	var deliverMsg *Msg
 
+	// Responses of a server signing them are checked against the signatures sent
+	// ahead, and kept as evidence if found invalid
+	//
+	// 签名模式下, 校验 resp 与之前收到的签名是否匹配, 无效的 resp 作为证据保留
+	var signed *SignedResponse
+	if pm.lightSync && p.signResponses && signedResponseCodes[msg.Code] {
+		if signed, err = p.checkResponseSig(&msg); err != nil {
+			return err
+		}
+	}
+
 	// Handle the message depending on its contents
 	//
 	// 根据消息内容处理消息
@@ -559,12 +802,18 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			return errResp(ErrDecode, "%v: %v", msg, err)
 		}
 
-		if p.requestAnnounceType == announceTypeSigned { // 这个也是, 因为目前没看到对这个 p.requestAnnounceType 赋值 这个的地方啊
+		if p.requestAnnounceType == announceTypeSigned { // client 开启了 signedAnnounce 且 对端 server 不是可信节点时
 			if err := req.checkSignature(p.pubKey); err != nil {
 				p.Log().Trace("Invalid announcement signature", "err", err)
-				return err
+				if pm.announceTrust != nil {
+					pm.announceTrust.invalid(p.ID())
+				}
+				return errResp(ErrInvalidResponse, "announcement signature: %v", err)
 			}
 			p.Log().Trace("Valid announcement signature")
+			if pm.announceTrust != nil {
+				pm.announceTrust.valid(p.ID())
+			}
 		}
 
 		p.Log().Trace("Announce message content", "number", req.Number, "hash", req.Hash, "td", req.Td, "reorg", req.ReorgDepth)
@@ -700,7 +949,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		pm.server.fcCostStats.update(msg.Code, query.Amount, rcost)
 
 		// reqId, BV, headers
-		return p.SendBlockHeaders(req.ReqID, bv, headers)
+		return p.queueReply(func() error { return p.SendBlockHeaders(req.ReqID, bv, headers) })
 
 	/**
 	todo #################################
@@ -721,7 +970,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	todo #################################
 	 */
 	case BlockHeadersMsg:
-		if pm.downloader == nil {
+		if pm.downloader == nil && pm.odr == nil {
 			return errResp(ErrUnexpectedResponse, "")
 		}
 
@@ -736,13 +985,20 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 
 		// 根据对端节点的 server 调整消耗
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 
 
 		// 将resp 回来的header做交付, 可能是将 header 入链
-		if pm.fetcher != nil && pm.fetcher.requestedID(resp.ReqID) {
+		if pm.odr != nil && pm.retriever.requested(resp.ReqID) {
+			// header range of an ODR retrieval, 交给 retriever 做 hash 链校验
+			deliverMsg = &Msg{
+				MsgType: MsgBlockHeaders,
+				ReqID:   resp.ReqID,
+				Obj:     resp.Headers,
+			}
+		} else if pm.fetcher != nil && pm.fetcher.requestedID(resp.ReqID) {
 			pm.fetcher.deliverHeaders(p, resp.ReqID, resp.Headers)
-		} else {
+		} else if pm.downloader != nil {
 
 			// todo 这里交付给 downloader 去插 header了
 			err := pm.downloader.DeliverHeaders(p.id, resp.Headers)
@@ -771,12 +1027,26 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			bodies []rlp.RawValue
 		)
 		reqCnt := len(req.Hashes)
-		if reject(uint64(reqCnt), MaxBodyFetch) {
+		maxCnt := uint64(MaxBodyFetch)
+		if p.bodyStreaming {
+			maxCnt = MaxBodyStreamFetch
+		}
+		if reject(uint64(reqCnt), maxCnt) {
 			return errResp(ErrRequestRejected, "")
 		}
 		for _, hash := range req.Hashes {
 			if bytes >= softResponseLimit {
-				break
+				if !p.bodyStreaming {
+					break
+				}
+				// flush the collected bodies as an intermediate chunk and keep going
+				//
+				// 分块发送: 先将已收集的 bodies 发送出去
+				chunk := bodies
+				if err := p.queueReply(func() error { return p.SendBlockBodiesChunkRLP(req.ReqID, 0, chunk, true) }); err != nil {
+					return err
+				}
+				bytes, bodies = 0, nil
 			}
 			// Retrieve the requested block body, stopping if enough was found
 			if number := rawdb.ReadHeaderNumber(pm.chainDb, hash); number != nil {
@@ -788,7 +1058,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
-		return p.SendBlockBodiesRLP(req.ReqID, bv, bodies)
+		return p.queueReply(func() error { return p.SendBlockBodiesRLP(req.ReqID, bv, bodies) })
 
 
 	/**
@@ -805,12 +1075,30 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			ReqID, BV uint64 // BV: Buffer Value
 			Data      []*types.Body
 		}
-		if err := msg.Decode(&resp); err != nil {
+		if p.bodyStreaming {
+			// streamed responses are collected until the last chunk arrives
+			var chunk struct {
+				ReqID, BV uint64
+				Data      []*types.Body
+				More      bool
+			}
+			if err := msg.Decode(&chunk); err != nil {
+				return errResp(ErrDecode, "msg %v: %v", msg, err)
+			}
+			bodies, complete, err := p.collectBodyChunk(chunk.ReqID, chunk.Data, chunk.More)
+			if err != nil {
+				return err
+			}
+			if !complete {
+				return nil
+			}
+			resp.ReqID, resp.BV, resp.Data = chunk.ReqID, chunk.BV, bodies
+		} else if err := msg.Decode(&resp); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
 
 		// 调节 Server 资源
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 
 		/**
 		交付类型
@@ -844,30 +1132,33 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		if reject(uint64(reqCnt), MaxCodeFetch) {
 			return errResp(ErrRequestRejected, "")
 		}
-		for _, req := range req.Reqs {
-			// Retrieve the requested state entry, stopping if enough was found
-			if number := rawdb.ReadHeaderNumber(pm.chainDb, req.BHash); number != nil {
-				if header := rawdb.ReadHeader(pm.chainDb, req.BHash, *number); header != nil {
-					statedb, err := pm.blockchain.State()
-					if err != nil {
-						continue
-					}
-					account, err := pm.getAccount(statedb, header.Root, common.BytesToHash(req.AccKey))
-					if err != nil {
-						continue
-					}
-					code, _ := statedb.Database().TrieDB().Node(common.BytesToHash(account.CodeHash))
-
-					data = append(data, code)
-					if bytes += len(code); bytes >= softResponseLimit {
-						break
+		if statedb, err := pm.blockchain.State(); err == nil {
+			// Resolve the code hashes of the accounts, then read all the codes at once
+			var addrHashes, codeHashes []common.Hash
+			for _, req := range req.Reqs {
+				if number := rawdb.ReadHeaderNumber(pm.chainDb, req.BHash); number != nil {
+					if header := rawdb.ReadHeader(pm.chainDb, req.BHash, *number); header != nil {
+						account, err := pm.getAccount(statedb, header.Root, common.BytesToHash(req.AccKey))
+						if err != nil {
+							continue
+						}
+						addrHashes = append(addrHashes, common.BytesToHash(req.AccKey))
+						codeHashes = append(codeHashes, common.BytesToHash(account.CodeHash))
 					}
 				}
 			}
+			codes, _ := statedb.Database().ContractCodes(addrHashes, codeHashes)
+			for _, code := range codes {
+				// Stop if enough was found
+				data = append(data, code)
+				if bytes += len(code); bytes >= softResponseLimit {
+					break
+				}
+			}
 		}
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
-		return p.SendCode(req.ReqID, bv, data)
+		return p.queueReply(func() error { return p.SendCode(req.ReqID, bv, data) })
 
 	/**
 	处理拉取 code 的resp
@@ -886,7 +1177,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		if err := msg.Decode(&resp); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 		deliverMsg = &Msg{
 			MsgType: MsgCode,
 			ReqID:   resp.ReqID,
@@ -953,7 +1244,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
-		return p.SendReceiptsRLP(req.ReqID, bv, receipts)
+		return p.queueReply(func() error { return p.SendReceiptsRLP(req.ReqID, bv, receipts) })
 
 	/**
 	todo #################################
@@ -986,7 +1277,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		if err := msg.Decode(&resp); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 		deliverMsg = &Msg{
 			MsgType: MsgReceipts,
 			ReqID:   resp.ReqID,
@@ -1099,7 +1390,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
 
 		// todo 将本节点组装好的proof发回client
-		return p.SendProofs(req.ReqID, bv, proofs)
+		return p.queueReply(func() error { return p.SendProofs(req.ReqID, bv, proofs) })
 
 	/**
 	todo #################################
@@ -1133,8 +1424,8 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// Gather state data until the fetch or network limits is reached
 		var (
 			lastBHash common.Hash
-			statedb   *state.StateDB
-			root      common.Hash
+			reader    *state.BatchReader
+			readers   = make(map[common.Hash]*state.BatchReader)
 		)
 
 		// 请求 checkpoint 的长度 !?
@@ -1148,53 +1439,72 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// 构建一个node的Set
 		nodes := light.NewNodeSet()
 
+		// 顺带推送给 client 的 state access hint
+		var hints []stateHint
+
 		// TODO  遍历所有 proof req
-		for _, req := range req.Reqs {
-			// Look up the state belonging to the request
+		reqs := req.Reqs
+		for len(reqs) > 0 {
+			// Consecutive requests for the same trie are proven in one pass
 			//
-			// 查找属于 req的 state
-			if statedb == nil || req.BHash != lastBHash {
-				statedb, root, lastBHash = nil, common.Hash{}, req.BHash
+			// 连续的 针对同一个 trie (同一个 block 且 同一个 account) 的 req 合并在一起, 一次性 prove
+			req := reqs[0]
+			keys := [][]byte{req.Key}
+			for _, next := range reqs[1:] {
+				if next.BHash != req.BHash || !bytes.Equal(next.AccKey, req.AccKey) || next.FromLevel != req.FromLevel {
+					break
+				}
+				keys = append(keys, next.Key)
+			}
+			reqs = reqs[len(keys):]
 
-				// 如果已经拉取足够的 state 的条目了,则停止拉取
-				if number := rawdb.ReadHeaderNumber(pm.chainDb, req.BHash); number != nil {
-					if header := rawdb.ReadHeader(pm.chainDb, req.BHash, *number); header != nil {
-						statedb, _ = pm.blockchain.State()
-						root = header.Root
+			// Look up the state belonging to the request, the reader of a state is
+			// reused by all the requests for the same block
+			//
+			// 查找属于 req的 state, 同一个 block 的 req 复用同一个 BatchReader (已解析的 account 与 storage trie)
+			if reader == nil || req.BHash != lastBHash {
+				lastBHash = req.BHash
+
+				var ok bool
+				if reader, ok = readers[req.BHash]; !ok {
+					if number := rawdb.ReadHeaderNumber(pm.chainDb, req.BHash); number != nil {
+						if header := rawdb.ReadHeader(pm.chainDb, req.BHash, *number); header != nil {
+							if statedb, _ := pm.blockchain.State(); statedb != nil {
+								reader, _ = state.NewBatchReader(header.Root, statedb.Database())
+							}
+						}
 					}
+					readers[req.BHash] = reader
 				}
 			}
-			if statedb == nil {
+			if reader == nil {
 				continue
 			}
-			// Pull the account or storage trie of the request
+			// Prove the user's request from the account or storage trie, the keys
+			// of a trie are proven in one traversal
 			//
-			// 提取请求的帐户或存储 trie
-			var trie state.Trie
+			// 从 account trie 或 storage trie 中 一次性 prove 所有的 key (共享路径上的 node 只遍历一次)
+			// todo fromLevel大于零，则可以从证明中省略最接近根的给定数量的trie节点
+			var err error
 			if len(req.AccKey) > 0 {
-				account, err := pm.getAccount(statedb, root, common.BytesToHash(req.AccKey))
-				if err != nil {
-					continue
-				}
-				trie, _ = statedb.Database().OpenStorageTrie(common.BytesToHash(req.AccKey), account.Root)
+				err = reader.ProveStorage(common.BytesToHash(req.AccKey), keys, req.FromLevel, nodes)
 			} else {
-				trie, _ = statedb.Database().OpenTrie(root)
+				err = reader.ProveAccounts(keys, req.FromLevel, nodes)
 			}
-			if trie == nil {
+			if err != nil {
 				continue
 			}
-			// Prove the user's request from the account or stroage trie
-			// 填充 nodes
-
-			// todo 来来来,这个贼重要
-			// trie的类型根据实际而定,
-			// todo State中的 trie是 cachedTrie
-			// todo Storage中的 trie是 SecureTrie
-			//
-			// todo 但是看了实现,最终的Prove 都是调用了 `SecureTrie.Prove`
-
-			// todo fromLevel大于零，则可以从证明中省略最接近根的给定数量的trie节点
-			trie.Prove(req.Key, req.FromLevel, nodes)
+			// Count the storage reads, hint the most frequent ones along with the accounts
+			if len(req.AccKey) > 0 {
+				pm.slotStats.record(common.BytesToHash(req.AccKey), keys)
+			} else if p.stateHints {
+				for _, key := range keys {
+					accKey := common.BytesToHash(key)
+					if slots := pm.slotStats.top(accKey, maxStateHintSlots); len(slots) > 0 {
+						hints = append(hints, stateHint{BHash: req.BHash, AccKey: accKey, Keys: slots})
+					}
+				}
+			}
 			if nodes.DataSize() >= softResponseLimit {
 				break
 			}
@@ -1202,7 +1512,16 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
 		// nodes.NodeList(): 将 nodes 转化成 nodeList
-		return p.SendProofsV2(req.ReqID, bv, nodes.NodeList())
+		proofs := nodes.NodeList()
+		return p.queueReply(func() error {
+			if err := p.SendProofsV2(req.ReqID, bv, proofs); err != nil {
+				return err
+			}
+			if len(hints) > 0 {
+				return p.SendStateHints(hints)
+			}
+			return nil
+		})
 
 	/**
 	todo #################################
@@ -1237,7 +1556,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 
 		// TODO 根据最新请求回复中包含的值来调整估计的缓冲区值
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 
 		/**
 		需要被处理的交付信息
@@ -1276,12 +1595,30 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			ReqID, BV uint64 // BV: Buffer Value
 			Data      light.NodeList
 		}
-		if err := msg.Decode(&resp); err != nil {
+		if p.proofStreaming {
+			// streamed responses are verified chunk by chunk and collected until the last one arrives
+			var chunk struct {
+				ReqID, BV    uint64
+				Index, Total uint64
+				Data         light.NodeList
+			}
+			if err := msg.Decode(&chunk); err != nil {
+				return errResp(ErrDecode, "msg %v: %v", msg, err)
+			}
+			nodes, _, complete, err := p.collectProofChunk(msg.Code, chunk.ReqID, chunk.Index, chunk.Total, chunk.Data, nil)
+			if err != nil {
+				return err
+			}
+			if !complete {
+				return nil
+			}
+			resp.ReqID, resp.BV, resp.Data = chunk.ReqID, chunk.BV, nodes
+		} else if err := msg.Decode(&resp); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
 
 		// TODO 根据最新请求回复中包含的值来调整估计的缓冲区值
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 
 		/**
 		需要被处理的交付信息
@@ -1383,7 +1720,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
-		return p.SendHeaderProofs(req.ReqID, bv, proofs)
+		return p.queueReply(func() error { return p.SendHeaderProofs(req.ReqID, bv, proofs) })
 
 	/**
 	todo #################################
@@ -1437,7 +1774,18 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			root     common.Hash
 			auxTrie  *trie.Trie
 		)
+		// The requests may mix the helper tries, keep the ones opened already
+		type helperTrieID struct {
+			typ uint
+			idx uint64
+		}
+		type openedTrie struct {
+			root common.Hash
+			trie *trie.Trie
+		}
+		opened := make(map[helperTrieID]openedTrie)
 
+		// 所有请求 (可能混合 CHT 和 BloomTrie) 的 proof 都放进 同一个 NodeSet, 共用的 node 只返回一次
 		nodes := light.NewNodeSet()  // Set 容器, 注意 和 List 的区别
 
 		// 遍历 所有 reqs
@@ -1452,8 +1800,14 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 				// 		htCanonical
 
 				// 这里根据  num -> CanonicalHash -> CHTRoot 或者 BloomTrieRoot
-				if root, prefix = pm.getHelperTrie(req.Type, req.TrieIdx); root != (common.Hash{}) {
-					auxTrie, _ = trie.New(root, trie.NewDatabase(ethdb.NewTable(pm.chainDb, prefix)))
+				id := helperTrieID{req.Type, req.TrieIdx}
+				if t, ok := opened[id]; ok {
+					root, auxTrie = t.root, t.trie
+				} else {
+					if root, prefix = pm.getHelperTrie(req.Type, req.TrieIdx); root != (common.Hash{}) {
+						auxTrie, _ = trie.New(root, trie.NewDatabase(ethdb.NewTable(pm.chainDb, prefix)))
+					}
+					opened[id] = openedTrie{root, auxTrie}
 				}
 			}
 
@@ -1489,7 +1843,8 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
-		return p.SendHelperTrieProofs(req.ReqID, bv, HelperTrieResps{Proofs: nodes.NodeList(), AuxData: auxData})  // nodes.NodeList()： 根据 proof 路径, 返回路径上 的所有 node原数据  list
+		resp := HelperTrieResps{Proofs: nodes.NodeList(), AuxData: auxData} // nodes.NodeList()： 根据 proof 路径, 返回路径上 的所有 node原数据  list
+		return p.queueReply(func() error { return p.SendHelperTrieProofs(req.ReqID, bv, resp) })
 
 
 	/**
@@ -1526,7 +1881,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		}
 
 		// 调节 server 的资源
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 
 		/**
 		交付类型
@@ -1568,14 +1923,33 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			ReqID, BV uint64 // BV: Buffer Value
 			Data      HelperTrieResps
 		}
-		if err := msg.Decode(&resp); err != nil {
+		if p.proofStreaming {
+			// streamed responses are verified chunk by chunk and collected until the last one arrives
+			var chunk struct {
+				ReqID, BV    uint64
+				Index, Total uint64
+				Data         HelperTrieResps
+			}
+			if err := msg.Decode(&chunk); err != nil {
+				return errResp(ErrDecode, "msg %v: %v", msg, err)
+			}
+			nodes, aux, complete, err := p.collectProofChunk(msg.Code, chunk.ReqID, chunk.Index, chunk.Total, chunk.Data.Proofs, chunk.Data.AuxData)
+			if err != nil {
+				return err
+			}
+			if !complete {
+				return nil
+			}
+			resp.ReqID, resp.BV = chunk.ReqID, chunk.BV
+			resp.Data = HelperTrieResps{Proofs: nodes, AuxData: aux}
+		} else if err := msg.Decode(&resp); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
 
 		/**
 		调节 server 的资源
 		 */
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
 
 		/**
 		交付类型
@@ -1680,12 +2054,18 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			}
 		}
 
+		// 被当作重放拒绝或因 nonce 空缺而排队的 tx, 告诉 client 其 sender 的 pending nonce
+		var advice []txNonceAdvice
+		if p.nonceAdvice {
+			advice = pm.nonceAdvice(req.Txs, stats)
+		}
+
 		// 调节 各种资源
 		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
 		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
 		// TODO 将 tx的状态发送回去
 		// todo 下面的 `TxStatusMsg` 有用
-		return p.SendTxStatus(req.ReqID, bv, stats)
+		return p.queueReply(func() error { return p.SendTxStatusAdvice(req.ReqID, bv, stats, advice) })
 
 	/**
 	todo #################################
@@ -1730,13 +2110,87 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 
 		// 回应 tx Status
 		// todo 下面的 `TxStatusMsg` 有用
-		return p.SendTxStatus(req.ReqID, bv, pm.txStatus(req.Hashes))
+		stats := pm.txStatus(req.Hashes)
+		return p.queueReply(func() error { return p.SendTxStatus(req.ReqID, bv, stats) })
+
+	/**
+	LPV2
+	Server 收到订阅 tx status 的req
+
+	回应所引用 tx 的当前 status, 之后 tx 被打包或被丢弃时, 由 server 通过 TxStatusUpdateMsg 主动推送
+	 */
+	case TxStatusSubscribeMsg:
+		if pm.txpool == nil || !p.txStatusPush {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+		var req struct {
+			ReqID  uint64
+			Hashes []common.Hash
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		reqCnt := len(req.Hashes)
+		if reject(uint64(reqCnt), MaxTxStatus) {
+			return errResp(ErrRequestRejected, "")
+		}
+		stats := pm.txStatus(req.Hashes)
+		p.subscribeTxStatus(req.Hashes, stats)
+
+		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost + uint64(reqCnt)*costs.reqCost)
+		pm.server.fcCostStats.update(msg.Code, uint64(reqCnt), rcost)
+		return p.queueReply(func() error { return p.SendTxStatus(req.ReqID, bv, stats) })
+
+	/**
+	LPV2
+	Client 处理 server 主动推送的 tx status 变化
+	 */
+	case TxStatusUpdateMsg:
+		if pm.odr == nil || !p.txStatusPush {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+
+		p.Log().Trace("Received tx status update")
+		var updates []txStatusUpdate
+		if err := msg.Decode(&updates); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if len(updates) > maxTxSubscriptions {
+			return errResp(ErrInvalidResponse, "too many status updates: %d", len(updates))
+		}
+		if pm.txrelay != nil {
+			pm.txrelay.statusUpdate(p, updates)
+		}
+
+	/**
+	LPV2
+	Client 处理 server 在 account proof 之后推送的 state access hint, 在后台预取其中的 storage slot
+	 */
+	case StateHintsMsg:
+		if pm.odr == nil || !p.stateHints {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+
+		p.Log().Trace("Received state access hints")
+		var hints []stateHint
+		if err := msg.Decode(&hints); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if len(hints) > MaxProofsFetch {
+			return errResp(ErrInvalidResponse, "too many state hints: %d", len(hints))
+		}
+		for _, hint := range hints {
+			if len(hint.Keys) > maxStateHintSlots {
+				return errResp(ErrInvalidResponse, "too many hinted slots: %d", len(hint.Keys))
+			}
+		}
+		pm.queueStateHints(hints)
 
 	/**
 	LPV2
 	Client 处理 jiaoyan tx status 的 resp
 
-	TODO  貌似没鸡吊 用
+	client 订阅 tx status 时收到的当前状态, 被 server 丢弃的 tx 会被重新广播
 	 */
 	case TxStatusMsg:
 		if pm.odr == nil {
@@ -1747,13 +2201,123 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		var resp struct {
 			ReqID, BV uint64 // BV: Buffer Value
 			Status    []txStatus
+			Nonces    []txNonceAdvice `rlp:"tail"` // only sent to the clients supporting nonce advice
 		}
 		if err := msg.Decode(&resp); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
+		if len(resp.Nonces) > 0 && !p.nonceAdvice {
+			return errResp(ErrUnexpectedResponse, "unrequested nonce advice")
+		}
 
 		// 调整 server 的资源
-		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		p.gotReply(resp.ReqID, resp.BV)
+		if pm.txrelay != nil {
+			pm.txrelay.deliverStatus(p, resp.ReqID, resp.Status)
+			pm.txrelay.deliverNonces(p, resp.Nonces)
+		}
+
+	/**
+	LPV2
+	Client 处理 server 过载时的 "retry after" 回复
+	 */
+	/**
+	LPV2
+	Server 收到 client 的流控状态 resync 请求, 回复权威的 buffer value
+	 */
+	case GetBufferValueMsg:
+		if pm.server == nil || p.fcClient == nil {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+		var req struct{ ReqID uint64 }
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		// 和其他 req 一样计入流控, 防止 client 用 resync 绕过 buffer
+		if reject(0, 0) {
+			return errResp(ErrRequestRejected, "")
+		}
+		bv, rcost := p.fcClient.RequestProcessed(costs.baseCost)
+		pm.server.fcCostStats.update(msg.Code, 0, rcost)
+		return p.queueReply(func() error { return p.SendBufferValue(req.ReqID, bv) })
+
+	/**
+	LPV2
+	Client 收到 server 的 buffer value, 重新校准流控的估计值
+	 */
+	case BufferValueMsg:
+		if pm.odr == nil || p.fcServer == nil {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+		var resp struct{ ReqID, BV uint64 }
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.gotBufferValue(resp.ReqID, resp.BV)
+
+	/**
+	LPV2
+	Client 收到 server 对下一个 resp 的签名
+	 */
+	case ResponseSigMsg:
+		if !pm.lightSync || !p.signResponses {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+		var sig responseSig
+		if err := msg.Decode(&sig); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if err := p.addResponseSig(sig); err != nil {
+			return err
+		}
+
+	/**
+	LPV2
+	Client 收到 server 即将停止的通知:
+	不再等待该 server 的 resp, 把 req 转给其他 server, 并按提示 推迟重拨 / 拨号 替代 server
+	 */
+	case StopAnnounceMsg:
+		if pm.odr == nil {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+		if !p.stopAnnounces() {
+			return errResp(ErrUnexpectedResponse, "unrequested stop announcement")
+		}
+		var stop stopAnnounce
+		if err := msg.Decode(&stop); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.Log().Debug("Server stopping", "resume", time.Duration(stop.ResumeAfter)*time.Second, "alternatives", len(stop.Alternatives))
+
+		// Stop sending requests to the server before the pending ones are resent
+		pm.removePeer(p.id)
+		pm.retriever.rejectPeer(p)
+		if pm.serverPool != nil && p.poolEntry != nil {
+			pm.serverPool.serverStopping(p.poolEntry, time.Duration(stop.ResumeAfter)*time.Second, stop.nodes())
+		}
+		return p2p.DiscRequested
+
+	case ServerBusyMsg:
+		if pm.odr == nil {
+			return errResp(ErrUnexpectedResponse, "")
+		}
+		if !p.serverBusy {
+			return errResp(ErrUnexpectedResponse, "unrequested server busy reply")
+		}
+
+		p.Log().Trace("Received server busy response")
+		var resp struct {
+			ReqID, BV  uint64 // BV: Buffer Value
+			RetryAfter uint64 // milliseconds
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.gotReply(resp.ReqID, resp.BV)
+
+		// Avoid the server for a while and send the request elsewhere
+		p.setBusy(time.Duration(resp.RetryAfter) * time.Millisecond)
+		pm.retriever.reject(p, resp.ReqID)
 
 	default:
 		p.Log().Trace("Received unknown message", "code", msg.Code)
@@ -1766,9 +2330,21 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	todo 这里是 将被需要交付的 data做处理
 	 */
 	if deliverMsg != nil {
+		deliverMsg.Size = msg.Size
 		err := pm.retriever.deliver(p, deliverMsg)
+		if err == nil && pm.serverPool != nil {
+			pm.serverPool.adjustServedBytes(p.poolEntry, uint64(msg.Size))
+		}
 		if err != nil {
 			p.responseErrors++
+			pm.peers.adjustScore(p, scoreResponseError)
+			if pm.announceTrust != nil {
+				pm.announceTrust.invalid(p.ID())
+			}
+			if signed != nil && pm.evidence != nil {
+				p.Log().Debug("Kept invalid signed response as evidence", "reqID", signed.ReqID, "err", err)
+				pm.evidence.add(signed, err)
+			}
 			// 为毛大于 50 个resp err时,返回最后一个 err !?
 			if p.responseErrors > maxResponseErrors {
 				return err
@@ -1843,6 +2419,40 @@ func (pm *ProtocolManager) txStatus(hashes []common.Hash) []txStatus {
 	return stats
 }
 
+// nonceAdvice returns the pending nonces of the senders of the transactions that
+// were rejected as replays or queued after a nonce gap, so the client can fix its
+// nonces without retrieving the account proofs.
+func (pm *ProtocolManager) nonceAdvice(txs []*types.Transaction, stats []txStatus) []txNonceAdvice {
+	pool, ok := pm.txpool.(nonceTxPool)
+	if !ok {
+		return nil
+	}
+	var (
+		signer = types.MakeSigner(pm.chainConfig, pm.blockchain.CurrentHeader().Number)
+		seen   = make(map[common.Address]struct{})
+		nonces *state.ManagedState
+		advice []txNonceAdvice
+	)
+	for i, tx := range txs {
+		if stats[i].Status != core.TxStatusQueued && stats[i].Error != core.ErrNonceTooLow.Error() {
+			continue
+		}
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[from]; ok {
+			continue
+		}
+		seen[from] = struct{}{}
+		if nonces == nil {
+			nonces = pool.State()
+		}
+		advice = append(advice, txNonceAdvice{Sender: from, Nonce: nonces.GetNonce(from)})
+	}
+	return advice
+}
+
 // downloaderPeerNotify implements peerSetNotify
 // peerSetNotify 的一个实现
 type downloaderPeerNotify ProtocolManager
@@ -20,19 +20,25 @@ import (
 	"encoding/binary"
 	"math/big"
 	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth/downloader"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
@@ -251,6 +257,64 @@ func testGetBlockBodies(t *testing.T, protocol int) {
 	}
 }
 
+// Tests that clients negotiating body streaming may request more bodies than
+// MaxBodyFetch and receive them in chunked responses.
+func TestGetBlockBodiesStreamedLes2(t *testing.T) {
+	pm := newTestProtocolManagerMust(t, false, MaxBodyFetch+15, nil, nil, nil, ethdb.NewMemDatabase())
+	bc := pm.blockchain.(*core.BlockChain)
+	peer, _ := newTestPeer(t, "peer", 2, pm, false)
+	defer peer.close()
+
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentHeader()
+		td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), keyValueList{}.add("bodyStreaming", nil))
+
+	var (
+		hashes []common.Hash
+		bodies []*types.Body
+	)
+	for i := uint64(1); i <= MaxBodyFetch+10; i++ {
+		block := bc.GetBlockByNumber(i)
+		hashes = append(hashes, block.Hash())
+		bodies = append(bodies, &types.Body{Transactions: block.Transactions(), Uncles: block.Uncles()})
+	}
+	cost := peer.GetRequestCost(GetBlockBodiesMsg, len(hashes))
+	sendRequest(peer.app, GetBlockBodiesMsg, 42, cost, hashes)
+
+	// all bodies fit into the soft response limit, expect a single final chunk
+	type chunk struct {
+		ReqID, BV uint64
+		Data      []*types.Body
+		More      bool
+	}
+	if err := p2p.ExpectMsg(peer.app, BlockBodiesMsg, chunk{42, testBufLimit, bodies, false}); err != nil {
+		t.Errorf("bodies mismatch: %v", err)
+	}
+}
+
+// Tests that the chunks of streamed body responses are reassembled by the client.
+func TestCollectBodyChunks(t *testing.T) {
+	p := &peer{bodyStreaming: true}
+	body := &types.Body{}
+
+	if _, complete, err := p.collectBodyChunk(1, []*types.Body{body, body}, true); complete || err != nil {
+		t.Fatalf("first chunk: complete %v, err %v", complete, err)
+	}
+	all, complete, err := p.collectBodyChunk(1, []*types.Body{body}, false)
+	if !complete || err != nil || len(all) != 3 {
+		t.Fatalf("last chunk: complete %v, err %v, %d bodies", complete, err, len(all))
+	}
+	if len(p.bodyChunks) != 0 {
+		t.Errorf("completed stream not released")
+	}
+	if _, _, err := p.collectBodyChunk(2, make([]*types.Body, MaxBodyStreamFetch+1), true); err == nil {
+		t.Errorf("oversized stream accepted")
+	}
+}
+
 // Tests that the contract codes can be retrieved based on account addresses.
 func TestGetCodeLes1(t *testing.T) { testGetCode(t, 1) }
 func TestGetCodeLes2(t *testing.T) { testGetCode(t, 2) }
@@ -284,6 +348,80 @@ func testGetCode(t *testing.T, protocol int) {
 	}
 }
 
+// Tests that the server reports the buffer value of the client on request.
+func TestGetBufferValueLes2(t *testing.T) {
+	pm := newTestProtocolManagerMust(t, false, 0, nil, nil, nil, ethdb.NewMemDatabase())
+	peer, _ := newTestPeer(t, "peer", 2, pm, true)
+	defer peer.close()
+
+	cost := peer.GetRequestCost(GetCodeMsg, 1)
+	sendRequest(peer.app, GetCodeMsg, 42, cost, []*CodeReq{{BHash: pm.blockchain.CurrentHeader().Hash()}})
+	msg, err := peer.app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read code reply: %v", err)
+	}
+	msg.Discard()
+
+	p2p.Send(peer.app, GetBufferValueMsg, struct{ ReqID uint64 }{43})
+	msg, err = peer.app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read buffer value: %v", err)
+	}
+	var resp struct{ ReqID, BV uint64 }
+	if msg.Code != BufferValueMsg {
+		t.Fatalf("message code mismatch: have %d, want %d", msg.Code, BufferValueMsg)
+	}
+	if err := msg.Decode(&resp); err != nil {
+		t.Fatalf("failed to decode buffer value: %v", err)
+	}
+	if resp.ReqID != 43 || resp.BV == 0 || resp.BV > testBufLimit {
+		t.Errorf("buffer value mismatch: %+v", resp)
+	}
+}
+
+// Tests that the overloaded server only sends server busy replies to the clients
+// that agreed to them in the handshake, and serves the other ones like LES/1 did.
+func TestServerBusyLes2(t *testing.T) {
+	test := func(agree bool) {
+		pm := newTestProtocolManagerMust(t, false, 0, nil, nil, nil, ethdb.NewMemDatabase())
+		pm.server.servingQueue = newServingQueue(1)
+		pm.server.breaker = newCircuitBreaker(breakerThreshold, breakerCooldown)
+		pm.server.breaker.open, pm.server.breaker.openUntil = true, mclock.Now()+mclock.AbsTime(time.Hour)
+
+		peer, _ := newTestPeer(t, "peer", 2, pm, false)
+		defer peer.close()
+
+		var (
+			genesis = pm.blockchain.Genesis()
+			head    = pm.blockchain.CurrentHeader()
+			td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+			options keyValueList
+		)
+		if agree {
+			options = options.add("serverBusy", nil)
+		}
+		peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), options)
+
+		cost := peer.GetRequestCost(GetCodeMsg, 1)
+		sendRequest(peer.app, GetCodeMsg, 42, cost, []*CodeReq{{BHash: head.Hash()}})
+		msg, err := peer.app.ReadMsg()
+		if err != nil {
+			t.Fatalf("agree %v: failed to read reply: %v", agree, err)
+		}
+		msg.Discard()
+
+		want := uint64(CodeMsg)
+		if agree {
+			want = ServerBusyMsg
+		}
+		if msg.Code != want {
+			t.Errorf("agree %v: reply code mismatch: have %d, want %d", agree, msg.Code, want)
+		}
+	}
+	test(true)
+	test(false)
+}
+
 // Tests that the transaction receipts can be retrieved based on hashes.
 func TestGetReceiptLes1(t *testing.T) { testGetReceipt(t, 1) }
 func TestGetReceiptLes2(t *testing.T) { testGetReceipt(t, 2) }
@@ -336,22 +474,25 @@ func testGetProofs(t *testing.T, protocol int) {
 		root := header.Root
 		trie, _ := trie.New(root, trie.NewDatabase(db))
 
+		var keys [][]byte
 		for _, acc := range accounts {
 			req := ProofReq{
 				BHash: header.Hash(),
 				Key:   crypto.Keccak256(acc[:]),
 			}
 			proofreqs = append(proofreqs, req)
+			keys = append(keys, req.Key)
 
-			switch protocol {
-			case 1:
+			if protocol == 1 {
 				var proof light.NodeList
 				trie.Prove(crypto.Keccak256(acc[:]), 0, &proof)
 				proofsV1 = append(proofsV1, proof)
-			case 2:
-				trie.Prove(crypto.Keccak256(acc[:]), 0, proofsV2)
 			}
 		}
+		// LES/2 servers prove all keys of the same trie in one pass
+		if protocol == 2 {
+			trie.ProveMulti(keys, 0, proofsV2)
+		}
 	}
 	// Send the proof request and verify the response
 	switch protocol {
@@ -370,6 +511,121 @@ func testGetProofs(t *testing.T, protocol int) {
 	}
 }
 
+// Tests that clients negotiating proof streaming receive the proofs in chunked
+// responses.
+func TestGetProofsStreamedLes2(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	peer, _ := newTestPeer(t, "peer", 2, pm, false)
+	defer peer.close()
+
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentHeader()
+		td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), keyValueList{}.add("proofStreaming", nil))
+
+	key := crypto.Keccak256(testBankAddress[:])
+	proofs := light.NewNodeSet()
+	trie, _ := trie.New(head.Root, trie.NewDatabase(db))
+	trie.Prove(key, 0, proofs)
+
+	reqs := []ProofReq{{BHash: head.Hash(), Key: key}}
+	cost := peer.GetRequestCost(GetProofsV2Msg, len(reqs))
+	sendRequest(peer.app, GetProofsV2Msg, 42, cost, reqs)
+
+	// the proof fits into a single chunk
+	type chunk struct {
+		ReqID, BV    uint64
+		Index, Total uint64
+		Data         light.NodeList
+	}
+	if err := p2p.ExpectMsg(peer.app, ProofsV2Msg, chunk{42, testBufLimit, 0, 1, proofs.NodeList()}); err != nil {
+		t.Errorf("proofs mismatch: %v", err)
+	}
+}
+
+// Tests that the most frequently read storage slots of an account are hinted
+// after the proofs of the account.
+func TestStateHintsLes2(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	peer, _ := newTestPeer(t, "peer", 2, pm, false)
+	defer peer.close()
+
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentHeader()
+		td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), keyValueList{}.add("stateHints", nil))
+
+	var (
+		accKey = crypto.Keccak256Hash(testContractAddr[:])
+		slotA  = crypto.Keccak256Hash(common.Hash{}.Bytes())
+		slotB  = crypto.Keccak256Hash(common.BigToHash(big.NewInt(1)).Bytes())
+	)
+	request := func(reqID uint64, reqs []ProofReq) {
+		cost := peer.GetRequestCost(GetProofsV2Msg, len(reqs))
+		sendRequest(peer.app, GetProofsV2Msg, reqID, cost, reqs)
+		msg, err := peer.app.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read proofs: %v", err)
+		}
+		if msg.Code != ProofsV2Msg {
+			t.Fatalf("response code mismatch: have %d, want %d", msg.Code, ProofsV2Msg)
+		}
+		msg.Discard()
+	}
+	// Read slot A twice and slot B once
+	request(1, []ProofReq{
+		{BHash: head.Hash(), AccKey: accKey[:], Key: slotA[:]},
+		{BHash: head.Hash(), AccKey: accKey[:], Key: slotB[:]},
+	})
+	request(2, []ProofReq{{BHash: head.Hash(), AccKey: accKey[:], Key: slotA[:]}})
+
+	// Request the account, expecting the slots hinted by frequency
+	request(3, []ProofReq{{BHash: head.Hash(), Key: accKey[:]}})
+	hints := []stateHint{{BHash: head.Hash(), AccKey: accKey, Keys: []common.Hash{slotA, slotB}}}
+	if err := p2p.ExpectMsg(peer.app, StateHintsMsg, hints); err != nil {
+		t.Fatalf("state hints mismatch: %v", err)
+	}
+	// Accounts without storage reads are not hinted
+	request(4, []ProofReq{{BHash: head.Hash(), Key: crypto.Keccak256(acc1Addr[:])}})
+	if slots := pm.slotStats.top(crypto.Keccak256Hash(acc1Addr[:]), maxStateHintSlots); len(slots) != 0 {
+		t.Fatalf("unexpected hinted slots: %x", slots)
+	}
+}
+
+// Tests that the least read slots are evicted when an account tracks too many.
+func TestSlotStatsEviction(t *testing.T) {
+	stats := newSlotStats()
+	acc := common.Hash{1}
+
+	for i := 0; i < maxTrackedHintSlots; i++ {
+		slot := common.BigToHash(big.NewInt(int64(i)))
+		for j := 0; j <= i%3; j++ {
+			stats.record(acc, [][]byte{slot[:]})
+		}
+	}
+	fresh := common.BigToHash(big.NewInt(1000))
+	stats.record(acc, [][]byte{fresh[:]})
+
+	slots := stats.top(acc, maxTrackedHintSlots+1)
+	if len(slots) != maxTrackedHintSlots {
+		t.Fatalf("tracked slot count mismatch: have %d, want %d", len(slots), maxTrackedHintSlots)
+	}
+	for _, slot := range slots {
+		if slot == (common.Hash{}) {
+			t.Fatalf("least read slot not evicted")
+		}
+	}
+	if top := stats.top(acc, 1); top[0] != common.BigToHash(big.NewInt(2)) {
+		t.Fatalf("most read slot mismatch: have %x", top[0])
+	}
+}
+
 // Tests that CHT proofs can be correctly retrieved.
 func TestGetCHTProofsLes1(t *testing.T) { testGetCHTProofs(t, 1) }
 func TestGetCHTProofsLes2(t *testing.T) { testGetCHTProofs(t, 2) }
@@ -576,3 +832,226 @@ func TestTransactionStatusLes2(t *testing.T) {
 	test(tx1, false, txStatus{Status: core.TxStatusPending})
 	test(tx2, false, txStatus{Status: core.TxStatusPending})
 }
+
+// Tests that the server advises the pending nonce of the sender along with the
+// status of the transactions queued after a nonce gap or rejected as replays.
+func TestTransactionNonceAdviceLes2(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	pm := newTestProtocolManagerMust(t, false, 0, nil, nil, nil, db)
+	chain := pm.blockchain.(*core.BlockChain)
+	config := core.DefaultTxPoolConfig
+	config.Journal = ""
+	pm.txpool = core.NewTxPool(config, params.TestChainConfig, chain)
+	peer, _ := newTestPeer(t, "peer", 2, pm, false)
+	defer peer.close()
+
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentHeader()
+		td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), keyValueList{}.add("nonceAdvice", nil))
+
+	type resp struct {
+		ReqID, BV uint64
+		Status    []txStatus
+		Nonces    []txNonceAdvice `rlp:"tail"`
+	}
+	send := func(reqID uint64, txs types.Transactions, exp resp) {
+		sendRequest(peer.app, SendTxV2Msg, reqID, peer.GetRequestCost(SendTxV2Msg, len(txs)), txs)
+		if err := p2p.ExpectMsg(peer.app, TxStatusMsg, exp); err != nil {
+			t.Errorf("reply %d mismatch: %v", reqID, err)
+		}
+	}
+	newTx := func(nonce uint64) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, acc1Addr, big.NewInt(10000), params.TxGas, big.NewInt(100000000000), nil), types.HomesteadSigner{}, testBankKey)
+		return tx
+	}
+	// Processable transactions need no advice
+	send(1, types.Transactions{newTx(0), newTx(1)}, resp{1, testBufLimit, []txStatus{{Status: core.TxStatusPending}, {Status: core.TxStatusPending}}, nil})
+
+	// A nonce gap is advised once per sender
+	send(2, types.Transactions{newTx(3), newTx(4)}, resp{2, testBufLimit, []txStatus{{Status: core.TxStatusQueued}, {Status: core.TxStatusQueued}}, []txNonceAdvice{{Sender: testBankAddress, Nonce: 2}}})
+
+	// Replays of included nonces are advised too
+	gchain, _ := core.GenerateChain(params.TestChainConfig, chain.GetBlockByNumber(0), ethash.NewFaker(), db, 1, func(i int, block *core.BlockGen) {
+		block.AddTx(newTx(0))
+	})
+	if _, err := chain.InsertChain(gchain); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if pending, _ := pm.txpool.(*core.TxPool).Pending(); len(pending[testBankAddress]) == 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	replay, _ := types.SignTx(types.NewTransaction(0, acc2Addr, big.NewInt(10000), params.TxGas, big.NewInt(100000000000), nil), types.HomesteadSigner{}, testBankKey)
+	send(3, types.Transactions{replay}, resp{3, testBufLimit, []txStatus{{Status: core.TxStatusUnknown, Error: core.ErrNonceTooLow.Error()}}, []txNonceAdvice{{Sender: testBankAddress, Nonce: 2}}})
+}
+
+// statusTxPool is a transaction pool mock reporting preset statuses.
+type statusTxPool struct {
+	lock   sync.Mutex
+	status map[common.Hash]core.TxStatus
+}
+
+func (p *statusTxPool) AddRemotes(txs []*types.Transaction) []error {
+	return make([]error, len(txs))
+}
+
+func (p *statusTxPool) Status(hashes []common.Hash) []core.TxStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := make([]core.TxStatus, len(hashes))
+	for i, hash := range hashes {
+		stats[i] = p.status[hash]
+	}
+	return stats
+}
+
+func (p *statusTxPool) set(hash common.Hash, status core.TxStatus) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.status[hash] = status
+}
+
+// Tests that the server pushes the status changes of the subscribed transactions.
+func TestTransactionStatusPushLes2(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	pm := newTestProtocolManagerMust(t, false, 0, nil, nil, nil, db)
+	chain := pm.blockchain.(*core.BlockChain)
+	txpool := &statusTxPool{status: make(map[common.Hash]core.TxStatus)}
+	pm.txpool = txpool
+	pm.wg.Add(1)
+	go pm.txStatusLoop()
+
+	peer, _ := newTestPeer(t, "peer", 2, pm, false)
+	defer peer.close()
+
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentHeader()
+		td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), keyValueList{}.add("txStatusPush", nil))
+
+	signer := types.HomesteadSigner{}
+	tx1, _ := types.SignTx(types.NewTransaction(0, acc1Addr, big.NewInt(10000), params.TxGas, big.NewInt(100000000000), nil), signer, testBankKey)
+	tx2, _ := types.SignTx(types.NewTransaction(5, acc1Addr, big.NewInt(10000), params.TxGas, big.NewInt(100000000000), nil), signer, testBankKey)
+	tx3, _ := types.SignTx(types.NewTransaction(6, acc1Addr, big.NewInt(10000), params.TxGas, big.NewInt(100000000000), nil), signer, testBankKey)
+	txpool.set(tx1.Hash(), core.TxStatusPending)
+	txpool.set(tx2.Hash(), core.TxStatusQueued)
+	txpool.set(tx3.Hash(), core.TxStatusQueued)
+
+	hashes := []common.Hash{tx1.Hash(), tx2.Hash(), tx3.Hash()}
+	sendRequest(peer.app, TxStatusSubscribeMsg, 1, peer.GetRequestCost(TxStatusSubscribeMsg, len(hashes)), hashes)
+	exp := []txStatus{{Status: core.TxStatusPending}, {Status: core.TxStatusQueued}, {Status: core.TxStatusQueued}}
+	if err := expectResponse(peer.app, TxStatusMsg, 1, testBufLimit, exp); err != nil {
+		t.Fatalf("subscription reply mismatch: %v", err)
+	}
+
+	// include tx1, drop tx2 from the pool and leave tx3 unchanged
+	gchain, _ := core.GenerateChain(params.TestChainConfig, chain.GetBlockByNumber(0), ethash.NewFaker(), db, 1, func(i int, block *core.BlockGen) {
+		block.AddTx(tx1)
+	})
+	txpool.set(tx1.Hash(), core.TxStatusUnknown)
+	txpool.set(tx2.Hash(), core.TxStatusUnknown)
+	if _, err := chain.InsertChain(gchain); err != nil {
+		t.Fatal(err)
+	}
+	block1hash := rawdb.ReadCanonicalHash(db, 1)
+	updates := []txStatusUpdate{
+		{Hash: tx1.Hash(), Status: txStatus{Status: core.TxStatusIncluded, Lookup: &rawdb.TxLookupEntry{BlockHash: block1hash, BlockIndex: 1, Index: 0}}},
+		{Hash: tx2.Hash(), Status: txStatus{Status: core.TxStatusUnknown}},
+	}
+	msg, err := peer.app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read update: %v", err)
+	}
+	var have []txStatusUpdate
+	if msg.Code != TxStatusUpdateMsg {
+		t.Fatalf("message code mismatch: have %d, want %d", msg.Code, TxStatusUpdateMsg)
+	}
+	if err := msg.Decode(&have); err != nil {
+		t.Fatalf("failed to decode update: %v", err)
+	}
+	if len(have) == 2 && have[0].Hash != tx1.Hash() {
+		have[0], have[1] = have[1], have[0]
+	}
+	if !reflect.DeepEqual(have, updates) {
+		t.Errorf("status update mismatch: have %+v, want %+v", have, updates)
+	}
+	// only tx3 is still watched
+	if subs := peer.txSubscriptions(); len(subs) != 1 || subs[0] != tx3.Hash() {
+		t.Errorf("watched transactions mismatch: have %x, want [%x]", subs, tx3.Hash())
+	}
+}
+
+// Tests that a client requiring signed announcements asks untrusted servers for
+// them and drops the server if an announcement carries no valid signature.
+func TestSignedAnnounceLes1(t *testing.T) { testSignedAnnounce(t, 1) }
+func TestSignedAnnounceLes2(t *testing.T) { testSignedAnnounce(t, 2) }
+
+func testSignedAnnounce(t *testing.T, protocol int) {
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
+	db, ldb := ethdb.NewMemDatabase(), ethdb.NewMemDatabase()
+	odr := NewLesOdr(ldb, rm)
+	odr.SetIndexers(light.NewChtIndexer(db, true, nil), light.NewBloomTrieIndexer(db, true, nil), eth.NewBloomIndexer(db, light.BloomTrieFrequency, light.HelperTrieConfirmations))
+
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	lpm := newTestProtocolManagerMust(t, true, 0, nil, peers, odr, ldb)
+	lpm.signedAnnounce = true
+
+	key, _ := crypto.GenerateKey()
+	pm.server.privateKey = key
+
+	// Connect the client to a server identified by the signing key
+	app, net := p2p.MsgPipe()
+	id := discover.PubkeyID(&key.PublicKey)
+	speer := pm.newPeer(protocol, NetworkId, p2p.NewPeer(id, "server", nil), net)
+	cpeer := lpm.newPeer(protocol, NetworkId, p2p.NewPeer(id, "client", nil), app)
+
+	serr, cerr := make(chan error, 1), make(chan error, 1)
+	go func() { serr <- pm.handle(speer) }()
+	go func() { cerr <- lpm.handle(cpeer) }()
+	defer app.Close()
+
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case err := <-serr:
+		t.Fatalf("server handshake error: %v", err)
+	case err := <-cerr:
+		t.Fatalf("client handshake error: %v", err)
+	}
+	if speer.announceType != announceTypeSigned {
+		t.Fatalf("announce type mismatch: have %d, want %d", speer.announceType, announceTypeSigned)
+	}
+	head := pm.blockchain.CurrentHeader()
+	announce := announceData{Hash: head.Hash(), Number: head.Number.Uint64(), Td: pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())}
+
+	// A properly signed announcement is accepted
+	signed := announce
+	signed.sign(key)
+	speer.announceChn <- signed
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case err := <-cerr:
+		t.Fatalf("signed announcement rejected: %v", err)
+	}
+	// An unsigned one gets the server dropped
+	announce.Td = new(big.Int).Add(announce.Td, big.NewInt(1))
+	speer.announceChn <- announce
+	select {
+	case <-time.After(time.Second):
+		t.Fatalf("unsigned announcement accepted")
+	case err := <-cerr:
+		if err == nil || !strings.HasPrefix(err.Error(), errCode(ErrInvalidResponse).String()) {
+			t.Fatalf("error mismatch: have %v, want %v", err, ErrInvalidResponse)
+		}
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"testing"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
@@ -59,7 +60,8 @@ var (
 	testEventEmitterCode = common.Hex2Bytes("60606040523415600e57600080fd5b7f57050ab73f6b9ebdd9f76b8d4997793f48cf956e965ee070551b9ca0bb71584e60405160405180910390a160358060476000396000f3006060604052600080fd00a165627a7a723058203f727efcad8b5811f8cb1fc2620ce5e8c63570d697aef968172de296ea3994140029")
 	testEventEmitterAddr common.Address
 
-	testBufLimit = uint64(100)
+	testBufLimit     = uint64(100)
+	testRecentStates = uint64(128) // number of recent states served by the test servers
 )
 
 /*
@@ -152,7 +154,7 @@ func newTestProtocolManager(lightSync bool, blocks int, generator func(int, *cor
 	}
 
 	if lightSync {
-		chain, _ = light.NewLightChain(odr, gspec.Config, engine)
+		chain, _ = light.NewLightChain(odr, gspec.Config, engine, nil)
 	} else {
 		blockchain, _ := core.NewBlockChain(db, nil, gspec.Config, engine, vm.Config{})
 
@@ -177,7 +179,7 @@ func newTestProtocolManager(lightSync bool, blocks int, generator func(int, *cor
 		return nil, err
 	}
 	if !lightSync {
-		srv := &LesServer{lesCommons: lesCommons{protocolManager: pm}}
+		srv := &LesServer{lesCommons: lesCommons{protocolManager: pm}, recentStates: testRecentStates}
 		pm.server = srv
 
 		srv.defParams = &flowcontrol.ServerParams{
@@ -185,7 +187,7 @@ func newTestProtocolManager(lightSync bool, blocks int, generator func(int, *cor
 			MinRecharge: 1,
 		}
 
-		srv.fcManager = flowcontrol.NewClientManager(50, 10, 1000000000)
+		srv.fcManager = flowcontrol.NewClientManager(50, 10, 1000000000, mclock.System{})
 		srv.fcCostStats = newCostStats(nil)
 	}
 	pm.Start(1000)
@@ -208,6 +210,7 @@ func newTestProtocolManagerMust(t *testing.T, lightSync bool, blocks int, genera
 type testPeer struct {
 	net p2p.MsgReadWriter // Network layer reader/writer to simulate remote messaging
 	app *p2p.MsgPipeRW    // Application layer reader/writer to simulate the local side
+	pm  *ProtocolManager  // Protocol manager the peer is connected to
 	*peer
 }
 
@@ -235,6 +238,7 @@ func newTestPeer(t *testing.T, name string, version int, pm *ProtocolManager, sh
 	tp := &testPeer{
 		app:  app,
 		net:  net,
+		pm:   pm,
 		peer: peer,
 	}
 	// Execute any implicitly requested handshakes and return
@@ -250,14 +254,25 @@ func newTestPeer(t *testing.T, name string, version int, pm *ProtocolManager, sh
 }
 
 func newTestPeerPair(name string, version int, pm, pm2 *ProtocolManager) (*peer, <-chan error, *peer, <-chan error) {
+	return newFaultyTestPeerPair(name, version, pm, pm2, nil)
+}
+
+// newFaultyTestPeerPair is like newTestPeerPair, but injects the given faults into
+// the messages sent by the first peer (pm's side), if a config is given.
+func newFaultyTestPeerPair(name string, version int, pm, pm2 *ProtocolManager, faults *p2p.MsgFaultConfig) (*peer, <-chan error, *peer, <-chan error) {
 	// Create a message pipe to communicate through
 	app, net := p2p.MsgPipe()
 
+	var rw p2p.MsgReadWriter = net
+	if faults != nil {
+		rw = p2p.NewFaultyMsgReadWriter(net, *faults)
+	}
+
 	// Generate a random id and create the peer
 	var id discover.NodeID
 	rand.Read(id[:])
 
-	peer := pm.newPeer(version, NetworkId, p2p.NewPeer(id, name, nil), net)
+	peer := pm.newPeer(version, NetworkId, p2p.NewPeer(id, name, nil), rw)
 	peer2 := pm2.newPeer(version, NetworkId, p2p.NewPeer(id, name, nil), app)
 
 	// Start the peer on a new thread
@@ -285,6 +300,12 @@ func newTestPeerPair(name string, version int, pm, pm2 *ProtocolManager) (*peer,
 // handshake simulates a trivial handshake that expects the same state from the
 // remote side as we are simulating locally.
 func (p *testPeer) handshake(t *testing.T, td *big.Int, head common.Hash, headNum uint64, genesis common.Hash) {
+	p.handshakeWithOptions(t, td, head, headNum, genesis, nil)
+}
+
+// handshakeWithOptions is like handshake but additionally announces the given
+// optional fields (e.g. feature flags) to the remote side.
+func (p *testPeer) handshakeWithOptions(t *testing.T, td *big.Int, head common.Hash, headNum uint64, genesis common.Hash, options keyValueList) {
 	var expList keyValueList
 	expList = expList.add("protocolVersion", uint64(p.version))
 	expList = expList.add("networkId", uint64(NetworkId))
@@ -294,6 +315,7 @@ func (p *testPeer) handshake(t *testing.T, td *big.Int, head common.Hash, headNu
 	expList = expList.add("genesisHash", genesis)
 	sendList := make(keyValueList, len(expList))
 	copy(sendList, expList)
+	sendList = append(sendList, options...)
 	expList = expList.add("serveHeaders", nil)
 	expList = expList.add("serveChainSince", uint64(0))
 	expList = expList.add("serveStateSince", uint64(0))
@@ -301,6 +323,17 @@ func (p *testPeer) handshake(t *testing.T, td *big.Int, head common.Hash, headNu
 	expList = expList.add("flowControl/BL", testBufLimit) // 握手的 Buffer Limit
 	expList = expList.add("flowControl/MRR", uint64(1))
 	expList = expList.add("flowControl/MRC", testRCL())
+	if p.version >= lpv2 {
+		expList = expList.add("bodyStreaming", nil)
+		expList = expList.add("txStatusPush", nil)
+		expList = expList.add("stateHints", nil)
+		expList = expList.add("nonceAdvice", nil)
+		expList = expList.add("proofStreaming", nil)
+		expList = expList.add("serverBusy", nil)
+		expList = expList.add("serveRecentState", testRecentStates)
+	}
+	expList = expList.add(stopAnnounceExtension, nil)
+	expList = expList.add(extensionsKey, []string{stopAnnounceExtension})
 
 	if err := p2p.ExpectMsg(p.app, StatusMsg, expList); err != nil {
 		t.Fatalf("status recv: %v", err)
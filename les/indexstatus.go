@@ -0,0 +1,139 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+)
+
+// Names of the helper tries in the indexer status and events.
+const (
+	helperTrieCht   = "cht"
+	helperTrieBloom = "bloomTrie"
+)
+
+// chtSectionRatio is the number of server side CHT sections making up a section
+// served to the clients.
+const chtSectionRatio = light.CHTFrequencyClient / light.CHTFrequencyServer
+
+// IndexerStatus is the progress of generating a helper trie of the server. The
+// sections are counted in the size the clients request them in.
+type IndexerStatus struct {
+	Sections uint64      `json:"sections"` // Completed sections, servable to the clients
+	Pending  uint64      `json:"pending"`  // Sections complete on the chain, waiting to be indexed
+	LastHead common.Hash `json:"lastHead"` // Hash of the last block of the last completed section
+	LastRoot common.Hash `json:"lastRoot"` // Root of the trie of the last completed section
+}
+
+// HelperTrieSectionEvent is posted when the server completed a helper trie
+// section, so it can serve checkpoints including it from now on.
+type HelperTrieSectionEvent struct {
+	Trie    string      // helperTrieCht or helperTrieBloom
+	Section uint64      // Index of the section, in the size the clients request it in
+	Head    common.Hash // Hash of the last block of the section
+	Root    common.Hash // Root of the trie of the section
+}
+
+// helperTrieSection converts a section completed by the indexer of a helper
+// trie into the section served to the clients, false if it doesn't complete one
+// (the server side CHT sections are smaller).
+//
+// CHT 的 server 端 section 为 4k 个 block, 只有凑满一个 client 端的 32k section 时 才算完成
+func helperTrieSection(db ethdb.Database, trie string, ev core.ChainSectionEvent) (HelperTrieSectionEvent, bool) {
+	switch trie {
+	case helperTrieCht:
+		if (ev.Section+1)%chtSectionRatio != 0 {
+			return HelperTrieSectionEvent{}, false
+		}
+		section := (ev.Section+1)/chtSectionRatio - 1
+		return HelperTrieSectionEvent{Trie: trie, Section: section, Head: ev.Head, Root: light.GetChtV2Root(db, section, ev.Head)}, true
+	default:
+		return HelperTrieSectionEvent{Trie: trie, Section: ev.Section, Head: ev.Head, Root: light.GetBloomTrieRoot(db, ev.Section, ev.Head)}, true
+	}
+}
+
+// indexerStatus returns the progress of the helper trie indexers of the server.
+func (s *LesServer) indexerStatus() map[string]*IndexerStatus {
+	status := make(map[string]*IndexerStatus)
+
+	stored, known := s.chtIndexer.Progress()
+	cht := &IndexerStatus{Sections: stored / chtSectionRatio, Pending: known/chtSectionRatio - stored/chtSectionRatio}
+	if cht.Sections > 0 {
+		cht.LastHead = s.chtIndexer.SectionHead(cht.Sections*chtSectionRatio - 1)
+		cht.LastRoot = light.GetChtV2Root(s.chainDb, cht.Sections-1, cht.LastHead)
+	}
+	status[helperTrieCht] = cht
+
+	stored, known = s.bloomTrieIndexer.Progress()
+	bloom := &IndexerStatus{Sections: stored, Pending: known - stored}
+	if bloom.Sections > 0 {
+		bloom.LastHead = s.bloomTrieIndexer.SectionHead(bloom.Sections - 1)
+		bloom.LastRoot = light.GetBloomTrieRoot(s.chainDb, bloom.Sections-1, bloom.LastHead)
+	}
+	status[helperTrieBloom] = bloom
+
+	return status
+}
+
+// SubscribeHelperTrieSections registers a subscription of HelperTrieSectionEvent,
+// posted each time the server completes a helper trie section.
+func (s *LesServer) SubscribeHelperTrieSections(ch chan<- HelperTrieSectionEvent) event.Subscription {
+	return s.sectionScope.Track(s.sectionFeed.Subscribe(ch))
+}
+
+// sectionLoop announces the helper trie sections completed by the indexers
+// until the server is stopped.
+//
+// 监听 CHT / BloomTrie 索引器 完成的 section, 打印日志 并 通知订阅者 (server 可以提供 新的 checkpoint 了)
+func (s *LesServer) sectionLoop() {
+	var (
+		chtCh    = make(chan core.ChainSectionEvent, 8)
+		bloomCh  = make(chan core.ChainSectionEvent, 8)
+		chtSub   = s.chtIndexer.SubscribeSections(chtCh)
+		bloomSub = s.bloomTrieIndexer.SubscribeSections(bloomCh)
+	)
+	defer chtSub.Unsubscribe()
+	defer bloomSub.Unsubscribe()
+
+	for {
+		var (
+			trie string
+			ev   core.ChainSectionEvent
+		)
+		select {
+		case ev = <-chtCh:
+			trie = helperTrieCht
+		case ev = <-bloomCh:
+			trie = helperTrieBloom
+		case <-chtSub.Err():
+			return
+		case <-bloomSub.Err():
+			return
+		case <-s.quitSync:
+			return
+		}
+		if section, ok := helperTrieSection(s.chainDb, trie, ev); ok {
+			log.Info("Completed helper trie section", "trie", trie, "section", section.Section, "head", section.Head, "root", section.Root)
+			s.sectionFeed.Send(section)
+		}
+	}
+}
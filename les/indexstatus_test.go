@@ -0,0 +1,47 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+)
+
+// Tests that only the server side CHT sections completing a client side one are
+// announced, with the indices and roots of the clients.
+func TestHelperTrieSection(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	head, chtRoot, bloomRoot := common.Hash{1}, common.Hash{2}, common.Hash{3}
+	light.StoreChtRoot(db, 2*chtSectionRatio-1, head, chtRoot)
+	light.StoreBloomTrieRoot(db, 1, head, bloomRoot)
+
+	if _, ok := helperTrieSection(db, helperTrieCht, core.ChainSectionEvent{Section: 2*chtSectionRatio - 2, Head: head}); ok {
+		t.Errorf("partial CHT section announced")
+	}
+	ev, ok := helperTrieSection(db, helperTrieCht, core.ChainSectionEvent{Section: 2*chtSectionRatio - 1, Head: head})
+	if !ok || ev.Section != 1 || ev.Root != chtRoot {
+		t.Errorf("CHT section mismatch: have %+v (%v), want section 1 root %x", ev, ok, chtRoot)
+	}
+	ev, ok = helperTrieSection(db, helperTrieBloom, core.ChainSectionEvent{Section: 1, Head: head})
+	if !ok || ev.Section != 1 || ev.Root != bloomRoot {
+		t.Errorf("bloom trie section mismatch: have %+v (%v), want section 1 root %x", ev, ok, bloomRoot)
+	}
+}
@@ -17,6 +17,10 @@
 package les
 
 import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
 )
@@ -62,13 +66,34 @@ var (
 	miscInTrafficMeter  = metrics.NewRegisteredMeter("les/misc/in/traffic", nil)
 	miscOutPacketsMeter = metrics.NewRegisteredMeter("les/misc/out/packets", nil)
 	miscOutTrafficMeter = metrics.NewRegisteredMeter("les/misc/out/traffic", nil)
+
+	// 按 peer 和 msg code 统计的流量, series 数量有上限, 断开连接的 peer 的 series 会被删除
+	peerInTrafficMeter  = metrics.NewLabeledMeter("les/peer/in/traffic", []string{"peer", "code"}, maxPeerMetricSeries, nil)
+	peerOutTrafficMeter = metrics.NewLabeledMeter("les/peer/out/traffic", []string{"peer", "code"}, maxPeerMetricSeries, nil)
+
+	// 按 peer 和 通道 (high/normal) 统计的 sendQueue 深度
+	peerSendQueueGauge = metrics.NewLabeledGauge("les/peer/sendqueue", []string{"peer", "lane"}, maxPeerMetricSeries, nil)
+
+	// client 超出 buffer 时 各级惩罚的次数
+	underrunMeters = map[flowcontrol.UnderrunAction]metrics.Meter{
+		flowcontrol.UnderrunWarn:       metrics.NewRegisteredMeter("les/server/underrun/warn", nil),
+		flowcontrol.UnderrunFreeze:     metrics.NewRegisteredMeter("les/server/underrun/freeze", nil),
+		flowcontrol.UnderrunDisconnect: metrics.NewRegisteredMeter("les/server/underrun/disconnect", nil),
+	}
 )
 
+// maxPeerMetricSeries is the number of per-peer traffic series kept in each
+// direction, the traffic of the message types and peers over it is accounted
+// together.
+const maxPeerMetricSeries = 1024
+
 // meteredMsgReadWriter is a wrapper around a p2p.MsgReadWriter, capable of
 // accumulating the above defined metrics based on the data stream contents.
 type meteredMsgReadWriter struct {
-	p2p.MsgReadWriter     // Wrapped message stream to meter
-	version           int // Protocol version to select correct meters
+	p2p.MsgReadWriter        // Wrapped message stream to meter
+	version           int    // Protocol version to select correct meters
+	id                string // Peer ID labeling the per-peer meters, empty until known
+	expired           int32  // Set when the peer disconnected, its meters are dropped (atomic)
 }
 
 // newMeteredMsgWriter wraps a p2p MsgReadWriter with metering support. If the
@@ -81,9 +106,24 @@ func newMeteredMsgWriter(rw p2p.MsgReadWriter) p2p.MsgReadWriter {
 }
 
 // Init sets the protocol version used by the stream to know which meters to
-// increment in case of overlapping message ids between protocol versions.
-func (rw *meteredMsgReadWriter) Init(version int) {
+// increment in case of overlapping message ids between protocol versions, and
+// the ID of the peer to label the per-peer meters with.
+func (rw *meteredMsgReadWriter) Init(version int, id string) {
 	rw.version = version
+	rw.id = id
+}
+
+// expire drops the per-peer meters of the disconnected peer, the messages still
+// in flight are not accounted to it any more.
+func (rw *meteredMsgReadWriter) expire() {
+	atomic.StoreInt32(&rw.expired, 1)
+	peerInTrafficMeter.DeleteLabel("peer", rw.id)
+	peerOutTrafficMeter.DeleteLabel("peer", rw.id)
+}
+
+// perPeer tells whether the traffic is accounted in the per-peer meters.
+func (rw *meteredMsgReadWriter) perPeer() bool {
+	return rw.id != "" && atomic.LoadInt32(&rw.expired) == 0
 }
 
 func (rw *meteredMsgReadWriter) ReadMsg() (p2p.Msg, error) {
@@ -96,7 +136,9 @@ func (rw *meteredMsgReadWriter) ReadMsg() (p2p.Msg, error) {
 	packets, traffic := miscInPacketsMeter, miscInTrafficMeter
 	packets.Mark(1)
 	traffic.Mark(int64(msg.Size))
-
+	if rw.perPeer() {
+		peerInTrafficMeter.With(rw.id, strconv.FormatUint(msg.Code, 10)).Mark(int64(msg.Size))
+	}
 	return msg, err
 }
 
@@ -105,7 +147,9 @@ func (rw *meteredMsgReadWriter) WriteMsg(msg p2p.Msg) error {
 	packets, traffic := miscOutPacketsMeter, miscOutTrafficMeter
 	packets.Mark(1)
 	traffic.Mark(int64(msg.Size))
-
+	if rw.perPeer() {
+		peerOutTrafficMeter.With(rw.id, strconv.FormatUint(msg.Code, 10)).Mark(int64(msg.Size))
+	}
 	// Send the packet to the p2p layer
 	return rw.MsgReadWriter.WriteMsg(msg)
 }
@@ -0,0 +1,57 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+)
+
+// Tests that the traffic of a peer is metered by message code until the peer
+// disconnects.
+func TestPeerTrafficMetrics(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+
+	rw := newMeteredMsgWriter(net).(*meteredMsgReadWriter)
+	rw.Init(lpv2, "0123456789abcdef")
+
+	go p2p.Send(app, GetBlockHeadersMsg, []uint64{1, 2, 3})
+	if _, err := rw.ReadMsg(); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	name := "les/peer/in/traffic/peer=0123456789abcdef/code=2"
+	meter, ok := metrics.Get(name).(metrics.Meter)
+	if !ok || meter.Count() == 0 {
+		t.Fatalf("traffic of the peer not metered")
+	}
+	rw.expire()
+	if metrics.Get(name) != nil {
+		t.Fatalf("meter of the disconnected peer still registered")
+	}
+	go p2p.Send(app, GetBlockHeadersMsg, []uint64{1, 2, 3})
+	rw.ReadMsg()
+	if metrics.Get(name) != nil {
+		t.Fatalf("disconnected peer metered again")
+	}
+}
@@ -18,6 +18,8 @@ package les
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
@@ -35,6 +37,33 @@ type LesOdr struct {
 	retriever                                  *retrieveManager
 	// 关闭信号通道
 	stop                                       chan struct{}
+	// 失败重试策略
+	retry                                      RetryConfig
+	// 持久化的 ODR 结果索引 (可为 nil)
+	cache                                      *light.OdrCache
+	// 按请求来源统计的网络消耗
+	origins                                    *originTracker
+	// 相同的并发请求共享一次网络请求
+	dedup                                      *odrDedup
+}
+
+// RetryConfig contains the settings of the ODR retry wrapper. A failed retrieval
+// (no valid answer before the attempt deadline or no suitable peers left) is
+// re-dispatched to the remaining peers after an exponentially growing backoff.
+//
+// RetryConfig: ODR 失败重试的配置, 每次重试都会排除之前已经请求过的 peer
+type RetryConfig struct {
+	MaxAttempts    int           // Maximum number of dispatch rounds per request (at least 1)
+	AttemptTimeout time.Duration // Deadline of a single dispatch round (0 = caller's context only)
+	Backoff        time.Duration // Wait time before the first re-dispatch, doubled every round
+	MaxBackoff     time.Duration // Upper limit of the backoff wait time
+}
+
+// DefaultRetryConfig is the retry policy used by the light client by default.
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 3,
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  2 * time.Second,
 }
 
 func NewLesOdr(db ethdb.Database, retriever *retrieveManager) *LesOdr {
@@ -42,12 +71,40 @@ func NewLesOdr(db ethdb.Database, retriever *retrieveManager) *LesOdr {
 		db:        db,
 		retriever: retriever,
 		stop:      make(chan struct{}),
+		retry:     DefaultRetryConfig,
+		origins:   newOriginTracker(),
+		dedup:     newOdrDedup(),
 	}
 }
 
-// Stop cancels all pending retrievals
+// SetRetryConfig replaces the retry policy of the ODR backend. It should be
+// called before the backend starts serving requests.
+func (odr *LesOdr) SetRetryConfig(config RetryConfig) {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	odr.retry = config
+}
+
+// SetCache sets the cache keeping track of the persisted retrieval results. It
+// should be called before the backend starts serving requests.
+func (odr *LesOdr) SetCache(cache *light.OdrCache) {
+	odr.cache = cache
+}
+
+// Cache returns the cache of the persisted retrieval results, nil if there is none
+func (odr *LesOdr) Cache() *light.OdrCache {
+	return odr.cache
+}
+
+// Stop cancels all pending retrievals and saves the usage of the persisted results
 func (odr *LesOdr) Stop() {
 	close(odr.stop)
+	if odr.cache != nil {
+		if err := odr.cache.Close(); err != nil {
+			log.Warn("Failed to save ODR cache usage", "err", err)
+		}
+	}
 }
 
 // Database returns the backing database
@@ -91,6 +148,7 @@ const (
 	MsgProofsV2
 	MsgHeaderProofs
 	MsgHelperTrieProofs
+	MsgBlockHeaders
 )
 
 // Msg encodes a LES message that delivers reply data for a request
@@ -98,6 +156,7 @@ type Msg struct {
 	MsgType int
 	ReqID   uint64
 	Obj     interface{}
+	Size    uint32 // size of the reply on the wire
 }
 
 // Retrieve tries to fetch an object from the LES network.
@@ -109,16 +168,88 @@ Retrieve: 尝试从LES网络中获取对象。 如果网络检索成功，它将
 TODO 一般只有两个 Indexer 需要用到
 todo 一) BloomTrieIndexer
 todo 二) ChtIndexer
+
+失败时 (超时或者 proof 校验失败) 会按照 RetryConfig 将 req 重新分发给剩余的 peer
  */
-func (odr *LesOdr) Retrieve(ctx context.Context, req light.OdrRequest) (err error) {
+func (odr *LesOdr) Retrieve(ctx context.Context, req light.OdrRequest) error {
 
 	// 如果是BloomTrieIndexer的话, 那么 req是 `BloomRequest`
 	// 如果是ChtIndexer的话, 那么 req是 `ChtRequest`
 	// 类型强转处理
 	lreq := LesRequest(req)
 
+	// identical requests in progress are waited for instead of sent again
+	return odr.dedup.do(ctx, odr.db, lreq, func() error {
+		return odr.retrieve(ctx, req, lreq)
+	})
+}
+
+// retrieve fetches the object of a request from the network, retrying with other
+// peers on failure, and stores it in the local database.
+func (odr *LesOdr) retrieve(ctx context.Context, req light.OdrRequest, lreq LesOdrRequest) (err error) {
+	var (
+		backoff = odr.retry.Backoff
+		failed  = newPeerExclusion()
+	)
+	for attempt := 1; ; attempt++ {
+		last := err
+		if err = odr.retrieveOnce(ctx, lreq, failed); err == nil {
+			// retrieved from network, store in db
+			//
+			// todo 极度重要
+			// todo 从网络检索，存储在数据库中
+			// (the cache first, to tell its own results from the data already present)
+			if odr.cache != nil {
+				odr.cache.Add(req)
+			}
+			req.StoreResult(odr.db)
+			return nil
+		}
+		// a round running out of peers is less telling than the failures of the
+		// peers excluded by the previous rounds, keep reporting those
+		if last != nil && light.ErrorCause(err) == light.ErrNoPeers {
+			err = last
+		}
+		if attempt >= odr.retry.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+		log.Debug("Retrying failed network retrieval", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Debug("Failed to retrieve data from network", "err", err)
+			return err
+		case <-odr.stop:
+			return err
+		}
+		if backoff *= 2; odr.retry.MaxBackoff != 0 && backoff > odr.retry.MaxBackoff {
+			backoff = odr.retry.MaxBackoff
+		}
+	}
+	log.Debug("Failed to retrieve data from network", "err", err)
+	return err
+}
+
+// retrieveOnce performs a single dispatch round of a request, avoiding the peers
+// that already failed to serve it in a previous round. Every peer the request is
+// sent to is added to the exclusion set; it is cleared again if the round succeeds.
+func (odr *LesOdr) retrieveOnce(ctx context.Context, lreq LesOdrRequest, failed *peerExclusion) error {
+	if odr.retry.AttemptTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, odr.retry.AttemptTimeout)
+		defer cancel()
+	}
 	// 随机生成一个reqId
 	reqID := genReqID()
+	origin := light.RequestOrigin(ctx)
+
+	// context of the last attempt, reported along with the failure
+	var (
+		lastLock sync.Mutex
+		last     *peer
+		lastCost uint64
+	)
 	// 构造对应的req体
 	rq := &distReq{
 
@@ -127,6 +258,9 @@ func (odr *LesOdr) Retrieve(ctx context.Context, req light.OdrRequest) (err erro
 			return lreq.GetCost(dp.(*peer))
 		},
 		canSend: func(dp distPeer) bool {
+			if failed.contains(dp) {
+				return false
+			}
 			p := dp.(*peer)
 			return lreq.CanSend(p)
 		},
@@ -135,6 +269,12 @@ func (odr *LesOdr) Retrieve(ctx context.Context, req light.OdrRequest) (err erro
 		request: func(dp distPeer) func() {
 			p := dp.(*peer)
 			cost := lreq.GetCost(p)
+			failed.add(dp)
+			odr.origins.request(origin, cost)
+
+			lastLock.Lock()
+			last, lastCost = p, cost
+			lastLock.Unlock()
 
 			// 调整下 server 端的资源
 			p.fcServer.QueueRequest(reqID, cost)
@@ -147,30 +287,62 @@ func (odr *LesOdr) Retrieve(ctx context.Context, req light.OdrRequest) (err erro
 		},
 	}
 
-
 	/**
 	todo  将构建好的 req 发起拉取, 并且对 proof 做校验
 	 */
-	if err = odr.retriever.retrieve(ctx, reqID, rq, func(p distPeer, msg *Msg) error { return lreq.Validate(odr.db, msg) }, odr.stop); err == nil {
-		// retrieved from network, store in db
-		//
-		// todo #####################################
-		// todo #####################################
-		// todo #####################################
-		// todo #####################################
-		// todo #####################################
-		// todo 极度重要
-		// todo
-		// todo 从网络检索，存储在数据库中
-		//
-		// todo #####################################
-		// todo #####################################
-		// todo #####################################
-		// todo #####################################
-		// todo #####################################
-		req.StoreResult(odr.db)
-	} else {
-		log.Debug("Failed to retrieve data from network", "err", err)
+	err := odr.retriever.retrieve(ctx, reqID, rq, func(p distPeer, msg *Msg) error {
+		odr.origins.reply(origin, msg.Size)
+		if err := lreq.Validate(odr.db, msg); err != nil {
+			p.(*peer).Log().Debug("Invalid response to on-demand request", "reqID", reqID, "err", err)
+			return err
+		}
+		// the peer served the request properly, it may be asked again
+		failed.remove(p)
+		return nil
+	}, odr.stop)
+	if err == nil {
+		return nil
+	}
+	// Wrap the failure with the context of the last attempt
+	if err == context.DeadlineExceeded {
+		err = light.ErrRequestTimeout
 	}
-	return
+	rerr := &light.RequestError{ReqID: reqID, Err: err}
+
+	lastLock.Lock()
+	defer lastLock.Unlock()
+	if last != nil {
+		rerr.Peer, rerr.MsgCode, rerr.Cost = last.id, requestCode(lreq, last), lastCost
+	}
+	return rerr
+}
+
+// peerExclusion is a concurrency safe set of peers that should not be asked again
+// when a request is re-dispatched.
+type peerExclusion struct {
+	lock  sync.Mutex
+	peers map[distPeer]struct{}
+}
+
+func newPeerExclusion() *peerExclusion {
+	return &peerExclusion{peers: make(map[distPeer]struct{})}
+}
+
+func (e *peerExclusion) add(p distPeer) {
+	e.lock.Lock()
+	e.peers[p] = struct{}{}
+	e.lock.Unlock()
+}
+
+func (e *peerExclusion) remove(p distPeer) {
+	e.lock.Lock()
+	delete(e.peers, p)
+	e.lock.Unlock()
+}
+
+func (e *peerExclusion) contains(p distPeer) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, ok := e.peers[p]
+	return ok
 }
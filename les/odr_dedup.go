@@ -0,0 +1,126 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+var odrDedupMeter = metrics.NewRegisteredMeter("les/odr/dedup", nil)
+
+// odrFlight is a network retrieval in progress, shared by all the identical
+// requests issued while it is running.
+type odrFlight struct {
+	done chan struct{} // closed when the retrieval finished
+	req  LesOdrRequest // request holding the results, valid after done
+	err  error         // result of the retrieval, valid after done
+}
+
+// odrDedup makes concurrent identical retrievals (same block body, receipts,
+// trie proof or contract code) share a single network request and verification.
+// The first request is sent to the network, the others wait for it and copy its
+// validated results. If the first one fails (e.g. its context is cancelled), the
+// waiting requests are retrieved separately.
+//
+// odrDedup: 相同的并发 ODR 请求 (同一个 block body, receipts, proof, code) 只发一次网络请求和一次校验,
+// 其他请求等待并复制结果
+type odrDedup struct {
+	lock    sync.Mutex
+	flights map[string]*odrFlight
+}
+
+func newOdrDedup() *odrDedup {
+	return &odrDedup{flights: make(map[string]*odrFlight)}
+}
+
+// do runs retrieve for the request unless an identical one is in progress, in
+// which case it waits for that one and copies its results into req.
+func (d *odrDedup) do(ctx context.Context, db ethdb.Database, req LesOdrRequest, retrieve func() error) error {
+	key := dedupKey(req)
+	if key == "" {
+		return retrieve()
+	}
+	d.lock.Lock()
+	if flight := d.flights[key]; flight != nil {
+		d.lock.Unlock()
+
+		select {
+		case <-flight.done:
+			if flight.err == nil {
+				odrDedupMeter.Mark(1)
+				copyResult(db, req, flight.req)
+				return nil
+			}
+			return retrieve()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	flight := &odrFlight{done: make(chan struct{}), req: req}
+	d.flights[key] = flight
+	d.lock.Unlock()
+
+	flight.err = retrieve()
+
+	d.lock.Lock()
+	delete(d.flights, key)
+	d.lock.Unlock()
+	close(flight.done)
+
+	return flight.err
+}
+
+// dedupKey returns the identity of the data retrieved by a request, empty for
+// the request types which are never shared.
+func dedupKey(req LesOdrRequest) string {
+	switch r := req.(type) {
+	case *BlockRequest:
+		return "body" + string(r.Hash[:])
+	case *ReceiptsRequest:
+		return "receipts" + string(r.Hash[:])
+	case *TrieRequest:
+		return "proof" + string(r.Id.BlockHash[:]) + string(r.Id.Root[:]) + string(r.Id.AccKey) + "/" + string(r.Key)
+	case *CodeRequest:
+		return "code" + string(r.Id.BlockHash[:]) + string(r.Hash[:])
+	default:
+		return ""
+	}
+}
+
+// copyResult fills the results of a request from an identical one validated
+// before. The receipts are read back from the database, as the caller of the
+// retrieval may modify them.
+func copyResult(db ethdb.Database, dst, src LesOdrRequest) {
+	switch r := dst.(type) {
+	case *BlockRequest:
+		r.Rlp = common.CopyBytes(src.(*BlockRequest).Rlp)
+	case *ReceiptsRequest:
+		if r.Receipts = rawdb.ReadReceipts(db, r.Hash, r.Number); r.Receipts == nil {
+			r.Receipts = src.(*ReceiptsRequest).Receipts
+		}
+	case *TrieRequest:
+		r.Proof = src.(*TrieRequest).Proof
+	case *CodeRequest:
+		r.Data = common.CopyBytes(src.(*CodeRequest).Data)
+	}
+}
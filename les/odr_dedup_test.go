@@ -0,0 +1,115 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+)
+
+// Tests that concurrent identical requests share a single retrieval.
+func TestOdrDedupShared(t *testing.T) {
+	var (
+		dedup   = newOdrDedup()
+		db      = ethdb.NewMemDatabase()
+		release = make(chan struct{})
+		calls   int32
+		wg      sync.WaitGroup
+	)
+	reqs := make([]*BlockRequest, 8)
+	for i := range reqs {
+		req := &BlockRequest{Hash: common.Hash{1}, Number: 1}
+		reqs[i] = req
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := dedup.do(context.Background(), db, req, func() error {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				req.Rlp = []byte{0xc0}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("retrieval failed: %v", err)
+			}
+		}()
+	}
+	// wait until the first request is in flight and the others joined it
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("network retrievals mismatch: have %d, want 1", calls)
+	}
+	for i, req := range reqs {
+		if !bytes.Equal(req.Rlp, []byte{0xc0}) {
+			t.Errorf("request %d: result mismatch: have %x, want c0", i, req.Rlp)
+		}
+	}
+}
+
+// Tests that a waiting request is retrieved on its own if the shared retrieval
+// fails, and that different requests are never shared.
+func TestOdrDedupFailure(t *testing.T) {
+	var (
+		dedup   = newOdrDedup()
+		db      = ethdb.NewMemDatabase()
+		started = make(chan struct{})
+		release = make(chan struct{})
+		done    = make(chan error)
+	)
+	go func() {
+		done <- dedup.do(context.Background(), db, &CodeRequest{Id: new(light.TrieID)}, func() error {
+			close(started)
+			<-release
+			return errors.New("failed")
+		})
+	}()
+	<-started
+
+	// a different request is not blocked by the one in flight
+	if err := dedup.do(context.Background(), db, &BlockRequest{Hash: common.Hash{2}}, func() error { return nil }); err != nil {
+		t.Fatalf("independent retrieval failed: %v", err)
+	}
+	// an identical request waits, then retries when the shared one fails
+	var retried bool
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	req := &CodeRequest{Id: new(light.TrieID)}
+	if err := dedup.do(context.Background(), db, req, func() error { retried = true; req.Data = []byte{1}; return nil }); err != nil {
+		t.Fatalf("retried retrieval failed: %v", err)
+	}
+	if err := <-done; err == nil {
+		t.Errorf("shared retrieval did not fail")
+	}
+	if !retried || !bytes.Equal(req.Data, []byte{1}) {
+		t.Errorf("failed shared retrieval not retried")
+	}
+}
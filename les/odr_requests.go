@@ -21,7 +21,7 @@ package les
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"sync"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
@@ -40,6 +40,7 @@ var (
 	errHeaderUnavailable   = errors.New("header unavailable")
 	errTxHashMismatch      = errors.New("transaction hash mismatch")
 	errUncleHashMismatch   = errors.New("uncle hash mismatch")
+	errHeaderLinkMismatch  = errors.New("header chain link mismatch")
 	errReceiptHashMismatch = errors.New("receipt hash mismatch")
 	errDataHashMismatch    = errors.New("data hash mismatch")
 	errCHTHashMismatch     = errors.New("cht hash mismatch")
@@ -58,21 +59,54 @@ func LesRequest(req light.OdrRequest) LesOdrRequest {
 	switch r := req.(type) {
 	case *light.BlockRequest:
 		return (*BlockRequest)(r)
+	case *light.HeadersRequest:
+		return (*HeadersRequest)(r)
 	case *light.ReceiptsRequest:
 		return (*ReceiptsRequest)(r)
 	case *light.TrieRequest:
 		return (*TrieRequest)(r)
 	case *light.CodeRequest:
 		return (*CodeRequest)(r)
+	case *light.CodesRequest:
+		return (*CodesRequest)(r)
 	case *light.ChtRequest:
 		return (*ChtRequest)(r)
 	case *light.BloomRequest:
 		return (*BloomRequest)(r)
+	case *light.HelperTrieBatchRequest:
+		return (*HelperTrieBatchRequest)(r)
 	default:
 		return nil
 	}
 }
 
+// requestCode returns the message code the given request is sent with to a peer.
+func requestCode(req LesOdrRequest, peer *peer) uint64 {
+	switch req.(type) {
+	case *BlockRequest:
+		return GetBlockBodiesMsg
+	case *HeadersRequest:
+		return GetBlockHeadersMsg
+	case *ReceiptsRequest:
+		return GetReceiptsMsg
+	case *TrieRequest:
+		if peer.version >= lpv2 {
+			return GetProofsV2Msg
+		}
+		return GetProofsV1Msg
+	case *CodeRequest, *CodesRequest:
+		return GetCodeMsg
+	case *ChtRequest:
+		if peer.version >= lpv2 {
+			return GetHelperTrieProofsMsg
+		}
+		return GetHeaderProofsMsg
+	case *BloomRequest, *HelperTrieBatchRequest:
+		return GetHelperTrieProofsMsg
+	}
+	return 0
+}
+
 // BlockRequest is the ODR request type for block bodies
 type BlockRequest light.BlockRequest
 
@@ -160,6 +194,55 @@ func (r *BlockRequest) Validate(db ethdb.Database, msg *Msg) error {
 	return nil
 }
 
+// HeadersRequest is the ODR request type for the ancestors of a trusted header
+type HeadersRequest light.HeadersRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *HeadersRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetBlockHeadersMsg, int(r.Amount)+1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *HeadersRequest) CanSend(peer *peer) bool {
+	return peer.HasBlock(r.Origin, r.Number)
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *HeadersRequest) Request(reqID uint64, peer *peer) error {
+	peer.Log().Debug("Requesting header range", "origin", r.Origin, "number", r.Number, "amount", r.Amount)
+	// The origin is asked for too, so the reply can be checked to start from it
+	return peer.RequestHeadersByHash(reqID, r.GetCost(peer), r.Origin, int(r.Amount)+1, 0, true)
+}
+
+// Valid processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+//
+// 只校验 返回的 header 是否 从 Origin 开始 逐个 通过 ParentHash 连接, 不校验 PoW
+func (r *HeadersRequest) Validate(db ethdb.Database, msg *Msg) error {
+	log.Debug("Validating header range", "origin", r.Origin, "amount", r.Amount)
+
+	// Ensure we have a correct message with the origin and all the ancestors
+	if msg.MsgType != MsgBlockHeaders {
+		return errInvalidMessageType
+	}
+	headers := msg.Obj.([]*types.Header)
+	if uint64(len(headers)) != r.Amount+1 {
+		return errInvalidEntryCount
+	}
+	if headers[0].Hash() != r.Origin {
+		return errHeaderLinkMismatch
+	}
+	for i := 1; i < len(headers); i++ {
+		if headers[i].Hash() != headers[i-1].ParentHash || headers[i].Number.Uint64()+1 != headers[i-1].Number.Uint64() {
+			return errHeaderLinkMismatch
+		}
+	}
+	r.Headers = headers[1:]
+	return nil
+}
+
 // ReceiptsRequest is the ODR request type for block receipts by block hash
 type ReceiptsRequest light.ReceiptsRequest
 
@@ -274,7 +357,7 @@ func (r *TrieRequest) GetCost(peer *peer) uint64 {
 
 // CanSend tells if a certain peer is suitable for serving the given request
 func (r *TrieRequest) CanSend(peer *peer) bool {
-	return peer.HasBlock(r.Id.BlockHash, r.Id.BlockNumber)
+	return peer.HasState(r.Id.BlockHash, r.Id.BlockNumber)
 }
 
 // Request sends an ODR request to the LES network (implementation of LesOdrRequest)
@@ -285,6 +368,7 @@ func (r *TrieRequest) Request(reqID uint64, peer *peer) error {
 		AccKey: r.Id.AccKey,
 		Key:    r.Key,
 	}
+	peer.expectProofRoots(reqID, r.Id.Root)
 	return peer.RequestProofs(reqID, r.GetCost(peer), []ProofReq{req})
 }
 
@@ -331,8 +415,8 @@ func (r *TrieRequest) Validate(db ethdb.Database, msg *Msg) error {
 		// 验证证明并存储（如果签出）
 		//
 		// todo 根据对端 server 返回的proof对 Merkle 做校验 LPV1
-		if _, _, err := trie.VerifyProof(r.Id.Root, r.Key, nodeSet); err != nil {
-			return fmt.Errorf("merkle proof verification failed: %v", err)
+		if _, err := proofVerifier.verify(r.Id.Root, [][]byte{r.Key}, nodeSet); err != nil {
+			return err
 		}
 		r.Proof = nodeSet
 		return nil
@@ -348,8 +432,8 @@ func (r *TrieRequest) Validate(db ethdb.Database, msg *Msg) error {
 
 		//
 		// todo 根据对端 server 返回的proof对 Merkle 做校验 LPV2
-		if _, _, err := trie.VerifyProof(r.Id.Root, r.Key, reads); err != nil {
-			return fmt.Errorf("merkle proof verification failed: %v", err)
+		if _, err := proofVerifier.verify(r.Id.Root, [][]byte{r.Key}, reads); err != nil {
+			return err
 		}
 		// check if all nodes have been read by VerifyProof
 		if len(reads.reads) != nodeSet.KeyCount() {
@@ -379,7 +463,7 @@ func (r *CodeRequest) GetCost(peer *peer) uint64 {
 
 // CanSend tells if a certain peer is suitable for serving the given request
 func (r *CodeRequest) CanSend(peer *peer) bool {
-	return peer.HasBlock(r.Id.BlockHash, r.Id.BlockNumber)
+	return peer.HasState(r.Id.BlockHash, r.Id.BlockNumber)
 }
 
 // Request sends an ODR request to the LES network (implementation of LesOdrRequest)
@@ -444,6 +528,63 @@ func (r *CodeRequest) Validate(db ethdb.Database, msg *Msg) error {
 	return nil
 }
 
+// ODR request type for several contract codes in one message, see LesOdrRequest interface
+type CodesRequest light.CodesRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *CodesRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetCodeMsg, len(r.Hashes))
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *CodesRequest) CanSend(peer *peer) bool {
+	for _, id := range r.Ids {
+		if !peer.HasState(id.BlockHash, id.BlockNumber) {
+			return false
+		}
+	}
+	return true
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *CodesRequest) Request(reqID uint64, peer *peer) error {
+	peer.Log().Debug("Requesting batch of code data", "count", len(r.Hashes))
+	reqs := make([]CodeReq, len(r.Ids))
+	for i, id := range r.Ids {
+		reqs[i] = CodeReq{
+			BHash:  id.BlockHash,
+			AccKey: id.AccKey,
+		}
+	}
+	return peer.RequestCode(reqID, r.GetCost(peer), reqs)
+}
+
+// Valid processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *CodesRequest) Validate(db ethdb.Database, msg *Msg) error {
+	log.Debug("Validating batch of code data", "count", len(r.Hashes))
+
+	// Ensure we have a correct message with an element for some of the codes. A
+	// reply cut short by the soft response limit of the server delivers a prefix
+	// of the requested codes, the rest is requested again by the caller
+	if msg.MsgType != MsgCode {
+		return errInvalidMessageType
+	}
+	reply := msg.Obj.([][]byte)
+	if len(reply) == 0 || len(reply) > len(r.Hashes) {
+		return errInvalidEntryCount
+	}
+	for i, data := range reply {
+		if hash := crypto.Keccak256Hash(data); r.Hashes[i] != hash {
+			return errDataHashMismatch
+		}
+	}
+	r.Data = reply
+	return nil
+}
+
 const (
 	// helper trie type constants
 	// todo 超级超级重要
@@ -480,8 +621,8 @@ type HelperTrieReq struct {
 }
 
 type HelperTrieResps struct { // describes all responses, not just a single one
-	Proofs  light.NodeList
-	AuxData [][]byte
+	Proofs  light.NodeList // merged proof nodes of all requests, possibly of different tries
+	AuxData [][]byte       // auxiliary data of the requests asking for it, in request order
 }
 
 // legacy LES/1
@@ -525,15 +666,65 @@ func (r *ChtRequest) CanSend(peer *peer) bool {
 // Request sends an ODR request to the LES network (implementation of LesOdrRequest)
 func (r *ChtRequest) Request(reqID uint64, peer *peer) error {
 	peer.Log().Debug("Requesting CHT", "cht", r.ChtNum, "block", r.BlockNum)
+	peer.expectProofRoots(reqID, r.ChtRoot)
+	return peer.RequestHelperTrieProofs(reqID, r.GetCost(peer), []HelperTrieReq{r.helperTrieReq()})
+}
+
+// helperTrieReq returns the helper trie request of the CHT entry, asking for the
+// header as auxiliary data.
+func (r *ChtRequest) helperTrieReq() HelperTrieReq {
 	var encNum [8]byte
 	binary.BigEndian.PutUint64(encNum[:], r.BlockNum)
-	req := HelperTrieReq{
+	return HelperTrieReq{
 		Type:    htCanonical,
 		TrieIdx: r.ChtNum,
 		Key:     encNum[:],
 		AuxReq:  auxHeader,
 	}
-	return peer.RequestHelperTrieProofs(reqID, r.GetCost(peer), []HelperTrieReq{req})
+}
+
+// verifyHelperTrie checks the CHT entry against the proof nodes and the header
+// returned as auxiliary data, filling in the header and the total difficulty.
+// The reads of the nodes are traced, the caller checks for useless ones.
+func (r *ChtRequest) verifyHelperTrie(reads *readTraceDB, headerEnc []byte) error {
+	// todo 根据 对端server 返回的 proof 进行 CHT 校验, 这个是校验  Trie <Merkle Trie>
+	values, err := proofVerifier.verify(r.ChtRoot, [][]byte{r.chtKey()}, reads)
+	if err != nil {
+		return err
+	}
+	return r.checkEntry(values[0], headerEnc)
+}
+
+// chtKey returns the key of the requested block in the CHT.
+func (r *ChtRequest) chtKey() []byte {
+	var encNumber [8]byte
+	binary.BigEndian.PutUint64(encNumber[:], r.BlockNum)
+	return encNumber[:]
+}
+
+// checkEntry checks the proven CHT entry against the header returned as
+// auxiliary data, filling in the header and the total difficulty.
+func (r *ChtRequest) checkEntry(value []byte, headerEnc []byte) error {
+	if len(headerEnc) == 0 {
+		return errHeaderUnavailable
+	}
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(headerEnc, header); err != nil {
+		return errHeaderUnavailable
+	}
+	var node light.ChtNode
+	if err := rlp.DecodeBytes(value, &node); err != nil {
+		return err
+	}
+	if node.Hash != header.Hash() {
+		return errCHTHashMismatch
+	}
+	if r.BlockNum != header.Number.Uint64() {
+		return errCHTNumberMismatch
+	}
+	r.Header = header
+	r.Td = node.Td
+	return nil
 }
 
 // Valid processes an ODR request reply message from the LES network
@@ -575,18 +766,13 @@ func (r *ChtRequest) Validate(db ethdb.Database, msg *Msg) error {
 		}
 		proof := proofs[0]
 
-		// Verify the CHT
-		var encNumber [8]byte
-		binary.BigEndian.PutUint64(encNumber[:], r.BlockNum)
-
-
 		// todo 根据 对端server 返回的 proof 进行 CHT 校验, 这个是校验 Header
-		value, _, err := trie.VerifyProof(r.ChtRoot, encNumber[:], light.NodeList(proof.Proof).NodeSet())
+		values, err := proofVerifier.verify(r.ChtRoot, [][]byte{r.chtKey()}, light.NodeList(proof.Proof).NodeSet())
 		if err != nil {
 			return err
 		}
 		var node light.ChtNode
-		if err := rlp.DecodeBytes(value, &node); err != nil {
+		if err := rlp.DecodeBytes(values[0], &node); err != nil {
 			return err
 		}
 		if node.Hash != proof.Header.Hash() {
@@ -602,44 +788,15 @@ func (r *ChtRequest) Validate(db ethdb.Database, msg *Msg) error {
 			return errInvalidEntryCount
 		}
 		nodeSet := resp.Proofs.NodeSet()
-		headerEnc := resp.AuxData[0]
-		if len(headerEnc) == 0 {
-			return errHeaderUnavailable
-		}
-		header := new(types.Header)
-		if err := rlp.DecodeBytes(headerEnc, header); err != nil {
-			return errHeaderUnavailable
-		}
-
-		// Verify the CHT
-		var encNumber [8]byte
-		binary.BigEndian.PutUint64(encNumber[:], r.BlockNum)
-
 		reads := &readTraceDB{db: nodeSet}
-
-		// todo 根据 对端server 返回的 proof 进行 CHT 校验, 这个是校验  Trie <Merkle Trie>
-		value, _, err := trie.VerifyProof(r.ChtRoot, encNumber[:], reads)
-		if err != nil {
-			return fmt.Errorf("merkle proof verification failed: %v", err)
+		if err := r.verifyHelperTrie(reads, resp.AuxData[0]); err != nil {
+			return err
 		}
 		if len(reads.reads) != nodeSet.KeyCount() {
 			return errUselessNodes
 		}
-
-		var node light.ChtNode
-		if err := rlp.DecodeBytes(value, &node); err != nil {
-			return err
-		}
-		if node.Hash != header.Hash() {
-			return errCHTHashMismatch
-		}
-		if r.BlockNum != header.Number.Uint64() {
-			return errCHTNumberMismatch
-		}
 		// Verifications passed, store and return
-		r.Header = header
 		r.Proof = nodeSet
-		r.Td = node.Td
 	default:
 		return errInvalidMessageType
 	}
@@ -661,18 +818,25 @@ func (r *BloomRequest) GetCost(peer *peer) uint64 {
 
 // CanSend tells if a certain peer is suitable for serving the given request
 func (r *BloomRequest) CanSend(peer *peer) bool {
+	if !peer.supports(GetHelperTrieProofsMsg) {
+		return false
+	}
 	peer.lock.RLock()
 	defer peer.lock.RUnlock()
 
-	if peer.version < lpv2 {
-		return false
-	}
 	return peer.headInfo.Number >= light.HelperTrieConfirmations && r.BloomTrieNum <= (peer.headInfo.Number-light.HelperTrieConfirmations)/light.BloomTrieFrequency
 }
 
 // Request sends an ODR request to the LES network (implementation of LesOdrRequest)
 func (r *BloomRequest) Request(reqID uint64, peer *peer) error {
 	peer.Log().Debug("Requesting BloomBits", "bloomTrie", r.BloomTrieNum, "bitIdx", r.BitIdx, "sections", r.SectionIdxList)
+	peer.expectProofRoots(reqID, r.BloomTrieRoot)
+	return peer.RequestHelperTrieProofs(reqID, r.GetCost(peer), r.helperTrieReqs())
+}
+
+// helperTrieReqs returns the helper trie requests of the bloom bits, one for
+// each section.
+func (r *BloomRequest) helperTrieReqs() []HelperTrieReq {
 	reqs := make([]HelperTrieReq, len(r.SectionIdxList))
 
 	var encNumber [10]byte
@@ -686,7 +850,7 @@ func (r *BloomRequest) Request(reqID uint64, peer *peer) error {
 			Key:     common.CopyBytes(encNumber[:]),
 		}
 	}
-	return peer.RequestHelperTrieProofs(reqID, r.GetCost(peer), reqs)
+	return reqs
 }
 
 // Valid processes an ODR request reply message from the LES network
@@ -731,47 +895,179 @@ func (r *BloomRequest) Validate(db ethdb.Database, msg *Msg) error {
 	proofs := resps.Proofs
 	nodeSet := proofs.NodeSet()
 	reads := &readTraceDB{db: nodeSet}
+	if err := r.verifyHelperTrie(reads); err != nil {
+		return err
+	}
+	if len(reads.reads) != nodeSet.KeyCount() {
+		return errUselessNodes
+	}
+	r.Proofs = nodeSet
+	return nil
+}
 
-	r.BloomBits = make([][]byte, len(r.SectionIdxList))
-
-	// Verify the proofs
-	//
-	// 验证证明
-	var encNumber [10]byte
-	binary.BigEndian.PutUint16(encNumber[:2], uint16(r.BitIdx))
+// verifyHelperTrie checks the bloom bits of all sections against the proof
+// nodes, filling in the bit vectors. The reads of the nodes are traced, the
+// caller checks for useless ones.
+func (r *BloomRequest) verifyHelperTrie(reads *readTraceDB) error {
+	/**
+	TODO 并发校验 各个section的 Bloom trie
+	 */
+	values, err := proofVerifier.verify(r.BloomTrieRoot, r.bloomKeys(), reads)
+	if err != nil {
+		return err
+	}
+	r.BloomBits = values
+	return nil
+}
 
+// bloomKeys returns the keys of the requested sections in the bloom trie.
+func (r *BloomRequest) bloomKeys() [][]byte {
+	keys := make([][]byte, len(r.SectionIdxList))
 	for i, idx := range r.SectionIdxList {
+		var encNumber [10]byte
+		binary.BigEndian.PutUint16(encNumber[:2], uint16(r.BitIdx))
 		binary.BigEndian.PutUint64(encNumber[2:], idx)
-		/**
-		TODO 逐个校验 各个section的 Bloom trie
-		 */
-		value, _, err := trie.VerifyProof(r.BloomTrieRoot, encNumber[:], reads)
-		if err != nil {
-			return err
+		keys[i] = encNumber[:]
+	}
+	return keys
+}
+
+// HelperTrieBatchRequest is the ODR request type for retrieving CHT entries and
+// bloom bits with a single helper trie proof request, see LesOdrRequest interface
+type HelperTrieBatchRequest light.HelperTrieBatchRequest
+
+// count returns the number of helper trie entries requested.
+func (r *HelperTrieBatchRequest) count() int {
+	count := len(r.Chts)
+	for _, req := range r.Blooms {
+		count += len(req.SectionIdxList)
+	}
+	return count
+}
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *HelperTrieBatchRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetHelperTrieProofsMsg, r.count())
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *HelperTrieBatchRequest) CanSend(peer *peer) bool {
+	if peer.version < lpv2 || !peer.supports(GetHelperTrieProofsMsg) {
+		return false
+	}
+	for _, req := range r.Chts {
+		if !(*ChtRequest)(req).CanSend(peer) {
+			return false
 		}
-		r.BloomBits[i] = value
 	}
+	for _, req := range r.Blooms {
+		if !(*BloomRequest)(req).CanSend(peer) {
+			return false
+		}
+	}
+	return true
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+//
+// CHT 请求 在前, bloom 请求 在后, 都放进 同一个 GetHelperTrieProofsMsg;
+// 只有 CHT 请求 带 auxHeader, 所以 返回的 AuxData 和 r.Chts 一一对应
+func (r *HelperTrieBatchRequest) Request(reqID uint64, peer *peer) error {
+	peer.Log().Debug("Requesting helper trie batch", "chts", len(r.Chts), "blooms", len(r.Blooms))
+	var (
+		reqs  = make([]HelperTrieReq, 0, r.count())
+		roots []common.Hash
+	)
+	for _, req := range r.Chts {
+		reqs = append(reqs, (*ChtRequest)(req).helperTrieReq())
+		roots = append(roots, req.ChtRoot)
+	}
+	for _, req := range r.Blooms {
+		reqs = append(reqs, (*BloomRequest)(req).helperTrieReqs()...)
+		roots = append(roots, req.BloomTrieRoot)
+	}
+	peer.expectProofRoots(reqID, roots...)
+	return peer.RequestHelperTrieProofs(reqID, r.GetCost(peer), reqs)
+}
+
+// Valid processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+//
+// 所有 子请求 共用 server 合并后的 NodeSet 校验, 最后检查 是否存在 没有被任何 proof 用到的 node
+func (r *HelperTrieBatchRequest) Validate(db ethdb.Database, msg *Msg) error {
+	log.Debug("Validating helper trie batch", "chts", len(r.Chts), "blooms", len(r.Blooms))
+
+	if msg.MsgType != MsgHelperTrieProofs {
+		return errInvalidMessageType
+	}
+	resp := msg.Obj.(HelperTrieResps)
+	if len(resp.AuxData) != len(r.Chts) {
+		return errInvalidEntryCount
+	}
+	nodeSet := resp.Proofs.NodeSet()
+	reads := &readTraceDB{db: nodeSet}
 
+	// The entries of all the tries are verified together by the worker pool
+	var (
+		roots []common.Hash
+		keys  [][]byte
+	)
+	for _, req := range r.Chts {
+		roots = append(roots, req.ChtRoot)
+		keys = append(keys, (*ChtRequest)(req).chtKey())
+	}
+	for _, req := range r.Blooms {
+		for _, key := range (*BloomRequest)(req).bloomKeys() {
+			roots = append(roots, req.BloomTrieRoot)
+			keys = append(keys, key)
+		}
+	}
+	values, err := proofVerifier.verifyRoots(roots, keys, reads)
+	if err != nil {
+		return err
+	}
+	for i, req := range r.Chts {
+		if err := (*ChtRequest)(req).checkEntry(values[i], resp.AuxData[i]); err != nil {
+			return err
+		}
+	}
+	values = values[len(r.Chts):]
+	for _, req := range r.Blooms {
+		req.BloomBits, values = values[:len(req.SectionIdxList)], values[len(req.SectionIdxList):]
+	}
 	if len(reads.reads) != nodeSet.KeyCount() {
 		return errUselessNodes
 	}
-	r.Proofs = nodeSet
+	// Verifications passed, the proofs of all entries are in the shared set
+	for _, req := range r.Chts {
+		req.Proof = nodeSet
+	}
+	for _, req := range r.Blooms {
+		req.Proofs = nodeSet
+	}
 	return nil
 }
 
 // readTraceDB stores the keys of database reads. We use this to check that received node
-// sets contain only the trie nodes necessary to make proofs pass.
+// sets contain only the trie nodes necessary to make proofs pass. It is safe for
+// concurrent use by the proof verifier workers.
 type readTraceDB struct {
 	db    trie.DatabaseReader
 	reads map[string]struct{}
+	lock  sync.Mutex
 }
 
 // Get returns a stored node
 func (db *readTraceDB) Get(k []byte) ([]byte, error) {
+	db.lock.Lock()
 	if db.reads == nil {
 		db.reads = make(map[string]struct{})
 	}
 	db.reads[string(k)] = struct{}{}
+	db.lock.Unlock()
+
 	return db.db.Get(k)
 }
 
@@ -25,14 +25,17 @@ import (
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/math"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
 )
@@ -109,6 +112,47 @@ func odrAccounts(ctx context.Context, db ethdb.Database, config *params.ChainCon
 	return res
 }
 
+func TestOdrContractCodesLes1(t *testing.T) { testOdr(t, 1, 1, odrContractCodes) }
+
+func TestOdrContractCodesLes2(t *testing.T) { testOdr(t, 2, 1, odrContractCodes) }
+
+func odrContractCodes(ctx context.Context, db ethdb.Database, config *params.ChainConfig, bc *core.BlockChain, lc *light.LightChain, bhash common.Hash) []byte {
+	var (
+		st  *state.StateDB
+		err error
+	)
+	if bc != nil {
+		header := bc.GetHeaderByHash(bhash)
+		st, err = state.New(header.Root, state.NewDatabase(db))
+	} else {
+		header := lc.GetHeaderByHash(bhash)
+		st = light.NewState(ctx, header, lc.Odr())
+	}
+	if err != nil {
+		return nil
+	}
+	var addrHashes, codeHashes []common.Hash
+	for _, addr := range []common.Address{testContractAddr, testBankAddress, testContractAddr} {
+		if hash := st.GetCodeHash(addr); hash != (common.Hash{}) {
+			addrHashes = append(addrHashes, crypto.Keccak256Hash(addr[:]))
+			codeHashes = append(codeHashes, hash)
+		}
+	}
+	if st.Error() != nil {
+		return nil
+	}
+	codes, err := st.Database().ContractCodes(addrHashes, codeHashes)
+	if err != nil {
+		return nil
+	}
+	var res []byte
+	for i, code := range codes {
+		res = append(res, codeHashes[i][:]...)
+		res = append(res, code...)
+	}
+	return res
+}
+
 func TestOdrContractCallLes1(t *testing.T) { testOdr(t, 1, 2, odrContractCall) }
 
 func TestOdrContractCallLes2(t *testing.T) { testOdr(t, 2, 2, odrContractCall) }
@@ -164,7 +208,7 @@ func testOdr(t *testing.T, protocol int, expFail uint64, fn odrTestFn) {
 	// Assemble the test environment
 	peers := newPeerSet()
 	dist := newRequestDistributor(peers, make(chan struct{}))
-	rm := newRetrieveManager(peers, dist, nil)
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
 	db := ethdb.NewMemDatabase()
 	ldb := ethdb.NewMemDatabase()
 	odr := NewLesOdr(ldb, rm)
@@ -219,3 +263,162 @@ func testOdr(t *testing.T, protocol int, expFail uint64, fn odrTestFn) {
 	time.Sleep(time.Millisecond * 10) // ensure that all peerSetNotify callbacks are executed
 	test(5)
 }
+
+func TestOdrRetryBackoff(t *testing.T) {
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
+	odr := NewLesOdr(ethdb.NewMemDatabase(), rm)
+	odr.SetRetryConfig(RetryConfig{MaxAttempts: 3, Backoff: 20 * time.Millisecond, MaxBackoff: 30 * time.Millisecond})
+
+	// without any peers every round fails instantly, only the backoff takes time
+	start := time.Now()
+	err := odr.Retrieve(context.Background(), &light.BlockRequest{Hash: common.Hash{1}, Number: 1})
+	if light.ErrorCause(err) != light.ErrNoPeers {
+		t.Fatalf("error mismatch: have %v, want %v", err, light.ErrNoPeers)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("retrieval returned too early: %v", elapsed)
+	}
+	// a cancelled context interrupts the backoff
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	odr.SetRetryConfig(RetryConfig{MaxAttempts: 10, Backoff: time.Second})
+	if err := odr.Retrieve(ctx, &light.BlockRequest{Hash: common.Hash{1}, Number: 1}); err != context.DeadlineExceeded {
+		t.Fatalf("error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// Tests that failed retrievals report the cause along with the context of the
+// request sent.
+func TestOdrRequestError(t *testing.T) {
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
+	db := ethdb.NewMemDatabase()
+	ldb := ethdb.NewMemDatabase()
+	odr := NewLesOdr(ldb, rm)
+	odr.SetIndexers(light.NewChtIndexer(db, true, nil), light.NewBloomTrieIndexer(db, true, nil), eth.NewBloomIndexer(db, light.BloomTrieFrequency, light.HelperTrieConfirmations))
+	odr.SetRetryConfig(RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond})
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	lpm := newTestProtocolManagerMust(t, true, 0, nil, peers, odr, ldb)
+	_, err1, lpeer, err2 := newTestPeerPair("peer", 2, pm, lpm)
+	select {
+	case <-time.After(time.Millisecond * 100):
+	case err := <-err1:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	case err := <-err2:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	}
+	lpeer.lock.Lock()
+	lpeer.hasBlock = func(common.Hash, uint64) bool { return true }
+	lpeer.lock.Unlock()
+
+	// The server has no body for an unknown hash, the empty reply fails the validation
+	err := odr.Retrieve(context.Background(), &light.BlockRequest{Hash: common.Hash{1}, Number: 1})
+	rerr, ok := err.(*light.RequestError)
+	if !ok {
+		t.Fatalf("error type mismatch: have %T, want *light.RequestError", err)
+	}
+	if rerr.Err != light.ErrInvalidResponse {
+		t.Errorf("cause mismatch: have %v, want %v", rerr.Err, light.ErrInvalidResponse)
+	}
+	if rerr.Peer != lpeer.id || rerr.MsgCode != GetBlockBodiesMsg || rerr.Cost != lpeer.GetRequestCost(GetBlockBodiesMsg, 1) {
+		t.Errorf("request context mismatch: have %+v", rerr)
+	}
+	if code := rerr.ErrorCode(); code != -32011 {
+		t.Errorf("error code mismatch: have %d, want %d", code, -32011)
+	}
+}
+
+// Tests that the ancestors of a trusted header are retrieved and checked for
+// linking to it.
+func TestOdrHeaderRange(t *testing.T) {
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
+	db := ethdb.NewMemDatabase()
+	ldb := ethdb.NewMemDatabase()
+	odr := NewLesOdr(ldb, rm)
+	odr.SetIndexers(light.NewChtIndexer(db, true, nil), light.NewBloomTrieIndexer(db, true, nil), eth.NewBloomIndexer(db, light.BloomTrieFrequency, light.HelperTrieConfirmations))
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	lpm := newTestProtocolManagerMust(t, true, 0, nil, peers, odr, ldb)
+	_, err1, lpeer, err2 := newTestPeerPair("peer", 2, pm, lpm)
+	select {
+	case <-time.After(time.Millisecond * 100):
+	case err := <-err1:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	case err := <-err2:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	}
+	lpeer.lock.Lock()
+	lpeer.hasBlock = func(common.Hash, uint64) bool { return true }
+	lpeer.lock.Unlock()
+
+	head := pm.blockchain.CurrentHeader()
+	req := &light.HeadersRequest{Origin: head.Hash(), Number: head.Number.Uint64(), Amount: 3}
+	if err := odr.Retrieve(context.Background(), req); err != nil {
+		t.Fatalf("failed to retrieve header range: %v", err)
+	}
+	for i, header := range req.Headers {
+		number := head.Number.Uint64() - 1 - uint64(i)
+		if hash := rawdb.ReadCanonicalHash(db, number); header.Hash() != hash {
+			t.Errorf("header %d mismatch: have %x, want %x", number, header.Hash(), hash)
+		}
+		if rawdb.ReadCanonicalHash(ldb, number) != header.Hash() {
+			t.Errorf("header %d not stored as canonical", number)
+		}
+	}
+	// A reply not linking to the origin is rejected
+	headers := append([]*types.Header{head}, req.Headers...)
+	headers[1], headers[2] = headers[2], headers[1]
+	if err := (*HeadersRequest)(&light.HeadersRequest{Origin: head.Hash(), Amount: 3}).Validate(ldb, &Msg{MsgType: MsgBlockHeaders, Obj: headers}); err != errHeaderLinkMismatch {
+		t.Errorf("unlinked reply error mismatch: have %v, want %v", err, errHeaderLinkMismatch)
+	}
+}
+
+// Tests that on-demand retrievals succeed while the replies of the server are
+// delayed and reordered.
+func TestOdrFaultyNetwork(t *testing.T) {
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
+	db := ethdb.NewMemDatabase()
+	ldb := ethdb.NewMemDatabase()
+	odr := NewLesOdr(ldb, rm)
+	odr.SetIndexers(light.NewChtIndexer(db, true, nil), light.NewBloomTrieIndexer(db, true, nil), eth.NewBloomIndexer(db, light.BloomTrieFrequency, light.HelperTrieConfirmations))
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	lpm := newTestProtocolManagerMust(t, true, 0, nil, peers, odr, ldb)
+
+	reply := p2p.MsgFaultRule{Delay: 0.3, Reorder: 0.3, MaxDelay: 50 * time.Millisecond}
+	faults := &p2p.MsgFaultConfig{
+		Seed:  1,
+		Codes: map[uint64]p2p.MsgFaultRule{BlockBodiesMsg: reply, ReceiptsMsg: reply, ProofsV2Msg: reply, CodeMsg: reply},
+	}
+	_, err1, lpeer, err2 := newFaultyTestPeerPair("peer", 2, pm, lpm, faults)
+	select {
+	case <-time.After(time.Millisecond * 100):
+	case err := <-err1:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	case err := <-err2:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	}
+	lpm.synchronise(lpeer)
+	lpeer.lock.Lock()
+	lpeer.hasBlock = func(common.Hash, uint64) bool { return true }
+	lpeer.lock.Unlock()
+
+	for _, fn := range []odrTestFn{odrGetBlock, odrGetReceipts, odrAccounts, odrContractCodes} {
+		for i := uint64(0); i <= pm.blockchain.CurrentHeader().Number.Uint64(); i++ {
+			bhash := rawdb.ReadCanonicalHash(db, i)
+			b1 := fn(light.NoOdr, db, pm.chainConfig, pm.blockchain.(*core.BlockChain), nil, bhash)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			b2 := fn(ctx, ldb, lpm.chainConfig, nil, lpm.blockchain.(*light.LightChain), bhash)
+			cancel()
+			if !bytes.Equal(b1, b2) {
+				t.Errorf("block %d: odr mismatch", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import "sync"
+
+const (
+	// maxTrackedOrigins caps the number of origins accounted separately, the
+	// requests of any further origins are added to otherOrigin.
+	maxTrackedOrigins = 256
+
+	localOrigin = "local" // label of the requests not tagged with an origin
+	otherOrigin = "other" // label of the requests of the untracked origins
+)
+
+// OriginStats is the network consumption of the requests of a single origin.
+type OriginStats struct {
+	Requests uint64 `json:"requests"` // Requests sent to the servers, re-dispatches included
+	Cost     uint64 `json:"cost"`     // Flow control cost charged by the servers
+	Bytes    uint64 `json:"bytes"`    // Size of the replies received
+}
+
+// originTracker attributes the ODR requests to the origins (e.g. dapps) of the
+// RPC calls triggering them, so embedders can see what consumes the bandwidth
+// and the flow control buffers of the light client.
+//
+// originTracker: 按请求来源 (例如 dapp) 统计 ODR 请求的数量, 流控成本和回复的字节数
+type originTracker struct {
+	lock  sync.Mutex
+	stats map[string]*OriginStats
+}
+
+// newOriginTracker creates an empty origin tracker.
+func newOriginTracker() *originTracker {
+	return &originTracker{stats: make(map[string]*OriginStats)}
+}
+
+// get returns the statistics of an origin, creating them if needed. The lock is
+// held by the caller.
+func (t *originTracker) get(origin string) *OriginStats {
+	if origin == "" {
+		origin = localOrigin
+	}
+	stats := t.stats[origin]
+	if stats == nil {
+		if len(t.stats) >= maxTrackedOrigins {
+			origin = otherOrigin
+			if stats = t.stats[origin]; stats != nil {
+				return stats
+			}
+		}
+		stats = new(OriginStats)
+		t.stats[origin] = stats
+	}
+	return stats
+}
+
+// request records a request of the origin sent with the given cost.
+func (t *originTracker) request(origin string, cost uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stats := t.get(origin)
+	stats.Requests++
+	stats.Cost += cost
+}
+
+// reply records a reply of the given size to a request of the origin.
+func (t *originTracker) reply(origin string, size uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.get(origin).Bytes += uint64(size)
+}
+
+// Stats returns a copy of the statistics of all the origins.
+func (t *originTracker) Stats() map[string]OriginStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stats := make(map[string]OriginStats, len(t.stats))
+	for origin, s := range t.stats {
+		stats[origin] = *s
+	}
+	return stats
+}
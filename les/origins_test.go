@@ -0,0 +1,55 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+)
+
+func TestOriginTracker(t *testing.T) {
+	tracker := newOriginTracker()
+
+	ctx := light.WithOrigin(context.Background(), "https://dapp.example")
+	origin := light.RequestOrigin(ctx)
+	tracker.request(origin, 100)
+	tracker.request(origin, 50)
+	tracker.reply(origin, 1024)
+	tracker.request(light.RequestOrigin(context.Background()), 10)
+
+	stats := tracker.Stats()
+	if have, want := stats["https://dapp.example"], (OriginStats{Requests: 2, Cost: 150, Bytes: 1024}); have != want {
+		t.Errorf("dapp stats mismatch: have %+v, want %+v", have, want)
+	}
+	if have, want := stats[localOrigin], (OriginStats{Requests: 1, Cost: 10}); have != want {
+		t.Errorf("local stats mismatch: have %+v, want %+v", have, want)
+	}
+	// Origins beyond the limit are accounted together
+	for i := len(stats); i < maxTrackedOrigins+10; i++ {
+		tracker.request(fmt.Sprintf("origin-%d", i), 1)
+	}
+	stats = tracker.Stats()
+	if len(stats) != maxTrackedOrigins+1 {
+		t.Errorf("tracked origin count mismatch: have %d, want %d", len(stats), maxTrackedOrigins+1)
+	}
+	if have := stats[otherOrigin].Requests; have != 10 {
+		t.Errorf("untracked origin requests mismatch: have %d, want 10", have)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+)
+
+// errNotPageable is returned if a paged retrieval is asked for a request type
+// that can't be split into pages.
+var errNotPageable = errors.New("request type can't be paged")
+
+// maxBatchAmount is the number of items of each request type a server answers
+// in one request.
+var maxBatchAmount = map[uint64]int{
+	GetBlockHeadersMsg:     MaxHeaderFetch,
+	GetBlockBodiesMsg:      MaxBodyFetch,
+	GetReceiptsMsg:         MaxReceiptFetch,
+	GetCodeMsg:             MaxCodeFetch,
+	GetProofsV1Msg:         MaxProofsFetch,
+	GetProofsV2Msg:         MaxProofsFetch,
+	GetHeaderProofsMsg:     MaxHelperTrieProofsFetch,
+	GetHelperTrieProofsMsg: MaxHelperTrieProofsFetch,
+	GetTxStatusMsg:         MaxTxStatus,
+}
+
+// queryBatch is a page of a bulk query: the items [start, start+amount) of the
+// query, requested from a peer at the given estimated cost.
+type queryBatch struct {
+	peer          *peer
+	start, amount int
+	cost          uint64
+}
+
+// affordable returns the largest number of items, at most max, a request of the
+// given type to the peer may ask for within the given buffer budget.
+func (p *peer) affordable(msgcode uint64, budget uint64, max int) int {
+	return sort.Search(max, func(n int) bool {
+		return p.GetRequestCost(msgcode, n+1) > budget
+	})
+}
+
+// paginate splits a bulk query of total items into batches scheduled across the
+// given servers, based on their request cost tables and buffer estimates. Each
+// batch is as large as the protocol allows, limited to what the server with the
+// most buffer left can serve right away, so the query is spread over the
+// servers instead of waiting for the recharge of one. When none of them can
+// afford a single item any more, the remaining full sized batches are queued
+// round robin, waiting for the buffers to recharge.
+//
+/**
+paginate: 把 大批量的查询 (例如 10k 个 header, 500 个 receipt) 切分成 多个 req 批次, 并分配给多个 server
+	每个批次的大小 受 协议上限 和 server 当前的 buffer 估计值 (按其 MRC 成本表计算) 限制,
+	每次都选择 剩余 buffer 最多的 server, 使查询 分散到多个 server 上 而不是 等待一个 server 充电;
+	所有 server 的 buffer 都不够时, 剩余的批次按最大批量 轮流分配, 等待 buffer 充电后发送
+ */
+func paginate(peers []*peer, msgcode uint64, total int) []queryBatch {
+	max := maxBatchAmount[msgcode]
+	if len(peers) == 0 || total <= 0 || max == 0 {
+		return nil
+	}
+	budgets := make([]uint64, len(peers))
+	for i, p := range peers {
+		budgets[i] = uint64(p.fcServer.BufferLevel() * float64(p.fcServerParams.BufLimit))
+	}
+	var (
+		batches []queryBatch
+		next    int // round robin index of the servers once the buffers ran out
+	)
+	for start := 0; start < total; {
+		size := max
+		if total-start < size {
+			size = total - start
+		}
+		// Pick the server with the most buffer left
+		best := 0
+		for i := range peers {
+			if budgets[i] > budgets[best] {
+				best = i
+			}
+		}
+		amount := peers[best].affordable(msgcode, budgets[best], size)
+		if amount == 0 {
+			best, amount = next%len(peers), size
+			next++
+		}
+		p := peers[best]
+		cost := p.GetRequestCost(msgcode, amount)
+		if cost > budgets[best] {
+			budgets[best] = 0
+		} else {
+			budgets[best] -= cost
+		}
+		batches = append(batches, queryBatch{peer: p, start: start, amount: amount, cost: cost})
+		start += amount
+	}
+	return batches
+}
+
+// planQuery splits a bulk query of total items across the connected servers
+// able to serve the request type, leaving out the ones reported overloaded.
+func (ps *peerSet) planQuery(msgcode uint64, total int) []queryBatch {
+	var servers []*peer
+	now := mclock.Now()
+	for _, p := range ps.AllPeers() {
+		p.lock.RLock()
+		ok := p.fcServer != nil && p.fcCosts[msgcode] != nil && p.busyUntil <= now
+		p.lock.RUnlock()
+		if ok {
+			servers = append(servers, p)
+		}
+	}
+	return paginate(servers, msgcode, total)
+}
+
+// pageCode returns the message code of the requests of a paged query, zero if the
+// request type can't be split into pages.
+func pageCode(req LesOdrRequest) uint64 {
+	switch req.(type) {
+	case *CodesRequest:
+		return GetCodeMsg
+	}
+	return 0
+}
+
+// RetrievePaged retrieves a bulk query of total items in pages planned across
+// the connected servers by paginate. Every page is sent through the retriever to
+// the server it was planned for, and stored in the local database once valid
+// (implementation of light.PagedOdrBackend).
+func (odr *LesOdr) RetrievePaged(ctx context.Context, total int, page func(start, amount int) light.OdrRequest) error {
+	msgcode := pageCode(LesRequest(page(0, 0)))
+	if msgcode == 0 {
+		return errNotPageable
+	}
+	if total <= 0 {
+		return nil
+	}
+	batches := odr.retriever.peers.planQuery(msgcode, total)
+	if len(batches) == 0 {
+		return light.ErrNoPeers
+	}
+	reqs := make([]light.OdrRequest, len(batches))
+	for i, b := range batches {
+		reqs[i] = page(b.start, b.amount)
+	}
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		first   error
+	)
+	for i, b := range batches {
+		wg.Add(1)
+		go func(req light.OdrRequest, target *peer) {
+			defer wg.Done()
+			if err := odr.retrievePage(ctx, req, target); err != nil {
+				errLock.Lock()
+				if first == nil {
+					first = err
+				}
+				errLock.Unlock()
+			}
+		}(reqs[i], b.peer)
+	}
+	wg.Wait()
+	return first
+}
+
+// retrievePage sends a page of a paged query to the server it was planned for.
+func (odr *LesOdr) retrievePage(ctx context.Context, req light.OdrRequest, target *peer) error {
+	var (
+		lreq  = LesRequest(req)
+		reqID = genReqID()
+	)
+	rq := &distReq{
+		getCost: func(dp distPeer) uint64 {
+			return lreq.GetCost(dp.(*peer))
+		},
+		canSend: func(dp distPeer) bool {
+			return dp == distPeer(target) && lreq.CanSend(target)
+		},
+		request: func(dp distPeer) func() {
+			p := dp.(*peer)
+			p.fcServer.QueueRequest(reqID, lreq.GetCost(p))
+			return func() { lreq.Request(reqID, p) }
+		},
+	}
+	err := odr.retriever.retrieve(ctx, reqID, rq, func(p distPeer, msg *Msg) error {
+		return lreq.Validate(odr.db, msg)
+	}, odr.stop)
+	if err != nil {
+		return err
+	}
+	if odr.cache != nil {
+		odr.cache.Add(req)
+	}
+	req.StoreResult(odr.db)
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// newPaginationPeer creates a server peer charging 100 + 10 per header, with the
+// given buffer limit and estimated buffer value.
+func newPaginationPeer(id byte, bufLimit, bufValue uint64, clock mclock.Clock) *peer {
+	p := newPeer(lpv2, NetworkId, p2p.NewPeer(discover.NodeID{id}, "test", nil), nil)
+	p.fcServerParams = &flowcontrol.ServerParams{BufLimit: bufLimit, MinRecharge: 1}
+	p.fcServer = flowcontrol.NewServerNode(p.fcServerParams, clock)
+	p.fcCosts = requestCostTable{GetBlockHeadersMsg: &requestCosts{baseCost: 100, reqCost: 10}}
+	if bufValue < bufLimit {
+		p.fcServer.QueueRequest(1, bufLimit-bufValue)
+	}
+	return p
+}
+
+// Tests that the bulk queries are split by the protocol limits and the buffers
+// of the servers, covering all the items exactly once.
+func TestPaginate(t *testing.T) {
+	clock := &mclock.Simulated{}
+	large := newPaginationPeer(1, 100000, 100000, clock)
+
+	// A large buffer is limited by the protocol only
+	batches := paginate([]*peer{large}, GetBlockHeadersMsg, 500)
+	if len(batches) != 3 || batches[0].amount != MaxHeaderFetch || batches[2].amount != 500-2*MaxHeaderFetch {
+		t.Fatalf("protocol limited batches mismatch: %+v", batches)
+	}
+	// Drained buffers (100 headers left) are spread across the servers and queued once depleted
+	batches = paginate([]*peer{newPaginationPeer(2, 10000, 1100, clock), newPaginationPeer(3, 10000, 1100, clock)}, GetBlockHeadersMsg, 1000)
+	next := 0
+	for i, b := range batches {
+		if b.start != next {
+			t.Fatalf("batch %d starts at %d, want %d", i, b.start, next)
+		}
+		next += b.amount
+	}
+	if next != 1000 {
+		t.Fatalf("batches cover %d items, want 1000", next)
+	}
+	if batches[0].amount != 100 || batches[1].amount != 100 || batches[0].peer == batches[1].peer {
+		t.Fatalf("buffered batches mismatch: %+v %+v", batches[0], batches[1])
+	}
+	if batches[2].amount != MaxHeaderFetch {
+		t.Fatalf("queued batch size mismatch: have %d, want %d", batches[2].amount, MaxHeaderFetch)
+	}
+	if paginate(nil, GetBlockHeadersMsg, 10) != nil || paginate([]*peer{large}, StatusMsg, 10) != nil {
+		t.Fatalf("batches planned without servers or for a non-request")
+	}
+}
+
+// Tests that the pages of a bulk query are retrieved from the planned servers and
+// stored locally.
+func TestRetrievePaged(t *testing.T) {
+	peers := newPeerSet()
+	dist := newRequestDistributor(peers, make(chan struct{}))
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
+	db := ethdb.NewMemDatabase()
+	ldb := ethdb.NewMemDatabase()
+	odr := NewLesOdr(ldb, rm)
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	lpm := newTestProtocolManagerMust(t, true, 0, nil, peers, odr, ldb)
+	_, err1, lpeer, err2 := newTestPeerPair("peer", 2, pm, lpm)
+	select {
+	case <-time.After(time.Millisecond * 100):
+	case err := <-err1:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	case err := <-err2:
+		t.Fatalf("peer 1 handshake error: %v", err)
+	}
+	lpeer.lock.Lock()
+	lpeer.hasBlock = func(common.Hash, uint64) bool { return true }
+	lpeer.lock.Unlock()
+
+	head := pm.blockchain.CurrentHeader()
+	id := &light.TrieID{BlockHash: head.Hash(), BlockNumber: head.Number.Uint64(), Root: head.Root, AccKey: crypto.Keccak256(testContractAddr[:])}
+	hash := crypto.Keccak256Hash(testContractCodeDeployed)
+
+	var pages []*light.CodesRequest
+	err := odr.RetrievePaged(context.Background(), 3, func(start, amount int) light.OdrRequest {
+		req := &light.CodesRequest{Ids: make([]*light.TrieID, amount), Hashes: make([]common.Hash, amount)}
+		for i := range req.Ids {
+			req.Ids[i], req.Hashes[i] = id, hash
+		}
+		if amount > 0 {
+			pages = append(pages, req)
+		}
+		return req
+	})
+	if err != nil {
+		t.Fatalf("paged retrieval failed: %v", err)
+	}
+	if len(pages) != 1 || len(pages[0].Data) != 3 || !bytes.Equal(pages[0].Data[0], testContractCodeDeployed) {
+		t.Fatalf("pages mismatch: %d pages", len(pages))
+	}
+	if code, _ := ldb.Get(hash[:]); !bytes.Equal(code, testContractCodeDeployed) {
+		t.Errorf("retrieved code not stored")
+	}
+	if err := odr.RetrievePaged(context.Background(), 1, func(start, amount int) light.OdrRequest {
+		return &light.HeadersRequest{}
+	}); err != errNotPageable {
+		t.Errorf("unpageable request error mismatch: have %v, want %v", err, errNotPageable)
+	}
+}
@@ -18,17 +18,21 @@
 package les
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
-	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
@@ -64,6 +68,9 @@ type peer struct {
 	// todo requestAnnounceType: 默认也是这模式
 	announceType, requestAnnounceType uint64
 
+	// Client: the server's announcements aren't used (ultra-light mode), request none
+	noAnnounce bool
+
 	id string
 
 	// 设置当前 peer 的通知类型?
@@ -76,6 +83,9 @@ type peer struct {
 	//  todo 一个 func 队列
 	sendQueue   *execQueue
 
+	// 按顺序 异步执行 peerSetNotify 的回调 (register 一定在 unregister 之前)
+	notifyQueue *execQueue // ordered peerSetNotify callbacks of the peer
+
 	// poolEntry: 代表 服务器节点 <light的server端> 并存储其当前状态和统计信息
 	poolEntry      *poolEntry
 	hasBlock       func(common.Hash, uint64) bool
@@ -87,12 +97,65 @@ type peer struct {
 	// 如果peer 是client的话,则该值为nil
 	// todo fcServer: 流量控制Server
 	fcServer       *flowcontrol.ServerNode // nil if the peer is client only
+	resyncing      uint64                  // request ID of the buffer value resync in flight, zero if none (atomic)
 
 	// todo 流量控制的Server参数
 	fcServerParams *flowcontrol.ServerParams
 
 	// todo 记录req的消耗表
 	fcCosts        requestCostTable
+
+	// 双方在握手时都声明了 "bodyStreaming", 则 bodies 的 resp 可以分成多个 msg 发送
+	bodyStreaming  bool                     // both sides support chunked block body responses
+	bodyChunks     map[uint64][]*types.Body // partially received streamed body responses by reqID
+	chunkLock      sync.Mutex
+
+	// 双方在握手时都声明了 "proofStreaming", 则过大的 proof resp 可以分成多个 msg 发送
+	proofStreaming bool                     // both sides support chunked proof responses
+	proofChunks    map[uint64]*proofStream  // partially received streamed proof responses by reqID
+	proofRoots     map[uint64][]common.Hash // trie roots of the proof requests in flight by reqID
+
+	// 统计 每种 req 的往返延迟
+	latency *latencyTracker // round-trip times of the requests sent to the peer
+
+	// 根据 server 的实际响应时间调整其 req 成本, nil 表示不调整
+	costEstimate *costEstimator // adjusts the announced costs to the measured response times, nil if disabled
+
+	// server 过载回复 "retry after" 时, 在此之前不再向其发送 req
+	busyUntil mclock.AbsTime // no requests are sent to an overloaded server until this time
+
+	// 双方在握手时都声明了 "serverBusy", 则 server 过载时可以回复 ServerBusyMsg, 否则按 LES/1 的方式处理
+	serverBusy bool // both sides support server busy replies
+
+	// 双方在握手时都声明了 "txStatusPush", 则 client 可以订阅 tx status, 由 server 主动推送变化
+	txStatusPush bool                          // both sides support transaction status subscriptions
+	txSubs       map[common.Hash]core.TxStatus // last status reported of the watched transactions
+	txSubLock    sync.Mutex
+
+	// client 在握手时要求 "signResponses" 且 server 支持, 则 server 对每个 resp 的摘要签名, 用作其作恶的证据
+	requestSignedResponses bool                   // Client: ask the server to sign its responses
+	signResponses          bool                   // the responses are signed, negotiated in the handshake
+	responseSigs           map[responseKey][]byte // Client: signatures of the responses not yet arrived
+
+	// 双方都支持的 握手扩展 的值, 及 对端发来的 本地不认识的 握手字段 (保留以供查看)
+	extensions  keyValueMap // values of the handshake extensions supported by both sides
+	unknownKeys keyValueMap // handshake keys of the peer not known locally
+
+	// 双方在握手时都声明了 "stateHints", 则 server 在 account proof 之后推送常读的 storage slot
+	stateHints bool // both sides support state access hints
+
+	// 双方在握手时都声明了 "nonceAdvice", 则 server 在 tx status 之后附带 sender 的 pending nonce
+	nonceAdvice bool // both sides support nonce advice in the transaction status replies
+
+	// server 在握手时声明的保证可以提供 state 的最近块数 (0 表示所有的 state)
+	serveRecentState uint64 // number of recent block states served by the server, zero for all
+
+	// server 发送给该 client 的字节数, 及按 client 限制 每日发送字节数 的统计 (nil 表示不限制)
+	bytesSent uint64            // bytes sent to the client over the connection, accessed atomically
+	bandwidth *bandwidthTracker // daily byte cap of the client, nil if not capped
+
+	// client 的 IP 子网, 用于按子网限制 req 速率 (空表示不限制, 例如可信节点)
+	subnet string // IP subnet of the client for request throttling, empty if exempt
 }
 
 func newPeer(version int, network uint64, p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
@@ -107,6 +170,8 @@ func newPeer(version int, network uint64, p *p2p.Peer, rw p2p.MsgReadWriter) *pe
 		network:     network,
 		id:          fmt.Sprintf("%x", id[:8]),
 		announceChn: make(chan announceData, 20),
+		latency:     newLatencyTracker(fmt.Sprintf("%x", id[:8])),
+		txSubs:      make(map[common.Hash]core.TxStatus),
 	}
 }
 
@@ -118,13 +183,81 @@ func (p *peer) queueSend(f func()) {
 	p.sendQueue.queue(f)
 }
 
+// queueReply queues sending a data response in the normal lane of the send
+// queue. If the queue is full, it waits for room, holding back the processing of
+// further requests of the client, and fails if the client doesn't take its
+// responses within sendQueueTimeout.
+//
+// 数据响应 走 sendQueue 的普通通道; 队列满时 阻塞 (不再读取该 client 的新请求), 超时则返回错误 断开连接
+func (p *peer) queueReply(send func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendQueueTimeout)
+	defer cancel()
+
+	return p.sendQueue.queueWait(ctx, false, func() {
+		if err := send(); err != nil {
+			p.Log().Warn("Failed to send response", "err", err)
+		}
+	})
+}
+
+// flushReplies waits until the replies queued so far are sent, at most for
+// sendQueueTimeout, e.g. before disconnecting the client.
+func (p *peer) flushReplies() {
+	done := make(chan struct{})
+	if err := p.queueReply(func() error { close(done); return nil }); err != nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(sendQueueTimeout):
+	}
+}
+
+// queueAnnounce queues sending an announcement in the high priority lane of the
+// send queue, so it's not delayed behind the pending data responses.
+func (p *peer) queueAnnounce(ctx context.Context, announce announceData) {
+	err := p.sendQueue.queueWait(ctx, true, func() {
+		if err := p.SendAnnounce(announce); err != nil {
+			p.Log().Debug("Failed to send announcement", "err", err)
+		}
+	})
+	if err != nil {
+		p.Log().Debug("Dropped announcement", "number", announce.Number, "err", err)
+	}
+}
+
+// PeerInfo represents a short summary of the les sub-protocol metadata known
+// about a connected peer.
+type PeerInfo struct {
+	Version    int      `json:"version"`              // Les protocol version negotiated
+	Difficulty *big.Int `json:"difficulty"`           // Total difficulty of the peer's blockchain
+	Head       string   `json:"head"`                 // SHA3 hash of the peer's best owned block
+	BytesSent  uint64   `json:"bytesSent,omitempty"`  // Bytes sent to the client over the connection
+	DailyBytes uint64   `json:"dailyBytes,omitempty"` // Bytes sent to the client in the last 24 hours, if capped
+	Extensions []string `json:"extensions,omitempty"` // Handshake extensions negotiated with the peer
+	Unknown    []string `json:"unknown,omitempty"`    // Handshake keys of the peer not known locally
+}
+
 // Info gathers and returns a collection of metadata known about a peer.
-func (p *peer) Info() *eth.PeerInfo {
-	return &eth.PeerInfo{
+func (p *peer) Info() *PeerInfo {
+	info := &PeerInfo{
 		Version:    p.version,
 		Difficulty: p.Td(),
 		Head:       fmt.Sprintf("%x", p.Head()),
+		BytesSent:  atomic.LoadUint64(&p.bytesSent),
+	}
+	if p.bandwidth != nil {
+		info.DailyBytes = p.bandwidth.usage(p.id)
 	}
+	for name := range p.extensions {
+		info.Extensions = append(info.Extensions, name)
+	}
+	for key := range p.unknownKeys {
+		info.Unknown = append(info.Unknown, key)
+	}
+	sort.Strings(info.Extensions)
+	sort.Strings(info.Unknown)
+	return info
 }
 
 // Head retrieves a copy of the current head (most recent) hash of the peer.
@@ -161,9 +294,48 @@ func (p *peer) Td() *big.Int {
 
 // waitBefore implements distPeer interface
 func (p *peer) waitBefore(maxCost uint64) (time.Duration, float64) {
+	p.lock.RLock()
+	busy := time.Duration(p.busyUntil - mclock.Now())
+	p.lock.RUnlock()
+
+	if busy > 0 {
+		return busy, 0
+	}
 	return p.fcServer.CanSend(maxCost)
 }
 
+// waitSend implements distPeer interface
+func (p *peer) waitSend(ctx context.Context, maxCost uint64) error {
+	p.lock.RLock()
+	busy := time.Duration(p.busyUntil - mclock.Now())
+	p.lock.RUnlock()
+
+	if busy > 0 {
+		timer := time.NewTimer(busy)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	_, err := p.fcServer.CanSendCtx(ctx, maxCost)
+	return err
+}
+
+// setBusy marks the server overloaded for the given time, during which no
+// requests are sent to it. The time is capped to protect against servers
+// trying to stall the client.
+func (p *peer) setBusy(retryAfter time.Duration) {
+	if retryAfter > hardRequestTimeout {
+		retryAfter = hardRequestTimeout
+	}
+	p.lock.Lock()
+	p.busyUntil = mclock.Now() + mclock.AbsTime(retryAfter)
+	p.lock.Unlock()
+}
+
 func sendRequest(w p2p.MsgWriter, msgcode, reqID, cost uint64, data interface{}) error {
 	type req struct {
 		ReqID uint64
@@ -172,6 +344,81 @@ func sendRequest(w p2p.MsgWriter, msgcode, reqID, cost uint64, data interface{})
 	return p2p.Send(w, msgcode, req{reqID, data})
 }
 
+// sendRequest sends a request of the given number of items to the peer, recording
+// the send time for the latency statistics.
+func (p *peer) sendRequest(msgcode, reqID, cost uint64, amount int, data interface{}) error {
+	p.latency.sent(reqID, msgcode, amount)
+	return sendRequest(p.rw, msgcode, reqID, cost, data)
+}
+
+// gotReply updates the flow control state, the latency statistics and the cost
+// estimates of the peer when a reply arrives.
+func (p *peer) gotReply(reqID, bv uint64) {
+	if p.fcServer.GotReply(reqID, bv) {
+		p.requestBufferValue()
+	}
+	if req, rtt, ok := p.latency.replied(reqID); ok && p.costEstimate != nil {
+		p.costEstimate.add(req.msgcode, req.amount, rtt)
+	}
+}
+
+// requestBufferValue asks an LES/2 server for the authoritative buffer value after
+// the flow control estimate drifted. The request is charged like any other, so
+// that the reply readjusts the estimate, it's sent in the background once the
+// buffer recharged. Only one resync is in flight at a time, a new one may be
+// started if the reply doesn't arrive in hardRequestTimeout.
+func (p *peer) requestBufferValue() {
+	if !p.supports(GetBufferValueMsg) {
+		return
+	}
+	reqID := genReqID()
+	if !atomic.CompareAndSwapUint64(&p.resyncing, 0, reqID) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), hardRequestTimeout)
+		defer cancel()
+
+		cost := p.GetRequestCost(GetBufferValueMsg, 0)
+		if _, err := p.fcServer.CanSendCtx(ctx, cost); err != nil {
+			atomic.CompareAndSwapUint64(&p.resyncing, reqID, 0)
+			return // the next drift retries
+		}
+		p.Log().Debug("Flow control state desynced, requesting buffer value")
+		p.fcServer.QueueRequest(reqID, cost)
+		if err := p2p.Send(p.rw, GetBufferValueMsg, struct{ ReqID uint64 }{reqID}); err != nil {
+			atomic.CompareAndSwapUint64(&p.resyncing, reqID, 0)
+			return
+		}
+		time.AfterFunc(hardRequestTimeout, func() { p.abandonResync(reqID) })
+	}()
+}
+
+// abandonResync allows a new buffer value resync if the given one is still in
+// flight.
+func (p *peer) abandonResync(reqID uint64) {
+	if atomic.CompareAndSwapUint64(&p.resyncing, reqID, 0) {
+		p.Log().Debug("Buffer value resync timed out")
+	}
+}
+
+// gotBufferValue applies the buffer value reported by the server for a resync.
+func (p *peer) gotBufferValue(reqID, bv uint64) {
+	p.fcServer.GotReply(reqID, bv)
+	atomic.CompareAndSwapUint64(&p.resyncing, reqID, 0)
+}
+
+// SendBufferValue reports the buffer value of the client for a resync request.
+func (p *peer) SendBufferValue(reqID, bv uint64) error {
+	return p2p.Send(p.rw, BufferValueMsg, struct{ ReqID, BV uint64 }{reqID, bv})
+}
+
+// LatencyStats returns the round-trip time statistics of the requests sent to
+// the peer, by request type.
+func (p *peer) LatencyStats() map[string]LatencyStats {
+	return p.latency.snapshot()
+}
+
 func sendResponse(w p2p.MsgWriter, msgcode, reqID, bv uint64, data interface{}) error {
 	type resp struct {
 		ReqID, BV uint64 // BV: Buffer Value
@@ -185,6 +432,10 @@ func (p *peer) GetRequestCost(msgcode uint64, amount int) uint64 {
 	defer p.lock.RUnlock()
 
 	cost := p.fcCosts[msgcode].baseCost + p.fcCosts[msgcode].reqCost*uint64(amount)
+	if p.costEstimate != nil {
+		// 响应比其他 server 慢的 server, 其 req 成本相应地调高
+		cost = uint64(float64(cost) * p.costEstimate.factor(msgcode))
+	}
 	if cost > p.fcServerParams.BufLimit {
 		cost = p.fcServerParams.BufLimit
 	}
@@ -199,6 +450,21 @@ func (p *peer) HasBlock(hash common.Hash, number uint64) bool {
 	return hasBlock != nil && hasBlock(hash, number)
 }
 
+// HasState checks if the peer has the given block and serves its state, which
+// is only guaranteed for the recent blocks announced in the handshake.
+func (p *peer) HasState(hash common.Hash, number uint64) bool {
+	if !p.HasBlock(hash, number) {
+		return false
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.serveRecentState == 0 || p.headInfo == nil {
+		return true
+	}
+	return number+p.serveRecentState > p.headInfo.Number
+}
+
 // SendAnnounce announces the availability of a number of blocks through
 // a hash notification.
 // todo 发送新block header 通知
@@ -214,9 +480,53 @@ func (p *peer) SendBlockHeaders(reqID, bv uint64, headers []*types.Header) error
 // SendBlockBodiesRLP sends a batch of block contents to the remote peer from
 // an already RLP encoded format.
 func (p *peer) SendBlockBodiesRLP(reqID, bv uint64, bodies []rlp.RawValue) error {
+	if p.bodyStreaming {
+		return p.SendBlockBodiesChunkRLP(reqID, bv, bodies, false)
+	}
 	return sendResponse(p.rw, BlockBodiesMsg, reqID, bv, bodies)
 }
 
+// SendBlockBodiesChunkRLP sends one chunk of a streamed block body response. The
+// more flag signals that further chunks belonging to the same request follow.
+// Only the buffer value of the last chunk is meaningful for the client.
+func (p *peer) SendBlockBodiesChunkRLP(reqID, bv uint64, bodies []rlp.RawValue, more bool) error {
+	type resp struct {
+		ReqID, BV uint64 // BV: Buffer Value
+		Data      []rlp.RawValue
+		More      bool
+	}
+	return p2p.Send(p.rw, BlockBodiesMsg, resp{reqID, bv, bodies, more})
+}
+
+// maxPendingBodyStreams is the number of incomplete streamed body responses a
+// client accepts from a single server at the same time.
+const maxPendingBodyStreams = 16
+
+// collectBodyChunk stores a chunk of a streamed body response. If it is the last
+// one, the complete list of bodies is returned and complete is set to true.
+func (p *peer) collectBodyChunk(reqID uint64, bodies []*types.Body, more bool) (all []*types.Body, complete bool, err error) {
+	p.chunkLock.Lock()
+	defer p.chunkLock.Unlock()
+
+	all = append(p.bodyChunks[reqID], bodies...)
+	if len(all) > MaxBodyStreamFetch {
+		delete(p.bodyChunks, reqID)
+		return nil, false, errResp(ErrInvalidResponse, "too many streamed bodies for reqID %v", reqID)
+	}
+	if !more {
+		delete(p.bodyChunks, reqID)
+		return all, true, nil
+	}
+	if p.bodyChunks == nil {
+		p.bodyChunks = make(map[uint64][]*types.Body)
+	}
+	if _, ok := p.bodyChunks[reqID]; !ok && len(p.bodyChunks) >= maxPendingBodyStreams {
+		return nil, false, errResp(ErrInvalidResponse, "too many pending body streams")
+	}
+	p.bodyChunks[reqID] = all
+	return nil, false, nil
+}
+
 // SendCodeRLP sends a batch of arbitrary internal data, corresponding to the
 // hashes requested.
 func (p *peer) SendCode(reqID, bv uint64, data [][]byte) error {
@@ -236,6 +546,9 @@ func (p *peer) SendProofs(reqID, bv uint64, proofs proofsData) error {
 
 // SendProofsV2 sends a batch of merkle proofs, corresponding to the ones requested.
 func (p *peer) SendProofsV2(reqID, bv uint64, proofs light.NodeList) error {
+	if p.proofStreaming {
+		return p.sendProofsV2Chunks(reqID, bv, proofs)
+	}
 	return sendResponse(p.rw, ProofsV2Msg, reqID, bv, proofs)
 }
 
@@ -246,6 +559,9 @@ func (p *peer) SendHeaderProofs(reqID, bv uint64, proofs []ChtResp) error {
 
 // SendHelperTrieProofs sends a batch of HelperTrie proofs, corresponding to the ones requested.
 func (p *peer) SendHelperTrieProofs(reqID, bv uint64, resp HelperTrieResps) error {
+	if p.proofStreaming {
+		return p.sendHelperTrieProofsChunks(reqID, bv, resp)
+	}
 	return sendResponse(p.rw, HelperTrieProofsMsg, reqID, bv, resp)
 }
 
@@ -254,40 +570,60 @@ func (p *peer) SendTxStatus(reqID, bv uint64, stats []txStatus) error {
 	return sendResponse(p.rw, TxStatusMsg, reqID, bv, stats)
 }
 
+// SendTxStatusAdvice sends a batch of transaction status records followed by the
+// pending nonces of the senders, if the peer supports them.
+func (p *peer) SendTxStatusAdvice(reqID, bv uint64, stats []txStatus, advice []txNonceAdvice) error {
+	if !p.nonceAdvice || len(advice) == 0 {
+		return p.SendTxStatus(reqID, bv, stats)
+	}
+	type resp struct {
+		ReqID, BV uint64 // BV: Buffer Value
+		Status    []txStatus
+		Nonces    []txNonceAdvice `rlp:"tail"`
+	}
+	return p2p.Send(p.rw, TxStatusMsg, resp{reqID, bv, stats, advice})
+}
+
+// SendServerBusy tells the client that a request has been rejected because the
+// server is overloaded, and that it may be retried after the given time.
+func (p *peer) SendServerBusy(reqID, bv uint64, retryAfter time.Duration) error {
+	return sendResponse(p.rw, ServerBusyMsg, reqID, bv, uint64(retryAfter/time.Millisecond))
+}
+
 // RequestHeadersByHash fetches a batch of blocks' headers corresponding to the
 // specified header query, based on the hash of an origin block.
 //
 // 根据Hash 去拿 header
 func (p *peer) RequestHeadersByHash(reqID, cost uint64, origin common.Hash, amount int, skip int, reverse bool) error {
 	p.Log().Debug("Fetching batch of headers", "count", amount, "fromhash", origin, "skip", skip, "reverse", reverse)
-	return sendRequest(p.rw, GetBlockHeadersMsg, reqID, cost, &getBlockHeadersData{Origin: hashOrNumber{Hash: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse})
+	return p.sendRequest(GetBlockHeadersMsg, reqID, cost, amount, &getBlockHeadersData{Origin: hashOrNumber{Hash: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse})
 }
 
 // RequestHeadersByNumber fetches a batch of blocks' headers corresponding to the
 // specified header query, based on the number of an origin block.
 func (p *peer) RequestHeadersByNumber(reqID, cost, origin uint64, amount int, skip int, reverse bool) error {
 	p.Log().Debug("Fetching batch of headers", "count", amount, "fromnum", origin, "skip", skip, "reverse", reverse)
-	return sendRequest(p.rw, GetBlockHeadersMsg, reqID, cost, &getBlockHeadersData{Origin: hashOrNumber{Number: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse})
+	return p.sendRequest(GetBlockHeadersMsg, reqID, cost, amount, &getBlockHeadersData{Origin: hashOrNumber{Number: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse})
 }
 
 // RequestBodies fetches a batch of blocks' bodies corresponding to the hashes
 // specified.
 func (p *peer) RequestBodies(reqID, cost uint64, hashes []common.Hash) error {
 	p.Log().Debug("Fetching batch of block bodies", "count", len(hashes))
-	return sendRequest(p.rw, GetBlockBodiesMsg, reqID, cost, hashes)
+	return p.sendRequest(GetBlockBodiesMsg, reqID, cost, len(hashes), hashes)
 }
 
 // RequestCode fetches a batch of arbitrary data from a node's known state
 // data, corresponding to the specified hashes.
 func (p *peer) RequestCode(reqID, cost uint64, reqs []CodeReq) error {
 	p.Log().Debug("Fetching batch of codes", "count", len(reqs))
-	return sendRequest(p.rw, GetCodeMsg, reqID, cost, reqs)
+	return p.sendRequest(GetCodeMsg, reqID, cost, len(reqs), reqs)
 }
 
 // RequestReceipts fetches a batch of transaction receipts from a remote node.
 func (p *peer) RequestReceipts(reqID, cost uint64, hashes []common.Hash) error {
 	p.Log().Debug("Fetching batch of receipts", "count", len(hashes))
-	return sendRequest(p.rw, GetReceiptsMsg, reqID, cost, hashes)
+	return p.sendRequest(GetReceiptsMsg, reqID, cost, len(hashes), hashes)
 }
 
 // RequestProofs fetches a batch of merkle proofs from a remote node.
@@ -299,9 +635,9 @@ func (p *peer) RequestProofs(reqID, cost uint64, reqs []ProofReq) error {
 	p.Log().Debug("Fetching batch of proofs", "count", len(reqs))
 	switch p.version {
 	case lpv1:
-		return sendRequest(p.rw, GetProofsV1Msg, reqID, cost, reqs)
+		return p.sendRequest(GetProofsV1Msg, reqID, cost, len(reqs), reqs)
 	case lpv2:
-		return sendRequest(p.rw, GetProofsV2Msg, reqID, cost, reqs)
+		return p.sendRequest(GetProofsV2Msg, reqID, cost, len(reqs), reqs)
 	default:
 		panic(nil)
 	}
@@ -331,9 +667,9 @@ func (p *peer) RequestHelperTrieProofs(reqID, cost uint64, reqs []HelperTrieReq)
 			// 将HelperTrie请求转换为旧的CHT请求
 			reqsV1[i] = ChtReq{ChtNum: (req.TrieIdx + 1) * (light.CHTFrequencyClient / light.CHTFrequencyServer), BlockNum: blockNum, FromLevel: req.FromLevel}
 		}
-		return sendRequest(p.rw, GetHeaderProofsMsg, reqID, cost, reqsV1)
+		return p.sendRequest(GetHeaderProofsMsg, reqID, cost, len(reqsV1), reqsV1)
 	case lpv2:
-		return sendRequest(p.rw, GetHelperTrieProofsMsg, reqID, cost, reqs)
+		return p.sendRequest(GetHelperTrieProofsMsg, reqID, cost, len(reqs), reqs)
 	default:
 		panic(nil)
 	}
@@ -343,11 +679,18 @@ func (p *peer) RequestHelperTrieProofs(reqID, cost uint64, reqs []HelperTrieReq)
 //
 /**
  todo RequestTxStatus:
-		从远程 peer 获取一批 txs 状态记录  (貌似没人调用)
+		从远程 peer 获取一批 txs 状态记录  (LesTxRelay 用来轮询已发送的 tx)
  */
 func (p *peer) RequestTxStatus(reqID, cost uint64, txHashes []common.Hash) error {
 	p.Log().Debug("Requesting transaction status", "count", len(txHashes))
-	return sendRequest(p.rw, GetTxStatusMsg, reqID, cost, txHashes)
+	return p.sendRequest(GetTxStatusMsg, reqID, cost, len(txHashes), txHashes)
+}
+
+// SubscribeTxStatus asks the remote node to push the status changes of a batch of
+// transactions. The current status of them is returned in a TxStatus reply.
+func (p *peer) SubscribeTxStatus(reqID, cost uint64, txHashes []common.Hash) error {
+	p.Log().Debug("Subscribing to transaction status", "count", len(txHashes))
+	return p.sendRequest(TxStatusSubscribeMsg, reqID, cost, len(txHashes), txHashes)
 }
 
 // SendTxStatus sends a batch of transactions to be added to the remote transaction pool.
@@ -366,7 +709,7 @@ func (p *peer) SendTxs(reqID, cost uint64, txs types.Transactions) error {
 	case lpv2:
 
 		// todo 后面以太坊都用这个
-		return sendRequest(p.rw, SendTxV2Msg, reqID, cost, txs)
+		return p.sendRequest(SendTxV2Msg, reqID, cost, len(txs), txs)
 	default:
 		panic(nil)
 	}
@@ -524,11 +867,35 @@ func (p *peer) Handshake(td *big.Int, head common.Hash, headNum uint64, genesis
 		p.fcCosts = list.decode()
 	} else {
 
-		// 设置为默认，直到实现“非常轻巧”客户端模式
-		p.requestAnnounceType = announceTypeSimple // set to default until "very light" client mode is implemented
+		// 默认为 announceTypeSimple, 除非 pm 已经要求对端对 announce 签名
+		// 超轻节点模式下 不计票的 server 则要求 announceTypeNone (不发送 announce)
+		if p.noAnnounce {
+			p.requestAnnounceType = announceTypeNone
+		} else if p.requestAnnounceType == announceTypeNone {
+			p.requestAnnounceType = announceTypeSimple
+		}
 		send = send.add("announceType", p.requestAnnounceType)
 	}
 
+	// LES/2 节点都支持分块发送 bodies 的 resp
+	if p.version >= lpv2 {
+		send = send.add("bodyStreaming", nil)
+		send = send.add("txStatusPush", nil)
+		send = send.add("stateHints", nil)
+		send = send.add("nonceAdvice", nil)
+		send = send.add("proofStreaming", nil)
+		send = send.add("serverBusy", nil)
+		if (server != nil && server.privateKey != nil) || p.requestSignedResponses {
+			send = send.add("signResponses", nil)
+		}
+		if server != nil {
+			// 保证可以提供 state 的最近块数, 与 blockchain 的 gc 保留窗口 及 本地实际可用的 state 范围一致
+			send = send.add("serveRecentState", server.servedStates())
+		}
+	}
+	// 追加 已注册的 握手扩展 及其列表
+	send = addExtensions(send, p.ID(), server != nil)
+
 	/**
 	TODO 这里处理 p2p 的 send/receive
 	 */
@@ -576,6 +943,20 @@ func (p *peer) Handshake(td *big.Int, head common.Hash, headNum uint64, genesis
 	if int(rVersion) != p.version {
 		return errResp(ErrProtocolVersionMismatch, "%d (!= %d)", rVersion, p.version)
 	}
+	p.bodyStreaming = p.version >= lpv2 && recv.get("bodyStreaming", nil) == nil
+	p.txStatusPush = p.version >= lpv2 && recv.get("txStatusPush", nil) == nil
+	p.stateHints = p.version >= lpv2 && recv.get("stateHints", nil) == nil
+	p.nonceAdvice = p.version >= lpv2 && recv.get("nonceAdvice", nil) == nil
+	p.proofStreaming = p.version >= lpv2 && recv.get("proofStreaming", nil) == nil
+	p.serverBusy = p.version >= lpv2 && recv.get("serverBusy", nil) == nil
+	if p.extensions, p.unknownKeys, err = negotiateExtensions(recv, p.ID(), server != nil); err != nil {
+		return err
+	}
+	if server != nil {
+		p.signResponses = server.privateKey != nil && p.version >= lpv2 && recv.get("signResponses", nil) == nil
+	} else {
+		p.signResponses = p.requestSignedResponses && p.version >= lpv2 && recv.get("signResponses", nil) == nil
+	}
 
 
 	// 根据条件 选择性的获取 参数
@@ -590,8 +971,18 @@ func (p *peer) Handshake(td *big.Int, head common.Hash, headNum uint64, genesis
 			// todo 如果是 轻节点的server 端,则默认是: announceTypeSimple
 			p.announceType = announceTypeSimple
 		}
+		if p.announceType > announceTypeSigned {
+			return errResp(ErrInvalidResponse, "unknown announce type %d", p.announceType)
+		}
+		if p.announceType == announceTypeSigned && server.privateKey == nil {
+			return errResp(ErrUselessPeer, "signed announcements not available")
+		}
 		// todo 则，确认 `对端节点实例 p` 是 client
 		p.fcClient = flowcontrol.NewClientNode(server.fcManager, server.defParams)
+		p.fcClient.SetID(p.id)
+		if weight, ok := server.clientWeights[p.ID()]; ok {
+			p.fcClient.SetWeight(weight)
+		}
 	} else {
 
 		// todo 如果当前节点是 client的话
@@ -617,8 +1008,11 @@ func (p *peer) Handshake(td *big.Int, head common.Hash, headNum uint64, genesis
 		}
 		p.fcServerParams = params
 		// todo 否则，确认 `对端节点实例 p` 是 server
-		p.fcServer = flowcontrol.NewServerNode(params)
+		p.fcServer = flowcontrol.NewServerNode(params, mclock.System{})
 		p.fcCosts = MRC.decode()
+		if p.version >= lpv2 {
+			recv.get("serveRecentState", &p.serveRecentState) // optional, all states if missing
+		}
 	}
 
 	// 组装对端节点的 block的当前 head信息
@@ -651,6 +1045,19 @@ type peerSetNotify interface {
 	unregisterPeer(*peer)
 }
 
+// notifyQueueSize is the number of pending peerSetNotify callbacks of a peer.
+const notifyQueueSize = 16
+
+const (
+	// sendQueueSize is the number of messages waiting to be sent to a peer in
+	// each lane of its send queue.
+	sendQueueSize = 100
+
+	// sendQueueTimeout is the time a response waits for room in the send queue
+	// before the peer is considered too slow and dropped.
+	sendQueueTimeout = 10 * time.Second
+)
+
 // peerSet represents the collection of active peers currently participating in
 // the Light Ethereum sub-protocol.
 type peerSet struct {
@@ -659,12 +1066,26 @@ type peerSet struct {
 	// 记录所有发过 notify 通知给 peerSet中的peer 的 notify实例
 	notifyList []peerSetNotify
 	closed     bool
+
+	// peer 的信誉分, 以及被拉黑的 peer (id => 解禁时间)
+	scores map[string]int            // reputation scores of the registered peers
+	banned map[string]mclock.AbsTime // ban expiry times of the misbehaving peers
+	clock  mclock.Clock
+
+	// 按协议版本统计的 peer 数, 以及没有任何 server 支持的 neededCapabilities
+	versions map[int]int     // number of registered peers by protocol version
+	missing  map[uint64]bool // needed capabilities without providers, already warned about
 }
 
 // newPeerSet creates a new peer set to track the active participants.
 func newPeerSet() *peerSet {
 	return &peerSet{
-		peers: make(map[string]*peer),
+		peers:    make(map[string]*peer),
+		scores:   make(map[string]int),
+		banned:   make(map[string]mclock.AbsTime),
+		clock:    mclock.System{},
+		versions: make(map[int]int),
+		missing:  make(map[uint64]bool),
 	}
 }
 
@@ -687,14 +1108,19 @@ func (ps *peerSet) notify(n peerSetNotify) {
 	// 但是在lock中直接做 append 耗时很快
 	// todo 还有一种好的写法是，在lock中启用 goroutine 调用 n.registerPeer
 	// (相当于取了个 peerSet 的快照)
+	//
+	// 已注册的 peer 通过其 notifyQueue 排队, 保证在 unregisterPeer 之前执行
 	for _, p := range ps.peers {
 		peers = append(peers, p)
 	}
 	ps.lock.Unlock()
 
+	// The registrations wait for room in the queues of the peers. A peer whose
+	// queue is closing has been unregistered meanwhile and is skipped.
 	for _, p := range peers {
+		p := p
 		// 调用 Notify实例 逐个注册 peerSet中的 peer
-		n.registerPeer(p)
+		p.notifyQueue.queueWait(context.Background(), false, func() { n.registerPeer(p) })
 	}
 }
 
@@ -713,24 +1139,47 @@ func (ps *peerSet) Register(p *peer) error {
 		ps.lock.Unlock()
 		return errAlreadyRegistered
 	}
+	// 被拉黑的 peer 在解禁前不能再连接
+	if ps.isBanned(p.id) {
+		ps.lock.Unlock()
+		return errBannedPeer
+	}
 
 	// 如果 peer 还未存在,则加入 peerSet中
 	ps.peers[p.id] = p
+	ps.registered(p)
 
 	// 创建一个 func 队列实例
 	// 该队列在创建的同时就已经进入 监听阶段了
-	p.sendQueue = newExecQueue(100)
+	p.sendQueue = newExecQueue(sendQueueSize)
+	p.sendQueue.setDepthHook(func(high, normal int) {
+		peerSendQueueGauge.With(p.id, "high").Update(int64(high))
+		peerSendQueueGauge.With(p.id, "normal").Update(int64(normal))
+	})
+
+	// The services are notified asynchronously so that slow callbacks don't
+	// hold up the handshake, the queue keeps them ordered with the unregistration
+	//
+	// 每一次有新的peer注册到pm的时候,都需要将peer 逐个注册到 对应改的 notify 实现上 (异步, 不阻塞握手)
+	p.notifyQueue = newExecQueue(notifyQueueSize)
 	peers := make([]peerSetNotify, len(ps.notifyList))
 	copy(peers, ps.notifyList)
+	p.notifyQueue.queue(func() {
+		for _, n := range peers {
+			n.registerPeer(p)
+		}
+	})
 	ps.lock.Unlock()
-
-	// 每一次有新的peer注册到pm的时候,都需要将peer 逐个注册到 对应改的 notify 实现上
-	for _, n := range peers {
-		n.registerPeer(p)
-	}
 	return nil
 }
 
+// afterRegistration runs a function of a registered peer once the services have
+// been notified about the peer, e.g. to act on the peer in one of them. The
+// function is dropped if the peer gets unregistered first.
+func (ps *peerSet) afterRegistration(p *peer, f func()) {
+	p.notifyQueue.queueWait(context.Background(), false, f)
+}
+
 // Unregister removes a remote peer from the active set, disabling any further
 // actions to/from that particular entity. It also initiates disconnection at the networking layer.
 func (ps *peerSet) Unregister(id string) error {
@@ -742,16 +1191,27 @@ func (ps *peerSet) Unregister(id string) error {
 
 		// 先从pm的peerSet中删除对应pid的peer
 		delete(ps.peers, id)
+		ps.unregistered(p)
+		// 负分会被保留, 重连的 peer 不能借此清空自己的信誉分
+		if ps.scores[id] >= 0 || len(ps.scores) > maxScoredPeers {
+			delete(ps.scores, id)
+		}
 		peers := make([]peerSetNotify, len(ps.notifyList))
 		copy(peers, ps.notifyList)
 		ps.lock.Unlock()
 
 		// 每一次有peer被移除时,都需要逐个到对应的 notify 上面去移除掉
-		for _, n := range peers {
-			n.unregisterPeer(p)
-		}
+		// (排在 pending 的 registerPeer 之后, 并等待其全部执行完)
+		p.notifyQueue.drain(func() {
+			for _, n := range peers {
+				n.unregisterPeer(p)
+			}
+		})
+
 		// 将该peer 的func 执行队列关闭
 		p.sendQueue.quit()
+		peerSendQueueGauge.DeleteLabel("peer", p.id)
+		p.latency.stop()
 		// 断开对端peer 的链接
 		p.Peer.Disconnect(p2p.DiscUselessPeer)
 		return nil
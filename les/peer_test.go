@@ -0,0 +1,191 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+)
+
+// Tests that state requests are only sent for the recent blocks whose state is
+// served by the server.
+func TestPeerHasState(t *testing.T) {
+	p := &peer{
+		hasBlock: func(common.Hash, uint64) bool { return true },
+		headInfo: &announceData{Number: 1000},
+	}
+	for _, tt := range []struct {
+		recent uint64
+		number uint64
+		want   bool
+	}{
+		{0, 0, true},
+		{0, 1000, true},
+		{128, 1000, true},
+		{128, 873, true},
+		{128, 872, false},
+		{128, 0, false},
+	} {
+		p.serveRecentState = tt.recent
+		if have := p.HasState(common.Hash{}, tt.number); have != tt.want {
+			t.Errorf("recent %d, block #%d: have %v, want %v", tt.recent, tt.number, have, tt.want)
+		}
+	}
+	p.hasBlock = nil
+	if p.HasState(common.Hash{}, 1000) {
+		t.Errorf("state reported for unknown block")
+	}
+}
+
+// orderNotify is a peerSetNotify recording the callbacks, delayed by a gate.
+type orderNotify struct {
+	name   string
+	gate   chan struct{}
+	lock   *sync.Mutex
+	events *[]string
+}
+
+func (n *orderNotify) registerPeer(p *peer) {
+	<-n.gate
+	n.lock.Lock()
+	*n.events = append(*n.events, fmt.Sprintf("%s register %s", n.name, p.id[:4]))
+	n.lock.Unlock()
+}
+
+func (n *orderNotify) unregisterPeer(p *peer) {
+	n.lock.Lock()
+	*n.events = append(*n.events, fmt.Sprintf("%s unregister %s", n.name, p.id[:4]))
+	n.lock.Unlock()
+}
+
+// Tests that the peer registration doesn't wait for the notified services, while
+// the unregistration waits for the pending registrations and stays ordered after
+// them.
+func TestPeerSetNotifyOrder(t *testing.T) {
+	var (
+		ps     = newPeerSet()
+		gate   = make(chan struct{})
+		lock   sync.Mutex
+		events []string
+	)
+	ps.notify(&orderNotify{"a", gate, &lock, &events})
+
+	p := newScoreTestPeer(1)
+	registered := make(chan error)
+	go func() { registered <- ps.Register(p) }()
+	select {
+	case err := <-registered:
+		if err != nil {
+			t.Fatalf("registration failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("registration blocked by the notified service")
+	}
+	// A service added meanwhile is notified after the pending ones
+	ps.notify(&orderNotify{"b", gate, &lock, &events})
+	ran := make(chan struct{})
+	ps.afterRegistration(p, func() { close(ran) })
+
+	unregistered := make(chan error)
+	go func() { unregistered <- ps.Unregister(p.id) }()
+	select {
+	case <-unregistered:
+		t.Fatalf("unregistration didn't wait for the pending registrations")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gate)
+	if err := <-unregistered; err != nil {
+		t.Fatalf("unregistration failed: %v", err)
+	}
+	<-ran
+
+	id := p.id[:4]
+	want := []string{"a register " + id, "b register " + id, "a unregister " + id, "b unregister " + id}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("callback order mismatch:\nhave %v\nwant %v", events, want)
+	}
+}
+
+// Tests that a single buffer value resync is in flight at a time, and that an
+// unanswered one doesn't block the later resyncs.
+func TestPeerBufferValueResync(t *testing.T) {
+	p := newCapabilityTestServer(1, lpv2, false)
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	p.rw = net
+
+	resync := func() (reqID uint64) {
+		go p.requestBufferValue()
+		msg, err := app.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read resync request: %v", err)
+		}
+		var req struct{ ReqID uint64 }
+		if msg.Code != GetBufferValueMsg || msg.Decode(&req) != nil {
+			t.Fatalf("unexpected resync request: %v", msg)
+		}
+		return req.ReqID
+	}
+	first := resync()
+	p.requestBufferValue()
+	if id := atomic.LoadUint64(&p.resyncing); id != first {
+		t.Fatalf("resync in flight mismatch: have %d, want %d", id, first)
+	}
+	// A timed out resync allows a new one, the late reply doesn't end it
+	p.abandonResync(first)
+	second := resync()
+	p.gotBufferValue(first, 1000)
+	if id := atomic.LoadUint64(&p.resyncing); id != second {
+		t.Fatalf("resync ended by stale reply: have %d, want %d", id, second)
+	}
+	p.gotBufferValue(second, 1000)
+	if id := atomic.LoadUint64(&p.resyncing); id != 0 {
+		t.Errorf("resync not ended by its reply: %d", id)
+	}
+}
+
+// Tests that flushing the replies waits until the earlier queued ones are sent.
+func TestPeerFlushReplies(t *testing.T) {
+	p := &peer{sendQueue: newExecQueue(sendQueueSize)}
+	defer p.sendQueue.quit()
+
+	var sent int32
+	block := make(chan struct{})
+	p.queueReply(func() error { <-block; atomic.StoreInt32(&sent, 1); return nil })
+
+	flushed := make(chan struct{})
+	go func() {
+		p.flushReplies()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		t.Fatalf("flushed before the pending reply was sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(block)
+	<-flushed
+	if atomic.LoadInt32(&sent) != 1 {
+		t.Errorf("pending reply not sent")
+	}
+}
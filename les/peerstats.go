@@ -0,0 +1,169 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+// maxTrackedRequests is the number of unanswered requests per peer above which
+// the ones older than hardRequestTimeout are forgotten.
+const maxTrackedRequests = 256
+
+// requestNames maps the request message codes to the names used in the latency
+// metrics and stats.
+var requestNames = map[uint64]string{
+	GetBlockHeadersMsg:     "headers",
+	GetBlockBodiesMsg:      "bodies",
+	GetReceiptsMsg:         "receipts",
+	GetProofsV1Msg:         "proofs",
+	GetProofsV2Msg:         "proofs",
+	GetCodeMsg:             "code",
+	GetHeaderProofsMsg:     "helperTrieProofs",
+	GetHelperTrieProofsMsg: "helperTrieProofs",
+	SendTxV2Msg:            "txs",
+	GetTxStatusMsg:         "txStatus",
+	TxStatusSubscribeMsg:   "txStatus",
+}
+
+// LatencyStats is a summary of the round-trip times of one request type.
+type LatencyStats struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	Max   time.Duration `json:"max"`
+	P50   time.Duration `json:"p50"` // Percentiles are only available if metrics are enabled
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+}
+
+// requestLatency collects the round-trip times of one request type.
+type requestLatency struct {
+	count      uint64
+	total, max time.Duration
+	timer      metrics.Timer // registered per-peer timer, NilTimer if metrics are disabled
+}
+
+// pendingRequest is a sent request waiting for its reply.
+type pendingRequest struct {
+	name    string
+	msgcode uint64
+	amount  int // number of items requested
+	sent    mclock.AbsTime
+}
+
+// latencyTracker measures the time between sending a request to a server and
+// receiving the reply, separately for each request type.
+//
+// latencyTracker: 统计 发送 req 到收到 server resp 之间的时间 (按 req 类型分别统计)
+type latencyTracker struct {
+	prefix string // metrics name prefix of the peer
+
+	lock    sync.Mutex
+	pending map[uint64]pendingRequest  // sent requests by reqID
+	stats   map[string]*requestLatency // latency statistics by request name
+}
+
+// newLatencyTracker creates a latency tracker for the peer with the given id.
+func newLatencyTracker(id string) *latencyTracker {
+	return &latencyTracker{
+		prefix:  fmt.Sprintf("les/client/peer/%s/latency/", id),
+		pending: make(map[uint64]pendingRequest),
+		stats:   make(map[string]*requestLatency),
+	}
+}
+
+// sent records that a request of the given number of items has been sent.
+func (t *latencyTracker) sent(reqID, msgcode uint64, amount int) {
+	name, ok := requestNames[msgcode]
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := mclock.Now()
+	if len(t.pending) >= maxTrackedRequests {
+		for id, req := range t.pending {
+			if time.Duration(now-req.sent) > hardRequestTimeout {
+				delete(t.pending, id)
+			}
+		}
+	}
+	t.pending[reqID] = pendingRequest{name: name, msgcode: msgcode, amount: amount, sent: now}
+}
+
+// replied records the arrival of the (first) reply to a request, returning the
+// request and the measured round-trip time.
+func (t *latencyTracker) replied(reqID uint64) (pendingRequest, time.Duration, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	req, ok := t.pending[reqID]
+	if !ok {
+		return pendingRequest{}, 0, false
+	}
+	delete(t.pending, reqID)
+
+	stats := t.stats[req.name]
+	if stats == nil {
+		stats = &requestLatency{timer: metrics.NewRegisteredTimer(t.prefix+req.name, nil)}
+		t.stats[req.name] = stats
+	}
+	rtt := time.Duration(mclock.Now() - req.sent)
+	stats.count++
+	stats.total += rtt
+	if rtt > stats.max {
+		stats.max = rtt
+	}
+	stats.timer.Update(rtt)
+	return req, rtt, true
+}
+
+// snapshot returns the latency statistics collected so far.
+func (t *latencyTracker) snapshot() map[string]LatencyStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	result := make(map[string]LatencyStats, len(t.stats))
+	for name, stats := range t.stats {
+		ps := stats.timer.Percentiles([]float64{0.5, 0.95, 0.99})
+		result[name] = LatencyStats{
+			Count: stats.count,
+			Mean:  stats.total / time.Duration(stats.count),
+			Max:   stats.max,
+			P50:   time.Duration(ps[0]),
+			P95:   time.Duration(ps[1]),
+			P99:   time.Duration(ps[2]),
+		}
+	}
+	return result
+}
+
+// stop removes the per-peer timers from the metrics registry.
+func (t *latencyTracker) stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for name := range t.stats {
+		metrics.DefaultRegistry.Unregister(t.prefix + name)
+	}
+}
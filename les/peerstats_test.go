@@ -0,0 +1,54 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := newLatencyTracker("test")
+	defer tracker.stop()
+
+	tracker.sent(1, GetBlockHeadersMsg, 1)
+	tracker.sent(2, GetBlockHeadersMsg, 1)
+	tracker.sent(3, GetReceiptsMsg, 1)
+	tracker.sent(4, AnnounceMsg, 1) // not a request, ignored
+	time.Sleep(10 * time.Millisecond)
+
+	tracker.replied(1)
+	tracker.replied(1) // second chunk of the same reply, ignored
+	tracker.replied(2)
+	tracker.replied(4)
+	tracker.replied(5) // never sent
+
+	stats := tracker.snapshot()
+	if len(stats) != 1 {
+		t.Fatalf("stats length mismatch: have %d, want 1", len(stats))
+	}
+	headers := stats["headers"]
+	if headers.Count != 2 {
+		t.Errorf("reply count mismatch: have %d, want 2", headers.Count)
+	}
+	if headers.Mean < 10*time.Millisecond || headers.Max < headers.Mean {
+		t.Errorf("latency mismatch: mean %v, max %v", headers.Mean, headers.Max)
+	}
+	if len(tracker.pending) != 1 {
+		t.Errorf("pending request count mismatch: have %d, want 1", len(tracker.pending))
+	}
+}
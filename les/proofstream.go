@@ -0,0 +1,281 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+const (
+	// proofChunkSize is the size above which the proof responses sent to clients
+	// supporting proof streaming are split into continuation messages. It stays
+	// under softResponseLimit so that no single message exceeds what the other
+	// responses are limited to.
+	proofChunkSize = softResponseLimit / 2
+
+	// maxProofStreamChunks is the maximum number of chunks of a single streamed
+	// proof response. Servers omit the proofs not fitting into them.
+	maxProofStreamChunks = 16
+
+	// maxPendingProofStreams is the number of incomplete streamed proof responses
+	// a client accepts from a single server at the same time.
+	maxPendingProofStreams = 16
+)
+
+// proofStream is a partially received streamed proof response.
+//
+// proofStream: 正在接收中的分块 proof resp, 按 index 顺序拼接
+type proofStream struct {
+	code        uint64                   // message code of the response
+	next, total uint64                   // index of the next expected chunk and the number of chunks
+	nodes       light.NodeList           // proof nodes received so far
+	aux         [][]byte                 // auxiliary data received so far (helper trie proofs only)
+	seen        map[common.Hash]struct{} // hashes of the received nodes
+	expect      map[common.Hash]struct{} // hashes of the requested roots and the nodes referenced so far
+}
+
+// expectProofRoots records the trie roots a proof request is answered against,
+// allowing the chunks of a streamed response to be verified as they arrive. The
+// roots are forgotten when the first chunk arrives or the request times out.
+func (p *peer) expectProofRoots(reqID uint64, roots ...common.Hash) {
+	if !p.proofStreaming {
+		return
+	}
+	p.chunkLock.Lock()
+	if p.proofRoots == nil {
+		p.proofRoots = make(map[uint64][]common.Hash)
+	}
+	p.proofRoots[reqID] = roots
+	p.chunkLock.Unlock()
+
+	time.AfterFunc(hardRequestTimeout, func() {
+		p.chunkLock.Lock()
+		delete(p.proofRoots, reqID)
+		p.chunkLock.Unlock()
+	})
+}
+
+// proofNodeRefs adds the hashes referenced by an encoded trie node (including
+// the ones in its embedded children) to refs. Values of the same length are
+// added too, which only widens the set of acceptable nodes.
+func proofNodeRefs(node []byte, refs map[common.Hash]struct{}) error {
+	elems, _, err := rlp.SplitList(node)
+	if err != nil {
+		return err
+	}
+	for len(elems) > 0 {
+		kind, content, rest, err := rlp.Split(elems)
+		if err != nil {
+			return err
+		}
+		switch {
+		case kind == rlp.List:
+			if err := proofNodeRefs(elems[:len(elems)-len(rest)], refs); err != nil {
+				return err
+			}
+		case len(content) == common.HashLength:
+			refs[common.BytesToHash(content)] = struct{}{}
+		}
+		elems = rest
+	}
+	return nil
+}
+
+// proofChunkBounds splits a list of items with the given sizes into consecutive
+// chunks of at most limit bytes (or a single item if that's larger) and returns
+// the end index of each chunk. At least one, possibly empty chunk is returned.
+func proofChunkBounds(sizes []int, limit int) []int {
+	var (
+		bounds []int
+		size   int
+	)
+	for i, s := range sizes {
+		if size > 0 && size+s > limit {
+			bounds = append(bounds, i)
+			size = 0
+		}
+		size += s
+	}
+	return append(bounds, len(sizes))
+}
+
+// sendResponseChunk sends one chunk of a streamed response. Only the buffer value
+// of the last chunk is meaningful for the client.
+func sendResponseChunk(w p2p.MsgWriter, msgcode, reqID, bv, index, total uint64, data interface{}) error {
+	type chunk struct {
+		ReqID, BV    uint64 // BV: Buffer Value
+		Index, Total uint64
+		Data         interface{}
+	}
+	return p2p.Send(w, msgcode, chunk{reqID, bv, index, total, data})
+}
+
+// sendProofsV2Chunks streams a batch of merkle proofs in as many chunks as needed.
+func (p *peer) sendProofsV2Chunks(reqID, bv uint64, proofs light.NodeList) error {
+	sizes := make([]int, len(proofs))
+	for i, node := range proofs {
+		sizes[i] = len(node)
+	}
+	bounds := proofChunkBounds(sizes, proofChunkSize)
+	if len(bounds) > maxProofStreamChunks {
+		bounds = bounds[:maxProofStreamChunks]
+	}
+	start, total := 0, uint64(len(bounds))
+	for i, end := range bounds {
+		var chunkBV uint64
+		if uint64(i) == total-1 {
+			chunkBV = bv
+		}
+		if err := sendResponseChunk(p.rw, ProofsV2Msg, reqID, chunkBV, uint64(i), total, proofs[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// sendHelperTrieProofsChunks streams a batch of helper trie proofs in as many
+// chunks as needed. The proof nodes are sent first, followed by the auxiliary data.
+func (p *peer) sendHelperTrieProofsChunks(reqID, bv uint64, resp HelperTrieResps) error {
+	sizes := make([]int, 0, len(resp.Proofs)+len(resp.AuxData))
+	for _, node := range resp.Proofs {
+		sizes = append(sizes, len(node))
+	}
+	for _, data := range resp.AuxData {
+		sizes = append(sizes, len(data))
+	}
+	bounds := proofChunkBounds(sizes, proofChunkSize)
+	if len(bounds) > maxProofStreamChunks {
+		bounds = bounds[:maxProofStreamChunks]
+	}
+	// clip returns the part of the [start, end) item range falling into [from, to)
+	clip := func(start, end, from, to int) (int, int) {
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if start > end {
+			start = end
+		}
+		return start - from, end - from
+	}
+	var (
+		start  int
+		total  = uint64(len(bounds))
+		nodes  = len(resp.Proofs)
+		length = len(sizes)
+	)
+	for i, end := range bounds {
+		var (
+			chunk   HelperTrieResps
+			chunkBV uint64
+		)
+		from, to := clip(start, end, 0, nodes)
+		chunk.Proofs = resp.Proofs[from:to]
+		from, to = clip(start, end, nodes, length)
+		chunk.AuxData = resp.AuxData[from:to]
+
+		if uint64(i) == total-1 {
+			chunkBV = bv
+		}
+		if err := sendResponseChunk(p.rw, HelperTrieProofsMsg, reqID, chunkBV, uint64(i), total, chunk); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// collectProofChunk verifies and stores a chunk of a streamed proof response. The
+// chunks of a response have to arrive in order, each of them consisting of well
+// formed trie nodes not seen before in the same response. Proofs are sent from
+// the root down, so every node has to be one of the requested roots or be
+// referenced by a node received earlier. If the chunk is the
+// last one, the reassembled nodes and auxiliary data are returned and complete is
+// set to true.
+func (p *peer) collectProofChunk(code, reqID, index, total uint64, nodes light.NodeList, aux [][]byte) (allNodes light.NodeList, allAux [][]byte, complete bool, err error) {
+	p.chunkLock.Lock()
+	defer p.chunkLock.Unlock()
+
+	stream := p.proofChunks[reqID]
+	if stream == nil {
+		if index != 0 {
+			return nil, nil, false, errResp(ErrInvalidResponse, "proof chunk %d/%d without the first one for reqID %v", index, total, reqID)
+		}
+		if total == 0 || total > maxProofStreamChunks {
+			return nil, nil, false, errResp(ErrInvalidResponse, "invalid proof chunk count %d for reqID %v", total, reqID)
+		}
+		if total > 1 && len(p.proofChunks) >= maxPendingProofStreams {
+			return nil, nil, false, errResp(ErrInvalidResponse, "too many pending proof streams")
+		}
+		roots, ok := p.proofRoots[reqID]
+		if !ok {
+			return nil, nil, false, errResp(ErrUnexpectedResponse, "streamed proof without a pending request for reqID %v", reqID)
+		}
+		delete(p.proofRoots, reqID)
+
+		stream = &proofStream{code: code, total: total, seen: make(map[common.Hash]struct{}), expect: make(map[common.Hash]struct{})}
+		for _, root := range roots {
+			stream.expect[root] = struct{}{}
+		}
+	} else if code != stream.code || index != stream.next || total != stream.total {
+		delete(p.proofChunks, reqID)
+		return nil, nil, false, errResp(ErrInvalidResponse, "unexpected proof chunk %d/%d for reqID %v", index, total, reqID)
+	}
+	// Verify the chunk before accepting it, a corrupt one fails the whole response
+	for _, node := range nodes {
+		if kind, _, rest, err := rlp.Split(node); err != nil || kind != rlp.List || len(rest) != 0 {
+			delete(p.proofChunks, reqID)
+			return nil, nil, false, errResp(ErrInvalidResponse, "malformed proof node in chunk %d of reqID %v", index, reqID)
+		}
+		hash := crypto.Keccak256Hash(node)
+		if _, ok := stream.seen[hash]; ok {
+			delete(p.proofChunks, reqID)
+			return nil, nil, false, errResp(ErrInvalidResponse, "duplicate proof node in chunk %d of reqID %v", index, reqID)
+		}
+		if _, ok := stream.expect[hash]; !ok {
+			delete(p.proofChunks, reqID)
+			return nil, nil, false, errResp(ErrInvalidResponse, "unrelated proof node in chunk %d of reqID %v", index, reqID)
+		}
+		if err := proofNodeRefs(node, stream.expect); err != nil {
+			delete(p.proofChunks, reqID)
+			return nil, nil, false, errResp(ErrInvalidResponse, "malformed proof node in chunk %d of reqID %v", index, reqID)
+		}
+		stream.seen[hash] = struct{}{}
+	}
+	stream.nodes = append(stream.nodes, nodes...)
+	stream.aux = append(stream.aux, aux...)
+	stream.next++
+
+	if stream.next == stream.total {
+		delete(p.proofChunks, reqID)
+		return stream.nodes, stream.aux, true, nil
+	}
+	if p.proofChunks == nil {
+		p.proofChunks = make(map[uint64]*proofStream)
+	}
+	p.proofChunks[reqID] = stream
+	return nil, nil, false, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// testProofNode creates a well formed list node of the given payload size.
+func testProofNode(t *testing.T, fill byte, size int) []byte {
+	node, err := rlp.EncodeToBytes([][]byte{bytes.Repeat([]byte{fill}, size)})
+	if err != nil {
+		t.Fatalf("failed to encode node: %v", err)
+	}
+	return node
+}
+
+// testProofChain creates a root first list of count well formed nodes of about
+// the given payload size, each one referencing the next by its hash.
+func testProofChain(t *testing.T, count, size int) light.NodeList {
+	nodes := make(light.NodeList, count)
+	nodes[count-1] = testProofNode(t, byte(count-1), size)
+	for i := count - 2; i >= 0; i-- {
+		node, err := rlp.EncodeToBytes([][]byte{crypto.Keccak256(nodes[i+1]), bytes.Repeat([]byte{byte(i)}, size)})
+		if err != nil {
+			t.Fatalf("failed to encode node: %v", err)
+		}
+		nodes[i] = node
+	}
+	return nodes
+}
+
+func TestProofChunkBounds(t *testing.T) {
+	tests := []struct {
+		sizes  []int
+		bounds []int
+	}{
+		{nil, []int{0}},
+		{[]int{1, 2, 3}, []int{3}},
+		{[]int{4, 4, 4}, []int{2, 3}},
+		{[]int{12, 1, 1}, []int{1, 3}},
+		{[]int{1, 12, 1}, []int{1, 2, 3}},
+	}
+	for i, tt := range tests {
+		if bounds := proofChunkBounds(tt.sizes, 10); !reflect.DeepEqual(bounds, tt.bounds) {
+			t.Errorf("test %d: bounds mismatch: have %v, want %v", i, bounds, tt.bounds)
+		}
+	}
+}
+
+// Tests that proof responses exceeding the chunk size are streamed in multiple
+// messages and reassembled by the client.
+func TestProofStreamRoundtrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+
+	server := &peer{rw: app, proofStreaming: true}
+	client := &peer{proofStreaming: true}
+
+	proofs := testProofChain(t, 5, proofChunkSize/3)
+	client.expectProofRoots(42, crypto.Keccak256Hash(proofs[0]))
+	go server.sendProofsV2Chunks(42, 1000, proofs)
+
+	for i := uint64(0); ; i++ {
+		msg, err := net.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read chunk %d: %v", i, err)
+		}
+		var chunk struct {
+			ReqID, BV    uint64
+			Index, Total uint64
+			Data         light.NodeList
+		}
+		// the payload is read at once, the pipe reports EOF together with the last bytes
+		payload, err := ioutil.ReadAll(msg.Payload)
+		if err != nil {
+			t.Fatalf("failed to read chunk %d: %v", i, err)
+		}
+		if err := rlp.DecodeBytes(payload, &chunk); err != nil {
+			t.Fatalf("failed to decode chunk %d: %v", i, err)
+		}
+		if chunk.Index != i || chunk.Total != 3 {
+			t.Fatalf("chunk header mismatch: have %d/%d, want %d/3", chunk.Index, chunk.Total, i)
+		}
+		nodes, _, complete, err := client.collectProofChunk(ProofsV2Msg, chunk.ReqID, chunk.Index, chunk.Total, chunk.Data, nil)
+		if err != nil {
+			t.Fatalf("chunk %d rejected: %v", i, err)
+		}
+		if !complete {
+			if chunk.BV != 0 {
+				t.Errorf("intermediate chunk %d carries buffer value %d", i, chunk.BV)
+			}
+			continue
+		}
+		if chunk.BV != 1000 {
+			t.Errorf("buffer value mismatch: have %d, want 1000", chunk.BV)
+		}
+		if !reflect.DeepEqual(nodes, proofs) {
+			t.Errorf("reassembled proofs mismatch")
+		}
+		break
+	}
+	if len(client.proofChunks) != 0 {
+		t.Errorf("completed stream not released")
+	}
+}
+
+// Tests that invalid chunks fail the streamed proof response.
+func TestCollectProofChunksInvalid(t *testing.T) {
+	var (
+		chain     = testProofChain(t, 2, 10)
+		node      = chain[0]
+		other     = chain[1]
+		unrelated = testProofNode(t, 3, 10)
+		root      = crypto.Keccak256Hash(node)
+	)
+	p := &peer{proofStreaming: true}
+	for reqID := uint64(1); reqID <= 4; reqID++ {
+		p.expectProofRoots(reqID, root)
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 1, 1, 2, light.NodeList{node}, nil); err == nil {
+		t.Errorf("stream starting with the second chunk accepted")
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 1, 0, maxProofStreamChunks+1, light.NodeList{node}, nil); err == nil {
+		t.Errorf("stream with too many chunks accepted")
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 1, 0, 1, light.NodeList{[]byte{0x01, 0x02}}, nil); err == nil {
+		t.Errorf("malformed node accepted")
+	}
+	// duplicate nodes across chunks
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 2, 0, 2, light.NodeList{node}, nil); err != nil {
+		t.Fatalf("first chunk rejected: %v", err)
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 2, 1, 2, light.NodeList{node}, nil); err == nil {
+		t.Errorf("duplicate node accepted")
+	}
+	if _, ok := p.proofChunks[2]; ok {
+		t.Errorf("failed stream not released")
+	}
+	// out of order and mismatching chunks
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 3, 0, 3, light.NodeList{node}, nil); err != nil {
+		t.Fatalf("first chunk rejected: %v", err)
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 3, 2, 3, light.NodeList{other}, nil); err == nil {
+		t.Errorf("out of order chunk accepted")
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 4, 0, 2, light.NodeList{node}, nil); err != nil {
+		t.Fatalf("first chunk rejected: %v", err)
+	}
+	if _, _, _, err := p.collectProofChunk(HelperTrieProofsMsg, 4, 1, 2, light.NodeList{other}, nil); err == nil {
+		t.Errorf("chunk of a different response type accepted")
+	}
+	// responses without a pending request and nodes not connected to the root
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 5, 0, 1, light.NodeList{node}, nil); err == nil {
+		t.Errorf("stream without expected roots accepted")
+	}
+	p.expectProofRoots(6, root)
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 6, 0, 2, light.NodeList{node}, nil); err != nil {
+		t.Fatalf("first chunk rejected: %v", err)
+	}
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 6, 1, 2, light.NodeList{unrelated}, nil); err == nil {
+		t.Errorf("unrelated node accepted")
+	}
+	p.expectProofRoots(7, root)
+	if _, _, _, err := p.collectProofChunk(ProofsV2Msg, 7, 0, 2, light.NodeList{node}, nil); err != nil {
+		t.Fatalf("first chunk rejected: %v", err)
+	}
+	if _, _, complete, err := p.collectProofChunk(ProofsV2Msg, 7, 1, 2, light.NodeList{other}, nil); err != nil || !complete {
+		t.Errorf("referenced node rejected: complete %v, err %v", complete, err)
+	}
+}
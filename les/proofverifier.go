@@ -0,0 +1,176 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// proofVerifier is a concurrent merkle proof verifier shared by all the ODR
+// requests of the light client.
+var proofVerifier = newProofVerifierPool(runtime.NumCPU())
+
+// proofTask is the verification of a single key against a trie root.
+type proofTask struct {
+	root  common.Hash
+	key   []byte
+	db    trie.DatabaseReader
+	value []byte
+	err   error
+	done  *sync.WaitGroup
+}
+
+// proofVerifierPool is a helper structure to verify the merkle proofs of the
+// multiple keys of a response on background threads.
+//
+/**
+proofVerifierPool:
+对一个 resp 中多个 key 的 merkle proof 做并发校验 (按 CPU 核数起 worker), 并汇总校验错误
+ */
+type proofVerifierPool struct {
+	threads int
+	tasks   chan *proofTask
+
+	verified uint64 // number of responses verified (atomic)
+	spent    uint64 // total time spent verifying them in nanoseconds (atomic)
+}
+
+// newProofVerifierPool creates a proof verifier pool and starts the given number
+// of worker goroutines.
+func newProofVerifierPool(threads int) *proofVerifierPool {
+	if threads < 1 {
+		threads = 1
+	}
+	pool := &proofVerifierPool{
+		threads: threads,
+		tasks:   make(chan *proofTask, threads),
+	}
+	for i := 0; i < threads; i++ {
+		go pool.loop()
+	}
+	return pool
+}
+
+// loop is an infinite loop verifying the proofs of the scheduled tasks.
+func (pool *proofVerifierPool) loop() {
+	for task := range pool.tasks {
+		task.value, _, task.err = trie.VerifyProof(task.root, task.key, task.db)
+		task.done.Done()
+	}
+}
+
+// verify checks the proofs of the given keys against the trie root, using the
+// nodes of the given database which must be safe for concurrent use. It returns
+// the proven values in the order of the keys. If any of the proofs fail, the
+// errors are aggregated into a *proofError.
+func (pool *proofVerifierPool) verify(root common.Hash, keys [][]byte, db trie.DatabaseReader) ([][]byte, error) {
+	roots := make([]common.Hash, len(keys))
+	for i := range roots {
+		roots[i] = root
+	}
+	return pool.verifyRoots(roots, keys, db)
+}
+
+// verifyRoots checks the proofs of the given keys, each one against the trie root
+// of the same index, so the entries of several tries proven by a single node set
+// are verified together.
+func (pool *proofVerifierPool) verifyRoots(roots []common.Hash, keys [][]byte, db trie.DatabaseReader) ([][]byte, error) {
+	defer func(start time.Time) {
+		atomic.AddUint64(&pool.verified, 1)
+		atomic.AddUint64(&pool.spent, uint64(time.Since(start)))
+	}(time.Now())
+
+	values := make([][]byte, len(keys))
+
+	// A single proof is not worth the scheduling overhead
+	if len(keys) == 1 || pool.threads == 1 {
+		perr := &proofError{total: len(keys)}
+		for i, key := range keys {
+			value, _, err := trie.VerifyProof(roots[i], key, db)
+			values[i] = value
+			perr.add(i, err)
+		}
+		return values, perr.result()
+	}
+	var (
+		tasks = make([]proofTask, len(keys))
+		done  sync.WaitGroup
+	)
+	done.Add(len(keys))
+	for i, key := range keys {
+		tasks[i] = proofTask{root: roots[i], key: key, db: db, done: &done}
+		pool.tasks <- &tasks[i]
+	}
+	done.Wait()
+
+	perr := &proofError{total: len(keys)}
+	for i := range tasks {
+		values[i] = tasks[i].value
+		perr.add(i, tasks[i].err)
+	}
+	return values, perr.result()
+}
+
+// averageTime returns the average time of verifying the proofs of a response.
+func (pool *proofVerifierPool) averageTime() time.Duration {
+	verified := atomic.LoadUint64(&pool.verified)
+	if verified == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadUint64(&pool.spent) / verified)
+}
+
+// proofError aggregates the failures of a batch of proof verifications.
+type proofError struct {
+	total  int   // number of proofs verified
+	failed int   // number of proofs failing
+	index  int   // index of the first failing proof
+	first  error // error of the first failing proof
+}
+
+// add records the verification result of the proof with the given index.
+func (e *proofError) add(index int, err error) {
+	if err == nil {
+		return
+	}
+	if e.failed == 0 {
+		e.index, e.first = index, err
+	}
+	e.failed++
+}
+
+// result returns the aggregated error, or nil if all proofs checked out.
+func (e *proofError) result() error {
+	if e.failed == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *proofError) Error() string {
+	if e.total == 1 {
+		return fmt.Sprintf("merkle proof verification failed: %v", e.first)
+	}
+	return fmt.Sprintf("%d of %d merkle proofs failed, first (#%d): %v", e.failed, e.total, e.index, e.first)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+)
+
+// Tests that the proofs of many keys are verified concurrently and that the
+// failures are aggregated.
+func TestProofVerifierPool(t *testing.T) {
+	tr, _ := trie.New(common.Hash{}, trie.NewDatabase(ethdb.NewMemDatabase()))
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], uint64(i)*0x0123456789)
+		tr.Update(keys[i], bytes.Repeat(keys[i], 8)) // long enough not to be embedded
+	}
+	root := tr.Hash()
+	proofs := light.NewNodeSet()
+	for _, key := range keys[:90] {
+		tr.Prove(key, 0, proofs)
+	}
+	pool := newProofVerifierPool(4)
+
+	// All proven keys check out and are returned in order
+	reads := &readTraceDB{db: proofs}
+	values, err := pool.verify(root, keys[:90], reads)
+	if err != nil {
+		t.Fatalf("proof verification failed: %v", err)
+	}
+	for i, value := range values {
+		if want := bytes.Repeat(keys[i], 8); !bytes.Equal(value, want) {
+			t.Errorf("value %d mismatch: have %x, want %x", i, value, want)
+		}
+	}
+	if len(reads.reads) != proofs.KeyCount() {
+		t.Errorf("read trace mismatch: have %d nodes, want %d", len(reads.reads), proofs.KeyCount())
+	}
+
+	// Keys without proofs are reported together
+	_, err = pool.verify(root, keys[80:], proofs)
+	perr, ok := err.(*proofError)
+	if !ok {
+		t.Fatalf("error type mismatch: have %T, want *proofError", err)
+	}
+	if perr.total != 20 || perr.failed != 10 || perr.index != 10 {
+		t.Errorf("aggregated error mismatch: %d total, %d failed, first #%d", perr.total, perr.failed, perr.index)
+	}
+}
+
+// Tests that the keys of several tries proven by one node set are verified
+// against their own roots.
+func TestProofVerifierRoots(t *testing.T) {
+	var (
+		tries  [2]*trie.Trie
+		roots  []common.Hash
+		keys   [][]byte
+		proofs = light.NewNodeSet()
+	)
+	for i := range tries {
+		tries[i], _ = trie.New(common.Hash{}, trie.NewDatabase(ethdb.NewMemDatabase()))
+		for j := 0; j < 10; j++ {
+			key := []byte{byte(i), byte(j)}
+			tries[i].Update(key, bytes.Repeat(key, 20))
+		}
+	}
+	for j := 0; j < 10; j++ {
+		for i := range tries {
+			key := []byte{byte(i), byte(j)}
+			tries[i].Prove(key, 0, proofs)
+			roots = append(roots, tries[i].Hash())
+			keys = append(keys, key)
+		}
+	}
+	values, err := newProofVerifierPool(4).verifyRoots(roots, keys, proofs)
+	if err != nil {
+		t.Fatalf("proof verification failed: %v", err)
+	}
+	for i, value := range values {
+		if want := bytes.Repeat(keys[i], 20); !bytes.Equal(value, want) {
+			t.Errorf("value %d mismatch: have %x, want %x", i, value, want)
+		}
+	}
+	// Keys checked against the wrong root don't prove the values
+	roots[0], roots[1] = roots[1], roots[0]
+	values, err = newProofVerifierPool(4).verifyRoots(roots, keys, proofs)
+	if err == nil && (values[0] != nil || values[1] != nil) {
+		t.Errorf("values proven against the wrong roots")
+	}
+}
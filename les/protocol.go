@@ -48,7 +48,7 @@ var (
 )
 
 // Number of implemented message corresponding to different protocol versions.
-var ProtocolLengths = map[uint]uint64{lpv1: 15, lpv2: 22}
+var ProtocolLengths = map[uint]uint64{lpv1: 15, lpv2: 30}
 
 const (
 	NetworkId          = 1
@@ -88,6 +88,14 @@ const (
 	SendTxV2Msg            = 0x13  // 发出 tx 的广播 LPV2  (会将 txs 的 status 回应给 client)
 	GetTxStatusMsg         = 0x14  // 校验 tx status 的req
 	TxStatusMsg            = 0x15  // 校验 tx status 的 resp
+	ServerBusyMsg          = 0x16  // server 过载时, 对低优先级 req 的 "retry after" 回复
+	TxStatusSubscribeMsg   = 0x17  // 订阅 tx status 的变化 (回应为 TxStatusMsg)
+	TxStatusUpdateMsg      = 0x18  // server 主动推送被订阅 tx 的 status 变化
+	StateHintsMsg          = 0x19  // server 在 account proof 之后顺带推送该 account 最常读的 storage slot
+	GetBufferValueMsg      = 0x1a  // client 发现流控状态不同步时, 请求 server 权威的 buffer value
+	BufferValueMsg         = 0x1b  // server 回复当前的 buffer value
+	ResponseSigMsg         = 0x1c  // 签名模式下, server 在每个 resp 之前发送该 resp 摘要的签名
+	StopAnnounceMsg        = 0x1d  // server 停止前通知 client 迁移到其他 server (附带 恢复时间 及 替代 server)
 )
 
 type errCode int
@@ -108,6 +116,7 @@ const (
 	ErrInvalidResponse
 	ErrTooManyTimeouts
 	ErrMissingKey
+	ErrServiceQuotaExceeded
 )
 
 func (e errCode) String() string {
@@ -130,6 +139,7 @@ var errorToString = map[int]string{
 	ErrInvalidResponse:         "Invalid response",
 	ErrTooManyTimeouts:         "Too many request timeouts",
 	ErrMissingKey:              "Key missing from list",
+	ErrServiceQuotaExceeded:    "Daily service quota exceeded",
 }
 
 type announceBlock struct {
@@ -245,3 +255,13 @@ type txStatus struct {
 	Lookup *rawdb.TxLookupEntry `rlp:"nil"`
 	Error  string
 }
+
+// txNonceAdvice is the pending nonce of a sender, reported by the server along
+// with the status of its transactions rejected as replays or queued after a
+// nonce gap.
+//
+// server 拒绝 (nonce 过低, 即重放) 或排队 (nonce 有空缺) 一个 tx 时, 附带其 sender 当前的 pending nonce
+type txNonceAdvice struct {
+	Sender common.Address
+	Nonce  uint64
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// Tests that the reorgs driven by the simulator are announced to the clients
+// with their depth.
+func TestReorgAnnouncements(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	pm := newTestProtocolManagerMust(t, false, 4, testChainGen, nil, nil, db)
+	pm.blockLoop()
+
+	peer, _ := newTestPeer(t, "peer", lpv2, pm, true)
+	defer peer.close()
+
+	for i := 0; pm.peers.Len() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("peer not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sim := core.NewReorgSimulator(pm.blockchain.(*core.BlockChain), ethash.NewFaker(), db)
+
+	expect := func(number, reorg uint64) {
+		msg, err := peer.app.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read announcement: %v", err)
+		}
+		if msg.Code != AnnounceMsg {
+			t.Fatalf("message code mismatch: have %d, want %d", msg.Code, AnnounceMsg)
+		}
+		var announce announceData
+		if err := msg.Decode(&announce); err != nil {
+			t.Fatalf("failed to decode announcement: %v", err)
+		}
+		if announce.Number != number || announce.ReorgDepth != reorg {
+			t.Fatalf("announcement mismatch: have #%d reorg %d, want #%d reorg %d", announce.Number, announce.ReorgDepth, number, reorg)
+		}
+	}
+	if _, err := sim.Extend(1); err != nil {
+		t.Fatalf("failed to extend chain: %v", err)
+	}
+	expect(5, 0)
+
+	if _, err := sim.Reorg(2, 3); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	expect(6, 2)
+}
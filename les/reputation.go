@@ -0,0 +1,153 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+// Score changes of the peer reputation events. Every peer starts with a zero
+// score, good answers raise it up to maxPeerScore while misbehaviour lowers it.
+// Peers dropping below banScoreThreshold are disconnected and banned for a while.
+//
+// peer 信誉分: 每个 peer 初始为 0 分, 有效的 resp 加分 (最高 maxPeerScore),
+// resp 出错/超时/无效的 proof 扣分, 低于 banScoreThreshold 时断开并暂时拉黑
+const (
+	scoreValidResponse = 1   // valid answer to a retrieval
+	scoreResponseError = -5  // unexpected or undeliverable response
+	scoreInvalidProof  = -20 // answer failing the validation (on top of the response error)
+	scoreSoftTimeout   = -2  // answer not arriving within softRequestTimeout
+	scoreHardTimeout   = -30 // answer not arriving within hardRequestTimeout
+
+	maxPeerScore      = 100
+	banScoreThreshold = -100
+
+	peerBanDuration = time.Hour // time a peer is refused after falling below the threshold
+	maxBannedPeers  = 1024      // bans kept at most, the ones expiring first are dropped
+	maxScoredPeers  = 4096      // negative scores of disconnected peers are kept up to this many peers
+)
+
+var (
+	errBannedPeer = errors.New("peer is banned")
+
+	peerBanMeter = metrics.NewRegisteredMeter("les/peers/banned", nil)
+)
+
+// adjustScore applies a reputation event to the peer. If the score falls below
+// the ban threshold, the peer is disconnected and banned for peerBanDuration.
+func (ps *peerSet) adjustScore(p *peer, delta int) {
+	ps.lock.Lock()
+	if _, ok := ps.peers[p.id]; !ok {
+		ps.lock.Unlock()
+		return
+	}
+	score := ps.scores[p.id] + delta
+	if score > maxPeerScore {
+		score = maxPeerScore
+	}
+	ps.scores[p.id] = score
+	if score >= banScoreThreshold {
+		ps.lock.Unlock()
+		return
+	}
+	ps.ban(p.id)
+	delete(ps.scores, p.id)
+	ps.lock.Unlock()
+
+	p.Log().Debug("Banning peer with low reputation", "score", score, "duration", peerBanDuration)
+	peerBanMeter.Mark(1)
+	ps.Unregister(p.id)
+}
+
+// ban adds the peer to the ban list. The lock is held by the caller.
+func (ps *peerSet) ban(id string) {
+	now := ps.clock.Now()
+	if _, ok := ps.banned[id]; !ok && len(ps.banned) >= maxBannedPeers {
+		var (
+			oldest string
+			expiry mclock.AbsTime
+		)
+		for bid, exp := range ps.banned {
+			if oldest == "" || exp < expiry {
+				oldest, expiry = bid, exp
+			}
+		}
+		delete(ps.banned, oldest)
+	}
+	ps.banned[id] = now + mclock.AbsTime(peerBanDuration)
+}
+
+// isBanned reports whether the peer is banned, forgetting the expired ban. The
+// lock is held by the caller.
+func (ps *peerSet) isBanned(id string) bool {
+	expiry, ok := ps.banned[id]
+	if !ok {
+		return false
+	}
+	if ps.clock.Now() >= expiry {
+		delete(ps.banned, id)
+		return false
+	}
+	return true
+}
+
+// AllPeerScores returns the reputation score of all registered peers, keyed by id.
+func (ps *peerSet) AllPeerScores() map[string]int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	scores := make(map[string]int, len(ps.peers))
+	for id := range ps.peers {
+		scores[id] = ps.scores[id]
+	}
+	return scores
+}
+
+// BannedPeers returns the remaining ban time of the banned peers, keyed by id.
+func (ps *peerSet) BannedPeers() map[string]time.Duration {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	now := ps.clock.Now()
+	banned := make(map[string]time.Duration, len(ps.banned))
+	for id, expiry := range ps.banned {
+		if now >= expiry {
+			delete(ps.banned, id)
+			continue
+		}
+		banned[id] = time.Duration(expiry - now)
+	}
+	return banned
+}
+
+// Unban lifts the ban of a peer, returning false if it wasn't banned.
+func (ps *peerSet) Unban(id string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if !ps.isBanned(id) {
+		return false
+	}
+	delete(ps.banned, id)
+	log.Debug("Peer unbanned", "id", id)
+	return true
+}
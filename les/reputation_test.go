@@ -0,0 +1,102 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+func newScoreTestPeer(id byte) *peer {
+	var nodeID discover.NodeID
+	nodeID[0] = id
+	return newPeer(lpv2, NetworkId, p2p.NewPeer(nodeID, "test", nil), nil)
+}
+
+func TestPeerReputation(t *testing.T) {
+	clock := &mclock.Simulated{}
+	ps := newPeerSet()
+	ps.clock = clock
+
+	good, bad := newScoreTestPeer(1), newScoreTestPeer(2)
+	ps.Register(good)
+	ps.Register(bad)
+
+	// Rewards are capped, penalties accumulate
+	for i := 0; i < 2*maxPeerScore; i++ {
+		ps.adjustScore(good, scoreValidResponse)
+	}
+	ps.adjustScore(bad, scoreInvalidProof)
+	ps.adjustScore(bad, scoreResponseError)
+	scores := ps.AllPeerScores()
+	if scores[good.id] != maxPeerScore {
+		t.Errorf("good peer score mismatch: have %d, want %d", scores[good.id], maxPeerScore)
+	}
+	if want := scoreInvalidProof + scoreResponseError; scores[bad.id] != want {
+		t.Errorf("bad peer score mismatch: have %d, want %d", scores[bad.id], want)
+	}
+
+	// Negative scores survive reconnects
+	ps.Unregister(bad.id)
+	bad = newScoreTestPeer(2)
+	if err := ps.Register(bad); err != nil {
+		t.Fatalf("failed to reconnect: %v", err)
+	}
+	if score := ps.AllPeerScores()[bad.id]; score != scoreInvalidProof+scoreResponseError {
+		t.Errorf("score reset by reconnect: %d", score)
+	}
+
+	// Falling below the threshold drops and bans the peer
+	for ps.Peer(bad.id) != nil {
+		ps.adjustScore(bad, scoreHardTimeout)
+	}
+	banned := ps.BannedPeers()
+	if banned[bad.id] != peerBanDuration {
+		t.Errorf("ban time mismatch: have %v, want %v", banned[bad.id], peerBanDuration)
+	}
+	if err := ps.Register(newScoreTestPeer(2)); err != errBannedPeer {
+		t.Errorf("banned peer registration: have %v, want %v", err, errBannedPeer)
+	}
+
+	// Bans expire after a while
+	clock.Run(peerBanDuration + time.Second)
+	if len(ps.BannedPeers()) != 0 {
+		t.Error("ban not expired")
+	}
+	bad = newScoreTestPeer(2)
+	if err := ps.Register(bad); err != nil {
+		t.Fatalf("failed to register after ban: %v", err)
+	}
+	if score := ps.AllPeerScores()[bad.id]; score != 0 {
+		t.Errorf("score after ban mismatch: have %d, want 0", score)
+	}
+
+	// Bans can be lifted manually
+	for ps.Peer(bad.id) != nil {
+		ps.adjustScore(bad, scoreHardTimeout)
+	}
+	if !ps.Unban(bad.id) {
+		t.Error("failed to unban peer")
+	}
+	if err := ps.Register(newScoreTestPeer(2)); err != nil {
+		t.Errorf("failed to register unbanned peer: %v", err)
+	}
+}
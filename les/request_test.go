@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth"
@@ -86,7 +87,7 @@ func testAccess(t *testing.T, protocol int, fn accessTestFn) {
 	// Assemble the test environment
 	peers := newPeerSet()
 	dist := newRequestDistributor(peers, make(chan struct{}))
-	rm := newRetrieveManager(peers, dist, nil)
+	rm := newRetrieveManager(peers, dist, nil, mclock.System{})
 	db := ethdb.NewMemDatabase()
 	ldb := ethdb.NewMemDatabase()
 	odr := NewLesOdr(ldb, rm)
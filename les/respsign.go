@@ -0,0 +1,223 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/hexutil"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+const (
+	// maxPendingResponseSigs is the number of response signatures a client keeps
+	// from a server while waiting for the responses.
+	maxPendingResponseSigs = 256
+
+	// maxResponseEvidence is the number of invalid signed responses kept as
+	// evidence, the oldest ones are dropped.
+	maxResponseEvidence = 32
+)
+
+var errWrongResponseSig = errors.New("response signed by a different key")
+
+// signedResponseCodes are the responses signed by the servers in the signed
+// response mode: the ones carrying requested data.
+var signedResponseCodes = map[uint64]bool{
+	BlockHeadersMsg:     true,
+	BlockBodiesMsg:      true,
+	ReceiptsMsg:         true,
+	ProofsV1Msg:         true,
+	CodeMsg:             true,
+	HeaderProofsMsg:     true,
+	ProofsV2Msg:         true,
+	HelperTrieProofsMsg: true,
+	TxStatusMsg:         true,
+}
+
+// responseSig is the content of ResponseSigMsg, the signature of the digest of
+// the following response with the same request ID and message code.
+type responseSig struct {
+	ReqID, Code uint64
+	Sig         []byte
+}
+
+// responseKey identifies the response a signature belongs to.
+type responseKey struct {
+	reqID, code uint64
+}
+
+// responseDigest returns the hash signed by the server for a response. It binds
+// the payload to the request and the message type, so a signed response can't
+// be presented as the answer to another request.
+//
+// responseDigest: server 对 resp 签名的摘要 keccak256(rlp(reqID, code, keccak256(payload)))
+func responseDigest(reqID, code uint64, payload []byte) []byte {
+	enc, _ := rlp.EncodeToBytes([]interface{}{reqID, code, crypto.Keccak256Hash(payload)})
+	return crypto.Keccak256(enc)
+}
+
+// signingMsgWriter signs the responses sent to a client in the signed response
+// mode, sending the signature of each right before it.
+//
+// signingMsgWriter: 签名模式下, server 在每个 resp 之前 先发送该 resp 摘要的签名 (ResponseSigMsg)
+type signingMsgWriter struct {
+	p2p.MsgReadWriter
+	key *ecdsa.PrivateKey
+}
+
+func (w *signingMsgWriter) WriteMsg(msg p2p.Msg) error {
+	if !signedResponseCodes[msg.Code] {
+		return w.MsgReadWriter.WriteMsg(msg)
+	}
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	reqID, err := responseReqID(payload)
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(responseDigest(reqID, msg.Code, payload), w.key)
+	if err != nil {
+		return err
+	}
+	if err := p2p.Send(w.MsgReadWriter, ResponseSigMsg, responseSig{reqID, msg.Code, sig}); err != nil {
+		return err
+	}
+	msg.Payload = bytes.NewReader(payload)
+	return w.MsgReadWriter.WriteMsg(msg)
+}
+
+// responseReqID returns the request ID of an encoded response, the first field
+// of all of them.
+func responseReqID(payload []byte) (uint64, error) {
+	content, _, err := rlp.SplitList(payload)
+	if err != nil {
+		return 0, err
+	}
+	var reqID uint64
+	err = rlp.NewStream(bytes.NewReader(content), uint64(len(content))).Decode(&reqID)
+	return reqID, err
+}
+
+// addResponseSig stores the signature of a response expected to arrive next.
+func (p *peer) addResponseSig(sig responseSig) error {
+	if len(p.responseSigs) >= maxPendingResponseSigs {
+		return errResp(ErrInvalidResponse, "too many pending response signatures")
+	}
+	if p.responseSigs == nil {
+		p.responseSigs = make(map[responseKey][]byte)
+	}
+	p.responseSigs[responseKey{sig.ReqID, sig.Code}] = sig.Sig
+	return nil
+}
+
+// checkResponseSig reads the payload of a signed response and checks it against
+// its signature sent ahead. The payload of the message is restored, and the
+// signed response returned to be kept as evidence if it turns out to be invalid.
+// The response signatures are only accessed by the message handler of the peer.
+func (p *peer) checkResponseSig(msg *p2p.Msg) (*SignedResponse, error) {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.Payload = bytes.NewReader(payload)
+
+	reqID, err := responseReqID(payload)
+	if err != nil {
+		return nil, errResp(ErrDecode, "msg %v: %v", msg, err)
+	}
+	key := responseKey{reqID, msg.Code}
+	sig, ok := p.responseSigs[key]
+	if !ok {
+		return nil, errResp(ErrInvalidResponse, "missing response signature")
+	}
+	delete(p.responseSigs, key)
+
+	signed := &SignedResponse{
+		Server:  p.ID(),
+		ReqID:   reqID,
+		Code:    msg.Code,
+		Payload: payload,
+		Sig:     sig,
+		Time:    time.Now(),
+	}
+	if err := signed.Verify(); err != nil {
+		return nil, errResp(ErrInvalidResponse, "response signature: %v", err)
+	}
+	return signed, nil
+}
+
+// SignedResponse is a response signed by a server, kept as non-repudiable evidence
+// when the client found it invalid: anyone knowing the node ID of the server can
+// verify that it sent the payload as the answer to the request.
+type SignedResponse struct {
+	Server  discover.NodeID `json:"server"`  // Node ID (public key) of the signing server
+	ReqID   uint64          `json:"reqID"`   // ID of the answered request
+	Code    uint64          `json:"code"`    // Message code of the response
+	Payload hexutil.Bytes   `json:"payload"` // RLP encoded response
+	Sig     hexutil.Bytes   `json:"sig"`     // Signature of the response digest
+	Reason  string          `json:"reason"`  // Why the response was found invalid
+	Time    time.Time       `json:"time"`    // When the response arrived
+}
+
+// Verify checks that the response was signed by the server.
+func (r *SignedResponse) Verify() error {
+	pub, err := crypto.Ecrecover(responseDigest(r.ReqID, r.Code, r.Payload), r.Sig)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub[1:], r.Server[:]) {
+		return errWrongResponseSig
+	}
+	return nil
+}
+
+// responseEvidence keeps the most recent invalid signed responses of the servers.
+type responseEvidence struct {
+	lock      sync.Mutex
+	responses []*SignedResponse
+}
+
+// add stores an invalid signed response.
+func (e *responseEvidence) add(r *SignedResponse, reason error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	r.Reason = reason.Error()
+	if len(e.responses) >= maxResponseEvidence {
+		e.responses = append(e.responses[:0], e.responses[1:]...)
+	}
+	e.responses = append(e.responses, r)
+}
+
+// list returns the kept invalid signed responses, oldest first.
+func (e *responseEvidence) list() []*SignedResponse {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]*SignedResponse(nil), e.responses...)
+}
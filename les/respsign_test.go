@@ -0,0 +1,105 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// Tests that the responses are preceded by their signatures, which the client
+// verifies, and that the kept evidence can be verified independently.
+func TestSignedResponses(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	server, client := p2p.MsgPipe()
+	defer server.Close()
+
+	w := &signingMsgWriter{MsgReadWriter: server, key: key}
+	p := newPeer(lpv2, NetworkId, p2p.NewPeer(discover.PubkeyID(&key.PublicKey), "test", nil), nil)
+
+	headers := []*types.Header{{Number: big.NewInt(1)}, {Number: big.NewInt(2)}}
+	go func() {
+		sendResponse(w, BlockHeadersMsg, 42, 1000, headers)
+		p2p.Send(w, AnnounceMsg, announceData{Number: 2})
+	}()
+	// The signature comes first
+	msg, err := client.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read signature: %v", err)
+	}
+	if msg.Code != ResponseSigMsg {
+		t.Fatalf("message code mismatch: have %d, want %d", msg.Code, ResponseSigMsg)
+	}
+	var sig responseSig
+	if err := msg.Decode(&sig); err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+	if sig.ReqID != 42 || sig.Code != BlockHeadersMsg {
+		t.Fatalf("signature of the wrong response: reqID %d, code %d", sig.ReqID, sig.Code)
+	}
+	if err := p.addResponseSig(sig); err != nil {
+		t.Fatalf("failed to store signature: %v", err)
+	}
+	// The response is verified and still decodable afterwards
+	msg, err = client.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	signed, err := p.checkResponseSig(&msg)
+	if err != nil {
+		t.Fatalf("valid response rejected: %v", err)
+	}
+	var resp struct {
+		ReqID, BV uint64
+		Headers   []*types.Header
+	}
+	if err := msg.Decode(&resp); err != nil || len(resp.Headers) != 2 {
+		t.Fatalf("failed to decode verified response: %v", err)
+	}
+	// Messages other than responses aren't signed
+	if msg, err = client.ReadMsg(); err != nil || msg.Code != AnnounceMsg {
+		t.Fatalf("unsigned announcement mismatch: code %d, err %v", msg.Code, err)
+	}
+	msg.Discard()
+
+	// The evidence is verifiable, but not with a tampered payload
+	evidence := new(responseEvidence)
+	evidence.add(signed, errors.New("invalid headers"))
+	kept := evidence.list()
+	if len(kept) != 1 || kept[0].Reason != "invalid headers" {
+		t.Fatalf("evidence mismatch: %v", kept)
+	}
+	if err := kept[0].Verify(); err != nil {
+		t.Errorf("valid evidence rejected: %v", err)
+	}
+	kept[0].Payload[len(kept[0].Payload)-1] ^= 0xff
+	if err := kept[0].Verify(); err == nil {
+		t.Errorf("tampered evidence accepted")
+	}
+	// A response without a signature is rejected
+	go sendResponse(server, BlockHeadersMsg, 43, 1000, headers)
+	msg, _ = client.ReadMsg()
+	if _, err := p.checkResponseSig(&msg); err == nil {
+		t.Errorf("unsigned response accepted")
+	}
+}
@@ -58,6 +58,9 @@ type retrieveManager struct {
 
 	// todo 请求分发器中的所有 sendReq, 主要用来一一对应的处理resp
 	sentReqs map[uint64]*sentReq
+
+	// 请求的 重试/软超时/硬超时 计时所用的时钟, 测试时可替换为模拟时钟
+	clock mclock.Clock
 }
 
 // validatorFunc is a function that processes a reply message
@@ -108,6 +111,9 @@ type sentReq struct {
 
 	// 达到软（但不是硬）超时的请求数
 	reqSrtoCount  int      // number of requests that reached soft (but not hard) timeout
+
+	// 最近一次失败的原因 (超时 或 无效 resp), 没有更多 peer 时作为错误返回
+	failure error // cause of the last failed attempt, reported when running out of peers
 }
 
 // sentReqToPeer notifies the request-from-peer goroutine (tryRequest) about a response
@@ -140,13 +146,15 @@ const (
 	rpDeliveredInvalid
 )
 
-// newRetrieveManager creates the retrieve manager
-func newRetrieveManager(peers *peerSet, dist *requestDistributor, serverPool peerSelector) *retrieveManager {
+// newRetrieveManager creates the retrieve manager, timing the retries and the
+// request timeouts on the given clock.
+func newRetrieveManager(peers *peerSet, dist *requestDistributor, serverPool peerSelector, clock mclock.Clock) *retrieveManager {
 	return &retrieveManager{
 		peers:      peers,
 		dist:       dist,
 		serverPool: serverPool,
 		sentReqs:   make(map[uint64]*sentReq),
+		clock:      clock,
 	}
 }
 
@@ -228,23 +236,78 @@ func (rm *retrieveManager) sendReq(reqID uint64, req *distReq, val validatorFunc
 	return r
 }
 
+// pending returns the number of retrievals waiting for a valid answer.
+func (rm *retrieveManager) pending() int {
+	rm.lock.RLock()
+	defer rm.lock.RUnlock()
+
+	return len(rm.sentReqs)
+}
+
+// requested tells whether a reply with the given ID is awaited by a retrieval.
+func (rm *retrieveManager) requested(reqID uint64) bool {
+	rm.lock.RLock()
+	defer rm.lock.RUnlock()
+
+	_, ok := rm.sentReqs[reqID]
+	return ok
+}
+
 // deliver is called by the LES protocol manager to deliver reply messages to waiting requests
 //
 // deliver:
 // deliver 被 LES protocol manager 调用来 答复消息传递给等待的 reqs
-func (rm *retrieveManager) deliver(peer distPeer, msg *Msg) error {
+func (rm *retrieveManager) deliver(dp distPeer, msg *Msg) error {
 	rm.lock.RLock()
 	// 根据响应的reqId 处理响应的 req, msg 是resp 的msg
 	req, ok := rm.sentReqs[msg.ReqID]
 	rm.lock.RUnlock()
 
+	if !ok {
+		return errResp(ErrUnexpectedResponse, "reqID = %v", msg.ReqID)
+	}
+	/**
+	todo  啦啦啦, 上上上~
+	 */
+	expected, err := req.deliver(dp, msg)
+
+	// 根据 resp 是否通过校验调整 peer 的信誉分
+	if p, ok := dp.(*peer); ok && expected && rm.peers != nil {
+		if err == nil {
+			rm.peers.adjustScore(p, scoreValidResponse)
+		} else {
+			rm.peers.adjustScore(p, scoreInvalidProof)
+		}
+	}
+	return err
+}
+
+// reject is called when a peer refused to serve a request (e.g. because it is
+// overloaded). The request is sent to another peer as if the answer was invalid,
+// but the peer is not held responsible for it.
+func (rm *retrieveManager) reject(peer distPeer, reqID uint64) {
+	rm.lock.RLock()
+	req, ok := rm.sentReqs[reqID]
+	rm.lock.RUnlock()
+
 	if ok {
-		/**
-		todo  啦啦啦, 上上上~
-		 */
-		return req.deliver(peer, msg)
+		req.reject(peer)
+	}
+}
+
+// rejectPeer rejects all the requests pending at a peer which won't answer them
+// (e.g. because it's shutting down), so they are sent to other peers right away.
+func (rm *retrieveManager) rejectPeer(peer distPeer) {
+	rm.lock.RLock()
+	reqs := make([]*sentReq, 0, len(rm.sentReqs))
+	for _, req := range rm.sentReqs {
+		reqs = append(reqs, req)
+	}
+	rm.lock.RUnlock()
+
+	for _, req := range reqs {
+		req.reject(peer)
 	}
-	return errResp(ErrUnexpectedResponse, "reqID = %v", msg.ReqID)
 }
 
 // reqStateFn represents a state of the retrieve loop state machine
@@ -295,7 +358,7 @@ func (r *sentReq) stateRequesting() reqStateFn {
 					return r.stateNoMorePeers
 				}
 				// nothing to wait for, no more peers to ask, return with error
-				r.stop(light.ErrNoPeers)
+				r.stop(r.noPeersError())
 				// no need to go to stopped state because waiting() already returned false
 				return nil
 			}
@@ -304,6 +367,14 @@ func (r *sentReq) stateRequesting() reqStateFn {
 			go r.tryRequest()
 			r.lastReqQueued = true
 			return r.stateRequesting
+		case rpDeliveredInvalid:
+			// the peer sent an invalid answer (bad proof), fail over to the next
+			// one right away instead of waiting for the soft timeout
+			if !r.lastReqQueued && r.lastReqSentTo == nil {
+				go r.tryRequest()
+				r.lastReqQueued = true
+			}
+			return r.stateRequesting
 		case rpDeliveredValid:
 			r.stop(nil)
 			return r.stateStopped
@@ -325,7 +396,7 @@ peer可能以后会适合某个req，或者可能会出现新的 peer，因此
  */
 func (r *sentReq) stateNoMorePeers() reqStateFn {
 	select {
-	case <-time.After(retryQueue):
+	case <-r.rm.clock.After(retryQueue):
 		go r.tryRequest()
 		r.lastReqQueued = true
 		return r.stateRequesting
@@ -364,9 +435,13 @@ func (r *sentReq) update(ev reqPeerEvent) {
 	case rpSoftTimeout:
 		r.lastReqSentTo = nil
 		r.reqSrtoCount++
+		r.failure = light.ErrRequestTimeout
 	case rpHardTimeout:
 		r.reqSrtoCount--
 	case rpDeliveredValid, rpDeliveredInvalid:
+		if ev.event == rpDeliveredInvalid {
+			r.failure = light.ErrInvalidResponse
+		}
 		if ev.peer == r.lastReqSentTo {
 			r.lastReqSentTo = nil
 		} else {
@@ -375,6 +450,15 @@ func (r *sentReq) update(ev reqPeerEvent) {
 	}
 }
 
+// noPeersError returns the error of a retrieval running out of peers to ask: the
+// cause of the last failed attempt, or ErrNoPeers if the request couldn't be sent.
+func (r *sentReq) noPeersError() error {
+	if r.failure != nil {
+		return r.failure
+	}
+	return light.ErrNoPeers
+}
+
 // waiting returns true if the retrieval mechanism is waiting for an answer from
 // any peer
 func (r *sentReq) waiting() bool {
@@ -413,7 +497,7 @@ func (r *sentReq) tryRequest() {
 		return
 	}
 
-	reqSent := mclock.Now()
+	reqSent := r.rm.clock.Now()
 	srto, hrto := false, false
 
 	r.lock.RLock()
@@ -427,9 +511,16 @@ func (r *sentReq) tryRequest() {
 		// send feedback to server pool and remove peer if hard timeout happened
 		pp, ok := p.(*peer)
 		if ok && r.rm.serverPool != nil {
-			respTime := time.Duration(mclock.Now() - reqSent)
+			respTime := time.Duration(r.rm.clock.Now() - reqSent)
 			r.rm.serverPool.adjustResponseTime(pp.poolEntry, respTime, srto)
 		}
+		if ok && srto && r.rm.peers != nil {
+			if hrto {
+				r.rm.peers.adjustScore(pp, scoreHardTimeout)
+			} else {
+				r.rm.peers.adjustScore(pp, scoreSoftTimeout)
+			}
+		}
 		if hrto {
 			pp.Log().Debug("Request timed out hard")
 			if r.rm.peers != nil {
@@ -454,7 +545,7 @@ func (r *sentReq) tryRequest() {
 			r.eventsCh <- reqPeerEvent{rpDeliveredInvalid, p}
 		}
 		return
-	case <-time.After(softRequestTimeout):
+	case <-r.rm.clock.After(softRequestTimeout):
 		srto = true
 		r.eventsCh <- reqPeerEvent{rpSoftTimeout, p}
 	}
@@ -469,7 +560,7 @@ func (r *sentReq) tryRequest() {
 		} else {
 			r.eventsCh <- reqPeerEvent{rpDeliveredInvalid, p}
 		}
-	case <-time.After(hardRequestTimeout):
+	case <-r.rm.clock.After(hardRequestTimeout):
 		hrto = true
 		r.eventsCh <- reqPeerEvent{rpHardTimeout, p}
 	}
@@ -482,13 +573,16 @@ func (r *sentReq) tryRequest() {
 sentReq:
 代表由 retrieveManager 发送和跟踪的 req
 */
-func (r *sentReq) deliver(peer distPeer, msg *Msg) error {
+//
+// The returned flag tells whether the reply was expected, in which case an error
+// means that it failed the validation.
+func (r *sentReq) deliver(peer distPeer, msg *Msg) (bool, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
 	s, ok := r.sentTo[peer]
 	if !ok || s.delivered {
-		return errResp(ErrUnexpectedResponse, "reqID = %v", msg.ReqID)
+		return false, errResp(ErrUnexpectedResponse, "reqID = %v", msg.ReqID)
 	}
 
 	/**
@@ -520,9 +614,22 @@ func (r *sentReq) deliver(peer distPeer, msg *Msg) error {
 	r.sentTo[peer] = sentReqToPeer{true, s.valid}
 	s.valid <- valid
 	if !valid {
-		return errResp(ErrInvalidResponse, "reqID = %v", msg.ReqID)
+		return true, errResp(ErrInvalidResponse, "reqID = %v", msg.ReqID)
 	}
-	return nil
+	return true, nil
+}
+
+// reject marks the request as answered by the peer without a usable response.
+func (r *sentReq) reject(peer distPeer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s, ok := r.sentTo[peer]
+	if !ok || s.delivered {
+		return
+	}
+	r.sentTo[peer] = sentReqToPeer{true, s.valid}
+	s.valid <- false
 }
 
 // stop stops the retrieval process and sets an error code that will be returned
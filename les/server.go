@@ -20,21 +20,27 @@ package les
 import (
 	"crypto/ecdsa"
 	"encoding/binary"
+	"fmt"
 	"math"
+	"runtime"
 	"sync"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/eth"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/event"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/les/flowcontrol"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discv5"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rpc"
 )
 
 
@@ -48,6 +54,20 @@ type LesServer struct {
 	fcManager   *flowcontrol.ClientManager // nil if our node is client only
 	fcCostStats *requestCostStats
 	defParams   *flowcontrol.ServerParams
+	// 按 client buffer 排序的 req 处理队列
+	servingQueue *servingQueue
+	breaker      *circuitBreaker
+	// 按 client IP 子网 限制 req 速率, nil 表示不限制
+	subnetLimiter *subnetLimiter // request throttling by client subnet, nil if unlimited
+	bandwidth     *bandwidthTracker // daily byte cap of the clients, nil if unlimited
+	// 每个 client 的 服务水平 (SLA) 统计
+	sla *slaTracker // minimum service guarantee metrics of the clients
+	// client 的 flow control 充电权重 (默认为 1)
+	clientWeights map[discover.NodeID]uint64 // recharge weights of prioritized clients
+	recentStates  uint64                     // number of recent block states served, zero for all
+	stopAnnounce  stopAnnounce               // migration hints sent to the clients on Stop
+	sectionFeed   event.Feed                 // helper trie sections completed, see SubscribeHelperTrieSections
+	sectionScope  event.SubscriptionScope
 	lesTopics   []discv5.Topic
 	privateKey  *ecdsa.PrivateKey
 	quitSync    chan struct{}
@@ -147,12 +167,53 @@ func NewLesServer(eth *eth.Ethereum, config *eth.Config) (*LesServer, error) {
 	}
 
 	// todo 只有当前节点是 les 的server 端下回有这个, 即一些关于 client 管理相关的
-	srv.fcManager = flowcontrol.NewClientManager(uint64(config.LightServ), 10, 1000000000)
+	srv.fcManager = flowcontrol.NewClientManager(uint64(config.LightServ), 10, 1000000000, mclock.System{})
 	// 资源消耗统计相关 !?
 	srv.fcCostStats = newCostStats(eth.ChainDb())
+	srv.servingQueue = newServingQueue(runtime.NumCPU())
+	srv.breaker = newCircuitBreaker(breakerThreshold, breakerCooldown)
+	srv.subnetLimiter = newSubnetLimiter(config.LightSubnetRate, mclock.System{})
+	srv.bandwidth = newBandwidthTracker(config.LightDailyCap*1024*1024, mclock.System{})
+	srv.sla = newSLATracker(config.LightSLATarget)
+	srv.recentStates = eth.BlockChain().RecentStates()
+	if recorder := eth.ChainRecorder(); recorder != nil {
+		recorder.AddSource("lesServed", srv.fcCostStats.totals)
+	}
+
+	if srv.stopAnnounce, err = newStopAnnounce(config.LightStopResume, config.LightStopAlternatives); err != nil {
+		return nil, err
+	}
+	srv.clientWeights = make(map[discover.NodeID]uint64, len(config.LightClientWeights))
+	for id, weight := range config.LightClientWeights {
+		nodeID, err := discover.HexID(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LES client weight node ID %q: %v", id, err)
+		}
+		srv.clientWeights[nodeID] = weight
+	}
 	return srv, nil
 }
 
+// servedStates returns the number of recent block states announced to the clients
+// in the handshake: the retention window of the chain, narrowed down to the states
+// actually available (e.g. after a fast sync, or a restart of a pruned node), so
+// that the clients don't ask for states which eth_call couldn't use either. Zero
+// means all the states.
+func (s *LesServer) servedStates() uint64 {
+	chain, ok := s.protocolManager.blockchain.(*core.BlockChain)
+	if !ok {
+		return s.recentStates
+	}
+	sr := chain.StateRange()
+	if sr == nil || sr.Oldest == 0 {
+		return s.recentStates
+	}
+	if s.recentStates == 0 || sr.Blocks() < s.recentStates {
+		return sr.Blocks()
+	}
+	return s.recentStates
+}
+
 // todo ##############################
 // todo ##############################
 // todo ##############################
@@ -160,7 +221,7 @@ func NewLesServer(eth *eth.Ethereum, config *eth.Config) (*LesServer, error) {
 //
 // todo 启动 轻节点 Server 端
 func (s *LesServer) Protocols() []p2p.Protocol {
-	return s.makeProtocols(ServerProtocolVersions)
+	return s.makeProtocols(ServerProtocolVersions, p2p.DialInboundOnly)
 }
 
 // Start starts the LES server
@@ -170,6 +231,7 @@ func (s *LesServer) Start(srvr *p2p.Server) {
 
 	// 启动 轻节点的 pm
 	s.protocolManager.Start(s.config.LightPeers)
+	s.loadState()
 	if srvr.DiscV5 != nil {
 		for _, topic := range s.lesTopics {
 			topic := topic
@@ -184,6 +246,8 @@ func (s *LesServer) Start(srvr *p2p.Server) {
 		}
 	}
 	s.privateKey = srvr.PrivateKey
+	go s.sla.loop(s.quitSync)
+	go s.sectionLoop()
 
 	/**
 	TODO 超级重要~
@@ -193,6 +257,17 @@ func (s *LesServer) Start(srvr *p2p.Server) {
 	s.protocolManager.blockLoop()
 }
 
+// APIs returns the RPC services of the light server.
+func (s *LesServer) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "les",
+			Version:   "1.0",
+			Service:   NewPrivateLightServerAPI(s),
+		},
+	}
+}
+
 // 添加 BloomBits 子索引器
 func (s *LesServer) SetBloomBitsIndexer(bloomIndexer *core.ChainIndexer) {
 	bloomIndexer.AddChildIndexer(s.bloomTrieIndexer)
@@ -200,8 +275,13 @@ func (s *LesServer) SetBloomBitsIndexer(bloomIndexer *core.ChainIndexer) {
 
 // Stop stops the LES service
 func (s *LesServer) Stop() {
+	// 先通知 client 迁移, 避免其 req 在 断开连接时 白白等到超时
+	s.announceStop()
+	s.saveState()
+
 	s.chtIndexer.Close()
 	// bloom trie indexer is closed by parent bloombits indexer
+	s.sectionScope.Close()
 	s.fcCostStats.store()
 	s.fcManager.Stop()
 	go func() {
@@ -295,6 +375,15 @@ type requestCostStats struct {
 	lock  sync.RWMutex
 	db    ethdb.Database
 	stats map[uint64]*linReg
+
+	servedReqs, servedCost uint64 // totals since startup, not persisted
+}
+
+// servedTotals is the total number of requests served and their real cost since
+// the server was started.
+type servedTotals struct {
+	Requests uint64 `json:"requests"`
+	Cost     uint64 `json:"cost"`
 }
 
 type requestCostStatsRlp []struct {
@@ -381,6 +470,16 @@ func (s *requestCostStats) update(msgCode, reqCnt, cost uint64) {
 		return
 	}
 	c.add(float64(reqCnt), float64(cost))
+	s.servedReqs += reqCnt
+	s.servedCost += cost
+}
+
+// totals returns the requests served and their real cost since startup.
+func (s *requestCostStats) totals() interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return servedTotals{Requests: s.servedReqs, Cost: s.servedCost}
 }
 
 /**
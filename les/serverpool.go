@@ -27,6 +27,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
@@ -82,6 +83,12 @@ const (
 	responseScoreTC = time.Millisecond * 100
 	delayScoreTC    = time.Second * 5
 	timeoutPow      = 10
+	// known entry selection weight is raised with the total amount of data served
+	// by the node, by a factor of 1+log10(1+served/servedBytesUnit)/servedBytesDiv
+	// capped at maxServedBonus
+	servedBytesUnit = 1 << 20
+	servedBytesDiv  = 3
+	maxServedBonus  = 2
 	// initStatsWeight is used to initialize previously unknown peers with good
 	// statistics to give a chance to prove themselves
 	initStatsWeight = 1
@@ -108,6 +115,14 @@ type registerReq struct {
 	done  chan struct{}
 }
 
+// stopReq represents the stop announcement of a connected server.
+type stopReq struct {
+	entry        *poolEntry
+	resumeAfter  time.Duration
+	alternatives []*discover.Node
+	done         chan struct{}
+}
+
 // serverPool implements a pool for storing and selecting newly discovered and already
 // known light server nodes. It received discovered nodes, stores statistics about
 // known nodes and takes care of always having enough good quality servers connected.
@@ -138,6 +153,7 @@ type serverPool struct {
 	connCh     chan *connReq
 	disconnCh  chan *disconnReq
 	registerCh chan *registerReq
+	stopCh     chan *stopReq
 
 	knownQueue, newQueue       poolEntryQueue
 	knownSelect, newSelect     *weightedRandomSelect
@@ -159,6 +175,7 @@ func newServerPool(db ethdb.Database, quit chan struct{}, wg *sync.WaitGroup) *s
 		connCh:       make(chan *connReq),
 		disconnCh:    make(chan *disconnReq),
 		registerCh:   make(chan *registerReq),
+		stopCh:       make(chan *stopReq),
 		// 已知的 请求随机选择器
 		knownSelect:  newWeightedRandomSelect(),
 		// 新的 请求随机选择器
@@ -241,17 +258,32 @@ func (pool *serverPool) disconnect(entry *poolEntry) {
 	<-req.done
 }
 
+// serverStopping should be called when a connected server announces its shutdown,
+// before it's disconnected. The server is not dialed again until it's expected to
+// be back, and the alternative servers it suggested are dialed instead.
+func (pool *serverPool) serverStopping(entry *poolEntry, resumeAfter time.Duration, alternatives []*discover.Node) {
+	req := &stopReq{entry: entry, resumeAfter: resumeAfter, alternatives: alternatives, done: make(chan struct{})}
+	select {
+	case pool.stopCh <- req:
+		<-req.done
+	case <-pool.quit:
+	}
+}
+
 const (
 	pseBlockDelay = iota
 	pseResponseTime
 	pseResponseTimeout
+	pseServedBytes
 )
 
-// poolStatAdjust records are sent to adjust peer block delay/response time statistics
+// poolStatAdjust records are sent to adjust peer block delay/response time/served
+// bytes statistics
 type poolStatAdjust struct {
 	adjustType int
 	entry      *poolEntry
 	time       time.Duration
+	bytes      uint64
 }
 
 // adjustBlockDelay adjusts the block announce delay statistics of a node
@@ -259,7 +291,7 @@ func (pool *serverPool) adjustBlockDelay(entry *poolEntry, time time.Duration) {
 	if entry == nil {
 		return
 	}
-	pool.adjustStats <- poolStatAdjust{pseBlockDelay, entry, time}
+	pool.adjustStats <- poolStatAdjust{pseBlockDelay, entry, time, 0}
 }
 
 // adjustResponseTime adjusts the request response time statistics of a node
@@ -268,10 +300,19 @@ func (pool *serverPool) adjustResponseTime(entry *poolEntry, time time.Duration,
 		return
 	}
 	if timeout {
-		pool.adjustStats <- poolStatAdjust{pseResponseTimeout, entry, time}
+		pool.adjustStats <- poolStatAdjust{pseResponseTimeout, entry, time, 0}
 	} else {
-		pool.adjustStats <- poolStatAdjust{pseResponseTime, entry, time}
+		pool.adjustStats <- poolStatAdjust{pseResponseTime, entry, time, 0}
+	}
+}
+
+// adjustServedBytes adds the size of a valid reply to the total amount of data
+// served by a node
+func (pool *serverPool) adjustServedBytes(entry *poolEntry, bytes uint64) {
+	if entry == nil {
+		return
 	}
+	pool.adjustStats <- poolStatAdjust{pseServedBytes, entry, 0, bytes}
 }
 
 // eventLoop handles pool events and mutex locking for all internal functions
@@ -287,6 +328,10 @@ func (pool *serverPool) eventLoop() {
 	disconnect := func(req *disconnReq, stopped bool) {
 		// Handle peer disconnection requests.
 		entry := req.entry
+		// A server announcing its shutdown is not blamed for the disconnection
+		if entry.stopAnnounced {
+			stopped, entry.stopAnnounced = true, false
+		}
 		if entry.state == psRegistered {
 			connAdjust := float64(mclock.Now()-entry.regTime) / float64(targetConnTime)
 			if connAdjust > 1 {
@@ -334,6 +379,8 @@ func (pool *serverPool) eventLoop() {
 				adj.entry.timeoutStats.add(0, 1)
 			case pseResponseTimeout:
 				adj.entry.timeoutStats.add(1, 1)
+			case pseServedBytes:
+				adj.entry.servedBytes += adj.bytes
 			}
 
 		case node := <-pool.discNodes:
@@ -392,6 +439,18 @@ func (pool *serverPool) eventLoop() {
 			entry.shortRetry = shortRetryCnt
 			close(req.done)
 
+		case req := <-pool.stopCh:
+			// Handle server stop announcements.
+			req.entry.stopAnnounced = true
+			req.entry.resumeAt = mclock.Now() + mclock.AbsTime(req.resumeAfter)
+			for _, node := range req.alternatives {
+				if node.ID == req.entry.id {
+					continue
+				}
+				pool.updateCheckDial(pool.findOrNewNode(node.ID, node.IP, node.TCP))
+			}
+			close(req.done)
+
 		case req := <-pool.disconnCh:
 			// Handle peer disconnection requests.
 			disconnect(req, req.stopped)
@@ -471,7 +530,8 @@ func (pool *serverPool) loadNodes() {
 			"conn", fmt.Sprintf("%v/%v", e.connectStats.avg, e.connectStats.weight),
 			"delay", fmt.Sprintf("%v/%v", time.Duration(e.delayStats.avg), e.delayStats.weight),
 			"response", fmt.Sprintf("%v/%v", time.Duration(e.responseStats.avg), e.responseStats.weight),
-			"timeout", fmt.Sprintf("%v/%v", e.timeoutStats.avg, e.timeoutStats.weight))
+			"timeout", fmt.Sprintf("%v/%v", e.timeoutStats.avg, e.timeoutStats.weight),
+			"served", common.StorageSize(e.servedBytes))
 		pool.entries[e.id] = e
 		pool.knownQueue.setLatest(e)
 		pool.knownSelect.update((*knownEntry)(e))
@@ -509,6 +569,9 @@ func (pool *serverPool) setRetryDial(entry *poolEntry) {
 		delay = shortRetryDelay
 	}
 	delay += time.Duration(rand.Int63n(int64(delay) + 1))
+	if resume := time.Duration(entry.resumeAt - mclock.Now()); resume > delay {
+		delay = resume
+	}
 	entry.delayedRetry = true
 	go func() {
 		select {
@@ -634,13 +697,17 @@ type poolEntry struct {
 	regTime                     mclock.AbsTime
 	queueIdx                    int
 	removed                     bool
+	servedBytes                 uint64 // total size of the valid replies received from the node (persistent)
 
 	delayedRetry bool
 	shortRetry   int
+
+	stopAnnounced bool           // the server announced its shutdown before disconnecting
+	resumeAt      mclock.AbsTime // time the server announced to be back at, not dialed before
 }
 
 func (e *poolEntry) EncodeRLP(w io.Writer) error {
-	return rlp.Encode(w, []interface{}{e.id, e.lastConnected.ip, e.lastConnected.port, e.lastConnected.fails, &e.connectStats, &e.delayStats, &e.responseStats, &e.timeoutStats})
+	return rlp.Encode(w, []interface{}{e.id, e.lastConnected.ip, e.lastConnected.port, e.lastConnected.fails, &e.connectStats, &e.delayStats, &e.responseStats, &e.timeoutStats, e.servedBytes})
 }
 
 func (e *poolEntry) DecodeRLP(s *rlp.Stream) error {
@@ -650,6 +717,7 @@ func (e *poolEntry) DecodeRLP(s *rlp.Stream) error {
 		Port                       uint16
 		Fails                      uint
 		CStat, DStat, RStat, TStat poolStats
+		Served                     []uint64 `rlp:"tail"` // missing from entries saved by older versions
 	}
 	if err := s.Decode(&entry); err != nil {
 		return err
@@ -665,6 +733,9 @@ func (e *poolEntry) DecodeRLP(s *rlp.Stream) error {
 	e.delayStats = entry.DStat
 	e.responseStats = entry.RStat
 	e.timeoutStats = entry.TStat
+	if len(entry.Served) > 0 {
+		e.servedBytes = entry.Served[0]
+	}
 	e.shortRetry = shortRetryCnt
 	e.known = true
 	return nil
@@ -693,7 +764,17 @@ func (e *knownEntry) Weight() int64 {
 	if e.state != psNotConnected || !e.known || e.delayedRetry {
 		return 0
 	}
-	return int64(1000000000 * e.connectStats.recentAvg() * math.Exp(-float64(e.lastConnected.fails)*failDropLn-e.responseStats.recentAvg()/float64(responseScoreTC)-e.delayStats.recentAvg()/float64(delayScoreTC)) * math.Pow(1-e.timeoutStats.recentAvg(), timeoutPow))
+	return int64(1000000000 * e.connectStats.recentAvg() * math.Exp(-float64(e.lastConnected.fails)*failDropLn-e.responseStats.recentAvg()/float64(responseScoreTC)-e.delayStats.recentAvg()/float64(delayScoreTC)) * math.Pow(1-e.timeoutStats.recentAvg(), timeoutPow) * servedBonus(e.servedBytes))
+}
+
+// servedBonus returns the factor the selection weight of a known entry is raised
+// with, preferring the nodes which have served more data in the past.
+func servedBonus(served uint64) float64 {
+	bonus := 1 + math.Log10(1+float64(served)/servedBytesUnit)/servedBytesDiv
+	if bonus > maxServedBonus {
+		return maxServedBonus
+	}
+	return bonus
 }
 
 // poolEntryAddress is a separate object because currently it is necessary to remember
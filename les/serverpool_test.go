@@ -0,0 +1,112 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+
+package les
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// newTestServerPool creates a server pool without networking on top of the
+// given database.
+func newTestServerPool(db ethdb.Database) *serverPool {
+	pool := newServerPool(db, make(chan struct{}), new(sync.WaitGroup))
+	pool.dbKey = []byte("serverPool/test")
+	return pool
+}
+
+// addKnownNode adds a node to the pool as if it had been connected once.
+func addKnownNode(pool *serverPool, id discover.NodeID, served uint64) *poolEntry {
+	entry := pool.findOrNewNode(id, net.IP{127, 0, 0, 1}, 30303)
+	entry.lastConnected = entry.addr["127.0.0.1:30303"]
+	entry.known = true
+	entry.servedBytes = served
+	entry.connectStats.init(1, 1)
+	pool.newQueue.remove(entry)
+	pool.knownQueue.setLatest(entry)
+	return entry
+}
+
+// Tests that the quality statistics of the known nodes survive a restart.
+func TestServerPoolPersistence(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+
+	pool := newTestServerPool(db)
+	entry := addKnownNode(pool, discover.NodeID{1}, 5<<20)
+	entry.connectStats.add(0.5, 10)
+	entry.responseStats.add(float64(30e6), 10)
+	pool.saveNodes()
+
+	pool = newTestServerPool(db)
+	pool.loadNodes()
+	loaded := pool.entries[discover.NodeID{1}]
+	if loaded == nil {
+		t.Fatal("known node not loaded")
+	}
+	if loaded.servedBytes != 5<<20 {
+		t.Errorf("served bytes mismatch: have %d, want %d", loaded.servedBytes, 5<<20)
+	}
+	if loaded.connectStats.avg != entry.connectStats.avg || loaded.responseStats.avg != entry.responseStats.avg {
+		t.Errorf("statistics mismatch: have conn %v resp %v, want conn %v resp %v",
+			loaded.connectStats.avg, loaded.responseStats.avg, entry.connectStats.avg, entry.responseStats.avg)
+	}
+}
+
+// Tests that node lists saved without the served bytes are still loaded.
+func TestServerPoolLoadLegacy(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+
+	var stats poolStats
+	stats.init(1, 1)
+	legacy := []interface{}{discover.NodeID{1}, net.IP{127, 0, 0, 1}, uint16(30303), uint(0), &stats, &stats, &stats, &stats}
+	enc, err := rlp.EncodeToBytes([]interface{}{legacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("serverPool/test"), enc)
+
+	pool := newTestServerPool(db)
+	pool.loadNodes()
+	entry := pool.entries[discover.NodeID{1}]
+	if entry == nil {
+		t.Fatal("legacy node not loaded")
+	}
+	if entry.servedBytes != 0 {
+		t.Errorf("served bytes mismatch: have %d, want 0", entry.servedBytes)
+	}
+}
+
+// Tests that nodes which served more data are preferred when reconnecting.
+func TestServerPoolServedWeight(t *testing.T) {
+	pool := newTestServerPool(ethdb.NewMemDatabase())
+
+	idle := addKnownNode(pool, discover.NodeID{1}, 0)
+	busy := addKnownNode(pool, discover.NodeID{2}, 100<<20)
+
+	if wi, wb := (*knownEntry)(idle).Weight(), (*knownEntry)(busy).Weight(); wb <= wi {
+		t.Errorf("serving node not preferred: weight %d, idle node weight %d", wb, wi)
+	}
+	if bonus := servedBonus(1 << 50); bonus != maxServedBonus {
+		t.Errorf("served bonus not capped: have %v, want %v", bonus, maxServedBonus)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// serverStateVersion is the version of the encoding of the server state, to be
+// bumped on incompatible changes. Records of other versions are not restored.
+const serverStateVersion = 1
+
+// serverStateKey is the database key the server state is kept under.
+var serverStateKey = []byte("lesServerState")
+
+// ServerState is the operational state of a server kept across restarts and
+// upgrades: the recent usage of the free clients, the traffic of the clients in
+// the daily quota window and the banned peers.
+//
+/**
+ServerState: server 的运行状态 (带版本号), 停止时写入 db, 启动时恢复, 也可以通过 RPC 导出/导入
+	free client pool 中 各 client 的 近期使用时间
+	各 client 在 24 小时配额窗口内 已发送的字节数
+	被拉黑的 peer 及 剩余拉黑时间
+ */
+type ServerState struct {
+	Version     uint               `json:"version"`
+	FreeClients []FreeClientRecord `json:"freeClients"`
+	Bandwidth   []BandwidthRecord  `json:"bandwidth"`
+	Bans        []BanRecord        `json:"bans"`
+}
+
+// FreeClientRecord is the recent usage of a client of the free client pool.
+type FreeClientRecord struct {
+	Address string `json:"address"`
+	Usage   uint64 `json:"usage"` // recent connection time in nanoseconds, decaying exponentially
+}
+
+// BandwidthRecord is the traffic of a client in the daily quota window.
+type BandwidthRecord struct {
+	ID    string   `json:"id"`
+	Hours []uint64 `json:"hours"` // bytes sent in the hours of the window, the current one first
+}
+
+// BanRecord is a banned peer.
+type BanRecord struct {
+	ID        string `json:"id"`
+	Remaining uint64 `json:"remaining"` // remaining ban time in nanoseconds
+}
+
+// usages returns the recent usage of the clients known by the pool.
+func (f *freeClientPool) usages() []FreeClientRecord {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.clock.Now()
+	records := make([]FreeClientRecord, 0, len(f.addressMap))
+	for _, e := range f.addressMap {
+		var usage int64
+		if e.connected {
+			usage = e.linUsage + int64(now)
+		} else {
+			usage = int64(math.Exp(float64(e.logUsage-f.logOffset(now)) / fixedPointMultiplier))
+		}
+		if usage < 0 {
+			usage = 0
+		}
+		records = append(records, FreeClientRecord{Address: e.address, Usage: uint64(usage)})
+	}
+	return records
+}
+
+// restoreUsages adds the clients unknown to the pool with their recorded recent
+// usage, as long as the pool has room for them. It returns the number of clients
+// added.
+func (f *freeClientPool) restoreUsages(records []FreeClientRecord) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.clock.Now()
+	var added int
+	for _, r := range records {
+		if f.connPool.Size()+f.disconnPool.Size() >= f.totalLimit {
+			break
+		}
+		if _, ok := f.addressMap[r.Address]; ok {
+			continue
+		}
+		usage := float64(r.Usage)
+		if usage < 1 {
+			usage = 1
+		}
+		e := &freeClientPoolEntry{address: r.Address, index: -1}
+		e.logUsage = int64(math.Log(usage)*fixedPointMultiplier) + f.logOffset(now)
+		f.addressMap[e.address] = e
+		f.disconnPool.Push(e, -e.logUsage)
+		added++
+	}
+	return added
+}
+
+// records returns the traffic of the clients with usage in the window.
+func (t *bandwidthTracker) records() []BandwidthRecord {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hour := t.hour()
+	records := make([]BandwidthRecord, 0, len(t.clients))
+	for id, c := range t.clients {
+		if c.roll(hour); c.sum == 0 {
+			continue
+		}
+		hours := make([]uint64, bandwidthBuckets)
+		for i := range hours {
+			hours[i] = c.buckets[bandwidthBucket(hour-int64(i))]
+		}
+		for len(hours) > 0 && hours[len(hours)-1] == 0 {
+			hours = hours[:len(hours)-1]
+		}
+		records = append(records, BandwidthRecord{ID: id, Hours: hours})
+	}
+	return records
+}
+
+// restore adds the recorded traffic of the clients unknown to the tracker,
+// returning the number of clients added.
+func (t *bandwidthTracker) restore(records []BandwidthRecord) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hour := t.hour()
+	var added int
+	for _, r := range records {
+		if _, ok := t.clients[r.ID]; ok {
+			continue
+		}
+		c := &clientBandwidth{hour: hour}
+		for i, bytes := range r.Hours {
+			if i == bandwidthBuckets {
+				break
+			}
+			c.buckets[bandwidthBucket(hour-int64(i))] = bytes
+			c.sum += bytes
+		}
+		if c.sum > 0 {
+			t.clients[r.ID] = c
+			added++
+		}
+	}
+	return added
+}
+
+// bandwidthBucket returns the index of the bucket of an hour, which may be
+// negative shortly after the start of the clock.
+func bandwidthBucket(hour int64) int64 {
+	return (hour%bandwidthBuckets + bandwidthBuckets) % bandwidthBuckets
+}
+
+// banRecords returns the banned peers with their remaining ban time.
+func (ps *peerSet) banRecords() []BanRecord {
+	banned := ps.BannedPeers()
+
+	records := make([]BanRecord, 0, len(banned))
+	for id, remaining := range banned {
+		records = append(records, BanRecord{ID: id, Remaining: uint64(remaining)})
+	}
+	return records
+}
+
+// restoreBans bans the recorded peers for their remaining time, unless banned
+// for longer already or the ban list is full. It returns the number of bans
+// restored.
+func (ps *peerSet) restoreBans(records []BanRecord) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	now := ps.clock.Now()
+	var added int
+	for _, r := range records {
+		expiry := now + mclock.AbsTime(r.Remaining)
+		if old, ok := ps.banned[r.ID]; ok {
+			if old >= expiry {
+				continue
+			}
+		} else if len(ps.banned) >= maxBannedPeers {
+			continue
+		}
+		ps.banned[r.ID] = expiry
+		added++
+	}
+	return added
+}
+
+// exportState collects the operational state of the server.
+func (s *LesServer) exportState() *ServerState {
+	state := &ServerState{Version: serverStateVersion}
+	if pool := s.protocolManager.clientPool; pool != nil {
+		state.FreeClients = pool.usages()
+	}
+	if s.bandwidth != nil {
+		state.Bandwidth = s.bandwidth.records()
+	}
+	state.Bans = s.protocolManager.peers.banRecords()
+	return state
+}
+
+// importState restores an exported state of a server, adding the records of the
+// clients and peers not known yet.
+func (s *LesServer) importState(state *ServerState) error {
+	if state.Version != serverStateVersion {
+		return fmt.Errorf("unsupported server state version %d, want %d", state.Version, serverStateVersion)
+	}
+	var clients, traffic, bans int
+	if pool := s.protocolManager.clientPool; pool != nil {
+		clients = pool.restoreUsages(state.FreeClients)
+	}
+	if s.bandwidth != nil {
+		traffic = s.bandwidth.restore(state.Bandwidth)
+	}
+	bans = s.protocolManager.peers.restoreBans(state.Bans)
+	log.Info("Restored server state", "clients", clients, "traffic", traffic, "bans", bans)
+	return nil
+}
+
+// saveState stores the state of the server in the database.
+//
+// server 停止时 把运行状态 写入 db
+func (s *LesServer) saveState() {
+	enc, err := rlp.EncodeToBytes(s.exportState())
+	if err != nil {
+		log.Error("Failed to encode server state", "err", err)
+		return
+	}
+	if err := s.chainDb.Put(serverStateKey, enc); err != nil {
+		log.Error("Failed to store server state", "err", err)
+	}
+}
+
+// loadState restores the state of the server stored in the database, if any.
+//
+// server 启动时 从 db 恢复 上次停止时的 运行状态
+func (s *LesServer) loadState() {
+	enc, err := s.chainDb.Get(serverStateKey)
+	if err != nil {
+		return
+	}
+	// Check the version first, the records of other versions may not decode
+	var header struct {
+		Version uint
+		Rest    []rlp.RawValue `rlp:"tail"`
+	}
+	if err := rlp.DecodeBytes(enc, &header); err != nil {
+		log.Error("Failed to decode server state", "err", err)
+		return
+	}
+	if header.Version != serverStateVersion {
+		log.Warn("Discarded stored server state", "version", header.Version, "want", serverStateVersion)
+		return
+	}
+	var state ServerState
+	if err := rlp.DecodeBytes(enc, &state); err != nil {
+		log.Error("Failed to decode server state", "err", err)
+		return
+	}
+	if err := s.importState(&state); err != nil {
+		log.Warn("Discarded stored server state", "err", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+// Tests that the exported state of a server is restored by another one running
+// on a different clock.
+func TestServerStateRoundTrip(t *testing.T) {
+	var clock mclock.Simulated
+
+	pool := newFreeClientPool(ethdb.NewMemDatabase(), 2, 100, &clock)
+	pool.connect("a", func() {})
+	clock.Run(10 * time.Minute)
+	pool.disconnect("a")
+	pool.connect("b", func() {})
+	clock.Run(5 * time.Minute)
+
+	bandwidth := newBandwidthTracker(1<<20, &clock)
+	bandwidth.add("a", 1000)
+	clock.Run(2 * time.Hour)
+	bandwidth.add("a", 500)
+
+	peers := newPeerSet()
+	peers.clock = &clock
+	peers.lock.Lock()
+	peers.ban("x")
+	peers.lock.Unlock()
+	clock.Run(time.Minute)
+
+	exported := &ServerState{
+		Version:     serverStateVersion,
+		FreeClients: pool.usages(),
+		Bandwidth:   bandwidth.records(),
+		Bans:        peers.banRecords(),
+	}
+	enc, err := rlp.EncodeToBytes(exported)
+	if err != nil {
+		t.Fatalf("failed to encode state: %v", err)
+	}
+	var state ServerState
+	if err := rlp.DecodeBytes(enc, &state); err != nil {
+		t.Fatalf("failed to decode state: %v", err)
+	}
+
+	// Restore on a clock started at a different time
+	var clock2 mclock.Simulated
+	clock2.Run(5 * time.Hour)
+
+	pool2 := newFreeClientPool(ethdb.NewMemDatabase(), 2, 100, &clock2)
+	if n := pool2.restoreUsages(state.FreeClients); n != 2 {
+		t.Fatalf("restored clients mismatch: have %d, want %d", n, 2)
+	}
+	want := make(map[string]uint64)
+	for _, r := range exported.FreeClients {
+		want[r.Address] = r.Usage
+	}
+	for _, r := range pool2.usages() {
+		if diff := int64(r.Usage) - int64(want[r.Address]); diff > int64(want[r.Address]/100) || -diff > int64(want[r.Address]/100) {
+			t.Errorf("client %s usage mismatch: have %v, want %v", r.Address, time.Duration(r.Usage), time.Duration(want[r.Address]))
+		}
+	}
+
+	bandwidth2 := newBandwidthTracker(1<<20, &clock2)
+	if n := bandwidth2.restore(state.Bandwidth); n != 1 {
+		t.Fatalf("restored traffic mismatch: have %d, want %d", n, 1)
+	}
+	if usage := bandwidth2.usage("a"); usage != 1500 {
+		t.Errorf("restored usage mismatch: have %d, want %d", usage, 1500)
+	}
+	clock2.Run(22 * time.Hour)
+	if usage := bandwidth2.usage("a"); usage != 500 {
+		t.Errorf("usage after the first hour left the window: have %d, want %d", usage, 500)
+	}
+
+	peers2 := newPeerSet()
+	peers2.clock = &clock2
+	if n := peers2.restoreBans(state.Bans); n != 1 {
+		t.Fatalf("restored bans mismatch: have %d, want %d", n, 1)
+	}
+	if remaining := peers2.BannedPeers()["x"]; remaining != peerBanDuration-time.Minute {
+		t.Errorf("remaining ban mismatch: have %v, want %v", remaining, peerBanDuration-time.Minute)
+	}
+
+	// States of other versions are refused
+	if err := new(LesServer).importState(&ServerState{Version: serverStateVersion + 1}); err == nil {
+		t.Errorf("state of unknown version imported")
+	}
+}
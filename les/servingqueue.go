@@ -0,0 +1,124 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/prque"
+)
+
+// servingQueue limits the number of client requests served concurrently by the
+// server. When all serving threads are busy, waiting requests are admitted in
+// the order of their priority instead of FIFO, so that well-behaved clients
+// (the ones with a lot of remaining buffer) get lower latency under load.
+//
+/**
+servingQueue:
+限制 server 同时处理的 client req 数目, 当所有的处理线程都繁忙时,
+按优先级 (client 剩余的 buffer) 而不是 FIFO 的顺序放行等待中的 req
+ */
+type servingQueue struct {
+	lock  sync.Mutex
+	free  int          // number of idle serving threads
+	queue *prque.Prque // waiting requests, highest priority first
+}
+
+// servingTask is a request waiting for a serving thread.
+type servingTask struct {
+	granted chan struct{}
+	index   int // index in the priority queue, -1 if not queued
+}
+
+// newServingQueue creates a serving queue with the given number of threads.
+func newServingQueue(threads int) *servingQueue {
+	if threads < 1 {
+		threads = 1
+	}
+	return &servingQueue{
+		free: threads,
+		queue: prque.New(func(a interface{}, i int) {
+			a.(*servingTask).index = i
+		}),
+	}
+}
+
+// enter blocks until a serving thread is assigned to the caller. Returns false
+// if quit is closed before that happens, in which case leave must not be called.
+func (sq *servingQueue) enter(priority int64, quit <-chan struct{}) bool {
+	sq.lock.Lock()
+	if sq.free > 0 && sq.queue.Empty() {
+		sq.free--
+		sq.lock.Unlock()
+		return true
+	}
+	task := &servingTask{granted: make(chan struct{})}
+	sq.queue.Push(task, priority)
+	sq.lock.Unlock()
+
+	select {
+	case <-task.granted:
+		return true
+	case <-quit:
+		sq.lock.Lock()
+		defer sq.lock.Unlock()
+
+		if task.index < 0 {
+			// thread has been granted in the meantime, pass it on
+			sq.release()
+		} else {
+			sq.queue.Remove(task.index)
+		}
+		return false
+	}
+}
+
+// leave frees the serving thread of the caller.
+func (sq *servingQueue) leave() {
+	sq.lock.Lock()
+	sq.release()
+	sq.lock.Unlock()
+}
+
+// release hands a freed thread to the highest priority waiting task or returns
+// it to the idle pool. The lock is held by the caller.
+func (sq *servingQueue) release() {
+	if sq.queue.Empty() {
+		sq.free++
+		return
+	}
+	task := sq.queue.PopItem().(*servingTask)
+	task.index = -1
+	close(task.granted)
+}
+
+// servingPriority calculates the queue priority of a request sent by the given
+// peer. Requests of clients with a higher relative buffer value are served first;
+// at equal buffer levels clients requesting less announcement work are preferred.
+//
+// servingPriority: 计算 req 的优先级, 主要根据 client 剩余的 buffer 比例,
+// 其次根据 client 请求的 announceType (越简单越优先)
+func servingPriority(p *peer) int64 {
+	priority := int64(p.fcClient.BufferLevel() * 1000000)
+	switch p.announceType {
+	case announceTypeNone:
+		priority += 2
+	case announceTypeSimple:
+		priority++
+	}
+	return priority
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServingQueuePriority(t *testing.T) {
+	var (
+		q      = newServingQueue(1)
+		quit   = make(chan struct{})
+		served = make(chan int64, 3)
+	)
+	// occupy the only serving thread
+	if !q.enter(0, quit) {
+		t.Fatal("failed to enter idle queue")
+	}
+	for _, priority := range []int64{1, 3, 2} {
+		go func(priority int64) {
+			if q.enter(priority, quit) {
+				served <- priority
+				q.leave()
+			}
+		}(priority)
+	}
+	// wait until all requests are queued, then release the thread
+	for {
+		q.lock.Lock()
+		size := q.queue.Size()
+		q.lock.Unlock()
+		if size == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.leave()
+	for _, want := range []int64{3, 2, 1} {
+		if have := <-served; have != want {
+			t.Fatalf("service order mismatch: have %d, want %d", have, want)
+		}
+	}
+	// a cancelled waiter must not leak its place in the queue
+	q.enter(0, quit)
+	cancelled := make(chan struct{})
+	close(cancelled)
+	if q.enter(1, cancelled) {
+		t.Fatal("entered busy queue with closed quit channel")
+	}
+	q.leave()
+	if q.free != 1 || !q.queue.Empty() {
+		t.Fatalf("queue state mismatch: %d free threads, %d queued", q.free, q.queue.Size())
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// stopAnnounceTimeout is the time a stopping server waits for its stop
+// announcements to be sent before shutting down the connections anyway.
+const stopAnnounceTimeout = 2 * time.Second
+
+// maxStopAlternatives is the number of alternative servers a stop announcement
+// may suggest. Clients ignore the ones beyond, so a server can't flood their
+// server pools.
+const maxStopAlternatives = 4
+
+// stopAnnounceExtension is the handshake extension advertised by the peers
+// supporting stop announcements. A server only sends them to the clients that
+// advertised it, the other ones don't know the message.
+const stopAnnounceExtension = "stopAnnounce"
+
+func init() {
+	RegisterHandshakeExtension(HandshakeExtension{
+		Name:  stopAnnounceExtension,
+		Value: func(discover.NodeID, bool) interface{} { return nil },
+	})
+}
+
+// stopAnnounce is sent by a stopping server to its LES/2 clients, so they move
+// their requests to other servers right away instead of waiting for them to time
+// out, and don't dial the server again before it's expected back.
+//
+/**
+stopAnnounce: server 停止 (Stop) 时 广播给 LES/2 client 的 msg
+	ResumeAfter:  预计多久之后 server 恢复服务 (秒, 0 表示未知), 在此之前 client 不再重拨该 server
+	Alternatives: 可选的 替代 server 的 enode URL, client 会尝试去连接它们
+client 收到后 立即把 还在等待该 server 的 req 转发给其他 server, 而不是等到超时
+ */
+type stopAnnounce struct {
+	ResumeAfter  uint64   // seconds, zero if unknown
+	Alternatives []string // enode URLs of alternative servers
+}
+
+// newStopAnnounce creates the stop announcement of a server, validating the
+// alternative servers.
+func newStopAnnounce(resumeAfter time.Duration, alternatives []string) (stopAnnounce, error) {
+	if len(alternatives) > maxStopAlternatives {
+		return stopAnnounce{}, fmt.Errorf("too many LES alternative servers: %d (max %d)", len(alternatives), maxStopAlternatives)
+	}
+	for _, url := range alternatives {
+		if _, err := discover.ParseNode(url); err != nil {
+			return stopAnnounce{}, fmt.Errorf("invalid LES alternative server %q: %v", url, err)
+		}
+	}
+	return stopAnnounce{ResumeAfter: uint64(resumeAfter / time.Second), Alternatives: alternatives}, nil
+}
+
+// nodes returns the valid alternative servers of the announcement, a client
+// ignores the ones it can't parse and the ones beyond maxStopAlternatives.
+func (s *stopAnnounce) nodes() []*discover.Node {
+	var nodes []*discover.Node
+	for i, url := range s.Alternatives {
+		if i == maxStopAlternatives {
+			break
+		}
+		if node, err := discover.ParseNode(url); err == nil {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// stopAnnounces returns whether the stop announcements were negotiated with the
+// peer in the handshake.
+func (p *peer) stopAnnounces() bool {
+	_, ok := p.extensions[stopAnnounceExtension]
+	return p.version >= lpv2 && ok
+}
+
+// SendStopAnnounce tells a client that the server is stopping.
+func (p *peer) SendStopAnnounce(stop stopAnnounce) error {
+	return p2p.Send(p.rw, StopAnnounceMsg, stop)
+}
+
+// announceStop sends the stop announcement to the connected clients supporting
+// it, waiting at most stopAnnounceTimeout for the slow ones.
+func (s *LesServer) announceStop() {
+	var wg sync.WaitGroup
+	for _, p := range s.protocolManager.peers.AllPeers() {
+		if !p.stopAnnounces() {
+			continue
+		}
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			if err := p.SendStopAnnounce(s.stopAnnounce); err != nil {
+				p.Log().Debug("Failed to announce server stop", "err", err)
+			}
+		}(p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopAnnounceTimeout):
+	}
+}
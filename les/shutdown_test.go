@@ -0,0 +1,100 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+const testAlternative = "enode://a979fb575495b8d6db44f750317d0f4622bf4c2aa3365d6af7c284339968eef29b69ad0dce72a4d8db5ebb4968de0e3bec910127f134779fbcb0cb6d3331163c@52.16.188.185:30303"
+
+// Tests that a stopping server sends the migration hints to its clients.
+func TestStopAnnounce(t *testing.T) {
+	if _, err := newStopAnnounce(time.Minute, []string{"enode://invalid"}); err == nil {
+		t.Fatalf("invalid alternative server accepted")
+	}
+	many := make([]string, maxStopAlternatives+1)
+	for i := range many {
+		many[i] = testAlternative
+	}
+	if _, err := newStopAnnounce(time.Minute, many); err == nil {
+		t.Fatalf("too many alternative servers accepted")
+	}
+	// Clients only use the first few alternatives of an announcement
+	flood := stopAnnounce{Alternatives: append(many, many...)}
+	if nodes := flood.nodes(); len(nodes) != maxStopAlternatives {
+		t.Errorf("alternative count mismatch: have %d, want %d", len(nodes), maxStopAlternatives)
+	}
+	stop, err := newStopAnnounce(90*time.Second, []string{testAlternative})
+	if err != nil {
+		t.Fatalf("failed to create stop announcement: %v", err)
+	}
+	pm := newTestProtocolManagerMust(t, false, 0, nil, nil, nil, ethdb.NewMemDatabase())
+	pm.server.stopAnnounce = stop
+
+	// Only the clients advertising the extension get the announcement, the other
+	// one would block it until the timeout as nobody reads its messages
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentHeader()
+		td      = pm.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	peer, _ := newTestPeer(t, "peer", lpv2, pm, false)
+	defer peer.close()
+	peer.handshakeWithOptions(t, td, head.Hash(), head.Number.Uint64(), genesis.Hash(), keyValueList{}.add(stopAnnounceExtension, nil).add(extensionsKey, []string{stopAnnounceExtension}))
+
+	legacy, _ := newTestPeer(t, "legacy", lpv2, pm, true)
+	defer legacy.close()
+
+	for i := 0; pm.peers.Len() < 2; i++ {
+		if i == 100 {
+			t.Fatalf("peers not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		pm.server.announceStop()
+		close(done)
+	}()
+
+	msg, err := peer.app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read stop announcement: %v", err)
+	}
+	if msg.Code != StopAnnounceMsg {
+		t.Fatalf("message code mismatch: have %d, want %d", msg.Code, StopAnnounceMsg)
+	}
+	var recv stopAnnounce
+	if err := msg.Decode(&recv); err != nil {
+		t.Fatalf("failed to decode stop announcement: %v", err)
+	}
+	if recv.ResumeAfter != 90 {
+		t.Errorf("resume time mismatch: have %d, want 90", recv.ResumeAfter)
+	}
+	if nodes := recv.nodes(); len(nodes) != 1 || nodes[0].TCP != 30303 {
+		t.Errorf("alternative servers mismatch: %v", nodes)
+	}
+	select {
+	case <-done:
+	case <-time.After(stopAnnounceTimeout / 2):
+		t.Errorf("stop announced to a client not supporting it")
+	}
+}
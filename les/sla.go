@@ -0,0 +1,199 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+const (
+	// defaultSLATarget is the target latency of serving a client request if none
+	// is configured.
+	defaultSLATarget = 500 * time.Millisecond
+
+	// slaReportInterval is the period of the service level summary logged by the
+	// server.
+	slaReportInterval = 10 * time.Minute
+)
+
+var (
+	slaOnTimeMeter = metrics.NewRegisteredMeter("les/server/sla/ontime", nil)
+	slaLateMeter   = metrics.NewRegisteredMeter("les/server/sla/late", nil)
+	slaWaitMeter   = metrics.NewRegisteredMeter("les/server/sla/waits", nil)
+)
+
+// SLAClientStats is the service level provided to a client (or to all of them).
+type SLAClientStats struct {
+	Served      uint64        `json:"served"`      // Requests answered
+	OnTime      uint64        `json:"onTime"`      // Requests answered within the target latency
+	OnTimeRatio float64       `json:"onTimeRatio"` // Fraction of the requests answered within the target latency
+	AvgLatency  time.Duration `json:"avgLatency"`  // Average time of answering a request
+	ForcedWaits uint64        `json:"forcedWaits"` // Requests delayed or refused by flow control, throttling or overload
+}
+
+// SLAReport is the service level summary of the server.
+type SLAReport struct {
+	Target  time.Duration             `json:"target"`  // Target latency of answering a request
+	Since   time.Time                 `json:"since"`   // Start of the reported period
+	Total   SLAClientStats            `json:"total"`   // Service level of all the clients of the period, including the disconnected ones
+	Clients map[string]SLAClientStats `json:"clients"` // Service level of the connected clients since their connection
+}
+
+// slaCounters collects the service level of a client.
+type slaCounters struct {
+	served, onTime, waits uint64
+	latency               time.Duration // sum of the answering times
+}
+
+// stats converts the counters to their reported form.
+func (c *slaCounters) stats() SLAClientStats {
+	s := SLAClientStats{Served: c.served, OnTime: c.onTime, ForcedWaits: c.waits}
+	if c.served > 0 {
+		s.OnTimeRatio = float64(c.onTime) / float64(c.served)
+		s.AvgLatency = c.latency / time.Duration(c.served)
+	}
+	return s
+}
+
+// slaTracker measures the minimum service guarantees of the server: the fraction
+// of the requests of each client answered within the target latency, and the
+// number of times a client was forced to wait by flow control, throttling or
+// overload protection. Operators offering paid service can verify from it that
+// they meet their commitments.
+//
+/**
+slaTracker: 统计 server 对每个 client 的服务水平 (SLA):
+在目标延迟内应答的 req 比例, 以及 client 因 流控/限流/过载保护 被迫等待 (或被拒绝) 的次数
+ */
+type slaTracker struct {
+	target time.Duration
+
+	lock    sync.Mutex
+	clients map[string]*slaCounters // counters of the connected clients
+	total   slaCounters             // counters of all the clients of the period
+	since   time.Time               // start of the period
+}
+
+// newSLATracker creates a tracker with the given target latency, zero selects
+// the default.
+func newSLATracker(target time.Duration) *slaTracker {
+	if target <= 0 {
+		target = defaultSLATarget
+	}
+	return &slaTracker{
+		target:  target,
+		clients: make(map[string]*slaCounters),
+		since:   time.Now(),
+	}
+}
+
+// connect starts tracking a client.
+func (t *slaTracker) connect(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.clients[id] = new(slaCounters)
+}
+
+// disconnect stops tracking a client, its requests remain in the total.
+func (t *slaTracker) disconnect(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.clients, id)
+}
+
+// served records a request of a client answered in the given time.
+func (t *slaTracker) served(id string, latency time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	onTime := latency <= t.target
+	if onTime {
+		slaOnTimeMeter.Mark(1)
+	} else {
+		slaLateMeter.Mark(1)
+	}
+	for _, c := range []*slaCounters{t.clients[id], &t.total} {
+		if c == nil {
+			continue
+		}
+		c.served++
+		c.latency += latency
+		if onTime {
+			c.onTime++
+		}
+	}
+}
+
+// forcedWait records a request of a client delayed or refused by the server.
+func (t *slaTracker) forcedWait(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	slaWaitMeter.Mark(1)
+	if c := t.clients[id]; c != nil {
+		c.waits++
+	}
+	t.total.waits++
+}
+
+// report returns the service level summary. If reset is set, a new period of the
+// total is started.
+func (t *slaTracker) report(reset bool) *SLAReport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r := &SLAReport{
+		Target:  t.target,
+		Since:   t.since,
+		Total:   t.total.stats(),
+		Clients: make(map[string]SLAClientStats, len(t.clients)),
+	}
+	for id, c := range t.clients {
+		r.Clients[id] = c.stats()
+	}
+	if reset {
+		t.total, t.since = slaCounters{}, time.Now()
+	}
+	return r
+}
+
+// loop logs the service level summary of every period until quit is closed.
+func (t *slaTracker) loop(quit <-chan struct{}) {
+	ticker := time.NewTicker(slaReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r := t.report(true)
+			if r.Total.Served == 0 && r.Total.ForcedWaits == 0 {
+				continue
+			}
+			log.Info("LES service level report", "clients", len(r.Clients), "served", r.Total.Served,
+				"ontime", r.Total.OnTimeRatio, "latency", common.PrettyDuration(r.Total.AvgLatency), "target", r.Target, "waits", r.Total.ForcedWaits)
+		case <-quit:
+			return
+		}
+	}
+}
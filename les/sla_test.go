@@ -0,0 +1,92 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// Tests that the service level of the clients is tracked against the target
+// latency, and that the total of a period survives the disconnection of clients.
+func TestSLATracker(t *testing.T) {
+	sla := newSLATracker(100 * time.Millisecond)
+	sla.connect("a")
+	sla.connect("b")
+
+	sla.served("a", 10*time.Millisecond)
+	sla.served("a", 50*time.Millisecond)
+	sla.served("a", 300*time.Millisecond)
+	sla.forcedWait("a")
+	sla.served("b", 100*time.Millisecond)
+	sla.served("unknown", time.Millisecond)
+
+	r := sla.report(false)
+	if a := r.Clients["a"]; a.Served != 3 || a.OnTime != 2 || a.ForcedWaits != 1 || a.AvgLatency != 120*time.Millisecond {
+		t.Errorf("client a: stats mismatch: %+v", a)
+	}
+	if b := r.Clients["b"]; b.Served != 1 || b.OnTimeRatio != 1 {
+		t.Errorf("client b: stats mismatch: %+v", b)
+	}
+	sla.disconnect("a")
+	r = sla.report(true)
+	if _, ok := r.Clients["a"]; ok {
+		t.Errorf("disconnected client reported")
+	}
+	if r.Total.Served != 5 || r.Total.OnTime != 4 || r.Total.ForcedWaits != 1 {
+		t.Errorf("total stats mismatch: %+v", r.Total)
+	}
+	// A new period starts after a reset, the connected clients are kept
+	r = sla.report(false)
+	if r.Total.Served != 0 || r.Clients["b"].Served != 1 {
+		t.Errorf("stats mismatch after reset: total %+v, client b %+v", r.Total, r.Clients["b"])
+	}
+}
+
+// Tests that the requests answered by the server are reported per client.
+func TestSLAServedRequests(t *testing.T) {
+	pm := newTestProtocolManagerMust(t, false, 4, nil, nil, nil, ethdb.NewMemDatabase())
+	pm.server.servingQueue = newServingQueue(1)
+	pm.server.sla = newSLATracker(time.Hour)
+
+	peer, _ := newTestPeer(t, "peer", 2, pm, true)
+	defer peer.close()
+
+	for i := uint64(1); i <= 3; i++ {
+		query := &getBlockHeadersData{Origin: hashOrNumber{Number: i}, Amount: 1}
+		cost := peer.GetRequestCost(GetBlockHeadersMsg, 1)
+		sendRequest(peer.app, GetBlockHeadersMsg, i, cost, query)
+		headers := []*types.Header{pm.blockchain.GetHeaderByNumber(i)}
+		if err := expectResponse(peer.app, BlockHeadersMsg, i, testBufLimit, headers); err != nil {
+			t.Fatalf("request %d: headers mismatch: %v", i, err)
+		}
+	}
+	// The answering time is recorded after the reply was sent
+	var stats SLAClientStats
+	for i := 0; i < 100; i++ {
+		if stats = pm.server.sla.report(false).Clients[peer.id]; stats.Served == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.Served != 3 || stats.OnTime != 3 || stats.ForcedWaits != 0 {
+		t.Errorf("client stats mismatch: %+v", stats)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/rawdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/light"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	maxStateHintSlots   = 8    // storage slots hinted at most with an account
+	maxHintAccounts     = 4096 // accounts whose storage reads are tracked by the server
+	maxTrackedHintSlots = 64   // storage slots tracked per account
+
+	stateHintQueue      = 64                    // hints waiting for prefetching on the client
+	stateHintRetries    = 3                     // lookups of the hinted account before giving up
+	stateHintRetryDelay = 50 * time.Millisecond // wait for the account proof to be stored
+	stateHintTimeout    = 10 * time.Second      // timeout of a single slot prefetch
+)
+
+var stateHintPrefetchMeter = metrics.NewRegisteredMeter("les/client/statehints/prefetch", nil)
+
+// stateHint lists the storage slots most frequently read with an account, sent
+// by the server after a proof of the account.
+type stateHint struct {
+	BHash  common.Hash
+	AccKey common.Hash   // hash of the account address
+	Keys   []common.Hash // hashes of the storage slots
+}
+
+// SendStateHints piggybacks the state access hints of the accounts of a proof
+// response.
+func (p *peer) SendStateHints(hints []stateHint) error {
+	return p2p.Send(p.rw, StateHintsMsg, hints)
+}
+
+// slotStats counts the storage slot proofs requested by the clients for each
+// account, the most frequently read ones are hinted along with the account.
+//
+/**
+slotStats:
+server 端按 account 统计 client 请求 proof 的 storage slot 的次数,
+client 请求该 account 的 proof 时, 顺带推送读得最频繁的几个 slot (state access hint)
+*/
+type slotStats struct {
+	lock     sync.Mutex
+	accounts *lru.Cache // account hash -> map[common.Hash]uint64
+}
+
+func newSlotStats() *slotStats {
+	accounts, _ := lru.New(maxHintAccounts)
+	return &slotStats{accounts: accounts}
+}
+
+// record counts a read of the given storage slots of the account.
+func (s *slotStats) record(accKey common.Hash, keys [][]byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var counts map[common.Hash]uint64
+	if cached, ok := s.accounts.Get(accKey); ok {
+		counts = cached.(map[common.Hash]uint64)
+	} else {
+		counts = make(map[common.Hash]uint64)
+		s.accounts.Add(accKey, counts)
+	}
+	for _, key := range keys {
+		slot := common.BytesToHash(key)
+		if _, ok := counts[slot]; !ok && len(counts) >= maxTrackedHintSlots {
+			// Make room by evicting the least read slot
+			var (
+				least common.Hash
+				min   uint64
+				first = true
+			)
+			for k, c := range counts {
+				if first || c < min || (c == min && bytes.Compare(k[:], least[:]) < 0) {
+					least, min, first = k, c, false
+				}
+			}
+			delete(counts, least)
+		}
+		counts[slot]++
+	}
+}
+
+// top returns the at most limit most frequently read storage slots of the account.
+func (s *slotStats) top(accKey common.Hash, limit int) []common.Hash {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cached, ok := s.accounts.Peek(accKey)
+	if !ok {
+		return nil
+	}
+	counts := cached.(map[common.Hash]uint64)
+	slots := make([]common.Hash, 0, len(counts))
+	for slot := range counts {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if ci, cj := counts[slots[i]], counts[slots[j]]; ci != cj {
+			return ci > cj
+		}
+		return bytes.Compare(slots[i][:], slots[j][:]) < 0
+	})
+	if len(slots) > limit {
+		slots = slots[:limit]
+	}
+	return slots
+}
+
+// stateHintLoop prefetches the storage slots hinted by the servers into the
+// local database of the client, so the ODR reads of them are served locally.
+func (pm *ProtocolManager) stateHintLoop() {
+	defer pm.wg.Done()
+
+	for {
+		select {
+		case hint := <-pm.stateHintCh:
+			pm.prefetchStateHint(hint)
+		case <-pm.quitSync:
+			return
+		}
+	}
+}
+
+// queueStateHints schedules the received hints for prefetching, hints beyond
+// the capacity of the queue are dropped.
+func (pm *ProtocolManager) queueStateHints(hints []stateHint) {
+	for _, hint := range hints {
+		select {
+		case pm.stateHintCh <- hint:
+		default:
+			return
+		}
+	}
+}
+
+// prefetchStateHint retrieves the hinted storage slots of an account which are
+// not available locally yet.
+func (pm *ProtocolManager) prefetchStateHint(hint stateHint) {
+	db := pm.odr.Database()
+	number := rawdb.ReadHeaderNumber(db, hint.BHash)
+	if number == nil {
+		return
+	}
+	header := rawdb.ReadHeader(db, hint.BHash, *number)
+	if header == nil {
+		return
+	}
+	// The hint follows the account proof, which might not have been stored yet
+	var (
+		tdb     = trie.NewDatabase(db)
+		account *state.Account
+	)
+	for i := 0; ; i++ {
+		var err error
+		if account, err = localAccount(tdb, header.Root, hint.AccKey); err == nil {
+			break
+		}
+		if i+1 == stateHintRetries {
+			return
+		}
+		select {
+		case <-time.After(stateHintRetryDelay):
+		case <-pm.quitSync:
+			return
+		}
+	}
+	if account == nil || account.Root == types.EmptyRootHash {
+		return
+	}
+	storage, _ := trie.New(account.Root, tdb)
+	id := light.StorageTrieID(light.StateTrieID(header), hint.AccKey, account.Root)
+	for _, key := range hint.Keys {
+		if storage != nil {
+			if _, err := storage.TryGet(key[:]); err == nil {
+				continue // available locally
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), stateHintTimeout)
+		err := pm.odr.Retrieve(ctx, &light.TrieRequest{Id: id, Key: key[:]})
+		cancel()
+		if err != nil {
+			log.Trace("Failed to prefetch hinted storage slot", "account", hint.AccKey, "slot", key, "err", err)
+			return
+		}
+		stateHintPrefetchMeter.Mark(1)
+	}
+}
+
+// localAccount resolves an account from the locally stored state trie nodes. It
+// returns nil if the account does not exist.
+func localAccount(db *trie.Database, root, accKey common.Hash) (*state.Account, error) {
+	tr, err := trie.New(root, db)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := tr.TryGet(accKey[:])
+	if err != nil || enc == nil {
+		return nil, err
+	}
+	account := new(state.Account)
+	if err := rlp.DecodeBytes(enc, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
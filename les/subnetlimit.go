@@ -0,0 +1,142 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+var subnetRejectMeter = metrics.NewRegisteredMeter("les/server/subnet/rejected", nil)
+
+const (
+	// subnetBurstTime is the time worth of requests a subnet may send at once,
+	// after being idle for long enough.
+	subnetBurstTime = 10 * time.Second
+
+	// subnetIPv4Bits and subnetIPv6Bits are the prefix lengths of the subnets
+	// the clients are grouped by. A /24 or a /64 is usually one operator.
+	subnetIPv4Bits = 24
+	subnetIPv6Bits = 64
+
+	// maxTrackedSubnets caps the number of subnet buckets kept in memory, the
+	// full (idle) ones are dropped above it.
+	maxTrackedSubnets = 4096
+)
+
+// subnetLimiter throttles the requests of the clients by IP subnet, on top of
+// the per-peer flow control. Every subnet has a token bucket refilled at the
+// configured rate, so an operator connecting many client keys from one host (or
+// a few neighbouring ones) gets the same request rate as a single client would.
+//
+/**
+subnetLimiter:
+	在 每个 peer 的 flow control 之外, 按 client 的 IP 子网 (IPv4 /24, IPv6 /64) 限制 req 速率 (令牌桶),
+	避免 同一运营者 用 大量 client key 从同一 主机 连接 耗尽 server 的处理能力
+ */
+type subnetLimiter struct {
+	rate  float64 // requests per second allowed for a subnet
+	burst float64 // capacity of the buckets
+	clock mclock.Clock
+
+	lock    sync.Mutex
+	buckets map[string]*subnetBucket
+}
+
+// subnetBucket is the request token bucket of a subnet.
+type subnetBucket struct {
+	tokens  float64
+	updated mclock.AbsTime
+}
+
+// newSubnetLimiter creates a limiter allowing the given number of requests per
+// second for each subnet, or returns nil (no limit) if the rate is zero.
+func newSubnetLimiter(rate uint64, clock mclock.Clock) *subnetLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &subnetLimiter{
+		rate:    float64(rate),
+		burst:   float64(rate) * subnetBurstTime.Seconds(),
+		clock:   clock,
+		buckets: make(map[string]*subnetBucket),
+	}
+}
+
+// subnetOf returns the subnet key of a client address, empty if the address is
+// not an IP one (e.g. simulated peers).
+func subnetOf(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp.IP == nil {
+		return ""
+	}
+	if ip := tcp.IP.To4(); ip != nil {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(subnetIPv4Bits, 32)), Mask: net.CIDRMask(subnetIPv4Bits, 32)}).String()
+	}
+	return (&net.IPNet{IP: tcp.IP.Mask(net.CIDRMask(subnetIPv6Bits, 128)), Mask: net.CIDRMask(subnetIPv6Bits, 128)}).String()
+}
+
+// allow takes a request token of the subnet. If none is left, it returns false
+// and the time after which the next token is available.
+func (l *subnetLimiter) allow(subnet string) (bool, time.Duration) {
+	if subnet == "" {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.clock.Now()
+	bucket := l.buckets[subnet]
+	if bucket == nil {
+		if len(l.buckets) >= maxTrackedSubnets {
+			l.prune(now)
+		}
+		bucket = &subnetBucket{tokens: l.burst, updated: now}
+		l.buckets[subnet] = bucket
+	} else {
+		l.refill(bucket, now)
+	}
+	if bucket.tokens < 1 {
+		subnetRejectMeter.Mark(1)
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// refill adds the tokens accumulated since the last update of a bucket.
+func (l *subnetLimiter) refill(bucket *subnetBucket, now mclock.AbsTime) {
+	bucket.tokens += time.Duration(now - bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+}
+
+// prune drops the buckets which are full again, those behave the same as new
+// ones. The lock is held by the caller.
+func (l *subnetLimiter) prune(now mclock.AbsTime) {
+	for subnet, bucket := range l.buckets {
+		if l.refill(bucket, now); bucket.tokens >= l.burst {
+			delete(l.buckets, subnet)
+		}
+	}
+}
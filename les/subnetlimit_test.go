@@ -0,0 +1,88 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+)
+
+func TestSubnetOf(t *testing.T) {
+	tests := []struct {
+		addr   net.Addr
+		subnet string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 30303}, "10.1.2.0/24"},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.200"), Port: 1}, "10.1.2.0/24"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6")}, "2001:db8:1:2::/64"},
+		{&net.UnixAddr{Name: "sim", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if subnet := subnetOf(tt.addr); subnet != tt.subnet {
+			t.Errorf("%v: subnet mismatch: have %q, want %q", tt.addr, subnet, tt.subnet)
+		}
+	}
+}
+
+func TestSubnetLimiter(t *testing.T) {
+	if newSubnetLimiter(0, nil) != nil {
+		t.Fatalf("limiter created with zero rate")
+	}
+	clock := &mclock.Simulated{}
+	limiter := newSubnetLimiter(10, clock)
+
+	// A subnet may burst up to its bucket, then it is throttled
+	burst := int(10 * subnetBurstTime / time.Second)
+	for i := 0; i < burst; i++ {
+		if ok, _ := limiter.allow("10.0.0.0/24"); !ok {
+			t.Fatalf("request %d rejected within burst", i)
+		}
+	}
+	ok, retry := limiter.allow("10.0.0.0/24")
+	if ok {
+		t.Fatalf("request allowed above burst")
+	}
+	if retry <= 0 || retry > 100*time.Millisecond {
+		t.Errorf("retry time mismatch: have %v, want (0, 100ms]", retry)
+	}
+	// Other subnets and unknown addresses are not affected
+	if ok, _ := limiter.allow("10.0.1.0/24"); !ok {
+		t.Errorf("request of other subnet rejected")
+	}
+	if ok, _ := limiter.allow(""); !ok {
+		t.Errorf("request of exempt client rejected")
+	}
+	// The bucket refills at the configured rate
+	clock.Run(time.Second)
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.allow("10.0.0.0/24"); !ok {
+			t.Fatalf("request %d rejected after refill", i)
+		}
+	}
+	if ok, _ := limiter.allow("10.0.0.0/24"); ok {
+		t.Fatalf("request allowed above refilled tokens")
+	}
+	// Idle subnets are dropped when too many are tracked
+	clock.Run(subnetBurstTime)
+	limiter.prune(clock.Now())
+	if len(limiter.buckets) != 0 {
+		t.Errorf("idle buckets kept: %d", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+)
+
+// maxTxSubscriptions is the number of transactions a single client can watch
+// at the same time.
+const maxTxSubscriptions = 1024
+
+// txStatusUpdate is a transaction status change pushed to a subscribed client.
+type txStatusUpdate struct {
+	Hash   common.Hash
+	Status txStatus
+}
+
+// subscribeTxStatus starts watching the given transactions on behalf of the peer.
+// Only transactions waiting in the pool are watched, the status of the others
+// is final and has already been returned in the reply.
+func (p *peer) subscribeTxStatus(hashes []common.Hash, stats []txStatus) {
+	p.txSubLock.Lock()
+	defer p.txSubLock.Unlock()
+
+	for i, hash := range hashes {
+		switch stats[i].Status {
+		case core.TxStatusPending, core.TxStatusQueued:
+			if _, ok := p.txSubs[hash]; !ok && len(p.txSubs) >= maxTxSubscriptions {
+				continue
+			}
+			p.txSubs[hash] = stats[i].Status
+		default:
+			delete(p.txSubs, hash)
+		}
+	}
+}
+
+// txSubscriptions returns the transactions watched on behalf of the peer.
+func (p *peer) txSubscriptions() []common.Hash {
+	p.txSubLock.Lock()
+	defer p.txSubLock.Unlock()
+
+	hashes := make([]common.Hash, 0, len(p.txSubs))
+	for hash := range p.txSubs {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// updateTxSubscriptions compares the current status of the watched transactions
+// with the last one reported to the peer and returns the changes. Included and
+// dropped transactions are not watched any more.
+func (p *peer) updateTxSubscriptions(hashes []common.Hash, stats []txStatus) []txStatusUpdate {
+	p.txSubLock.Lock()
+	defer p.txSubLock.Unlock()
+
+	var updates []txStatusUpdate
+	for i, hash := range hashes {
+		last, ok := p.txSubs[hash]
+		if !ok || last == stats[i].Status {
+			continue
+		}
+		updates = append(updates, txStatusUpdate{Hash: hash, Status: stats[i]})
+		if stats[i].Status == core.TxStatusPending || stats[i].Status == core.TxStatusQueued {
+			p.txSubs[hash] = stats[i].Status
+		} else {
+			delete(p.txSubs, hash)
+		}
+	}
+	return updates
+}
+
+// SendTxStatusUpdates pushes status changes of the subscribed transactions.
+func (p *peer) SendTxStatusUpdates(updates []txStatusUpdate) error {
+	return p2p.Send(p.rw, TxStatusUpdateMsg, updates)
+}
+
+// txStatusLoop checks the transactions watched by the clients after every new
+// chain head and pushes the status changes (inclusion or drop) to them.
+//
+/**
+txStatusLoop:
+每当有新的 chain head 时, 检查 client 订阅的 tx 的状态, 并把变化 (被打包 或 被丢弃) 主动推送给 client,
+client 无需再轮询 GetTxStatusMsg
+ */
+func (pm *ProtocolManager) txStatusLoop() {
+	headCh := make(chan core.ChainHeadEvent, 10)
+	headSub := pm.blockchain.SubscribeChainHeadEvent(headCh)
+	defer headSub.Unsubscribe()
+	defer pm.wg.Done()
+
+	for {
+		select {
+		case <-headCh:
+			for _, p := range pm.peers.AllPeers() {
+				if !p.txStatusPush {
+					continue
+				}
+				hashes := p.txSubscriptions()
+				if len(hashes) == 0 {
+					continue
+				}
+				if updates := p.updateTxSubscriptions(hashes, pm.txStatus(hashes)); len(updates) > 0 {
+					pp := p
+					pp.queueSend(func() {
+						if err := pp.SendTxStatusUpdates(updates); err != nil {
+							pp.Log().Debug("Failed to push transaction status", "err", err)
+						}
+					})
+				}
+			}
+		case <-pm.quitSync:
+			return
+		}
+	}
+}
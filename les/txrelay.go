@@ -17,9 +17,13 @@
 package les
 
 import (
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 )
 
@@ -45,15 +49,45 @@ type LesTxRelay struct {
 
 	// 请求分发器的指针
 	reqDist *requestDistributor
+
+	// 正在进行中的 tx status 订阅 (reqID => 请求)
+	statusReqs map[uint64]*txStatusReq // outstanding transaction status subscriptions by request ID
+
+	// server 告知的 sender pending nonce 的处理函数 (light txpool)
+	adviseNonce func(from common.Address, nonce uint64) // handler of the pending nonces reported by the servers
+
+	// 各 server 告知的 sender pending nonce, 只有足够多的 server 一致时才交给处理函数
+	advices map[common.Address]map[*peer]uint64 // pending nonces of the senders reported by each server
+}
+
+const (
+	// nonceAdviceQuorum is the number of servers that have to report at least
+	// the same pending nonce of a sender before it is passed to the nonce handler.
+	// A single server can't push a wrong nonce into the client.
+	nonceAdviceQuorum = 2
+
+	// maxAdvisedSenders is the maximum number of senders whose nonce advices are
+	// collected, further advices are ignored until the servers disconnect.
+	maxAdvisedSenders = 1024
+)
+
+// txStatusReq is a TxStatusSubscribe request asking a server to push the status
+// changes of the transactions sent to it.
+type txStatusReq struct {
+	peer   *peer
+	hashes []common.Hash
+	sent   mclock.AbsTime
 }
 
 func NewLesTxRelay(ps *peerSet, reqDist *requestDistributor) *LesTxRelay {
 	r := &LesTxRelay{
 		//
 		txSent:    make(map[common.Hash]*ltrInfo),
-		txPending: make(map[common.Hash]struct{}),
-		ps:        ps,
-		reqDist:   reqDist,
+		txPending:  make(map[common.Hash]struct{}),
+		ps:         ps,
+		reqDist:    reqDist,
+		statusReqs: make(map[uint64]*txStatusReq),
+		advices:    make(map[common.Address]map[*peer]uint64),
 	}
 	ps.notify(r)
 	return r
@@ -71,6 +105,17 @@ func (self *LesTxRelay) unregisterPeer(p *peer) {
 	defer self.lock.Unlock()
 
 	self.peerList = self.ps.AllPeers()
+	for reqID, req := range self.statusReqs {
+		if req.peer == p {
+			delete(self.statusReqs, reqID)
+		}
+	}
+	for from, advices := range self.advices {
+		delete(advices, p)
+		if len(advices) == 0 {
+			delete(self.advices, from)
+		}
+	}
 }
 
 // send sends a list of transactions to at most a given number of peers at
@@ -81,6 +126,7 @@ send:
 一次将 tx 列表最多发送给给定数量的 peer，而从未两次将任何特定 tx 重新发送给同一 peer
  */
 func (self *LesTxRelay) send(txs types.Transactions, count int) {
+	self.expireStatusReqs(mclock.Now())
 	sendTo := make(map[*peer]types.Transactions)
 
 	self.peerStartPos++ // rotate the starting position of the peer list
@@ -128,11 +174,32 @@ func (self *LesTxRelay) send(txs types.Transactions, count int) {
 		pp := p
 		ll := list
 
+		// Servers supporting it are asked to push the status changes of the sent
+		// transactions, so the dropped ones can be sent again
+		//
+		// 支持 txStatusPush 的 server, 在发送 tx 的同时订阅它们的 status 变化, 被丢弃的 tx 会被重新广播
+		var (
+			subID  uint64
+			hashes []common.Hash
+		)
+		if pp.supports(TxStatusSubscribeMsg) {
+			subID = genReqID()
+			hashes = make([]common.Hash, len(ll))
+			for i, tx := range ll {
+				hashes[i] = tx.Hash()
+			}
+			self.statusReqs[subID] = &txStatusReq{peer: pp, hashes: hashes, sent: mclock.Now()}
+		}
+
 		reqID := genReqID()
 		rq := &distReq{
 			getCost: func(dp distPeer) uint64 {
 				peer := dp.(*peer)
-				return peer.GetRequestCost(SendTxMsg, len(ll))
+				cost := peer.GetRequestCost(SendTxMsg, len(ll))
+				if hashes != nil {
+					cost += peer.GetRequestCost(TxStatusSubscribeMsg, len(hashes))
+				}
+				return cost
 			},
 			canSend: func(dp distPeer) bool {
 				return dp.(*peer) == pp
@@ -142,14 +209,36 @@ func (self *LesTxRelay) send(txs types.Transactions, count int) {
 				cost := peer.GetRequestCost(SendTxMsg, len(ll))
 				peer.fcServer.QueueRequest(reqID, cost)
 
+				var subCost uint64
+				if hashes != nil {
+					subCost = peer.GetRequestCost(TxStatusSubscribeMsg, len(hashes))
+					peer.fcServer.QueueRequest(subID, subCost)
+				}
+
 				// todo 发送一个 txs req
-				return func() { peer.SendTxs(reqID, cost, ll) }
+				return func() {
+					peer.SendTxs(reqID, cost, ll)
+					if hashes != nil {
+						peer.SubscribeTxStatus(subID, subCost, hashes)
+					}
+				}
 			},
 		}
 		self.reqDist.queue(rq)
 	}
 }
 
+// expireStatusReqs forgets the status subscriptions not answered within the hard
+// request timeout, their replies have been lost or were never sent. The lock is
+// held by the caller.
+func (self *LesTxRelay) expireStatusReqs(now mclock.AbsTime) {
+	for reqID, req := range self.statusReqs {
+		if time.Duration(now-req.sent) > hardRequestTimeout {
+			delete(self.statusReqs, reqID)
+		}
+	}
+}
+
 func (self *LesTxRelay) Send(txs types.Transactions) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -162,12 +251,19 @@ func (self *LesTxRelay) NewHead(head common.Hash, mined []common.Hash, rollback
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
+	self.expireStatusReqs(mclock.Now())
 	for _, hash := range mined {
 		delete(self.txPending, hash)
 	}
 
 	for _, hash := range rollback {
 		self.txPending[hash] = struct{}{}
+
+		// The servers may have dropped the transaction when it got included,
+		// so it needs to be broadcast again
+		if ltr, ok := self.txSent[hash]; ok {
+			ltr.sentTo = make(map[*peer]struct{})
+		}
 	}
 
 	if len(self.txPending) > 0 {
@@ -183,6 +279,127 @@ func (self *LesTxRelay) NewHead(head common.Hash, mined []common.Hash, rollback
 	}
 }
 
+// deliverStatus processes the answer of a server to a status subscription, sending
+// the transactions unknown to the server again.
+func (self *LesTxRelay) deliverStatus(p *peer, reqID uint64, stats []txStatus) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	req, ok := self.statusReqs[reqID]
+	if !ok || req.peer != p {
+		return
+	}
+	delete(self.statusReqs, reqID)
+
+	var resend types.Transactions
+	for i, hash := range req.hashes {
+		if i >= len(stats) {
+			break
+		}
+		if _, ok := self.txPending[hash]; !ok {
+			continue
+		}
+		if ltr := self.txSent[hash]; stats[i].Status == core.TxStatusUnknown {
+			// 该 server 已丢弃此 tx, 需要重新发送
+			delete(ltr.sentTo, p)
+			resend = append(resend, ltr.tx)
+		}
+	}
+	if len(resend) > 0 {
+		p.Log().Debug("Re-sending dropped transactions", "count", len(resend))
+		self.send(resend, 1)
+	}
+}
+
+// statusUpdate processes the status changes pushed by a server, sending the
+// transactions dropped by it again.
+func (self *LesTxRelay) statusUpdate(p *peer, updates []txStatusUpdate) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var resend types.Transactions
+	for _, update := range updates {
+		if _, ok := self.txPending[update.Hash]; !ok {
+			continue
+		}
+		ltr := self.txSent[update.Hash]
+		if _, ok := ltr.sentTo[p]; ok && update.Status.Status == core.TxStatusUnknown {
+			delete(ltr.sentTo, p)
+			resend = append(resend, ltr.tx)
+		}
+	}
+	if len(resend) > 0 {
+		p.Log().Debug("Re-sending dropped transactions", "count", len(resend))
+		self.send(resend, 1)
+	}
+}
+
+// setNonceHandler sets the function processing the pending nonces of the senders
+// reported by the servers along with the transaction statuses.
+func (self *LesTxRelay) setNonceHandler(handler func(from common.Address, nonce uint64)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.adviseNonce = handler
+}
+
+// deliverNonces records the pending nonces reported by a server and passes the
+// ones agreed on by enough servers to the nonce handler, so the nonce gaps can be
+// resolved without reading the account states. The advices are not proven, the
+// nonce passed on is the highest one reported by at least nonceAdviceQuorum
+// servers.
+func (self *LesTxRelay) deliverNonces(p *peer, nonces []txNonceAdvice) {
+	if len(nonces) == 0 {
+		return
+	}
+	type agreed struct {
+		from  common.Address
+		nonce uint64
+	}
+	var pass []agreed
+
+	self.lock.Lock()
+	handler := self.adviseNonce
+	for _, advice := range nonces {
+		p.Log().Debug("Received nonce advice", "from", advice.Sender, "nonce", advice.Nonce)
+
+		advices := self.advices[advice.Sender]
+		if advices == nil {
+			if len(self.advices) >= maxAdvisedSenders {
+				continue
+			}
+			advices = make(map[*peer]uint64)
+			self.advices[advice.Sender] = advices
+		}
+		advices[p] = advice.Nonce
+		if nonce, ok := agreedNonce(advices); ok {
+			pass = append(pass, agreed{advice.Sender, nonce})
+		}
+	}
+	self.lock.Unlock()
+
+	if handler == nil {
+		return
+	}
+	for _, a := range pass {
+		handler(a.from, a.nonce)
+	}
+}
+
+// agreedNonce returns the highest nonce reported by at least nonceAdviceQuorum
+// of the given servers.
+func agreedNonce(advices map[*peer]uint64) (uint64, bool) {
+	if len(advices) < nonceAdviceQuorum {
+		return 0, false
+	}
+	nonces := make([]uint64, 0, len(advices))
+	for _, nonce := range advices {
+		nonces = append(nonces, nonce)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] > nonces[j] })
+	return nonces[nonceAdviceQuorum-1], true
+}
+
 func (self *LesTxRelay) Discard(hashes []common.Hash) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -0,0 +1,88 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/mclock"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// Tests that status subscriptions without an answer are forgotten.
+func TestStatusReqExpiry(t *testing.T) {
+	relay := NewLesTxRelay(newPeerSet(), nil)
+	relay.statusReqs[1] = &txStatusReq{sent: 0}
+	relay.statusReqs[2] = &txStatusReq{sent: mclock.AbsTime(hardRequestTimeout)}
+
+	relay.expireStatusReqs(mclock.AbsTime(hardRequestTimeout) + 1)
+	if _, ok := relay.statusReqs[1]; ok {
+		t.Errorf("timed out status subscription kept")
+	}
+	if _, ok := relay.statusReqs[2]; !ok {
+		t.Errorf("recent status subscription dropped")
+	}
+}
+
+// Tests that the nonce advices of the servers are only passed on when enough
+// servers agree, and that the advices of disconnected servers are forgotten.
+func TestNonceAdviceQuorum(t *testing.T) {
+	relay := NewLesTxRelay(newPeerSet(), nil)
+
+	advised := make(map[common.Address]uint64)
+	relay.setNonceHandler(func(from common.Address, nonce uint64) {
+		advised[from] = nonce
+	})
+	var peers []*peer
+	for i := 0; i < 3; i++ {
+		peers = append(peers, newPeer(lpv2, NetworkId, p2p.NewPeer(discover.NodeID{byte(i + 1)}, "test", nil), nil))
+	}
+	var (
+		sender = common.Address{1}
+		other  = common.Address{2}
+	)
+	// A single server can't push a nonce into the pool
+	relay.deliverNonces(peers[0], []txNonceAdvice{{Sender: sender, Nonce: 100}, {Sender: other, Nonce: 3}})
+	if len(advised) != 0 {
+		t.Fatalf("nonce advised by a single server: %v", advised)
+	}
+	// The highest nonce reported by enough servers is passed on
+	relay.deliverNonces(peers[1], []txNonceAdvice{{Sender: sender, Nonce: 5}})
+	if nonce, ok := advised[sender]; !ok || nonce != 5 {
+		t.Fatalf("agreed nonce mismatch: have %d (%v), want 5", nonce, ok)
+	}
+	relay.deliverNonces(peers[2], []txNonceAdvice{{Sender: sender, Nonce: 7}})
+	if nonce := advised[sender]; nonce != 7 {
+		t.Fatalf("agreed nonce mismatch: have %d, want 7", nonce)
+	}
+	if _, ok := advised[other]; ok {
+		t.Fatalf("nonce of other sender advised by a single server")
+	}
+	// Disconnected servers don't count any more
+	relay.unregisterPeer(peers[0])
+	relay.unregisterPeer(peers[2])
+	if _, ok := relay.advices[other]; ok {
+		t.Errorf("advices of disconnected servers kept")
+	}
+	delete(advised, sender)
+	relay.deliverNonces(peers[1], []txNonceAdvice{{Sender: sender, Nonce: 9}})
+	if len(advised) != 0 {
+		t.Errorf("nonce advised by a single remaining server: %v", advised)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// errInvalidULCFraction is returned if the agreeing fraction of the ultra-light
+// servers isn't a percentage.
+var errInvalidULCFraction = errors.New("ultra-light server fraction must be between 1 and 100")
+
+// ulc is the configuration of the ultra-light client mode: the head announced
+// by the given fraction of a fixed set of servers is accepted without validating
+// the header chain, and the other servers are only used for retrievals and send
+// no announcements at all.
+//
+/**
+ulc: 超轻节点 (ultra-light client) 模式
+只信任 固定的一组 server 的 announce, 当其中 不少于 fraction% 的 server 宣布了同一个 head 时,
+才去拉取该 head, 且 不校验 header chain (不做 seal 校验)
+其余 server 在握手时 要求 announceTypeNone, 只用于 ODR 检索
+ */
+type ulc struct {
+	servers  map[discover.NodeID]struct{} // servers whose announcements are counted
+	fraction int                          // percentage of the servers agreeing on a head to accept it
+}
+
+// newULC parses the enode URLs of the announcing servers.
+func newULC(servers []string, fraction int) (*ulc, error) {
+	if fraction <= 0 || fraction > 100 {
+		return nil, errInvalidULCFraction
+	}
+	u := &ulc{
+		servers:  make(map[discover.NodeID]struct{}),
+		fraction: fraction,
+	}
+	for _, url := range servers {
+		node, err := discover.ParseNode(url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ultra-light server %q: %v", url, err)
+		}
+		u.servers[node.ID] = struct{}{}
+	}
+	return u, nil
+}
+
+// trusted returns whether the announcements of the server are counted.
+func (u *ulc) trusted(id discover.NodeID) bool {
+	_, ok := u.servers[id]
+	return ok
+}
+
+// agreed returns whether enough of the servers voted for a head, out of all
+// the configured ones, connected or not.
+func (u *ulc) agreed(votes int) bool {
+	return votes*100 >= u.fraction*len(u.servers)
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// Tests that the ultra-light server list and fraction are validated.
+func TestULCConfig(t *testing.T) {
+	if _, err := newULC(nil, 0); err != errInvalidULCFraction {
+		t.Errorf("zero fraction: error mismatch: have %v, want %v", err, errInvalidULCFraction)
+	}
+	if _, err := newULC(nil, 101); err != errInvalidULCFraction {
+		t.Errorf("fraction above 100: error mismatch: have %v, want %v", err, errInvalidULCFraction)
+	}
+	if _, err := newULC([]string{"enode://invalid"}, 50); err == nil {
+		t.Errorf("invalid server URL accepted")
+	}
+}
+
+// Tests that a head is only fetched in ultra-light mode after enough of the
+// voting servers announced it, regardless of the other servers.
+func TestULCVoting(t *testing.T) {
+	var (
+		ids     []discover.NodeID
+		servers []string
+	)
+	for i := byte(1); i <= 5; i++ {
+		var id discover.NodeID
+		id[0] = i
+		ids = append(ids, id)
+		if i <= 4 {
+			servers = append(servers, fmt.Sprintf("enode://%x@127.0.0.1:30303", id[:]))
+		}
+	}
+	u, err := newULC(servers, 75)
+	if err != nil {
+		t.Fatalf("failed to create ultra-light config: %v", err)
+	}
+	f := &lightFetcher{
+		pm:    &ProtocolManager{ulc: u},
+		peers: make(map[*peer]*fetcherPeerInfo),
+	}
+	head := common.Hash{0xff}
+	announce := func(id discover.NodeID) {
+		p := newPeer(lpv2, NetworkId, p2p.NewPeer(id, "test", nil), nil)
+		f.peers[p] = &fetcherPeerInfo{nodeByHash: map[common.Hash]*fetcherTreeNode{head: {hash: head}}}
+	}
+	// The untrusted server doesn't count, neither do two of the four voters
+	announce(ids[4])
+	announce(ids[0])
+	announce(ids[1])
+	if f.ulcAgreed(head) {
+		t.Fatalf("head accepted with 2 of 4 votes")
+	}
+	announce(ids[2])
+	if !f.ulcAgreed(head) {
+		t.Fatalf("head rejected with 3 of 4 votes")
+	}
+	if f.ulcAgreed(common.Hash{0xee}) {
+		t.Fatalf("unannounced head accepted")
+	}
+	// Without ultra-light mode every head is fetched
+	f.pm.ulc = nil
+	if !f.ulcAgreed(common.Hash{0xee}) {
+		t.Fatalf("head rejected without ultra-light mode")
+	}
+}
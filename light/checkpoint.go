@@ -0,0 +1,69 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+)
+
+// ErrInvalidCheckpoint is returned if a checkpoint is missing one of its roots.
+var ErrInvalidCheckpoint = errors.New("invalid trusted checkpoint")
+
+// checkpointLock protects the trustedCheckpoints registry.
+var checkpointLock sync.RWMutex
+
+// RegisterTrustedCheckpoint adds (or replaces) the hardcoded checkpoint of the
+// chain with the given genesis hash. Light chains created afterwards start syncing
+// from the registered checkpoint unless they are configured with an explicit one.
+//
+// RegisterTrustedCheckpoint: 注册 (或替换) 某条链 (以 genesis hash 区分) 的 checkpoint
+func RegisterTrustedCheckpoint(genesis common.Hash, cp TrustedCheckpoint) error {
+	if err := cp.validate(); err != nil {
+		return err
+	}
+	checkpointLock.Lock()
+	defer checkpointLock.Unlock()
+
+	trustedCheckpoints[genesis] = cp
+	return nil
+}
+
+// KnownTrustedCheckpoint returns the registered checkpoint of the chain with the
+// given genesis hash.
+func KnownTrustedCheckpoint(genesis common.Hash) (TrustedCheckpoint, bool) {
+	checkpointLock.RLock()
+	defer checkpointLock.RUnlock()
+
+	cp, ok := trustedCheckpoints[genesis]
+	return cp, ok
+}
+
+// HeadNumber returns the number of the last block covered by the checkpoint.
+func (cp *TrustedCheckpoint) HeadNumber() uint64 {
+	return (cp.SectionIdx+1)*CHTFrequencyClient - 1
+}
+
+// validate checks that all fields of the checkpoint are filled in.
+func (cp *TrustedCheckpoint) validate() error {
+	if cp.SectionHead == (common.Hash{}) || cp.CHTRoot == (common.Hash{}) || cp.BloomRoot == (common.Hash{}) {
+		return ErrInvalidCheckpoint
+	}
+	return nil
+}
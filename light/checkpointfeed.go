@@ -0,0 +1,217 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common/hexutil"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+)
+
+const (
+	// checkpointFeedInterval is the time between two polls of a checkpoint feed.
+	checkpointFeedInterval = time.Hour
+
+	// checkpointFeedTimeout limits the download time of a checkpoint feed.
+	checkpointFeedTimeout = 30 * time.Second
+
+	// maxCheckpointFeedSize limits the size of a checkpoint feed document.
+	maxCheckpointFeedSize = 64 * 1024
+)
+
+var (
+	errCheckpointSigner  = errors.New("checkpoint not signed by a trusted signer")
+	errCheckpointChain   = errors.New("checkpoint of another chain")
+	errCheckpointOutdate = errors.New("checkpoint not newer than the active one")
+)
+
+// SignedCheckpoint is a trusted checkpoint signed by an operator, the document
+// served by a checkpoint feed.
+//
+// SignedCheckpoint: 运营者签名的 checkpoint, 即 checkpoint feed (文件或 URL) 的内容
+type SignedCheckpoint struct {
+	Genesis    common.Hash       `json:"genesis"`
+	Checkpoint TrustedCheckpoint `json:"checkpoint"`
+	Signature  hexutil.Bytes     `json:"signature"`
+}
+
+// SigHash returns the hash signed by the operator.
+func (s *SignedCheckpoint) SigHash() common.Hash {
+	enc, _ := rlp.EncodeToBytes([]interface{}{
+		s.Genesis,
+		s.Checkpoint.SectionIdx,
+		s.Checkpoint.SectionHead,
+		s.Checkpoint.CHTRoot,
+		s.Checkpoint.BloomRoot,
+	})
+	return crypto.Keccak256Hash(enc)
+}
+
+// Sign signs the checkpoint with the key of the operator.
+func (s *SignedCheckpoint) Sign(key *ecdsa.PrivateKey) error {
+	sig, err := crypto.Sign(s.SigHash().Bytes(), key)
+	if err != nil {
+		return err
+	}
+	s.Signature = sig
+	return nil
+}
+
+// Signer recovers the address of the operator who signed the checkpoint.
+func (s *SignedCheckpoint) Signer() (common.Address, error) {
+	pub, err := crypto.SigToPub(s.SigHash().Bytes(), s.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// checkpointTarget is the chain the checkpoints of a feed are applied to.
+type checkpointTarget interface {
+	Genesis() *types.Block
+	Checkpoint() *TrustedCheckpoint
+	SetCheckpoint(cp TrustedCheckpoint) error
+}
+
+// CheckpointFeed keeps the trusted checkpoint of a long running light chain
+// fresh by polling a file or URL serving signed checkpoints. A checkpoint is
+// applied if it is signed by one of the trusted signers, belongs to the chain
+// and is newer than the active one.
+//
+// CheckpointFeed: 定期从 文件或 URL 拉取 签名的 checkpoint, 校验签名者, 链 和 section 后 热更新到 light chain,
+// 使长时间运行的 light client 不必升级程序 就能获得新的 checkpoint
+type CheckpointFeed struct {
+	source  string // file path or http(s) URL of the feed
+	signers map[common.Address]bool
+	chain   checkpointTarget
+	client  *http.Client
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewCheckpointFeed creates a checkpoint feed applying the checkpoints of the
+// given source, signed by any of the signers, to the chain.
+func NewCheckpointFeed(source string, signers []common.Address, chain *LightChain) *CheckpointFeed {
+	return newCheckpointFeed(source, signers, chain)
+}
+
+func newCheckpointFeed(source string, signers []common.Address, chain checkpointTarget) *CheckpointFeed {
+	feed := &CheckpointFeed{
+		source:  source,
+		signers: make(map[common.Address]bool),
+		chain:   chain,
+		client:  &http.Client{Timeout: checkpointFeedTimeout},
+		quit:    make(chan struct{}),
+	}
+	for _, signer := range signers {
+		feed.signers[signer] = true
+	}
+	return feed
+}
+
+// Start polls the feed in the background, starting right away.
+func (f *CheckpointFeed) Start() {
+	f.wg.Add(1)
+	go f.loop()
+}
+
+// Stop terminates the polling of the feed.
+func (f *CheckpointFeed) Stop() {
+	close(f.quit)
+	f.wg.Wait()
+}
+
+func (f *CheckpointFeed) loop() {
+	defer f.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if err := f.update(); err != nil && err != errCheckpointOutdate {
+				log.Warn("Failed to update trusted checkpoint", "feed", f.source, "err", err)
+			}
+			timer.Reset(checkpointFeedInterval)
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+// update fetches the feed and applies its checkpoint if it is valid and new.
+func (f *CheckpointFeed) update() error {
+	data, err := f.fetch()
+	if err != nil {
+		return err
+	}
+	var signed SignedCheckpoint
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return err
+	}
+	signer, err := signed.Signer()
+	if err != nil {
+		return err
+	}
+	if !f.signers[signer] {
+		return errCheckpointSigner
+	}
+	if signed.Genesis != f.chain.Genesis().Hash() {
+		return errCheckpointChain
+	}
+	if cp := f.chain.Checkpoint(); cp != nil && signed.Checkpoint.SectionIdx <= cp.SectionIdx {
+		return errCheckpointOutdate
+	}
+	signed.Checkpoint.name = "feed"
+	if err := f.chain.SetCheckpoint(signed.Checkpoint); err != nil {
+		return err
+	}
+	log.Info("Updated trusted checkpoint from feed", "feed", f.source, "section", signed.Checkpoint.SectionIdx, "signer", signer)
+	return nil
+}
+
+// fetch reads the feed document.
+func (f *CheckpointFeed) fetch() ([]byte, error) {
+	if !strings.HasPrefix(f.source, "http://") && !strings.HasPrefix(f.source, "https://") {
+		return ioutil.ReadFile(f.source)
+	}
+	resp, err := f.client.Get(f.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckpointFeedSize))
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+)
+
+// testCheckpointTarget is a chain accepting the checkpoints of a feed.
+type testCheckpointTarget struct {
+	genesis *types.Block
+	active  *TrustedCheckpoint
+}
+
+func (t *testCheckpointTarget) Genesis() *types.Block          { return t.genesis }
+func (t *testCheckpointTarget) Checkpoint() *TrustedCheckpoint { return t.active }
+func (t *testCheckpointTarget) SetCheckpoint(cp TrustedCheckpoint) error {
+	if err := cp.validate(); err != nil {
+		return err
+	}
+	t.active = &cp
+	return nil
+}
+
+// signedCheckpoint creates the feed document of a checkpoint of the given section.
+func signedCheckpoint(genesis common.Hash, section uint64, key *ecdsa.PrivateKey) []byte {
+	signed := &SignedCheckpoint{
+		Genesis: genesis,
+		Checkpoint: TrustedCheckpoint{
+			SectionIdx:  section,
+			SectionHead: common.Hash{1},
+			CHTRoot:     common.Hash{2},
+			BloomRoot:   common.Hash{3},
+		},
+	}
+	signed.Sign(key)
+	data, _ := json.Marshal(signed)
+	return data
+}
+
+func TestCheckpointFeedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpointfeed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	operator, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	genesis := types.NewBlockWithHeader(&types.Header{Extra: []byte("test genesis")})
+
+	target := &testCheckpointTarget{genesis: genesis, active: &TrustedCheckpoint{SectionIdx: 10}}
+	path := filepath.Join(dir, "checkpoint.json")
+	feed := newCheckpointFeed(path, []common.Address{crypto.PubkeyToAddress(operator.PublicKey)}, target)
+
+	tests := []struct {
+		doc     []byte
+		err     error
+		section uint64
+	}{
+		{signedCheckpoint(genesis.Hash(), 11, other), errCheckpointSigner, 10},
+		{signedCheckpoint(common.Hash{0xff}, 11, operator), errCheckpointChain, 10},
+		{signedCheckpoint(genesis.Hash(), 10, operator), errCheckpointOutdate, 10},
+		{signedCheckpoint(genesis.Hash(), 11, operator), nil, 11},
+		{signedCheckpoint(genesis.Hash(), 9, operator), errCheckpointOutdate, 11},
+	}
+	for i, tt := range tests {
+		if err := ioutil.WriteFile(path, tt.doc, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := feed.update(); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if section := target.active.SectionIdx; section != tt.section {
+			t.Errorf("test %d: active section mismatch: have %d, want %d", i, section, tt.section)
+		}
+	}
+}
+
+func TestCheckpointFeedURL(t *testing.T) {
+	operator, _ := crypto.GenerateKey()
+	genesis := types.NewBlockWithHeader(&types.Header{Extra: []byte("test genesis")})
+	doc := signedCheckpoint(genesis.Hash(), 5, operator)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(doc)
+	}))
+	defer server.Close()
+
+	target := &testCheckpointTarget{genesis: genesis}
+	feed := newCheckpointFeed(server.URL, []common.Address{crypto.PubkeyToAddress(operator.PublicKey)}, target)
+	if err := feed.update(); err != nil {
+		t.Fatalf("failed to update from URL: %v", err)
+	}
+	if target.active == nil || target.active.SectionIdx != 5 {
+		t.Fatalf("checkpoint not applied: %v", target.active)
+	}
+}
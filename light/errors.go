@@ -0,0 +1,76 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import "fmt"
+
+// RequestError describes a failed network retrieval along with the context of
+// the last attempt: the peer the request was sent to, the message code, the id
+// and the flow control cost of the request. Callers can tell the reasons of the
+// failure apart by the cause returned by ErrorCause.
+//
+// RequestError: 网络检索失败时返回, 带有最后一次尝试的 peer, msgcode, reqID, cost 及失败原因
+type RequestError struct {
+	Peer    string // id of the peer the request was last sent to, empty if it wasn't sent
+	MsgCode uint64 // message code of the last request sent
+	ReqID   uint64 // id of the last request sent
+	Cost    uint64 // flow control cost of the last request sent
+	Err     error  // cause of the failure
+}
+
+func (e *RequestError) Error() string {
+	if e.Peer == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (peer %s, msgcode %#x, reqID %d, cost %d)", e.Err, e.Peer, e.MsgCode, e.ReqID, e.Cost)
+}
+
+// ErrorCode returns the JSON-RPC error code of the failure, distinguishing the
+// causes for the API callers.
+func (e *RequestError) ErrorCode() int {
+	switch e.Err {
+	case ErrNoPeers:
+		return -32010
+	case ErrInvalidResponse:
+		return -32011
+	case ErrRequestTimeout:
+		return -32012
+	}
+	return -32000
+}
+
+// ErrorData returns the context of the failed request for the API callers.
+func (e *RequestError) ErrorData() interface{} {
+	if e.Peer == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"peer":    e.Peer,
+		"msgCode": e.MsgCode,
+		"reqID":   e.ReqID,
+		"cost":    e.Cost,
+	}
+}
+
+// ErrorCause returns the cause of a failed retrieval, or the error itself if it
+// isn't a RequestError.
+func ErrorCause(err error) error {
+	if rerr, ok := err.(*RequestError); ok {
+		return rerr.Err
+	}
+	return err
+}
@@ -19,6 +19,7 @@ package light
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math/big"
 	"sync"
 	"sync/atomic"
@@ -55,6 +56,7 @@ type LightChain struct {
 	chainHeadFeed event.Feed
 	scope         event.SubscriptionScope
 	genesisBlock  *types.Block
+	checkpoint    *TrustedCheckpoint // Active trusted checkpoint, nil if none
 
 	mu      sync.RWMutex
 	chainmu sync.RWMutex
@@ -63,8 +65,14 @@ type LightChain struct {
 	bodyRLPCache *lru.Cache // Cache for the most recent block bodies in RLP encoded format
 	blockCache   *lru.Cache // Cache for the most recent entire blocks
 
+	bodyStats    *cacheStats // Hits and misses of the body cache
+	bodyRLPStats *cacheStats // Hits and misses of the RLP body cache
+	blockStats   *cacheStats // Hits and misses of the block cache
+
 	quit    chan struct{}
 	running int32 // running must be called automically
+	// disableCheckFreq must be atomically called
+	disableCheckFreq int32 // skip the seal verification of inserted headers (ultra-light mode)
 	// procInterrupt must be atomically called
 	procInterrupt int32 // interrupt signaler for block processing
 	wg            sync.WaitGroup
@@ -75,7 +83,10 @@ type LightChain struct {
 // NewLightChain returns a fully initialised light chain using information
 // available in the database. It initialises the default Ethereum header
 // validator.
-func NewLightChain(odr OdrBackend, config *params.ChainConfig, engine consensus.Engine) (*LightChain, error) {
+//
+// If checkpoint is nil, the hardcoded checkpoint registered for the genesis
+// block of the chain (if any) is used.
+func NewLightChain(odr OdrBackend, config *params.ChainConfig, engine consensus.Engine, checkpoint *TrustedCheckpoint) (*LightChain, error) {
 	bodyCache, _ := lru.New(bodyCacheLimit)
 	bodyRLPCache, _ := lru.New(bodyCacheLimit)
 	blockCache, _ := lru.New(blockCacheLimit)
@@ -87,6 +98,9 @@ func NewLightChain(odr OdrBackend, config *params.ChainConfig, engine consensus.
 		bodyCache:    bodyCache,
 		bodyRLPCache: bodyRLPCache,
 		blockCache:   blockCache,
+		bodyStats:    new(cacheStats),
+		bodyRLPStats: new(cacheStats),
+		blockStats:   new(cacheStats),
 		engine:       engine,
 	}
 	var err error
@@ -98,7 +112,14 @@ func NewLightChain(odr OdrBackend, config *params.ChainConfig, engine consensus.
 	if bc.genesisBlock == nil {
 		return nil, core.ErrNoGenesis
 	}
-	if cp, ok := trustedCheckpoints[bc.genesisBlock.Hash()]; ok {
+	if checkpoint != nil {
+		if err := checkpoint.validate(); err != nil {
+			return nil, err
+		}
+	} else if cp, ok := KnownTrustedCheckpoint(bc.genesisBlock.Hash()); ok {
+		checkpoint = &cp
+	}
+	if checkpoint != nil {
 
 		/**
 		todo ##########################
@@ -118,7 +139,7 @@ func NewLightChain(odr OdrBackend, config *params.ChainConfig, engine consensus.
 		todo ##########################
 
 		*/
-		bc.addTrustedCheckpoint(cp)
+		bc.addTrustedCheckpoint(*checkpoint)
 	}
 	if err := bc.loadLastState(); err != nil {
 		return nil, err
@@ -176,7 +197,36 @@ func (self *LightChain) addTrustedCheckpoint(cp TrustedCheckpoint) {
 		// 设置数据库中当前有效 sections 的数量
 		self.odr.BloomIndexer().AddKnownSectionHead(cp.SectionIdx, cp.SectionHead)
 	}
-	log.Info("Added trusted checkpoint", "chain", cp.name, "block", (cp.SectionIdx+1)*CHTFrequencyClient-1, "hash", cp.SectionHead)
+	self.mu.Lock()
+	self.checkpoint = &cp
+	self.mu.Unlock()
+
+	log.Info("Added trusted checkpoint", "chain", cp.name, "block", cp.HeadNumber(), "hash", cp.SectionHead)
+}
+
+// Checkpoint returns the trusted checkpoint the chain was synced from, or nil
+// if there is none.
+func (self *LightChain) Checkpoint() *TrustedCheckpoint {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	if self.checkpoint == nil {
+		return nil
+	}
+	cp := *self.checkpoint
+	return &cp
+}
+
+// SetCheckpoint overrides the active trusted checkpoint. The next sync skips
+// the header download up to the head of the new checkpoint.
+//
+// SetCheckpoint: 覆盖当前的 checkpoint, 下一次同步时 会直接跳到 checkpoint 的 head
+func (self *LightChain) SetCheckpoint(cp TrustedCheckpoint) error {
+	if err := cp.validate(); err != nil {
+		return err
+	}
+	self.addTrustedCheckpoint(cp)
+	return nil
 }
 
 func (self *LightChain) getProcInterrupt() bool {
@@ -266,9 +316,11 @@ func (bc *LightChain) State() (*state.StateDB, error) {
 func (self *LightChain) GetBody(ctx context.Context, hash common.Hash) (*types.Body, error) {
 	// Short circuit if the body's already in the cache, retrieve otherwise
 	if cached, ok := self.bodyCache.Get(hash); ok {
+		self.bodyStats.hit()
 		body := cached.(*types.Body)
 		return body, nil
 	}
+	self.bodyStats.miss()
 	number := self.hc.GetBlockNumber(hash)
 	if number == nil {
 		return nil, errors.New("unknown block")
@@ -287,8 +339,10 @@ func (self *LightChain) GetBody(ctx context.Context, hash common.Hash) (*types.B
 func (self *LightChain) GetBodyRLP(ctx context.Context, hash common.Hash) (rlp.RawValue, error) {
 	// Short circuit if the body's already in the cache, retrieve otherwise
 	if cached, ok := self.bodyRLPCache.Get(hash); ok {
+		self.bodyRLPStats.hit()
 		return cached.(rlp.RawValue), nil
 	}
+	self.bodyRLPStats.miss()
 	number := self.hc.GetBlockNumber(hash)
 	if number == nil {
 		return nil, errors.New("unknown block")
@@ -314,8 +368,10 @@ func (bc *LightChain) HasBlock(hash common.Hash, number uint64) bool {
 func (self *LightChain) GetBlock(ctx context.Context, hash common.Hash, number uint64) (*types.Block, error) {
 	// Short circuit if the block's already in the cache, retrieve otherwise
 	if block, ok := self.blockCache.Get(hash); ok {
+		self.blockStats.hit()
 		return block.(*types.Block), nil
 	}
+	self.blockStats.miss()
 	block, err := GetBlock(ctx, self.odr, hash, number)
 	if err != nil {
 		return nil, err
@@ -389,6 +445,12 @@ func (self *LightChain) postChainEvents(events []interface{}) {
 	}
 }
 
+// DisableCheckFreq turns off the seal verification of the inserted headers, the
+// ultra-light client trusts the heads agreed on by its servers instead.
+func (self *LightChain) DisableCheckFreq() {
+	atomic.StoreInt32(&self.disableCheckFreq, 1)
+}
+
 // InsertHeaderChain attempts to insert the given header chain in to the local
 // chain, possibly creating a reorg. If an error is returned, it will return the
 // index number of the failing header as well an error describing what went wrong.
@@ -402,6 +464,9 @@ func (self *LightChain) postChainEvents(events []interface{}) {
 // chain events when necessary.
 func (self *LightChain) InsertHeaderChain(chain []*types.Header, checkFreq int) (int, error) {
 	start := time.Now()
+	if atomic.LoadInt32(&self.disableCheckFreq) == 1 {
+		checkFreq = 0
+	}
 	// 校验 lightchain 的所有header
 	if i, err := self.hc.ValidateHeaderChain(chain, checkFreq); err != nil {
 		return i, err
@@ -513,6 +578,52 @@ func (self *LightChain) GetHeaderByNumberOdr(ctx context.Context, number uint64)
 	return GetHeaderByNumber(ctx, self.odr, number)
 }
 
+// HeaderVerifyMode is the strategy of verifying the headers of a range retrieved
+// by GetHeaderRangeOdr.
+type HeaderVerifyMode int
+
+const (
+	// HeaderVerifyAnchored only proves the last header of the range (by the CHT
+	// if not known locally), the others by their hash chain linking to it.
+	HeaderVerifyAnchored HeaderVerifyMode = iota
+
+	// HeaderVerifySeal additionally verifies the seal (e.g. the PoW) of every
+	// header of the range.
+	HeaderVerifySeal
+)
+
+func (m HeaderVerifyMode) String() string {
+	switch m {
+	case HeaderVerifyAnchored:
+		return "anchored"
+	case HeaderVerifySeal:
+		return "seal"
+	default:
+		return fmt.Sprintf("HeaderVerifyMode(%d)", int(m))
+	}
+}
+
+// GetHeaderRangeOdr retrieves count canonical headers from start on from the
+// database or network, verified according to the given mode. Anchoring on the
+// CHT saves checking the seal of every header, which makes up most of the CPU
+// time of fetching long historical ranges.
+//
+// 批量拉取历史 header: 默认 只证明 区间的最后一个 header (CHT 锚点) + 校验 hash 链, 不逐个校验 PoW
+func (self *LightChain) GetHeaderRangeOdr(ctx context.Context, start, count uint64, mode HeaderVerifyMode) ([]*types.Header, error) {
+	headers, err := GetHeaderRange(ctx, self.odr, start, count)
+	if err != nil {
+		return nil, err
+	}
+	if mode == HeaderVerifySeal {
+		for _, header := range headers {
+			if err := self.engine.VerifySeal(self.hc, header); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return headers, nil
+}
+
 // Config retrieves the header chain's chain configuration.
 func (self *LightChain) Config() *params.ChainConfig { return self.hc.Config() }
 
@@ -584,3 +695,30 @@ func (self *LightChain) SubscribeLogsEvent(ch chan<- []*types.Log) event.Subscri
 func (self *LightChain) SubscribeRemovedLogsEvent(ch chan<- core.RemovedLogsEvent) event.Subscription {
 	return self.scope.Track(new(event.Feed).Subscribe(ch))
 }
+
+// cacheStats counts the hits and misses of a cache of the ODR retrieved data.
+type cacheStats struct {
+	hits, misses uint64
+}
+
+func (s *cacheStats) hit()  { atomic.AddUint64(&s.hits, 1) }
+func (s *cacheStats) miss() { atomic.AddUint64(&s.misses, 1) }
+
+// rate returns the fraction of the lookups served from the cache.
+func (s *cacheStats) rate() float64 {
+	hits, misses := atomic.LoadUint64(&s.hits), atomic.LoadUint64(&s.misses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// CacheHitRates returns the fraction of the lookups of the block data served
+// from the memory caches instead of the database or ODR, keyed by cache.
+func (self *LightChain) CacheHitRates() map[string]float64 {
+	return map[string]float64{
+		"body":    self.bodyStats.rate(),
+		"bodyRLP": self.bodyRLPStats.rate(),
+		"block":   self.blockStats.rate(),
+	}
+}
@@ -55,7 +55,7 @@ func newCanonical(n int) (ethdb.Database, *LightChain, error) {
 	db := ethdb.NewMemDatabase()
 	gspec := core.Genesis{Config: params.TestChainConfig}
 	genesis := gspec.MustCommit(db)
-	blockchain, _ := NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFaker())
+	blockchain, _ := NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFaker(), nil)
 
 	// Create and inject the requested chain
 	if n == 0 {
@@ -75,7 +75,7 @@ func newTestLightChain() *LightChain {
 		Config:     params.TestChainConfig,
 	}
 	gspec.MustCommit(db)
-	lc, err := NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFullFaker())
+	lc, err := NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFullFaker(), nil)
 	if err != nil {
 		panic(err)
 	}
@@ -276,6 +276,10 @@ func (odr *dummyOdr) Retrieve(ctx context.Context, req OdrRequest) error {
 	return nil
 }
 
+func (odr *dummyOdr) ChtIndexer() *core.ChainIndexer       { return nil }
+func (odr *dummyOdr) BloomTrieIndexer() *core.ChainIndexer { return nil }
+func (odr *dummyOdr) BloomIndexer() *core.ChainIndexer     { return nil }
+
 // Tests that reorganizing a long difficult chain after a short easy one
 // overwrites the canonical numbers and links in the database.
 func TestReorgLongHeaders(t *testing.T) {
@@ -339,7 +343,7 @@ func TestReorgBadHeaderHashes(t *testing.T) {
 	defer func() { delete(core.BadHashes, headers[3].Hash()) }()
 
 	// Create a new LightChain and check that it rolled back the state.
-	ncm, err := NewLightChain(&dummyOdr{db: bc.chainDb}, params.TestChainConfig, ethash.NewFaker())
+	ncm, err := NewLightChain(&dummyOdr{db: bc.chainDb}, params.TestChainConfig, ethash.NewFaker(), nil)
 	if err != nil {
 		t.Fatalf("failed to create new chain manager: %v", err)
 	}
@@ -347,3 +351,77 @@ func TestReorgBadHeaderHashes(t *testing.T) {
 		t.Errorf("last header hash mismatch: have: %x, want %x", ncm.CurrentHeader().Hash(), headers[2].Hash())
 	}
 }
+
+// Tests that light chains pick up the registered checkpoint of their network
+// unless configured with an explicit one, and that invalid checkpoints are
+// rejected.
+func TestTrustedCheckpoint(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	gspec := core.Genesis{Config: params.TestChainConfig}
+	genesis := gspec.MustCommit(db)
+
+	lc, err := NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFaker(), nil)
+	if err != nil {
+		t.Fatalf("failed to create light chain: %v", err)
+	}
+	if cp := lc.Checkpoint(); cp != nil {
+		t.Fatalf("unexpected checkpoint: %v", cp)
+	}
+	registered := TrustedCheckpoint{SectionIdx: 1, SectionHead: common.Hash{1}, CHTRoot: common.Hash{2}, BloomRoot: common.Hash{3}}
+	if err := RegisterTrustedCheckpoint(genesis.Hash(), registered); err != nil {
+		t.Fatalf("failed to register checkpoint: %v", err)
+	}
+	defer func() {
+		checkpointLock.Lock()
+		delete(trustedCheckpoints, genesis.Hash())
+		checkpointLock.Unlock()
+	}()
+	if lc, _ = NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFaker(), nil); lc.Checkpoint() == nil || *lc.Checkpoint() != registered {
+		t.Fatalf("registered checkpoint mismatch: have %v, want %v", lc.Checkpoint(), registered)
+	}
+	explicit := TrustedCheckpoint{SectionIdx: 2, SectionHead: common.Hash{4}, CHTRoot: common.Hash{5}, BloomRoot: common.Hash{6}}
+	if lc, _ = NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFaker(), &explicit); lc.Checkpoint() == nil || *lc.Checkpoint() != explicit {
+		t.Fatalf("explicit checkpoint mismatch: have %v, want %v", lc.Checkpoint(), explicit)
+	}
+	if _, err := NewLightChain(&dummyOdr{db: db}, gspec.Config, ethash.NewFaker(), &TrustedCheckpoint{SectionIdx: 3}); err != ErrInvalidCheckpoint {
+		t.Fatalf("invalid checkpoint error mismatch: have %v, want %v", err, ErrInvalidCheckpoint)
+	}
+	if err := lc.SetCheckpoint(registered); err != nil {
+		t.Fatalf("failed to override checkpoint: %v", err)
+	}
+	if *lc.Checkpoint() != registered {
+		t.Fatalf("overridden checkpoint mismatch: have %v, want %v", lc.Checkpoint(), registered)
+	}
+}
+
+// Tests that the hit rates of the block data caches are tracked.
+func TestCacheHitRates(t *testing.T) {
+	_, bc, err := newCanonical(0)
+	if err != nil {
+		t.Fatalf("failed to create light chain: %v", err)
+	}
+	genesis := bc.Genesis()
+
+	// Start from empty caches, the chain setup already looked up the genesis
+	bc.blockCache.Purge()
+	bc.bodyCache.Purge()
+	bc.blockStats, bc.bodyStats = new(cacheStats), new(cacheStats)
+
+	if rates := bc.CacheHitRates(); rates["block"] != 0 || rates["body"] != 0 {
+		t.Fatalf("unexpected hit rates without lookups: %v", rates)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := bc.GetBlock(context.Background(), genesis.Hash(), 0); err != nil {
+			t.Fatalf("failed to retrieve block: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := bc.GetBody(context.Background(), genesis.Hash()); err != nil {
+			t.Fatalf("failed to retrieve body: %v", err)
+		}
+	}
+	rates := bc.CacheHitRates()
+	if rates["block"] != 0.75 || rates["body"] != 0.5 || rates["bodyRLP"] != 0 {
+		t.Fatalf("hit rates mismatch: %v", rates)
+	}
+}
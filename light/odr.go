@@ -42,8 +42,33 @@ import (
 // NoOdr是不需要ODR服务时传递给支持ODR的功能的默认上下文
 var NoOdr = context.Background()
 
-// ErrNoPeers is returned if no peers capable of serving a queued request are available
-var ErrNoPeers = errors.New("no suitable peers available")
+// originKey is the context key of the origin label of the requests. The RPC
+// server sets it to the Origin header of the HTTP calls.
+const originKey = "origin"
+
+// WithOrigin returns a context labelling the ODR requests made with it as
+// originating from the given dapp, for the per origin accounting of the backend.
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originKey, origin)
+}
+
+// RequestOrigin returns the origin label of the context, empty if unlabelled.
+func RequestOrigin(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey).(string)
+	return origin
+}
+
+var (
+	// ErrNoPeers is returned if no peers capable of serving a queued request are available
+	ErrNoPeers = errors.New("no suitable peers available")
+
+	// ErrInvalidResponse is returned if the peers asked only delivered replies
+	// failing the validation of a request (e.g. invalid merkle proofs)
+	ErrInvalidResponse = errors.New("invalid response")
+
+	// ErrRequestTimeout is returned if the peers asked didn't answer a request in time
+	ErrRequestTimeout = errors.New("request timed out")
+)
 
 // OdrBackend is an interface to a backend service that handles ODR retrievals type
 //
@@ -56,6 +81,19 @@ type OdrBackend interface {
 	Retrieve(ctx context.Context, req OdrRequest) error
 }
 
+// PagedOdrBackend is an ODR backend able to split a bulk retrieval into pages
+// served by several servers at once.
+type PagedOdrBackend interface {
+	OdrBackend
+
+	// RetrievePaged retrieves a query of total items in pages. The page function
+	// creates the request of the items [start, start+amount); it is called with
+	// a zero amount first to tell the request type, then once for every page
+	// before any of them is sent. The pages failing to be retrieved are left
+	// unfilled and the first error is returned.
+	RetrievePaged(ctx context.Context, total int, page func(start, amount int) OdrRequest) error
+}
+
 // OdrRequest is an interface for retrieval requests
 type OdrRequest interface {
 	StoreResult(db ethdb.Database)
@@ -119,6 +157,57 @@ func (req *CodeRequest) StoreResult(db ethdb.Database) {
 	db.Put(req.Hash[:], req.Data)
 }
 
+// MaxCodesPerRequest is the number of contract codes retrieved at most by a
+// single CodesRequest, the limit of the serving peers.
+const MaxCodesPerRequest = 64
+
+// CodesRequest is the ODR request type for retrieving the codes of several
+// contracts in one round trip
+//
+// 一次 ODR 往返批量拉取多个合约的 code, 每个 code 对应一个 account 的 TrieID
+type CodesRequest struct {
+	OdrRequest
+	Ids    []*TrieID     // reference the storage tries of the accounts
+	Hashes []common.Hash // hashes of the requested codes
+	Data   [][]byte      // retrieved codes in the order of the hashes, possibly only a prefix
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *CodesRequest) StoreResult(db ethdb.Database) {
+	for i, data := range req.Data {
+		db.Put(req.Hashes[i][:], data)
+	}
+}
+
+// MaxHeadersPerRequest is the number of headers retrieved at most by a single
+// HeadersRequest, the limit of the serving peers not counting the origin.
+const MaxHeadersPerRequest = 191
+
+// HeadersRequest is the ODR request type for retrieving the ancestors of a known
+// canonical header. The headers are only checked for linking to the origin, it
+// is the caller's job to make sure the origin is trusted (e.g. proven by a CHT).
+//
+/**
+HeadersRequest: 拉取 一个已知的 规范 header (Origin) 之前的 Amount 个祖先 header
+	只校验 hash 链 (每个 header 的 hash 等于 后一个的 ParentHash), 不校验 PoW;
+	Origin 本身 必须是可信的 (例如 由 CHT proof 证明过), 这一点由 调用方 保证
+ */
+type HeadersRequest struct {
+	OdrRequest
+	Origin  common.Hash     // hash of the trusted header the range ends below
+	Number  uint64          // number of the origin header
+	Amount  uint64          // number of ancestors to retrieve
+	Headers []*types.Header // retrieved ancestors, from the parent of the origin downwards
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *HeadersRequest) StoreResult(db ethdb.Database) {
+	for _, header := range req.Headers {
+		rawdb.WriteHeader(db, header)
+		rawdb.WriteCanonicalHash(db, header.Hash(), header.Number.Uint64())
+	}
+}
+
 // BlockRequest is the ODR request type for retrieving block bodies
 type BlockRequest struct {
 	OdrRequest
@@ -240,3 +329,32 @@ func (req *BloomRequest) StoreResult(db ethdb.Database) {
 		rawdb.WriteBloomBits(db, req.BitIdx, sectionIdx, sectionHead, req.BloomBits[i])
 	}
 }
+
+// MaxHelperTrieProofsPerRequest is the number of helper trie entries retrieved
+// at most by a single HelperTrieBatchRequest, the limit of the serving peers.
+const MaxHelperTrieProofsPerRequest = 64
+
+// HelperTrieBatchRequest is the ODR request type for retrieving CHT entries and
+// bloom bits in one round trip. The proofs of the entries share a single node
+// set, so the trie nodes common to several of them are only sent once.
+//
+/**
+HelperTrieBatchRequest: 一次往返中 同时拉取多个 CHT 条目 和 bloom bits (可以混合两种 helper trie)
+	server 把所有的 proof 合并成一个 NodeSet 返回, 多个 proof 共用的 trie node 只发送一次;
+	各个 子请求 的 Header/Td/BloomBits 等结果 和 单独请求时 一样回填, Proof 都指向 同一个 NodeSet
+ */
+type HelperTrieBatchRequest struct {
+	OdrRequest
+	Chts   []*ChtRequest
+	Blooms []*BloomRequest
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *HelperTrieBatchRequest) StoreResult(db ethdb.Database) {
+	for _, r := range req.Chts {
+		r.StoreResult(db)
+	}
+	for _, r := range req.Blooms {
+		r.StoreResult(db)
+	}
+}
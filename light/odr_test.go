@@ -55,8 +55,11 @@ var (
 
 type testOdr struct {
 	OdrBackend
-	sdb, ldb ethdb.Database
-	disable  bool
+	sdb, ldb   ethdb.Database
+	disable    bool
+	headerReqs int
+	codesLimit int // codes delivered at most per CodesRequest, zero for all
+	codesReqs  int
 }
 
 func (odr *testOdr) Database() ethdb.Database {
@@ -87,6 +90,23 @@ func (odr *testOdr) Retrieve(ctx context.Context, req OdrRequest) error {
 		req.Proof = nodes
 	case *CodeRequest:
 		req.Data, _ = odr.sdb.Get(req.Hash[:])
+	case *CodesRequest:
+		odr.codesReqs++
+		req.Data = make([][]byte, len(req.Hashes))
+		for i, hash := range req.Hashes {
+			req.Data[i], _ = odr.sdb.Get(hash[:])
+		}
+		if odr.codesLimit > 0 && len(req.Data) > odr.codesLimit {
+			req.Data = req.Data[:odr.codesLimit]
+		}
+	case *HeadersRequest:
+		odr.headerReqs++
+		header := rawdb.ReadHeader(odr.sdb, req.Origin, req.Number)
+		for header != nil && uint64(len(req.Headers)) < req.Amount {
+			if header = rawdb.ReadHeader(odr.sdb, header.ParentHash, header.Number.Uint64()-1); header != nil {
+				req.Headers = append(req.Headers, header)
+			}
+		}
 	}
 	req.StoreResult(odr.ldb)
 	return nil
@@ -156,6 +176,37 @@ func odrAccounts(ctx context.Context, db ethdb.Database, bc *core.BlockChain, lc
 	return res, st.Error()
 }
 
+func TestOdrContractCodesLes1(t *testing.T) { testChainOdr(t, 1, odrContractCodes) }
+
+func odrContractCodes(ctx context.Context, db ethdb.Database, bc *core.BlockChain, lc *LightChain, bhash common.Hash) ([]byte, error) {
+	var st *state.StateDB
+	if bc == nil {
+		header := lc.GetHeaderByHash(bhash)
+		st = NewState(ctx, header, lc.Odr())
+	} else {
+		header := bc.GetHeaderByHash(bhash)
+		st, _ = state.New(header.Root, state.NewDatabase(db))
+	}
+
+	var addrHashes, codeHashes []common.Hash
+	for _, addr := range []common.Address{testContractAddr, testBankAddress} {
+		if hash := st.GetCodeHash(addr); hash != (common.Hash{}) {
+			addrHashes = append(addrHashes, crypto.Keccak256Hash(addr[:]))
+			codeHashes = append(codeHashes, hash)
+		}
+	}
+	if err := st.Error(); err != nil {
+		return nil, err
+	}
+	codes, err := st.Database().ContractCodes(addrHashes, codeHashes)
+	var res []byte
+	for i, code := range codes {
+		res = append(res, codeHashes[i][:]...)
+		res = append(res, code...)
+	}
+	return res, err
+}
+
 func TestOdrContractCallLes1(t *testing.T) { testChainOdr(t, 1, odrContractCall) }
 
 type callmsg struct {
@@ -259,7 +310,7 @@ func testChainOdr(t *testing.T, protocol int, fn odrTestFn) {
 	}
 
 	odr := &testOdr{sdb: sdb, ldb: ldb}
-	lightchain, err := NewLightChain(odr, params.TestChainConfig, ethash.NewFullFaker())
+	lightchain, err := NewLightChain(odr, params.TestChainConfig, ethash.NewFullFaker(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -310,3 +361,56 @@ func testChainOdr(t *testing.T, protocol int, fn odrTestFn) {
 	odr.disable = true
 	test(len(gchain))
 }
+
+// Tests that a header range is retrieved in batches anchored on its last header,
+// only checking the seals of the headers if requested.
+func TestGetHeaderRange(t *testing.T) {
+	var (
+		sdb     = ethdb.NewMemDatabase()
+		ldb     = ethdb.NewMemDatabase()
+		gspec   = core.Genesis{Alloc: core.GenesisAlloc{testBankAddress: {Balance: testBankFunds}}}
+		genesis = gspec.MustCommit(sdb)
+	)
+	gspec.MustCommit(ldb)
+	blockchain, _ := core.NewBlockChain(sdb, nil, params.TestChainConfig, ethash.NewFullFaker(), vm.Config{})
+	gchain, _ := core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), sdb, 400, nil)
+	if _, err := blockchain.InsertChain(gchain); err != nil {
+		t.Fatal(err)
+	}
+	// Only the head is known to the light client, as if proven by the CHT
+	head := gchain[len(gchain)-1].Header()
+	rawdb.WriteHeader(ldb, head)
+	rawdb.WriteCanonicalHash(ldb, head.Hash(), head.Number.Uint64())
+
+	odr := &testOdr{sdb: sdb, ldb: ldb}
+	lightchain, err := NewLightChain(odr, params.TestChainConfig, ethash.NewFakeFailer(100), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := lightchain.GetHeaderRangeOdr(NoOdr, 1, 400, HeaderVerifyAnchored)
+	if err != nil {
+		t.Fatalf("failed to retrieve header range: %v", err)
+	}
+	for i, header := range headers {
+		if header.Hash() != gchain[i].Hash() {
+			t.Fatalf("header %d mismatch: have %x, want %x", i+1, header.Hash(), gchain[i].Hash())
+		}
+	}
+	if odr.headerReqs != 3 {
+		t.Errorf("header requests mismatch: have %d, want %d", odr.headerReqs, 3)
+	}
+	// The headers are stored, retrieving them again needs no requests
+	if _, err := GetHeaderRange(NoOdr, odr, 50, 100); err != nil {
+		t.Fatalf("failed to read stored header range: %v", err)
+	}
+	if odr.headerReqs != 3 {
+		t.Errorf("header requests after stored range: have %d, want %d", odr.headerReqs, 3)
+	}
+	// Checking the seals catches the header of the failing block
+	if _, err := lightchain.GetHeaderRangeOdr(NoOdr, 1, 400, HeaderVerifySeal); err == nil {
+		t.Errorf("seal verification of the range succeeded with an invalid seal")
+	}
+	if _, err := lightchain.GetHeaderRangeOdr(NoOdr, 101, 50, HeaderVerifySeal); err != nil {
+		t.Errorf("seal verification of a valid range failed: %v", err)
+	}
+}
@@ -95,6 +95,57 @@ func GetHeaderByNumber(ctx context.Context, odr OdrBackend, number uint64) (*typ
 	return r.Header, nil
 }
 
+// GetHeaderRange retrieves count canonical headers from start on. Only the last
+// header is proven, by the CHT if not known locally, the others are trusted for
+// their hash chain linking to it, which makes fetching long historical ranges
+// much cheaper than verifying every header on its own.
+//
+/**
+GetHeaderRange: 拉取 [start, start+count) 区间的 规范 header
+	只有最后一个 header 需要证明 (本地没有时 用 CHT proof 拉取), 作为 锚点;
+	其余 header 从锚点 往回 用 HeadersRequest 批量拉取, 只校验 hash 链的连接关系,
+	本地已有的 header 直接复用
+ */
+func GetHeaderRange(ctx context.Context, odr OdrBackend, start, count uint64) ([]*types.Header, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	end := start + count - 1
+	anchor, err := GetHeaderByNumber(ctx, odr, end)
+	if err != nil {
+		return nil, err
+	}
+	db := odr.Database()
+
+	headers := make([]*types.Header, count)
+	headers[count-1] = anchor
+	for number := end; number > start; {
+		child := headers[number-start]
+		// Take the parent from the database if it's known already
+		if header := rawdb.ReadHeader(db, child.ParentHash, number-1); header != nil {
+			headers[number-1-start] = header
+			number--
+			continue
+		}
+		amount := number - start
+		if amount > MaxHeadersPerRequest {
+			amount = MaxHeadersPerRequest
+		}
+		r := &HeadersRequest{Origin: child.Hash(), Number: number, Amount: amount}
+		if err := odr.Retrieve(ctx, r); err != nil {
+			return nil, err
+		}
+		if uint64(len(r.Headers)) != amount {
+			return nil, ErrInvalidResponse
+		}
+		for i, header := range r.Headers {
+			headers[number-1-start-uint64(i)] = header
+		}
+		number -= amount
+	}
+	return headers, nil
+}
+
 func GetCanonicalHash(ctx context.Context, odr OdrBackend, number uint64) (common.Hash, error) {
 	hash := rawdb.ReadCanonicalHash(odr.Database(), number)
 	if (hash != common.Hash{}) {
@@ -0,0 +1,369 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+var (
+	// odrCacheEntryPrefix is the database key prefix of the entries of the
+	// persisted ODR results, each written in the same batch as its result.
+	odrCacheEntryPrefix = []byte("odrCache-") // odrCacheEntryPrefix + hash -> odrCacheEntry
+
+	// odrCacheClockKey tracks the logical time of the last use of a result.
+	odrCacheClockKey = []byte("odrCacheClock")
+)
+
+// odrCacheEntryKey = odrCacheEntryPrefix + hash
+func odrCacheEntryKey(hash common.Hash) []byte {
+	return append(append([]byte{}, odrCacheEntryPrefix...), hash[:]...)
+}
+
+// Kinds of the persisted ODR results
+const (
+	odrCacheNode = iota // state or storage trie node of a verified proof
+	odrCacheCode        // contract code
+)
+
+// odrCacheEntry is the integrity and usage metadata of a persisted ODR result.
+// The result itself is stored in the database under its hash.
+type odrCacheEntry struct {
+	Hash common.Hash
+	Kind uint8
+	Size uint64 // length of the stored data, checked along with the hash on the first read
+	Used uint64 // logical time of the last retrieval or local read
+
+	verified bool // whether the stored data was checked in this run
+}
+
+// prefixIterator is implemented by the databases able to iterate over the keys
+// with a given prefix.
+type prefixIterator interface {
+	NewIteratorWithPrefix(prefix []byte) iterator.Iterator
+}
+
+// OdrCache keeps track of the verified ODR results persisted in the client
+// database, so that they are reused after a restart instead of being retrieved
+// again. Every result is written together with its entry, so the cache survives
+// crashes. The entries are loaded in the background on startup and the results
+// of a previous run are checked against their hash on their first local read,
+// the corrupted ones are dropped. If the persisted results exceed the byte
+// budget, the least recently used ones are deleted.
+//
+// Only the results the cache stored itself are tracked and evicted, data already
+// present in the database under the same key belongs to someone else. Header and
+// CHT retrievals are not tracked, their results are written into the canonical
+// chain by rawdb and kept anyway.
+//
+/**
+OdrCache: 记录持久化到 client db 中的 (已校验的) ODR 结果 (proof 上的 trie node, 合约 code),
+重启后直接复用, 不必重新从网络拉取.
+每个结果与其 entry 在同一个 batch 中写入 (crash 安全), 启动时在后台加载 entry, 上次运行留下的结果在
+第一次本地读取时才校验 hash 和 长度, 损坏的被丢弃; 超出 字节预算 时 删除 最久未使用的 结果.
+只有 cache 自己写入的 key 才会被淘汰, db 中原本就存在的数据不归 cache 管.
+ */
+type OdrCache struct {
+	db     ethdb.Database
+	budget uint64 // total size of the persisted results in bytes, zero for unlimited
+
+	lock    sync.Mutex
+	entries map[common.Hash]*odrCacheEntry
+	size    uint64
+	clock   uint64                   // logical time, incremented on every use
+	dirty   map[common.Hash]struct{} // entries used since the last flush
+	loaded  bool                     // whether the entries of the previous run are loaded
+
+	loadDone chan struct{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewOdrCache creates an ODR result cache on top of the client database and
+// starts loading the entries persisted by the previous run in the background.
+func NewOdrCache(db ethdb.Database, budget uint64) *OdrCache {
+	c := &OdrCache{
+		db:       db,
+		budget:   budget,
+		entries:  make(map[common.Hash]*odrCacheEntry),
+		dirty:    make(map[common.Hash]struct{}),
+		loadDone: make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	if enc, err := db.Get(odrCacheClockKey); err == nil && len(enc) == 8 {
+		c.clock = binary.BigEndian.Uint64(enc)
+	}
+	c.wg.Add(1)
+	go c.load()
+	return c
+}
+
+// load reads the persisted entries, without touching the results they reference.
+func (c *OdrCache) load() {
+	defer c.wg.Done()
+	defer close(c.loadDone)
+
+	var count, dropped int
+	if it, ok := c.db.(prefixIterator); ok {
+		iter := it.NewIteratorWithPrefix(odrCacheEntryPrefix)
+		for iter.Next() {
+			select {
+			case <-c.quit:
+				iter.Release()
+				return
+			default:
+			}
+			var entry odrCacheEntry
+			if err := rlp.DecodeBytes(iter.Value(), &entry); err != nil || !bytes.Equal(iter.Key(), odrCacheEntryKey(entry.Hash)) {
+				// The result of a corrupted entry is ours, but can't be checked
+				key := common.CopyBytes(iter.Key())
+				c.db.Delete(key[len(odrCacheEntryPrefix):])
+				c.db.Delete(key)
+				dropped++
+				continue
+			}
+			c.lock.Lock()
+			if _, ok := c.entries[entry.Hash]; !ok {
+				c.entries[entry.Hash] = &entry
+				c.size += entry.Size
+			}
+			if entry.Used > c.clock {
+				c.clock = entry.Used
+			}
+			c.lock.Unlock()
+			count++
+		}
+		iter.Release()
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.loaded = true
+	c.trim()
+	log.Info("Loaded persisted ODR results", "count", count, "size", common.StorageSize(c.size), "dropped", dropped)
+}
+
+// odrResult is a single result of a retrieval.
+type odrResult struct {
+	hash common.Hash
+	kind uint8
+	data []byte
+}
+
+// Add stores the results of a successful retrieval along with their entries.
+// It must be called before the request stores its results, so that the ones
+// already present in the database are recognised as not owned by the cache.
+func (c *OdrCache) Add(req OdrRequest) {
+	var results []odrResult
+	switch r := req.(type) {
+	case *TrieRequest:
+		if r.Proof == nil {
+			return
+		}
+		for _, node := range r.Proof.NodeList() {
+			results = append(results, odrResult{crypto.Keccak256Hash(node), odrCacheNode, node})
+		}
+	case *CodeRequest:
+		results = append(results, odrResult{r.Hash, odrCacheCode, r.Data})
+	case *CodesRequest:
+		for i, data := range r.Data {
+			results = append(results, odrResult{r.Hashes[i], odrCacheCode, data})
+		}
+	default:
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	batch := c.db.NewBatch()
+	var added []*odrCacheEntry
+	for _, res := range results {
+		c.clock++
+		if entry, ok := c.entries[res.hash]; ok {
+			entry.Used = c.clock
+			c.dirty[res.hash] = struct{}{}
+			continue
+		}
+		// Results of the previous run not loaded yet are still ours, anything
+		// else already in the database is not
+		if owned, _ := c.db.Has(odrCacheEntryKey(res.hash)); !owned {
+			if has, _ := c.db.Has(res.hash[:]); has {
+				continue
+			}
+		}
+		entry := &odrCacheEntry{Hash: res.hash, Kind: res.kind, Size: uint64(len(res.data)), Used: c.clock, verified: true}
+		batch.Put(res.hash[:], res.data)
+		writeOdrCacheEntry(batch, entry)
+		added = append(added, entry)
+	}
+	c.writeClock(batch)
+	if err := batch.Write(); err != nil {
+		log.Warn("Failed to persist ODR results", "err", err)
+		return
+	}
+	for _, entry := range added {
+		if _, ok := c.entries[entry.Hash]; !ok {
+			c.entries[entry.Hash] = entry
+			c.size += entry.Size
+		}
+	}
+	c.trim()
+}
+
+// Touch marks a persisted result as used by a local read, protecting it from
+// eviction. A result of a previous run is checked against its entry on its first
+// read; if it's corrupted, it's dropped and false is returned.
+func (c *OdrCache) Touch(hash common.Hash, data []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[hash]
+	if !ok {
+		return true
+	}
+	if !entry.verified {
+		if uint64(len(data)) != entry.Size || crypto.Keccak256Hash(data) != hash {
+			log.Warn("Dropping corrupted ODR result", "hash", hash)
+			batch := c.db.NewBatch()
+			c.drop(batch, entry)
+			if err := batch.Write(); err != nil {
+				log.Warn("Failed to drop ODR result", "err", err)
+			}
+			return false
+		}
+		entry.verified = true
+	}
+	c.clock++
+	entry.Used = c.clock
+	c.dirty[hash] = struct{}{}
+	return true
+}
+
+// drop deletes a result and its entry. The lock is held by the caller.
+func (c *OdrCache) drop(batch ethdb.Batch, entry *odrCacheEntry) {
+	batch.Delete(entry.Hash[:])
+	batch.Delete(odrCacheEntryKey(entry.Hash))
+	delete(c.entries, entry.Hash)
+	delete(c.dirty, entry.Hash)
+	c.size -= entry.Size
+}
+
+// trim deletes the least recently used results until the persisted ones fit in
+// 90% of the budget, leaving room for a number of additions before the next
+// trim. Nothing is deleted before the entries of the previous run are loaded.
+// The lock is held by the caller.
+func (c *OdrCache) trim() {
+	if c.budget == 0 || c.size <= c.budget || !c.loaded {
+		return
+	}
+	entries := make([]*odrCacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Used < entries[j].Used })
+
+	batch := c.db.NewBatch()
+	target := c.budget / 10 * 9
+	for _, entry := range entries {
+		if c.size <= target {
+			break
+		}
+		c.drop(batch, entry)
+	}
+	if err := batch.Write(); err != nil {
+		log.Warn("Failed to evict ODR results", "err", err)
+	}
+}
+
+// Flush saves the usage of the persisted results into the database.
+func (c *OdrCache) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.dirty) == 0 {
+		return nil
+	}
+	batch := c.db.NewBatch()
+	for hash := range c.dirty {
+		if entry, ok := c.entries[hash]; ok {
+			writeOdrCacheEntry(batch, entry)
+		}
+	}
+	c.writeClock(batch)
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	c.dirty = make(map[common.Hash]struct{})
+	return nil
+}
+
+// Close stops loading the entries and saves the usage of the results.
+func (c *OdrCache) Close() error {
+	close(c.quit)
+	c.wg.Wait()
+	return c.Flush()
+}
+
+// Size returns the number and total size of the persisted results known so far.
+func (c *OdrCache) Size() (int, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.entries), c.size
+}
+
+// writeClock stores the logical time. The lock is held by the caller.
+func (c *OdrCache) writeClock(db ethdb.Putter) {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], c.clock)
+	db.Put(odrCacheClockKey, enc[:])
+}
+
+// writeOdrCacheEntry stores the entry of a persisted result.
+func writeOdrCacheEntry(db ethdb.Putter, entry *odrCacheEntry) {
+	enc, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	db.Put(odrCacheEntryKey(entry.Hash), enc)
+}
+
+// CachingOdrBackend is an OdrBackend keeping track of the persisted results, the
+// local reads of the results are reported to its cache.
+type CachingOdrBackend interface {
+	OdrBackend
+	Cache() *OdrCache
+}
+
+// touchCache reports a local read of a persisted result to the cache of the
+// backend, if it has one. It returns false if the result turned out corrupted.
+func touchCache(backend OdrBackend, hash common.Hash, data []byte) bool {
+	if b, ok := backend.(CachingOdrBackend); ok && b.Cache() != nil {
+		return b.Cache().Touch(hash, data)
+	}
+	return true
+}
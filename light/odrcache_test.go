@@ -0,0 +1,122 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package light
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// storeCode stores a contract code the way a code retrieval does and returns the
+// request.
+func storeCode(db ethdb.Database, cache *OdrCache, code []byte) *CodeRequest {
+	req := &CodeRequest{Hash: crypto.Keccak256Hash(code), Data: code}
+	cache.Add(req)
+	req.StoreResult(db)
+	return req
+}
+
+// Tests that the results survive a restart without a flush and are checked on
+// their first read.
+func TestOdrCachePersistence(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	cache := NewOdrCache(db, 0)
+	<-cache.loadDone
+
+	code1 := storeCode(db, cache, []byte{1, 2, 3})
+	code2 := storeCode(db, cache, []byte{4, 5, 6, 7})
+
+	proof := NewNodeSet()
+	node := []byte{0xc2, 0x80, 0x80}
+	proof.Put(crypto.Keccak256(node), node)
+	trieReq := &TrieRequest{Proof: proof}
+	cache.Add(trieReq)
+	trieReq.StoreResult(db)
+
+	if count, size := cache.Size(); count != 3 || size != 10 {
+		t.Fatalf("size mismatch: have %d/%d, want 3/10", count, size)
+	}
+	// Corrupt one of the results and restart without flushing
+	db.Put(code2.Hash[:], []byte{4, 5, 6, 8})
+
+	cache = NewOdrCache(db, 0)
+	<-cache.loadDone
+	if count, size := cache.Size(); count != 3 || size != 10 {
+		t.Fatalf("size mismatch after reload: have %d/%d, want 3/10", count, size)
+	}
+	if !cache.Touch(code1.Hash, code1.Data) {
+		t.Errorf("intact result rejected")
+	}
+	if cache.Touch(code2.Hash, []byte{4, 5, 6, 8}) {
+		t.Errorf("corrupted result accepted")
+	}
+	if has, _ := db.Has(code2.Hash[:]); has {
+		t.Errorf("corrupted result not deleted")
+	}
+	if count, size := cache.Size(); count != 2 || size != 6 {
+		t.Fatalf("size mismatch after check: have %d/%d, want 2/6", count, size)
+	}
+}
+
+func TestOdrCacheEviction(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	cache := NewOdrCache(db, 100)
+	<-cache.loadDone
+
+	var reqs []*CodeRequest
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, storeCode(db, cache, bytes.Repeat([]byte{byte(i)}, 10)))
+	}
+	// Reading the oldest result locally protects it from the eviction
+	cache.Touch(reqs[0].Hash, reqs[0].Data)
+	storeCode(db, cache, bytes.Repeat([]byte{0xff}, 10))
+
+	if _, size := cache.Size(); size > 90 {
+		t.Fatalf("budget exceeded after trim: have %d, want at most 90", size)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		if has, _ := db.Has(reqs[i].Hash[:]); has != want {
+			t.Errorf("result %d: presence mismatch: have %v, want %v", i, has, want)
+		}
+	}
+}
+
+// Tests that data already present in the database is not tracked, and thus
+// never evicted by the cache.
+func TestOdrCacheOwnership(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	foreign := bytes.Repeat([]byte{0xaa}, 60)
+	hash := crypto.Keccak256Hash(foreign)
+	db.Put(hash[:], foreign)
+
+	cache := NewOdrCache(db, 100)
+	<-cache.loadDone
+
+	storeCode(db, cache, foreign)
+	if count, _ := cache.Size(); count != 0 {
+		t.Fatalf("foreign data tracked")
+	}
+	for i := 0; i < 10; i++ {
+		storeCode(db, cache, bytes.Repeat([]byte{byte(i)}, 20))
+	}
+	if data, _ := db.Get(hash[:]); !bytes.Equal(data, foreign) {
+		t.Errorf("foreign data evicted")
+	}
+}
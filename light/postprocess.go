@@ -242,13 +242,13 @@ func (c *ChtIndexerBackend) fetchMissingNodes(ctx context.Context, section uint6
 		todo 构建 发起 检索拉取 证明的 req 并将 result 存储在本地 <里面调用了 StoreResult()>
 		*/
 		err := c.odr.Retrieve(ctx, r)
-		switch err {
-		case nil:
+		switch {
+		case err == nil:
 
 			// todo 并将 proof 写入db
 			r.Proof.Store(batch)
 			return batch.Write()
-		case ErrNoPeers:
+		case retryLater(err):
 			// if there are no peers to serve, retry later
 			select {
 			case <-ctx.Done():
@@ -420,25 +420,33 @@ fetchMissingNodes:
 尝试从ODR后端检索最新的可信任Bloom Trie的最后一个条目，以便能够添加新条目并计算后续的根哈希.
  */
 func (b *BloomTrieIndexerBackend) fetchMissingNodes(ctx context.Context, section uint64, root common.Hash) error {
-	indexCh := make(chan uint, types.BloomBitLength)
+	// The bits are requested in batches sharing a single proof
+	//
+	// 每 MaxHelperTrieProofsPerRequest 个 bit 合成一个 HelperTrieBatchRequest, 共用一个 proof, 减少往返次数
+	const batches = (types.BloomBitLength + MaxHelperTrieProofsPerRequest - 1) / MaxHelperTrieProofsPerRequest
+
+	indexCh := make(chan uint, batches)
 	type res struct {
 		nodes *NodeSet
 		err   error
 	}
-	resCh := make(chan res, types.BloomBitLength)
+	resCh := make(chan res, batches)
 	for i := 0; i < 20; i++ {
 		go func() {
 
-			// 根据 chan中传过来 bit 的索引,构建req
-			for bitIndex := range indexCh {
-				// todo 查看当前 section <section - 1: 表示 section的索引是从0开始的> 中的 各个 bit
-				r := &BloomRequest{BloomTrieRoot: root, BloomTrieNum: section - 1, BitIdx: bitIndex, SectionIdxList: []uint64{section - 1}}
+			// 根据 chan中传过来 的 第一个 bit 的索引,构建 一批 req
+			for first := range indexCh {
+				r := &HelperTrieBatchRequest{}
+				for bitIndex := first; bitIndex < first+MaxHelperTrieProofsPerRequest && bitIndex < types.BloomBitLength; bitIndex++ {
+					// todo 查看当前 section <section - 1: 表示 section的索引是从0开始的> 中的 各个 bit
+					r.Blooms = append(r.Blooms, &BloomRequest{BloomTrieRoot: root, BloomTrieNum: section - 1, BitIdx: bitIndex, SectionIdxList: []uint64{section - 1}})
+				}
 				for {
 
 					/**
 					todo 构建 发起 检索拉取 证明的 req 并将result存储在本地 (里面调用了 StoreResult())
 					 */
-					if err := b.odr.Retrieve(ctx, r); err == ErrNoPeers {
+					if err := b.odr.Retrieve(ctx, r); retryLater(err) {
 						// if there are no peers to serve, retry later
 						select {
 						case <-ctx.Done():
@@ -449,8 +457,12 @@ func (b *BloomTrieIndexerBackend) fetchMissingNodes(ctx context.Context, section
 						}
 					} else {
 
-						// 将 proof 发送 resCh <往下的代码有用>
-						resCh <- res{r.Proofs, err}
+						// 将 proof 发送 resCh <往下的代码有用>, 整批 共用 同一个 NodeSet
+						var nodes *NodeSet
+						if err == nil {
+							nodes = r.Blooms[0].Proofs
+						}
+						resCh <- res{nodes, err}
 						break
 					}
 				}
@@ -458,13 +470,13 @@ func (b *BloomTrieIndexerBackend) fetchMissingNodes(ctx context.Context, section
 		}()
 	}
 
-	// 按照 Bloom 的bit,一个一个的遍历
-	for i := uint(0); i < types.BloomBitLength; i++ {
+	// 按照 Bloom 的bit,一批一批的遍历
+	for i := uint(0); i < types.BloomBitLength; i += MaxHelperTrieProofsPerRequest {
 		indexCh <- i
 	}
 	close(indexCh)
 	batch := b.trieTable.NewBatch()
-	for i := uint(0); i < types.BloomBitLength; i++ {
+	for i := 0; i < batches; i++ {
 		res := <-resCh
 		if res.err != nil {
 			return res.err
@@ -552,3 +564,13 @@ func (b *BloomTrieIndexerBackend) Commit() error {
 
 	return nil
 }
+
+// retryLater tells whether a failed retrieval is worth retrying once other peers
+// may be able to serve it.
+func retryLater(err error) bool {
+	switch ErrorCause(err) {
+	case ErrNoPeers, ErrInvalidResponse, ErrRequestTimeout:
+		return true
+	}
+	return false
+}
@@ -26,16 +26,60 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
 )
 
+// OdrStateBackend is the name of the state database backend retrieving the state
+// from the network on demand. It has to be opened on a store created by
+// NewOdrStore.
+const OdrStateBackend = "odr"
+
+// errNoCodesDelivered is returned if a batch code retrieval made no progress.
+var errNoCodesDelivered = errors.New("no contract codes delivered")
+
+// errNoOdrStore is returned if the ODR state backend is opened on a plain store.
+var errNoOdrStore = errors.New("odr state backend needs a store created by NewOdrStore")
+
+func init() {
+	state.RegisterViewBackend(OdrStateBackend, func(db ethdb.Database, config state.Config) (state.Database, error) {
+		store, ok := db.(*odrStore)
+		if !ok {
+			return nil, errNoOdrStore
+		}
+		return &odrDatabase{store.ctx, store.id, store.odr}, nil
+	})
+}
+
+// odrStore is the local database of an ODR backend along with what the ODR state
+// backend needs to retrieve a state: the context of the retrievals and the state
+// header.
+type odrStore struct {
+	ethdb.Database
+	ctx context.Context
+	id  *TrieID
+	odr OdrBackend
+}
+
+// NewOdrStore creates a store the ODR state backend can be opened on, retrieving
+// the state of the given header.
+func NewOdrStore(ctx context.Context, head *types.Header, odr OdrBackend) ethdb.Database {
+	return &odrStore{odr.Database(), ctx, StateTrieID(head), odr}
+}
+
 func NewState(ctx context.Context, head *types.Header, odr OdrBackend) *state.StateDB {
 	state, _ := state.New(head.Root, NewStateDatabase(ctx, head, odr))
 	return state
 }
 
+// NewStateDatabase opens the ODR state backend retrieving the state of the given
+// header.
 func NewStateDatabase(ctx context.Context, head *types.Header, odr OdrBackend) state.Database {
-	return &odrDatabase{ctx, StateTrieID(head), odr}
+	db, err := state.OpenDatabase(NewOdrStore(ctx, head, odr), state.Config{Backend: OdrStateBackend})
+	if err != nil {
+		panic(err) // the backend is registered at init and accepts the store
+	}
+	return db
 }
 
 type odrDatabase struct {
@@ -70,7 +114,7 @@ func (db *odrDatabase) ContractCode(addrHash, codeHash common.Hash) ([]byte, err
 	if codeHash == sha3_nil {
 		return nil, nil
 	}
-	if code, err := db.backend.Database().Get(codeHash[:]); err == nil {
+	if code, err := db.backend.Database().Get(codeHash[:]); err == nil && touchCache(db.backend, codeHash, code) {
 		return code, nil
 	}
 	id := *db.id
@@ -80,6 +124,91 @@ func (db *odrDatabase) ContractCode(addrHash, codeHash common.Hash) ([]byte, err
 	return req.Data, err
 }
 
+// ContractCodes retrieves the codes of several contracts, the ones not available
+// locally are requested from the network in batches of MaxCodesPerRequest. If the
+// backend supports it, the batches are spread over several servers first.
+func (db *odrDatabase) ContractCodes(addrHashes, codeHashes []common.Hash) ([][]byte, error) {
+	var (
+		codes = make([][]byte, len(codeHashes))
+		keys  [][]byte
+		idxs  []int
+	)
+	for i, codeHash := range codeHashes {
+		if codeHash != sha3_nil {
+			keys = append(keys, codeHash[:])
+			idxs = append(idxs, i)
+		}
+	}
+	local, err := ethdb.GetMany(db.backend.Database(), keys)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ids     []*TrieID
+		hashes  []common.Hash
+		pending []int
+	)
+	for i, index := range idxs {
+		if local[i] != nil && touchCache(db.backend, codeHashes[index], local[i]) {
+			codes[index] = local[i]
+			continue
+		}
+		id := *db.id
+		id.AccKey = addrHashes[index][:]
+		ids = append(ids, &id)
+		hashes = append(hashes, codeHashes[index])
+		pending = append(pending, index)
+	}
+	if paged, ok := db.backend.(PagedOdrBackend); ok && len(pending) > MaxCodesPerRequest {
+		pages := make(map[int]*CodesRequest)
+		err := paged.RetrievePaged(db.ctx, len(pending), func(start, amount int) OdrRequest {
+			req := &CodesRequest{Ids: ids[start : start+amount], Hashes: hashes[start : start+amount]}
+			if amount > 0 {
+				pages[start] = req
+			}
+			return req
+		})
+		if err != nil {
+			log.Debug("Paged code retrieval failed", "err", err)
+		}
+		for start, req := range pages {
+			for i, data := range req.Data {
+				codes[pending[start+i]] = data
+			}
+		}
+		// The codes of the failed pages and the ones cut from short replies are
+		// requested again one batch at a time
+		var left int
+		for i, index := range pending {
+			if codes[index] == nil {
+				ids[left], hashes[left], pending[left] = ids[i], hashes[i], index
+				left++
+			}
+		}
+		ids, hashes, pending = ids[:left], hashes[:left], pending[:left]
+	}
+	for start := 0; start < len(pending); {
+		end := start + MaxCodesPerRequest
+		if end > len(pending) {
+			end = len(pending)
+		}
+		req := &CodesRequest{Ids: ids[start:end], Hashes: hashes[start:end]}
+		if err := db.backend.Retrieve(db.ctx, req); err != nil {
+			return codes, err
+		}
+		if len(req.Data) == 0 {
+			return codes, errNoCodesDelivered
+		}
+		for i, data := range req.Data {
+			codes[pending[start+i]] = data
+		}
+		// Replies cut short by the response limit of the server only deliver a
+		// prefix of the codes, continue with the rest
+		start += len(req.Data)
+	}
+	return codes, nil
+}
+
 func (db *odrDatabase) ContractCodeSize(addrHash, codeHash common.Hash) (int, error) {
 	code, err := db.ContractCode(addrHash, codeHash)
 	return len(code), err
@@ -105,6 +234,15 @@ func (t *odrTrie) TryGet(key []byte) ([]byte, error) {
 	return res, err
 }
 
+func (t *odrTrie) TryGetHashed(key []byte) ([]byte, error) {
+	var res []byte
+	err := t.do(key, func() (err error) {
+		res, err = t.trie.TryGet(key)
+		return err
+	})
+	return res, err
+}
+
 func (t *odrTrie) TryUpdate(key, value []byte) error {
 	key = crypto.Keccak256(key)
 	return t.do(key, func() error {
@@ -145,6 +283,14 @@ func (t *odrTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.Putter) error
 	return errors.New("not implemented, needs client/server interface split")
 }
 
+func (t *odrTrie) ProveMulti(keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error {
+	return errors.New("not implemented, needs client/server interface split")
+}
+
+func (t *odrTrie) ProveRange(start, end []byte, proofDb ethdb.Putter) error {
+	return errors.New("not implemented, needs client/server interface split")
+}
+
 // do tries and retries to execute a function until it returns with no error or
 // an error type other than MissingNodeError
 func (t *odrTrie) do(key []byte, fn func() error) error {
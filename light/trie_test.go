@@ -19,14 +19,19 @@ package light
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/consensus/ethash"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/state"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/types"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/core/vm"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/params"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/trie"
@@ -80,3 +85,105 @@ func diffTries(t1, t2 state.Trie) error {
 	}
 	return nil
 }
+
+// Tests that the codes missing from replies cut short by the serving peer are
+// requested again.
+func TestContractCodesTruncatedReplies(t *testing.T) {
+	odr := &testOdr{sdb: ethdb.NewMemDatabase(), ldb: ethdb.NewMemDatabase(), codesLimit: 2}
+	var addrHashes, codeHashes []common.Hash
+	for i := 0; i < 5; i++ {
+		code := []byte{byte(i), 0xff}
+		addrHashes = append(addrHashes, common.Hash{byte(i)})
+		codeHashes = append(codeHashes, crypto.Keccak256Hash(code))
+		odr.sdb.Put(codeHashes[i][:], code)
+	}
+	db := NewStateDatabase(context.Background(), &types.Header{Number: big.NewInt(0)}, odr)
+	codes, err := db.ContractCodes(addrHashes, codeHashes)
+	if err != nil {
+		t.Fatalf("failed to retrieve codes: %v", err)
+	}
+	for i, code := range codes {
+		if !bytes.Equal(code, []byte{byte(i), 0xff}) {
+			t.Errorf("code %d mismatch: have %x", i, code)
+		}
+	}
+	if odr.codesReqs != 3 {
+		t.Errorf("request count mismatch: have %d, want 3", odr.codesReqs)
+	}
+}
+
+// pagedTestOdr is a test ODR backend retrieving bulk queries in pages of 50 items,
+// failing the second page.
+type pagedTestOdr struct {
+	*testOdr
+	pages int
+}
+
+func (odr *pagedTestOdr) RetrievePaged(ctx context.Context, total int, page func(start, amount int) OdrRequest) error {
+	page(0, 0)
+	var reqs []OdrRequest
+	for start := 0; start < total; start += 50 {
+		amount := 50
+		if total-start < amount {
+			amount = total - start
+		}
+		reqs = append(reqs, page(start, amount))
+	}
+	var err error
+	for i, req := range reqs {
+		odr.pages++
+		if i == 1 {
+			err = errors.New("page failed")
+			continue
+		}
+		odr.Retrieve(ctx, req)
+	}
+	return err
+}
+
+// Tests that the codes are retrieved in pages if the backend supports it, and the
+// ones missing from failed pages are requested again.
+func TestContractCodesPaged(t *testing.T) {
+	odr := &pagedTestOdr{testOdr: &testOdr{sdb: ethdb.NewMemDatabase(), ldb: ethdb.NewMemDatabase()}}
+	var addrHashes, codeHashes []common.Hash
+	for i := 0; i < 150; i++ {
+		code := []byte{byte(i), 0xff}
+		addrHashes = append(addrHashes, common.Hash{byte(i)})
+		codeHashes = append(codeHashes, crypto.Keccak256Hash(code))
+		odr.sdb.Put(codeHashes[i][:], code)
+	}
+	db := NewStateDatabase(context.Background(), &types.Header{Number: big.NewInt(0)}, odr)
+	codes, err := db.ContractCodes(addrHashes, codeHashes)
+	if err != nil {
+		t.Fatalf("failed to retrieve codes: %v", err)
+	}
+	for i, code := range codes {
+		if !bytes.Equal(code, []byte{byte(i), 0xff}) {
+			t.Errorf("code %d mismatch: have %x", i, code)
+		}
+	}
+	if odr.pages != 3 || odr.codesReqs != 3 {
+		t.Errorf("request count mismatch: have %d pages and %d requests, want 3 and 3", odr.pages, odr.codesReqs)
+	}
+}
+
+// Tests that the ODR state backend is registered, opens on ODR stores only and
+// can't hold the state of a blockchain.
+func TestOdrStateBackend(t *testing.T) {
+	odr := &testOdr{sdb: ethdb.NewMemDatabase(), ldb: ethdb.NewMemDatabase()}
+	head := &types.Header{Number: big.NewInt(0)}
+
+	db, err := state.OpenDatabase(NewOdrStore(context.Background(), head, odr), state.Config{Backend: OdrStateBackend})
+	if err != nil {
+		t.Fatalf("failed to open ODR state backend: %v", err)
+	}
+	if _, ok := db.(*odrDatabase); !ok {
+		t.Errorf("ODR backend type mismatch: have %T", db)
+	}
+	if _, err := state.OpenDatabase(odr.ldb, state.Config{Backend: OdrStateBackend}); err != errNoOdrStore {
+		t.Errorf("plain store error mismatch: have %v, want %v", err, errNoOdrStore)
+	}
+	if err := state.CheckChainBackend(OdrStateBackend); err == nil {
+		t.Errorf("ODR backend accepted for a blockchain")
+	}
+}
@@ -19,6 +19,9 @@ package light
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/big"
+	"sort"
 	"sync"
 	"time"
 
@@ -45,9 +48,10 @@ var txPermanent = uint64(500)
 
 // TxPool implements the transaction pool for light clients, which keeps track
 // of the status of locally created transactions, detecting if they are included
-// in a block (mined) or rolled back. There are no queued transactions since we
-// always receive all locally signed transactions in the same order as they are
-// created.
+// in a block (mined) or rolled back. Pending transactions can be replaced by
+// ones with the same nonce paying a higher gas price. Transactions following a
+// nonce gap (which can't be mined before the gap is filled) are reported as
+// queued.
 type TxPool struct {
 	config       *params.ChainConfig
 	signer       types.Signer
@@ -67,6 +71,12 @@ type TxPool struct {
 	mined        map[common.Hash][]*types.Transaction // mined transactions by block hash
 	clearIdx     uint64                               // earliest block nr that can contain mined tx info
 
+	byNonce    map[common.Address]map[uint64]*types.Transaction // pending transactions by sender and nonce
+	stateNonce map[common.Address]uint64                        // account nonces of the senders in the latest state seen
+	advised    map[common.Address]uint64                        // pending nonces of the senders reported by the servers
+	replaced   map[common.Hash]*types.Transaction               // transactions replaced by a higher priced one, may still get mined
+	priceBump  uint64                                           // minimum price bump percentage to replace a pending transaction
+
 	homestead bool
 }
 
@@ -93,6 +103,11 @@ func NewTxPool(config *params.ChainConfig, chain *LightChain, relay TxRelayBacke
 		nonce:       make(map[common.Address]uint64),
 		pending:     make(map[common.Hash]*types.Transaction),
 		mined:       make(map[common.Hash][]*types.Transaction),
+		byNonce:     make(map[common.Address]map[uint64]*types.Transaction),
+		stateNonce:  make(map[common.Address]uint64),
+		advised:     make(map[common.Address]uint64),
+		replaced:    make(map[common.Hash]*types.Transaction),
+		priceBump:   core.DefaultTxPoolConfig.PriceBump,
 		quit:        make(chan bool),
 		chainHeadCh: make(chan core.ChainHeadEvent, chainHeadChanSize),
 		chain:       chain,
@@ -133,6 +148,133 @@ func (pool *TxPool) GetNonce(ctx context.Context, addr common.Address) (uint64,
 	return nonce, nil
 }
 
+// addPending adds a transaction to the pending set.
+func (pool *TxPool) addPending(tx *types.Transaction) {
+	pool.pending[tx.Hash()] = tx
+
+	from, _ := types.Sender(pool.signer, tx)
+	if pool.byNonce[from] == nil {
+		pool.byNonce[from] = make(map[uint64]*types.Transaction)
+	}
+	pool.byNonce[from][tx.Nonce()] = tx
+}
+
+// removePending removes a transaction from the pending set.
+func (pool *TxPool) removePending(tx *types.Transaction) {
+	hash := tx.Hash()
+	delete(pool.pending, hash)
+
+	from, _ := types.Sender(pool.signer, tx)
+	if list := pool.byNonce[from]; list != nil {
+		if cur, ok := list[tx.Nonce()]; ok && cur.Hash() == hash {
+			delete(list, tx.Nonce())
+			if len(list) == 0 {
+				delete(pool.byNonce, from)
+			}
+		}
+	}
+}
+
+// dropReplaced forgets the replaced transactions of the sender with the given
+// nonce, once another transaction with that nonce has been mined.
+func (pool *TxPool) dropReplaced(from common.Address, nonce uint64) {
+	for hash, tx := range pool.replaced {
+		if sender, _ := types.Sender(pool.signer, tx); sender == from && tx.Nonce() == nonce {
+			delete(pool.replaced, hash)
+		}
+	}
+}
+
+// maxNonceGaps is the maximum number of missing nonces reported per sender.
+const maxNonceGaps = 256
+
+// maxReplacedTxs is the maximum number of replaced transactions still watched
+// for getting mined.
+const maxReplacedTxs = 1024
+
+// addReplaced records a replaced transaction which may still get mined. The
+// replaced transactions of nonces already included in the chain are pruned
+// first, then the ones of the lowest nonces, so the set stays bounded.
+func (pool *TxPool) addReplaced(tx *types.Transaction) {
+	if len(pool.replaced) >= maxReplacedTxs {
+		for hash, old := range pool.replaced {
+			if from, _ := types.Sender(pool.signer, old); old.Nonce() < pool.stateNonce[from] {
+				delete(pool.replaced, hash)
+			}
+		}
+	}
+	for len(pool.replaced) >= maxReplacedTxs {
+		var (
+			drop  common.Hash
+			nonce uint64 = math.MaxUint64
+		)
+		for hash, old := range pool.replaced {
+			if old.Nonce() < nonce {
+				drop, nonce = hash, old.Nonce()
+			}
+		}
+		delete(pool.replaced, drop)
+	}
+	pool.replaced[tx.Hash()] = tx
+}
+
+// nonceGaps returns the missing nonces between the account nonce of the sender
+// and its highest pending nonce, in ascending order.
+func (pool *TxPool) nonceGaps(from common.Address) []uint64 {
+	nonces := make([]uint64, 0, len(pool.byNonce[from]))
+	for nonce := range pool.byNonce[from] {
+		nonces = append(nonces, nonce)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+
+	var gaps []uint64
+	next := pool.stateNonce[from]
+	if advised := pool.advised[from]; advised > next {
+		// The nonces below the one advised by a server are known to the network
+		next = advised
+	}
+	for _, nonce := range nonces {
+		for ; next < nonce && len(gaps) < maxNonceGaps; next++ {
+			gaps = append(gaps, next)
+		}
+		if nonce >= next {
+			next = nonce + 1
+		}
+	}
+	return gaps
+}
+
+// AdviseNonce processes the pending nonce of a sender reported by a server along
+// with a transaction it queued after a nonce gap or rejected as a replay. The
+// lower nonces are known to the network: they are not reported as missing and
+// not handed out for new transactions any more.
+func (pool *TxPool) AdviseNonce(from common.Address, nonce uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if nonce > pool.advised[from] {
+		pool.advised[from] = nonce
+	}
+	if nonce > pool.nonce[from] {
+		pool.nonce[from] = nonce
+	}
+}
+
+// NonceGaps returns the missing nonces of the senders which have pending
+// transactions that can't be mined until the gaps are filled.
+func (pool *TxPool) NonceGaps() map[common.Address][]uint64 {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	gaps := make(map[common.Address][]uint64)
+	for from := range pool.byNonce {
+		if list := pool.nonceGaps(from); len(list) > 0 {
+			gaps[from] = list
+		}
+	}
+	return gaps
+}
+
 // txStateChanges stores the recent changes between pending/mined states of
 // transactions. True means mined, false means rolled back, no entry means no change
 type txStateChanges map[common.Hash]bool
@@ -171,11 +313,14 @@ func (pool *TxPool) checkMinedTxs(ctx context.Context, hash common.Hash, number
 	if err != nil {
 		return err
 	}
-	// Gather all the local transaction mined in this block
+	// Gather all the local transaction mined in this block, including the ones
+	// replaced in the meantime
 	list := pool.mined[hash]
 	for _, tx := range block.Transactions() {
 		if _, ok := pool.pending[tx.Hash()]; ok {
 			list = append(list, tx)
+		} else if _, ok := pool.replaced[tx.Hash()]; ok {
+			list = append(list, tx)
 		}
 	}
 	// If some transactions have been mined, write the needed data to disk and update
@@ -187,11 +332,26 @@ func (pool *TxPool) checkMinedTxs(ctx context.Context, hash common.Hash, number
 		rawdb.WriteTxLookupEntries(pool.chainDb, block)
 
 		// Update the transaction pool's state
+		var discard []common.Hash
 		for _, tx := range list {
-			delete(pool.pending, tx.Hash())
+			from, _ := types.Sender(pool.signer, tx)
+			if repl := pool.byNonce[from][tx.Nonce()]; repl != nil && repl.Hash() != tx.Hash() {
+				// A replaced transaction got mined, its replacement never will
+				pool.removePending(repl)
+				pool.chainDb.Delete(repl.Hash().Bytes())
+				discard = append(discard, repl.Hash())
+			}
+			pool.removePending(tx)
+			pool.dropReplaced(from, tx.Nonce())
+			if nonce := tx.Nonce() + 1; nonce > pool.stateNonce[from] {
+				pool.stateNonce[from] = nonce
+			}
 			txc.setState(tx.Hash(), true)
 		}
 		pool.mined[hash] = list
+		if len(discard) > 0 {
+			pool.relay.Discard(discard)
+		}
 	}
 	return nil
 }
@@ -204,7 +364,10 @@ func (pool *TxPool) rollbackTxs(hash common.Hash, txc txStateChanges) {
 		for _, tx := range list {
 			txHash := tx.Hash()
 			rawdb.DeleteTxLookupEntry(batch, txHash)
-			pool.pending[txHash] = tx
+			pool.addPending(tx)
+			if from, _ := types.Sender(pool.signer, tx); tx.Nonce() < pool.stateNonce[from] {
+				pool.stateNonce[from] = tx.Nonce()
+			}
 			txc.setState(txHash, false)
 		}
 		delete(pool.mined, hash)
@@ -355,7 +518,11 @@ func (pool *TxPool) validateTx(ctx context.Context, tx *types.Transaction) error
 	}
 	// Last but not least check for nonce errors
 	currentState := pool.currentState(ctx)
-	if n := currentState.GetNonce(from); n > tx.Nonce() {
+	n := currentState.GetNonce(from)
+	if currentState.Error() == nil {
+		pool.stateNonce[from] = n
+	}
+	if n > tx.Nonce() {
 		return core.ErrNonceTooLow
 	}
 
@@ -402,16 +569,35 @@ func (self *TxPool) add(ctx context.Context, tx *types.Transaction) error {
 	if err != nil {
 		return err
 	}
+	addr, _ := types.Sender(self.signer, tx)
+
+	// If a pending transaction has the same nonce, replace it if the new one
+	// pays a high enough price bump
+	//
+	// 如果已有相同 nonce 的 pending tx, 新 tx 的 gasPrice 需要高出 priceBump% 才能替换它
+	if old := self.byNonce[addr][tx.Nonce()]; old != nil {
+		threshold := new(big.Int).Div(new(big.Int).Mul(old.GasPrice(), big.NewInt(100+int64(self.priceBump))), big.NewInt(100))
+		if old.GasPrice().Cmp(tx.GasPrice()) >= 0 || threshold.Cmp(tx.GasPrice()) > 0 {
+			return core.ErrReplaceUnderpriced
+		}
+		self.removePending(old)
+		self.addReplaced(old)
+		self.chainDb.Delete(old.Hash().Bytes())
+		self.relay.Discard([]common.Hash{old.Hash()})
+
+		log.Debug("Replaced pending transaction", "old", old.Hash(), "new", hash)
+	}
 
 	if _, ok := self.pending[hash]; !ok {
-		self.pending[hash] = tx
+		self.addPending(tx)
 
 		nonce := tx.Nonce() + 1
-
-		addr, _ := types.Sender(self.signer, tx)
 		if nonce > self.nonce[addr] {
 			self.nonce[addr] = nonce
 		}
+		if gaps := self.nonceGaps(addr); len(gaps) > 0 {
+			log.Warn("Pending transactions have nonce gap", "from", addr, "missing", len(gaps), "first", gaps[0])
+		}
 
 		// Notify the subscribers. This event is posted in a goroutine
 		// because it's possible that somewhere during the post "Remove transaction"
@@ -491,19 +677,33 @@ func (self *TxPool) GetTransactions() (txs types.Transactions, err error) {
 }
 
 // Content retrieves the data content of the transaction pool, returning all the
-// pending as well as queued transactions, grouped by account and nonce.
+// pending as well as queued transactions, grouped by account and nonce. The
+// transactions following a nonce gap are reported as queued.
 func (self *TxPool) Content() (map[common.Address]types.Transactions, map[common.Address]types.Transactions) {
 	self.mu.RLock()
 	defer self.mu.RUnlock()
 
 	// Retrieve all the pending transactions and sort by account and by nonce
 	pending := make(map[common.Address]types.Transactions)
-	for _, tx := range self.pending {
-		account, _ := types.Sender(self.signer, tx)
-		pending[account] = append(pending[account], tx)
-	}
-	// There are no queued transactions in a light pool, just return an empty map
 	queued := make(map[common.Address]types.Transactions)
+	for account, list := range self.byNonce {
+		txs := make(types.Transactions, 0, len(list))
+		for _, tx := range list {
+			txs = append(txs, tx)
+		}
+		sort.Sort(types.TxByNonce(txs))
+
+		split := len(txs)
+		if gaps := self.nonceGaps(account); len(gaps) > 0 {
+			split = sort.Search(len(txs), func(i int) bool { return txs[i].Nonce() > gaps[0] })
+		}
+		if split > 0 {
+			pending[account] = txs[:split]
+		}
+		if split < len(txs) {
+			queued[account] = txs[split:]
+		}
+	}
 	return pending, queued
 }
 
@@ -516,7 +716,7 @@ func (self *TxPool) RemoveTransactions(txs types.Transactions) {
 	batch := self.chainDb.NewBatch()
 	for _, tx := range txs {
 		hash := tx.Hash()
-		delete(self.pending, hash)
+		self.removePending(tx)
 		batch.Delete(hash.Bytes())
 		hashes = append(hashes, hash)
 	}
@@ -529,7 +729,9 @@ func (pool *TxPool) RemoveTx(hash common.Hash) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 	// delete from pending pool
-	delete(pool.pending, hash)
+	if tx, ok := pool.pending[hash]; ok {
+		pool.removePending(tx)
+	}
 	pool.chainDb.Delete(hash[:])
 	pool.relay.Discard([]common.Hash{hash})
 }
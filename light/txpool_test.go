@@ -100,7 +100,7 @@ func TestTxPool(t *testing.T) {
 		discard: make(chan int, 1),
 		mined:   make(chan int, 1),
 	}
-	lightchain, _ := NewLightChain(odr, params.TestChainConfig, ethash.NewFullFaker())
+	lightchain, _ := NewLightChain(odr, params.TestChainConfig, ethash.NewFullFaker(), nil)
 	txPermanent = 50
 	pool := NewTxPool(params.TestChainConfig, lightchain, relay)
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -141,3 +141,172 @@ func TestTxPool(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the pending nonces advised by the servers are not handed out again,
+// and that a lower advice doesn't move the nonce back.
+func TestTxPoolAdviseNonce(t *testing.T) {
+	pool := &TxPool{
+		nonce:   make(map[common.Address]uint64),
+		advised: make(map[common.Address]uint64),
+	}
+
+	pool.AdviseNonce(testBankAddress, 5)
+	if nonce := pool.nonce[testBankAddress]; nonce != 5 {
+		t.Fatalf("advised nonce mismatch: have %d, want 5", nonce)
+	}
+	pool.AdviseNonce(testBankAddress, 3)
+	if nonce := pool.nonce[testBankAddress]; nonce != 5 {
+		t.Errorf("lower advice applied: have %d, want 5", nonce)
+	}
+}
+
+// Tests replace-by-fee and nonce gap tracking of the light transaction pool, as
+// well as the handling of replaced transactions getting mined anyway.
+func TestTxPoolReplacement(t *testing.T) {
+	newTx := func(nonce uint64, price int64) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, acc1Addr, big.NewInt(10000), params.TxGas, big.NewInt(price), nil), types.HomesteadSigner{}, testBankKey)
+		return tx
+	}
+	var (
+		sdb     = ethdb.NewMemDatabase()
+		ldb     = ethdb.NewMemDatabase()
+		gspec   = core.Genesis{Alloc: core.GenesisAlloc{testBankAddress: {Balance: testBankFunds}}}
+		genesis = gspec.MustCommit(sdb)
+		orig    = newTx(0, 100)
+		gapped  = newTx(2, 100)
+	)
+	gspec.MustCommit(ldb)
+	gchain, _ := core.GenerateChain(params.TestChainConfig, genesis, ethash.NewFaker(), sdb, 1, func(i int, block *core.BlockGen) {
+		block.AddTx(orig)
+	})
+	blockchain, _ := core.NewBlockChain(sdb, nil, params.TestChainConfig, ethash.NewFullFaker(), vm.Config{})
+	if _, err := blockchain.InsertChain(gchain); err != nil {
+		t.Fatal(err)
+	}
+	odr := &testOdr{sdb: sdb, ldb: ldb}
+	relay := &testTxRelay{
+		send:    make(chan int, 10),
+		discard: make(chan int, 10),
+		mined:   make(chan int, 10),
+	}
+	lightchain, _ := NewLightChain(odr, params.TestChainConfig, ethash.NewFullFaker(), nil)
+	pool := NewTxPool(params.TestChainConfig, lightchain, relay)
+	defer pool.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := pool.Add(ctx, orig); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	if err := pool.Add(ctx, gapped); err != nil {
+		t.Fatalf("failed to add gapped transaction: %v", err)
+	}
+	checkGaps := func(want []uint64) {
+		t.Helper()
+		gaps := pool.NonceGaps()[testBankAddress]
+		if len(gaps) != len(want) || (len(want) > 0 && gaps[0] != want[0]) {
+			t.Errorf("nonce gaps mismatch: have %v, want %v", gaps, want)
+		}
+	}
+	checkGaps([]uint64{1})
+	if pending, queued := pool.Content(); len(pending[testBankAddress]) != 1 || len(queued[testBankAddress]) != 1 {
+		t.Errorf("content mismatch: %d pending, %d queued, want 1 and 1", len(pending[testBankAddress]), len(queued[testBankAddress]))
+	}
+
+	// Replacements need a large enough price bump
+	if err := pool.Add(ctx, newTx(0, 105)); err != core.ErrReplaceUnderpriced {
+		t.Errorf("underpriced replacement: have %v, want %v", err, core.ErrReplaceUnderpriced)
+	}
+	replacement := newTx(0, 110)
+	if err := pool.Add(ctx, replacement); err != nil {
+		t.Fatalf("failed to replace transaction: %v", err)
+	}
+	if n := <-relay.discard; n != 1 {
+		t.Errorf("discarded transaction count mismatch: have %d, want 1", n)
+	}
+	if pool.GetTransaction(orig.Hash()) != nil || pool.GetTransaction(replacement.Hash()) == nil {
+		t.Errorf("transaction not replaced")
+	}
+
+	// Filling the gap makes the transactions processable
+	filler := newTx(1, 100)
+	if err := pool.Add(ctx, filler); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	checkGaps(nil)
+	if pending, queued := pool.Content(); len(pending[testBankAddress]) != 3 || len(queued) != 0 {
+		t.Errorf("content mismatch: %d pending, %d queued accounts, want 3 and 0", len(pending[testBankAddress]), len(queued))
+	}
+	if n := len(relay.send); n != 4 {
+		t.Errorf("relayed transaction count mismatch: have %d, want 4", n)
+	}
+
+	// The replaced transaction gets mined, the replacement is dropped
+	if _, err := lightchain.InsertHeaderChain([]*types.Header{gchain[0].Header()}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-relay.mined; n != 1 {
+		t.Errorf("mined transaction count mismatch: have %d, want 1", n)
+	}
+	if n := <-relay.discard; n != 1 {
+		t.Errorf("discarded transaction count mismatch: have %d, want 1", n)
+	}
+	if pool.GetTransaction(replacement.Hash()) != nil {
+		t.Errorf("replacement of mined transaction still pending")
+	}
+	if pending := pool.Stats(); pending != 2 {
+		t.Errorf("pending transaction count mismatch: have %d, want 2", pending)
+	}
+	checkGaps(nil)
+
+	// The nonces below the one advised by a server are not missing
+	if err := pool.Add(ctx, newTx(5, 100)); err != nil {
+		t.Fatalf("failed to add gapped transaction: %v", err)
+	}
+	checkGaps([]uint64{3, 4})
+	pool.AdviseNonce(testBankAddress, 5)
+	checkGaps(nil)
+}
+
+// Tests that the replaced transactions watched for getting mined stay bounded,
+// dropping the ones of already included nonces first.
+func TestTxPoolReplacedLimit(t *testing.T) {
+	pool := &TxPool{
+		signer:     types.HomesteadSigner{},
+		stateNonce: map[common.Address]uint64{testBankAddress: 10},
+		replaced:   make(map[common.Hash]*types.Transaction),
+	}
+	newTx := func(nonce uint64) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, acc1Addr, big.NewInt(10000), params.TxGas, big.NewInt(int64(nonce)), nil), types.HomesteadSigner{}, testBankKey)
+		return tx
+	}
+	for i := 0; i < maxReplacedTxs; i++ {
+		pool.addReplaced(newTx(uint64(i)))
+	}
+	if len(pool.replaced) != maxReplacedTxs {
+		t.Fatalf("replaced count mismatch: have %d, want %d", len(pool.replaced), maxReplacedTxs)
+	}
+	// The included nonces are pruned once the limit is reached
+	last := newTx(maxReplacedTxs)
+	pool.addReplaced(last)
+	if have, want := len(pool.replaced), maxReplacedTxs-10+1; have != want {
+		t.Fatalf("replaced count mismatch after pruning: have %d, want %d", have, want)
+	}
+	// Without included nonces the lowest one is dropped
+	pool.stateNonce[testBankAddress] = 0
+	for i := 0; i < 10; i++ {
+		pool.addReplaced(newTx(uint64(maxReplacedTxs + 1 + i)))
+	}
+	if len(pool.replaced) != maxReplacedTxs {
+		t.Fatalf("replaced count mismatch: have %d, want %d", len(pool.replaced), maxReplacedTxs)
+	}
+	for _, tx := range pool.replaced {
+		if tx.Nonce() < 11 {
+			t.Errorf("low nonce %d kept over the limit", tx.Nonce())
+		}
+	}
+	if pool.replaced[last.Hash()] == nil {
+		t.Errorf("latest replaced transaction dropped")
+	}
+}
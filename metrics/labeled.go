@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LabeledOverflow is the label value of the series collecting the updates of the
+// label combinations over the cardinality limit of a family.
+const LabeledOverflow = "overflow"
+
+// A LabeledFamily is a set of metrics of the same kind told apart by the values
+// of a fixed list of labels (e.g. peer ID, protocol, message code). The series
+// are created and registered on first use, named after the family and their
+// labels, e.g. "les/peer/traffic/peer=0123abcd/code=2".
+//
+// The number of series is capped: once the limit is reached, new label
+// combinations share a single overflow series, so high cardinality labels like
+// peer IDs can't create an unbounded number of metric objects. The series of a
+// label value going away (e.g. a disconnected peer) are expired with DeleteLabel,
+// making room for new ones.
+type LabeledFamily struct {
+	name     string
+	labels   []string
+	limit    int
+	create   func() interface{}
+	registry Registry
+
+	lock     sync.Mutex
+	series   map[string]*labeledSeries
+	overflow *labeledSeries
+}
+
+// labeledSeries is a metric of a family with the values of its labels.
+type labeledSeries struct {
+	name   string
+	values []string
+	metric interface{}
+}
+
+// NewLabeledFamily creates a family of metrics constructed by create, with the
+// given label names and at most limit series (zero for unlimited), registered
+// in r (the default registry if nil).
+func NewLabeledFamily(name string, labels []string, limit int, create func() interface{}, r Registry) *LabeledFamily {
+	if len(labels) == 0 {
+		panic("metrics: labeled family without labels")
+	}
+	if r == nil {
+		r = DefaultRegistry
+	}
+	return &LabeledFamily{
+		name:     name,
+		labels:   labels,
+		limit:    limit,
+		create:   create,
+		registry: r,
+		series:   make(map[string]*labeledSeries),
+	}
+}
+
+// With returns the metric of the given label values, creating it if needed. It
+// panics if the number of values doesn't match the labels of the family.
+func (f *LabeledFamily) With(values ...string) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %d label values for %d labels", len(values), len(f.labels)))
+	}
+	if !Enabled {
+		return f.create()
+	}
+	key := strings.Join(values, "\x00")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if s, ok := f.series[key]; ok {
+		return s.metric
+	}
+	if f.limit > 0 && len(f.series) >= f.limit {
+		if f.overflow == nil {
+			f.overflow = f.newSeries(nil)
+		}
+		return f.overflow.metric
+	}
+	s := f.newSeries(append([]string(nil), values...))
+	f.series[key] = s
+	return s.metric
+}
+
+// newSeries creates and registers a series, nil values meaning the overflow one.
+func (f *LabeledFamily) newSeries(values []string) *labeledSeries {
+	s := &labeledSeries{values: values, metric: f.create()}
+	if values == nil {
+		s.name = f.name + "/" + LabeledOverflow
+	} else {
+		parts := make([]string, len(values))
+		for i, value := range values {
+			parts[i] = f.labels[i] + "=" + value
+		}
+		s.name = f.name + "/" + strings.Join(parts, "/")
+	}
+	f.registry.Register(s.name, s.metric)
+	return s
+}
+
+// DeleteLabel expires all the series with the given value of a label, e.g. the
+// metrics of a disconnected peer. The stoppable metrics (meters, timers) are
+// stopped, so they are no longer ticked. It returns the number of series removed.
+func (f *LabeledFamily) DeleteLabel(label, value string) int {
+	idx := -1
+	for i, l := range f.labels {
+		if l == label {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var removed int
+	for key, s := range f.series {
+		if s.values[idx] == value {
+			f.registry.Unregister(s.name)
+			if m, ok := s.metric.(Stoppable); ok {
+				m.Stop()
+			}
+			delete(f.series, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of series of the family, not counting the overflow.
+func (f *LabeledFamily) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.series)
+}
+
+// Names returns the registered names of the series of the family, sorted.
+func (f *LabeledFamily) Names() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	names := make([]string, 0, len(f.series)+1)
+	for _, s := range f.series {
+		names = append(names, s.name)
+	}
+	if f.overflow != nil {
+		names = append(names, f.overflow.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LabeledMeter is a family of meters.
+type LabeledMeter struct {
+	*LabeledFamily
+}
+
+// NewLabeledMeter creates a family of meters with the given labels and at most
+// limit series, registered in r (the default registry if nil).
+func NewLabeledMeter(name string, labels []string, limit int, r Registry) LabeledMeter {
+	return LabeledMeter{NewLabeledFamily(name, labels, limit, func() interface{} { return NewMeter() }, r)}
+}
+
+// With returns the meter of the given label values.
+func (m LabeledMeter) With(values ...string) Meter {
+	return m.LabeledFamily.With(values...).(Meter)
+}
+
+// LabeledCounter is a family of counters.
+type LabeledCounter struct {
+	*LabeledFamily
+}
+
+// NewLabeledCounter creates a family of counters with the given labels and at
+// most limit series, registered in r (the default registry if nil).
+func NewLabeledCounter(name string, labels []string, limit int, r Registry) LabeledCounter {
+	return LabeledCounter{NewLabeledFamily(name, labels, limit, func() interface{} { return NewCounter() }, r)}
+}
+
+// With returns the counter of the given label values.
+func (c LabeledCounter) With(values ...string) Counter {
+	return c.LabeledFamily.With(values...).(Counter)
+}
+
+// LabeledGauge is a family of gauges.
+type LabeledGauge struct {
+	*LabeledFamily
+}
+
+// NewLabeledGauge creates a family of gauges with the given labels and at most
+// limit series, registered in r (the default registry if nil).
+func NewLabeledGauge(name string, labels []string, limit int, r Registry) LabeledGauge {
+	return LabeledGauge{NewLabeledFamily(name, labels, limit, func() interface{} { return NewGauge() }, r)}
+}
+
+// With returns the gauge of the given label values.
+func (g LabeledGauge) With(values ...string) Gauge {
+	return g.LabeledFamily.With(values...).(Gauge)
+}
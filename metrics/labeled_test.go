@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabeledCounter(t *testing.T) {
+	r := NewRegistry()
+	c := NewLabeledCounter("les/requests", []string{"peer", "code"}, 3, r)
+
+	c.With("a", "2").Inc(1)
+	c.With("a", "2").Inc(1)
+	c.With("a", "4").Inc(1)
+	c.With("b", "2").Inc(1)
+	if count := r.Get("les/requests/peer=a/code=2").(Counter).Count(); count != 2 {
+		t.Fatalf("series count mismatch: have %d, want 2", count)
+	}
+	// Combinations over the limit share the overflow series
+	c.With("c", "2").Inc(1)
+	c.With("d", "2").Inc(1)
+	if c.Len() != 3 {
+		t.Fatalf("series number mismatch: have %d, want 3", c.Len())
+	}
+	if count := r.Get("les/requests/" + LabeledOverflow).(Counter).Count(); count != 2 {
+		t.Fatalf("overflow count mismatch: have %d, want 2", count)
+	}
+	// Expiring a peer makes room for new ones
+	if removed := c.DeleteLabel("peer", "a"); removed != 2 {
+		t.Fatalf("removed series mismatch: have %d, want 2", removed)
+	}
+	if r.Get("les/requests/peer=a/code=2") != nil {
+		t.Fatalf("expired series still registered")
+	}
+	c.With("c", "2").Inc(1)
+	want := []string{"les/requests/overflow", "les/requests/peer=b/code=2", "les/requests/peer=c/code=2"}
+	if names := c.Names(); !reflect.DeepEqual(names, want) {
+		t.Fatalf("series names mismatch: have %v, want %v", names, want)
+	}
+}
+
+func TestLabeledMeterUnknownLabel(t *testing.T) {
+	m := NewLabeledMeter("p2p/traffic", []string{"peer"}, 0, NewRegistry())
+	defer m.DeleteLabel("peer", "a")
+
+	m.With("a").Mark(10)
+	if m.DeleteLabel("protocol", "a") != 0 || m.Len() != 1 {
+		t.Fatalf("series removed by unknown label")
+	}
+}
+
+func TestLabeledMeterDeleteStops(t *testing.T) {
+	r := NewRegistry()
+	m := NewLabeledMeter("p2p/traffic", []string{"peer"}, 0, r)
+
+	// Occupy the name of the series, so it's only reachable through the family
+	r.Register("p2p/traffic/peer=a", NewCounter())
+	meter := m.With("a").(*StandardMeter)
+
+	m.DeleteLabel("peer", "a")
+	arbiter.RLock()
+	_, ticked := arbiter.meters[meter]
+	arbiter.RUnlock()
+	if ticked {
+		t.Fatalf("deleted meter still ticked")
+	}
+}
@@ -107,7 +107,8 @@ func (api *PrivateAdminAPI) RemoveTrustedPeer(url string) (bool, error) {
 }
 
 // PeerEvents creates an RPC subscription which receives peer events from the
-// node's p2p.Server
+// node's p2p.Server: added and dropped peers, failed handshakes and, if message
+// events are enabled, the sizes of the sent and received messages
 func (api *PrivateAdminAPI) PeerEvents(ctx context.Context) (*rpc.Subscription, error) {
 	// Make sure the server is running, fail otherwise
 	server := api.node.Server()
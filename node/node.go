@@ -215,6 +215,9 @@ func (n *Node) Start() error {
 	if n.serverConfig.NodeDatabase == "" {
 		n.serverConfig.NodeDatabase = n.config.NodeDB()			// 根据配置文件 指定  p2p node 的 db 目录
 	}
+	if n.serverConfig.PeerDatabase == "" {
+		n.serverConfig.PeerDatabase = n.config.PeerDB()			// 对端 peer 元数据的 db 目录
+	}
 
 	// todo 初始化 p2p Server 实例
 	running := &p2p.Server{Config: n.serverConfig}
@@ -266,9 +269,13 @@ func (n *Node) Start() error {
 	// todo ##############################
 	// todo ##############################
 	// todo ##############################
+	registry := p2p.NewProtocolRegistry()
 	for _, service := range services {
-		running.Protocols = append(running.Protocols, service.Protocols()...)
+		if err := registry.Register(service.Protocols()...); err != nil {
+			return err
+		}
 	}
+	running.Protocols = registry.Protocols()
 
 	if err := running.Start(); err != nil {  // todo 这里启动 p2p 服务, 不是 peer 实例哦
 		return convertFileLockError(err)
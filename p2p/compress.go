@@ -0,0 +1,117 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	"github.com/golang/snappy"
+)
+
+// setCompressedCaps announces the capabilities of the protocols opting into
+// message compression. The list is stored as the first element of the handshake
+// tail, which older implementations ignore.
+//
+// setCompressedCaps: 将开启了 压缩 的子协议列表 放到 握手消息的 Rest 中 (旧版本节点会忽略它)
+func (hs *protoHandshake) setCompressedCaps(protocols []Protocol) {
+	var caps []Cap
+	for _, proto := range protocols {
+		if proto.Compress {
+			caps = append(caps, proto.cap())
+		}
+	}
+	if len(caps) == 0 {
+		hs.Rest = nil
+		return
+	}
+	enc, _ := rlp.EncodeToBytes(caps)
+	hs.Rest = []rlp.RawValue{enc}
+}
+
+// compressedCaps returns the capabilities the remote side opted into message
+// compression for. Malformed or missing announcements disable compression.
+func (hs *protoHandshake) compressedCaps() []Cap {
+	if len(hs.Rest) == 0 {
+		return nil
+	}
+	var caps []Cap
+	if err := rlp.DecodeBytes(hs.Rest[0], &caps); err != nil {
+		return nil
+	}
+	return caps
+}
+
+// snappyConn reports whether the whole connection is snappy compressed after the
+// protocol handshake. If both sides announce compressed protocols, only these
+// are compressed and the messages of the other protocols are sent plain.
+//
+// snappyConn: 双方都声明了 按子协议压缩 时, 不再压缩整条连接, 只压缩声明的子协议
+func snappyConn(our, their *protoHandshake) bool {
+	if their.Version < snappyProtocolVersion {
+		return false
+	}
+	return our.compressedCaps() == nil || their.compressedCaps() == nil
+}
+
+// hasCap reports whether the capability is in the list.
+func hasCap(caps []Cap, cap Cap) bool {
+	for _, c := range caps {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
+
+// compressMsg replaces the payload of a message with its snappy encoding.
+func compressMsg(msg Msg) (Msg, error) {
+	if msg.Size > maxUint24 {
+		return msg, errPlainMessageTooLarge
+	}
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return msg, err
+	}
+	payload = snappy.Encode(nil, payload)
+	msg.Payload = bytes.NewReader(payload)
+	msg.Size = uint32(len(payload))
+	return msg, nil
+}
+
+// decompressMsg replaces the snappy encoded payload of a message with the
+// decoded one.
+func decompressMsg(msg Msg) (Msg, error) {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return msg, err
+	}
+	size, err := snappy.DecodedLen(payload)
+	if err != nil {
+		return msg, err
+	}
+	if size > int(maxUint24) {
+		return msg, errPlainMessageTooLarge
+	}
+	if payload, err = snappy.Decode(nil, payload); err != nil {
+		return msg, err
+	}
+	msg.Payload = bytes.NewReader(payload)
+	msg.Size = uint32(len(payload))
+	return msg, nil
+}
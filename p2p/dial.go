@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
@@ -90,6 +91,9 @@ type dialstate struct {
 
 	// 引导节点集合
 	bootnodes []*discover.Node // default dials when there are no peers   当没有 对端 peer 时, 我们 默认连接到 引导节点上
+
+	// 每个协议需要的动态拨号 peer 数 (nil 表示不区分协议)
+	quotas map[string]int // dynamically dialed peers wanted per protocol name, see dialQuotas
 }
 
 type discoverTable interface {
@@ -100,6 +104,30 @@ type discoverTable interface {
 	ReadRandomNodes([]*discover.Node) int
 }
 
+// livenessPredictor is implemented by discovery tables tracking the availability
+// of nodes over the day. Dial candidates which are usually offline at the current
+// time of day are tried last.
+//
+// livenessPredictor: 记录 node 在一天中各时段的在线情况, 当前时段通常不在线的 node 会被最后拨号
+type livenessPredictor interface {
+	Liveness(id discover.NodeID) float64
+	NoteLiveness(id discover.NodeID, alive bool)
+}
+
+// sortByLiveness orders dial candidates by their predicted availability, keeping
+// the order of equally rated nodes.
+func sortByLiveness(ntab discoverTable, nodes []*discover.Node) {
+	lp, ok := ntab.(livenessPredictor)
+	if !ok || len(nodes) < 2 {
+		return
+	}
+	scores := make(map[discover.NodeID]float64, len(nodes))
+	for _, n := range nodes {
+		scores[n.ID] = lp.Liveness(n.ID)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return scores[nodes[i].ID] > scores[nodes[j].ID] })
+}
+
 // the dial history remembers recent dials.   拨号历史记录会记住最近的拨号
 //
 // 全局用来记录  历史连接过的  对端 peer
@@ -157,6 +185,73 @@ func newDialState(static []*discover.Node, bootnodes []*discover.Node, ntab disc
 	return s
 }
 
+// dialQuotas splits the dynamic dial budget among the protocols according to
+// their dial preferences. It returns the number of dynamically dialed peers
+// wanted per protocol name, or nil if none of the protocols declares a preference.
+// Reserved slots are allocated first, the rest is shared evenly.
+func dialQuotas(protocols []Protocol, maxdyn int) map[string]int {
+	var (
+		names    []string
+		prefs    = make(map[string]Protocol)
+		declared bool
+	)
+	for _, p := range protocols {
+		if _, ok := prefs[p.Name]; ok {
+			continue // versions of the same protocol share the preference of the first
+		}
+		names = append(names, p.Name)
+		prefs[p.Name] = p
+		declared = declared || p.Dial != DialAny
+	}
+	if !declared {
+		return nil
+	}
+	var (
+		quotas    = make(map[string]int, len(names))
+		remaining = maxdyn
+		sharing   []string
+	)
+	for _, name := range names {
+		switch p := prefs[name]; {
+		case p.Dial == DialInboundOnly:
+			quotas[name] = 0
+		case p.Dial == DialOutbound && p.DialSlots > 0:
+			slots := p.DialSlots
+			if slots > remaining {
+				slots = remaining
+			}
+			quotas[name] = slots
+			remaining -= slots
+		default:
+			sharing = append(sharing, name)
+		}
+	}
+	for i, name := range sharing {
+		quotas[name] = remaining / len(sharing)
+		if i < remaining%len(sharing) {
+			quotas[name]++
+		}
+	}
+	return quotas
+}
+
+// neededQuotaDials returns the number of dynamic dials needed to fill the dial
+// quotas of the protocols. A dialed peer counts for every protocol it runs.
+func (s *dialstate) neededQuotaDials(peers map[discover.NodeID]*Peer, pending int) int {
+	need := 0
+	for name, quota := range s.quotas {
+		for _, p := range peers {
+			if _, ok := p.running[name]; ok && p.rw.is(dynDialedConn) {
+				quota--
+			}
+		}
+		if quota > need {
+			need = quota
+		}
+	}
+	return need - pending
+}
+
 func (s *dialstate) addStatic(n *discover.Node) { // 设置静态链接  任务集合
 	// This overwites the task instead of updating an existing
 	// entry, giving users the opportunity to force a resolve operation.
@@ -198,9 +293,17 @@ func (s *dialstate) newTasks(nRunning int, peers map[discover.NodeID]*Peer, now
 			needDynDials--
 		}
 	}
+	pending := 0
 	for _, flag := range s.dialing {
 		if flag&dynDialedConn != 0 {
 			needDynDials--
+			pending++
+		}
+	}
+	// Only dial for the protocols wanting outbound connections
+	if s.quotas != nil {
+		if need := s.neededQuotaDials(peers, pending); need < needDynDials {
+			needDynDials = need
 		}
 	}
 
@@ -236,6 +339,7 @@ func (s *dialstate) newTasks(nRunning int, peers map[discover.NodeID]*Peer, now
 	randomCandidates := needDynDials / 2
 	if randomCandidates > 0 {
 		n := s.ntab.ReadRandomNodes(s.randomNodes)
+		sortByLiveness(s.ntab, s.randomNodes[:n])
 		for i := 0; i < randomCandidates && i < n; i++ {
 			if addDial(dynDialedConn, s.randomNodes[i]) {   // 配置文件中指定的节点
 				needDynDials--
@@ -306,6 +410,7 @@ func (s *dialstate) taskDone(t task, now time.Time) {
 	case *discoverTask:
 		s.lookupRunning = false
 		s.lookupBuf = append(s.lookupBuf, t.results...)
+		sortByLiveness(s.ntab, s.lookupBuf)
 	}
 }
 
@@ -317,6 +422,12 @@ func (t *dialTask) Do(srv *Server) {
 	}
 
 	err := t.dial(srv, t.dest) // todo 这里会以 当前 peer 作为 客户端, 向 对端 peer 发起 拨号连接   (里面会处理:  往 `srv.posthandshake` 通道 和 往 `srv.addpeer` 添加 conn 信号)
+	if lp, ok := srv.ntab.(livenessPredictor); ok {
+		// Only connection failures tell that the node is offline, a failed
+		// handshake still means it's there
+		_, unreachable := err.(*dialError)
+		lp.NoteLiveness(t.dest.ID, !unreachable)
+	}
 	if err != nil {
 		log.Trace("Dial error", "task", t, "err", err)
 		// Try resolving the ID of static nodes if dialing failed.
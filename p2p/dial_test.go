@@ -84,6 +84,128 @@ func (t fakeTable) Lookup(discover.NodeID) []*discover.Node  { return nil }
 func (t fakeTable) Resolve(discover.NodeID) *discover.Node   { return nil }
 func (t fakeTable) ReadRandomNodes(buf []*discover.Node) int { return copy(buf, t) }
 
+// livenessTable is a fakeTable rating the availability of its nodes.
+type livenessTable struct {
+	fakeTable
+	scores map[discover.NodeID]float64
+}
+
+func (t livenessTable) Liveness(id discover.NodeID) float64 {
+	if score, ok := t.scores[id]; ok {
+		return score
+	}
+	return 0.5
+}
+
+func (t livenessTable) NoteLiveness(discover.NodeID, bool) {}
+
+// This test checks that nodes which are usually offline at the current time of
+// day are dialed last.
+func TestDialStateLiveness(t *testing.T) {
+	table := livenessTable{
+		fakeTable: fakeTable{
+			{ID: uintID(1)},
+			{ID: uintID(2)},
+			{ID: uintID(3)},
+			{ID: uintID(4)},
+		},
+		scores: map[discover.NodeID]float64{
+			uintID(1): 0.1,
+			uintID(3): 0.9,
+		},
+	}
+	runDialTest(t, dialtest{
+		init: newDialState(nil, nil, table, 8, nil),
+		rounds: []round{
+			// The random nodes are dialed best first
+			{
+				new: []task{
+					&dialTask{flags: dynDialedConn, dest: &discover.Node{ID: uintID(3)}},
+					&dialTask{flags: dynDialedConn, dest: &discover.Node{ID: uintID(2)}},
+					&dialTask{flags: dynDialedConn, dest: &discover.Node{ID: uintID(4)}},
+					&dialTask{flags: dynDialedConn, dest: &discover.Node{ID: uintID(1)}},
+					&discoverTask{},
+				},
+			},
+		},
+	})
+}
+
+// This test checks the split of the dynamic dial budget among the protocols.
+func TestDialQuotas(t *testing.T) {
+	tests := []struct {
+		protocols []Protocol
+		want      map[string]int
+	}{
+		{
+			protocols: []Protocol{{Name: "eth", Version: 62}, {Name: "eth", Version: 63}},
+			want:      nil,
+		},
+		{
+			protocols: []Protocol{{Name: "eth"}, {Name: "les", Version: 1, Dial: DialInboundOnly}, {Name: "les", Version: 2}},
+			want:      map[string]int{"eth": 10, "les": 0},
+		},
+		{
+			protocols: []Protocol{{Name: "les", Dial: DialOutbound, DialSlots: 4}, {Name: "eth"}, {Name: "shh"}},
+			want:      map[string]int{"les": 4, "eth": 3, "shh": 3},
+		},
+		{
+			protocols: []Protocol{{Name: "les", Dial: DialOutbound, DialSlots: 20}, {Name: "eth"}},
+			want:      map[string]int{"les": 10, "eth": 0},
+		},
+		{
+			protocols: []Protocol{{Name: "a", Dial: DialOutbound}, {Name: "b"}, {Name: "c"}},
+			want:      map[string]int{"a": 4, "b": 3, "c": 3},
+		},
+	}
+	for i, test := range tests {
+		if have := dialQuotas(test.protocols, 10); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("test %d: quotas mismatch: have %v, want %v", i, have, test.want)
+		}
+	}
+}
+
+// This test checks that dynamic dials are only made for the protocols wanting
+// outbound connections.
+func TestDialStateQuotas(t *testing.T) {
+	table := fakeTable{
+		{ID: uintID(1)},
+		{ID: uintID(2)},
+		{ID: uintID(3)},
+		{ID: uintID(4)},
+		{ID: uintID(5)},
+	}
+	les := map[string]*protoRW{"les": nil}
+
+	// Inbound only protocols don't dial at all
+	state := newDialState(nil, nil, table, 10, nil)
+	state.quotas = dialQuotas([]Protocol{{Name: "les", Dial: DialInboundOnly}}, 10)
+	if tasks := state.newTasks(0, nil, time.Time{}); len(tasks) != 0 {
+		t.Fatalf("dial tasks for inbound only protocol: %v", tasks)
+	}
+	// Only dialed peers running the protocol fill its quota
+	state = newDialState(nil, nil, table, 10, nil)
+	state.quotas = map[string]int{"les": 3, "eth": 0}
+	peers := map[discover.NodeID]*Peer{
+		uintID(1): {rw: &conn{flags: dynDialedConn, id: uintID(1)}, running: les},
+		uintID(2): {rw: &conn{flags: dynDialedConn, id: uintID(2)}},
+		uintID(3): {rw: &conn{flags: staticDialedConn, id: uintID(3)}, running: les},
+		uintID(4): {rw: &conn{flags: inboundConn, id: uintID(4)}, running: les},
+	}
+	if need := state.neededQuotaDials(peers, 0); need != 2 {
+		t.Errorf("needed dials mismatch: have %d, want 2", need)
+	}
+	if need := state.neededQuotaDials(peers, 1); need != 1 {
+		t.Errorf("needed dials with pending dial mismatch: have %d, want 1", need)
+	}
+	// No dials once the quotas are filled
+	peers[uintID(2)].running = les
+	peers[uintID(5)] = &Peer{rw: &conn{flags: dynDialedConn, id: uintID(5)}, running: les}
+	if tasks := state.newTasks(0, peers, time.Time{}); len(tasks) != 0 {
+		t.Errorf("dial tasks with filled quotas: %v", tasks)
+	}
+}
+
 // This test checks that dynamic dials are launched from discovery results.
 func TestDialStateDynDial(t *testing.T) {
 	runDialTest(t, dialtest{
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"math"
 	"os"
 	"sync"
 	"time"
@@ -51,6 +52,8 @@ type nodeDB struct {
 	self   NodeID        // Own node id to prevent adding it into the database
 	runner sync.Once     // Ensures we can start at most one expirer
 	quit   chan struct{} // Channel to signal the expiring thread to stop
+
+	livenessLock sync.Mutex // Serializes the updates of the availability histories
 }
 
 // Schema layout for the node database
@@ -62,6 +65,7 @@ var (
 	nodeDBDiscoverPing      = nodeDBDiscoverRoot + ":lastping"
 	nodeDBDiscoverPong      = nodeDBDiscoverRoot + ":lastpong"
 	nodeDBDiscoverFindFails = nodeDBDiscoverRoot + ":findfail"
+	nodeDBDiscoverLiveness  = nodeDBDiscoverRoot + ":liveness"
 )
 
 // newNodeDB creates a new node database for storing and retrieving infos about
@@ -314,6 +318,64 @@ func (db *nodeDB) updateFindFails(id NodeID, fails int) error {
 	return db.storeInt64(makeKey(id, nodeDBDiscoverFindFails), int64(fails))
 }
 
+// livenessSlots is the number of time-of-day slots (hours) the availability
+// history of a node is tracked in.
+const livenessSlots = 24
+
+// livenessSlot returns the time-of-day slot of the given time.
+func livenessSlot(t time.Time) int {
+	return t.UTC().Hour()
+}
+
+// updateLiveness records whether the node was reachable at the given time. The
+// history is stored as the number of successful and total checks in every
+// time-of-day slot, halving both counters when they would overflow so that
+// recent behaviour weighs more.
+//
+// `updateLiveness()` 按照一天中的小时记录 node 是否在线 (成功次数/总次数), 用于预测 node 在某个时段是否在线
+func (db *nodeDB) updateLiveness(id NodeID, instance time.Time, alive bool) error {
+	db.livenessLock.Lock()
+	defer db.livenessLock.Unlock()
+
+	key := makeKey(id, nodeDBDiscoverLiveness)
+	blob, err := db.lvl.Get(key, nil)
+	if err != nil || len(blob) != 2*livenessSlots {
+		blob = make([]byte, 2*livenessSlots)
+	}
+	slot := livenessSlot(instance)
+	if blob[livenessSlots+slot] == math.MaxUint8 {
+		blob[slot] /= 2
+		blob[livenessSlots+slot] /= 2
+	}
+	blob[livenessSlots+slot]++
+	if alive {
+		blob[slot]++
+	}
+	return db.lvl.Put(key, blob, nil)
+}
+
+// liveness predicts the probability of the node being online at the given time
+// of day from its availability history. The neighbouring slots are taken into
+// account with half weight, nodes without history are rated 0.5.
+//
+// `liveness()` 根据 node 的历史在线记录, 预测其在给定时段在线的概率
+func (db *nodeDB) liveness(id NodeID, instance time.Time) float64 {
+	blob, err := db.lvl.Get(makeKey(id, nodeDBDiscoverLiveness), nil)
+	if err != nil || len(blob) != 2*livenessSlots {
+		return 0.5
+	}
+	var (
+		slot         = livenessSlot(instance)
+		alive, total float64
+	)
+	for i, weight := range []float64{0.5, 1, 0.5} {
+		s := (slot + i - 1 + livenessSlots) % livenessSlots
+		alive += weight * float64(blob[s])
+		total += weight * float64(blob[livenessSlots+s])
+	}
+	return (alive + 1) / (total + 2)
+}
+
 // querySeeds retrieves random nodes to be used as potential seed nodes
 // for bootstrapping.
 //
@@ -378,3 +378,44 @@ func TestNodeDBSelfExpiration(t *testing.T) {
 		t.Errorf("self not evacuated")
 	}
 }
+
+func TestNodeDBLiveness(t *testing.T) {
+	db, _ := newNodeDB("", nodeDBVersion, NodeID{})
+	defer db.close()
+
+	var (
+		id      = MustHexID("0x1dd9d65c4552b5eb43d5ad55a2ee3f56c6cbc1c64a5c8d659f51fcd51bace24351232b8d7821617d2b29b54b81cdefb9b3e9c37d7fd5f63270bcc9e1a6f6a439")
+		day     = time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+		morning = day.Add(10 * time.Hour)
+		night   = day.Add(22 * time.Hour)
+	)
+	if p := db.liveness(id, morning); p != 0.5 {
+		t.Errorf("liveness without history: have %v, want 0.5", p)
+	}
+	// Online in the morning, offline at night for a few weeks
+	for i := 0; i < 300; i++ {
+		offset := time.Duration(i/10) * 24 * time.Hour
+		if err := db.updateLiveness(id, morning.Add(offset), true); err != nil {
+			t.Fatalf("failed to update liveness: %v", err)
+		}
+		if err := db.updateLiveness(id, night.Add(offset), false); err != nil {
+			t.Fatalf("failed to update liveness: %v", err)
+		}
+	}
+	if p := db.liveness(id, morning.Add(30*time.Minute)); p < 0.9 {
+		t.Errorf("morning liveness too low: %v", p)
+	}
+	if p := db.liveness(id, night.Add(time.Hour)); p > 0.1 {
+		t.Errorf("night liveness too high: %v", p)
+	}
+	if p := db.liveness(id, day.Add(16*time.Hour)); p != 0.5 {
+		t.Errorf("liveness of unobserved slot: have %v, want 0.5", p)
+	}
+	// The node changes its habits, recent observations take over
+	for i := 0; i < 300; i++ {
+		db.updateLiveness(id, morning, false)
+	}
+	if p := db.liveness(id, morning); p > 0.5 {
+		t.Errorf("morning liveness not adapted: %v", p)
+	}
+}
@@ -60,6 +60,11 @@ const (
 	seedMinTableTime    = 5 * time.Minute
 	seedCount           = 30
 	seedMaxAge          = 5 * 24 * time.Hour
+
+	// Network lookup allowance of a passive table: a burst of lookups, one more
+	// allowed for every interval elapsed
+	passiveLookupBurst    = 3
+	passiveLookupInterval = time.Minute
 )
 
 type Table struct {
@@ -81,6 +86,11 @@ type Table struct {
 
 	net  transport
 	self *Node // metadata of the local node
+
+	// 被动模式: 只应答 ping, 不做 刷桶/重新验证, 只在需要时 (限速) 发起 lookup
+	passive      bool      // no table maintenance, rate limited lookups
+	lookupTokens float64   // network lookups currently allowed in passive mode
+	lookupRefill time.Time // last update of lookupTokens
 }
 
 // transport is implemented by the UDP transport.
@@ -104,7 +114,7 @@ type bucket struct {
 	ips          netutil.DistinctNetSet
 }
 
-func newTable(t transport, ourID NodeID, ourAddr *net.UDPAddr, nodeDBPath string, bootnodes []*Node) (*Table, error) {
+func newTable(t transport, ourID NodeID, ourAddr *net.UDPAddr, nodeDBPath string, bootnodes []*Node, passive bool) (*Table, error) {
 	// If no node database was given, use an in-memory one
 	db, err := newNodeDB(nodeDBPath, nodeDBVersion, ourID)  // todo 实例化一个 存放  node 信息的 leveldb
 	if err != nil {
@@ -120,6 +130,10 @@ func newTable(t transport, ourID NodeID, ourAddr *net.UDPAddr, nodeDBPath string
 		closed:     make(chan struct{}),
 		rand:       mrand.New(mrand.NewSource(0)),
 		ips:        netutil.DistinctNetSet{Subnet: tableSubnet, Limit: tableIPLimit},
+
+		passive:      passive,
+		lookupTokens: passiveLookupBurst,
+		lookupRefill: time.Now(),
 	}
 	if err := tab.setFallbackNodes(bootnodes); err != nil { // 设置启动节点信息到桶的tab.nursery数组中
 		return nil, err
@@ -198,6 +212,17 @@ func (tab *Table) ReadRandomNodes(buf []*Node) (n int) {
 	return i + 1
 }
 
+// Liveness returns the predicted probability that the node is online at the
+// current time of day, based on its availability history.
+func (tab *Table) Liveness(id NodeID) float64 {
+	return tab.db.liveness(id, time.Now())
+}
+
+// NoteLiveness records whether the node could be reached, e.g. when dialing it.
+func (tab *Table) NoteLiveness(id NodeID, alive bool) {
+	tab.db.updateLiveness(id, time.Now(), alive)
+}
+
 // Close terminates the network listener and flushes the node database.
 func (tab *Table) Close() {
 	select {
@@ -265,10 +290,39 @@ func (tab *Table) Resolve(targetID NodeID) *Node {
 // nodes that are closer to it on each iteration.
 // The given target does not need to be an actual node
 // identifier.
+//
+// A passive table only starts a network search if its lookup allowance is not
+// exhausted, otherwise the closest nodes already known are returned.
 func (tab *Table) Lookup(targetID NodeID) []*Node {
+	if tab.passive && !tab.allowLookup() {
+		target := crypto.Keccak256Hash(targetID[:])
+		tab.mutex.Lock()
+		defer tab.mutex.Unlock()
+		return tab.closest(target, bucketSize).entries
+	}
 	return tab.lookup(targetID, true)   // 最终是调用 真正刷桶的动作    (tab *Table) Lookup(targetID NodeID)
 }
 
+// allowLookup consumes one of the network lookups allowed in passive mode, it
+// returns false if none is left.
+func (tab *Table) allowLookup() bool {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	now := time.Now()
+	tab.lookupTokens += float64(now.Sub(tab.lookupRefill)) / float64(passiveLookupInterval)
+	if tab.lookupTokens > passiveLookupBurst {
+		tab.lookupTokens = passiveLookupBurst
+	}
+	tab.lookupRefill = now
+
+	if tab.lookupTokens < 1 {
+		return false
+	}
+	tab.lookupTokens--
+	return true
+}
+
 // 真正激发刷桶动作的函数
 func (tab *Table) lookup(targetID NodeID, refreshIfEmpty bool) []*Node {
 	var (
@@ -374,6 +428,15 @@ func (tab *Table) loop() {  // 异步启动刷桶逻辑
 	defer revalidate.Stop()
 	defer copyNodes.Stop()
 
+	// A passive table generates no maintenance traffic, it's only refreshed on
+	// demand when a lookup finds it empty
+	//
+	// 被动模式下 不定时刷桶, 也不重新验证 k-bucket 中的 node
+	if tab.passive {
+		refresh.Stop()
+		revalidate.Stop()
+	}
+
 	// Start initial refresh.
 	go tab.doRefresh(refreshDone)  // 进来先刷一波 桶
 
@@ -440,6 +503,12 @@ func (tab *Table) doRefresh(done chan struct{}) {
 	// 从 db 加载节点并将其插入. 这应该会产生一些以前希望看到的仍然活跃的节点.
 	tab.loadSeedNodes()   // 从 本地 db 中 随机加载一部分 (活跃的) node 信息 和 配置的 种子节点一起返回  (用来做 启动引导用)
 
+	// A passive table only needs the seeds, the lookup waiting for the refresh
+	// queries them itself
+	if tab.passive {
+		return
+	}
+
 	// Run self lookup to discover new neighbor nodes.
 	//
 	// 先加载一波静态节点，然后根据当前节点信息先去刷一波桶拉回据当前节点的邻居节点
@@ -489,6 +558,7 @@ func (tab *Table) doRevalidate(done chan<- struct{}) {  // 随机 验证 k-bucke
 
 	// Ping the selected node and wait for a pong.
 	err := tab.net.ping(last.ID, last.addr())  // todo 对该 node 发出 ping 消息
+	tab.db.updateLiveness(last.ID, time.Now(), err == nil)
 
 	tab.mutex.Lock()
 	defer tab.mutex.Unlock()
@@ -49,7 +49,7 @@ func TestTable_pingReplace(t *testing.T) {
 
 func testPingReplace(t *testing.T, newNodeIsResponding, lastInBucketIsResponding bool) {
 	transport := newPingRecorder()
-	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil)
+	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil, false)
 	defer tab.Close()
 
 	<-tab.initDone
@@ -134,7 +134,7 @@ func TestBucket_bumpNoDuplicates(t *testing.T) {
 // This checks that the table-wide IP limit is applied correctly.
 func TestTable_IPLimit(t *testing.T) {
 	transport := newPingRecorder()
-	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil)
+	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil, false)
 	defer tab.Close()
 
 	for i := 0; i < tableIPLimit+1; i++ {
@@ -150,7 +150,7 @@ func TestTable_IPLimit(t *testing.T) {
 // This checks that the table-wide IP limit is applied correctly.
 func TestTable_BucketIPLimit(t *testing.T) {
 	transport := newPingRecorder()
-	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil)
+	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil, false)
 	defer tab.Close()
 
 	d := 3
@@ -222,7 +222,7 @@ func TestTable_closest(t *testing.T) {
 	test := func(test *closeTest) bool {
 		// for any node table, Target and N
 		transport := newPingRecorder()
-		tab, _ := newTable(transport, test.Self, &net.UDPAddr{}, "", nil)
+		tab, _ := newTable(transport, test.Self, &net.UDPAddr{}, "", nil, false)
 		defer tab.Close()
 		tab.stuff(test.All)
 
@@ -282,7 +282,7 @@ func TestTable_ReadRandomNodesGetAll(t *testing.T) {
 	}
 	test := func(buf []*Node) bool {
 		transport := newPingRecorder()
-		tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil)
+		tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil, false)
 		defer tab.Close()
 		<-tab.initDone
 
@@ -327,7 +327,7 @@ func (*closeTest) Generate(rand *rand.Rand, size int) reflect.Value {
 
 func TestTable_Lookup(t *testing.T) {
 	self := nodeAtDistance(common.Hash{}, 0)
-	tab, _ := newTable(lookupTestnet, self.ID, &net.UDPAddr{}, "", nil)
+	tab, _ := newTable(lookupTestnet, self.ID, &net.UDPAddr{}, "", nil, false)
 	defer tab.Close()
 
 	// lookup on empty table returns no nodes
@@ -660,3 +660,64 @@ func newkey() *ecdsa.PrivateKey {
 	}
 	return key
 }
+
+// findnodeCounter is a transport counting the findnode queries.
+type findnodeCounter struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (t *findnodeCounter) findnode(toid NodeID, toaddr *net.UDPAddr, target NodeID) ([]*Node, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count++
+	return nil, nil
+}
+
+func (t *findnodeCounter) queries() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.count
+}
+
+func (t *findnodeCounter) ping(toid NodeID, toaddr *net.UDPAddr) error { return nil }
+func (t *findnodeCounter) close()                                      {}
+
+// Tests that a passive table only queries the network within its lookup allowance
+// and serves the further lookups from the known nodes.
+func TestTable_PassiveLookup(t *testing.T) {
+	transport := new(findnodeCounter)
+	tab, _ := newTable(transport, NodeID{}, &net.UDPAddr{}, "", nil, true)
+	defer tab.Close()
+	<-tab.initDone
+
+	seed := NewNode(MustHexID("a502af0f59b2aab7746995408c79e9ca312d2793cc997e44fc55eda62f0150bbb8c59a6f9269ba3a081518b62699ee807c7c19c20125ddfccca872608af9e370"), net.IP{127, 0, 0, 1}, 30303, 30303)
+	tab.stuff([]*Node{seed})
+	if n := transport.queries(); n != 0 {
+		t.Fatalf("passive table issued %d queries on its own", n)
+	}
+	for i := 0; i < passiveLookupBurst; i++ {
+		tab.Lookup(NodeID{byte(i)})
+		if n := transport.queries(); n != i+1 {
+			t.Fatalf("lookup %d: query count mismatch: have %d, want %d", i, n, i+1)
+		}
+	}
+	// The allowance is exhausted, the known nodes are returned
+	if results := tab.Lookup(NodeID{0xff}); len(results) != 1 || results[0].ID != seed.ID {
+		t.Errorf("local lookup result mismatch: %v", results)
+	}
+	if n := transport.queries(); n != passiveLookupBurst {
+		t.Errorf("query count mismatch after exhausted allowance: have %d, want %d", n, passiveLookupBurst)
+	}
+	// A new lookup is allowed after the interval
+	tab.mutex.Lock()
+	tab.lookupRefill = tab.lookupRefill.Add(-passiveLookupInterval)
+	tab.mutex.Unlock()
+
+	tab.Lookup(NodeID{0xfe})
+	if n := transport.queries(); n != passiveLookupBurst+1 {
+		t.Errorf("query count mismatch after refill: have %d, want %d", n, passiveLookupBurst+1)
+	}
+}
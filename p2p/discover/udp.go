@@ -224,6 +224,10 @@ type Config struct {
 	NetRestrict  *netutil.Netlist  // network whitelist
 	Bootnodes    []*Node           // list of bootstrap nodes
 	Unhandled    chan<- ReadPacket // unhandled packets are sent on this channel
+
+	// Passive answers pings but looks up nodes only on demand at a limited rate,
+	// without any table maintenance traffic (e.g. for mobile light clients)
+	Passive bool
 }
 
 // ListenUDP returns a new table that listens for UDP packets on laddr.
@@ -253,7 +257,7 @@ func newUDP(c conn, cfg Config) (*Table, *udp, error) {
 	}
 	// TODO: separate TCP port
 	udp.ourEndpoint = makeEndpoint(realaddr, uint16(realaddr.Port))
-	tab, err := newTable(udp, PubkeyID(&cfg.PrivateKey.PublicKey), realaddr, cfg.NodeDBPath, cfg.Bootnodes)
+	tab, err := newTable(udp, PubkeyID(&cfg.PrivateKey.PublicKey), realaddr, cfg.NodeDBPath, cfg.Bootnodes, cfg.Passive)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -609,9 +613,12 @@ func (req *ping) handle(t *udp, from *net.UDPAddr, fromID NodeID, mac []byte) er
 
 	// Add the node to the table. Before doing so, ensure that we have a recent enough pong
 	// recorded in the database so their findnode requests will be accepted later.
+	// A passive table doesn't ping back, unknown nodes are simply not added.
 	n := NewNode(fromID, from.IP, uint16(from.Port), req.From.TCP)
 	if time.Since(t.db.lastPongReceived(fromID)) > nodeDBNodeExpiration {
-		t.sendPing(fromID, from, func() { t.addThroughPing(n) })
+		if !t.passive {
+			t.sendPing(fromID, from, func() { t.addThroughPing(n) })
+		}
 	} else {
 		t.addThroughPing(n)
 	}
@@ -0,0 +1,163 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+// defaultFaultHold is the time a message held back for reordering is sent after
+// if the protocol doesn't write another one, unless the rule sets a MaxDelay.
+const defaultFaultHold = 100 * time.Millisecond
+
+var (
+	faultDropMeter    = metrics.NewRegisteredMeter("p2p/faults/dropped", nil)
+	faultDelayMeter   = metrics.NewRegisteredMeter("p2p/faults/delayed", nil)
+	faultReorderMeter = metrics.NewRegisteredMeter("p2p/faults/reordered", nil)
+)
+
+// MsgFaultRule is the fault injection policy of the messages with a given code.
+// The probabilities are checked in order: a message is either dropped, delayed,
+// held back until the next message is written, or sent untouched.
+type MsgFaultRule struct {
+	Drop     float64       // probability of silently dropping a message
+	Delay    float64       // probability of delaying a message by a random time up to MaxDelay
+	Reorder  float64       // probability of sending a message after the next one
+	MaxDelay time.Duration // upper bound of the delays and of holding a message back
+}
+
+// MsgFaultConfig describes the network faults injected into the messages written
+// by a protocol. It is meant for soak testing the retry and timeout logic of the
+// protocols under adverse network conditions, never for production use.
+//
+// MsgFaultConfig: 对子协议写出的 msg 按 code 随机 丢弃/延迟/乱序, 用于 dev 环境的 soak 测试
+type MsgFaultConfig struct {
+	Seed    int64                   // seed of the random decisions, same seed same faults
+	Default MsgFaultRule            // rule of the message codes not listed in Codes
+	Codes   map[uint64]MsgFaultRule // rules by protocol message code
+}
+
+// rule returns the fault policy of a message code.
+func (c *MsgFaultConfig) rule(code uint64) MsgFaultRule {
+	if rule, ok := c.Codes[code]; ok {
+		return rule
+	}
+	return c.Default
+}
+
+// NewMsgFaultInjector creates an interceptor injecting the configured faults into
+// the messages written by a protocol. Install it on both ends of a connection to
+// disturb the traffic in both directions.
+func NewMsgFaultInjector(config MsgFaultConfig) MsgInterceptor {
+	return func(peer *Peer, rw MsgReadWriter) MsgReadWriter {
+		return NewFaultyMsgReadWriter(rw, config)
+	}
+}
+
+// faultyMsgReadWriter is a MsgReadWriter injecting faults into the written messages.
+type faultyMsgReadWriter struct {
+	MsgReadWriter
+	config MsgFaultConfig
+
+	lock sync.Mutex
+	rand *rand.Rand
+	held *Msg        // message held back for reordering
+	hold *time.Timer // flushes the held message if no other one is written
+}
+
+// NewFaultyMsgReadWriter wraps a MsgReadWriter, dropping, delaying and reordering
+// the messages written through it according to the given config. Messages are
+// read untouched. Delayed and reordered messages are sent in the background, so
+// their write errors are not reported.
+func NewFaultyMsgReadWriter(rw MsgReadWriter, config MsgFaultConfig) MsgReadWriter {
+	return &faultyMsgReadWriter{
+		MsgReadWriter: rw,
+		config:        config,
+		rand:          rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+func (rw *faultyMsgReadWriter) WriteMsg(msg Msg) error {
+	// The payload is consumed right away, the message may be sent later
+	data, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = bytes.NewReader(data)
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	// A previously held message is sent right after this one
+	held := rw.held
+	if held != nil {
+		rw.held = nil
+		rw.hold.Stop()
+	}
+	rule := rw.config.rule(msg.Code)
+	switch {
+	case rule.Drop > 0 && rw.rand.Float64() < rule.Drop:
+		faultDropMeter.Mark(1)
+		log.Trace("Dropping message", "code", msg.Code, "size", msg.Size)
+
+	case rule.Delay > 0 && rw.rand.Float64() < rule.Delay:
+		var delay time.Duration
+		if rule.MaxDelay > 0 {
+			delay = time.Duration(rw.rand.Int63n(int64(rule.MaxDelay)))
+		}
+		faultDelayMeter.Mark(1)
+		log.Trace("Delaying message", "code", msg.Code, "size", msg.Size, "delay", delay)
+		time.AfterFunc(delay, func() { rw.MsgReadWriter.WriteMsg(msg) })
+
+	case held == nil && rule.Reorder > 0 && rw.rand.Float64() < rule.Reorder:
+		hold := rule.MaxDelay
+		if hold == 0 {
+			hold = defaultFaultHold
+		}
+		faultReorderMeter.Mark(1)
+		log.Trace("Holding back message", "code", msg.Code, "size", msg.Size)
+		rw.held = &msg
+		rw.hold = time.AfterFunc(hold, rw.flush)
+
+	default:
+		err = rw.MsgReadWriter.WriteMsg(msg)
+	}
+	if held != nil {
+		if err := rw.MsgReadWriter.WriteMsg(*held); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// flush sends the held back message if no other message was written meanwhile.
+func (rw *faultyMsgReadWriter) flush() {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	if rw.held != nil {
+		rw.MsgReadWriter.WriteMsg(*rw.held)
+		rw.held = nil
+	}
+}
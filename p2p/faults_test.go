@@ -0,0 +1,138 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readCodes reads n messages from rw, returning their codes.
+func readCodes(t *testing.T, rw MsgReader, n int) []uint64 {
+	var codes []uint64
+	for i := 0; i < n; i++ {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read message %d: %v", i, err)
+		}
+		msg.Discard()
+		codes = append(codes, msg.Code)
+	}
+	return codes
+}
+
+func TestFaultyMsgReadWriterDrop(t *testing.T) {
+	app, net := MsgPipe()
+	defer app.Close()
+
+	rw := NewFaultyMsgReadWriter(app, MsgFaultConfig{Codes: map[uint64]MsgFaultRule{1: {Drop: 1}}})
+	go func() {
+		for _, code := range []uint64{1, 2, 1, 3} {
+			if err := SendItems(rw, code, code); err != nil {
+				t.Errorf("failed to send message %d: %v", code, err)
+			}
+		}
+	}()
+	if codes := readCodes(t, net, 2); !reflect.DeepEqual(codes, []uint64{2, 3}) {
+		t.Errorf("received messages mismatch: have %v, want [2 3]", codes)
+	}
+}
+
+func TestFaultyMsgReadWriterReorder(t *testing.T) {
+	app, net := MsgPipe()
+	defer app.Close()
+
+	rw := NewFaultyMsgReadWriter(app, MsgFaultConfig{Codes: map[uint64]MsgFaultRule{1: {Reorder: 1}}})
+	go func() {
+		for _, code := range []uint64{1, 2, 1} {
+			if err := SendItems(rw, code, code); err != nil {
+				t.Errorf("failed to send message %d: %v", code, err)
+			}
+		}
+	}()
+	// the first message is sent after the second one, the last one is flushed
+	// after the hold time
+	start := time.Now()
+	if codes := readCodes(t, net, 3); !reflect.DeepEqual(codes, []uint64{2, 1, 1}) {
+		t.Errorf("received messages mismatch: have %v, want [2 1 1]", codes)
+	}
+	if elapsed := time.Since(start); elapsed < defaultFaultHold {
+		t.Errorf("held message flushed too early: %v", elapsed)
+	}
+}
+
+func TestFaultyMsgReadWriterDelay(t *testing.T) {
+	app, net := MsgPipe()
+	defer app.Close()
+
+	rw := NewFaultyMsgReadWriter(app, MsgFaultConfig{Default: MsgFaultRule{Delay: 1, MaxDelay: 50 * time.Millisecond}})
+	go func() {
+		for code := uint64(0); code < 5; code++ {
+			if err := SendItems(rw, code, code); err != nil {
+				t.Errorf("failed to send message %d: %v", code, err)
+			}
+		}
+	}()
+	received := make(map[uint64]bool)
+	for _, code := range readCodes(t, net, 5) {
+		received[code] = true
+	}
+	if len(received) != 5 {
+		t.Errorf("delayed messages lost: received %v", received)
+	}
+}
+
+// Tests that the faults are reproducible with the same seed.
+func TestFaultyMsgReadWriterSeed(t *testing.T) {
+	delivered := func(seed int64) []uint64 {
+		app, net := MsgPipe()
+		defer app.Close()
+
+		config := MsgFaultConfig{
+			Seed:    seed,
+			Default: MsgFaultRule{Drop: 0.5},
+			Codes:   map[uint64]MsgFaultRule{1000: {}}, // the end marker is never dropped
+		}
+		rw := NewFaultyMsgReadWriter(app, config)
+		go func() {
+			for code := uint64(0); code < 100; code++ {
+				SendItems(rw, code)
+			}
+			SendItems(rw, 1000)
+		}()
+		var codes []uint64
+		for {
+			msg, err := net.ReadMsg()
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+			msg.Discard()
+			if msg.Code == 1000 {
+				return codes
+			}
+			codes = append(codes, msg.Code)
+		}
+	}
+	first, second := delivered(1), delivered(1)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("faults not reproducible:\nfirst:  %v\nsecond: %v", first, second)
+	}
+	if len(first) == 0 || len(first) == 100 {
+		t.Errorf("unexpected number of delivered messages: %d", len(first))
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// LinkConfig describes the shaping applied to one direction of a loopback link.
+//
+// LinkConfig: 用于对 loopback 链路做 延迟/带宽 整形, 方便在没有 socket 的情况下对协议 handler 做 benchmark
+type LinkConfig struct {
+	Latency   time.Duration // One-way delivery delay of every message
+	Bandwidth int           // Bytes per second, zero means unlimited
+	QueueSize int           // Number of in-flight messages before writes block (default 64)
+}
+
+// LoopbackPipe creates an in-process MsgReadWriter pair. Unlike MsgPipe, writes
+// don't wait for the payload to be consumed: messages are buffered and delivered
+// to the other end after the transmission time implied by the bandwidth limit
+// plus the configured latency, like they would be over a real connection.
+func LoopbackPipe(config LinkConfig) (*LoopbackRW, *LoopbackRW) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 64
+	}
+	var (
+		c1, c2  = make(chan loopbackMsg, config.QueueSize), make(chan loopbackMsg, config.QueueSize)
+		closing = make(chan struct{})
+		once    = new(sync.Once)
+		rw1     = &LoopbackRW{config: config, w: c1, r: c2, closing: closing, once: once}
+		rw2     = &LoopbackRW{config: config, w: c2, r: c1, closing: closing, once: once}
+	)
+	return rw1, rw2
+}
+
+// loopbackMsg is a message in flight together with its scheduled arrival.
+type loopbackMsg struct {
+	msg       Msg
+	deliverAt time.Time
+}
+
+// LoopbackRW is an endpoint of a shaped loopback pipe.
+type LoopbackRW struct {
+	config LinkConfig
+	w      chan<- loopbackMsg
+	r      <-chan loopbackMsg
+
+	wlock  sync.Mutex
+	txDone time.Time // time the last written message leaves the "wire"
+
+	closing chan struct{}
+	once    *sync.Once
+}
+
+// WriteMsg sends a message to the other end of the pipe. It blocks for the time
+// it takes to push the payload through the bandwidth limited link.
+func (p *LoopbackRW) WriteMsg(msg Msg) error {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = bytes.NewReader(payload)
+	msg.Size = uint32(len(payload))
+
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+
+	// select picks randomly among ready cases, the closed state is checked first
+	// so no write can succeed after Close returned
+	if p.closed() {
+		return ErrPipeClosed
+	}
+	now := time.Now()
+	if p.txDone.Before(now) {
+		p.txDone = now
+	}
+	if p.config.Bandwidth > 0 {
+		p.txDone = p.txDone.Add(time.Duration(len(payload)) * time.Second / time.Duration(p.config.Bandwidth))
+	}
+	select {
+	case p.w <- loopbackMsg{msg, p.txDone.Add(p.config.Latency)}:
+	case <-p.closing:
+		return ErrPipeClosed
+	}
+	// the writer is busy while the message is being transmitted
+	if wait := time.Until(p.txDone); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-p.closing:
+			return ErrPipeClosed
+		}
+	}
+	return nil
+}
+
+// ReadMsg returns the next message sent on the other end of the pipe, waiting
+// until its scheduled arrival time.
+func (p *LoopbackRW) ReadMsg() (Msg, error) {
+	if p.closed() {
+		return Msg{}, ErrPipeClosed
+	}
+	select {
+	case lm := <-p.r:
+		if wait := time.Until(lm.deliverAt); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-p.closing:
+				return Msg{}, ErrPipeClosed
+			}
+		}
+		lm.msg.ReceivedAt = time.Now()
+		return lm.msg, nil
+	case <-p.closing:
+		return Msg{}, ErrPipeClosed
+	}
+}
+
+// closed reports whether the pipe has been closed.
+func (p *LoopbackRW) closed() bool {
+	select {
+	case <-p.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close unblocks any pending ReadMsg and WriteMsg calls on both ends of the
+// pipe. They will return ErrPipeClosed.
+func (p *LoopbackRW) Close() error {
+	p.once.Do(func() { close(p.closing) })
+	return nil
+}
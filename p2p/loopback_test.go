@@ -0,0 +1,90 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopbackPipeShaping(t *testing.T) {
+	rw1, rw2 := LoopbackPipe(LinkConfig{Latency: 20 * time.Millisecond, Bandwidth: 100000})
+	defer rw1.Close()
+
+	// 1000 bytes at 100kB/s take 10ms to transmit, plus 20ms latency
+	start := time.Now()
+	if err := Send(rw1, 3, make([]byte, 1000)); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	var data []byte
+	msg, err := rw2.ReadMsg()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if err := msg.Decode(&data); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if msg.Code != 3 || len(data) != 1000 {
+		t.Errorf("message mismatch: code %d, %d bytes", msg.Code, len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("message delivered too early: %v", elapsed)
+	}
+}
+
+func TestLoopbackPipeClose(t *testing.T) {
+	rw1, rw2 := LoopbackPipe(LinkConfig{QueueSize: 4})
+
+	// leave a message in flight, it must not be delivered after closing
+	if err := Send(rw1, 3, []uint{}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	rw2.Close()
+
+	// the write queue has free slots, writes must fail nevertheless
+	for i := 0; i < 100; i++ {
+		if err := Send(rw1, 3, []uint{}); err != ErrPipeClosed {
+			t.Fatalf("write %d on closed pipe: have %v, want %v", i, err, ErrPipeClosed)
+		}
+		if _, err := rw2.ReadMsg(); err != ErrPipeClosed {
+			t.Fatalf("read %d on closed pipe: have %v, want %v", i, err, ErrPipeClosed)
+		}
+	}
+}
+
+func BenchmarkLoopbackPipe(b *testing.B) {
+	rw1, rw2 := LoopbackPipe(LinkConfig{})
+	defer rw1.Close()
+
+	payload := make([]byte, 1024)
+	n := b.N
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := Send(rw1, 1, payload); err != nil {
+				return
+			}
+		}
+	}()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		msg, err := rw2.ReadMsg()
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg.Discard()
+	}
+}
@@ -248,6 +248,46 @@ func ExpectMsg(r MsgReader, code uint64, content interface{}) error {
 	return nil
 }
 
+// MsgInterceptor wraps the MsgReadWriter of a protocol running on a peer. The
+// returned MsgReadWriter is passed to the protocol instead of the original one.
+//
+// MsgInterceptor: 子协议 MsgReadWriter 的中间件 (限流, 日志, 故障注入等), 见 Protocol.Interceptors
+type MsgInterceptor func(peer *Peer, rw MsgReadWriter) MsgReadWriter
+
+// InterceptMsgs creates an interceptor passing the messages read and written by
+// the protocol through the given functions, either of which may be nil. An error
+// returned by a function is returned to the protocol instead of the message.
+func InterceptMsgs(read, write func(peer *Peer, msg Msg) (Msg, error)) MsgInterceptor {
+	return func(peer *Peer, rw MsgReadWriter) MsgReadWriter {
+		return &funcInterceptor{MsgReadWriter: rw, peer: peer, read: read, write: write}
+	}
+}
+
+// funcInterceptor is the MsgReadWriter created by InterceptMsgs.
+type funcInterceptor struct {
+	MsgReadWriter
+	peer        *Peer
+	read, write func(peer *Peer, msg Msg) (Msg, error)
+}
+
+func (i *funcInterceptor) ReadMsg() (Msg, error) {
+	msg, err := i.MsgReadWriter.ReadMsg()
+	if err != nil || i.read == nil {
+		return msg, err
+	}
+	return i.read(i.peer, msg)
+}
+
+func (i *funcInterceptor) WriteMsg(msg Msg) error {
+	if i.write != nil {
+		var err error
+		if msg, err = i.write(i.peer, msg); err != nil {
+			return err
+		}
+	}
+	return i.MsgReadWriter.WriteMsg(msg)
+}
+
 // msgEventer wraps a MsgReadWriter and sends events whenever a message is sent
 // or received
 type msgEventer struct {
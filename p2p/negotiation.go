@@ -0,0 +1,87 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+const (
+	handshakeResultDone    = "done"
+	handshakeResultTimeout = "timeout"
+)
+
+// protoHandshakeCounter counts the subprotocol handshakes of the inbound peers
+// by protocol and outcome.
+//
+// 按 子协议 和 结果 (done/timeout) 统计 连入 peer 的 子协议握手
+var protoHandshakeCounter = metrics.NewLabeledCounter("p2p/handshake", []string{"proto", "result"}, 64, nil)
+
+// setHandshakeBudgets overrides the handshake timeouts of the protocols run by
+// the peer with the configured ones, keyed by protocol name.
+func (p *Peer) setHandshakeBudgets(budgets map[string]time.Duration) {
+	for name, proto := range p.running {
+		if budget, ok := budgets[name]; ok {
+			proto.HandshakeTimeout = budget
+		}
+	}
+}
+
+// startHandshakeTimer starts the handshake budget of a protocol started for an
+// inbound peer, disconnecting the peer if the protocol doesn't report its
+// handshake done in time. The devp2p handshakes are already over at this point,
+// so a peer completing the encryption but stalling in the status exchange of a
+// subprotocol (e.g. les) is shed quickly instead of holding a slot.
+//
+/**
+startHandshakeTimer: 对 连入 的 peer, 在子协议启动时 开始计时,
+子协议 在 HandshakeTimeout 内 没有调用 HandshakeDone (例如 les 的 status 交换 卡住) 的话 断开该 peer;
+与 devp2p 的握手 (加密 + protoHandshake) 超时 分开计算
+ */
+func (p *Peer) startHandshakeTimer(proto *protoRW) {
+	if proto.HandshakeTimeout <= 0 || !p.Inbound() {
+		return
+	}
+	proto.hsTimer = time.AfterFunc(proto.HandshakeTimeout, func() {
+		protoHandshakeCounter.With(proto.Name, handshakeResultTimeout).Inc(1)
+		p.log.Debug("Protocol handshake timed out", "proto", proto.Name, "budget", proto.HandshakeTimeout)
+		p.Disconnect(DiscReadTimeout)
+	})
+}
+
+// stopHandshakeTimers stops the handshake budgets of the disconnected peer.
+func (p *Peer) stopHandshakeTimers() {
+	for _, proto := range p.running {
+		if proto.hsTimer != nil {
+			proto.hsTimer.Stop()
+		}
+	}
+}
+
+// HandshakeDone is called by a protocol when its handshake with the peer
+// completed, stopping its handshake budget.
+func (p *Peer) HandshakeDone(protocol string) {
+	proto, ok := p.running[protocol]
+	if !ok || proto.hsTimer == nil {
+		return
+	}
+	if proto.hsTimer.Stop() {
+		protoHandshakeCounter.With(protocol, handshakeResultDone).Inc(1)
+	}
+}
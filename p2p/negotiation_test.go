@@ -0,0 +1,112 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testInboundPeer runs an inbound peer with the given protocols, returning the
+// peer and the channel of its disconnect error.
+func testInboundPeer(protos []Protocol, budgets map[string]time.Duration) (*Peer, func(), <-chan error) {
+	fd1, fd2 := net.Pipe()
+	c1 := &conn{fd: fd1, transport: newTestTransport(randomID(), fd1), flags: inboundConn}
+	c2 := &conn{fd: fd2, transport: newTestTransport(randomID(), fd2)}
+	for _, p := range protos {
+		c1.caps = append(c1.caps, p.cap())
+	}
+	peer := newPeer(c1, protos)
+	peer.setHandshakeBudgets(budgets)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := peer.run()
+		errc <- err
+	}()
+	return peer, func() { c2.close(DiscQuitting) }, errc
+}
+
+// Tests that an inbound peer stalling in the handshake of a protocol is dropped
+// once the budget of the protocol runs out, while the one completing it in time
+// is kept.
+func TestProtocolHandshakeBudget(t *testing.T) {
+	stall := Protocol{
+		Name:             "stall",
+		Length:           1,
+		HandshakeTimeout: 50 * time.Millisecond,
+		Run: func(peer *Peer, rw MsgReadWriter) error {
+			_, err := rw.ReadMsg()
+			return err
+		},
+	}
+	_, closer, errc := testInboundPeer([]Protocol{stall}, nil)
+	defer closer()
+
+	select {
+	case err := <-errc:
+		if err != DiscReadTimeout {
+			t.Errorf("stalling peer dropped with wrong reason: have %v, want %v", err, DiscReadTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stalling peer not dropped")
+	}
+
+	done := Protocol{
+		Name:             "done",
+		Length:           1,
+		HandshakeTimeout: 50 * time.Millisecond,
+		Run: func(peer *Peer, rw MsgReadWriter) error {
+			peer.HandshakeDone("done")
+			_, err := rw.ReadMsg()
+			return err
+		},
+	}
+	_, closer, errc = testInboundPeer([]Protocol{done}, nil)
+	defer closer()
+
+	select {
+	case err := <-errc:
+		t.Fatalf("peer completing the handshake dropped: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// Tests that the configured budgets override the ones of the protocols.
+func TestProtocolHandshakeBudgetOverride(t *testing.T) {
+	stall := Protocol{
+		Name:             "stall",
+		Length:           1,
+		HandshakeTimeout: 50 * time.Millisecond,
+		Run: func(peer *Peer, rw MsgReadWriter) error {
+			_, err := rw.ReadMsg()
+			return err
+		},
+	}
+	peer, closer, errc := testInboundPeer([]Protocol{stall}, map[string]time.Duration{"stall": 0})
+	defer closer()
+
+	select {
+	case err := <-errc:
+		t.Fatalf("peer dropped with the budget disabled: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if budget := peer.running["stall"].HandshakeTimeout; budget != 0 {
+		t.Errorf("budget not overridden: %v", budget)
+	}
+}
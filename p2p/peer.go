@@ -95,6 +95,11 @@ const (
 	// PeerEventTypeMsgRecv is the type of event emitted when a
 	// message is received from a peer
 	PeerEventTypeMsgRecv PeerEventType = "msgrecv"
+
+	// PeerEventTypeHandshakeFail is the type of event emitted when the
+	// handshakes of a connection fail or the peer is rejected by the checks
+	// following them
+	PeerEventTypeHandshakeFail PeerEventType = "handshakefail"
 )
 
 // PeerEvent is an event emitted when peers are either added or dropped from
@@ -106,6 +111,8 @@ type PeerEvent struct {
 	Protocol string          `json:"protocol,omitempty"`
 	MsgCode  *uint64         `json:"msg_code,omitempty"`
 	MsgSize  *uint32         `json:"msg_size,omitempty"`
+
+	RemoteAddr string `json:"remote_addr,omitempty"` // Set for failed handshakes, the peer may be unknown
 }
 
 // Peer represents a connected remote node.
@@ -125,6 +132,14 @@ type Peer struct {
 
 	// events receives message send / receive events if set
 	events *event.Feed
+
+	// reason of the disconnect, set when run returns
+	dropReason DiscReason
+
+	// metadata of the previous session and of the current one, see PeerMeta
+	metaLock sync.Mutex
+	prevMeta *PeerMeta
+	meta     *PeerMeta
 }
 
 // NewPeer returns a peer for testing purposes.
@@ -183,6 +198,11 @@ func (p *Peer) Inbound() bool {  // 当前 peer 是否为 接进来的 peer
 
 func newPeer(conn *conn, protocols []Protocol) *Peer {
 	protomap := matchProtocols(protocols, conn.caps, conn)
+	if t, ok := conn.transport.(interface{ compressed() bool }); !ok || !t.compressed() {
+		for _, rw := range protomap {
+			rw.compress = rw.Compress && hasCap(conn.zcaps, rw.cap())
+		}
+	}
 	p := &Peer{
 		rw:       conn,
 		running:  protomap,
@@ -191,6 +211,7 @@ func newPeer(conn *conn, protocols []Protocol) *Peer {
 		protoErr: make(chan error, len(protomap)+1), // protocols + pingLoop
 		closed:   make(chan struct{}),
 		log:      log.New("id", conn.id, "conn", conn.flags),
+		meta:     new(PeerMeta),
 	}
 	return p
 }
@@ -199,6 +220,65 @@ func (p *Peer) Log() log.Logger {
 	return p.log
 }
 
+// PreviousMeta returns the metadata of the peer stored at the end of its previous
+// session, or nil if the peer is not known.
+func (p *Peer) PreviousMeta() *PeerMeta {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+	return p.prevMeta.copy()
+}
+
+// SetScore sets the score of the peer in the given protocol. The score is stored
+// with the metadata of the peer when it disconnects.
+func (p *Peer) SetScore(protocol string, score float64) {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+
+	if p.meta.Scores == nil {
+		p.meta.Scores = make(map[string]float64)
+	}
+	p.meta.Scores[protocol] = score
+}
+
+// SetMetaData sets protocol specific data of the peer, which is stored with the
+// metadata of the peer when it disconnects. Nil data removes the entry.
+func (p *Peer) SetMetaData(protocol string, data []byte) {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+
+	if data == nil {
+		delete(p.meta.Data, protocol)
+		return
+	}
+	if p.meta.Data == nil {
+		p.meta.Data = make(map[string][]byte)
+	}
+	p.meta.Data[protocol] = append([]byte(nil), data...)
+}
+
+// setPreviousMeta installs the metadata of the previous session, which the
+// current session starts from.
+func (p *Peer) setPreviousMeta(meta *PeerMeta) {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+
+	p.prevMeta = meta
+	if meta != nil {
+		p.meta = meta.copy()
+	}
+}
+
+// sessionMeta returns the metadata of the current session to be stored.
+func (p *Peer) sessionMeta() *PeerMeta {
+	p.metaLock.Lock()
+	defer p.metaLock.Unlock()
+
+	meta := p.meta.copy()
+	meta.Caps = p.Caps()
+	meta.LastSeen = time.Now()
+	return meta
+}
+
 func (p *Peer) run() (remoteRequested bool, err error) {
 	var (
 		writeStart = make(chan struct{}, 1)
@@ -246,8 +326,10 @@ loop:
 	}
 
 	close(p.closed)
+	p.stopHandshakeTimers()
 	p.rw.close(reason)
 	p.wg.Wait()
+	p.dropReason = reason
 	return remoteRequested, err
 }
 
@@ -329,6 +411,22 @@ func countMatchingProtocols(protocols []Protocol, caps []Cap) int {
 	return n
 }
 
+// runsProtocol tells whether a peer with the given capabilities runs any version
+// of the named protocol.
+func runsProtocol(protocols []Protocol, caps []Cap, name string) bool {
+	for _, cap := range caps {
+		if cap.Name != name {
+			continue
+		}
+		for _, proto := range protocols {
+			if proto.Name == cap.Name && proto.Version == cap.Version {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // matchProtocols creates structures for matching named subprotocols.
 func matchProtocols(protocols []Protocol, caps []Cap, rw MsgReadWriter) map[string]*protoRW {
 	sort.Sort(capsByNameAndVersion(caps))
@@ -367,7 +465,14 @@ func (p *Peer) startProtocols(writeStart <-chan struct{}, writeErr chan<- error)
 		if p.events != nil {
 			rw = newMsgEventer(rw, p.events, p.ID(), proto.Name)
 		}
+		for i := len(proto.Interceptors) - 1; i >= 0; i-- {
+			rw = proto.Interceptors[i](p, rw)
+		}
 		p.log.Trace(fmt.Sprintf("Starting protocol %s/%d", proto.Name, proto.Version))
+		if proto.OnHandshake != nil {
+			proto.OnHandshake(p)
+		}
+		p.startHandshakeTimer(proto)
 		go func() {
 			err := proto.Run(p, rw)  // todo 这个就是 eth\handler.go 的 ProtocalManager的 NewProtocolManager() 中实现的 protocol.Run() 回调, 最终会调用 `manager.handle(peer)`
 			if err == nil {
@@ -401,6 +506,9 @@ type protoRW struct {
 	werr   chan<- error    // for write results
 	offset uint64
 	w      MsgWriter
+
+	compress bool        // whether message payloads are snappy compressed
+	hsTimer  *time.Timer // handshake budget of the protocol, nil if unlimited
 }
 
 func (rw *protoRW) WriteMsg(msg Msg) (err error) {
@@ -408,6 +516,11 @@ func (rw *protoRW) WriteMsg(msg Msg) (err error) {
 		return newPeerError(errInvalidMsgCode, "not handled")
 	}
 	msg.Code += rw.offset
+	if rw.compress {
+		if msg, err = compressMsg(msg); err != nil {
+			return err
+		}
+	}
 	select {
 	case <-rw.wstart:
 		err = rw.w.WriteMsg(msg)
@@ -426,6 +539,9 @@ func (rw *protoRW) ReadMsg() (Msg, error) {
 	select {
 	case msg := <-rw.in:
 		msg.Code -= rw.offset
+		if rw.compress {
+			return decompressMsg(msg)
+		}
 		return msg, nil
 	case <-rw.closed:
 		return Msg{}, io.EOF
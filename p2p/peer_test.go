@@ -22,8 +22,11 @@ import (
 	"math/rand"
 	"net"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
 )
 
 var discard = Protocol{
@@ -50,6 +53,9 @@ func testPeer(protos []Protocol) (func(), *conn, *Peer, <-chan error) {
 	for _, p := range protos {
 		c1.caps = append(c1.caps, p.cap())
 		c2.caps = append(c2.caps, p.cap())
+		if p.Compress {
+			c1.zcaps = append(c1.zcaps, p.cap())
+		}
 	}
 
 	peer := newPeer(c1, protos)
@@ -120,6 +126,134 @@ func TestPeerProtoEncodeMsg(t *testing.T) {
 	}
 }
 
+func TestPeerProtoCompression(t *testing.T) {
+	proto := Protocol{
+		Name:     "a",
+		Length:   2,
+		Compress: true,
+		Run: func(peer *Peer, rw MsgReadWriter) error {
+			if err := ExpectMsg(rw, 1, []string{"foo", "bar"}); err != nil {
+				t.Error(err)
+			}
+			return SendItems(rw, 1, "baz")
+		},
+	}
+	closer, rw, _, _ := testPeer([]Protocol{proto})
+	defer closer()
+
+	// Messages on the wire are compressed, the protocol sees the plain ones
+	size, r, _ := rlp.EncodeToReader([]string{"foo", "bar"})
+	msg, _ := compressMsg(Msg{Code: 17, Size: uint32(size), Payload: r})
+	if err := rw.WriteMsg(msg); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	msg, err := rw.ReadMsg()
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if msg, err = decompressMsg(msg); err != nil {
+		t.Fatalf("payload not compressed: %v", err)
+	}
+	var content []string
+	if err := msg.Decode(&content); err != nil || !reflect.DeepEqual(content, []string{"baz"}) {
+		t.Errorf("reply mismatch: have %v (%v), want [baz]", content, err)
+	}
+}
+
+func TestCompressedCapsHandshake(t *testing.T) {
+	protos := []Protocol{
+		{Name: "a", Version: 1},
+		{Name: "b", Version: 2, Compress: true},
+	}
+	hs := &protoHandshake{Version: baseProtocolVersion, Caps: []Cap{protos[0].cap(), protos[1].cap()}}
+	hs.setCompressedCaps(protos)
+
+	enc, err := rlp.EncodeToBytes(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec protoHandshake
+	if err := rlp.DecodeBytes(enc, &dec); err != nil {
+		t.Fatal(err)
+	}
+	if caps := dec.compressedCaps(); !reflect.DeepEqual(caps, []Cap{{"b", 2}}) {
+		t.Errorf("compressed caps mismatch: have %v, want [b/2]", caps)
+	}
+	// Peers announcing compressed protocols on both sides don't compress the
+	// whole connection, even with a snappy capable version
+	if snappyConn(hs, &dec) {
+		t.Errorf("whole connection compressed despite compressed protocols")
+	}
+	hs.setCompressedCaps(protos[:1])
+	if caps := hs.compressedCaps(); caps != nil {
+		t.Errorf("unexpected compressed caps: %v", caps)
+	}
+	if !snappyConn(hs, &dec) || !snappyConn(&dec, hs) {
+		t.Errorf("whole connection not compressed with a plain peer")
+	}
+	if dec.Version = snappyProtocolVersion - 1; snappyConn(hs, &dec) {
+		t.Errorf("whole connection compressed with a legacy peer")
+	}
+}
+
+func TestPeerProtoInterceptors(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		trace []string
+	)
+	record := func(name string) MsgInterceptor {
+		return InterceptMsgs(
+			func(p *Peer, msg Msg) (Msg, error) {
+				lock.Lock()
+				trace = append(trace, fmt.Sprintf("%s read %d", name, msg.Code))
+				lock.Unlock()
+				return msg, nil
+			},
+			func(p *Peer, msg Msg) (Msg, error) {
+				lock.Lock()
+				trace = append(trace, fmt.Sprintf("%s write %d", name, msg.Code))
+				lock.Unlock()
+				return msg, nil
+			},
+		)
+	}
+	errInjected := errors.New("injected fault")
+	faults := InterceptMsgs(nil, func(p *Peer, msg Msg) (Msg, error) {
+		if msg.Code == 2 {
+			return msg, errInjected
+		}
+		return msg, nil
+	})
+	proto := Protocol{
+		Name:         "a",
+		Length:       5,
+		Interceptors: []MsgInterceptor{record("outer"), record("inner"), faults},
+		Run: func(peer *Peer, rw MsgReadWriter) error {
+			if err := ExpectMsg(rw, 3, []uint{1}); err != nil {
+				t.Error(err)
+			}
+			if err := SendItems(rw, 2); err != errInjected {
+				t.Errorf("injected fault mismatch: have %v, want %v", err, errInjected)
+			}
+			return SendItems(rw, 4)
+		},
+	}
+	closer, rw, _, _ := testPeer([]Protocol{proto})
+	defer closer()
+
+	Send(rw, baseProtocolLength+3, []uint{1})
+	if err := ExpectMsg(rw, baseProtocolLength+4, nil); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	want := []string{"inner read 3", "outer read 3", "outer write 2", "inner write 2", "outer write 4", "inner write 4"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("interceptor trace mismatch:\nhave %q\nwant %q", trace, want)
+	}
+}
+
 func TestPeerPing(t *testing.T) {
 	closer, rw, _, _ := testPeer(nil)
 	defer closer()
@@ -0,0 +1,158 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// peerMetaExpiry is the time after which the metadata of a peer not seen again
+// is dropped.
+const peerMetaExpiry = 30 * 24 * time.Hour
+
+var peerMetaPrefix = []byte("p:") // Identifier to prefix peer metadata entries with
+
+// PeerMeta is the metadata of a peer kept across sessions and restarts. The
+// metadata stored at the end of the previous session is available to the
+// protocols when the peer connects again, see Peer.PreviousMeta.
+//
+/**
+PeerMeta:
+对端 peer 的元数据 (上次协商的 caps, 最后一次见到的时间, 各个协议记录的分数和数据),
+持久化在 peer db 中, 跨重启保留, 对端再次连接时协议可以直接使用之前的信息
+(例如 les client 可以立即应用某个 server 已知的 cost table 特征)
+*/
+type PeerMeta struct {
+	Caps     []Cap              `json:"caps"`             // Capabilities negotiated in the session
+	LastSeen time.Time          `json:"lastSeen"`         // End of the session
+	Scores   map[string]float64 `json:"scores,omitempty"` // Protocol level scores keyed by protocol name
+	Data     map[string][]byte  `json:"data,omitempty"`   // Protocol specific data keyed by protocol name
+}
+
+// copy returns a deep copy of the metadata.
+func (m *PeerMeta) copy() *PeerMeta {
+	if m == nil {
+		return nil
+	}
+	cpy := &PeerMeta{
+		Caps:     append([]Cap(nil), m.Caps...),
+		LastSeen: m.LastSeen,
+	}
+	if m.Scores != nil {
+		cpy.Scores = make(map[string]float64, len(m.Scores))
+		for name, score := range m.Scores {
+			cpy.Scores[name] = score
+		}
+	}
+	if m.Data != nil {
+		cpy.Data = make(map[string][]byte, len(m.Data))
+		for name, data := range m.Data {
+			cpy.Data[name] = append([]byte(nil), data...)
+		}
+	}
+	return cpy
+}
+
+// peerMetaDB stores the metadata of the peers in a leveldb database. A nil
+// database stores nothing.
+type peerMetaDB struct {
+	lvl *leveldb.DB
+}
+
+// newPeerMetaDB opens the peer metadata database at the given path, or an
+// in-memory one if the path is empty. Entries not updated for peerMetaExpiry
+// are dropped.
+func newPeerMetaDB(path string) (*peerMetaDB, error) {
+	var (
+		db  *leveldb.DB
+		err error
+	)
+	if path == "" {
+		db, err = leveldb.Open(storage.NewMemStorage(), nil)
+	} else {
+		db, err = leveldb.OpenFile(path, &opt.Options{OpenFilesCacheCapacity: 5})
+		if _, corrupted := err.(*errors.ErrCorrupted); corrupted {
+			db, err = leveldb.RecoverFile(path, nil)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	pdb := &peerMetaDB{lvl: db}
+	pdb.expire(time.Now().Add(-peerMetaExpiry))
+	return pdb, nil
+}
+
+func peerMetaKey(id discover.NodeID) []byte {
+	return append(append([]byte(nil), peerMetaPrefix...), id[:]...)
+}
+
+// get retrieves the stored metadata of a peer, or nil if there is none.
+func (db *peerMetaDB) get(id discover.NodeID) *PeerMeta {
+	if db == nil {
+		return nil
+	}
+	blob, err := db.lvl.Get(peerMetaKey(id), nil)
+	if err != nil {
+		return nil
+	}
+	meta := new(PeerMeta)
+	if err := json.Unmarshal(blob, meta); err != nil {
+		return nil
+	}
+	return meta
+}
+
+// put stores the metadata of a peer.
+func (db *peerMetaDB) put(id discover.NodeID, meta *PeerMeta) error {
+	if db == nil {
+		return nil
+	}
+	blob, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return db.lvl.Put(peerMetaKey(id), blob, nil)
+}
+
+// expire deletes the metadata of the peers last seen before the given time.
+func (db *peerMetaDB) expire(before time.Time) {
+	it := db.lvl.NewIterator(util.BytesPrefix(peerMetaPrefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		meta := new(PeerMeta)
+		if err := json.Unmarshal(it.Value(), meta); err != nil || meta.LastSeen.Before(before) {
+			db.lvl.Delete(it.Key(), nil)
+		}
+	}
+}
+
+func (db *peerMetaDB) close() {
+	if db == nil {
+		return
+	}
+	db.lvl.Close()
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Tests that peer metadata survives reopening the database and that stale
+// entries are expired.
+func TestPeerMetaDBPersistence(t *testing.T) {
+	root, err := ioutil.TempDir("", "peermeta-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "peers")
+
+	db, err := newPeerMetaDB(path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	fresh, stale := randomID(), randomID()
+	meta := &PeerMeta{
+		Caps:     []Cap{{"les", 2}},
+		LastSeen: time.Now().Round(0),
+		Scores:   map[string]float64{"les": 1.5},
+		Data:     map[string][]byte{"les": {0x01, 0x02}},
+	}
+	if err := db.put(fresh, meta); err != nil {
+		t.Fatalf("failed to store metadata: %v", err)
+	}
+	if err := db.put(stale, &PeerMeta{LastSeen: time.Now().Add(-peerMetaExpiry - time.Hour)}); err != nil {
+		t.Fatalf("failed to store metadata: %v", err)
+	}
+	db.close()
+
+	if db, err = newPeerMetaDB(path); err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.close()
+
+	have := db.get(fresh)
+	if have == nil || !have.LastSeen.Equal(meta.LastSeen) {
+		t.Fatalf("metadata mismatch: have %+v, want %+v", have, meta)
+	}
+	have.LastSeen = meta.LastSeen
+	if !reflect.DeepEqual(have, meta) {
+		t.Errorf("metadata mismatch: have %+v, want %+v", have, meta)
+	}
+	if db.get(stale) != nil {
+		t.Errorf("stale metadata not expired")
+	}
+	if db.get(randomID()) != nil {
+		t.Errorf("metadata of unknown peer returned")
+	}
+}
+
+// Tests that the metadata set by the protocols during a session is available to
+// them when the peer connects again.
+func TestServerPeerMeta(t *testing.T) {
+	connected := make(chan *Peer, 1)
+	remid := randomID()
+	srv := startTestServer(t, remid, func(p *Peer) { connected <- p })
+	defer srv.Stop()
+
+	connect := func() (*Peer, net.Conn) {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", srv.ListenAddr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("could not dial: %v", err)
+		}
+		select {
+		case p := <-connected:
+			return p, conn
+		case <-time.After(time.Second):
+			t.Fatalf("server did not accept within one second")
+		}
+		return nil, nil
+	}
+	disconnect := func(conn net.Conn) {
+		t.Helper()
+		conn.Close()
+		for start := time.Now(); srv.PeerCount() > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("peer not dropped within one second")
+			}
+		}
+	}
+	p, conn := connect()
+	if meta := p.PreviousMeta(); meta != nil {
+		t.Fatalf("metadata of new peer: %+v", meta)
+	}
+	p.SetScore("les", 3)
+	p.SetMetaData("les", []byte("quirk"))
+	disconnect(conn)
+
+	p, conn = connect()
+	meta := p.PreviousMeta()
+	if meta == nil || meta.Scores["les"] != 3 || string(meta.Data["les"]) != "quirk" {
+		t.Fatalf("previous metadata mismatch: %+v", meta)
+	}
+	if time.Since(meta.LastSeen) > time.Minute {
+		t.Errorf("last seen time mismatch: %v", meta.LastSeen)
+	}
+	// The metadata carries over to the next session unless changed
+	p.SetMetaData("les", nil)
+	disconnect(conn)
+
+	p, conn = connect()
+	defer conn.Close()
+	if meta := p.PreviousMeta(); meta.Scores["les"] != 3 || meta.Data["les"] != nil {
+		t.Errorf("carried over metadata mismatch: %+v", meta)
+	}
+}
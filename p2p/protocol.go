@@ -18,6 +18,7 @@ package p2p
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
 )
@@ -56,8 +57,83 @@ type Protocol struct {
 	// about a certain peer in the network. If an info retrieval function is set,
 	// but returns nil, it is assumed that the protocol handshake is still running.
 	PeerInfo func(id discover.NodeID) interface{}
+
+	// Dial declares whether the protocol wants outbound connections. DialSlots
+	// is the number of dynamically dialed peers wanted by a DialOutbound protocol,
+	// zero for an even share of the dial budget.
+	Dial      DialPreference
+	DialSlots int
+
+	// OnAdd is an optional hook called when a peer passed the devp2p handshakes
+	// and was added to the server, whether or not it supports the protocol. OnDrop
+	// is called with the disconnect reason once the peer has been removed. If
+	// several versions of the protocol are registered, only the hooks of the
+	// first version setting any of them are called.
+	OnAdd  func(peer *Peer)
+	OnDrop func(peer *Peer, reason DiscReason)
+
+	// OnHandshake is an optional hook called when the capability negotiation
+	// selected this version of the protocol for a peer, before Run is started.
+	OnHandshake func(peer *Peer)
+
+	// HandshakeTimeout is the time an inbound peer has to complete the handshake
+	// of the protocol once it's started, reported by Run calling Peer.HandshakeDone.
+	// The peer is disconnected if it doesn't. Zero means no limit. It can be
+	// overridden by protocol name with Config.HandshakeBudgets.
+	HandshakeTimeout time.Duration
+
+	// Compress opts the protocol into snappy compression of its message payloads.
+	// The compressed capabilities are announced in the tail of the protocol
+	// handshake, so compression is only used if the remote side opted into the
+	// negotiated version too. Connections between peers announcing compressed
+	// protocols aren't compressed as a whole, only these protocols are.
+	Compress bool
+
+	// Interceptors optionally wrap the MsgReadWriter passed to Run, e.g. for rate
+	// limiting, logging or fault injection. The first interceptor sees the messages
+	// written by the protocol first and the messages read by it last.
+	Interceptors []MsgInterceptor
 }
 
+// hookedProtocols returns the protocols whose OnAdd and OnDrop hooks are called,
+// one per protocol name.
+//
+// hookedProtocols: 每个协议名 只取第一个设置了 OnAdd/OnDrop 的版本, 避免多版本重复回调
+func hookedProtocols(protocols []Protocol) []Protocol {
+	var (
+		hooked []Protocol
+		seen   = make(map[string]bool)
+	)
+	for _, proto := range protocols {
+		if (proto.OnAdd != nil || proto.OnDrop != nil) && !seen[proto.Name] {
+			seen[proto.Name] = true
+			hooked = append(hooked, proto)
+		}
+	}
+	return hooked
+}
+
+// DialPreference tells the dialer whether a protocol wants outbound connections.
+// If none of the protocols of a server declares a preference, the dynamic dial
+// budget is not split among the protocols.
+//
+// DialPreference: 协议声明自己是否需要主动拨号的连接 (例如 les client 需要主动连接 server,
+// les server 只接受连入), dialer 按协议分配动态拨号的名额
+type DialPreference int
+
+const (
+	// DialAny shares the dynamic dial budget evenly with the other protocols.
+	DialAny DialPreference = iota
+
+	// DialOutbound marks protocols seeking outbound connections, e.g. light
+	// clients looking for servers.
+	DialOutbound
+
+	// DialInboundOnly marks protocols only serving inbound connections, e.g. light
+	// servers. No dynamic dials are made on their behalf.
+	DialInboundOnly
+)
+
 func (p Protocol) cap() Cap {
 	return Cap{p.Name, p.Version}
 }
@@ -0,0 +1,110 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ProtocolRegistry collects the subprotocols run by a server. Registering the
+// same capability twice is rejected, as well as protocols whose message code
+// ranges, as assigned by the capability negotiation, would overlap.
+//
+// ProtocolRegistry: 子协议注册表, 重复注册同一个 (name, version) 或 协商后分配到的
+// 消息码区间 会重叠的子协议 会返回错误, 并自动生成握手用的 Cap 列表
+type ProtocolRegistry struct {
+	protocols []Protocol
+	index     map[Cap]int // position of the registered capabilities
+}
+
+// NewProtocolRegistry creates an empty protocol registry.
+func NewProtocolRegistry() *ProtocolRegistry {
+	return &ProtocolRegistry{index: make(map[Cap]int)}
+}
+
+// Register adds protocols to the registry. Either all or none of them are added.
+func (r *ProtocolRegistry) Register(protocols ...Protocol) error {
+	added := make(map[Cap]bool)
+	for _, proto := range protocols {
+		cap := proto.cap()
+		if proto.Name == "" {
+			return fmt.Errorf("protocol %v has no name", cap)
+		}
+		if proto.Length == 0 {
+			return fmt.Errorf("protocol %v has no message codes", cap)
+		}
+		if i, ok := r.index[cap]; ok {
+			return fmt.Errorf("protocol %v registered twice (message codes %d and %d)", cap, r.protocols[i].Length, proto.Length)
+		}
+		if added[cap] {
+			return fmt.Errorf("protocol %v registered twice", cap)
+		}
+		added[cap] = true
+	}
+	if err := checkCodeRanges(append(r.Protocols(), protocols...)); err != nil {
+		return err
+	}
+	for _, proto := range protocols {
+		r.index[proto.cap()] = len(r.protocols)
+		r.protocols = append(r.protocols, proto)
+	}
+	return nil
+}
+
+// checkCodeRanges verifies that the message code ranges assigned to the protocols
+// by the capability negotiation with a peer supporting all of them don't overlap
+// each other or the base protocol.
+func checkCodeRanges(protocols []Protocol) error {
+	caps := make([]Cap, len(protocols))
+	for i, proto := range protocols {
+		caps[i] = proto.cap()
+	}
+	var running []*protoRW
+	for _, rw := range matchProtocols(protocols, caps, nil) {
+		running = append(running, rw)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].offset < running[j].offset })
+
+	end, prev := baseProtocolLength, "the base protocol"
+	for _, rw := range running {
+		if rw.offset < end {
+			return fmt.Errorf("message codes of protocol %v overlap %s", rw.cap(), prev)
+		}
+		if end = rw.offset + rw.Length; end < rw.offset {
+			return fmt.Errorf("message codes of protocol %v overflow", rw.cap())
+		}
+		prev = rw.cap().String()
+	}
+	return nil
+}
+
+// Protocols returns the registered protocols in registration order.
+func (r *ProtocolRegistry) Protocols() []Protocol {
+	return append([]Protocol(nil), r.protocols...)
+}
+
+// Caps returns the capabilities of the registered protocols sorted by name and
+// version.
+func (r *ProtocolRegistry) Caps() []Cap {
+	caps := make([]Cap, 0, len(r.protocols))
+	for _, proto := range r.protocols {
+		caps = append(caps, proto.cap())
+	}
+	sort.Sort(capsByNameAndVersion(caps))
+	return caps
+}
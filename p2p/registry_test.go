@@ -0,0 +1,59 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProtocolRegistry(t *testing.T) {
+	r := NewProtocolRegistry()
+	if err := r.Register(Protocol{Name: "les", Version: 2, Length: 21}, Protocol{Name: "eth", Version: 63, Length: 17}); err != nil {
+		t.Fatalf("failed to register protocols: %v", err)
+	}
+	if err := r.Register(Protocol{Name: "les", Version: 1, Length: 15}); err != nil {
+		t.Fatalf("failed to register other version: %v", err)
+	}
+	// Conflicting registrations are rejected as a whole
+	if err := r.Register(Protocol{Name: "shh", Version: 6, Length: 128}, Protocol{Name: "les", Version: 2, Length: 22}); err == nil {
+		t.Error("conflicting protocol registered")
+	}
+	if err := r.Register(Protocol{Name: "bzz", Version: 1}, Protocol{Name: "bzz", Version: 1}); err == nil {
+		t.Error("duplicate protocols registered")
+	}
+	if err := r.Register(Protocol{Version: 1}); err == nil {
+		t.Error("unnamed protocol registered")
+	}
+	if err := r.Register(Protocol{Name: "bzz", Version: 1}); err == nil {
+		t.Error("protocol without message codes registered")
+	}
+	// The code range of a protocol must not wrap into the ranges of the others
+	if err := r.Register(Protocol{Name: "abc", Version: 1, Length: ^uint64(0) - 8}); err == nil {
+		t.Error("protocol with overlapping message codes registered")
+	}
+	if err := r.Register(Protocol{Name: "zzz", Version: 1, Length: ^uint64(0) - 8}); err == nil {
+		t.Error("protocol with overflowing message codes registered")
+	}
+	if len(r.Protocols()) != 3 {
+		t.Errorf("registered protocol count mismatch: have %d, want 3", len(r.Protocols()))
+	}
+	want := []Cap{{"eth", 63}, {"les", 1}, {"les", 2}}
+	if caps := r.Caps(); !reflect.DeepEqual(caps, want) {
+		t.Errorf("caps mismatch: have %v, want %v", caps, want)
+	}
+}
@@ -0,0 +1,843 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+)
+
+// The relay protocol lets two nodes which can't dial each other (typically
+// because both of them are behind NAT) establish a connection with the help of
+// a relay node they are both connected to:
+//
+//   - the relay tells both nodes the endpoint of the other one as it sees it,
+//     and they dial each other at the same time. The outgoing dials open the NAT
+//     mappings on both sides, so one of them usually gets through.
+//   - if that fails, the relay forwards the traffic of the two nodes for a
+//     limited time. The RLPx handshake runs end-to-end over the relayed stream,
+//     so the relay can neither read nor forge the messages of the peers.
+//
+/**
+relay 协议:
+	两个都在 NAT 之后无法互相拨号的节点, 借助双方都连接着的 relay 节点建立连接:
+	1. relay 把双方的公网 endpoint 告诉对方, 双方同时互相拨号 (打洞)
+	2. 打洞失败时, relay 在有限的时间内转发双方的流量 (RLPx 的握手是端到端的, relay 无法窃听或伪造消息)
+*/
+const (
+	relayProtocolName    = "relay"
+	relayProtocolVersion = 1
+	relayProtocolLength  = 7
+
+	relayStatusMsg   = 0x00
+	relayPunchReqMsg = 0x01
+	relayPunchMsg    = 0x02
+	relayOpenReqMsg  = 0x03
+	relayOpenMsg     = 0x04
+	relayDataMsg     = 0x05
+	relayCloseMsg    = 0x06
+)
+
+const (
+	defaultRelayTimeout = 10 * time.Minute       // lifetime of relayed connections
+	relayRequestTimeout = 5 * time.Second        // time to wait for the answer of a relay
+	relayPunchDelay     = 500 * time.Millisecond // time given to both sides to receive the punch message
+	relayPunchTimeout   = 3 * time.Second        // dial timeout of the simultaneous open
+	maxRelayPunchDelay  = 2 * time.Second        // cap of the punch delay chosen by the relay
+
+	maxRelaySessions        = 32 // connections relayed concurrently
+	maxRelaySessionsPerPeer = 4  // connections relayed concurrently for a single node
+	maxPunchDials           = 8  // punch dials made concurrently for the other side of our requests
+	maxPunchDialsPerPeer    = 2  // punch dials made concurrently on behalf of a single relay
+	relayChunkSize          = 16 * 1024
+	relayReadQueue          = 64 // data chunks buffered per relayed connection
+)
+
+var (
+	errRelayUnavailable = errors.New("no relay can reach the node")
+	errRelayTimeout     = errors.New("relay request timed out")
+
+	relayTrafficMeter = metrics.NewRegisteredMeter("p2p/relay/traffic", nil)
+)
+
+// relayStatus is exchanged when the relay protocol starts.
+type relayStatus struct {
+	ListenPort uint16 // TCP port the node accepts connections on, 0 if not listening
+	Service    bool   // whether the node relays for others
+}
+
+// relayTargetReq asks the relay to connect the sender to the target node, by
+// hole punching (relayPunchReqMsg) or by forwarding traffic (relayOpenReqMsg).
+type relayTargetReq struct {
+	ReqID  uint64
+	Target discover.NodeID
+}
+
+// relayPunch tells a node to dial the given peer at the same time as the peer
+// dials it. ReqID is zero on the side not requesting the punch.
+type relayPunch struct {
+	ReqID uint64
+	Peer  discover.NodeID
+	IP    net.IP
+	Port  uint16
+	Delay uint64 // milliseconds to wait before dialing
+}
+
+// relayOpen announces a relayed connection. ReqID is zero on the accepting side.
+type relayOpen struct {
+	ReqID   uint64
+	Session uint64
+	Peer    discover.NodeID
+	IP      net.IP
+	Port    uint16
+}
+
+// relayData carries the traffic of a relayed connection.
+type relayData struct {
+	Session uint64
+	Data    []byte
+}
+
+// relayClose rejects a request (ReqID set) or terminates a relayed connection
+// (Session set).
+type relayClose struct {
+	ReqID   uint64
+	Session uint64
+	Reason  string
+}
+
+// relayPeer is a peer running the relay protocol.
+type relayPeer struct {
+	*Peer
+	rw     MsgReadWriter
+	status relayStatus
+}
+
+// remoteIP returns the IP address of the peer as seen by us.
+func (p *relayPeer) remoteIP() net.IP {
+	if addr, ok := p.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// relaySession is a connection relayed by the local node.
+type relaySession struct {
+	ends  [2]*relayPeer
+	timer *time.Timer
+}
+
+// relayConnKey identifies a relayed connection of the local node.
+type relayConnKey struct {
+	relay   discover.NodeID
+	session uint64
+}
+
+// relayManager runs the relay protocol of a Server, both the relay service for
+// other nodes and the use of relays for reaching the nodes which can't be dialed.
+type relayManager struct {
+	srv     *Server
+	timeout time.Duration
+
+	lock     sync.Mutex
+	peers    map[discover.NodeID]*relayPeer
+	pending  map[uint64]chan interface{} // replies to our requests by ReqID
+	sessions map[uint64]*relaySession    // connections relayed by us
+	conns    map[relayConnKey]*relayConn // our connections relayed by others
+	nextID   uint64
+
+	punching   map[discover.NodeID]int // nodes we're dialing through the relays
+	punchDials map[*relayPeer]int      // punch dials in progress by the relay asking for them
+}
+
+func newRelayManager(srv *Server) *relayManager {
+	timeout := srv.RelayTimeout
+	if timeout <= 0 {
+		timeout = defaultRelayTimeout
+	}
+	return &relayManager{
+		srv:      srv,
+		timeout:  timeout,
+		peers:    make(map[discover.NodeID]*relayPeer),
+		pending:  make(map[uint64]chan interface{}),
+		sessions: make(map[uint64]*relaySession),
+		conns:    make(map[relayConnKey]*relayConn),
+
+		punching:   make(map[discover.NodeID]int),
+		punchDials: make(map[*relayPeer]int),
+	}
+}
+
+// protocol returns the relay protocol run by the server.
+func (rm *relayManager) protocol() Protocol {
+	return Protocol{
+		Name:    relayProtocolName,
+		Version: relayProtocolVersion,
+		Length:  relayProtocolLength,
+		Run:     rm.run,
+	}
+}
+
+// listenPort returns the TCP port of the local node, or zero if it's not listening.
+func (rm *relayManager) listenPort() uint16 {
+	if rm.srv.listener == nil {
+		return 0
+	}
+	if addr, ok := rm.srv.listener.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+func (rm *relayManager) run(p *Peer, rw MsgReadWriter) error {
+	rp := &relayPeer{Peer: p, rw: rw}
+	if err := Send(rw, relayStatusMsg, &relayStatus{ListenPort: rm.listenPort(), Service: rm.srv.RelayService}); err != nil {
+		return err
+	}
+	msg, err := rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Code != relayStatusMsg {
+		msg.Discard()
+		return fmt.Errorf("relay: first message has code %d (!= %d)", msg.Code, relayStatusMsg)
+	}
+	if err := msg.Decode(&rp.status); err != nil {
+		return fmt.Errorf("relay: invalid status: %v", err)
+	}
+	rm.register(rp)
+	defer rm.unregister(rp)
+
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return err
+		}
+		err = rm.handle(rp, msg)
+		msg.Discard()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rm *relayManager) register(rp *relayPeer) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	rm.peers[rp.ID()] = rp
+}
+
+// unregister drops a peer, closing every relayed connection it was part of.
+func (rm *relayManager) unregister(rp *relayPeer) {
+	rm.lock.Lock()
+	if rm.peers[rp.ID()] == rp {
+		delete(rm.peers, rp.ID())
+	}
+	var (
+		sessions []uint64
+		conns    []*relayConn
+	)
+	for id, s := range rm.sessions {
+		if s.ends[0] == rp || s.ends[1] == rp {
+			sessions = append(sessions, id)
+		}
+	}
+	for key, c := range rm.conns {
+		if key.relay == rp.ID() {
+			conns = append(conns, c)
+		}
+	}
+	rm.lock.Unlock()
+
+	for _, id := range sessions {
+		rm.closeSession(id, "peer disconnected")
+	}
+	for _, c := range conns {
+		c.shutdown(false)
+	}
+}
+
+func (rm *relayManager) handle(rp *relayPeer, msg Msg) error {
+	switch msg.Code {
+	case relayPunchReqMsg, relayOpenReqMsg:
+		var req relayTargetReq
+		if err := msg.Decode(&req); err != nil {
+			return fmt.Errorf("relay: invalid request: %v", err)
+		}
+		if msg.Code == relayPunchReqMsg {
+			return rm.servePunch(rp, req)
+		}
+		return rm.serveOpen(rp, req)
+
+	case relayPunchMsg:
+		var punch relayPunch
+		if err := msg.Decode(&punch); err != nil {
+			return fmt.Errorf("relay: invalid punch: %v", err)
+		}
+		if !rp.status.Service {
+			return errors.New("relay: punch from non-relay peer")
+		}
+		if punch.ReqID != 0 {
+			rm.deliver(punch.ReqID, &punch)
+		} else if rm.admitPunch(rp, &punch) {
+			go rm.acceptPunch(rp, &punch)
+		} else {
+			rp.log.Trace("Dropping unsolicited punch", "peer", punch.Peer)
+		}
+
+	case relayOpenMsg:
+		var open relayOpen
+		if err := msg.Decode(&open); err != nil {
+			return fmt.Errorf("relay: invalid open: %v", err)
+		}
+		if !rp.status.Service {
+			return errors.New("relay: open from non-relay peer")
+		}
+		if open.ReqID != 0 {
+			rm.deliver(open.ReqID, &open)
+		} else if reason := rm.admitOpen(rp); reason != "" {
+			return Send(rp.rw, relayCloseMsg, &relayClose{Session: open.Session, Reason: reason})
+		} else {
+			c := rm.newConn(rp, &open)
+			go func() {
+				rm.srv.SetupConn(newMeteredConn(c, true), inboundConn, nil)
+				rm.srv.inboundSlots <- struct{}{}
+			}()
+		}
+
+	case relayDataMsg:
+		if msg.Size > relayChunkSize+64 {
+			return fmt.Errorf("relay: data message too large (%d bytes)", msg.Size)
+		}
+		var data relayData
+		if err := msg.Decode(&data); err != nil {
+			return fmt.Errorf("relay: invalid data: %v", err)
+		}
+		return rm.forward(rp, &data)
+
+	case relayCloseMsg:
+		var cl relayClose
+		if err := msg.Decode(&cl); err != nil {
+			return fmt.Errorf("relay: invalid close: %v", err)
+		}
+		if cl.ReqID != 0 {
+			rm.deliver(cl.ReqID, &cl)
+			return nil
+		}
+		rm.lock.Lock()
+		s := rm.sessions[cl.Session]
+		c := rm.conns[relayConnKey{rp.ID(), cl.Session}]
+		rm.lock.Unlock()
+
+		if s != nil && (s.ends[0] == rp || s.ends[1] == rp) {
+			rm.closeSession(cl.Session, cl.Reason)
+		} else if c != nil {
+			c.shutdown(false)
+		}
+
+	default:
+		return fmt.Errorf("relay: invalid message code %d", msg.Code)
+	}
+	return nil
+}
+
+// target looks up the peer a request is aimed at, or rejects the request.
+func (rm *relayManager) target(rp *relayPeer, req relayTargetReq) *relayPeer {
+	reject := func(reason string) *relayPeer {
+		Send(rp.rw, relayCloseMsg, &relayClose{ReqID: req.ReqID, Reason: reason})
+		return nil
+	}
+	if !rm.srv.RelayService {
+		return reject("relay service disabled")
+	}
+	rm.lock.Lock()
+	target := rm.peers[req.Target]
+	rm.lock.Unlock()
+
+	if target == nil || target == rp {
+		return reject("unknown target")
+	}
+	return target
+}
+
+// servePunch coordinates a simultaneous dial of the requester and the target.
+func (rm *relayManager) servePunch(rp *relayPeer, req relayTargetReq) error {
+	target := rm.target(rp, req)
+	if target == nil {
+		return nil
+	}
+	delay := uint64(relayPunchDelay / time.Millisecond)
+	Send(target.rw, relayPunchMsg, &relayPunch{Peer: rp.ID(), IP: rp.remoteIP(), Port: rp.status.ListenPort, Delay: delay})
+	return Send(rp.rw, relayPunchMsg, &relayPunch{ReqID: req.ReqID, Peer: target.ID(), IP: target.remoteIP(), Port: target.status.ListenPort, Delay: delay})
+}
+
+// serveOpen starts relaying traffic between the requester and the target.
+func (rm *relayManager) serveOpen(rp *relayPeer, req relayTargetReq) error {
+	target := rm.target(rp, req)
+	if target == nil {
+		return nil
+	}
+	rm.lock.Lock()
+	if reason := rm.sessionLimit(rp, target); reason != "" {
+		rm.lock.Unlock()
+		return Send(rp.rw, relayCloseMsg, &relayClose{ReqID: req.ReqID, Reason: reason})
+	}
+	rm.nextID++
+	id := rm.nextID
+	rm.sessions[id] = &relaySession{
+		ends:  [2]*relayPeer{rp, target},
+		timer: time.AfterFunc(rm.timeout, func() { rm.closeSession(id, "relay time limit reached") }),
+	}
+	rm.lock.Unlock()
+
+	rp.log.Debug("Relaying connection", "session", id, "target", target.ID())
+	Send(target.rw, relayOpenMsg, &relayOpen{Session: id, Peer: rp.ID(), IP: rp.remoteIP(), Port: rp.status.ListenPort})
+	return Send(rp.rw, relayOpenMsg, &relayOpen{ReqID: req.ReqID, Session: id, Peer: target.ID(), IP: target.remoteIP(), Port: target.status.ListenPort})
+}
+
+// sessionLimit returns why another session between the given peers can't be
+// relayed, or the empty string if it can. The lock is held by the caller.
+func (rm *relayManager) sessionLimit(a, b *relayPeer) string {
+	if len(rm.sessions) >= maxRelaySessions {
+		return "too many relayed connections"
+	}
+	var na, nb int
+	for _, s := range rm.sessions {
+		for _, end := range s.ends {
+			switch end {
+			case a:
+				na++
+			case b:
+				nb++
+			}
+		}
+	}
+	if na >= maxRelaySessionsPerPeer || nb >= maxRelaySessionsPerPeer {
+		return "too many relayed connections for peer"
+	}
+	return ""
+}
+
+// connLimit returns why another connection relayed by the given peer can't be
+// accepted, or the empty string if it can.
+func (rm *relayManager) connLimit(rp *relayPeer) string {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	if len(rm.conns) >= maxRelaySessions {
+		return "too many relayed connections"
+	}
+	var n int
+	for key := range rm.conns {
+		if key.relay == rp.ID() {
+			n++
+		}
+	}
+	if n >= maxRelaySessionsPerPeer {
+		return "too many relayed connections for peer"
+	}
+	return ""
+}
+
+// admitOpen decides whether to accept a connection relayed to us, returning the
+// reason of the refusal if not. Only the nodes using relays accept them, and they
+// go through the checks of the listeners: the relay has to match NetRestrict (the
+// remote address of the session is only claimed by it) and the handshake takes
+// one of the inbound slots, which the caller returns once it's done.
+func (rm *relayManager) admitOpen(rp *relayPeer) string {
+	if !rm.srv.UseRelays {
+		return "relayed connections not accepted"
+	}
+	if rm.srv.NetRestrict != nil {
+		if ip := rp.remoteIP(); ip == nil || !rm.srv.NetRestrict.Contains(ip) {
+			return "relay not whitelisted"
+		}
+	}
+	if reason := rm.connLimit(rp); reason != "" {
+		return reason
+	}
+	select {
+	case <-rm.srv.inboundSlots:
+		return ""
+	default:
+		return "too many pending connections"
+	}
+}
+
+// closeSession stops relaying a connection, notifying both ends.
+func (rm *relayManager) closeSession(id uint64, reason string) {
+	rm.lock.Lock()
+	s := rm.sessions[id]
+	delete(rm.sessions, id)
+	rm.lock.Unlock()
+
+	if s == nil {
+		return
+	}
+	s.timer.Stop()
+	for _, end := range s.ends {
+		Send(end.rw, relayCloseMsg, &relayClose{Session: id, Reason: reason})
+	}
+}
+
+// forward passes relayed data on, either to the other end of a session relayed
+// by us or to one of our own relayed connections.
+func (rm *relayManager) forward(rp *relayPeer, data *relayData) error {
+	rm.lock.Lock()
+	s := rm.sessions[data.Session]
+	c := rm.conns[relayConnKey{rp.ID(), data.Session}]
+	rm.lock.Unlock()
+
+	switch {
+	case s != nil:
+		var to *relayPeer
+		switch rp {
+		case s.ends[0]:
+			to = s.ends[1]
+		case s.ends[1]:
+			to = s.ends[0]
+		default:
+			return nil
+		}
+		relayTrafficMeter.Mark(int64(len(data.Data)))
+		if err := Send(to.rw, relayDataMsg, data); err != nil {
+			rm.closeSession(data.Session, "peer unreachable")
+		}
+	case c != nil:
+		c.deliver(data.Data)
+	}
+	return nil
+}
+
+// request sends a request to a relay and waits for the answer.
+func (rm *relayManager) request(rp *relayPeer, code uint64, target discover.NodeID) (interface{}, error) {
+	ch := make(chan interface{}, 1)
+	rm.lock.Lock()
+	rm.nextID++
+	id := rm.nextID
+	rm.pending[id] = ch
+	rm.lock.Unlock()
+
+	defer func() {
+		rm.lock.Lock()
+		delete(rm.pending, id)
+		rm.lock.Unlock()
+	}()
+	if err := Send(rp.rw, code, &relayTargetReq{ReqID: id, Target: target}); err != nil {
+		return nil, err
+	}
+	timeout := time.NewTimer(relayRequestTimeout)
+	defer timeout.Stop()
+
+	select {
+	case reply := <-ch:
+		if cl, ok := reply.(*relayClose); ok {
+			return nil, fmt.Errorf("relay: %s", cl.Reason)
+		}
+		return reply, nil
+	case <-timeout.C:
+		return nil, errRelayTimeout
+	case <-rm.srv.quit:
+		return nil, errServerStopped
+	}
+}
+
+// deliver hands the answer of a relay to the waiting request.
+func (rm *relayManager) deliver(id uint64, reply interface{}) {
+	rm.lock.Lock()
+	ch := rm.pending[id]
+	rm.lock.Unlock()
+
+	if ch != nil {
+		select {
+		case ch <- reply:
+		default:
+		}
+	}
+}
+
+// relays returns the connected relay nodes other than the given one.
+func (rm *relayManager) relays(exclude discover.NodeID) []*relayPeer {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	var list []*relayPeer
+	for id, rp := range rm.peers {
+		if rp.status.Service && id != exclude {
+			list = append(list, rp)
+		}
+	}
+	return list
+}
+
+// dial tries to reach the destination through the connected relays, first by a
+// simultaneous dial, then by relaying the connection.
+func (rm *relayManager) dial(dest *discover.Node) (net.Conn, error) {
+	// the punches sent to us for the destination are expected while dialing it
+	rm.lock.Lock()
+	rm.punching[dest.ID]++
+	rm.lock.Unlock()
+
+	defer func() {
+		rm.lock.Lock()
+		if rm.punching[dest.ID]--; rm.punching[dest.ID] <= 0 {
+			delete(rm.punching, dest.ID)
+		}
+		rm.lock.Unlock()
+	}()
+	for _, rp := range rm.relays(dest.ID) {
+		reply, err := rm.request(rp, relayPunchReqMsg, dest.ID)
+		if err != nil {
+			rp.log.Trace("Relay can't reach node", "id", dest.ID, "err", err)
+			continue
+		}
+		if fd, err := rm.punchDial(reply.(*relayPunch)); err == nil {
+			return fd, nil
+		}
+		reply, err = rm.request(rp, relayOpenReqMsg, dest.ID)
+		if err != nil {
+			rp.log.Trace("Relay refused connection", "id", dest.ID, "err", err)
+			continue
+		}
+		return rm.newConn(rp, reply.(*relayOpen)), nil
+	}
+	return nil, errRelayUnavailable
+}
+
+// admitPunch decides whether to dial the node which asked a relay for a
+// simultaneous dial with us. Otherwise any peer could make us dial arbitrary
+// addresses, so the punch is only accepted while we're dialing the same node
+// through the relays ourselves, and the punch dials are limited per relay and in
+// total. The other side falls back to a relayed connection if its punch is
+// dropped.
+func (rm *relayManager) admitPunch(rp *relayPeer, punch *relayPunch) bool {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	if rm.punching[punch.Peer] == 0 {
+		return false
+	}
+	var total int
+	for _, n := range rm.punchDials {
+		total += n
+	}
+	if total >= maxPunchDials || rm.punchDials[rp] >= maxPunchDialsPerPeer {
+		return false
+	}
+	rm.punchDials[rp]++
+	return true
+}
+
+// acceptPunch dials the node which asked a relay for a simultaneous dial with us.
+// Our dial mainly serves to open the NAT mapping for the dial of the other side,
+// so the connection is only used if that one doesn't arrive in time. Keeping both
+// would make the two nodes drop each other as duplicates.
+func (rm *relayManager) acceptPunch(rp *relayPeer, punch *relayPunch) {
+	defer func() {
+		rm.lock.Lock()
+		if rm.punchDials[rp]--; rm.punchDials[rp] <= 0 {
+			delete(rm.punchDials, rp)
+		}
+		rm.lock.Unlock()
+	}()
+	fd, err := rm.punchDial(punch)
+	if err != nil {
+		return
+	}
+	for deadline := time.Now().Add(relayPunchTimeout); time.Now().Before(deadline); {
+		if rm.connected(punch.Peer) {
+			fd.Close()
+			return
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-rm.srv.quit:
+			fd.Close()
+			return
+		}
+	}
+	node := discover.NewNode(punch.Peer, punch.IP, 0, punch.Port)
+	rm.srv.SetupConn(newMeteredConn(fd, false), dynDialedConn, node)
+}
+
+// connected returns whether the node is connected to the server.
+func (rm *relayManager) connected(id discover.NodeID) bool {
+	for _, p := range rm.srv.Peers() {
+		if p.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// punchDial dials the endpoint of a punch message once its delay passed. The
+// delay is chosen by the relay, it's capped at maxRelayPunchDelay.
+func (rm *relayManager) punchDial(punch *relayPunch) (net.Conn, error) {
+	if punch.IP == nil || punch.Port == 0 {
+		return nil, errors.New("peer is not listening")
+	}
+	delay := maxRelayPunchDelay
+	if punch.Delay < uint64(maxRelayPunchDelay/time.Millisecond) {
+		delay = time.Duration(punch.Delay) * time.Millisecond
+	}
+	select {
+	case <-time.After(delay):
+	case <-rm.srv.quit:
+		return nil, errServerStopped
+	}
+
+	addr := &net.TCPAddr{IP: punch.IP, Port: int(punch.Port)}
+	return net.DialTimeout("tcp", addr.String(), relayPunchTimeout)
+}
+
+// relayConn is a connection of the local node relayed by another node. It is
+// backed by a pipe, one end of which is used by the p2p server while the other
+// one is pumped to and from the relay.
+type relayConn struct {
+	net.Conn // end of the pipe used by the p2p server
+
+	rm       *relayManager
+	relay    *relayPeer
+	session  uint64
+	pipe     net.Conn // end of the pipe connected to the relay
+	remote   *net.TCPAddr
+	incoming chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (rm *relayManager) newConn(rp *relayPeer, open *relayOpen) *relayConn {
+	local, pipe := net.Pipe()
+	c := &relayConn{
+		Conn:     local,
+		rm:       rm,
+		relay:    rp,
+		session:  open.Session,
+		pipe:     pipe,
+		remote:   &net.TCPAddr{IP: open.IP, Port: int(open.Port)},
+		incoming: make(chan []byte, relayReadQueue),
+		closed:   make(chan struct{}),
+	}
+	rm.lock.Lock()
+	rm.conns[relayConnKey{rp.ID(), open.Session}] = c
+	rm.lock.Unlock()
+
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+// RemoteAddr returns the address of the remote node as seen by the relay.
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr returns the local address of the connection to the relay.
+func (c *relayConn) LocalAddr() net.Addr {
+	return c.relay.LocalAddr()
+}
+
+// Close terminates the relayed connection.
+func (c *relayConn) Close() error {
+	c.shutdown(true)
+	return nil
+}
+
+// readLoop sends the data written by the p2p server to the relay.
+func (c *relayConn) readLoop() {
+	buf := make([]byte, relayChunkSize)
+	for {
+		n, err := c.pipe.Read(buf)
+		if err != nil {
+			c.shutdown(true)
+			return
+		}
+		if err := Send(c.relay.rw, relayDataMsg, &relayData{Session: c.session, Data: buf[:n]}); err != nil {
+			c.shutdown(false)
+			return
+		}
+	}
+}
+
+// writeLoop passes the data received from the relay to the p2p server.
+func (c *relayConn) writeLoop() {
+	for {
+		select {
+		case data := <-c.incoming:
+			if _, err := c.pipe.Write(data); err != nil {
+				c.shutdown(true)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// deliver queues data received from the relay. The connection is dropped if the
+// local end doesn't keep up.
+func (c *relayConn) deliver(data []byte) {
+	select {
+	case c.incoming <- data:
+	case <-c.closed:
+	default:
+		c.shutdown(true)
+	}
+}
+
+// shutdown closes the connection, notifying the relay if requested.
+func (c *relayConn) shutdown(notify bool) {
+	c.once.Do(func() {
+		close(c.closed)
+		c.Conn.Close()
+		c.pipe.Close()
+
+		c.rm.lock.Lock()
+		delete(c.rm.conns, relayConnKey{c.relay.ID(), c.session})
+		c.rm.lock.Unlock()
+
+		if notify {
+			Send(c.relay.rw, relayCloseMsg, &relayClose{Session: c.session, Reason: "connection closed"})
+		}
+	})
+}
+
+// relayDialer is a NodeDialer falling back to the relays if the destination
+// can't be dialed directly.
+type relayDialer struct {
+	NodeDialer
+	relay *relayManager
+}
+
+// Dial connects to the node directly or through a relay.
+func (d relayDialer) Dial(dest *discover.Node) (net.Conn, error) {
+	fd, err := d.NodeDialer.Dial(dest)
+	if err == nil {
+		return fd, nil
+	}
+	if rfd, rerr := d.relay.dial(dest); rerr == nil {
+		return rfd, nil
+	}
+	return nil, err
+}
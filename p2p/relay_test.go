@@ -0,0 +1,236 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/discover"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/p2p/netutil"
+)
+
+// startRelayTestServer starts a server on the loopback interface, connected to
+// the given static nodes.
+func startRelayTestServer(t *testing.T, listen, service bool, static ...*discover.Node) *Server {
+	config := Config{
+		Name:         "test",
+		MaxPeers:     10,
+		PrivateKey:   newkey(),
+		NoDiscovery:  true,
+		StaticNodes:  static,
+		RelayService: service,
+		UseRelays:    !service,
+		RelayTimeout: 2 * time.Second,
+	}
+	if listen {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+	srv := &Server{Config: config}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("could not start server: %v", err)
+	}
+	return srv
+}
+
+// relayNode returns the node record of a listening server.
+func relayNode(srv *Server) *discover.Node {
+	addr := srv.listener.Addr().(*net.TCPAddr)
+	return discover.NewNode(srv.Self().ID, addr.IP, 0, uint16(addr.Port))
+}
+
+// waitFor polls the condition until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func hasPeer(srv *Server, id discover.NodeID) bool {
+	for _, p := range srv.Peers() {
+		if p.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+func relayPeerCount(srv *Server) int {
+	srv.relay.lock.Lock()
+	defer srv.relay.lock.Unlock()
+	return len(srv.relay.peers)
+}
+
+func relaySessionCount(srv *Server) int {
+	srv.relay.lock.Lock()
+	defer srv.relay.lock.Unlock()
+	return len(srv.relay.sessions)
+}
+
+// Tests that nodes which can't be dialed at their advertised endpoint are
+// connected by a simultaneous dial coordinated by the relay.
+func TestRelayPunch(t *testing.T) {
+	relay := startRelayTestServer(t, true, true)
+	defer relay.Stop()
+	a := startRelayTestServer(t, true, false, relayNode(relay))
+	defer a.Stop()
+	b := startRelayTestServer(t, true, false, relayNode(relay))
+	defer b.Stop()
+
+	waitFor(t, 5*time.Second, "relay peers", func() bool { return relayPeerCount(relay) == 2 })
+
+	// Dial b at a wrong port, the relay knows the right one
+	a.AddPeer(discover.NewNode(b.Self().ID, net.IP{127, 0, 0, 1}, 0, 1))
+	waitFor(t, 10*time.Second, "punched connection", func() bool { return hasPeer(a, b.Self().ID) })
+
+	if n := relaySessionCount(relay); n != 0 {
+		t.Errorf("punched connection relayed: %d sessions", n)
+	}
+}
+
+// Tests that nodes which don't accept connections at all are connected through
+// the relay, and that the relayed connection is dropped after the time limit.
+func TestRelayConn(t *testing.T) {
+	relay := startRelayTestServer(t, true, true)
+	defer relay.Stop()
+	a := startRelayTestServer(t, false, false, relayNode(relay))
+	defer a.Stop()
+	b := startRelayTestServer(t, false, false, relayNode(relay))
+	defer b.Stop()
+
+	waitFor(t, 5*time.Second, "relay peers", func() bool { return relayPeerCount(relay) == 2 })
+
+	a.AddPeer(discover.NewNode(b.Self().ID, net.IP{127, 0, 0, 1}, 0, 1))
+	waitFor(t, 10*time.Second, "relayed connection", func() bool {
+		return hasPeer(a, b.Self().ID) && hasPeer(b, a.Self().ID)
+	})
+	if n := relaySessionCount(relay); n != 1 {
+		t.Fatalf("relay session count mismatch: have %d, want 1", n)
+	}
+	// The relay cuts the connection after RelayTimeout
+	waitFor(t, 5*time.Second, "relayed connection drop", func() bool {
+		return !hasPeer(b, a.Self().ID) && relaySessionCount(relay) == 0
+	})
+}
+
+// Tests that punches are only dialed while we're dialing the same node through
+// the relays, and that the punch dials are limited per relay and in total.
+func TestRelayAdmitPunch(t *testing.T) {
+	rm := newRelayManager(&Server{})
+	relays := make([]*relayPeer, maxPunchDials)
+	for i := range relays {
+		relays[i] = new(relayPeer)
+	}
+	target := discover.NodeID{1}
+	punch := &relayPunch{Peer: target, IP: net.IP{127, 0, 0, 1}, Port: 30303}
+
+	// Unsolicited punches are dropped
+	if rm.admitPunch(relays[0], punch) {
+		t.Fatal("unsolicited punch admitted")
+	}
+	rm.punching[target] = 1
+
+	// A single relay can't make us dial more than maxPunchDialsPerPeer times
+	for i := 0; i < maxPunchDialsPerPeer; i++ {
+		if !rm.admitPunch(relays[0], punch) {
+			t.Fatalf("punch %d of relay dropped", i)
+		}
+	}
+	if rm.admitPunch(relays[0], punch) {
+		t.Fatal("punch over the per relay limit admitted")
+	}
+	// Neither can all the relays together exceed maxPunchDials
+	admitted := maxPunchDialsPerPeer
+	for _, rp := range relays[1:] {
+		if rm.admitPunch(rp, punch) {
+			admitted++
+		}
+	}
+	if admitted != maxPunchDials {
+		t.Fatalf("admitted punch count mismatch: have %d, want %d", admitted, maxPunchDials)
+	}
+}
+
+// addrConn is a connection reporting the given remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// Tests that relayed connections are only accepted by the nodes using relays,
+// from the relays matching NetRestrict and while there are free inbound slots.
+func TestRelayAdmitOpen(t *testing.T) {
+	fd, _ := net.Pipe()
+	defer fd.Close()
+	rp := &relayPeer{Peer: &Peer{rw: &conn{fd: addrConn{fd, &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 30303}}}}}
+
+	srv := &Server{inboundSlots: make(chan struct{}, 1)}
+	srv.inboundSlots <- struct{}{}
+	rm := newRelayManager(srv)
+
+	if reason := rm.admitOpen(rp); reason == "" {
+		t.Fatal("relayed connection accepted without UseRelays")
+	}
+	srv.UseRelays = true
+	srv.NetRestrict, _ = netutil.ParseNetlist("192.168.0.0/16")
+	if reason := rm.admitOpen(rp); reason == "" {
+		t.Fatal("relayed connection accepted from a relay not in NetRestrict")
+	}
+	srv.NetRestrict, _ = netutil.ParseNetlist("10.0.0.0/8")
+	if reason := rm.admitOpen(rp); reason != "" {
+		t.Fatalf("relayed connection refused: %s", reason)
+	}
+	// The slot is taken until the connection is set up
+	if reason := rm.admitOpen(rp); reason == "" {
+		t.Fatal("relayed connection accepted without a free inbound slot")
+	}
+}
+
+// Tests that the punch delay chosen by the relay is capped, and that the wait is
+// cut short by the server stopping.
+func TestRelayPunchDelay(t *testing.T) {
+	srv := &Server{quit: make(chan struct{})}
+	rm := newRelayManager(srv)
+
+	start := time.Now()
+	rm.punchDial(&relayPunch{IP: net.IP{127, 0, 0, 1}, Port: 1, Delay: ^uint64(0)})
+	if elapsed := time.Since(start); elapsed > maxRelayPunchDelay+time.Second {
+		t.Errorf("punch delay not capped: waited %v", elapsed)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rm.punchDial(&relayPunch{IP: net.IP{127, 0, 0, 1}, Port: 1, Delay: ^uint64(0)})
+		errc <- err
+	}()
+	close(srv.quit)
+	select {
+	case err := <-errc:
+		if err != errServerStopped {
+			t.Errorf("punch dial error mismatch: have %v, want %v", err, errServerStopped)
+		}
+	case <-time.After(maxRelayPunchDelay / 2):
+		t.Fatal("punch dial not stopped with the server")
+	}
+}
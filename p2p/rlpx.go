@@ -163,6 +163,12 @@ type rlpx struct {
 	rw       *rlpxFrameRW
 }
 
+// compressed reports whether the whole connection is snappy compressed, making
+// the compression of single protocols redundant.
+func (t *rlpx) compressed() bool {
+	return t.rw != nil && t.rw.snappy
+}
+
 func newRLPX(fd net.Conn) transport {
 	fd.SetDeadline(time.Now().Add(handshakeTimeout))
 	return &rlpx{fd: fd}
@@ -226,7 +232,8 @@ func (t *rlpx) doProtoHandshake(our *protoHandshake) (their *protoHandshake, err
 		return nil, fmt.Errorf("write error: %v", err)
 	}
 	// If the protocol version supports Snappy encoding, upgrade immediately  如果协议版本支持Snappy编码，请立即升级
-	t.rw.snappy = their.Version >= snappyProtocolVersion  // 默认 当前p2p功能版本为第5版 (开启 snappy 压缩)
+	// (unless both sides compress single protocols instead)
+	t.rw.snappy = snappyConn(our, their)  // 默认 当前p2p功能版本为第5版 (开启 snappy 压缩)
 
 	return their, nil
 }
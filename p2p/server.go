@@ -78,6 +78,15 @@ type Config struct {
 	//			将DialRatio设置为零会将其默认设置为3
 	DialRatio int `toml:",omitempty"`
 
+	// ReservedSlots reserves some of the MaxPeers slots for the peers running the
+	// named protocols, e.g. to guarantee the capacity of a light server. A peer
+	// only takes the free slots not reserved for the protocols it doesn't run,
+	// and the slots of inbound only protocols are never dialed. Trusted and static
+	// peers are not restricted.
+	//
+	// ReservedSlots: 按协议名 预留的 peer 名额 (例如 "les": 20), 不运行该协议的 peer 不能占用
+	ReservedSlots map[string]int `toml:",omitempty"`
+
 	// NoDiscovery can be used to disable the peer discovery mechanism.
 	// Disabling is useful for protocol debugging (manual topology).
 	//
@@ -91,6 +100,13 @@ type Config struct {
 	// DiscoveryV5 指定是否应该启动 新的基于 主题发现(topic-discovery) 的 V5发现协议
 	DiscoveryV5 bool `toml:",omitempty"`
 
+	// DiscoveryPassive makes the node discovery answer pings but look up nodes
+	// only on demand at a limited rate, without table maintenance traffic. It is
+	// meant for constrained (e.g. mobile light) clients.
+	//
+	// DiscoveryPassive: 被动的节点发现, 减少 移动端 light client 的 电量/流量 消耗
+	DiscoveryPassive bool `toml:",omitempty"`
+
 	// Name sets the node name of this server.
 	// Use common.MakeName to create a name that follows existing conventions.
 	Name string `toml:"-"`
@@ -131,6 +147,11 @@ type Config struct {
 	// live nodes in the network.
 	NodeDatabase string `toml:",omitempty"`
 
+	// PeerDatabase is the path to the database containing the metadata of the
+	// previously connected peers, see PeerMeta. If empty, the metadata is only
+	// kept while the server is running.
+	PeerDatabase string `toml:",omitempty"`
+
 	// Protocols should contain the protocols supported
 	// by the server. Matching protocols are launched for
 	// each peer.
@@ -144,6 +165,26 @@ type Config struct {
 	// the server is started.
 	ListenAddr string   // 例如L: "127.0.0.1:8080"  或者 "www.baidu.com"
 
+	// If WSListenAddr is set, the server also accepts sessions tunnelled through
+	// WebSocket connections on the given address, e.g. from light clients running
+	// in a browser. The RLPx handshake authenticates them as usual.
+	//
+	// WSListenAddr: 通过 WebSocket 接收 devp2p 会话 (例如 浏览器中的 light client)
+	WSListenAddr string `toml:",omitempty"`
+
+	// WSOrigins are the web page origins allowed to connect over WebSocket, "*"
+	// allows all. Clients sending no origin (non-browsers) are always allowed.
+	WSOrigins []string `toml:",omitempty"`
+
+	// WSOriginPeers limits the WebSocket connections of each origin. Zero
+	// defaults to 16.
+	WSOriginPeers int `toml:",omitempty"`
+
+	// WSCertFile and WSKeyFile are the TLS certificate and key of the WebSocket
+	// listener. If set, the connections are served as wss.
+	WSCertFile string `toml:",omitempty"`
+	WSKeyFile  string `toml:",omitempty"`
+
 	// If set to a non-nil value, the given NAT port mapper
 	// is used to make the listening port available to the
 	// Internet.
@@ -160,6 +201,29 @@ type Config struct {
 	// 如果NoDial为true，则服务器将 不拨打任何 peer  (不连接 任何 peer)
 	NoDial bool `toml:",omitempty"`
 
+	// RelayService makes the node help connected peers to reach each other when
+	// they can't dial directly, by coordinating simultaneous dials and by relaying
+	// their traffic for a limited time.
+	//
+	// RelayService: 作为 relay 节点, 帮助互相无法直接拨号的 peer 打洞或者中转流量
+	RelayService bool `toml:",omitempty"`
+
+	// UseRelays makes the node ask connected relays for help when a dial fails,
+	// and accept the connections set up through them.
+	//
+	// UseRelays: 直接拨号失败时, 借助已连接的 relay 节点建立连接 (适用于 NAT 之后的节点)
+	UseRelays bool `toml:",omitempty"`
+
+	// RelayTimeout limits the lifetime of relayed connections. Zero defaults
+	// to 10 minutes.
+	RelayTimeout time.Duration `toml:",omitempty"`
+
+	// HandshakeBudgets overrides the handshake timeouts of the subprotocols by
+	// protocol name (see Protocol.HandshakeTimeout), zero disabling the limit.
+	//
+	// HandshakeBudgets: 按子协议名 配置 连入 peer 完成子协议握手 (如 les status 交换) 的时间预算
+	HandshakeBudgets map[string]time.Duration `toml:",omitempty"`
+
 	// If EnableMsgEvents is set then the server will emit PeerEvents
 	// whenever a message is sent to or received from a peer
 	EnableMsgEvents bool
@@ -188,7 +252,10 @@ type Server struct {
 	running bool
 
 	ntab         discoverTable
+	relay        *relayManager // nil if neither RelayService nor UseRelays is set
 	listener     net.Listener
+	wsListener   *wsListener   // nil if WSListenAddr is not set
+	inboundSlots chan struct{} // handshake slots of the inbound connections, shared by the listeners
 	ourHandshake *protoHandshake   // protoHandshake是 协议握手的RLP结构
 	lastLookup   time.Time
 	DiscV5       *discv5.Network   // 对 V5发现协议的一些封装
@@ -205,6 +272,7 @@ type Server struct {
 	posthandshake chan *conn		// 接收 rlpx 传输握手信号
 	addpeer       chan *conn		// 有 新对端 peer 连进来时的信号
 	delpeer       chan peerDrop		// 需要移除 某对端 peer 连接的信号
+	peerMeta      *peerMetaDB    // 对端 peer 的元数据 (跨重启保留)
 	loopWG        sync.WaitGroup // loop, listenLoop
 	peerFeed      event.Feed    // peer 的事件监听. (用在 jsonrpc api 中查看 节点连接信息)
 	log           log.Logger
@@ -215,7 +283,8 @@ type peerOpFunc func(map[discover.NodeID]*Peer)
 type peerDrop struct {
 	*Peer
 	err       error
-	requested bool // true if signaled by the peer
+	requested bool          // true if signaled by the peer
+	removed   chan struct{} // closed once the peer is removed from the peer set
 }
 
 type connFlag int32
@@ -236,6 +305,7 @@ type conn struct {
 	cont  chan error      // The run loop uses cont to signal errors to SetupConn.
 	id    discover.NodeID // valid after the encryption handshake
 	caps  []Cap           // valid after the protocol handshake
+	zcaps []Cap           // capabilities the remote side compresses, valid after the protocol handshake
 	name  string          // valid after the protocol handshake
 }
 
@@ -415,6 +485,9 @@ func (srv *Server) Stop() {
 		// this unblocks listener Accept
 		srv.listener.Close()
 	}
+	if srv.wsListener != nil {
+		srv.wsListener.Close()
+	}
 	close(srv.quit)
 	srv.lock.Unlock()
 	srv.loopWG.Wait()
@@ -471,6 +544,20 @@ func (srv *Server) Start() (err error) {
 	if srv.Dialer == nil {
 		srv.Dialer = TCPDialer{&net.Dialer{Timeout: defaultDialTimeout}}   // 15s 超时
 	}
+	registry := NewProtocolRegistry()
+	if err := registry.Register(srv.Protocols...); err != nil {
+		return err
+	}
+	if srv.RelayService || srv.UseRelays {
+		srv.relay = newRelayManager(srv)
+		if err := registry.Register(srv.relay.protocol()); err != nil {
+			return err
+		}
+		srv.Protocols = registry.Protocols()
+		if srv.UseRelays {
+			srv.Dialer = relayDialer{srv.Dialer, srv.relay}
+		}
+	}
 
 	// 初始化 一些列 chan
 	srv.quit = make(chan struct{})
@@ -535,6 +622,7 @@ func (srv *Server) Start() (err error) {
 			NetRestrict:  srv.NetRestrict,
 			Bootnodes:    srv.BootstrapNodes,		// 配置文件的 种子节点  (非 V5发现协议的)
 			Unhandled:    unhandled,
+			Passive:      srv.DiscoveryPassive,
 		}
 		ntab, err := discover.ListenUDP(conn, cfg)  // 根据 配置文件返回一个新 table，该table 在laddr上侦听UDP数据包
 		if err != nil {
@@ -564,22 +652,32 @@ func (srv *Server) Start() (err error) {
 
 	dynPeers := srv.maxDialedConns()  // 计算 允许的最大连接数
 	dialer := newDialState(srv.StaticNodes, srv.BootstrapNodes, srv.ntab, dynPeers, srv.NetRestrict)  // 实例化 连接状态结构 (拨号状态结构)
+	dialer.quotas = dialQuotas(srv.Protocols, dynPeers)  // 按协议的拨号偏好分配动态拨号名额
 
 	// handshake    默认: 当前p2p功能版本为第5版 (开启 snappy 压缩)
 	srv.ourHandshake = &protoHandshake{Version: baseProtocolVersion, Name: srv.Name, ID: discover.PubkeyID(&srv.PrivateKey.PublicKey)}
-	for _, p := range srv.Protocols {
-		srv.ourHandshake.Caps = append(srv.ourHandshake.Caps, p.cap())
-	}
+	srv.ourHandshake.Caps = registry.Caps()
+	srv.ourHandshake.setCompressedCaps(srv.Protocols)
 	// listen/dial
+	srv.inboundSlots = srv.makeInboundSlots()
 	if srv.ListenAddr != "" {
 		if err := srv.startListening(); err != nil {  // 启动 TCP 服务监听
 			return err
 		}
 	}
-	if srv.NoDial && srv.ListenAddr == "" {
+	if srv.WSListenAddr != "" {
+		if err := srv.startWSListening(); err != nil {
+			return err
+		}
+	}
+	if srv.NoDial && srv.ListenAddr == "" && srv.WSListenAddr == "" {
 		srv.log.Warn("P2P server will be useless, neither dialing nor listening")
 	}
 
+	if srv.peerMeta, err = newPeerMetaDB(srv.PeerDatabase); err != nil {
+		return err
+	}
+
 	srv.loopWG.Add(1)
 
 	go srv.run(dialer)  // todo 把p2p的服务run起来
@@ -599,7 +697,8 @@ func (srv *Server) startListening() error {   // 启动 TCP 服务 (服务器使
 	srv.listener = listener
 	srv.loopWG.Add(1)
 
-	go srv.listenLoop()   // 一直 for 处理这 客户端发来的 TCP 包 (对端 peer 发来的 TCP 包)  todo 里面会逐个处理 所有 对端peer连进来的 连接 conn
+	srv.log.Info("RLPx listener up", "self", srv.makeSelf(srv.listener, srv.ntab))
+	go srv.listenLoop(listener, true)   // 一直 for 处理这 客户端发来的 TCP 包 (对端 peer 发来的 TCP 包)  todo 里面会逐个处理 所有 对端peer连进来的 连接 conn
 
 	// Map the TCP listening port if NAT is configured.
 	if !laddr.IP.IsLoopback() && srv.NAT != nil {  // 如果当亲 IP 不是 送回地址 , 将 端口映射 加入 NAT 端口映射表中
@@ -612,6 +711,36 @@ func (srv *Server) startListening() error {   // 启动 TCP 服务 (服务器使
 	return nil
 }
 
+// startWSListening launches the WebSocket listener, the sessions accepted by it
+// are handled like the inbound TCP ones.
+func (srv *Server) startWSListening() error {
+	listener, err := newWSListener(srv.WSListenAddr, srv.WSOrigins, srv.WSOriginPeers, srv.WSCertFile, srv.WSKeyFile, srv.inboundSlots)
+	if err != nil {
+		return err
+	}
+	srv.WSListenAddr = listener.Addr().String()
+	srv.wsListener = listener
+	srv.loopWG.Add(1)
+
+	srv.log.Info("WebSocket RLPx listener up", "addr", srv.WSListenAddr, "tls", srv.WSCertFile != "")
+	go srv.listenLoop(listener, false)
+	return nil
+}
+
+// makeInboundSlots creates the handshake slots of the inbound connections, which
+// limit the connections pending in the handshakes to MaxPendingPeers.
+func (srv *Server) makeInboundSlots() chan struct{} {
+	tokens := defaultMaxPendingPeers
+	if srv.MaxPendingPeers > 0 {
+		tokens = srv.MaxPendingPeers
+	}
+	slots := make(chan struct{}, tokens)
+	for i := 0; i < tokens; i++ {
+		slots <- struct{}{}
+	}
+	return slots
+}
+
 type dialer interface {
 	newTasks(running int, peers map[discover.NodeID]*Peer, now time.Time) []task
 	taskDone(task, time.Time)
@@ -802,6 +931,8 @@ running:
 			if err == nil {
 				// The handshakes are done and it passed all checks.
 				p := newPeer(c, srv.Protocols)  // 根据 conn 封装成  p2p.peer
+				p.setPreviousMeta(srv.peerMeta.get(c.id))
+				p.setHandshakeBudgets(srv.HandshakeBudgets)
 				// If message events are enabled, pass the peerFeed
 				// to the peer
 				if srv.EnableMsgEvents {
@@ -810,9 +941,10 @@ running:
 				name := truncateName(c.name)
 				srv.log.Debug("Adding p2p peer", "name", name, "addr", c.fd.RemoteAddr(), "peers", len(peers)+1)
 
+				// The peer is added before it's run, so that its OnAdd hooks see it
+				peers[c.id] = p    // todo 往全局容器记录 peer 信息
 				// todo 里面有 调到 ProtocalManager 中实现的 protocol.Run() 回调
 				go srv.runPeer(p)  // todo 处理 当前 peer 和 某个对端 peer 的消息来往    (到了 ProtocalManager 那边, p2p2.peer 还会被封装成 eth.peer 交由 Protocolmanager 管理)
-				peers[c.id] = p    // todo 往全局容器记录 peer 信息
 				if p.Inbound() {
 					inboundCount++  // 记录 被连接进来的 peer 的数量
 				}
@@ -832,6 +964,8 @@ running:
 			d := common.PrettyDuration(mclock.Now() - pd.created)
 			pd.log.Debug("Removing p2p peer", "duration", d, "peers", len(peers)-1, "req", pd.requested, "err", pd.err)
 			delete(peers, pd.ID())  // 从 peers 集合中移除  peer
+			close(pd.removed)
+			srv.storePeerMeta(pd.Peer)
 			if pd.Inbound() {
 				inboundCount--
 			}
@@ -860,6 +994,16 @@ running:
 		p := <-srv.delpeer
 		p.log.Trace("<-delpeer (spindown)", "remainingTasks", len(runningTasks))
 		delete(peers, p.ID())
+		close(p.removed)
+		srv.storePeerMeta(p.Peer)
+	}
+	srv.peerMeta.close()
+}
+
+// storePeerMeta stores the metadata of a disconnected peer.
+func (srv *Server) storePeerMeta(p *Peer) {
+	if err := srv.peerMeta.put(p.ID(), p.sessionMeta()); err != nil {
+		p.log.Warn("Failed to store peer metadata", "err", err)
 	}
 }
 
@@ -868,6 +1012,10 @@ func (srv *Server) protoHandshakeChecks(peers map[discover.NodeID]*Peer, inbound
 	if len(srv.Protocols) > 0 && countMatchingProtocols(srv.Protocols, c.caps) == 0 {
 		return DiscUselessPeer
 	}
+	// Keep the slots reserved for the protocols the peer doesn't run.
+	if !c.is(trustedConn|staticDialedConn) && len(peers)+srv.reservedSlots(peers, c.caps) >= srv.MaxPeers {
+		return DiscTooManyPeers
+	}
 	// Repeat the encryption handshake checks because the
 	// peer set might have changed between the handshakes.
 	return srv.encHandshakeChecks(peers, inboundCount, c)
@@ -900,7 +1048,53 @@ func (srv *Server) maxDialedConns() int {  // 计算 允许的最大连接数
 	if r == 0 {
 		r = defaultDialRatio  // 如果 比率为0, 则默认改为 3
 	}
-	return srv.MaxPeers / r   // 最允许被节点连接数/ 比率  == 允许的最大连接数
+	max := srv.MaxPeers / r   // 最允许被节点连接数/ 比率  == 允许的最大连接数
+
+	// Slots reserved for inbound only protocols are never dialed
+	if free := srv.MaxPeers - srv.reservedInboundSlots(); max > free {
+		max = free
+	}
+	if max < 0 {
+		max = 0
+	}
+	return max
+}
+
+// reservedSlots returns the number of the free slots reserved for the protocols
+// a peer with the given capabilities doesn't run.
+func (srv *Server) reservedSlots(peers map[discover.NodeID]*Peer, caps []Cap) int {
+	reserved := 0
+	for name, slots := range srv.ReservedSlots {
+		if runsProtocol(srv.Protocols, caps, name) {
+			continue
+		}
+		for _, p := range peers {
+			if _, ok := p.running[name]; ok {
+				slots--
+			}
+		}
+		if slots > 0 {
+			reserved += slots
+		}
+	}
+	return reserved
+}
+
+// reservedInboundSlots returns the number of the slots reserved for protocols
+// which only serve inbound connections.
+func (srv *Server) reservedInboundSlots() int {
+	reserved := 0
+	for name, slots := range srv.ReservedSlots {
+		for _, proto := range srv.Protocols {
+			if proto.Name == name {
+				if proto.Dial == DialInboundOnly {
+					reserved += slots
+				}
+				break // versions of the same protocol share the preference of the first
+			}
+		}
+	}
+	return reserved
 }
 
 type tempError interface {
@@ -908,24 +1102,20 @@ type tempError interface {
 }
 
 // listenLoop runs in its own goroutine and accepts
-// inbound connections.
-func (srv *Server) listenLoop() {   // todo 启动当前 peer 的 TCP 服务监听, 并逐个处理 连接进来的对端peer的连接 conn
+// inbound connections. If reserve is set, a handshake slot is taken
+// before accepting, otherwise the listener takes it for each accepted
+// connection (the WebSocket listener does so once a connection is upgraded).
+func (srv *Server) listenLoop(listener net.Listener, reserve bool) {   // todo 启动当前 peer 的 TCP 服务监听, 并逐个处理 连接进来的对端peer的连接 conn
 	defer srv.loopWG.Done()
-	srv.log.Info("RLPx listener up", "self", srv.makeSelf(srv.listener, srv.ntab))
 
-	tokens := defaultMaxPendingPeers
-	if srv.MaxPendingPeers > 0 {
-		tokens = srv.MaxPendingPeers
-	}
-	slots := make(chan struct{}, tokens)
-	for i := 0; i < tokens; i++ {
-		slots <- struct{}{}
-	}
+	slots := srv.inboundSlots
 
 	// 外面 这个 for 是 处理 当前 peer  和 多个 对端 peer 的 conn 的
 	for {
 		// Wait for a handshake slot before accepting.      等待握手槽，然后接受   (用来限制 外面的for, 逐个处理 对端 peer 和当前 peer 的连接逻辑)
-		<-slots
+		if reserve {
+			<-slots
+		}
 
 		var (
 			fd  net.Conn   // 当前 peer  和  某个对端 peer 的连接实例 conn
@@ -934,7 +1124,7 @@ func (srv *Server) listenLoop() {   // todo 启动当前 peer 的 TCP 服务监
 
 		// 里面 这个 for 是 处理 当前 peer  和  某个对端 peer 的连接消息 (内带当前 conn 实例)
 		for {
-			fd, err = srv.listener.Accept()  // 接收  客户端发来的 消息 <内带当前 conn 实例>  (对于当前 peer 来说,  对端 peer 就是 客户端)
+			fd, err = listener.Accept()  // 接收  客户端发来的 消息 <内带当前 conn 实例>  (对于当前 peer 来说,  对端 peer 就是 客户端)
 			if tempErr, ok := err.(tempError); ok && tempErr.Temporary() {
 				srv.log.Debug("Temporary read error", "err", err)
 				continue
@@ -977,6 +1167,14 @@ func (srv *Server) SetupConn(fd net.Conn, flags connFlag, dialDest *discover.Nod
 	if err != nil {
 		c.close(err)
 		srv.log.Trace("Setting up connection failed", "id", c.id, "err", err)
+		if err != errServerStopped {
+			srv.peerFeed.Send(&PeerEvent{
+				Type:       PeerEventTypeHandshakeFail,
+				Peer:       c.id,
+				Error:      err.Error(),
+				RemoteAddr: fd.RemoteAddr().String(),
+			})
+		}
 	}
 	return err
 }
@@ -1021,6 +1219,7 @@ func (srv *Server) setupConn(c *conn, flags connFlag, dialDest *discover.Node) e
 		return DiscUnexpectedIdentity
 	}
 	c.caps, c.name = phs.Caps, phs.Name
+	c.zcaps = phs.compressedCaps()
 	err = srv.checkpoint(c, srv.addpeer)  // todo 将 连接实例  conn 发送到 chan 中
 	if err != nil {
 		clog.Trace("Rejected peer", "err", err)
@@ -1068,6 +1267,13 @@ func (srv *Server) runPeer(p *Peer) {  // 处理 当前 peer 和 某个对端 pe
 		Type: PeerEventTypeAdd,
 		Peer: p.ID(),
 	})
+	// 通知 各子协议 peer 已经通过 devp2p 握手
+	hooked := hookedProtocols(srv.Protocols)
+	for _, proto := range hooked {
+		if proto.OnAdd != nil {
+			proto.OnAdd(p)
+		}
+	}
 
 	// run the protocol
 	//
@@ -1083,7 +1289,16 @@ func (srv *Server) runPeer(p *Peer) {  // 处理 当前 peer 和 某个对端 pe
 
 	// Note: run waits for existing peers to be sent on srv.delpeer
 	// before returning, so this send should not select on srv.quit.
-	srv.delpeer <- peerDrop{p, err, remoteRequested}   // 发送 移除 当前 peer 和 对端某个 peer 连接信号
+	removed := make(chan struct{})
+	srv.delpeer <- peerDrop{p, err, remoteRequested, removed}   // 发送 移除 当前 peer 和 对端某个 peer 连接信号
+
+	// 等 peer 从 peer 集合中移除之后 再通知 各子协议
+	<-removed
+	for _, proto := range hooked {
+		if proto.OnDrop != nil {
+			proto.OnDrop(p, p.dropReason)
+		}
+	}
 }
 
 // NodeInfo represents a short summary of the information known about the host.
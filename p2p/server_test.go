@@ -19,9 +19,11 @@ package p2p
 import (
 	"crypto/ecdsa"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -472,6 +474,71 @@ func TestServerPeerLimits(t *testing.T) {
 	conn.Close()
 }
 
+func TestServerProtocolHooks(t *testing.T) {
+	var (
+		events     []string
+		lock       sync.Mutex
+		handshaken = make(chan struct{})
+	)
+	record := func(event string) {
+		lock.Lock()
+		events = append(events, event)
+		lock.Unlock()
+	}
+	hooks := func(name string, version uint) Protocol {
+		proto := discard
+		proto.Name, proto.Version = name, version
+		proto.OnAdd = func(*Peer) { record(fmt.Sprintf("add %s/%d", name, version)) }
+		proto.OnHandshake = func(*Peer) {
+			record(fmt.Sprintf("handshake %s/%d", name, version))
+			close(handshaken)
+		}
+		proto.OnDrop = func(_ *Peer, reason DiscReason) { record(fmt.Sprintf("drop %s/%d %v", name, version, reason)) }
+		return proto
+	}
+	// The peer only supports b/2, a is not negotiated with it
+	protos := []Protocol{hooks("a", 1), hooks("b", 1), hooks("b", 2)}
+
+	fd1, fd2 := net.Pipe()
+	c1 := &conn{fd: fd1, transport: newTestTransport(randomID(), fd1), caps: []Cap{{"b", 2}}}
+	c2 := &conn{fd: fd2, transport: newTestTransport(randomID(), fd2)}
+
+	srv := &Server{
+		Config:  Config{Protocols: protos},
+		delpeer: make(chan peerDrop),
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.runPeer(newPeer(c1, protos))
+		close(done)
+	}()
+	// Stand in for the server loop removing the peer
+	go func() {
+		pd := <-srv.delpeer
+		record("removed")
+		close(pd.removed)
+	}()
+	select {
+	case <-handshaken:
+	case <-time.After(time.Second):
+		t.Fatal("protocol not negotiated")
+	}
+	c2.close(errors.New("close"))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("peer did not stop")
+	}
+	want := []string{
+		"add a/1", "add b/1", "handshake b/2", "removed",
+		"drop a/1 network error", "drop b/1 network error",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("hook events mismatch:\nhave %q\nwant %q", events, want)
+	}
+}
+
 func TestServerSetupConn(t *testing.T) {
 	id := randomID()
 	srvkey := newkey()
@@ -559,6 +626,41 @@ func TestServerSetupConn(t *testing.T) {
 	}
 }
 
+func TestServerHandshakeFailEvent(t *testing.T) {
+	id := randomID()
+	srv := &Server{
+		Config: Config{
+			PrivateKey: newkey(),
+			MaxPeers:   10,
+			NoDial:     true,
+			Protocols:  []Protocol{discard},
+		},
+		newTransport: func(fd net.Conn) transport {
+			return &setupTransport{id: id, protoHandshakeErr: errors.New("foo")}
+		},
+		log: log.New(),
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("couldn't start server: %v", err)
+	}
+	defer srv.Stop()
+
+	events := make(chan *PeerEvent, 1)
+	sub := srv.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+
+	p1, _ := net.Pipe()
+	go srv.SetupConn(p1, inboundConn, nil)
+	select {
+	case ev := <-events:
+		if ev.Type != PeerEventTypeHandshakeFail || ev.Peer != id || ev.Error != "foo" || ev.RemoteAddr == "" {
+			t.Errorf("event mismatch: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no handshake failure event")
+	}
+}
+
 type setupTransport struct {
 	id              discover.NodeID
 	encHandshakeErr error
@@ -0,0 +1,237 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
+	"golang.org/x/net/websocket"
+)
+
+// defaultWSOriginPeers is the number of concurrent WebSocket connections allowed
+// per origin if not configured.
+const defaultWSOriginPeers = 16
+
+var errWSListenerClosed = errors.New("websocket listener closed")
+
+// wsListener accepts devp2p sessions tunnelled through WebSocket connections, so
+// that light clients running in a browser (which cannot open raw TCP sockets)
+// can connect to the node. The WebSocket (or TLS for wss) layer only carries the
+// bytes, the sessions are authenticated and encrypted by the usual RLPx handshake
+// on top of it.
+//
+// The browser sends the origin of the page opening the connection, which is
+// checked against the allowed origins and limits the connections of each site.
+// Non-browser clients not sending an origin are always accepted.
+//
+/**
+wsListener: 通过 WebSocket (或 wss) 接收 devp2p 会话, 供 浏览器中的 light client 连接 (浏览器无法使用 TCP socket).
+WebSocket/TLS 层只负责传输, 会话的 认证与加密 仍然由其上的 RLPx 握手完成.
+浏览器 会带上 发起连接页面的 Origin, 用于检查 允许的 origin 并 限制每个 origin 的连接数.
+ */
+type wsListener struct {
+	listener   net.Listener
+	server     *http.Server
+	origins    map[string]bool // allowed origins in lower case, nil for all
+	originCap  int             // maximum number of connections per origin
+	originConn map[string]int  // number of open connections per origin
+	slots      chan struct{}   // handshake slots of the inbound connections, see Server.listenLoop
+
+	conns   chan *wsConn
+	closing chan struct{}
+	lock    sync.Mutex
+	once    sync.Once
+}
+
+// newWSListener starts accepting WebSocket connections on the given address. If
+// a certificate and key are given, the connections are served over TLS (wss).
+// Each upgraded connection takes one of the given handshake slots, connections
+// finding none left are dropped.
+func newWSListener(addr string, origins []string, originCap int, certFile, keyFile string, slots chan struct{}) (*wsListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	if originCap <= 0 {
+		originCap = defaultWSOriginPeers
+	}
+	l := &wsListener{
+		listener:   listener,
+		originCap:  originCap,
+		originConn: make(map[string]int),
+		slots:      slots,
+		origins:    make(map[string]bool), // browsers are rejected unless allowed
+		conns:      make(chan *wsConn),
+		closing:    make(chan struct{}),
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			l.origins = nil
+			break
+		}
+		l.origins[strings.ToLower(origin)] = true
+	}
+	l.server = &http.Server{
+		Handler:           websocket.Server{Handshake: l.handshake, Handler: l.handle},
+		ReadHeaderTimeout: handshakeTimeout,
+	}
+	go l.server.Serve(listener)
+	return l, nil
+}
+
+// handshake checks the origin of a new WebSocket connection.
+func (l *wsListener) handshake(config *websocket.Config, req *http.Request) error {
+	origin := strings.ToLower(req.Header.Get("Origin"))
+	if origin == "" || l.origins == nil || l.origins[origin] {
+		return nil
+	}
+	log.Debug("Rejected WebSocket peer connection", "origin", origin, "addr", req.RemoteAddr)
+	return errors.New("origin not allowed")
+}
+
+// handle passes an established WebSocket connection to Accept and waits until it
+// is closed, the HTTP server drops the connection when the handler returns.
+func (l *wsListener) handle(ws *websocket.Conn) {
+	req := ws.Request()
+	origin := strings.ToLower(req.Header.Get("Origin"))
+	if !l.reserve(origin) {
+		log.Debug("Too many WebSocket peer connections", "origin", origin, "addr", req.RemoteAddr)
+		return
+	}
+	defer l.release(origin)
+
+	// The connection is pending like an accepted TCP one from now on, the
+	// slot is given back by the listen loop after the handshakes
+	select {
+	case <-l.slots:
+	default:
+		log.Debug("Too many pending WebSocket peer connections", "addr", req.RemoteAddr)
+		return
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{Conn: ws, origin: origin, closed: make(chan struct{})}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		conn.remote = addr
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.closing:
+		l.slots <- struct{}{}
+		return
+	}
+	select {
+	case <-conn.closed:
+	case <-l.closing:
+	}
+}
+
+// reserve takes a connection slot of an origin, returning false if it has none
+// left. Non-browser clients (with no origin) are limited by MaxPendingPeers and
+// the peer limits only.
+func (l *wsListener) reserve(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.originConn[origin] >= l.originCap {
+		return false
+	}
+	l.originConn[origin]++
+	return true
+}
+
+// release gives back the connection slot of an origin.
+func (l *wsListener) release(origin string) {
+	if origin == "" {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.originConn[origin]--; l.originConn[origin] <= 0 {
+		delete(l.originConn, origin)
+	}
+}
+
+// Accept implements net.Listener, returning the next WebSocket connection.
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closing:
+		return nil, errWSListenerClosed
+	}
+}
+
+// Close implements net.Listener, stopping the HTTP server and dropping the open
+// connections.
+func (l *wsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closing)
+		err = l.server.Close()
+	})
+	return err
+}
+
+// Addr implements net.Listener.
+func (l *wsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// wsConn is a WebSocket connection carrying a devp2p session. It reports the
+// TCP address of the client as its remote address, so that the IP based checks
+// (NetRestrict, client pools) work the same as for the raw TCP connections.
+type wsConn struct {
+	*websocket.Conn
+	origin string
+	remote *net.TCPAddr
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// RemoteAddr implements net.Conn.
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// Close implements net.Conn, also releasing the handler waiting for it.
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package p2p
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialWS opens a WebSocket connection to a peer listener like a browser would.
+func dialWS(addr, origin string) (net.Conn, error) {
+	config, err := websocket.NewConfig("ws://"+addr, origin)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+func startWSTestServer(t *testing.T, wsAddr string, origins []string) *Server {
+	srv := &Server{Config: Config{
+		Name:          "test",
+		MaxPeers:      10,
+		NoDial:        true,
+		NoDiscovery:   true,
+		PrivateKey:    newkey(),
+		WSListenAddr:  wsAddr,
+		WSOrigins:     origins,
+		WSOriginPeers: 1,
+	}}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("could not start server: %v", err)
+	}
+	return srv
+}
+
+// Tests that a session set up over WebSocket goes through the RLPx handshakes
+// and ends up as a peer on both sides.
+func TestWSSession(t *testing.T) {
+	server := startWSTestServer(t, "127.0.0.1:0", []string{"https://wallet.example"})
+	defer server.Stop()
+	client := startWSTestServer(t, "", nil)
+	defer client.Stop()
+
+	events := make(chan *PeerEvent, 10)
+	sub := server.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+
+	fd, err := dialWS(server.WSListenAddr, "https://wallet.example")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	dest := server.Self()
+	dest.IP, dest.TCP = net.ParseIP("127.0.0.1"), 0
+	if err := client.SetupConn(fd, dynDialedConn, dest); err != nil {
+		t.Fatalf("session setup failed: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != PeerEventTypeAdd || ev.Peer != client.Self().ID {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peer not added on the server")
+	}
+	peers := server.Peers()
+	if len(peers) != 1 {
+		t.Fatalf("server peer count mismatch: have %d, want 1", len(peers))
+	}
+	if addr, ok := peers[0].RemoteAddr().(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+		t.Errorf("remote address not the client's TCP address: %v", peers[0].RemoteAddr())
+	}
+	// The origin has no connection slot left
+	if fd, err := dialWS(server.WSListenAddr, "https://wallet.example"); err == nil {
+		fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := fd.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+			t.Errorf("connection above origin limit not dropped: %v", err)
+		}
+		fd.Close()
+	}
+}
+
+// Tests that the connections of the pages of foreign origins are rejected.
+func TestWSOrigins(t *testing.T) {
+	server := startWSTestServer(t, "127.0.0.1:0", []string{"https://wallet.example"})
+	defer server.Stop()
+
+	if _, err := dialWS(server.WSListenAddr, "https://evil.example"); err == nil {
+		t.Errorf("connection from foreign origin accepted")
+	}
+	for _, tt := range []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{nil, "https://wallet.example", false},
+		{[]string{"*"}, "https://any.example", true},
+		{[]string{"HTTPS://Wallet.example"}, "https://wallet.example", true},
+	} {
+		l, err := newWSListener("127.0.0.1:0", tt.origins, 0, "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dialWS(l.Addr().String(), tt.origin)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("origins %v, origin %q: allowed %v, want %v", tt.origins, tt.origin, allowed, tt.allowed)
+		}
+		l.Close()
+	}
+}
+
+// Tests that the upgraded WebSocket connections count against MaxPendingPeers.
+func TestWSPendingLimit(t *testing.T) {
+	srv := &Server{Config: Config{
+		Name:            "test",
+		MaxPeers:        10,
+		MaxPendingPeers: 1,
+		NoDial:          true,
+		NoDiscovery:     true,
+		PrivateKey:      newkey(),
+		WSListenAddr:    "127.0.0.1:0",
+		WSOrigins:       []string{"*"},
+		WSOriginPeers:   10,
+	}}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("could not start server: %v", err)
+	}
+	defer srv.Stop()
+
+	// The first connection stalls in the encryption handshake, holding the slot
+	pending, err := dialWS(srv.WSListenAddr, "https://wallet.example")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer pending.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(srv.inboundSlots) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending connection took no handshake slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fd, err := dialWS(srv.WSListenAddr, "https://other.example")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer fd.Close()
+	fd.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := fd.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("connection above pending limit not dropped: %v", err)
+	}
+}
@@ -70,6 +70,17 @@ func TestCheckCompatible(t *testing.T) {
 				RewindTo:     9,
 			},
 		},
+		{
+			stored: &ChainConfig{},
+			new:    &ChainConfig{TrieCommitment: 1},
+			head:   0,
+			wantErr: &ConfigCompatError{
+				What:         "trie commitment",
+				StoredConfig: big.NewInt(0),
+				NewConfig:    big.NewInt(0),
+				RewindTo:     0,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -629,6 +629,10 @@ func (c *Client) closeRequestOps(err error) {
 }
 
 func (c *Client) handleNotification(msg *jsonrpcMessage) {
+	if strings.HasSuffix(msg.Method, lagMethodSuffix) {
+		log.Warn("Server dropped subscription notifications", "msg", msg)
+		return
+	}
 	if !strings.HasSuffix(msg.Method, notificationMethodSuffix) {
 		log.Debug("dropping non-subscription message", "msg", msg)
 		return
@@ -35,6 +35,7 @@ const (
 	subscribeMethodSuffix    = "_subscribe"
 	unsubscribeMethodSuffix  = "_unsubscribe"
 	notificationMethodSuffix = "_subscription"
+	lagMethodSuffix          = "_subscriptionLag"
 )
 
 type jsonRequest struct {
@@ -67,6 +68,11 @@ type jsonSubscription struct {
 	Result       interface{} `json:"result,omitempty"`
 }
 
+// jsonLag is the payload of a lag notification.
+type jsonLag struct {
+	Dropped uint64 `json:"dropped"`
+}
+
 type jsonNotification struct {
 	Version string           `json:"jsonrpc"`
 	Method  string           `json:"method"`
@@ -373,6 +379,13 @@ func (c *jsonCodec) CreateNotification(subid, namespace string, event interface{
 		Params: jsonSubscription{Subscription: subid, Result: event}}
 }
 
+// CreateLagNotification will create a JSON-RPC notification telling the client
+// the number of notifications of the subscription dropped by the server.
+func (c *jsonCodec) CreateLagNotification(subid, namespace string, dropped uint64) interface{} {
+	return &jsonNotification{Version: jsonrpcVersion, Method: namespace + lagMethodSuffix,
+		Params: jsonSubscription{Subscription: subid, Result: jsonLag{Dropped: dropped}}}
+}
+
 // Write message to client
 func (c *jsonCodec) Write(res interface{}) error {
 	c.encMu.Lock()
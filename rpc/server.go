@@ -387,6 +387,15 @@ func (s *Server) handle(ctx context.Context, codec ServerCodec, req *serverReque
 	if req.callb.errPos >= 0 { // test if method returned an error
 		if !reply[req.callb.errPos].IsNil() {
 			e := reply[req.callb.errPos].Interface().(error)
+			// errors with their own code (and data) are passed on to the caller as is
+			if de, ok := e.(DataError); ok {
+				if data := de.ErrorData(); data != nil {
+					return codec.CreateErrorResponseWithInfo(&req.id, de, data), nil
+				}
+			}
+			if ce, ok := e.(Error); ok {
+				return codec.CreateErrorResponse(&req.id, ce), nil
+			}
 			res := codec.CreateErrorResponse(&req.id, &callbackError{e.Error()})
 			return res, nil
 		}
@@ -18,6 +18,7 @@ package rpc
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"sync"
 )
@@ -27,8 +28,37 @@ var (
 	ErrNotificationsUnsupported = errors.New("notifications not supported")
 	// ErrNotificationNotFound is returned when the notification for the given id is not found
 	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrSubscriptionBufferOverflow is returned by Notify when the buffer of a subscription
+	// with the OverflowClose policy is full, the subscription is cancelled.
+	ErrSubscriptionBufferOverflow = errors.New("subscription buffer overflow")
+	// ErrNotificationDropped is returned by Notify when the buffer of a subscription
+	// with a drop policy is full and a notification was discarded. The subscription
+	// stays active.
+	ErrNotificationDropped = errors.New("subscription notification dropped")
 )
 
+// OverflowPolicy defines what happens to a notification that doesn't fit into
+// the buffer of a subscription whose client doesn't keep up reading.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest buffered notification.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the new notification.
+	OverflowDropNewest
+	// OverflowClose cancels the subscription.
+	OverflowClose
+)
+
+// SubscriptionBuffer configures the buffering of the notifications between the
+// producer calling Notify and the connection of the client. Buffering is opt-in,
+// see CreateSubscriptionWithBuffer.
+type SubscriptionBuffer struct {
+	Size   int            // Notifications buffered at most, zero delivers them synchronously
+	Policy OverflowPolicy // Handling of the notifications exceeding the buffer
+	Clone  bool           // Snapshot the payload when buffered, for producers reusing their objects
+}
+
 // ID defines a pseudo random number that is used to identify RPC subscriptions.
 type ID string
 
@@ -38,6 +68,12 @@ type Subscription struct {
 	ID        ID
 	namespace string
 	err       chan error // closed on unsubscribe
+
+	buffer  SubscriptionBuffer
+	queueMu sync.Mutex
+	queue   []interface{} // notifications waiting to be written
+	dropped uint64        // notifications dropped since the last lag notification
+	wake    chan struct{} // signals the sender of new notifications
 }
 
 // Err returns a channel that is closed when the client send an unsubscribe request.
@@ -88,7 +124,17 @@ func NotifierFromContext(ctx context.Context) (*Notifier, bool) {
 // are dropped until the subscription is marked as active. This is done
 // by the RPC server after the subscription ID is send to the client.
 func (n *Notifier) CreateSubscription() *Subscription {
-	s := &Subscription{ID: NewID(), err: make(chan error)}
+	return n.CreateSubscriptionWithBuffer(SubscriptionBuffer{})
+}
+
+// CreateSubscriptionWithBuffer returns a new subscription like CreateSubscription,
+// buffering its notifications as configured. The notifications of subscriptions
+// created without a buffer are written synchronously by Notify.
+func (n *Notifier) CreateSubscriptionWithBuffer(buffer SubscriptionBuffer) *Subscription {
+	s := &Subscription{ID: NewID(), err: make(chan error), buffer: buffer}
+	if buffer.Size > 0 {
+		s.wake = make(chan struct{}, 1)
+	}
 	n.subMu.Lock()
 	n.inactive[s.ID] = s  // 每次 [订阅] 方法, 被调用前, 创建本次 [订阅] 方法调用实例时, 追加
 	n.subMu.Unlock()
@@ -97,19 +143,110 @@ func (n *Notifier) CreateSubscription() *Subscription {
 
 // Notify sends a notification to the client with the given data as payload.
 // If an error occurs the RPC connection is closed and the error is returned.
+//
+// Notifications of buffered subscriptions are queued and written in the
+// background. If the client doesn't keep up reading, the overflow policy of the
+// subscription applies: ErrNotificationDropped is returned when a notification
+// was discarded, and the client is told about the dropped notifications, or
+// ErrSubscriptionBufferOverflow when the subscription was cancelled.
+//
+// 带缓冲的订阅: notification 先入队, 由后台 goroutine 写给 client, 不会因为 client 读得慢而阻塞生产者;
+// 缓冲满时按 OverflowPolicy 丢弃 (并给 client 发 lag 通知) 或 取消订阅
 func (n *Notifier) Notify(id ID, data interface{}) error {  // todo Notifier 对象给 各个 service api 的 [订阅] 方法中调用的...
 	n.subMu.RLock()
-	defer n.subMu.RUnlock()
 
 	sub, active := n.active[id]  // 找到, 返回, 用来做 Notify 给 客户端 ...
-	if active {
+	if !active {
+		n.subMu.RUnlock()
+		return nil
+	}
+	if sub.buffer.Size == 0 {
+		defer n.subMu.RUnlock()
+
 		notification := n.codec.CreateNotification(string(id), sub.namespace, data)
 		if err := n.codec.Write(notification); err != nil {  // todo 将被订阅到的  结果数据, 推送回给 客户端 ...
 			n.codec.Close()
 			return err
 		}
+		return nil
+	}
+	if sub.buffer.Clone {
+		blob, err := json.Marshal(data)
+		if err != nil {
+			n.subMu.RUnlock()
+			return err
+		}
+		data = json.RawMessage(blob)
+	}
+	err := sub.enqueue(n.codec.CreateNotification(string(id), sub.namespace, data))
+	n.subMu.RUnlock()
+
+	if err == ErrSubscriptionBufferOverflow {
+		n.unsubscribe(id)
+	}
+	return err
+}
+
+// enqueue buffers a notification, applying the overflow policy if the buffer is
+// full. It returns ErrNotificationDropped if a notification was discarded and
+// ErrSubscriptionBufferOverflow if the subscription has to be cancelled.
+func (s *Subscription) enqueue(notification interface{}) error {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	var err error
+	if len(s.queue) >= s.buffer.Size {
+		switch s.buffer.Policy {
+		case OverflowClose:
+			return ErrSubscriptionBufferOverflow
+		case OverflowDropNewest:
+			s.dropped++
+			return ErrNotificationDropped
+		default:
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.dropped++
+			err = ErrNotificationDropped
+		}
+	}
+	s.queue = append(s.queue, notification)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// send writes the buffered notifications of a subscription to the connection
+// until the subscription is cancelled or the connection is closed. Dropped
+// notifications are reported to the client before the next delivered one.
+func (n *Notifier) send(sub *Subscription) {
+	for {
+		select {
+		case <-sub.wake:
+		case <-sub.err:
+			return
+		case <-n.codec.Closed():
+			return
+		}
+		sub.queueMu.Lock()
+		queue, dropped := sub.queue, sub.dropped
+		sub.queue, sub.dropped = nil, 0
+		sub.queueMu.Unlock()
+
+		if dropped > 0 {
+			if err := n.codec.Write(n.codec.CreateLagNotification(string(sub.ID), sub.namespace, dropped)); err != nil {
+				n.codec.Close()
+				return
+			}
+		}
+		for _, notification := range queue {
+			if err := n.codec.Write(notification); err != nil {
+				n.codec.Close()
+				return
+			}
+		}
 	}
-	return nil
 }
 
 // Closed returns a channel that is closed when the RPC connection is closed.
@@ -141,5 +278,8 @@ func (n *Notifier) activate(id ID, namespace string) {
 		sub.namespace = namespace
 		n.active[id] = sub  //  每次 [订阅] 方法的调用, 都追加这个 .   todo 这里的 n.active 会在 Notifier.Notify() 和 Notifier.unsubscribe() 中被使用 ...
 		delete(n.inactive, id)
+		if sub.buffer.Size > 0 {
+			go n.send(sub)
+		}
 	}
 }
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -328,3 +329,128 @@ func TestSubscriptionMultipleNamespaces(t *testing.T) {
 		}
 	}
 }
+
+// Tests the overflow policies of the subscription buffers.
+func TestSubscriptionBufferOverflow(t *testing.T) {
+	tests := []struct {
+		policy  OverflowPolicy
+		queue   []interface{}
+		dropped uint64
+		err     error
+	}{
+		{OverflowDropOldest, []interface{}{2, 3, 4}, 2, ErrNotificationDropped},
+		{OverflowDropNewest, []interface{}{0, 1, 2}, 2, ErrNotificationDropped},
+		{OverflowClose, []interface{}{0, 1, 2}, 0, ErrSubscriptionBufferOverflow},
+	}
+	for i, tt := range tests {
+		sub := &Subscription{buffer: SubscriptionBuffer{Size: 3, Policy: tt.policy}, wake: make(chan struct{}, 1)}
+		var err error
+		for n := 0; n < 5 && err != ErrSubscriptionBufferOverflow; n++ {
+			if n < 3 {
+				if err = sub.enqueue(n); err != nil {
+					t.Fatalf("test %d: notification %d not buffered: %v", i, n, err)
+				}
+				continue
+			}
+			err = sub.enqueue(n)
+		}
+		if err != tt.err {
+			t.Errorf("test %d: result mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if !reflect.DeepEqual(sub.queue, tt.queue) || sub.dropped != tt.dropped {
+			t.Errorf("test %d: buffer mismatch: have %v (dropped %d), want %v (dropped %d)", i, sub.queue, sub.dropped, tt.queue, tt.dropped)
+		}
+	}
+}
+
+// Tests that a producer isn't blocked by a client not reading its notifications,
+// and that the client is told about the dropped ones.
+func TestSubscriptionLagNotification(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	codec := NewJSONCodec(serverConn)
+	notifier := newNotifier(codec)
+	sub := notifier.CreateSubscriptionWithBuffer(SubscriptionBuffer{Size: 4, Policy: OverflowDropOldest})
+	notifier.activate(sub.ID, "eth")
+
+	// Nobody reads the connection, the notifications must not block
+	const count = 10
+	done := make(chan error)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := notifier.Notify(sub.ID, i); err != nil && err != ErrNotificationDropped {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("notify failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("notify blocked by the client")
+	}
+	// Read the notifications: all but the dropped ones arrive in order
+	var (
+		in       = json.NewDecoder(clientConn)
+		received = -1
+		total    uint64
+		lagged   bool
+	)
+	for total < count {
+		var msg struct {
+			Method string `json:"method"`
+			Params struct {
+				Result json.RawMessage `json:"result"`
+			} `json:"params"`
+		}
+		if err := in.Decode(&msg); err != nil {
+			t.Fatalf("failed to read notification: %v", err)
+		}
+		switch msg.Method {
+		case "eth" + lagMethodSuffix:
+			var lag jsonLag
+			if err := json.Unmarshal(msg.Params.Result, &lag); err != nil {
+				t.Fatalf("invalid lag notification: %v", err)
+			}
+			total += lag.Dropped
+			lagged = true
+		case "eth" + notificationMethodSuffix:
+			var val int
+			if err := json.Unmarshal(msg.Params.Result, &val); err != nil {
+				t.Fatalf("invalid notification: %v", err)
+			}
+			if val <= received {
+				t.Fatalf("notification out of order: %d after %d", val, received)
+			}
+			received = val
+			total++
+		default:
+			t.Fatalf("unexpected method %q", msg.Method)
+		}
+	}
+	if !lagged {
+		t.Errorf("no lag notification received")
+	}
+	if received != count-1 {
+		t.Errorf("last notification mismatch: have %d, want %d", received, count-1)
+	}
+}
+
+// Tests that subscriptions are only buffered when asked for.
+func TestSubscriptionBufferOptIn(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	notifier := newNotifier(NewJSONCodec(serverConn))
+	if sub := notifier.CreateSubscription(); sub.buffer.Size != 0 || sub.wake != nil {
+		t.Errorf("default subscription buffered: %+v", sub.buffer)
+	}
+	if sub := notifier.CreateSubscriptionWithBuffer(SubscriptionBuffer{Size: 8}); sub.buffer.Size != 8 || sub.wake == nil {
+		t.Errorf("buffer of subscription not applied: %+v", sub.buffer)
+	}
+}
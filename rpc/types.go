@@ -121,6 +121,12 @@ type Error interface {
 	ErrorCode() int // returns the code
 }
 
+// DataError is an RPC error carrying additional data about the failure.
+type DataError interface {
+	Error
+	ErrorData() interface{} // returns the error data, nil if none
+}
+
 // ServerCodec implements reading, parsing and writing RPC messages for the server side of
 // a RPC session. Implementations must be go-routine safe since the codec can be called in
 // multiple go-routines concurrently.
@@ -142,6 +148,8 @@ type ServerCodec interface {
 	CreateErrorResponseWithInfo(id interface{}, err Error, info interface{}) interface{}
 	// Create notification response
 	CreateNotification(id, namespace string, event interface{}) interface{}
+	// Create notification telling the client that notifications were dropped
+	CreateLagNotification(id, namespace string, dropped uint64) interface{}
 	// Write msg to client.
 	Write(msg interface{}) error
 	// Close underlying data stream
@@ -0,0 +1,163 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+)
+
+// RefcountMismatch is a cached node whose tracked parent count differs from the
+// number of references actually held by other cached nodes.
+type RefcountMismatch struct {
+	Hash common.Hash `json:"hash"`
+	Have uint16      `json:"have"` // Parent count tracked by the database
+	Want uint16      `json:"want"` // References found in the cache
+}
+
+// AuditReport is the result of a reference count audit of the trie database.
+//
+// AuditReport: 对 trie database 中 node 引用计数的检查结果
+type AuditReport struct {
+	Roots     []common.Hash      `json:"roots"`     // Roots the audit was run against
+	Cached    int                `json:"cached"`    // Number of nodes in the memory cache
+	Reachable int                `json:"reachable"` // Number of cached nodes reachable from the roots
+	Leaked    []common.Hash      `json:"leaked"`    // Cached nodes not reachable from any root
+	Missing   []common.Hash      `json:"missing"`   // Reachable nodes neither cached nor on disk
+	Refcounts []RefcountMismatch `json:"refcounts"` // Cached nodes with an inconsistent parent count
+}
+
+// Healthy returns whether the audit found no problems.
+func (r *AuditReport) Healthy() bool {
+	return len(r.Leaked) == 0 && len(r.Missing) == 0 && len(r.Refcounts) == 0
+}
+
+// String implements fmt.Stringer.
+func (r *AuditReport) String() string {
+	return fmt.Sprintf("roots: %d, cached: %d, reachable: %d, leaked: %d, missing: %d, bad refcounts: %d",
+		len(r.Roots), r.Cached, r.Reachable, len(r.Leaked), len(r.Missing), len(r.Refcounts))
+}
+
+// Audit checks the reference counts of the memory cache against the set of nodes
+// actually reachable from the given roots. If no roots are given, the ones
+// referenced by the meta root (i.e. the tries held alive by the caller) are used.
+//
+// The report lists the cached nodes no root can reach (leaked, they'll never be
+// garbage collected), the nodes referenced from a reachable node that are neither
+// in memory nor on disk (prematurely dereferenced, these cause "missing trie node"
+// errors) and the nodes whose parent counter doesn't match the references held
+// by the other cached nodes.
+//
+// Subtries already flushed to disk are assumed to be complete and not traversed.
+// The method holds the database lock for the whole audit, only use it for
+// debugging.
+//
+/**
+Audit:
+	根据给定的 roots 的实际可达 node 集合, 检查内存缓存中 node 的引用计数, 报告:
+	1) 泄露的 node (缓存中存在, 但是任何 root 都不可达)
+	2) 过早被 dereference 的 node (可达, 但是 内存 和 磁盘 中都没有)
+	3) parents 计数 和 实际引用数不一致的 node
+ */
+func (db *Database) Audit(roots []common.Hash) *AuditReport {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if len(roots) == 0 {
+		for root := range db.nodes[common.Hash{}].children {
+			roots = append(roots, root)
+		}
+		sortHashes(roots)
+	}
+	report := &AuditReport{Roots: roots, Cached: len(db.nodes) - 1}
+
+	// Collect the reachable set, noting any node that's gone missing
+	var (
+		reachable = make(map[common.Hash]struct{})
+		missing   = make(map[common.Hash]struct{})
+	)
+	for _, root := range roots {
+		db.auditReachable(root, reachable, missing)
+	}
+	report.Reachable = len(reachable)
+	for hash := range missing {
+		report.Missing = append(report.Missing, hash)
+	}
+	// Count the references held by the cached nodes
+	refs := make(map[common.Hash]int)
+	for hash, node := range db.nodes {
+		for child, count := range node.children {
+			refs[child] += int(count)
+		}
+		if hash == (common.Hash{}) {
+			continue
+		}
+		if _, ok := reachable[hash]; !ok {
+			report.Leaked = append(report.Leaked, hash)
+		}
+		if _, ok := node.node.(rawNode); !ok {
+			var implicit []common.Hash
+			gatherChildren(node.node, &implicit)
+			for _, child := range implicit {
+				refs[child]++
+			}
+		}
+	}
+	for hash, node := range db.nodes {
+		if hash == (common.Hash{}) {
+			continue
+		}
+		if want := refs[hash]; int(node.parents) != want {
+			report.Refcounts = append(report.Refcounts, RefcountMismatch{Hash: hash, Have: node.parents, Want: uint16(want)})
+		}
+	}
+	sortHashes(report.Leaked)
+	sortHashes(report.Missing)
+	sort.Slice(report.Refcounts, func(i, j int) bool {
+		return bytes.Compare(report.Refcounts[i].Hash[:], report.Refcounts[j].Hash[:]) < 0
+	})
+	return report
+}
+
+// auditReachable marks all cached nodes reachable from hash. Nodes that are not
+// cached and not in the persistent database either are marked missing.
+func (db *Database) auditReachable(hash common.Hash, reachable, missing map[common.Hash]struct{}) {
+	if _, ok := reachable[hash]; ok || hash == emptyRoot {
+		return
+	}
+	node, ok := db.nodes[hash]
+	if !ok {
+		if has, _ := db.diskdb.Has(hash[:]); !has {
+			missing[hash] = struct{}{}
+		}
+		return
+	}
+	reachable[hash] = struct{}{}
+	for _, child := range node.childs() {
+		db.auditReachable(child, reachable, missing)
+	}
+}
+
+// sortHashes sorts a hash slice in ascending order.
+func sortHashes(hashes []common.Hash) {
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+func TestDatabaseAudit(t *testing.T) {
+	triedb := NewDatabase(ethdb.NewMemDatabase())
+
+	// Create two versions of a trie, both referenced from the meta root
+	trie, _ := New(common.Hash{}, triedb)
+	for i := byte(0); i < 100; i++ {
+		trie.Update([]byte{i, i, i}, []byte{i})
+	}
+	root1, _ := trie.Commit(nil)
+	triedb.Reference(root1, common.Hash{})
+
+	for i := byte(0); i < 10; i++ {
+		trie.Update([]byte{i, i, i}, []byte{i, i})
+	}
+	root2, _ := trie.Commit(nil)
+	triedb.Reference(root2, common.Hash{})
+
+	if report := triedb.Audit(nil); !report.Healthy() || report.Reachable != report.Cached {
+		t.Fatalf("fresh database audit failed: %v", report)
+	}
+	// Auditing against the new root only reports the old nodes as leaked
+	report := triedb.Audit([]common.Hash{root2})
+	if len(report.Leaked) == 0 || len(report.Missing) != 0 || len(report.Refcounts) != 0 {
+		t.Fatalf("stale version not reported as leaked: %v", report)
+	}
+	triedb.Dereference(root1)
+	if report := triedb.Audit([]common.Hash{root2}); !report.Healthy() {
+		t.Fatalf("dereferenced database audit failed: %v", report)
+	}
+	// Drop a live node behind the database's back and mess up a refcount
+	var victim common.Hash
+	for _, child := range triedb.nodes[root2].childs() {
+		if _, ok := triedb.nodes[child]; ok {
+			victim = child
+			break
+		}
+	}
+	if victim == (common.Hash{}) {
+		t.Fatalf("root has no cached children")
+	}
+	triedb.uncache(victim)
+	triedb.nodes[root2].parents++
+
+	report = triedb.Audit([]common.Hash{root2})
+	if len(report.Missing) != 1 || report.Missing[0] != victim {
+		t.Errorf("missing node mismatch: have %x, want [%x]", report.Missing, victim)
+	}
+	if len(report.Refcounts) != 1 || report.Refcounts[0] != (RefcountMismatch{Hash: root2, Have: 2, Want: 1}) {
+		t.Errorf("refcount mismatch not reported: %v", report.Refcounts)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sort"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+// unloadedNodes is the number of recently unloaded node hashes remembered by
+// each database to detect the nodes which had to be loaded again.
+const unloadedNodes = 32 * 1024
+
+var cacheRefetchCounter = metrics.NewRegisteredCounter("trie/cacherefetch", nil) // 被卸载后 又需要重新从 db 加载的 node 计数
+
+// CacheRefetches retrieves a global counter measuring the number of unloaded
+// nodes the tries had to load again from the database since process startup.
+// Compared to CacheUnloads, it tells how well the cache policy suits the access
+// pattern of the workload.
+func CacheRefetches() int64 {
+	return cacheRefetchCounter.Count()
+}
+
+// CachePolicy decides which nodes of a trie are unloaded from memory when the
+// trie is committed. Every node is tagged with the cache generation (number of
+// commits) it was created or loaded in; a policy returns the number of recent
+// generations kept in memory, the clean nodes of the older ones are unloaded.
+//
+/**
+CachePolicy: 决定 trie commit 时 哪些 node 从内存中卸载 (只留 hashNode).
+返回值 是保留在内存中的 最近 generation 数, 更老的 (非 dirty) node 被卸载.
+ */
+type CachePolicy interface {
+	CacheLimit(t *Trie) uint16
+}
+
+// GenerationPolicy keeps a fixed number of cache generations in memory. This is
+// the default policy of the tries, see SetCacheLimit.
+type GenerationPolicy uint16
+
+// CacheLimit implements CachePolicy, returning the configured generation count.
+func (p GenerationPolicy) CacheLimit(*Trie) uint16 {
+	return uint16(p)
+}
+
+// ByteBudgetPolicy keeps the most recently used nodes of a trie in memory, up to
+// the given number of bytes. The nodes are ordered by generation, so the ones of
+// the current generation are always kept even if they exceed the budget.
+//
+// ByteBudgetPolicy: 按 字节预算 保留 最近使用的 node (以 generation 为粒度的 LRU)
+type ByteBudgetPolicy uint64
+
+// CacheLimit implements CachePolicy, finding the number of generations fitting
+// in the budget from the sizes tracked by the trie.
+func (p ByteBudgetPolicy) CacheLimit(t *Trie) uint16 {
+	sizes := t.cachedSizes()
+
+	ages := make([]int, 0, len(sizes))
+	for age := range sizes {
+		ages = append(ages, int(age))
+	}
+	sort.Ints(ages)
+
+	var total uint64
+	for _, age := range ages {
+		if total += sizes[uint16(age)]; total > uint64(p) {
+			if age == 0 {
+				return 1
+			}
+			return uint16(age)
+		}
+	}
+	// Everything fits, keep all the generations
+	return ^uint16(0)
+}
+
+// cacheSizes tracks the estimated sizes of the nodes a trie holds in memory per
+// cache generation (not age) they are tagged with. It's updated as the nodes are
+// created, loaded and unloaded, so that the sizes are known without walking the
+// trie. A node only accounts for its own data, its children in memory have their
+// own entries.
+//
+// cacheSizes: 按 node 的 generation 增量记录 内存中 node 的大小 (创建/加载/卸载 时更新), 免去每次 commit 遍历整棵树
+type cacheSizes map[uint16]int64
+
+// add adds (or with a negative sign, removes) the size of a single node.
+func (s cacheSizes) add(n node, sign int64) {
+	var (
+		gen  uint16
+		size int
+	)
+	switch n := n.(type) {
+	case *shortNode:
+		gen, size = n.flags.gen, len(n.Key)+refSize(n.Val)
+	case *fullNode:
+		gen = n.flags.gen
+		for _, child := range &n.Children {
+			size += refSize(child)
+		}
+	default:
+		return
+	}
+	if s[gen] += sign * int64(size); s[gen] == 0 {
+		delete(s, gen)
+	}
+}
+
+// addTree adds (or removes) the sizes of a node and its descendants in memory.
+func (s cacheSizes) addTree(n node, sign int64) {
+	s.add(n, sign)
+	switch n := n.(type) {
+	case *shortNode:
+		s.addTree(n.Val, sign)
+	case *fullNode:
+		for _, child := range &n.Children {
+			s.addTree(child, sign)
+		}
+	}
+}
+
+// copy returns an independent copy of the sizes.
+func (s cacheSizes) copy() cacheSizes {
+	if s == nil {
+		return nil
+	}
+	cpy := make(cacheSizes, len(s))
+	for gen, size := range s {
+		cpy[gen] = size
+	}
+	return cpy
+}
+
+// refSize returns the size of a child reference held by a node: the inlined data
+// of a value, or a hash for any other node, loaded or not.
+func refSize(n node) int {
+	switch n := n.(type) {
+	case nil:
+		return 0
+	case valueNode:
+		return len(n)
+	}
+	return common.HashLength
+}
+
+// SetCachePolicy sets the policy deciding which nodes are unloaded on commit,
+// replacing the generation limit set by SetCacheLimit. A nil policy restores it.
+// The sizes of the nodes in memory are tracked while a policy is set.
+func (t *Trie) SetCachePolicy(policy CachePolicy) {
+	t.policy = policy
+	if policy == nil {
+		t.sizes = nil
+	} else if t.sizes == nil {
+		t.sizes = make(cacheSizes)
+		t.sizes.addTree(t.root, 1)
+	}
+}
+
+// SetCachePolicy sets the node unloading policy of the trie, see Trie.SetCachePolicy.
+func (t *SecureTrie) SetCachePolicy(policy CachePolicy) {
+	t.trie.SetCachePolicy(policy)
+}
+
+// cacheLimit returns the generation limit of the next commit.
+func (t *Trie) cacheLimit() uint16 {
+	if t.policy != nil {
+		return t.policy.CacheLimit(t)
+	}
+	return t.cachelimit
+}
+
+// cachedSizes returns the sizes of the nodes in memory by their generation age.
+func (t *Trie) cachedSizes() map[uint16]uint64 {
+	sizes := make(map[uint16]uint64, len(t.sizes))
+	for gen, size := range t.sizes {
+		if size > 0 {
+			sizes[t.cachegen-gen] += uint64(size)
+		}
+	}
+	return sizes
+}
+
+// track accounts for a node entering the memory of the trie.
+func (t *Trie) track(n node) {
+	if t.sizes != nil {
+		t.sizes.add(n, 1)
+	}
+}
+
+// untrack accounts for a node leaving the memory of the trie.
+func (t *Trie) untrack(n node) {
+	if t.sizes != nil {
+		t.sizes.add(n, -1)
+	}
+}
+
+// tracked accounts for a new node and returns it.
+func (t *Trie) tracked(n node) node {
+	t.track(n)
+	return n
+}
+
+// trackTree accounts for a node loaded from the database along with its
+// embedded children.
+func (t *Trie) trackTree(n node) {
+	if t.sizes != nil {
+		t.sizes.addTree(n, 1)
+	}
+}
+
+// markUnloaded remembers an unloaded node to detect if it has to be loaded again.
+func (db *Database) markUnloaded(hash hashNode) {
+	db.unloads.Add(common.BytesToHash(hash), struct{}{})
+}
+
+// checkRefetch counts the load of a node if it was recently unloaded.
+func (db *Database) checkRefetch(hash common.Hash) {
+	if db.unloads.Contains(hash) {
+		db.unloads.Remove(hash)
+		cacheRefetchCounter.Inc(1)
+	}
+}
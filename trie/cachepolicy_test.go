@@ -0,0 +1,134 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+func TestByteBudgetPolicy(t *testing.T) {
+	trie, _ := New(common.Hash{}, NewDatabase(ethdb.NewMemDatabase()))
+	trie.SetCachePolicy(GenerationPolicy(10))
+
+	// Fill two subtrees of the root in two generations
+	key := func(prefix byte, i int) []byte {
+		return append([]byte{prefix}, common.LeftPadBytes([]byte{byte(i)}, 31)...)
+	}
+	for i := 0; i < 100; i++ {
+		trie.Update(key(0x10, i), []byte("an old value which is long enough"))
+		trie.Update(key(0x30, i), []byte("an old value which is long enough"))
+	}
+	trie.Commit(nil)
+	for i := 0; i < 100; i++ {
+		trie.Update(key(0x20, i), []byte("a new value which is long enough"))
+	}
+	trie.Commit(nil)
+
+	sizes := walkSizes(trie)
+	if tracked := trie.cachedSizes(); !reflect.DeepEqual(tracked, sizes) {
+		t.Fatalf("tracked sizes mismatch: have %v, want %v", tracked, sizes)
+	}
+	if sizes[1] == 0 || sizes[2] == 0 {
+		t.Fatalf("unexpected generation sizes: %v", sizes)
+	}
+	tests := []struct {
+		budget uint64
+		limit  uint16
+	}{
+		{0, 1},
+		{sizes[1], 2},
+		{sizes[1] + sizes[2], ^uint16(0)},
+	}
+	for _, tt := range tests {
+		if limit := ByteBudgetPolicy(tt.budget).CacheLimit(trie); limit != tt.limit {
+			t.Errorf("budget %d: limit mismatch: have %d, want %d", tt.budget, limit, tt.limit)
+		}
+	}
+	// Committing with the budget of the recent generation unloads the old subtree
+	// (only the children of the modified nodes are checked for unloading)
+	trie.SetCachePolicy(ByteBudgetPolicy(sizes[1]))
+	trie.Update(key(0x20, 0), []byte("an updated value"))
+	trie.Commit(nil)
+
+	sizes = walkSizes(trie)
+	if tracked := trie.cachedSizes(); !reflect.DeepEqual(tracked, sizes) {
+		t.Fatalf("tracked sizes mismatch after unload: have %v, want %v", tracked, sizes)
+	}
+	if sizes[3] != 0 || sizes[2] == 0 || sizes[1] == 0 {
+		t.Fatalf("unexpected generation sizes after commit: %v", sizes)
+	}
+	old, ok := trie.root.(*fullNode).Children[1].(hashNode)
+	if !ok {
+		t.Fatalf("old subtree not unloaded: %T", trie.root.(*fullNode).Children[1])
+	}
+	if !trie.db.unloads.Contains(common.BytesToHash(old)) {
+		t.Fatalf("unloaded node not remembered")
+	}
+	// Loading it again is detected as a refetch
+	trie.Get(key(0x10, 0))
+	if trie.db.unloads.Contains(common.BytesToHash(old)) {
+		t.Errorf("refetch of unloaded node not detected")
+	}
+	if tracked, sizes := trie.cachedSizes(), walkSizes(trie); !reflect.DeepEqual(tracked, sizes) {
+		t.Errorf("tracked sizes mismatch after refetch: have %v, want %v", tracked, sizes)
+	}
+}
+
+func TestCachedSizesTracking(t *testing.T) {
+	trie, _ := New(common.Hash{}, NewDatabase(ethdb.NewMemDatabase()))
+	trie.SetCachePolicy(GenerationPolicy(2))
+
+	keys := make([][]byte, 0, 200)
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 50; j++ {
+			switch op := rand.Intn(5); {
+			case op == 0 && len(keys) > 0:
+				k := rand.Intn(len(keys))
+				trie.Delete(keys[k])
+				keys = append(keys[:k], keys[k+1:]...)
+			case op == 1 && len(keys) > 0:
+				trie.Get(keys[rand.Intn(len(keys))])
+			default:
+				key := common.LeftPadBytes([]byte{byte(rand.Intn(256)), byte(rand.Intn(256))}, 32)
+				trie.Update(key, randBytes(1+rand.Intn(40)))
+				keys = append(keys, key)
+			}
+		}
+		trie.Commit(nil)
+		if tracked, sizes := trie.cachedSizes(), walkSizes(trie); !reflect.DeepEqual(tracked, sizes) {
+			t.Fatalf("round %d: tracked sizes mismatch: have %v, want %v", i, tracked, sizes)
+		}
+	}
+}
+
+// walkSizes returns the sizes of the nodes in memory by generation age, walking
+// the whole trie.
+func walkSizes(t *Trie) map[uint16]uint64 {
+	sizes := make(cacheSizes)
+	sizes.addTree(t.root, 1)
+
+	ages := make(map[uint16]uint64)
+	for gen, size := range sizes {
+		ages[t.cachegen-gen] += uint64(size)
+	}
+	return ages
+}
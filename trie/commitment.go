@@ -0,0 +1,240 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+)
+
+// CommitmentVersion identifies the format the leaves of a trie commit to their
+// values in. Every version but the plain one prefixes the leaves with its own
+// version byte, so leaves of a different format are rejected instead of being
+// misinterpreted.
+//
+/**
+CommitmentVersion: 叶子节点 如何承诺 (commit) 其 value 的格式版本, 用于在本分析分支中 做实验
+	CommitmentPlain:  叶子 直接存 value (以太坊 标准格式, 例如 account 的 RLP)
+	CommitmentHashed: 叶子 只存 版本字节 + value 的 keccak256 hash, value 本身 在 commit 时 作为 blob 存放在 trie.Database 中,
+		由 持有该叶子的 node 引用 (和 合约 code 一样 参与 引用计数 GC)
+
+	注意: 版本不同, 同样的数据 得到的 trie root 也不同; key-value 迭代器 (Iterator) 给出的 是 还原后的 value,
+	NodeIterator.LeafBlob 和 proof 给出的 是 叶子的原始内容, 需要用 Database.LeafValue 还原
+ */
+type CommitmentVersion byte
+
+const (
+	CommitmentPlain  CommitmentVersion = iota // Leaves hold the values themselves (standard Ethereum)
+	CommitmentHashed                          // Leaves hold the version byte and the hash of the value
+)
+
+// ErrCommitmentVersion is returned when a leaf isn't in the commitment format of
+// the trie database.
+var ErrCommitmentVersion = errors.New("leaf of mismatching commitment version")
+
+// String implements fmt.Stringer.
+func (v CommitmentVersion) String() string {
+	switch v {
+	case CommitmentPlain:
+		return "plain"
+	case CommitmentHashed:
+		return "hashed"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(v))
+	}
+}
+
+// LeafCommitment encodes the values stored in a trie into the content of the
+// leaves committing to them, and resolves the values back.
+type LeafCommitment interface {
+	// Version returns the version of the leaf format.
+	Version() CommitmentVersion
+
+	// Encode returns the content of the leaf committing to a value. The data the
+	// leaf references by hash is passed to store.
+	Encode(value []byte, store func(hash common.Hash, data []byte)) []byte
+
+	// Decode returns the value a leaf commits to, looking up the data the leaf
+	// references by hash with resolve.
+	Decode(leaf []byte, resolve func(hash common.Hash) ([]byte, error)) ([]byte, error)
+
+	// References returns the hashes of the data referenced by a leaf, kept alive
+	// by the trie node holding the leaf.
+	References(leaf []byte) []common.Hash
+}
+
+// NewLeafCommitment returns the leaf commitment of a version.
+func NewLeafCommitment(version CommitmentVersion) (LeafCommitment, error) {
+	switch version {
+	case CommitmentPlain:
+		return plainCommitment{}, nil
+	case CommitmentHashed:
+		return hashedCommitment{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported trie commitment version %v", version)
+	}
+}
+
+// plainCommitment stores the values in the leaves as they are.
+type plainCommitment struct{}
+
+func (plainCommitment) Version() CommitmentVersion { return CommitmentPlain }
+
+func (plainCommitment) Encode(value []byte, store func(common.Hash, []byte)) []byte {
+	return value
+}
+
+func (plainCommitment) Decode(leaf []byte, resolve func(common.Hash) ([]byte, error)) ([]byte, error) {
+	return leaf, nil
+}
+
+func (plainCommitment) References(leaf []byte) []common.Hash { return nil }
+
+// hashedCommitment stores the hashes of the values in the leaves, prefixed with
+// the version byte. The values are kept as blobs of the trie database.
+type hashedCommitment struct{}
+
+func (hashedCommitment) Version() CommitmentVersion { return CommitmentHashed }
+
+func (hashedCommitment) Encode(value []byte, store func(common.Hash, []byte)) []byte {
+	hash := crypto.Keccak256Hash(value)
+	store(hash, value)
+	return append([]byte{byte(CommitmentHashed)}, hash[:]...)
+}
+
+func (hashedCommitment) Decode(leaf []byte, resolve func(common.Hash) ([]byte, error)) ([]byte, error) {
+	if len(leaf) != 1+common.HashLength || leaf[0] != byte(CommitmentHashed) {
+		return nil, ErrCommitmentVersion
+	}
+	hash := common.BytesToHash(leaf[1:])
+	value, err := resolve(hash)
+	if err != nil || len(value) == 0 {
+		return nil, fmt.Errorf("missing leaf value %x: %v", hash, err)
+	}
+	return value, nil
+}
+
+func (hashedCommitment) References(leaf []byte) []common.Hash {
+	if len(leaf) != 1+common.HashLength || leaf[0] != byte(CommitmentHashed) {
+		return nil
+	}
+	return []common.Hash{common.BytesToHash(leaf[1:])}
+}
+
+// SetCommitment sets the leaf format of the tries opened on the database. It
+// must be set before any trie is used, tries of different formats can't be
+// mixed in a database.
+func (db *Database) SetCommitment(version CommitmentVersion) error {
+	commitment, err := NewLeafCommitment(version)
+	if err != nil {
+		return err
+	}
+	db.commitment = commitment
+	return nil
+}
+
+// Commitment returns the leaf format of the tries opened on the database.
+func (db *Database) Commitment() CommitmentVersion {
+	return db.leafCommitment().Version()
+}
+
+// LeafValue returns the value committed to by the content of a leaf, as returned
+// by the iterators and proofs of the tries of the database.
+func (db *Database) LeafValue(leaf []byte) ([]byte, error) {
+	return db.leafCommitment().Decode(leaf, db.Node)
+}
+
+// leafCommitment returns the leaf commitment of the database, the plain one if
+// unset.
+func (db *Database) leafCommitment() LeafCommitment {
+	if db.commitment == nil {
+		return plainCommitment{}
+	}
+	return db.commitment
+}
+
+// leafCallback returns the commit callback of the tries of the database. The
+// data referenced by the committed leaves is stored from pending (the values the
+// trie collected since its last commit) and referenced from the nodes holding
+// the leaves, and onleaf (if any) is invoked with the values instead of the
+// leaves.
+//
+// 只有 真正 commit 的 叶子 才把 value blob 存入 db, 并挂到 持有该叶子的 node 下面 (引用计数),
+// 中途被覆盖 或 从未 commit 的 value 不会留在 db 中; 传给 onleaf 的 是 还原后的 value
+func (db *Database) leafCallback(onleaf LeafCallback, pending map[common.Hash][]byte) LeafCallback {
+	commitment := db.leafCommitment()
+	if commitment.Version() == CommitmentPlain {
+		return onleaf
+	}
+	resolve := pendingResolver(db, pending)
+	return func(leaf []byte, parent common.Hash) error {
+		db.lock.Lock()
+		for _, hash := range commitment.References(leaf) {
+			if value, ok := pending[hash]; ok {
+				db.insert(hash, value, rawNode(value))
+			}
+			db.reference(hash, parent)
+		}
+		db.lock.Unlock()
+
+		if onleaf == nil {
+			return nil
+		}
+		value, err := commitment.Decode(leaf, resolve)
+		if err != nil {
+			return err
+		}
+		return onleaf(value, parent)
+	}
+}
+
+// pendingResolver returns a lookup of the data referenced by leaves, preferring
+// the pending values not yet stored in the database.
+func pendingResolver(db *Database, pending map[common.Hash][]byte) func(common.Hash) ([]byte, error) {
+	return func(hash common.Hash) ([]byte, error) {
+		if value, ok := pending[hash]; ok {
+			return value, nil
+		}
+		return db.Node(hash)
+	}
+}
+
+// encodeLeaf returns the content of the leaf committing to a value. The data the
+// leaf references is kept with the trie until it's committed.
+func (t *Trie) encodeLeaf(value []byte) []byte {
+	if t.db == nil {
+		return value
+	}
+	return t.db.leafCommitment().Encode(value, func(hash common.Hash, data []byte) {
+		if t.leaves == nil {
+			t.leaves = make(map[common.Hash][]byte)
+		}
+		t.leaves[hash] = data
+	})
+}
+
+// decodeLeaf returns the value committed to by the content of a leaf, including
+// the leaves not committed yet.
+func (t *Trie) decodeLeaf(leaf []byte) ([]byte, error) {
+	if t.db == nil || leaf == nil {
+		return leaf, nil
+	}
+	return t.db.leafCommitment().Decode(leaf, pendingResolver(t.db, t.leaves))
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// newCommitmentDatabase creates a trie database with the given leaf format.
+func newCommitmentDatabase(t *testing.T, diskdb ethdb.Database, version CommitmentVersion) *Database {
+	db := NewDatabase(diskdb)
+	if err := db.SetCommitment(version); err != nil {
+		t.Fatalf("failed to set commitment %v: %v", version, err)
+	}
+	return db
+}
+
+// commitmentTestEntries returns the test content of the tries, with values long
+// enough for all the leaves to be stored on their own.
+func commitmentTestEntries() map[string][]byte {
+	entries := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		entries[key] = append(bytes.Repeat([]byte{byte(i)}, 40), key...)
+	}
+	return entries
+}
+
+func TestCommitmentPlain(t *testing.T)  { testCommitment(t, CommitmentPlain) }
+func TestCommitmentHashed(t *testing.T) { testCommitment(t, CommitmentHashed) }
+
+// Tests that the values of the tries are retrieved, passed to the commit callback
+// and persisted the same way, whatever the leaf format.
+func testCommitment(t *testing.T, version CommitmentVersion) {
+	diskdb := ethdb.NewMemDatabase()
+	triedb := newCommitmentDatabase(t, diskdb, version)
+	tr, _ := New(common.Hash{}, triedb)
+
+	entries := commitmentTestEntries()
+	for key, value := range entries {
+		tr.Update([]byte(key), value)
+	}
+	for i := 0; i < 100; i += 10 {
+		key := fmt.Sprintf("key-%03d", i)
+		tr.Delete([]byte(key))
+		delete(entries, key)
+	}
+	for key, value := range entries {
+		if have := tr.Get([]byte(key)); !bytes.Equal(have, value) {
+			t.Fatalf("%s: value mismatch: have %x, want %x", key, have, value)
+		}
+	}
+	if have := tr.Get([]byte("missing")); have != nil {
+		t.Fatalf("missing key: have %x, want nil", have)
+	}
+	// The commit callback is invoked with the values
+	leaves := make(map[string]bool)
+	root, err := tr.Commit(func(leaf []byte, parent common.Hash) error {
+		leaves[string(leaf)] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	if len(leaves) != len(entries) {
+		t.Errorf("leaf callbacks: have %d, want %d", len(leaves), len(entries))
+	}
+	for key, value := range entries {
+		if !leaves[string(value)] {
+			t.Errorf("%s: value not passed to the leaf callback", key)
+		}
+	}
+	// The values are retrieved from disk by a new database of the same format
+	if err := triedb.Commit(root, false); err != nil {
+		t.Fatalf("failed to flush trie database: %v", err)
+	}
+	tr, err = New(root, newCommitmentDatabase(t, diskdb, version))
+	if err != nil {
+		t.Fatalf("failed to reopen trie: %v", err)
+	}
+	for key, value := range entries {
+		have, err := tr.TryGet([]byte(key))
+		if err != nil || !bytes.Equal(have, value) {
+			t.Fatalf("%s: persisted value mismatch: have %x, want %x (err %v)", key, have, value, err)
+		}
+	}
+	// The iterator resolves the leaves to the values
+	var count int
+	it := NewIterator(tr.NodeIterator(nil))
+	for it.Next() {
+		if !bytes.Equal(it.Value, entries[string(it.Key)]) {
+			t.Errorf("%s: iterated value mismatch: have %x", it.Key, it.Value)
+		}
+		count++
+	}
+	if it.Err != nil {
+		t.Errorf("iteration failed: %v", it.Err)
+	}
+	if count != len(entries) {
+		t.Errorf("iterated leaves: have %d, want %d", count, len(entries))
+	}
+}
+
+// Tests that the leaf formats commit to different roots and that a trie can't be
+// read in another format than it was written in.
+func TestCommitmentMismatch(t *testing.T) {
+	diskdb := ethdb.NewMemDatabase()
+	roots := make(map[CommitmentVersion]common.Hash)
+	for _, version := range []CommitmentVersion{CommitmentPlain, CommitmentHashed} {
+		triedb := newCommitmentDatabase(t, diskdb, version)
+		tr, _ := New(common.Hash{}, triedb)
+		for key, value := range commitmentTestEntries() {
+			tr.Update([]byte(key), value)
+		}
+		root, _ := tr.Commit(nil)
+		triedb.Commit(root, false)
+		roots[version] = root
+	}
+	if roots[CommitmentPlain] == roots[CommitmentHashed] {
+		t.Fatalf("leaf formats commit to the same root %x", roots[CommitmentPlain])
+	}
+	tr, _ := New(roots[CommitmentPlain], newCommitmentDatabase(t, diskdb, CommitmentHashed))
+	if _, err := tr.TryGet([]byte("key-001")); err != ErrCommitmentVersion {
+		t.Errorf("plain leaf read as hashed: have %v, want %v", err, ErrCommitmentVersion)
+	}
+	if err := NewDatabase(diskdb).SetCommitment(CommitmentHashed + 1); err == nil {
+		t.Errorf("unknown commitment version accepted")
+	}
+}
+
+// Tests that the values referenced by the hashed leaves are garbage collected
+// along with the trie nodes holding them.
+func TestCommitmentHashedGC(t *testing.T) {
+	triedb := newCommitmentDatabase(t, ethdb.NewMemDatabase(), CommitmentHashed)
+	tr, _ := New(common.Hash{}, triedb)
+	for key, value := range commitmentTestEntries() {
+		tr.Update([]byte(key), value)
+	}
+	root, _ := tr.Commit(nil)
+	if nodes := len(triedb.Nodes()); nodes <= len(commitmentTestEntries()) {
+		t.Fatalf("cached nodes: have %d, want values and trie nodes", nodes)
+	}
+	triedb.Dereference(root)
+	if nodes := triedb.Nodes(); len(nodes) != 0 {
+		t.Errorf("cached nodes after dereferencing: have %d, want 0", len(nodes))
+	}
+}
+
+// Tests that the values of the hashed leaves are stored in the database only
+// once committed, so overwritten and uncommitted values leave nothing behind.
+func TestCommitmentHashedPending(t *testing.T) {
+	triedb := newCommitmentDatabase(t, ethdb.NewMemDatabase(), CommitmentHashed)
+	tr, _ := New(common.Hash{}, triedb)
+
+	stale, value := []byte("stale value"), []byte("committed value")
+	tr.Update([]byte("key"), stale)
+	tr.Update([]byte("key"), value)
+	if nodes := len(triedb.Nodes()); nodes != 0 {
+		t.Fatalf("cached nodes before commit: have %d, want 0", nodes)
+	}
+	// The uncommitted values are readable through the trie and its iterator
+	if have := tr.Get([]byte("key")); !bytes.Equal(have, value) {
+		t.Fatalf("uncommitted value mismatch: have %x, want %x", have, value)
+	}
+	it := NewIterator(tr.NodeIterator(nil))
+	if !it.Next() || !bytes.Equal(it.Value, value) {
+		t.Fatalf("uncommitted iterated value mismatch: have %x, want %x (err %v)", it.Value, value, it.Err)
+	}
+	if _, err := tr.Commit(nil); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	if _, err := triedb.Node(crypto.Keccak256Hash(value)); err != nil {
+		t.Errorf("committed value not stored: %v", err)
+	}
+	if _, err := triedb.Node(crypto.Keccak256Hash(stale)); err == nil {
+		t.Errorf("overwritten value stored")
+	}
+}
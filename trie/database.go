@@ -27,6 +27,7 @@ import (
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/log"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/rlp"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 var (
@@ -68,8 +69,8 @@ Database
 		目的是在内存中累积trie写操作，并且仅定期刷新一对尝试写入磁盘的内容，垃圾收集剩余的内容。
  */
 type Database struct {
-	// 永久存储成熟的Trie节点
-	diskdb ethdb.Database // Persistent storage for matured trie nodes
+	// 永久存储成熟的Trie节点 (本地 db 或 远程/分区 的 NodeStore)
+	diskdb NodeStore // Persistent storage for matured trie nodes
 
 	// trie node 的 数据 和 Hash 关系   todo (node.key 做了 compact编码之后的node计算的hash作为 key ->  并将该node作为 value)
 	nodes  map[common.Hash]*cachedNode // Data and references relationships of a node
@@ -107,6 +108,15 @@ type Database struct {
 	// preimages缓存的存储大小
 	preimagesSize common.StorageSize // Storage size of the preimages cache
 
+	// 合并 并发的 同一 node 的 disk 读取
+	fetches fetchDedup // Disk reads of trie nodes in progress, shared by concurrent readers
+
+	// 叶子节点 承诺 value 的格式, nil 表示 标准格式 (叶子 直接存 value)
+	commitment LeafCommitment // Leaf format of the tries, plain if nil
+
+	// 最近从 trie 内存中卸载的 node, 用于统计 重新加载
+	unloads *lru.Cache // Hashes of the nodes recently unloaded by the tries, to detect refetches
+
 	lock sync.RWMutex
 }
 
@@ -314,12 +324,20 @@ func expandNode(hash hashNode, n node, cachegen uint16) node {
 对 db 实例的封装
  */
 func NewDatabase(diskdb ethdb.Database) *Database {
+	return NewDatabaseWithStore(diskdb)
+}
+
+// NewDatabaseWithStore creates a new trie database like NewDatabase, flushing the
+// trie content into an arbitrary node store instead of a local database.
+func NewDatabaseWithStore(diskdb NodeStore) *Database {
 	/**
 	返回一个 封装过后的db实例
 	nodes
 	 */
+	unloads, _ := lru.New(unloadedNodes)
 	return &Database{
 		diskdb:    diskdb,
+		unloads:   unloads,
 		// 一个存放 trie 的node的缓存 map
 		nodes:     map[common.Hash]*cachedNode{{}: {}},
 		// 一个存放 state 数据的缓存 map
@@ -419,7 +437,7 @@ func (db *Database) node(hash common.Hash, cachegen uint16) node {
 	// Content unavailable in memory, attempt to retrieve from disk
 	//
 	// 缓存找不到时, 从 disk 获取 node
-	enc, err := db.diskdb.Get(hash[:])
+	enc, err := db.diskNode(hash)
 	if err != nil || enc == nil {
 		return nil
 	}
@@ -438,7 +456,48 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 		return node.rlp(), nil
 	}
 	// Content unavailable in memory, attempt to retrieve from disk
-	return db.diskdb.Get(hash[:])
+	return db.diskNode(hash)
+}
+
+// diskNode reads an encoded trie node from the persistent database, sharing the
+// read with the concurrent readers of the same node.
+func (db *Database) diskNode(hash common.Hash) ([]byte, error) {
+	return db.fetches.get(hash, func() ([]byte, error) {
+		return db.diskdb.Get(hash[:])
+	})
+}
+
+// NodeBatch retrieves several encoded trie nodes (or contract codes) like Node,
+// looking up the memory cache once and reading the missing ones from the
+// persistent database in one go. The entries not found are nil.
+func (db *Database) NodeBatch(hashes []common.Hash) ([][]byte, error) {
+	var (
+		values = make([][]byte, len(hashes))
+		keys   [][]byte
+		misses []int
+	)
+	db.lock.RLock()
+	for i, hash := range hashes {
+		if node := db.nodes[hash]; node != nil {
+			values[i] = node.rlp()
+			continue
+		}
+		keys = append(keys, common.CopyBytes(hash[:]))
+		misses = append(misses, i)
+	}
+	db.lock.RUnlock()
+
+	if len(keys) == 0 {
+		return values, nil
+	}
+	disk, err := getMany(db.diskdb, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, index := range misses {
+		values[index] = disk[i]
+	}
+	return values, nil
 }
 
 // preimage retrieves a cached trie node pre-image from memory. If it cannot be
@@ -0,0 +1,94 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+)
+
+var (
+	dedupDiskReadMeter   = metrics.NewRegisteredMeter("trie/dedup/disk", nil)   // 实际发往 disk 的 node 读取数
+	dedupSharedReadMeter = metrics.NewRegisteredMeter("trie/dedup/shared", nil) // 复用 进行中读取结果 的 node 读取数
+)
+
+// nodeFetch is a disk read of a trie node in progress, the result of which is
+// delivered to all the readers of the node arriving meanwhile.
+type nodeFetch struct {
+	done    chan struct{} // closed when the result is available
+	blob    []byte
+	err     error
+	waiters int // readers waiting for the result besides the one reading
+}
+
+// fetchDedup collapses the concurrent disk reads of the same trie node (e.g. by
+// the state prefetcher, the EVM and the les proof builders missing the same node
+// at once) into a single read, sharing the result. The zero value is ready for use.
+//
+/**
+fetchDedup: 多个 goroutine (prefetcher, EVM, les proof 构建) 同时读取 同一个 缺失的 trie node 时,
+只发起 一次 disk 读取, 其他 goroutine 等待并 共享该结果 (singleflight)
+ */
+type fetchDedup struct {
+	lock    sync.Mutex
+	pending map[common.Hash]*nodeFetch
+}
+
+// get reads a trie node with the given read function, unless a read of the same
+// node is already in progress, in which case it waits for that one. The returned
+// blob may be shared between the readers and must not be modified.
+func (d *fetchDedup) get(hash common.Hash, read func() ([]byte, error)) ([]byte, error) {
+	d.lock.Lock()
+	if f, ok := d.pending[hash]; ok {
+		f.waiters++
+		d.lock.Unlock()
+
+		dedupSharedReadMeter.Mark(1)
+		<-f.done
+		return f.blob, f.err
+	}
+	if d.pending == nil {
+		d.pending = make(map[common.Hash]*nodeFetch)
+	}
+	f := &nodeFetch{done: make(chan struct{})}
+	d.pending[hash] = f
+	d.lock.Unlock()
+
+	dedupDiskReadMeter.Mark(1)
+	f.blob, f.err = read()
+
+	d.lock.Lock()
+	delete(d.pending, hash)
+	d.lock.Unlock()
+	close(f.done)
+
+	return f.blob, f.err
+}
+
+// waiters returns the number of readers waiting for the read of a node in
+// progress.
+func (d *fetchDedup) waiters(hash common.Hash) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if f, ok := d.pending[hash]; ok {
+		return f.waiters
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// blockingStore is a counting node store holding back the reads until released.
+type blockingStore struct {
+	countingStore
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(key []byte) ([]byte, error) {
+	<-s.release
+	return s.countingStore.Get(key)
+}
+
+// Tests that the concurrent reads of the same missing node are served by a single
+// read of the store, delivering the node to all the readers.
+func TestDiskReadDedup(t *testing.T) {
+	store := &blockingStore{
+		countingStore: countingStore{MemDatabase: ethdb.NewMemDatabase()},
+		release:       make(chan struct{}),
+	}
+	blob := []byte("trie node")
+	hash := common.BytesToHash(crypto.Keccak256(blob))
+	store.Put(hash[:], blob)
+
+	db := NewDatabaseWithStore(store)
+
+	const readers = 8
+	var wg sync.WaitGroup
+	results := make([][]byte, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = db.Node(hash)
+		}(i)
+	}
+	// Wait until all the readers but the first are waiting for its read
+	for start := time.Now(); db.fetches.waiters(hash) < readers-1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("readers not deduplicated: %d waiting", db.fetches.waiters(hash))
+		}
+	}
+	close(store.release)
+	wg.Wait()
+
+	if store.gets != 1 {
+		t.Errorf("store reads mismatch: have %d, want 1", store.gets)
+	}
+	for i, result := range results {
+		if !bytes.Equal(result, blob) {
+			t.Errorf("reader %d: node mismatch: have %x, want %x", i, result, blob)
+		}
+	}
+	// Reads after the shared one completed hit the store again
+	if _, err := db.Node(hash); err != nil || store.gets != 2 {
+		t.Errorf("subsequent read mismatch: err %v, store reads %d", err, store.gets)
+	}
+	if n := len(db.fetches.pending); n != 0 {
+		t.Errorf("reads left pending: %d", n)
+	}
+}
@@ -32,6 +32,7 @@ type hasher struct {
 	cachegen   uint16			//
 	cachelimit uint16			//
 	onleaf     LeafCallback   	// 这个 回调指针; 只有在  db.store() 的时候 调用, 而且 stateObject.Trie.Commit() 传nil, 只有 stateDB.Trie.Commit() 才传的回调
+	sizes      cacheSizes		// 卸载 node 时需要扣减的 trie 内存统计, 可为 nil
 }
 
 // keccakState wraps sha3.state. In addition to the usual hash methods, it also supports
@@ -71,6 +72,7 @@ func newHasher(cachegen, cachelimit uint16, onleaf LeafCallback) *hasher {
 }
 
 func returnHasherToPool(h *hasher) {
+	h.sizes = nil
 	hasherPool.Put(h)
 }
 
@@ -119,6 +121,10 @@ func (h *hasher) hash(n node, db *Database, force bool) (node, node, error) {
 			//
 			// 从缓存中卸载节点。它的所有子节点将具有较低或相等的缓存世代号码
 			cacheUnloadCounter.Inc(1)
+			db.markUnloaded(hash)
+			if h.sizes != nil {
+				h.sizes.addTree(n, -1)
+			}
 
 			// 只, 返回 hash  和 hash形成的 hashNode
 			return hash, hash, nil
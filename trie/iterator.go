@@ -45,8 +45,14 @@ func NewIterator(it NodeIterator) *Iterator {
 func (it *Iterator) Next() bool {
 	for it.nodeIt.Next(true) {
 		if it.nodeIt.Leaf() {
+			// 返回 叶子 承诺的 value (非标准 commitment 格式时 按 trie 的格式 还原)
+			value, err := leafValue(it.nodeIt)
+			if err != nil {
+				it.Key, it.Value, it.Err = nil, nil, err
+				return false
+			}
 			it.Key = it.nodeIt.LeafKey()		// 返回 hex key
-			it.Value = it.nodeIt.LeafBlob()		// 返回 valueNode (也是 value的原始数据啦)
+			it.Value = value
 			return true
 		}
 	}
@@ -56,6 +62,24 @@ func (it *Iterator) Next() bool {
 	return false
 }
 
+// leafValue returns the value committed to by the leaf a node iterator is
+// positioned on, resolved in the leaf format of the iterated trie.
+func leafValue(it NodeIterator) ([]byte, error) {
+	switch it := it.(type) {
+	case *nodeIterator:
+		if it.trie == nil {
+			return it.LeafBlob(), nil
+		}
+		return it.trie.decodeLeaf(it.LeafBlob())
+	case *differenceIterator:
+		return leafValue(it.b)
+	case *unionIterator:
+		return leafValue((*it.items)[0])
+	default:
+		return it.LeafBlob(), nil
+	}
+}
+
 // Prove generates the Merkle proof for the leaf node the iterator is currently
 // positioned on.
 func (it *Iterator) Prove() [][]byte {
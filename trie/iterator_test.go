@@ -433,3 +433,58 @@ func checkIteratorNoDups(t *testing.T, it NodeIterator, seen map[string]bool) in
 	}
 	return len(seen)
 }
+
+// Tests that a snapshot iterator sees the complete trie of its root even if the
+// root is garbage collected and newer roots are committed during the iteration.
+func TestSnapshotIterator(t *testing.T) {
+	diskdb := ethdb.NewMemDatabase()
+	triedb := NewDatabase(diskdb)
+
+	tr, _ := New(common.Hash{}, triedb)
+	for i := 0; i < 100; i++ {
+		tr.Update([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("val-%03d", i)))
+	}
+	root, _ := tr.Commit(nil)
+	triedb.Reference(root, common.Hash{})
+
+	it, err := NewSnapshotIterator(triedb, root, nil)
+	if err != nil {
+		t.Fatalf("failed to create snapshot iterator: %v", err)
+	}
+	defer it.Close()
+	kv := NewIterator(it)
+
+	// Iterate halfway, then drop the root and commit a newer one
+	count := 0
+	for ; count < 50 && kv.Next(); count++ {
+	}
+	triedb.Dereference(root)
+	for i := 0; i < 100; i++ {
+		tr.Update([]byte(fmt.Sprintf("key-%03d", i)), []byte("updated"))
+	}
+	newRoot, _ := tr.Commit(nil)
+	triedb.Reference(newRoot, common.Hash{})
+
+	for kv.Next() {
+		if want := fmt.Sprintf("val-%s", kv.Key[4:]); string(kv.Value) != want {
+			t.Fatalf("value mismatch for %s: have %s, want %s", kv.Key, kv.Value, want)
+		}
+		count++
+	}
+	if kv.Err != nil {
+		t.Fatalf("iteration failed: %v", kv.Err)
+	}
+	if count != 100 {
+		t.Fatalf("iterated entry count mismatch: have %d, want 100", count)
+	}
+	// Closing releases the nodes of the old root
+	nodes := len(triedb.Nodes())
+	it.Close()
+	it.Close()
+	if len(triedb.Nodes()) >= nodes {
+		t.Fatalf("nodes of the released root kept: before %d, after %d", nodes, len(triedb.Nodes()))
+	}
+	if _, err := New(newRoot, triedb); err != nil {
+		t.Fatalf("newer root lost: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/metrics"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var (
+	storeCacheHitMeter  = metrics.NewRegisteredMeter("trie/store/cache/hit", nil)
+	storeCacheMissMeter = metrics.NewRegisteredMeter("trie/store/cache/miss", nil)
+	storeBatchReadMeter = metrics.NewRegisteredMeter("trie/store/batch/reads", nil) // 合并后 实际发往下层 store 的读请求数
+	storeBatchKeyMeter  = metrics.NewRegisteredMeter("trie/store/batch/keys", nil)  // 合并前 的 key 数
+
+	// errStoreNotFound is returned by the store layers for the missing keys.
+	errStoreNotFound = errors.New("trie node not found")
+)
+
+// NodeStore is the persistent storage backing a trie Database, holding the trie
+// nodes (and contract codes, preimages) keyed by their hashes. Any ethdb.Database
+// is a NodeStore; other implementations may serve the nodes from a remote or
+// partitioned store, for example one shared between several stateless servers.
+// A store implementing ethdb.MultiGetter is asked for several nodes in one read.
+//
+/**
+NodeStore: trie Database 背后的持久化存储 (读 + 批量写).
+任何 ethdb.Database 都是 NodeStore; 也可以是 远程/分区 的存储 (如 多个无状态 les server 共享).
+实现了 ethdb.MultiGetter 的 store 会被 一次读取多个 node.
+ */
+type NodeStore interface {
+	DatabaseReader
+
+	// NewBatch creates a write batch, the entries of which become visible in the
+	// store when the batch is written.
+	NewBatch() ethdb.Batch
+}
+
+// getMany retrieves several entries of a store in one go if it supports it, one
+// by one otherwise. The entries not found are nil.
+func getMany(store NodeStore, keys [][]byte) ([][]byte, error) {
+	if mg, ok := store.(ethdb.MultiGetter); ok {
+		return mg.GetMany(keys)
+	}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], _ = store.Get(key)
+	}
+	return values, nil
+}
+
+// cachingNodeStore keeps the recently read and written entries of a store in
+// memory. The entries are keyed by their hashes and never change, so the cache
+// needs no invalidation apart from the deletions.
+type cachingNodeStore struct {
+	NodeStore
+	cache *lru.Cache
+}
+
+// NewCachingNodeStore wraps a store with an in-memory cache of the given number
+// of entries, cutting the round trips to a remote store.
+func NewCachingNodeStore(store NodeStore, entries int) NodeStore {
+	cache, _ := lru.New(entries)
+	return &cachingNodeStore{NodeStore: store, cache: cache}
+}
+
+// Get implements DatabaseReader, serving the entry from the cache if present.
+func (s *cachingNodeStore) Get(key []byte) ([]byte, error) {
+	if value, ok := s.cache.Get(string(key)); ok {
+		storeCacheHitMeter.Mark(1)
+		return value.([]byte), nil
+	}
+	storeCacheMissMeter.Mark(1)
+
+	value, err := s.NodeStore.Get(key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	s.cache.Add(string(key), value)
+	return value, nil
+}
+
+// Has implements DatabaseReader.
+func (s *cachingNodeStore) Has(key []byte) (bool, error) {
+	if s.cache.Contains(string(key)) {
+		return true, nil
+	}
+	return s.NodeStore.Has(key)
+}
+
+// GetMany implements ethdb.MultiGetter, reading only the entries not cached from
+// the wrapped store.
+func (s *cachingNodeStore) GetMany(keys [][]byte) ([][]byte, error) {
+	var (
+		values = make([][]byte, len(keys))
+		misses [][]byte
+		index  []int
+	)
+	for i, key := range keys {
+		if value, ok := s.cache.Get(string(key)); ok {
+			values[i] = value.([]byte)
+			continue
+		}
+		misses = append(misses, key)
+		index = append(index, i)
+	}
+	storeCacheHitMeter.Mark(int64(len(keys) - len(misses)))
+	storeCacheMissMeter.Mark(int64(len(misses)))
+
+	if len(misses) == 0 {
+		return values, nil
+	}
+	fetched, err := getMany(s.NodeStore, misses)
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range fetched {
+		if value != nil {
+			s.cache.Add(string(misses[i]), value)
+		}
+		values[index[i]] = value
+	}
+	return values, nil
+}
+
+// NewBatch implements NodeStore, creating a batch which updates the cache once
+// it is written into the wrapped store.
+func (s *cachingNodeStore) NewBatch() ethdb.Batch {
+	return &cachingBatch{Batch: s.NodeStore.NewBatch(), cache: s.cache}
+}
+
+// cachingBatch records the writes of a batch to apply them to the cache after
+// the batch made it into the store.
+type cachingBatch struct {
+	ethdb.Batch
+	cache   *lru.Cache
+	puts    []cachingWrite
+	deletes []string
+}
+
+type cachingWrite struct {
+	key   string
+	value []byte
+}
+
+// Put implements ethdb.Putter. The key may be an ephemeral buffer of the caller
+// (see Database.secureKey), so it is copied.
+func (b *cachingBatch) Put(key []byte, value []byte) error {
+	if err := b.Batch.Put(key, value); err != nil {
+		return err
+	}
+	b.puts = append(b.puts, cachingWrite{string(key), common.CopyBytes(value)})
+	return nil
+}
+
+// Delete implements ethdb.Deleter.
+func (b *cachingBatch) Delete(key []byte) error {
+	if err := b.Batch.Delete(key); err != nil {
+		return err
+	}
+	b.deletes = append(b.deletes, string(key))
+	return nil
+}
+
+// Write implements ethdb.Batch, updating the cache after a successful write.
+func (b *cachingBatch) Write() error {
+	if err := b.Batch.Write(); err != nil {
+		return err
+	}
+	for _, w := range b.puts {
+		b.cache.Add(w.key, w.value)
+	}
+	for _, key := range b.deletes {
+		b.cache.Remove(key)
+	}
+	b.puts, b.deletes = b.puts[:0], b.deletes[:0]
+	return nil
+}
+
+// Reset implements ethdb.Batch.
+func (b *cachingBatch) Reset() {
+	b.Batch.Reset()
+	b.puts, b.deletes = b.puts[:0], b.deletes[:0]
+}
+
+// batchingNodeStore merges the single reads issued concurrently (e.g. by several
+// request handlers) into multi-key reads of the wrapped store, trading a short
+// delay for fewer round trips to a remote store.
+//
+/**
+batchingNodeStore: 将 并发的 单 key 读请求 在 wait 时间窗口内 合并成 一次 GetMany
+(远程 store 下 以少量延迟 换取 更少的 往返次数)
+ */
+type batchingNodeStore struct {
+	NodeStore
+	wait  time.Duration // time the first read of a batch waits for the others
+	limit int           // number of keys after which a batch is sent without waiting
+
+	lock    sync.Mutex
+	pending *readBatch // batch collecting the reads, nil if none
+}
+
+// readBatch is a set of reads sent to the store together.
+type readBatch struct {
+	keys   [][]byte
+	index  map[string]int // position of the keys, the same key is read once
+	values [][]byte
+	err    error
+	done   chan struct{} // closed when the values are available
+	sent   bool
+}
+
+// NewBatchingNodeStore wraps a store, merging the reads arriving within the wait
+// time of each other into one read of at most limit keys.
+func NewBatchingNodeStore(store NodeStore, wait time.Duration, limit int) NodeStore {
+	if limit < 1 {
+		limit = 1
+	}
+	return &batchingNodeStore{NodeStore: store, wait: wait, limit: limit}
+}
+
+// Get implements DatabaseReader, adding the key to the pending batch and waiting
+// for its result.
+func (s *batchingNodeStore) Get(key []byte) ([]byte, error) {
+	s.lock.Lock()
+	b := s.pending
+	if b == nil {
+		b = &readBatch{index: make(map[string]int), done: make(chan struct{})}
+		s.pending = b
+		time.AfterFunc(s.wait, func() { s.send(b) })
+	}
+	pos, ok := b.index[string(key)]
+	if !ok {
+		pos = len(b.keys)
+		b.keys = append(b.keys, common.CopyBytes(key))
+		b.index[string(key)] = pos
+	}
+	full := len(b.keys) >= s.limit
+	s.lock.Unlock()
+
+	storeBatchKeyMeter.Mark(1)
+	if full {
+		s.send(b)
+	}
+	<-b.done
+
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.values[pos] == nil {
+		return nil, errStoreNotFound
+	}
+	return b.values[pos], nil
+}
+
+// Has implements DatabaseReader through Get, so the existence checks are batched
+// as well.
+func (s *batchingNodeStore) Has(key []byte) (bool, error) {
+	value, err := s.Get(key)
+	if err == errStoreNotFound {
+		return false, nil
+	}
+	return value != nil, err
+}
+
+// GetMany implements ethdb.MultiGetter, the keys are already batched by the caller
+// so they are read right away.
+func (s *batchingNodeStore) GetMany(keys [][]byte) ([][]byte, error) {
+	return getMany(s.NodeStore, keys)
+}
+
+// send reads the keys of a batch from the wrapped store, unless it was already
+// sent by the timer or by a read filling it up.
+func (s *batchingNodeStore) send(b *readBatch) {
+	s.lock.Lock()
+	if b.sent {
+		s.lock.Unlock()
+		return
+	}
+	b.sent = true
+	if s.pending == b {
+		s.pending = nil
+	}
+	s.lock.Unlock()
+
+	storeBatchReadMeter.Mark(1)
+	values, err := getMany(s.NodeStore, b.keys)
+	if err == nil && len(values) != len(b.keys) {
+		err = errors.New("trie node store returned wrong number of values")
+	}
+	b.values, b.err = values, err
+	close(b.done)
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/ethdb"
+)
+
+// countingStore is a node store counting the reads reaching it.
+type countingStore struct {
+	*ethdb.MemDatabase
+
+	lock  sync.Mutex
+	gets  int
+	multi [][][]byte
+}
+
+func (s *countingStore) Get(key []byte) ([]byte, error) {
+	s.lock.Lock()
+	s.gets++
+	s.lock.Unlock()
+	return s.MemDatabase.Get(key)
+}
+
+func (s *countingStore) GetMany(keys [][]byte) ([][]byte, error) {
+	s.lock.Lock()
+	s.multi = append(s.multi, keys)
+	s.lock.Unlock()
+	return s.MemDatabase.GetMany(keys)
+}
+
+// Tests that the tries are committed into and loaded back from layered stores.
+func TestNodeStoreLayers(t *testing.T) {
+	store := &countingStore{MemDatabase: ethdb.NewMemDatabase()}
+	layered := NewCachingNodeStore(NewBatchingNodeStore(store, time.Millisecond, 64), 1024)
+
+	trie, _ := New(common.Hash{}, NewDatabaseWithStore(layered))
+	for i := 0; i < 100; i++ {
+		updateString(trie, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	root, _ := trie.Commit(nil)
+	if err := trie.db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	// The committed nodes are cached, reading them back does not hit the store
+	reloaded, err := New(root, NewDatabaseWithStore(layered))
+	if err != nil {
+		t.Fatalf("failed to reload trie: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if value := getString(reloaded, fmt.Sprintf("key-%d", i)); string(value) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("value %d mismatch: have %q", i, value)
+		}
+	}
+	if store.gets != 0 || len(store.multi) != 0 {
+		t.Errorf("store reads with warm cache: have %d gets, %d batches, want none", store.gets, len(store.multi))
+	}
+	// A cold cache reads the nodes through the batching layer
+	cold, _ := New(root, NewDatabaseWithStore(NewCachingNodeStore(NewBatchingNodeStore(store, time.Millisecond, 64), 1024)))
+	for i := 0; i < 100; i++ {
+		if value := getString(cold, fmt.Sprintf("key-%d", i)); string(value) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("value %d mismatch: have %q", i, value)
+		}
+	}
+	if store.gets != 0 || len(store.multi) == 0 {
+		t.Errorf("store reads with cold cache: have %d gets, %d batches", store.gets, len(store.multi))
+	}
+}
+
+// Tests that the concurrent reads are merged into batches and the results are
+// delivered to every reader.
+func TestBatchingNodeStore(t *testing.T) {
+	store := &countingStore{MemDatabase: ethdb.NewMemDatabase()}
+	for i := 0; i < 16; i++ {
+		store.Put([]byte{byte(i)}, []byte{byte(i), byte(i)})
+	}
+	batching := NewBatchingNodeStore(store, 50*time.Millisecond, 8)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(key byte) {
+			defer wg.Done()
+
+			value, err := batching.Get([]byte{key})
+			switch {
+			case key < 16 && (err != nil || !bytes.Equal(value, []byte{key, key})):
+				errs <- fmt.Errorf("key %d: have %x, %v", key, value, err)
+			case key >= 16 && err == nil:
+				errs <- fmt.Errorf("key %d: missing key found: %x", key, value)
+			}
+		}(byte(i % 20))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if store.gets != 0 {
+		t.Errorf("single reads reached the store: %d", store.gets)
+	}
+	for _, keys := range store.multi {
+		if len(keys) > 8 {
+			t.Errorf("batch exceeds limit: %d keys", len(keys))
+		}
+	}
+	if len(store.multi) >= 20 {
+		t.Errorf("reads not merged: %d batches for 20 keys", len(store.multi))
+	}
+	if has, err := batching.Has([]byte{100}); has || err != nil {
+		t.Errorf("missing key reported: %v, %v", has, err)
+	}
+}
+
+// Tests that the caching layer drops the deleted entries and ignores the batches
+// which were reset before being written.
+func TestCachingNodeStoreWrites(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	store := NewCachingNodeStore(db, 16)
+
+	batch := store.NewBatch()
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Reset()
+	batch.Put([]byte("b"), []byte("2"))
+	if err := batch.Write(); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	if has, _ := store.Has([]byte("a")); has {
+		t.Errorf("reset entry present")
+	}
+	db.Delete([]byte("b"))
+	if value, err := store.Get([]byte("b")); err != nil || string(value) != "2" {
+		t.Errorf("written entry not cached: %q, %v", value, err)
+	}
+	batch.Delete([]byte("b"))
+	batch.Write()
+	if _, err := store.Get([]byte("b")); err == nil {
+		t.Errorf("deleted entry still cached")
+	}
+}
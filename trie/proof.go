@@ -18,7 +18,9 @@ package trie
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
 	"github.com/blockchain-analysis-study/go-ethereum-analysis/crypto"
@@ -133,6 +135,148 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.Putter) error {
 	return nil
 }
 
+// ProveMulti constructs the merkle proofs of multiple keys at once. The result is
+// the union of the proofs Prove would return for each of the keys, but the nodes
+// on shared paths are resolved, hashed and encoded only once. The keys are sorted
+// before the traversal, so the caller doesn't need to order them.
+//
+/**
+ProveMulti: 一次性构造多个key的Merkle proof。
+结果 和对每个 key 分别调用 Prove 的并集相同, 但是多个 key 共同前缀路径上的 node 只会被 遍历/hash/编码 一次.
+ */
+func (t *Trie) ProveMulti(keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error {
+	hexKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		hexKeys[i] = keybytesToHex(key)
+	}
+	// 排序后 共享同一个前缀的 key 都是连续的
+	sort.Slice(hexKeys, func(i, j int) bool { return bytes.Compare(hexKeys[i], hexKeys[j]) < 0 })
+
+	p := &multiProver{trie: t, hasher: newHasher(0, 0, nil), fromLevel: fromLevel, proofDb: proofDb}
+	return p.prove(t.root, hexKeys, 0, true)
+}
+
+// errInvalidRange is returned by ProveRange if the start of the range is after
+// its end.
+var errInvalidRange = errors.New("invalid range: start after end")
+
+// ProveRange constructs a merkle proof of all the keys in the [start, end] range.
+// The result is the union of the proofs of every key in the range and of the
+// boundary proofs of start and end, which also prove their absence if they are
+// not in the trie. A verifier can thus check that no key of the range is left
+// out of the proof.
+//
+/**
+ProveRange: 构造 [start, end] 区间内所有 key 的 Merkle proof。
+结果包含 区间内每个 key 的 proof, 以及 start 和 end 这两个边界的 proof (不存在时证明其不存在),
+这样 校验方 就可以确认 区间内没有 key 被遗漏.
+ */
+func (t *Trie) ProveRange(start, end []byte, proofDb ethdb.Putter) error {
+	if bytes.Compare(start, end) > 0 {
+		return errInvalidRange
+	}
+	keys := [][]byte{start, end}
+
+	it := NewIterator(t.NodeIterator(start))
+	for it.Next() && bytes.Compare(it.Key, end) <= 0 {
+		keys = append(keys, common.CopyBytes(it.Key))
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+	return t.ProveMulti(keys, 0, proofDb)
+}
+
+// multiProver holds the state of a ProveMulti traversal.
+type multiProver struct {
+	trie      *Trie
+	hasher    *hasher
+	fromLevel uint
+	proofDb   ethdb.Putter
+}
+
+// prove collects the proof nodes of the given (sorted, hex encoded) key suffixes
+// in the subtrie rooted at tn. The level is the number of proof elements on the
+// path above tn.
+func (p *multiProver) prove(tn node, keys [][]byte, level uint, root bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	switch n := tn.(type) {
+	case nil, valueNode:
+		return nil
+
+	case hashNode:
+		resolved, err := p.trie.resolveHash(n, nil)
+		if err != nil {
+			log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+			return err
+		}
+		return p.prove(resolved, keys, level, root)
+
+	case *shortNode:
+		level = p.add(n, level, root)
+
+		// 只有 完整匹配 shortNode.Key 的 key 才会继续往下走
+		var matching [][]byte
+		for _, key := range keys {
+			if len(key) > len(n.Key) && bytes.Equal(n.Key, key[:len(n.Key)]) {
+				matching = append(matching, key[len(n.Key):])
+			}
+		}
+		return p.prove(n.Val, matching, level, false)
+
+	case *fullNode:
+		level = p.add(n, level, root)
+
+		// 按首个 nibble 分组, 每一组对应一个 child
+		for start := 0; start < len(keys); {
+			if len(keys[start]) == 0 {
+				start++
+				continue
+			}
+			end, nibble := start+1, keys[start][0]
+			for end < len(keys) && len(keys[end]) > 0 && keys[end][0] == nibble {
+				end++
+			}
+			suffixes := make([][]byte, 0, end-start)
+			for _, key := range keys[start:end] {
+				if len(key) > 1 {
+					suffixes = append(suffixes, key[1:])
+				}
+			}
+			if err := p.prove(n.Children[nibble], suffixes, level, false); err != nil {
+				return err
+			}
+			start = end
+		}
+		return nil
+
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
+	}
+}
+
+// add stores n in the proof database if it is a proof element (hashed or the
+// root node) deep enough to be requested. Returns the level of the children.
+func (p *multiProver) add(n node, level uint, root bool) uint {
+	n, _, _ = p.hasher.hashChildren(n, nil)
+	hn, _ := p.hasher.store(n, nil, false)
+	hash, ok := hn.(hashNode)
+	if !ok && !root {
+		// embedded into its parent, not a separate proof element
+		return level
+	}
+	if level >= p.fromLevel {
+		enc, _ := rlp.EncodeToBytes(n)
+		if !ok {
+			hash = crypto.Keccak256(enc)
+		}
+		p.proofDb.Put(hash, enc)
+	}
+	return level + 1
+}
+
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
 // on the path to the value at key. The value itself is also included in the last
 // node and can be retrieved by verifying the proof.
@@ -155,6 +299,20 @@ func (t *SecureTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.Putter) err
 }
 
 
+// ProveMulti constructs the merkle proofs of multiple keys in one traversal,
+// see Trie.ProveMulti.
+func (t *SecureTrie) ProveMulti(keys [][]byte, fromLevel uint, proofDb ethdb.Putter) error {
+	return t.trie.ProveMulti(keys, fromLevel, proofDb)
+}
+
+// ProveRange constructs a merkle proof of all the keys in a range, see
+// Trie.ProveRange. The range boundaries are hashed keys, the order of the keys
+// of a secure trie.
+func (t *SecureTrie) ProveRange(start, end []byte, proofDb ethdb.Putter) error {
+	return t.trie.ProveRange(start, end, proofDb)
+}
+
+
 // todo 校验  Prove() 返回的 proofDb 数组 和  key 的关系
 //
 //    以此来得知 key 是否在该  MPT 的路径上 ?
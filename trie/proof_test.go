@@ -20,6 +20,7 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	mrand "math/rand"
+	"sort"
 	"testing"
 	"time"
 
@@ -143,6 +144,93 @@ func TestMissingKeyProof(t *testing.T) {
 	}
 }
 
+// Tests that a multi-key proof is the union of the single key proofs, for both
+// existing and missing keys and with skipped upper levels.
+func TestProveMulti(t *testing.T) {
+	trie, vals := randomTrie(500)
+
+	var keys [][]byte
+	for _, kv := range vals {
+		keys = append(keys, kv.k)
+		if len(keys) == 50 {
+			break
+		}
+	}
+	keys = append(keys, randBytes(32), randBytes(32), keys[0])
+
+	for _, fromLevel := range []uint{0, 1, 3} {
+		want := ethdb.NewMemDatabase()
+		for _, key := range keys {
+			trie.Prove(key, fromLevel, want)
+		}
+		have := ethdb.NewMemDatabase()
+		if err := trie.ProveMulti(keys, fromLevel, have); err != nil {
+			t.Fatalf("fromLevel %d: proof failed: %v", fromLevel, err)
+		}
+		if have.Len() != want.Len() {
+			t.Errorf("fromLevel %d: proof size mismatch: have %d, want %d", fromLevel, have.Len(), want.Len())
+		}
+		for _, hash := range want.Keys() {
+			wantEnc, _ := want.Get(hash)
+			if haveEnc, _ := have.Get(hash); !bytes.Equal(haveEnc, wantEnc) {
+				t.Errorf("fromLevel %d: node %x mismatch", fromLevel, hash)
+			}
+		}
+	}
+	// The full proof must verify every single key
+	proof := ethdb.NewMemDatabase()
+	trie.ProveMulti(keys, 0, proof)
+	for _, key := range keys {
+		val, _, err := VerifyProof(trie.Hash(), key, proof)
+		if err != nil {
+			t.Fatalf("failed to verify proof of %x: %v", key, err)
+		}
+		if kv, ok := vals[string(key)]; ok && !bytes.Equal(val, kv.v) {
+			t.Fatalf("verified value mismatch for key %x: have %x, want %x", key, val, kv.v)
+		}
+	}
+}
+
+func TestProveRange(t *testing.T) {
+	trie, vals := randomTrie(500)
+
+	var keys [][]byte
+	for _, kv := range vals {
+		keys = append(keys, kv.k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	// Both boundaries in the trie, and neither of them
+	for _, bounds := range [][2][]byte{
+		{keys[100], keys[150]},
+		{randBytes(32), randBytes(32)},
+	} {
+		start, end := bounds[0], bounds[1]
+		if bytes.Compare(start, end) > 0 {
+			start, end = end, start
+		}
+		proof := ethdb.NewMemDatabase()
+		if err := trie.ProveRange(start, end, proof); err != nil {
+			t.Fatalf("range %x-%x: proof failed: %v", start, end, err)
+		}
+		for _, key := range append([][]byte{start, end}, keys...) {
+			if !bytes.Equal(key, start) && !bytes.Equal(key, end) && (bytes.Compare(key, start) < 0 || bytes.Compare(key, end) > 0) {
+				continue
+			}
+			val, _, err := VerifyProof(trie.Hash(), key, proof)
+			if err != nil {
+				t.Fatalf("range %x-%x: failed to verify proof of %x: %v", start, end, key, err)
+			}
+			if kv, ok := vals[string(key)]; ok && !bytes.Equal(val, kv.v) {
+				t.Fatalf("range %x-%x: verified value mismatch for key %x: have %x, want %x", start, end, key, val, kv.v)
+			}
+		}
+	}
+	if err := trie.ProveRange(keys[1], keys[0], ethdb.NewMemDatabase()); err != errInvalidRange {
+		t.Fatalf("inverted range: error mismatch: have %v, want %v", err, errInvalidRange)
+	}
+}
+
 // mutateByte changes one byte in b.
 func mutateByte(b []byte) {
 	for r := mrand.Intn(len(b)); ; {
@@ -171,6 +259,22 @@ func BenchmarkProve(b *testing.B) {
 	}
 }
 
+func BenchmarkProveMulti(b *testing.B) {
+	trie, vals := randomTrie(100)
+	var keys [][]byte
+	for _, kv := range vals {
+		keys = append(keys, kv.k)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		proofs := ethdb.NewMemDatabase()
+		if trie.ProveMulti(keys, 0, proofs); len(proofs.Keys()) == 0 {
+			b.Fatalf("zero length proof")
+		}
+	}
+}
+
 func BenchmarkVerifyProof(b *testing.B) {
 	trie, vals := randomTrie(100)
 	root := trie.Hash()
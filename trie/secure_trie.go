@@ -82,6 +82,12 @@ func (t *SecureTrie) TryGet(key []byte) ([]byte, error) {
 	return t.trie.TryGet(t.hashKey(key))  // 先将 key  算完 sha3 Hash 作为需要查询的 key     (t *SecureTrie) TryGet(key []byte) 中
 }
 
+// TryGetHashed returns the value stored under the given already hashed key, for
+// callers knowing the key hashes only.
+func (t *SecureTrie) TryGetHashed(hashedKey []byte) ([]byte, error) {
+	return t.trie.TryGet(hashedKey)
+}
+
 // Update associates key with value in the trie. Subsequent calls to
 // Get will return value. If value has length zero, any existing value
 // is deleted from the trie and calls to Get will return nil.
@@ -181,9 +187,27 @@ func (t *SecureTrie) Root() []byte {
 	return t.trie.Root()
 }
 
+// SetResolveHook sets a callback invoked with the path of every node the trie
+// loads from the database. The path is relative to the hashed keys.
+func (t *SecureTrie) SetResolveHook(hook func(path []byte)) {
+	t.trie.SetResolveHook(hook)
+}
+
+// SetCacheLimit sets the number of past cache generations to keep.
+func (t *SecureTrie) SetCacheLimit(l uint16) {
+	t.trie.SetCacheLimit(l)
+}
+
 // Copy returns a copy of SecureTrie.
 func (t *SecureTrie) Copy() *SecureTrie {
 	cpy := *t
+	cpy.trie.sizes = t.trie.sizes.copy()
+	if t.trie.leaves != nil {
+		cpy.trie.leaves = make(map[common.Hash][]byte, len(t.trie.leaves))
+		for hash, value := range t.trie.leaves {
+			cpy.trie.leaves[hash] = value
+		}
+	}
 	return &cpy
 }
 
@@ -0,0 +1,84 @@
+// Copyright 2018 The github.com/blockchain-analysis-study/go-ethereum-analysis Authors
+// This file is part of the github.com/blockchain-analysis-study/go-ethereum-analysis library.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The github.com/blockchain-analysis-study/go-ethereum-analysis library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the github.com/blockchain-analysis-study/go-ethereum-analysis library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync"
+
+	"github.com/blockchain-analysis-study/go-ethereum-analysis/common"
+)
+
+// SnapshotIterator is a node iterator over the trie of a fixed root, which keeps
+// the nodes of the root alive in the database until it's closed. The database
+// may keep accepting commits for newer roots and dereferencing the older ones in
+// the meantime, the nodes reachable from the iterated root are not garbage
+// collected from the memory cache, so e.g. an online state dump or a pruning scan
+// sees a consistent trie instead of failing on missing nodes.
+//
+/**
+SnapshotIterator:
+	在固定的 root 上遍历 trie, 在 Close 之前 通过 metaroot 对 root 的引用 (Reference) 钉住它,
+	期间 Database 可以继续 commit 新的 root, 并 Dereference 旧的 root,
+	但 被遍历 root 可达的 node 不会被 gc 出内存 (刷到磁盘的 node 仍然可读), 保证遍历看到的是一致的 trie
+ */
+type SnapshotIterator struct {
+	NodeIterator
+
+	db     *Database
+	root   common.Hash
+	pinned bool // whether the root was in the memory cache and got referenced
+	once   sync.Once
+}
+
+// NewSnapshotIterator pins the given root in the database and returns an
+// iterator over its trie, starting at the given key. The iterator must be closed
+// to release the root.
+func NewSnapshotIterator(db *Database, root common.Hash, start []byte) (*SnapshotIterator, error) {
+	// Pin the root with a metaroot reference, under the write lock so it can't be
+	// garbage collected between the lookup and the reference. Roots already on
+	// disk need no pinning, the nodes are never deleted from there.
+	db.lock.Lock()
+	_, pinned := db.nodes[root]
+	if pinned = pinned && root != (common.Hash{}); pinned {
+		db.reference(root, common.Hash{})
+	}
+	db.lock.Unlock()
+
+	it := &SnapshotIterator{db: db, root: root, pinned: pinned}
+	tr, err := New(root, db)
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	it.NodeIterator = tr.NodeIterator(start)
+	return it, nil
+}
+
+// Root returns the root of the iterated trie.
+func (it *SnapshotIterator) Root() common.Hash {
+	return it.root
+}
+
+// Close releases the root, allowing its nodes to be garbage collected again. It
+// is safe to call Close multiple times.
+func (it *SnapshotIterator) Close() {
+	it.once.Do(func() {
+		if it.pinned {
+			it.db.Dereference(it.root)
+		}
+	})
+}
@@ -91,6 +91,16 @@ type Trie struct {
 	//	cachegen:	表示当前trie树的版本，trie每次commit，则增加1
 	//	cachelimit:	如果当前的cache时代, cachelimit参数 大于node的cache时代，那么node会从cache里面卸载，以便节约内存. todo 该值决定 trie 的某些node 是要在内存中保存 node 还是保存 nodeHash,节省内存用
 	cachegen, cachelimit uint16
+
+	// 可选的 node 卸载策略, 设置后 代替 cachelimit
+	policy CachePolicy // optional node unloading policy, overrides cachelimit
+	sizes  cacheSizes  // sizes of the nodes in memory by generation, tracked while a policy is set
+
+	// 每从 db 加载一个 node 时, 回调其路径 (用于统计 trie 的访问热度)
+	onResolve func(path []byte) // optional callback invoked with the path of every node loaded from the database
+
+	// 非标准 commitment 格式下, 自上次 commit 以来 写入的 叶子 value (按 hash), 在 commit 时 才存入 db
+	leaves map[common.Hash][]byte // values referenced by the leaves updated since the last commit, stored on commit
 }
 
 // SetCacheLimit sets the number of 'cache generations' to keep.
@@ -99,6 +109,12 @@ func (t *Trie) SetCacheLimit(l uint16) {
 	t.cachelimit = l
 }
 
+// SetResolveHook sets a callback invoked with the path (in hex nibbles) of every
+// node the trie loads from the database. A nil hook disables the callback.
+func (t *Trie) SetResolveHook(hook func(path []byte)) {
+	t.onResolve = hook
+}
+
 // newFlag returns the cache flag value for a newly created node.
 //
 // todo 只要trie树上的某条路径上有节点 【新增】或者 【删除】，那这条路径的节点都会被重新实例化并负值，如此一来，节点的nodeFlag中的dirty也被改为true，这样就表示这条路径的所有节点都需要重新插入到db
@@ -175,7 +191,11 @@ func (t *Trie) TryGet(key []byte) ([]byte, error) {
 	if err == nil && didResolve {  	// 	说明 之前在 key 路径上的 node 都是 hashNode, didResolve == true 时, 表示这些 node都从 db 中被恢复会原来的 node类型了
 		t.root = newroot			//	将 db 中恢复的 root node 赋值到 t.root
 	}
-	return value, err
+	if err != nil {
+		return nil, err
+	}
+	// 按 db 的 commitment 格式 把 叶子内容 还原成 value
+	return t.decodeLeaf(value)
 }
 
 
@@ -214,9 +234,11 @@ func (t *Trie) tryGet(origNode node, key []byte, pos int) (value []byte, newnode
 		}
 		value, newnode, didResolve, err = t.tryGet(n.Val, key, pos+len(n.Key))
 		if err == nil && didResolve {
+			t.untrack(n)
 			n = n.copy()			  	// 值拷贝, 因为需要变更 n 的一些字段
 			n.Val = newnode				// 在这里我们就看到了 传入 tryGet() 时的 n.Val 和 newnode 的关系了. 其实就是同一个 node  todo (因为 n.Val 之前可能是 hashNode, 而newnode 才是从 db 新load 的 node数据啊)
 			n.flags.gen = t.cachegen  	// 将 trie 的 cachegen 值 覆盖当前节点 n 上 (最终会影响 n 会不会继续留在 内存中)
+			t.track(n)
 		}
 		return value, n, didResolve, err
 
@@ -224,9 +246,11 @@ func (t *Trie) tryGet(origNode node, key []byte, pos int) (value []byte, newnode
 	case *fullNode:
 		value, newnode, didResolve, err = t.tryGet(n.Children[key[pos]], key, pos+1)
 		if err == nil && didResolve {
+			t.untrack(n)
 			n = n.copy()				// 值拷贝, 因为需要变更 n 的一些字段
 			n.flags.gen = t.cachegen 	// 将 trie 的 cachegen 值 覆盖当前节点 n 上 (最终会影响 n 会不会继续留在 内存中)
 			n.Children[key[pos]] = newnode	// 在这里我们就看到了 传入 tryGet() 时的 n.Val 和 newnode 的关系了. 其实就是同一个 node  todo (因为 n.Val 之前可能是 hashNode, 而newnode 才是从 db 新load 的 node数据啊)
+			t.track(n)
 		}
 		return value, n, didResolve, err
 
@@ -249,6 +273,9 @@ func (t *Trie) tryGet(origNode node, key []byte, pos int) (value []byte, newnode
 
 		// 根据 node 的 Hash 获取了 node, 然后进入继续的 递归
 		value, newnode, _, err := t.tryGet(child, key, pos)
+		if err == nil {
+			t.trackTree(child)
+		}
 		return value, newnode, true, err
 	default:
 		panic(fmt.Sprintf("%T: invalid node: %v", origNode, origNode))
@@ -282,8 +309,8 @@ func (t *Trie) TryUpdate(key, value []byte) error {
 	// todo trie的Update() 只有两种,  insert 和 delete
 	if len(value) != 0 {
 
-		// 将  k-v 插入 trie
-		_, n, err := t.insert(t.root, nil, k, valueNode(value))
+		// 将  k-v 插入 trie (叶子内容 按 db 的 commitment 格式 编码)
+		_, n, err := t.insert(t.root, nil, k, valueNode(t.encodeLeaf(value)))
 		if err != nil {
 			return err
 		}
@@ -353,7 +380,8 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 			}
 			// 新增返回的必是叶子结点
 			// 从这里可以看出，从根路径到插入数据的位置，整条路径的节点都会被重新实例化，node的dirty也被改为true，表示要重新更新
-			return true, &shortNode{n.Key, nn, t.newFlag()}, nil
+			t.untrack(n)
+			return true, t.tracked(&shortNode{n.Key, nn, t.newFlag()}), nil
 		}
 		// Otherwise branch out at the index where they differ.
 		//
@@ -383,13 +411,15 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 		// 如果该shortNode出现在索引0处，则将其替换为 full Node
 		//
 		// 即: 待插入数据和trie中当前节点的前缀key一个也没匹配，则返回 分支节点
+		t.untrack(n)
+		t.track(branch)
 		if matchlen == 0 {
 			return true, branch, nil
 		}
 		// Otherwise, replace it with a short node leading up to the branch.
 		//
 		// 否则，将其替换为 通向 新建 full Node 的 short Node    （hex 编码的 key）
-		return true, &shortNode{key[:matchlen], branch, t.newFlag()}, nil
+		return true, t.tracked(&shortNode{key[:matchlen], branch, t.newFlag()}), nil
 
 
 	// 当前的节点是fullNode(也就是branch节点)，那么直接往对应的孩子节点调用insert方法,然后把对应的孩子节点指向新生成的节点.
@@ -398,17 +428,18 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 		if !dirty || err != nil {
 			return false, n, err
 		}
+		t.untrack(n)
 		n = n.copy()
 		n.flags = t.newFlag() // 构建新的 nodeFlag, 其中 hash字段中的 hashNode 是nil的,只有在trie求Hash的时候才填充
 		n.Children[key[0]] = nn
-		return true, n, nil
+		return true, t.tracked(n), nil
 
 	// 节点类型是nil(一颗全新的Trie树的节点就是nil的),这个时候整颗树是空的，直接返回
 	//
 	 //  也就是说，在 空trie中添加一个节点，就是 叶子节点，返回shortNode
 	case nil:
 		// 所有一颗新的单节点树,跟节点就是 shortNode    （hex 编码的 key）
-		return true, &shortNode{key, value, t.newFlag()}, nil
+		return true, t.tracked(&shortNode{key, value, t.newFlag()}), nil
 
 	// 当前节点是hashNode, hashNode的意思是当前节点还没有加载到内存里面来，
 	// todo 还是存放在数据库里面，那么首先调用 t.resolveHash(n, prefix)来加载到内存，
@@ -433,6 +464,7 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 		if !dirty || err != nil {
 			return false, rn, err
 		}
+		t.trackTree(rn)
 		return true, nn, nil
 
 	default:
@@ -483,6 +515,7 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 		//
 		// 走到这一步,  基本上是返回到上级   ·full node 逻辑·, 或者是 ·上级 short node 的 下面的逻辑·
 		if matchlen == len(key) {
+			t.untrack(n)
 			return true, nil, nil // remove n entirely for whole matches   完全删除 n
 		}
 
@@ -514,13 +547,16 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 			// 使用concat（总是创建一个新的片）而不是追加，以避免修改n.Key，因为它可能与其他节点共享.
 			//
 			//  说白了, 就是原来的   short node 下级 有一个 分支节点 fullNode，那么返回的 full node 基本上不会是 nil   (看 full node 逻辑)
-			return true, &shortNode{concat(n.Key, child.Key...), child.Val, t.newFlag()}, nil
+			t.untrack(n)
+			t.untrack(child)
+			return true, t.tracked(&shortNode{concat(n.Key, child.Key...), child.Val, t.newFlag()}), nil
 		default:
 
 			// 否则, 根据查找到的  child， 构造一个新的 short node,
 			//
 			//  注意: 如果 当前 short node 的下级是 value node 的话. 那么 返回的是   nil
-			return true, &shortNode{n.Key, child, t.newFlag()}, nil
+			t.untrack(n)
+			return true, t.tracked(&shortNode{n.Key, child, t.newFlag()}), nil
 		}
 
 	case *fullNode:
@@ -535,6 +571,7 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 
 		// 找到了, 开始处理
 
+		t.untrack(n)
 		n = n.copy()				// 值拷贝
 		n.flags = t.newFlag()		// 初始化(清空) node Hash
 		n.Children[key[0]] = nn		// 基本上这里返回的 是一个 nil
@@ -588,20 +625,24 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 					return false, nil, err
 				}
 				if cnode, ok := cnode.(*shortNode); ok {
+					if _, ok := n.Children[pos].(hashNode); ok {
+						t.trackTree(cnode)
+					}
+					t.untrack(cnode)
 					k := append([]byte{byte(pos)}, cnode.Key...)
-					return true, &shortNode{k, cnode.Val, t.newFlag()}, nil
+					return true, t.tracked(&shortNode{k, cnode.Val, t.newFlag()}), nil
 				}
 			}
 			// Otherwise, n is replaced by a one-nibble short node
 			// containing the child.
 			//
 			// 否则，n将被 包含 该子节点的一个半字节  short节点替换
-			return true, &shortNode{[]byte{byte(pos)}, n.Children[pos], t.newFlag()}, nil
+			return true, t.tracked(&shortNode{[]byte{byte(pos)}, n.Children[pos], t.newFlag()}), nil
 		}
 		// n still contains at least two values and cannot be reduced.
 		//
 		// full node 仍然至少包含两个值，并且不能减少.
-		return true, n, nil
+		return true, t.tracked(n), nil
 
 	// 看了 short node 的逻辑后,  感觉是找不到  value node 的啊
 	case valueNode:
@@ -624,6 +665,7 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 		if !dirty || err != nil {
 			return false, rn, err
 		}
+		t.trackTree(rn)
 		return true, nn, nil
 
 	default:
@@ -653,9 +695,13 @@ func (t *Trie) resolveHash(n hashNode, prefix []byte) (node, error) {
 	cacheMissCounter.Inc(1)
 
 	hash := common.BytesToHash(n) // HexBytes  -> HexHash  （slice -> arr）
+	if t.onResolve != nil {
+		t.onResolve(prefix)
+	}
 
 	// 根据 hash 去 全局 node map 中找, 找不到再从  disk 找
 	if node := t.db.node(hash, t.cachegen); node != nil {    // todo 注意:  node 的 Hash 其实都是之前 使用 node.Key 做了 compact 编码之后的node 计算得到的
+		t.db.checkRefetch(hash)
 		return node, nil     // todo 在 t.db.node 里, 最终调 mustDecodeNode() 会做. 将 node.key 从 compact 编码转回 hex 编码
 	}
 	return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
@@ -684,6 +730,8 @@ func (t *Trie) Commit(onleaf LeafCallback) (root common.Hash, err error) {
 	if t.db == nil {
 		panic("commit called on trie with nil database")
 	}
+	// 非标准 commitment 格式时, 需要 挂上 叶子引用的 value blob, 并把 还原后的 value 交给 onleaf
+	onleaf = t.db.leafCallback(onleaf, t.leaves)
 
 	// TODO 写入部分操作,在这里
 	// hash: 节点折叠后的 hashNode
@@ -692,6 +740,7 @@ func (t *Trie) Commit(onleaf LeafCallback) (root common.Hash, err error) {
 	if err != nil {
 		return common.Hash{}, err
 	}
+	t.leaves = nil
 	t.root = cached // 返回的  cache 可能是  rootNode 也可能是 rootNode的hashNode (具体 看rootNode 是否近期都没变动过, 并满足了从 内存中 卸载的条件而定)
 	t.cachegen++   // 每次 提交树 的时候, trie 的 cachegen 计数都 +1
 	return common.BytesToHash(hash.(hashNode)), nil
@@ -708,8 +757,13 @@ func (t *Trie) hashRoot(db *Database, onleaf LeafCallback) (node, node, error) {
 	if t.root == nil {
 		return hashNode(emptyRoot.Bytes()), nil, nil
 	}
-	h := newHasher(t.cachegen, t.cachelimit, onleaf)  // 每次 算 root 的时候 都重新将 trie 的 cachegen 和 cachelimit 赋值给  hasher.  todo 用来决定 是否将对应的  node从 内存中 清除掉   (下面的 h.hash() 中会使用改到 这两个参数)
+	limit := t.cachelimit
+	if db != nil {
+		limit = t.cacheLimit()
+	}
+	h := newHasher(t.cachegen, limit, onleaf)  // 每次 算 root 的时候 都重新将 trie 的 cachegen 和 cachelimit 赋值给  hasher.  todo 用来决定 是否将对应的  node从 内存中 清除掉   (下面的 h.hash() 中会使用改到 这两个参数)
 	defer returnHasherToPool(h)
+	h.sizes = t.sizes
 
 	// 这里才是真正 折叠node   (将 node.key 从 hex 编码 转成 compact 编码)
 	// node: 节点折叠后的 hashNode